@@ -72,6 +72,10 @@ data object VpnPlugin : FlutterPlugin, MethodChannel.MethodCallHandler {
         scope.launch {
             registerNetworkCallback()
         }
+        Core.setProtector(
+            protect = this::protect,
+            resolverProcess = this::resolverProcess,
+        )
         flutterMethodChannel = MethodChannel(flutterPluginBinding.binaryMessenger, "vpn")
         flutterMethodChannel.setMethodCallHandler(this)
     }
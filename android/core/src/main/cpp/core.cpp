@@ -16,6 +16,13 @@ Java_com_follow_clash_core_Core_stopTun(JNIEnv *) {
     stopTun();
 }
 
+extern "C"
+JNIEXPORT void JNICALL
+Java_com_follow_clash_core_Core_setProtector(JNIEnv *env, jobject, jobject cb) {
+    const auto interface = new_global(cb);
+    setProtector(interface);
+}
+
 
 static jmethodID m_tun_interface_protect;
 static jmethodID m_tun_interface_resolve_process;
@@ -10,18 +10,21 @@ data object Core {
         cb: TunInterface
     )
 
+    private external fun setProtector(
+        cb: TunInterface
+    )
+
     private fun parseInetSocketAddress(address: String): InetSocketAddress {
         val url = URL("https://$address")
 
         return InetSocketAddress(InetAddress.getByName(url.host), url.port)
     }
 
-    fun startTun(
-        fd: Int,
+    private fun tunInterface(
         protect: (Int) -> Boolean,
         resolverProcess: (protocol: Int, source: InetSocketAddress, target: InetSocketAddress, uid: Int) -> String
-    ) {
-        startTun(fd, object : TunInterface {
+    ): TunInterface {
+        return object : TunInterface {
             override fun protect(fd: Int) {
                 protect(fd)
             }
@@ -39,7 +42,22 @@ data object Core {
                     uid,
                 )
             }
-        });
+        }
+    }
+
+    fun startTun(
+        fd: Int,
+        protect: (Int) -> Boolean,
+        resolverProcess: (protocol: Int, source: InetSocketAddress, target: InetSocketAddress, uid: Int) -> String
+    ) {
+        startTun(fd, tunInterface(protect, resolverProcess))
+    }
+
+    fun setProtector(
+        protect: (Int) -> Boolean,
+        resolverProcess: (protocol: Int, source: InetSocketAddress, target: InetSocketAddress, uid: Int) -> String
+    ) {
+        setProtector(tunInterface(protect, resolverProcess))
     }
 
     external fun stopTun()
@@ -2,6 +2,8 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"runtime/debug"
 )
 
 type Action struct {
@@ -16,6 +18,7 @@ type ActionResult struct {
 	Data   interface{} `json:"data"`
 	Code   int         `json:"code"`
 	Port   int64
+	reply  chan<- ActionResult
 }
 
 func (result ActionResult) Json() ([]byte, error) {
@@ -26,21 +29,72 @@ func (result ActionResult) Json() ([]byte, error) {
 func (result ActionResult) success(data interface{}) {
 	result.Code = 0
 	result.Data = data
-	result.send()
+	result.deliver()
 }
 
 func (result ActionResult) error(data interface{}) {
 	result.Code = -1
 	result.Data = data
+	result.deliver()
+}
+
+// deliver hands the result to a waiting in process caller, or sends it through the bridge
+func (result ActionResult) deliver() {
+	if result.reply != nil {
+		result.reply <- result
+		return
+	}
 	result.send()
 }
 
+// fromApp tells the actions of the app over the bridge from the ones of the remote peers, the grpc
+// clients and the users of the daemon socket
+func (result ActionResult) fromApp() bool {
+	return result.reply == nil && !daemonMode
+}
+
 func handleAction(action *Action, result ActionResult) {
+	defer func() {
+		if value := recover(); value != nil {
+			panicRecorder.Record("action "+string(action.Method), value, debug.Stack())
+			result.error(fmt.Sprintf("panic: %v", value))
+		}
+	}()
 	switch action.Method {
 	case initClashMethod:
 		paramsString := action.Data.(string)
 		result.success(handleInitClash(paramsString))
 		return
+	case initEncryptionMethod:
+		paramsString := action.Data.(string)
+		result.success(handleInitEncryption(paramsString))
+		return
+	case startSecureCleanupMethod:
+		paramsString := action.Data.(string)
+		result.success(handleStartSecureCleanup(paramsString))
+		return
+	case stopSecureCleanupMethod:
+		result.success(handleStopSecureCleanup())
+		return
+	case getSecureCleanupStatsMethod:
+		result.success(handleGetSecureCleanupStats())
+		return
+	case getSecureCapabilitiesMethod:
+		result.success(handleGetSecureMemoryCapabilities())
+		return
+	case setSecureCacheLimitsMethod:
+		paramsString := action.Data.(string)
+		result.success(handleSetSecureCacheLimits(paramsString))
+		return
+	case encryptSecretMethod:
+		value := action.Data.(string)
+		secret, err := handleEncryptSecret(value)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(secret)
+		return
 	case getIsInitMethod:
 		result.success(handleGetIsInit())
 		return
@@ -55,6 +109,19 @@ func handleAction(action *Action, result ActionResult) {
 		data := []byte(action.Data.(string))
 		result.success(handleValidateConfig(data))
 		return
+	case validateProfileMethod:
+		paramsString := action.Data.(string)
+		diagnostics, err := handleValidateProfile(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(diagnostics)
+		return
+	case validateProxiesMethod:
+		data := []byte(action.Data.(string))
+		result.success(handleValidateProxies(data))
+		return
 	case updateConfigMethod:
 		data := []byte(action.Data.(string))
 		result.success(handleUpdateConfig(data))
@@ -78,6 +145,34 @@ func handleAction(action *Action, result ActionResult) {
 	case getTotalTrafficMethod:
 		result.success(handleGetTotalTraffic())
 		return
+	case getTrafficByProcessMethod:
+		paramsString := action.Data.(string)
+		result.success(handleGetTrafficStats(ProcessTrafficDimension, paramsString))
+		return
+	case getTrafficByDomainMethod:
+		paramsString := action.Data.(string)
+		result.success(handleGetTrafficStats(DomainTrafficDimension, paramsString))
+		return
+	case getTrafficByUserMethod:
+		paramsString := action.Data.(string)
+		result.success(handleGetTrafficStats(UserTrafficDimension, paramsString))
+		return
+	case getTrafficHistoryMethod:
+		paramsString := action.Data.(string)
+		history, err := handleGetTrafficHistory(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(history)
+		return
+	case clearTrafficHistoryMethod:
+		result.success(handleClearTrafficHistory())
+		return
+	case setTrafficRetentionMethod:
+		days := action.Data.(string)
+		result.success(handleSetTrafficRetention(days))
+		return
 	case resetTrafficMethod:
 		handleResetTraffic()
 		result.success(true)
@@ -88,8 +183,39 @@ func handleAction(action *Action, result ActionResult) {
 			result.success(value)
 		})
 		return
+	case testDelayBatchMethod:
+		paramsString := action.Data.(string)
+		handleTestDelayBatch(paramsString, func(value string, err error) {
+			if err != nil {
+				result.error(err.Error())
+				return
+			}
+			result.success(value)
+		})
+		return
+	case cancelDelayBatchMethod:
+		token := action.Data.(string)
+		result.success(handleCancelDelayBatch(token))
+		return
+	case startFailoverMethod:
+		paramsString := action.Data.(string)
+		result.success(handleStartFailover(paramsString))
+		return
+	case stopFailoverMethod:
+		result.success(handleStopFailover())
+		return
+	case startURLTestScheduleMethod:
+		paramsString := action.Data.(string)
+		result.success(handleStartURLTestSchedule(paramsString))
+		return
+	case stopURLTestScheduleMethod:
+		result.success(handleStopURLTestSchedule())
+		return
+	case getURLTestScheduleMethod:
+		result.success(handleGetURLTestSchedule())
+		return
 	case getConnectionsMethod:
-		result.success(handleGetConnections())
+		result.success(handleGetConnections(result.reply == nil))
 		return
 	case closeConnectionsMethod:
 		result.success(handleCloseConnections())
@@ -106,6 +232,1277 @@ func handleAction(action *Action, result ActionResult) {
 		}
 		result.success(config)
 		return
+	case diffProfilesMethod:
+		paramsString := action.Data.(string)
+		diff, err := handleDiffProfiles(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(diff)
+		return
+	case updateProfileMethod:
+		paramsString := action.Data.(string)
+		handleUpdateProfile(paramsString, func(value string, err error) {
+			if err != nil {
+				result.error(err.Error())
+				return
+			}
+			result.success(value)
+		})
+		return
+	case setProfileOverrideMethod:
+		paramsString := action.Data.(string)
+		result.success(handleSetProfileOverride(paramsString))
+		return
+	case getProfileOverrideMethod:
+		profileId := action.Data.(string)
+		result.success(handleGetProfileOverride(profileId))
+		return
+	case getMergedProfileMethod:
+		profileId := action.Data.(string)
+		profile, err := handleGetMergedProfile(profileId)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(profile)
+		return
+	case setProfileScriptMethod:
+		paramsString := action.Data.(string)
+		result.success(handleSetProfileScript(paramsString))
+		return
+	case getProfileScriptMethod:
+		profileId := action.Data.(string)
+		result.success(handleGetProfileScript(profileId))
+		return
+	case testProfileScriptMethod:
+		paramsString := action.Data.(string)
+		profile, err := handleTestProfileScript(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(profile)
+		return
+	case startRuleProviderUpdateMethod:
+		paramsString := action.Data.(string)
+		result.success(handleStartRuleProviderUpdate(paramsString))
+		return
+	case stopRuleProviderUpdateMethod:
+		result.success(handleStopRuleProviderUpdate())
+		return
+	case updateRuleProviderMethod:
+		name := action.Data.(string)
+		handleUpdateRuleProvider(name, func(value string) {
+			result.success(value)
+		})
+		return
+	case getRuleProviderUpdatesMethod:
+		result.success(handleGetRuleProviderUpdates())
+		return
+	case updateGeoDatabaseMethod:
+		paramsString := action.Data.(string)
+		handleUpdateGeoDatabase(paramsString, func(value string, err error) {
+			if err != nil {
+				result.error(err.Error())
+				return
+			}
+			result.success(value)
+		})
+		return
+	case getGeoDatabaseVersionsMethod:
+		result.success(handleGetGeoDatabaseVersions())
+		return
+	case startDnsLogMethod:
+		handleStartDnsLog()
+		result.success(true)
+		return
+	case stopDnsLogMethod:
+		handleStopDnsLog()
+		result.success(true)
+		return
+	case getDnsLogMethod:
+		since := action.Data.(string)
+		result.success(handleGetDnsLog(since))
+		return
+	case clearDnsLogMethod:
+		result.success(handleClearDnsLog())
+		return
+	case setDnsLogCapacityMethod:
+		capacity := action.Data.(string)
+		result.success(handleSetDnsLogCapacity(capacity))
+		return
+	case startDnsHealthCheckMethod:
+		paramsString := action.Data.(string)
+		result.success(handleStartDnsHealthCheck(paramsString))
+		return
+	case stopDnsHealthCheckMethod:
+		result.success(handleStopDnsHealthCheck())
+		return
+	case getDnsStatusMethod:
+		result.success(handleGetDnsStatus())
+		return
+	case setFakeIpPersistenceMethod:
+		enabledString := action.Data.(string)
+		result.success(handleSetFakeIpPersistence(enabledString))
+		return
+	case flushFakeIpMethod:
+		err := handleFlushFakeIp()
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case setDnsCacheMethod:
+		paramsString := action.Data.(string)
+		err := handleSetDnsCache(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getDnsCacheStatsMethod:
+		result.success(handleGetDnsCacheStats())
+		return
+	case purgeDnsCacheMethod:
+		domain := action.Data.(string)
+		result.success(handlePurgeDnsCache(domain))
+		return
+	case addInboundUserMethod:
+		paramsString := action.Data.(string)
+		err := handleAddInboundUser(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case removeInboundUserMethod:
+		username := action.Data.(string)
+		result.success(handleRemoveInboundUser(username))
+		return
+	case getInboundUsersMethod:
+		result.success(handleGetInboundUsers())
+		return
+	case setLanAclMethod:
+		paramsString := action.Data.(string)
+		err := handleSetLanAcl(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getLanAclMethod:
+		result.success(handleGetLanAcl())
+		return
+	case addLanAclEntryMethod:
+		paramsString := action.Data.(string)
+		err := handleAddLanAclEntry(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case removeLanAclEntryMethod:
+		paramsString := action.Data.(string)
+		result.success(handleRemoveLanAclEntry(paramsString))
+		return
+	case getLanAclLogMethod:
+		result.success(handleGetLanAclLog())
+		return
+	case clearLanAclLogMethod:
+		result.success(handleClearLanAclLog())
+		return
+	case benchmarkTunMethod:
+		paramsString := action.Data.(string)
+		handleBenchmarkTun(paramsString, func(value string, err error) {
+			if err != nil {
+				result.error(err.Error())
+				return
+			}
+			result.success(value)
+		})
+		return
+	case setTunStackMethod:
+		stack := action.Data.(string)
+		err := handleSetTunStack(stack)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getTunStackMethod:
+		result.success(handleGetTunStack())
+		return
+	case getTunStatusMethod:
+		result.success(handleGetTunStatus())
+		return
+	case setSplitTunnelMethod:
+		paramsString := action.Data.(string)
+		err := handleSetSplitTunnel(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case addSplitTunnelCidrMethod:
+		cidr := action.Data.(string)
+		err := handleAddSplitTunnelCidr(cidr)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case removeSplitTunnelCidrMethod:
+		cidr := action.Data.(string)
+		result.success(handleRemoveSplitTunnelCidr(cidr))
+		return
+	case getSplitTunnelMethod:
+		result.success(handleGetSplitTunnel())
+		return
+	case inspectConnectionsMethod:
+		result.success(handleInspectConnections())
+		return
+	case inspectConnectionMethod:
+		id := action.Data.(string)
+		result.success(handleInspectConnection(id))
+		return
+	case closeConnectionsByProxyMethod:
+		name := action.Data.(string)
+		result.success(handleCloseConnectionsByProxy(name))
+		return
+	case pinConnectionMethod:
+		id := action.Data.(string)
+		result.success(handlePinConnection(id))
+		return
+	case unpinConnectionMethod:
+		id := action.Data.(string)
+		result.success(handleUnpinConnection(id))
+		return
+	case setRateLimitMethod:
+		paramsString := action.Data.(string)
+		err := handleSetRateLimit(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getRateLimitsMethod:
+		result.success(handleGetRateLimits())
+		return
+	case setQuotaMethod:
+		paramsString := action.Data.(string)
+		err := handleSetQuota(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case removeQuotaMethod:
+		id := action.Data.(string)
+		result.success(handleRemoveQuota(id))
+		return
+	case resetQuotaMethod:
+		id := action.Data.(string)
+		result.success(handleResetQuota(id))
+		return
+	case getQuotaStatusMethod:
+		result.success(handleGetQuotaStatus())
+		return
+	case getLogsMethod:
+		paramsString := action.Data.(string)
+		result.success(handleGetLogs(paramsString))
+		return
+	case setModuleLogLevelMethod:
+		paramsString := action.Data.(string)
+		err := handleSetModuleLogLevel(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getLogLevelsMethod:
+		result.success(handleGetLogLevels())
+		return
+	case setLogFileMethod:
+		paramsString := action.Data.(string)
+		err := handleSetLogFile(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getLogFileMethod:
+		result.success(handleGetLogFile())
+		return
+	case exportLogsMethod:
+		data, err := handleExportLogs()
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(data)
+		return
+	case clearLogsMethod:
+		err := handleClearLogs()
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case setLogCapacityMethod:
+		capacity := action.Data.(string)
+		result.success(handleSetLogCapacity(capacity))
+		return
+	case exportDiagnosticsMethod:
+		paramsString := action.Data.(string)
+		result.success(handleExportDiagnostics(paramsString))
+		return
+	case clearPanicsMethod:
+		result.success(handleClearPanics())
+		return
+	case setExternalControllerMethod:
+		paramsString := action.Data.(string)
+		err := handleSetExternalController(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getExternalControllerMethod:
+		result.success(handleGetExternalController())
+		return
+	case startGrpcServerMethod:
+		paramsString := action.Data.(string)
+		err := handleStartGrpcServer(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case stopGrpcServerMethod:
+		result.success(handleStopGrpcServer())
+		return
+	case getGrpcServerMethod:
+		result.success(handleGetGrpcServer())
+		return
+	case subscribeEventsMethod:
+		paramsString := action.Data.(string)
+		data, err := handleSubscribeEvents(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(data)
+		return
+	case unsubscribeEventsMethod:
+		id := action.Data.(string)
+		result.success(handleUnsubscribeEvents(id))
+		return
+	case ackEventsMethod:
+		paramsString := action.Data.(string)
+		err := handleAckEvents(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case replayEventsMethod:
+		paramsString := action.Data.(string)
+		data, err := handleReplayEvents(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(data)
+		return
+	case getEventStreamsMethod:
+		result.success(handleGetEventStreams())
+		return
+	case importProfileMethod:
+		paramsString := action.Data.(string)
+		data, err := handleImportProfile(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(data)
+		return
+	case exportProfileMethod:
+		paramsString := action.Data.(string)
+		data, err := handleExportProfile(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(data)
+		return
+	case backupAllMethod:
+		paramsString := action.Data.(string)
+		data, err := handleBackupAll(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(data)
+		return
+	case restoreAllMethod:
+		paramsString := action.Data.(string)
+		data, err := handleRestoreAll(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(data)
+		return
+	case setSyncMethod:
+		paramsString := action.Data.(string)
+		err := handleSetSync(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case syncNowMethod:
+		resolve := action.Data.(string)
+		err := handleSyncNow(resolve)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(handleGetSyncStatus())
+		return
+	case getSyncStatusMethod:
+		result.success(handleGetSyncStatus())
+		return
+	case setGroupStatePersistenceMethod:
+		enabled := action.Data.(string)
+		result.success(handleSetGroupStatePersistence(enabled))
+		return
+	case getGroupStateMethod:
+		profileId := action.Data.(string)
+		result.success(handleGetGroupState(profileId))
+		return
+	case clearGroupStateMethod:
+		profileId := action.Data.(string)
+		result.success(handleClearGroupState(profileId))
+		return
+	case setRoutingModeMethod:
+		paramsString := action.Data.(string)
+		err := handleSetRoutingMode(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getRoutingModeMethod:
+		result.success(handleGetRoutingMode())
+		return
+	case setSniffingMethod:
+		paramsString := action.Data.(string)
+		err := handleSetSniffing(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getSniffStatsMethod:
+		result.success(handleGetSniffStats())
+		return
+	case getHttpRewriteStatsMethod:
+		result.success(handleGetHttpRewriteStats())
+		return
+	case setUdpOverTcpMethod:
+		paramsString := action.Data.(string)
+		err := handleSetUdpOverTcp(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getUdpOverTcpMethod:
+		result.success(handleGetUdpOverTcp())
+		return
+	case setDialRacingMethod:
+		paramsString := action.Data.(string)
+		err := handleSetDialRacing(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getDialRacingMethod:
+		result.success(handleGetDialRacing())
+		return
+	case setTcpOptionsMethod:
+		paramsString := action.Data.(string)
+		result.success(handleSetTcpOptions(paramsString))
+		return
+	case getTcpOptionsMethod:
+		result.success(handleGetTcpOptions())
+		return
+	case setConnectionTuningMethod:
+		paramsString := action.Data.(string)
+		err := handleSetConnectionTuning(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getSocketOptionsMethod:
+		result.success(handleGetSocketOptions())
+		return
+	case setPowerModeMethod:
+		mode := action.Data.(string)
+		err := handleSetPowerMode(mode)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getPowerModeMethod:
+		result.success(handleGetPowerMode())
+		return
+	case trimMemoryMethod:
+		pressure := action.Data.(string)
+		data, err := handleTrimMemory(pressure)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(data)
+		return
+	case setMemoryPolicyMethod:
+		paramsString := action.Data.(string)
+		err := handleSetMemoryPolicy(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getMemoryStatsMethod:
+		result.success(handleGetMemoryStats())
+		return
+	case benchmarkRelayMethod:
+		paramsString := action.Data.(string)
+		handleBenchmarkRelay(paramsString, func(value string, err error) {
+			if err != nil {
+				result.error(err.Error())
+				return
+			}
+			result.success(value)
+		})
+		return
+	case startCoreMethod:
+		data := []byte(action.Data.(string))
+		result.success(handleStartCore(data))
+		return
+	case getStartupStatusMethod:
+		result.success(handleGetStartupStatus())
+		return
+	case setProfileCacheMethod:
+		paramsString := action.Data.(string)
+		result.success(handleSetProfileCache(paramsString))
+		return
+	case getProfileCacheMethod:
+		result.success(handleGetProfileCache())
+		return
+	case clearProfileCacheMethod:
+		err := handleClearProfileCache()
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case setDomainMatcherMethod:
+		paramsString := action.Data.(string)
+		result.success(handleSetDomainMatcher(paramsString))
+		return
+	case benchmarkRuleMatchMethod:
+		paramsString := action.Data.(string)
+		value, err := handleBenchmarkRuleMatch(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(value)
+		return
+	case explainRouteMethod:
+		paramsString := action.Data.(string)
+		value, err := handleExplainRoute(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(value)
+		return
+	case simulateRulesMethod:
+		paramsString := action.Data.(string)
+		value, err := handleSimulateRules(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(value)
+		return
+	case getProvidersHealthMethod:
+		result.success(handleGetProvidersHealth())
+		return
+	case forceUpdateProviderMethod:
+		providerName := action.Data.(string)
+		handleForceUpdateProvider(providerName, func(value string, err error) {
+			if err != nil {
+				result.error(err.Error())
+				return
+			}
+			result.success(value)
+		})
+		return
+	case setSubscriptionAlertsMethod:
+		paramsString := action.Data.(string)
+		result.success(handleSetSubscriptionAlerts(paramsString))
+		return
+	case getSubscriptionUsageMethod:
+		profileId := action.Data.(string)
+		result.success(handleGetSubscriptionUsage(profileId))
+		return
+	case setProxyChainMethod:
+		paramsString := action.Data.(string)
+		value, err := handleSetProxyChain(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(value)
+		return
+	case getProxyChainsMethod:
+		result.success(handleGetProxyChains())
+		return
+	case testProxyChainMethod:
+		paramsString := action.Data.(string)
+		handleTestProxyChain(paramsString, func(value string, err error) {
+			if err != nil {
+				result.error(err.Error())
+				return
+			}
+			result.success(value)
+		})
+		return
+	case setLoadBalanceMethod:
+		paramsString := action.Data.(string)
+		err := handleSetLoadBalance(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getLoadBalanceMethod:
+		result.success(handleGetLoadBalance())
+		return
+	case setSmartGroupMethod:
+		paramsString := action.Data.(string)
+		if err := handleSetSmartGroup(paramsString); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getSmartGroupsMethod:
+		result.success(handleGetSmartGroups())
+		return
+	case setGeofenceMethod:
+		paramsString := action.Data.(string)
+		if err := handleSetGeofence(paramsString); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getGeofenceMethod:
+		result.success(handleGetGeofence())
+		return
+	case setGroupFilterMethod:
+		paramsString := action.Data.(string)
+		if err := handleSetGroupFilter(paramsString); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getGroupFiltersMethod:
+		result.success(handleGetGroupFilters())
+		return
+	case getCertPinsMethod:
+		result.success(handleGetCertPins())
+		return
+	case probeCertificatesMethod:
+		paramsString := action.Data.(string)
+		handleProbeCertificates(paramsString, func(value string, err error) {
+			if err != nil {
+				result.error(err.Error())
+				return
+			}
+			result.success(value)
+		})
+		return
+	case setFingerprintMethod:
+		paramsString := action.Data.(string)
+		if err := handleSetFingerprint(paramsString); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getFingerprintsMethod:
+		result.success(handleGetFingerprints())
+		return
+	case getEchStatusMethod:
+		result.success(handleGetEchStatus())
+		return
+	case getRealityStatusMethod:
+		result.success(handleGetRealityStatus())
+		return
+	case getObfsTransportsMethod:
+		result.success(handleGetObfsTransports())
+		return
+	case generateTransparentRulesMethod:
+		paramsString := action.Data.(string)
+		rules, err := handleGenerateTransparentRules(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(rules)
+		return
+	case getTransparentProxyMethod:
+		result.success(handleGetTransparentProxyStatus())
+		return
+	case addForwardMethod:
+		paramsString := action.Data.(string)
+		if err := handleAddForward(paramsString); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case removeForwardMethod:
+		id := action.Data.(string)
+		result.success(handleRemoveForward(id))
+		return
+	case listForwardsMethod:
+		result.success(handleListForwards())
+		return
+	case setShareServerMethod:
+		paramsString := action.Data.(string)
+		if err := handleSetShareServer(paramsString); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getShareServerMethod:
+		result.success(handleGetShareServer())
+		return
+	case generatePacMethod:
+		paramsString := action.Data.(string)
+		pac, err := handleGeneratePac(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(pac)
+		return
+	case setSystemProxyMethod:
+		paramsString := action.Data.(string)
+		if err := handleSetSystemProxy(paramsString); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getSystemProxyMethod:
+		result.success(handleGetSystemProxy())
+		return
+	case installServiceMethod:
+		paramsString := action.Data.(string)
+		if err := handleInstallService(paramsString); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case uninstallServiceMethod:
+		if err := handleUninstallService(); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case startServiceMethod:
+		if err := handleStartService(); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case stopServiceMethod:
+		if err := handleStopService(); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getServiceStatusMethod:
+		result.success(handleGetServiceStatus())
+		return
+	case setTunHelperMethod:
+		paramsString := action.Data.(string)
+		if err := handleSetTunHelper(paramsString); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getTunHelperMethod:
+		result.success(handleGetTunHelper())
+		return
+	case installTunHelperMethod:
+		paramsString := action.Data.(string)
+		if err := handleInstallTunHelper(paramsString); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case uninstallTunHelperMethod:
+		if err := handleUninstallTunHelper(); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case setNetworkMonitorMethod:
+		paramsString := action.Data.(string)
+		if err := handleSetNetworkMonitor(paramsString); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getNetworkMonitorMethod:
+		result.success(handleGetNetworkMonitor())
+		return
+	case notifyNetworkChangedMethod:
+		source, _ := action.Data.(string)
+		handleNotifyNetworkChanged(source)
+		result.success(true)
+		return
+	case setInterfaceBindingsMethod:
+		paramsString := action.Data.(string)
+		if err := handleSetInterfaceBindings(paramsString); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getInterfaceBindingsMethod:
+		result.success(handleGetInterfaceBindings())
+		return
+	case setCaptivePortalMethod:
+		paramsString := action.Data.(string)
+		if err := handleSetCaptivePortal(paramsString); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getCaptivePortalMethod:
+		result.success(handleGetCaptivePortal())
+		return
+	case probeCaptivePortalMethod:
+		handleProbeCaptivePortal()
+		result.success(true)
+		return
+	case setKillSwitchMethod:
+		paramsString := action.Data.(string)
+		if err := handleSetKillSwitch(paramsString); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getKillSwitchMethod:
+		result.success(handleGetKillSwitch())
+		return
+	case setDnsGuardMethod:
+		paramsString := action.Data.(string)
+		if err := handleSetDnsGuard(paramsString); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case setAutomationMethod:
+		paramsString := action.Data.(string)
+		if err := handleSetAutomation(paramsString); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getAutomationMethod:
+		result.success(handleGetAutomation())
+		return
+	case setNetworkContextMethod:
+		paramsString := action.Data.(string)
+		if err := handleSetNetworkContext(paramsString); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case evaluateAutomationMethod:
+		paramsString := action.Data.(string)
+		data, err := handleEvaluateAutomation(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(data)
+		return
+	case setTriggerMethod:
+		paramsString := action.Data.(string)
+		if err := handleSetTrigger(paramsString, result.fromApp()); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case removeTriggerMethod:
+		id := action.Data.(string)
+		result.success(handleRemoveTrigger(id))
+		return
+	case getTriggersMethod:
+		result.success(handleGetTriggers())
+		return
+	case testTriggerMethod:
+		id := action.Data.(string)
+		if err := handleTestTrigger(id); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case setRemoteHostMethod:
+		paramsString := action.Data.(string)
+		if err := handleSetRemoteHost(paramsString); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getRemoteMethod:
+		result.success(handleGetRemote())
+		return
+	case startRemotePairingMethod:
+		paramsString := action.Data.(string)
+		data, err := handleStartRemotePairing(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(data)
+		return
+	case pairRemoteMethod:
+		paramsString := action.Data.(string)
+		data, err := handlePairRemote(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(data)
+		return
+	case invokeRemoteMethod:
+		paramsString := action.Data.(string)
+		data, err := handleInvokeRemote(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(data)
+		return
+	case watchRemoteMethod:
+		fingerprint := action.Data.(string)
+		if err := handleWatchRemote(fingerprint); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case unwatchRemoteMethod:
+		fingerprint := action.Data.(string)
+		handleUnwatchRemote(fingerprint)
+		result.success(true)
+		return
+	case removeRemotePeerMethod:
+		paramsString := action.Data.(string)
+		data, err := handleRemoveRemotePeer(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(data)
+		return
+	case setDiscoveryMethod:
+		paramsString := action.Data.(string)
+		if err := handleSetDiscovery(paramsString); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getDiscoveryMethod:
+		result.success(handleGetDiscovery())
+		return
+	case createControllerTokenMethod:
+		paramsString := action.Data.(string)
+		data, err := handleCreateControllerToken(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(data)
+		return
+	case rotateControllerTokenMethod:
+		id := action.Data.(string)
+		data, err := handleRotateControllerToken(id)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(data)
+		return
+	case revokeControllerTokenMethod:
+		id := action.Data.(string)
+		result.success(handleRevokeControllerToken(id))
+		return
+	case getControllerTokenMethod:
+		id := action.Data.(string)
+		data, err := handleGetControllerToken(id)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(data)
+		return
+	case getControllerTokensMethod:
+		result.success(handleGetControllerTokens())
+		return
+	case getControllerTlsMethod:
+		result.success(handleGetControllerTls())
+		return
+	case regenerateControllerTlsMethod:
+		if err := handleRegenerateControllerTls(); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case setBridgeEncodingMethod:
+		paramsString := action.Data.(string)
+		if err := handleSetBridgeEncoding(paramsString); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getBridgeEncodingMethod:
+		result.success(handleGetBridgeEncoding())
+		return
+	case subscribeConnectionsMethod:
+		paramsString := action.Data.(string)
+		data, err := handleSubscribeConnections(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(data)
+		return
+	case updateConnectionsMethod:
+		paramsString := action.Data.(string)
+		if err := handleUpdateConnectionsSubscription(paramsString); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case resyncConnectionsMethod:
+		id := action.Data.(string)
+		if err := handleResyncConnections(id); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case unsubscribeConnectionsMethod:
+		id := action.Data.(string)
+		result.success(handleUnsubscribeConnections(id))
+		return
+	case setTemplateVariableMethod:
+		paramsString := action.Data.(string)
+		if err := handleSetTemplateVariable(paramsString); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case removeTemplateVariableMethod:
+		paramsString := action.Data.(string)
+		removed, err := handleRemoveTemplateVariable(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(removed)
+		return
+	case getTemplateVariablesMethod:
+		result.success(handleGetTemplateVariables())
+		return
+	case previewTemplateMethod:
+		paramsString := action.Data.(string)
+		data, err := handlePreviewTemplate(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(data)
+		return
+	case setTemplateProfileMethod:
+		paramsString := action.Data.(string)
+		if err := handleSetTemplateProfile(paramsString); err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(true)
+		return
+	case getTemplateProfilesMethod:
+		result.success(handleGetTemplateProfiles())
+		return
+	case storeSecretMethod:
+		paramsString := action.Data.(string)
+		data, err := handleStoreSecret(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(data)
+		return
+	case getSecretRefMethod:
+		name := action.Data.(string)
+		data, err := handleGetSecretRef(name)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(data)
+		return
+	case deleteSecretMethod:
+		name := action.Data.(string)
+		deleted, err := handleDeleteSecret(name)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(deleted)
+		return
+	case getSecretsMethod:
+		result.success(handleGetSecrets())
+		return
+	case createInstanceMethod:
+		paramsString := action.Data.(string)
+		result.success(handleCreateInstance(paramsString))
+		return
+	case startInstanceMethod:
+		paramsString := action.Data.(string)
+		handleStartInstance(paramsString, func(value string) {
+			result.success(value)
+		})
+		return
+	case stopInstanceMethod:
+		id := action.Data.(string)
+		result.success(handleStopInstance(id))
+		return
+	case removeInstanceMethod:
+		id := action.Data.(string)
+		result.success(handleRemoveInstance(id))
+		return
+	case invokeInstanceMethod:
+		paramsString := action.Data.(string)
+		handleInvokeInstance(paramsString, func(value string, err error) {
+			if err != nil {
+				result.error(err.Error())
+				return
+			}
+			result.success(value)
+		})
+		return
+	case getInstancesMethod:
+		result.success(handleGetInstances())
+		return
+	case patchRulesMethod:
+		paramsString := action.Data.(string)
+		rules, err := handlePatchRules(paramsString)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(rules)
+		return
+	case getRulesMethod:
+		result.success(handleGetRules())
+		return
+	case setAppFilterMethod:
+		paramsString := action.Data.(string)
+		result.success(handleSetAppFilter(paramsString))
+		return
+	case getAppFilterMethod:
+		result.success(handleGetAppFilter())
+		return
+	case getWireGuardStatusMethod:
+		name := action.Data.(string)
+		status, err := handleGetWireGuardStatus(name)
+		if err != nil {
+			result.error(err.Error())
+			return
+		}
+		result.success(status)
+		return
 	case closeConnectionMethod:
 		id := action.Data.(string)
 		result.success(handleCloseConnection(id))
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type AppFilterMode string
+
+const (
+	OffAppFilterMode   AppFilterMode = "off"
+	AllowAppFilterMode AppFilterMode = "allow"
+	DenyAppFilterMode  AppFilterMode = "deny"
+)
+
+// AppFilter lists apps by package name on android or by process name or path on desktop
+type AppFilter struct {
+	Mode AppFilterMode `json:"mode"`
+	Apps []string      `json:"apps"`
+}
+
+var (
+	appFilter = AppFilter{Mode: OffAppFilterMode}
+
+	// PACKAGE-NAME matches the process name, which the android resolver fills with the package name
+	packageRulePattern = regexp.MustCompile(`(?i)(^|[(,]\s*)PACKAGE-NAME\s*,`)
+)
+
+// rewritePackageRule maps PACKAGE-NAME, also nested in logic rules, to PROCESS-NAME
+func rewritePackageRule(line string) string {
+	return packageRulePattern.ReplaceAllString(line, "${1}PROCESS-NAME,")
+}
+
+func rewritePackageRules(lines []string) []string {
+	rewritten := make([]string, len(lines))
+	for i, line := range lines {
+		rewritten[i] = rewritePackageRule(line)
+	}
+	return rewritten
+}
+
+func appMatcher(app string) string {
+	if strings.ContainsAny(app, `/\`) {
+		return "PROCESS-PATH," + app
+	}
+	return "PROCESS-NAME," + app
+}
+
+// appFilterRules are placed in front of the profile rules while a filter is active
+func appFilterRules(filter AppFilter) []string {
+	if len(filter.Apps) == 0 {
+		return nil
+	}
+	switch filter.Mode {
+	case DenyAppFilterMode:
+		rules := make([]string, 0, len(filter.Apps))
+		for _, app := range filter.Apps {
+			rules = append(rules, appMatcher(app)+",DIRECT")
+		}
+		return rules
+	case AllowAppFilterMode:
+		matchers := make([]string, 0, len(filter.Apps))
+		for _, app := range filter.Apps {
+			matchers = append(matchers, "("+appMatcher(app)+")")
+		}
+		if len(matchers) == 1 {
+			return []string{fmt.Sprintf("NOT,(%s),DIRECT", matchers[0])}
+		}
+		return []string{fmt.Sprintf("NOT,((OR,(%s))),DIRECT", strings.Join(matchers, ","))}
+	default:
+		return nil
+	}
+}
+
+// SetAppFilter replaces the app filter and reapplies the running rules
+func SetAppFilter(filter AppFilter) error {
+	switch filter.Mode {
+	case OffAppFilterMode, AllowAppFilterMode, DenyAppFilterMode:
+	case "":
+		filter.Mode = OffAppFilterMode
+	default:
+		return fmt.Errorf("unknown app filter mode %s", filter.Mode)
+	}
+	apps := make([]string, 0, len(filter.Apps))
+	for _, app := range filter.Apps {
+		app = strings.TrimSpace(app)
+		if app == "" || strings.ContainsAny(app, ",()") {
+			continue
+		}
+		apps = append(apps, app)
+	}
+	filter.Apps = apps
+
+	runLock.Lock()
+	defer runLock.Unlock()
+	previous := appFilter
+	appFilter = filter
+	if currentConfig == nil {
+		return nil
+	}
+	if err := applyRulesLocked(currentRules); err != nil {
+		appFilter = previous
+		return err
+	}
+	return nil
+}
+
+func handleSetAppFilter(paramsString string) string {
+	var filter = AppFilter{}
+	if err := json.Unmarshal([]byte(paramsString), &filter); err != nil {
+		return err.Error()
+	}
+	if err := SetAppFilter(filter); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func handleGetAppFilter() string {
+	runLock.Lock()
+	defer runLock.Unlock()
+	data, err := json.Marshal(appFilter)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	"strings"
+	"sync"
+	"time"
+)
+
+const automationInterval = time.Minute
+
+type NetworkKind string
+
+const (
+	WifiNetworkKind     NetworkKind = "wifi"
+	CellularNetworkKind NetworkKind = "cellular"
+	EthernetNetworkKind NetworkKind = "ethernet"
+	NoneNetworkKind     NetworkKind = "none"
+)
+
+var automationDays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// NetworkContext is reported by the app, the core cannot read the ssid on any platform
+type NetworkContext struct {
+	Kind NetworkKind `json:"kind"`
+	Ssid string      `json:"ssid"`
+}
+
+// AutomationCondition matches when every field set matches, an empty condition always does
+type AutomationCondition struct {
+	Days []string `json:"days"`
+	// From and To are local times as 15:04, a window past midnight wraps
+	From    string        `json:"from"`
+	To      string        `json:"to"`
+	Ssids   []string      `json:"ssids"`
+	Network []NetworkKind `json:"network"`
+}
+
+type AutomationAction struct {
+	Profile string             `json:"profile,omitempty"`
+	Mode    *tunnel.TunnelMode `json:"mode,omitempty"`
+}
+
+type AutomationRule struct {
+	Name string              `json:"name"`
+	When AutomationCondition `json:"when"`
+	AutomationAction
+}
+
+// AutomationParams are evaluated top down, the first matching rule wins and Default applies when
+// none does, nothing is done while the winner stays the same so manual switches are kept
+type AutomationParams struct {
+	Enable  bool              `json:"enable"`
+	Rules   []*AutomationRule `json:"rules"`
+	Default *AutomationAction `json:"default"`
+}
+
+type AutomationEvaluateParams struct {
+	// Time is unix milliseconds, zero is now
+	Time    int64           `json:"time"`
+	Network *NetworkContext `json:"network"`
+}
+
+type AutomationDecision struct {
+	Rule    string             `json:"rule"`
+	Profile string             `json:"profile,omitempty"`
+	Mode    *tunnel.TunnelMode `json:"mode,omitempty"`
+	Reason  string             `json:"reason"`
+	Time    int64              `json:"time"`
+	Network NetworkContext     `json:"network"`
+	// Applied is false for a dry run and for a decision already in place
+	Applied bool `json:"applied"`
+}
+
+type AutomationStatus struct {
+	AutomationParams
+	Network NetworkContext      `json:"network"`
+	Profile string              `json:"profile"`
+	Last    *AutomationDecision `json:"last,omitempty"`
+}
+
+type automationWindow struct {
+	days     map[time.Weekday]struct{}
+	from, to int
+	timed    bool
+}
+
+type compiledAutomationRule struct {
+	*AutomationRule
+	window automationWindow
+	ssids  map[string]struct{}
+	kinds  map[NetworkKind]struct{}
+}
+
+// Automation switches the mode itself and asks the app to switch the profile, the profiles are
+// stored by the app
+type Automation struct {
+	mutex   sync.Mutex
+	params  AutomationParams
+	rules   []*compiledAutomationRule
+	network NetworkContext
+	profile string
+	winner  string
+	last    *AutomationDecision
+	cancel  context.CancelFunc
+}
+
+var automation = &Automation{}
+
+func parseClock(value string) (int, error) {
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("time %s is not 15:04", value)
+	}
+	return clock.Hour()*60 + clock.Minute(), nil
+}
+
+func compileAutomationRule(rule *AutomationRule) (*compiledAutomationRule, error) {
+	if rule.Profile == "" && rule.Mode == nil {
+		return nil, fmt.Errorf("rule %s switches nothing", rule.Name)
+	}
+	compiled := &compiledAutomationRule{AutomationRule: rule}
+	if len(rule.When.Days) > 0 {
+		compiled.window.days = map[time.Weekday]struct{}{}
+		for _, day := range rule.When.Days {
+			key := strings.ToLower(day)
+			if len(key) > 3 {
+				key = key[:3]
+			}
+			weekday, ok := automationDays[key]
+			if !ok {
+				return nil, fmt.Errorf("rule %s: unknown day %s", rule.Name, day)
+			}
+			compiled.window.days[weekday] = struct{}{}
+		}
+	}
+	if rule.When.From != "" || rule.When.To != "" {
+		if rule.When.From == "" || rule.When.To == "" {
+			return nil, fmt.Errorf("rule %s needs both from and to", rule.Name)
+		}
+		var err error
+		if compiled.window.from, err = parseClock(rule.When.From); err != nil {
+			return nil, fmt.Errorf("rule %s: %v", rule.Name, err)
+		}
+		if compiled.window.to, err = parseClock(rule.When.To); err != nil {
+			return nil, fmt.Errorf("rule %s: %v", rule.Name, err)
+		}
+		compiled.window.timed = true
+	}
+	if len(rule.When.Ssids) > 0 {
+		compiled.ssids = map[string]struct{}{}
+		for _, ssid := range rule.When.Ssids {
+			compiled.ssids[ssid] = struct{}{}
+		}
+	}
+	if len(rule.When.Network) > 0 {
+		compiled.kinds = map[NetworkKind]struct{}{}
+		for _, kind := range rule.When.Network {
+			compiled.kinds[kind] = struct{}{}
+		}
+	}
+	return compiled, nil
+}
+
+// contains tells a time of the window, the day of a window past midnight is the day it started
+func (w *automationWindow) contains(now time.Time) bool {
+	minute := now.Hour()*60 + now.Minute()
+	day := now.Weekday()
+	if w.timed {
+		switch {
+		case w.from <= w.to:
+			if minute < w.from || minute >= w.to {
+				return false
+			}
+		case minute >= w.from:
+		case minute < w.to:
+			day = (day + 6) % 7
+		default:
+			return false
+		}
+	}
+	if w.days != nil {
+		if _, ok := w.days[day]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *compiledAutomationRule) match(now time.Time, network NetworkContext) (bool, string) {
+	if !r.window.contains(now) {
+		return false, ""
+	}
+	var reasons []string
+	if r.window.timed || r.window.days != nil {
+		reasons = append(reasons, "schedule")
+	}
+	if r.kinds != nil {
+		if _, ok := r.kinds[network.Kind]; !ok {
+			return false, ""
+		}
+		reasons = append(reasons, "network "+string(network.Kind))
+	}
+	if r.ssids != nil {
+		if _, ok := r.ssids[network.Ssid]; !ok || network.Kind == CellularNetworkKind {
+			return false, ""
+		}
+		reasons = append(reasons, "ssid "+network.Ssid)
+	}
+	if len(reasons) == 0 {
+		reasons = append(reasons, "always")
+	}
+	return true, strings.Join(reasons, ", ")
+}
+
+func (a *Automation) Set(params *AutomationParams) error {
+	rules := make([]*compiledAutomationRule, 0, len(params.Rules))
+	names := map[string]struct{}{}
+	for i, rule := range params.Rules {
+		if rule == nil {
+			continue
+		}
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		if _, ok := names[rule.Name]; ok {
+			return fmt.Errorf("rule %s is defined twice", rule.Name)
+		}
+		names[rule.Name] = struct{}{}
+		compiled, err := compileAutomationRule(rule)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, compiled)
+	}
+	if params.Default != nil && params.Default.Profile == "" && params.Default.Mode == nil {
+		return errors.New("the default switches nothing")
+	}
+	a.mutex.Lock()
+	a.params = *params
+	a.rules = rules
+	a.winner = ""
+	a.mutex.Unlock()
+	a.Resume()
+	return nil
+}
+
+func (a *Automation) Resume() {
+	a.Stop()
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if !a.params.Enable {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	a.cancel = cancel
+	go func() {
+		for {
+			runGuarded("automation", a.run)
+			// wake on the minute, the windows are minutes
+			now := time.Now()
+			wait := now.Truncate(automationInterval).Add(automationInterval).Sub(now)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+	}()
+}
+
+func (a *Automation) Stop() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.cancel != nil {
+		a.cancel()
+		a.cancel = nil
+	}
+}
+
+// SetProfile records the profile the app applied, a switch to it is not asked for again
+func (a *Automation) SetProfile(profile string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.profile = profile
+}
+
+func (a *Automation) SetNetwork(network *NetworkContext) {
+	a.mutex.Lock()
+	changed := a.network != *network
+	a.network = *network
+	enabled := a.params.Enable
+	a.mutex.Unlock()
+	if changed && enabled {
+		go runGuarded("automation", a.run)
+	}
+}
+
+func (a *Automation) evaluateLocked(now time.Time, network NetworkContext) *AutomationDecision {
+	decision := &AutomationDecision{
+		Time:    now.UnixMilli(),
+		Network: network,
+	}
+	for _, rule := range a.rules {
+		if ok, reason := rule.match(now, network); ok {
+			decision.Rule = rule.Name
+			decision.Profile = rule.Profile
+			decision.Mode = rule.Mode
+			decision.Reason = reason
+			return decision
+		}
+	}
+	if a.params.Default != nil {
+		decision.Profile = a.params.Default.Profile
+		decision.Mode = a.params.Default.Mode
+		decision.Reason = "default"
+		return decision
+	}
+	decision.Reason = "no rule matches"
+	return decision
+}
+
+// Evaluate is the dry run, the state of the core is left as it is
+func (a *Automation) Evaluate(params *AutomationEvaluateParams) *AutomationDecision {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	now := time.Now()
+	if params.Time != 0 {
+		now = time.UnixMilli(params.Time)
+	}
+	network := a.network
+	if params.Network != nil {
+		network = *params.Network
+	}
+	return a.evaluateLocked(now, network)
+}
+
+func (a *Automation) run() {
+	a.mutex.Lock()
+	if !a.params.Enable {
+		a.mutex.Unlock()
+		return
+	}
+	decision := a.evaluateLocked(time.Now(), a.network)
+	// the default has no name, its reason tells it from no match at all
+	winner := decision.Rule
+	if winner == "" {
+		winner = "|" + decision.Reason
+	}
+	if winner == a.winner {
+		a.mutex.Unlock()
+		return
+	}
+	a.winner = winner
+	switchMode := decision.Mode != nil && tunnel.Mode() != *decision.Mode
+	switchProfile := decision.Profile != "" && decision.Profile != a.profile
+	decision.Applied = switchMode || switchProfile
+	a.last = decision
+	a.mutex.Unlock()
+	if switchMode {
+		log.Infoln("[Automation] %s switches to mode %s", decision.Reason, decision.Mode.String())
+		setAutomationMode(*decision.Mode)
+	}
+	if switchProfile {
+		log.Infoln("[Automation] %s switches to profile %s", decision.Reason, decision.Profile)
+	}
+	if decision.Applied {
+		go sendMessage(Message{
+			Type: AutomationMessage,
+			Data: decision,
+		})
+	}
+}
+
+func setAutomationMode(mode tunnel.TunnelMode) {
+	runLock.Lock()
+	defer runLock.Unlock()
+	if currentConfig != nil {
+		currentConfig.General.Mode = mode
+	}
+	tunnel.SetMode(mode)
+	closeConnections()
+}
+
+func (a *Automation) Status() *AutomationStatus {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return &AutomationStatus{
+		AutomationParams: a.params,
+		Network:          a.network,
+		Profile:          a.profile,
+		Last:             a.last,
+	}
+}
+
+func handleSetAutomation(paramsString string) error {
+	params := &AutomationParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	return automation.Set(params)
+}
+
+func handleGetAutomation() string {
+	data, err := json.Marshal(automation.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handleSetNetworkContext(paramsString string) error {
+	network := &NetworkContext{}
+	if err := json.Unmarshal([]byte(paramsString), network); err != nil {
+		return err
+	}
+	automation.SetNetwork(network)
+	return nil
+}
+
+func handleEvaluateAutomation(paramsString string) (string, error) {
+	params := &AutomationEvaluateParams{}
+	if paramsString != "" {
+		if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+			return "", err
+		}
+	}
+	data, err := json.Marshal(automation.Evaluate(params))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
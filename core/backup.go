@@ -0,0 +1,473 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/constant"
+	"golang.org/x/crypto/argon2"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	profilesDir         = "profiles"
+	backupManifestFile  = "manifest.json"
+	backupSettingsFile  = "settings.json"
+	backupVaultFile     = "vault.json"
+	backupTemplatesFile = "templates.json"
+	backupVersion       = 1
+	backupMinPassphrase = 8
+	backupMaxEntrySize  = 64 << 20
+
+	backupArgonTime    = 3
+	backupArgonMemory  = 64 * 1024
+	backupArgonThreads = 4
+	backupSaltSize     = 16
+)
+
+// backupMagic starts every bundle, followed by the version, the argon2id parameters, the salt and the AES-GCM payload
+var backupMagic = []byte("FLCBAK")
+
+// backupDirs are copied from the home dir, profiles are re-encrypted with the key of the target device
+var backupDirs = []string{profilesDir, overridesDir, scriptsDir}
+
+type BackupParams struct {
+	Passphrase string `json:"passphrase"`
+	Settings   string `json:"settings"`
+	Path       string `json:"path"`
+}
+
+type RestoreParams struct {
+	Bundle     string `json:"bundle"`
+	Path       string `json:"path"`
+	Passphrase string `json:"passphrase"`
+}
+
+type BackupManifest struct {
+	Version    int      `json:"version"`
+	Created    int64    `json:"created"`
+	AppVersion int      `json:"app-version"`
+	Files      []string `json:"files"`
+}
+
+type RestoreResult struct {
+	Created   int64    `json:"created"`
+	Profiles  []string `json:"profiles"`
+	Files     int      `json:"files"`
+	Secrets   int      `json:"secrets"`
+	Variables int      `json:"variables"`
+	Settings  string   `json:"settings"`
+}
+
+func backupKey(passphrase string, salt []byte, iterations uint32, memory uint32, threads uint8) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, iterations, memory, threads, 32)
+}
+
+func sealBackup(passphrase string, archive []byte) ([]byte, error) {
+	salt := make([]byte, backupSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key := backupKey(passphrase, salt, backupArgonTime, backupArgonMemory, backupArgonThreads)
+	defer clearBytes(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header := &bytes.Buffer{}
+	header.Write(backupMagic)
+	header.WriteByte(backupVersion)
+	_ = binary.Write(header, binary.BigEndian, uint32(backupArgonTime))
+	_ = binary.Write(header, binary.BigEndian, uint32(backupArgonMemory))
+	header.WriteByte(backupArgonThreads)
+	header.Write(salt)
+	header.Write(nonce)
+	// the header is authenticated so the kdf parameters cannot be swapped
+	return aead.Seal(header.Bytes(), nonce, archive, header.Bytes()), nil
+}
+
+func openBackup(passphrase string, bundle []byte) ([]byte, error) {
+	headerSize := len(backupMagic) + 1 + 4 + 4 + 1 + backupSaltSize
+	if len(bundle) < headerSize || !bytes.HasPrefix(bundle, backupMagic) {
+		return nil, errors.New("not a backup bundle")
+	}
+	offset := len(backupMagic)
+	if bundle[offset] != backupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d", bundle[offset])
+	}
+	offset++
+	argonTime := binary.BigEndian.Uint32(bundle[offset:])
+	argonMemory := binary.BigEndian.Uint32(bundle[offset+4:])
+	argonThreads := bundle[offset+8]
+	offset += 9
+	// the header is only authenticated once the key is derived, parameters beyond the ones this
+	// writer uses would let a crafted bundle exhaust the device
+	if argonTime == 0 || argonTime > backupArgonTime || argonMemory == 0 || argonMemory > backupArgonMemory ||
+		argonThreads == 0 || argonThreads > backupArgonThreads {
+		return nil, errors.New("invalid backup parameters")
+	}
+	salt := bundle[offset : offset+backupSaltSize]
+	offset += backupSaltSize
+	key := backupKey(passphrase, salt, argonTime, argonMemory, argonThreads)
+	defer clearBytes(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(bundle) < offset+aead.NonceSize() {
+		return nil, errors.New("not a backup bundle")
+	}
+	nonce := bundle[offset : offset+aead.NonceSize()]
+	header := bundle[:offset+aead.NonceSize()]
+	archive, err := aead.Open(nil, nonce, bundle[len(header):], header)
+	if err != nil {
+		return nil, errors.New("wrong passphrase or damaged bundle")
+	}
+	return archive, nil
+}
+
+// decryptProfileSecrets replaces the enc: values bound to this device with their plain text
+func decryptProfileSecrets(content []byte) []byte {
+	if getEncryptionService() == nil || !bytes.Contains(content, []byte(encryptedValuePrefix)) {
+		return content
+	}
+	document := &yaml.Node{}
+	if yaml.Unmarshal(content, document) != nil {
+		return content
+	}
+	var walk func(node *yaml.Node)
+	walk = func(node *yaml.Node) {
+		if node.Kind == yaml.ScalarNode && strings.HasPrefix(node.Value, encryptedValuePrefix) {
+			if plain, err := decryptSecretValue(node.Value); err == nil {
+				node.Value = plain
+			}
+			return
+		}
+		for _, child := range node.Content {
+			walk(child)
+		}
+	}
+	walk(document)
+	data, err := yaml.Marshal(document)
+	if err != nil {
+		return content
+	}
+	return data
+}
+
+// readBackupFile returns the plain content of a home dir file
+func readBackupFile(name string) ([]byte, error) {
+	data, err := os.ReadFile(constant.Path.Resolve(name))
+	if err != nil {
+		return nil, err
+	}
+	if !HasEncryptionHeader(data) {
+		return data, nil
+	}
+	if getEncryptionService() == nil {
+		return nil, errNoKeyProvider
+	}
+	plain, err := getEncryptionService().Decrypt(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return plain, nil
+}
+
+func backupFileNames() ([]string, error) {
+	var names []string
+	for _, dir := range backupDirs {
+		entries, err := os.ReadDir(constant.Path.Resolve(dir))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			// provider caches are downloaded again after the restore
+			if entry.Type().IsRegular() {
+				names = append(names, path.Join(dir, entry.Name()))
+			}
+		}
+	}
+	return names, nil
+}
+
+// writeBackupJSON adds a json entry to the archive
+func writeBackupJSON(writer *zip.Writer, name string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	defer clearBytes(data)
+	entry, err := writer.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = entry.Write(data)
+	return err
+}
+
+// BackupAll packs profiles, overrides, scripts, the vault, the template variables and the app
+// settings into one passphrase encrypted bundle
+func BackupAll(params *BackupParams) ([]byte, error) {
+	if !isInit {
+		return nil, errors.New("core is not initialized")
+	}
+	if len(params.Passphrase) < backupMinPassphrase {
+		return nil, fmt.Errorf("passphrase must have at least %d characters", backupMinPassphrase)
+	}
+	names, err := backupFileNames()
+	if err != nil {
+		return nil, err
+	}
+	archive := &bytes.Buffer{}
+	writer := zip.NewWriter(archive)
+	manifest := &BackupManifest{
+		Version:    backupVersion,
+		Created:    time.Now().UnixMilli(),
+		AppVersion: version,
+	}
+	for _, name := range names {
+		data, err := readBackupFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(name, profilesDir+"/") {
+			data = decryptProfileSecrets(data)
+		}
+		entry, err := writer.Create(name)
+		if err == nil {
+			_, err = entry.Write(data)
+		}
+		clearBytes(data)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, name)
+	}
+	// the vault and the secret variables are sealed by this device, they go in plain so the
+	// templated profiles render on the target
+	secrets, err := vault.backup()
+	if err != nil {
+		return nil, fmt.Errorf("vault: %v", err)
+	}
+	if len(secrets) > 0 {
+		if err := writeBackupJSON(writer, backupVaultFile, secrets); err != nil {
+			return nil, err
+		}
+	}
+	templates, err := templateVariables.backup()
+	if err != nil {
+		return nil, fmt.Errorf("template variables: %v", err)
+	}
+	if len(templates.Variables) > 0 || len(templates.Profiles) > 0 {
+		if err := writeBackupJSON(writer, backupTemplatesFile, templates); err != nil {
+			return nil, err
+		}
+	}
+	if params.Settings != "" {
+		entry, err := writer.Create(backupSettingsFile)
+		if err == nil {
+			_, err = entry.Write([]byte(params.Settings))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	manifestData, _ := json.Marshal(manifest)
+	entry, err := writer.Create(backupManifestFile)
+	if err == nil {
+		_, err = entry.Write(manifestData)
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer clearBytes(archive.Bytes())
+	return sealBackup(params.Passphrase, archive.Bytes())
+}
+
+func validBackupName(name string) bool {
+	dir, file := path.Split(name)
+	if file == "" || file == "." || file == ".." || strings.ContainsAny(file, `\`) {
+		return false
+	}
+	dir = strings.TrimSuffix(dir, "/")
+	for _, allowed := range backupDirs {
+		if dir == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// RestoreAll unpacks a bundle into the home dir, profiles are encrypted with the key of this device again
+func RestoreAll(params *RestoreParams, bundle []byte) (*RestoreResult, error) {
+	if !isInit {
+		return nil, errors.New("core is not initialized")
+	}
+	archive, err := openBackup(params.Passphrase, bundle)
+	if err != nil {
+		return nil, err
+	}
+	defer clearBytes(archive)
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return nil, err
+	}
+	result := &RestoreResult{Profiles: []string{}}
+	files := map[string][]byte{}
+	defer func() {
+		for _, data := range files {
+			clearBytes(data)
+		}
+	}()
+	for _, file := range reader.File {
+		if file.UncompressedSize64 > backupMaxEntrySize {
+			return nil, fmt.Errorf("%s is too large", file.Name)
+		}
+		entry, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(io.LimitReader(entry, backupMaxEntrySize))
+		_ = entry.Close()
+		if err != nil {
+			return nil, err
+		}
+		files[file.Name] = data
+	}
+	manifest := &BackupManifest{}
+	if err := json.Unmarshal(files[backupManifestFile], manifest); err != nil {
+		return nil, errors.New("backup manifest is missing")
+	}
+	result.Created = manifest.Created
+	result.Settings = string(files[backupSettingsFile])
+	// check everything before the first write so a bad bundle changes nothing
+	for _, name := range manifest.Files {
+		if !validBackupName(name) {
+			return nil, fmt.Errorf("invalid entry %s", name)
+		}
+		if _, ok := files[name]; !ok {
+			return nil, fmt.Errorf("entry %s is missing", name)
+		}
+	}
+	var secrets []VaultSecret
+	if data, ok := files[backupVaultFile]; ok {
+		if err := json.Unmarshal(data, &secrets); err != nil {
+			return nil, fmt.Errorf("invalid entry %s", backupVaultFile)
+		}
+	}
+	templates := &templateBackup{}
+	if data, ok := files[backupTemplatesFile]; ok {
+		if err := json.Unmarshal(data, templates); err != nil {
+			return nil, fmt.Errorf("invalid entry %s", backupTemplatesFile)
+		}
+	}
+	if (len(secrets) > 0 || len(templates.Variables) > 0) && getEncryptionService() == nil {
+		return nil, errNoKeyProvider
+	}
+	for _, name := range manifest.Files {
+		data := files[name]
+		if strings.HasPrefix(name, profilesDir+"/") && getEncryptionService() != nil {
+			encrypted, err := getEncryptionService().Encrypt(data)
+			if err != nil {
+				return nil, err
+			}
+			data = encrypted
+		}
+		target := constant.Path.Resolve(filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(target, data, 0600); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(name, profilesDir+"/") && strings.HasSuffix(name, ".yaml") {
+			result.Profiles = append(result.Profiles, strings.TrimSuffix(path.Base(name), ".yaml"))
+		}
+		result.Files++
+	}
+	if err := vault.restore(secrets); err != nil {
+		return nil, fmt.Errorf("vault: %v", err)
+	}
+	result.Secrets = len(secrets)
+	if err := templateVariables.restore(templates); err != nil {
+		return nil, fmt.Errorf("template variables: %v", err)
+	}
+	result.Variables = len(templates.Variables)
+	return result, nil
+}
+
+func handleBackupAll(paramsString string) (string, error) {
+	var params = &BackupParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return "", err
+	}
+	bundle, err := BackupAll(params)
+	if err != nil {
+		return "", err
+	}
+	if params.Path != "" {
+		if err := os.WriteFile(params.Path, bundle, 0600); err != nil {
+			return "", err
+		}
+		return params.Path, nil
+	}
+	return base64.StdEncoding.EncodeToString(bundle), nil
+}
+
+func handleRestoreAll(paramsString string) (string, error) {
+	var params = &RestoreParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return "", err
+	}
+	var bundle []byte
+	var err error
+	if params.Path != "" {
+		bundle, err = os.ReadFile(params.Path)
+	} else {
+		bundle, err = base64.StdEncoding.DecodeString(params.Bundle)
+	}
+	if err != nil {
+		return "", err
+	}
+	result, err := RestoreAll(params, bundle)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
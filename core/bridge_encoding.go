@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/metacubex/mihomo/tunnel/statistic"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	ZstdBridgeCompression      = "zstd"
+	defaultBridgeCompressBytes = 1024
+)
+
+// BridgeEncodingParams is chosen by the app once it can read the encodings, the plain json stays
+// the default for older ones
+type BridgeEncodingParams struct {
+	// Delta sends the counters of a known connection only and leaves out unchanged traffic ticks
+	Delta       bool   `json:"delta"`
+	Compression string `json:"compression"`
+	// MinSize is the bytes of json a payload needs before it is compressed
+	MinSize int `json:"min-size"`
+}
+
+// EncodedPayload replaces the data of a result or message, Data is the base64 of the compressed
+// json and Size its length before compression
+type EncodedPayload struct {
+	Encoding string `json:"encoding"`
+	Size     int    `json:"size"`
+	Data     string `json:"data"`
+}
+
+type ConnectionUpdate struct {
+	Id       string `json:"id"`
+	Upload   int64  `json:"upload"`
+	Download int64  `json:"download"`
+}
+
+// ConnectionsDelta is a snapshot against the one sent before, a full one lists every connection as
+// added and the app drops what it kept
+type ConnectionsDelta struct {
+	Full          bool                     `json:"full"`
+	DownloadTotal int64                    `json:"downloadTotal"`
+	UploadTotal   int64                    `json:"uploadTotal"`
+	Memory        uint64                   `json:"memory"`
+	Added         []*statistic.TrackerInfo `json:"added"`
+	Updated       []ConnectionUpdate       `json:"updated"`
+	Removed       []string                 `json:"removed"`
+}
+
+type connectionCounters struct {
+	upload   int64
+	download int64
+}
+
+// connectionDiffer remembers what the other side knows of the connections
+type connectionDiffer struct {
+	mutex sync.Mutex
+	known map[string]connectionCounters
+}
+
+func (d *connectionDiffer) Reset() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.known = nil
+}
+
+func (d *connectionDiffer) Diff(snapshot *statistic.Snapshot) *ConnectionsDelta {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delta := &ConnectionsDelta{
+		Full:          d.known == nil,
+		DownloadTotal: snapshot.DownloadTotal,
+		UploadTotal:   snapshot.UploadTotal,
+		Memory:        snapshot.Memory,
+		Added:         []*statistic.TrackerInfo{},
+		Updated:       []ConnectionUpdate{},
+		Removed:       []string{},
+	}
+	known := make(map[string]connectionCounters, len(snapshot.Connections))
+	for _, info := range snapshot.Connections {
+		id := info.UUID.String()
+		counters := connectionCounters{
+			upload:   info.UploadTotal.Load(),
+			download: info.DownloadTotal.Load(),
+		}
+		known[id] = counters
+		previous, ok := d.known[id]
+		switch {
+		case !ok:
+			delta.Added = append(delta.Added, info)
+		case previous != counters:
+			delta.Updated = append(delta.Updated, ConnectionUpdate{
+				Id:       id,
+				Upload:   counters.upload,
+				Download: counters.download,
+			})
+		}
+	}
+	for id := range d.known {
+		if _, ok := known[id]; !ok {
+			delta.Removed = append(delta.Removed, id)
+		}
+	}
+	d.known = known
+	return delta
+}
+
+// BridgeEncoding shapes what goes over the bridge, the grpc and remote streams keep plain json
+type BridgeEncoding struct {
+	params      atomic.Pointer[BridgeEncodingParams]
+	encoder     *zstd.Encoder
+	encoderOnce sync.Once
+	connections connectionDiffer
+	trafficMux  sync.Mutex
+	lastTraffic [2]int64
+	trafficSent bool
+}
+
+var bridgeEncoding = &BridgeEncoding{}
+
+func (e *BridgeEncoding) Params() BridgeEncodingParams {
+	if params := e.params.Load(); params != nil {
+		return *params
+	}
+	return BridgeEncodingParams{}
+}
+
+func (e *BridgeEncoding) Set(params *BridgeEncodingParams) error {
+	if params.Compression != "" && params.Compression != ZstdBridgeCompression {
+		return fmt.Errorf("unsupported compression %s", params.Compression)
+	}
+	if params.MinSize <= 0 {
+		params.MinSize = defaultBridgeCompressBytes
+	}
+	copied := *params
+	e.params.Store(&copied)
+	// a new setting is a new session of the app, it gets everything again
+	e.connections.Reset()
+	e.trafficMux.Lock()
+	e.trafficSent = false
+	e.trafficMux.Unlock()
+	return nil
+}
+
+func (e *BridgeEncoding) zstdEncoder() *zstd.Encoder {
+	e.encoderOnce.Do(func() {
+		// the fastest level already takes the most of the json, the bridge is on the same device
+		e.encoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	})
+	return e.encoder
+}
+
+// Encode turns marshalled json into the payload the app gets, small ones stay as they are
+func (e *BridgeEncoding) Encode(data []byte) any {
+	params := e.Params()
+	if params.Compression != ZstdBridgeCompression || len(data) < params.MinSize {
+		return json.RawMessage(data)
+	}
+	encoder := e.zstdEncoder()
+	if encoder == nil {
+		return json.RawMessage(data)
+	}
+	compressed := encoder.EncodeAll(data, make([]byte, 0, len(data)/4))
+	return &EncodedPayload{
+		Encoding: ZstdBridgeCompression,
+		Size:     len(data),
+		Data:     base64.StdEncoding.EncodeToString(compressed),
+	}
+}
+
+// EncodeString is Encode for the results that are json strings already
+func (e *BridgeEncoding) EncodeString(data string) any {
+	if data == "" || e.Params().Compression == "" {
+		return data
+	}
+	return e.Encode([]byte(data))
+}
+
+// Message compresses the data of a message, one that does not marshal is left to fail as before
+func (e *BridgeEncoding) Message(message Message) Message {
+	if e.Params().Compression == "" {
+		return message
+	}
+	data, err := json.Marshal(message.Data)
+	if err != nil {
+		return message
+	}
+	message.Data = e.Encode(data)
+	return message
+}
+
+// Connections is the snapshot for getConnections, a delta once the app asked for those
+func (e *BridgeEncoding) Connections(snapshot *statistic.Snapshot) any {
+	if !e.Params().Delta {
+		return snapshot
+	}
+	return e.connections.Diff(snapshot)
+}
+
+// SkipTraffic tells a tick that repeats the one sent before, an idle core sends nothing
+func (e *BridgeEncoding) SkipTraffic(up, down int64) bool {
+	if !e.Params().Delta {
+		return false
+	}
+	e.trafficMux.Lock()
+	defer e.trafficMux.Unlock()
+	current := [2]int64{up, down}
+	if e.trafficSent && e.lastTraffic == current {
+		return true
+	}
+	e.lastTraffic = current
+	e.trafficSent = true
+	return false
+}
+
+func handleSetBridgeEncoding(paramsString string) error {
+	params := &BridgeEncodingParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	return bridgeEncoding.Set(params)
+}
+
+func handleGetBridgeEncoding() string {
+	data, err := json.Marshal(bridgeEncoding.Params())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
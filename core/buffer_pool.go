@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"github.com/metacubex/mihomo/common/pool"
+	"github.com/metacubex/sing/common/buf"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	minBufferClassBits = 6
+	maxBufferClassBits = 16
+)
+
+type BufferClassStats struct {
+	Size  int   `json:"size"`
+	Gets  int64 `json:"gets"`
+	Hits  int64 `json:"hits"`
+	InUse int64 `json:"in-use"`
+}
+
+type BufferPoolStats struct {
+	Gets       int64              `json:"gets"`
+	Hits       int64              `json:"hits"`
+	HitRate    float64            `json:"hit-rate"`
+	InUse      int64              `json:"in-use"`
+	InUseBytes int64              `json:"in-use-bytes"`
+	Oversize   int64              `json:"oversize"`
+	Rejected   int64              `json:"rejected"`
+	Classes    []BufferClassStats `json:"classes"`
+}
+
+type bufferClass struct {
+	size   int
+	pool   sync.Pool
+	gets   atomic.Int64
+	misses atomic.Int64
+	puts   atomic.Int64
+}
+
+// BufferPool hands out power of two buffers from 64 bytes to 64 KiB, it replaces the allocators
+// of mihomo and sing so the tun stack, the relay and the dns share one set of pools
+type BufferPool struct {
+	classes  [maxBufferClassBits - minBufferClassBits + 1]*bufferClass
+	oversize atomic.Int64
+	rejected atomic.Int64
+}
+
+var bufferPool = newBufferPool()
+
+func init() {
+	pool.DefaultAllocator = bufferPool
+	buf.DefaultAllocator = bufferPool
+}
+
+func newBufferPool() *BufferPool {
+	p := &BufferPool{}
+	for i := range p.classes {
+		class := &bufferClass{size: 1 << (i + minBufferClassBits)}
+		class.pool.New = func() any {
+			class.misses.Add(1)
+			data := make([]byte, class.size)
+			return &data[0]
+		}
+		p.classes[i] = class
+	}
+	return p
+}
+
+func bufferClassIndex(size int) int {
+	if size <= 1<<minBufferClassBits {
+		return 0
+	}
+	return bits.Len(uint(size-1)) - minBufferClassBits
+}
+
+// Get returns a buffer of the length asked for, the capacity is the size of its class
+func (p *BufferPool) Get(size int) []byte {
+	if size <= 0 {
+		return nil
+	}
+	if size > 1<<maxBufferClassBits {
+		p.oversize.Add(1)
+		return make([]byte, size)
+	}
+	class := p.classes[bufferClassIndex(size)]
+	class.gets.Add(1)
+	// the pool keeps the first byte, which keeps the whole array of the class alive
+	data := unsafe.Slice(class.pool.Get().(*byte), class.size)
+	return data[:size]
+}
+
+// Put takes back a buffer from Get, the capacity must be exactly the size of a class
+func (p *BufferPool) Put(data []byte) error {
+	size := cap(data)
+	if size == 0 || size > 1<<maxBufferClassBits {
+		return nil
+	}
+	if size&(size-1) != 0 {
+		p.rejected.Add(1)
+		return errors.New("buffer pool put incorrect buffer size")
+	}
+	if size < 1<<minBufferClassBits {
+		return nil
+	}
+	class := p.classes[bufferClassIndex(size)]
+	class.puts.Add(1)
+	class.pool.Put(&data[:1][0])
+	return nil
+}
+
+func (p *BufferPool) Stats() *BufferPoolStats {
+	stats := &BufferPoolStats{
+		Oversize: p.oversize.Load(),
+		Rejected: p.rejected.Load(),
+		Classes:  make([]BufferClassStats, 0, len(p.classes)),
+	}
+	for _, class := range p.classes {
+		gets := class.gets.Load()
+		hits := gets - class.misses.Load()
+		if hits < 0 {
+			hits = 0
+		}
+		// buffers from the allocators replaced at init come back too, so the count can go below zero
+		inUse := gets - class.puts.Load()
+		if inUse < 0 {
+			inUse = 0
+		}
+		stats.Classes = append(stats.Classes, BufferClassStats{
+			Size:  class.size,
+			Gets:  gets,
+			Hits:  hits,
+			InUse: inUse,
+		})
+		stats.Gets += gets
+		stats.Hits += hits
+		stats.InUse += inUse
+		stats.InUseBytes += inUse * int64(class.size)
+	}
+	if stats.Gets != 0 {
+		stats.HitRate = float64(stats.Hits) / float64(stats.Gets)
+	}
+	return stats
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/metacubex/mihomo/adapter/outbound"
+	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPortalProbeUrl = "http://connectivitycheck.gstatic.com/generate_204"
+	defaultPortalBypass   = 10 * time.Minute
+	portalProbeTimeout    = 5 * time.Second
+	portalRecheckInterval = 5 * time.Second
+)
+
+type PortalProbeResult string
+
+const (
+	OnlinePortalProbe  PortalProbeResult = "online"
+	PortalPortalProbe  PortalProbeResult = "portal"
+	OfflinePortalProbe PortalProbeResult = "offline"
+)
+
+type CaptivePortalParams struct {
+	Enable   bool   `json:"enable"`
+	ProbeUrl string `json:"probe-url"`
+	// Interval is the seconds between probes without a portal, zero probes on network changes only
+	Interval int64 `json:"interval"`
+	Bypass   bool  `json:"bypass"`
+	// BypassTimeout is the seconds the portal is routed around the tunnel at most
+	BypassTimeout int64    `json:"bypass-timeout"`
+	Domains       []string `json:"domains"`
+}
+
+type CaptivePortalStatus struct {
+	CaptivePortalParams
+	Detected   bool              `json:"detected"`
+	Bypassing  bool              `json:"bypassing"`
+	Location   string            `json:"location,omitempty"`
+	Hosts      []string          `json:"hosts,omitempty"`
+	Since      int64             `json:"since,omitempty"`
+	LastProbe  int64             `json:"last-probe,omitempty"`
+	LastResult PortalProbeResult `json:"last-result,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// CaptivePortal probes for a portal through DIRECT and, while one holds the network, sends its
+// hosts around the tunnel with rules in front of the profile so the login page can load
+type CaptivePortal struct {
+	mutex      sync.Mutex
+	params     CaptivePortalParams
+	cancel     context.CancelFunc
+	trigger    chan struct{}
+	detected   bool
+	bypassing  bool
+	location   string
+	hosts      []string
+	since      time.Time
+	lastProbe  time.Time
+	lastResult PortalProbeResult
+	err        error
+}
+
+var captivePortal = &CaptivePortal{}
+
+func (p *CaptivePortal) Set(params *CaptivePortalParams) error {
+	if params.ProbeUrl != "" {
+		probe, err := url.Parse(params.ProbeUrl)
+		if err != nil {
+			return err
+		}
+		if probe.Scheme != "http" {
+			return errors.New("the probe must be plain http, a portal cannot answer https")
+		}
+	}
+	p.mutex.Lock()
+	p.params = *params
+	p.mutex.Unlock()
+	p.Resume()
+	return nil
+}
+
+func (p *CaptivePortal) probeUrl() string {
+	if p.params.ProbeUrl == "" {
+		return defaultPortalProbeUrl
+	}
+	return p.params.ProbeUrl
+}
+
+func (p *CaptivePortal) bypassTimeout() time.Duration {
+	if p.params.BypassTimeout <= 0 {
+		return defaultPortalBypass
+	}
+	return time.Duration(p.params.BypassTimeout) * time.Second
+}
+
+func (p *CaptivePortal) Resume() {
+	p.Stop()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.params.Enable {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.trigger = make(chan struct{}, 1)
+	go p.loop(ctx, p.trigger)
+	p.trigger <- struct{}{}
+}
+
+// Stop ends probing and takes the bypass rules down with it
+func (p *CaptivePortal) Stop() {
+	p.mutex.Lock()
+	if p.cancel != nil {
+		p.cancel()
+		p.cancel = nil
+	}
+	p.trigger = nil
+	bypassing := p.bypassing
+	p.detected = false
+	p.bypassing = false
+	p.hosts = nil
+	p.location = ""
+	p.mutex.Unlock()
+	if bypassing {
+		reapplyPortalRules()
+	}
+}
+
+// Notify probes at once, the network monitor calls it after every change
+func (p *CaptivePortal) Notify() {
+	p.mutex.Lock()
+	trigger := p.trigger
+	p.mutex.Unlock()
+	if trigger == nil {
+		return
+	}
+	select {
+	case trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (p *CaptivePortal) nextProbe() time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.detected {
+		return portalRecheckInterval
+	}
+	if p.params.Interval <= 0 {
+		return 0
+	}
+	return powerScaled(time.Duration(p.params.Interval) * time.Second)
+}
+
+func (p *CaptivePortal) loop(ctx context.Context, trigger chan struct{}) {
+	for {
+		var timer *time.Timer
+		var wait <-chan time.Time
+		if interval := p.nextProbe(); interval > 0 {
+			timer = time.NewTimer(interval)
+			wait = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-trigger:
+		case <-wait:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		runGuarded("captive portal", func() {
+			p.check(ctx)
+		})
+	}
+}
+
+func (p *CaptivePortal) check(ctx context.Context) {
+	p.mutex.Lock()
+	probe := p.probeUrl()
+	p.mutex.Unlock()
+	result, location, err := probePortal(ctx, probe)
+	if ctx.Err() != nil {
+		return
+	}
+	p.mutex.Lock()
+	p.lastProbe = time.Now()
+	p.lastResult = result
+	p.err = err
+	switch {
+	case result == PortalPortalProbe && !p.detected:
+		p.detected = true
+		p.since = time.Now()
+		p.location = location
+		p.hosts = portalHosts(probe, location, p.params.Domains)
+		p.bypassing = p.params.Bypass
+		status := p.statusLocked()
+		p.mutex.Unlock()
+		log.Infoln("[Portal] detected at %s", location)
+		if status.Bypassing {
+			reapplyPortalRules()
+		}
+		go sendMessage(Message{
+			Type: PortalDetectedMessage,
+			Data: status,
+		})
+	case result == OnlinePortalProbe && p.detected:
+		bypassing := p.bypassing
+		p.detected = false
+		p.bypassing = false
+		p.hosts = nil
+		p.location = ""
+		status := p.statusLocked()
+		p.mutex.Unlock()
+		log.Infoln("[Portal] cleared")
+		if bypassing {
+			reapplyPortalRules()
+		}
+		go sendMessage(Message{
+			Type: PortalClearedMessage,
+			Data: status,
+		})
+	case p.bypassing && time.Since(p.since) > p.bypassTimeout():
+		p.bypassing = false
+		p.mutex.Unlock()
+		log.Warnln("[Portal] bypass expired before the login")
+		reapplyPortalRules()
+	default:
+		p.mutex.Unlock()
+	}
+}
+
+// portalHosts collects what the login needs, the probe host is answered by the portal itself
+func portalHosts(probe string, location string, domains []string) []string {
+	seen := map[string]struct{}{}
+	for _, raw := range append([]string{probe, location}, domains...) {
+		host := raw
+		if parsed, err := url.Parse(raw); err == nil && parsed.Host != "" {
+			host = parsed.Hostname()
+		}
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" {
+			continue
+		}
+		seen[host] = struct{}{}
+	}
+	hosts := make([]string, 0, len(seen))
+	for host := range seen {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func (p *CaptivePortal) Bypassing() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.bypassing
+}
+
+// allows tells the hosts of the login while the bypass holds, the kill switch lets them out
+func (p *CaptivePortal) allows(host string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.bypassing {
+		return false
+	}
+	host = strings.ToLower(host)
+	for _, portal := range p.hosts {
+		if matchDomainSuffix(host, portal) {
+			return true
+		}
+	}
+	return false
+}
+
+// rules are the lines put in front of the profile while the bypass holds
+func (p *CaptivePortal) rules() []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.bypassing {
+		return nil
+	}
+	lines := make([]string, 0, len(p.hosts))
+	for _, host := range p.hosts {
+		if addr, err := netip.ParseAddr(host); err == nil {
+			lines = append(lines, "IP-CIDR,"+netip.PrefixFrom(addr, addr.BitLen()).String()+",DIRECT,no-resolve")
+			continue
+		}
+		lines = append(lines, "DOMAIN-SUFFIX,"+host+",DIRECT")
+	}
+	return lines
+}
+
+func reapplyPortalRules() {
+	runLock.Lock()
+	defer runLock.Unlock()
+	if currentConfig == nil {
+		return
+	}
+	if err := applyRulesLocked(currentRules); err != nil {
+		log.Warnln("[Portal] apply rules error: %v", err)
+	}
+}
+
+func portalDirect() C.ProxyAdapter {
+	if proxy, ok := tunnel.Proxies()["DIRECT"]; ok {
+		return proxy
+	}
+	return outbound.NewDirect()
+}
+
+// probePortal asks for the 204 through DIRECT, anything but an empty answer is a portal
+func probePortal(ctx context.Context, probe string) (PortalProbeResult, string, error) {
+	direct := portalDirect()
+	client := &http.Client{
+		Timeout: portalProbeTimeout,
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				metadata := &C.Metadata{NetWork: C.TCP}
+				if err := metadata.SetRemoteAddress(address); err != nil {
+					return nil, err
+				}
+				return direct.DialContext(ctx, metadata)
+			},
+		},
+		CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, probe, nil)
+	if err != nil {
+		return OfflinePortalProbe, "", err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return OfflinePortalProbe, "", err
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+	if response.StatusCode == http.StatusNoContent || (response.StatusCode == http.StatusOK && len(body) == 0) {
+		return OnlinePortalProbe, "", nil
+	}
+	location := probe
+	if redirect, err := response.Location(); err == nil {
+		location = redirect.String()
+	}
+	return PortalPortalProbe, location, nil
+}
+
+func (p *CaptivePortal) statusLocked() *CaptivePortalStatus {
+	status := &CaptivePortalStatus{
+		CaptivePortalParams: p.params,
+		Detected:            p.detected,
+		Bypassing:           p.bypassing,
+		Location:            p.location,
+		Hosts:               append([]string{}, p.hosts...),
+		LastResult:          p.lastResult,
+	}
+	if p.detected {
+		status.Since = p.since.UnixMilli()
+	}
+	if !p.lastProbe.IsZero() {
+		status.LastProbe = p.lastProbe.UnixMilli()
+	}
+	if p.err != nil {
+		status.Error = p.err.Error()
+	}
+	return status
+}
+
+func (p *CaptivePortal) Status() *CaptivePortalStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.statusLocked()
+}
+
+func handleSetCaptivePortal(paramsString string) error {
+	params := &CaptivePortalParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	return captivePortal.Set(params)
+}
+
+func handleGetCaptivePortal() string {
+	data, err := json.Marshal(captivePortal.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handleProbeCaptivePortal() {
+	captivePortal.Notify()
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/component/dialer"
+	"github.com/metacubex/mihomo/config"
+	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pinnedCertsKey        = "pinned-certs"
+	caBundleKey           = "ca-bundle"
+	caBundleStringKey     = "ca-bundle-str"
+	spkiPinPrefix         = "sha256/"
+	certPinVerifyTTL      = 10 * time.Minute
+	defaultCertPinTimeout = 5 * time.Second
+)
+
+// certPinTypes are the outbounds whose tls runs over tcp, the probe cannot reach a quic server
+var certPinTypes = map[string]bool{
+	"trojan": true, "vless": true, "vmess": true, "http": true, "socks5": true, "anytls": true,
+}
+
+type CertPinFailed struct {
+	Proxy        string   `json:"proxy"`
+	Server       string   `json:"server"`
+	Reason       string   `json:"reason"`
+	Fingerprints []string `json:"fingerprints"`
+}
+
+type CertPinStatus struct {
+	Pins         []string `json:"pins"`
+	CABundle     bool     `json:"ca-bundle"`
+	Server       string   `json:"server"`
+	ServerName   string   `json:"server-name"`
+	Verified     int64    `json:"verified"`
+	Error        string   `json:"error,omitempty"`
+	Fingerprints []string `json:"fingerprints,omitempty"`
+}
+
+type ProbeCertificatesParams struct {
+	Server     string `json:"server"`
+	ServerName string `json:"server-name"`
+	Proxy      string `json:"proxy"`
+}
+
+// CertificateInfo describes a certificate of the chain a server presented, Fingerprint and Spki
+// are the two pin forms pinned-certs takes
+type CertificateInfo struct {
+	Subject     string `json:"subject"`
+	Issuer      string `json:"issuer"`
+	NotAfter    int64  `json:"not-after"`
+	Fingerprint string `json:"fingerprint"`
+	Spki        string `json:"spki"`
+}
+
+type certPin struct {
+	spki bool
+	hash [sha256.Size]byte
+}
+
+func parseCertPin(value string) (certPin, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(strings.ToLower(value), spkiPinPrefix) {
+		raw, err := base64.StdEncoding.DecodeString(value[len(spkiPinPrefix):])
+		if err != nil || len(raw) != sha256.Size {
+			return certPin{}, fmt.Errorf("invalid spki pin %s", value)
+		}
+		pin := certPin{spki: true}
+		copy(pin.hash[:], raw)
+		return pin, nil
+	}
+	raw, err := hex.DecodeString(strings.ReplaceAll(value, ":", ""))
+	if err != nil || len(raw) != sha256.Size {
+		return certPin{}, fmt.Errorf("invalid certificate pin %s, need a sha256 fingerprint", value)
+	}
+	pin := certPin{}
+	copy(pin.hash[:], raw)
+	return pin, nil
+}
+
+func (p certPin) match(cert *x509.Certificate) bool {
+	if p.spki {
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		return bytes.Equal(hash[:], p.hash[:])
+	}
+	hash := sha256.Sum256(cert.Raw)
+	return bytes.Equal(hash[:], p.hash[:])
+}
+
+func certificateInfo(cert *x509.Certificate) CertificateInfo {
+	fingerprint := sha256.Sum256(cert.Raw)
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return CertificateInfo{
+		Subject:     cert.Subject.String(),
+		Issuer:      cert.Issuer.String(),
+		NotAfter:    cert.NotAfter.UnixMilli(),
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+		Spki:        spkiPinPrefix + base64.StdEncoding.EncodeToString(spki[:]),
+	}
+}
+
+// certPolicy is what an outbound asks of the chain of its server on top of the verification of
+// mihomo, a bundle limits the roots to its own certificates and a pin has to match one of the chain
+type certPolicy struct {
+	mutex      sync.Mutex
+	source     []string
+	pins       []certPin
+	roots      *x509.CertPool
+	server     string
+	serverName string
+	err        error
+	verified   time.Time
+	lastError  string
+	chain      []string
+}
+
+func (p *certPolicy) check(certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return errors.New("server sent no certificate")
+	}
+	if p.roots != nil {
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		if _, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         p.roots,
+			Intermediates: intermediates,
+			DNSName:       p.serverName,
+		}); err != nil {
+			return fmt.Errorf("chain is not signed by the ca bundle: %v", err)
+		}
+	}
+	if len(p.pins) == 0 {
+		return nil
+	}
+	for _, cert := range certs {
+		for _, pin := range p.pins {
+			if pin.match(cert) {
+				return nil
+			}
+		}
+	}
+	return errors.New("no certificate of the chain matches the pins")
+}
+
+func probeCertificates(ctx context.Context, server, serverName string) ([]*x509.Certificate, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultCertPinTimeout)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var certs []*x509.Certificate
+	// the chain is checked against the policy afterwards, the handshake only collects it
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return err
+				}
+				certs = append(certs, cert)
+			}
+			return nil
+		},
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// verify probes the server before the first dial and again once certPinVerifyTTL passed, the
+// outbound does not send its credentials before its server passed
+func (p *certPolicy) verify(ctx context.Context, name string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	if !p.verified.IsZero() && time.Since(p.verified) < certPinVerifyTTL {
+		return nil
+	}
+	certs, err := probeCertificates(ctx, p.server, p.serverName)
+	if err != nil {
+		return fmt.Errorf("certificate probe of %s failed: %w", p.server, err)
+	}
+	p.chain = p.chain[:0]
+	for _, cert := range certs {
+		p.chain = append(p.chain, certificateInfo(cert).Fingerprint)
+	}
+	if err := p.check(certs); err != nil {
+		p.verified = time.Time{}
+		p.lastError = err.Error()
+		log.Errorln("[CertPin] %s %s: %v", name, p.server, err)
+		go sendMessage(Message{
+			Type: CertPinFailedMessage,
+			Data: CertPinFailed{
+				Proxy:        name,
+				Server:       p.server,
+				Reason:       err.Error(),
+				Fingerprints: append([]string{}, p.chain...),
+			},
+		})
+		return fmt.Errorf("certificate pin of %s: %w", name, err)
+	}
+	p.verified = time.Now()
+	p.lastError = ""
+	return nil
+}
+
+type CertPinning struct {
+	mutex    sync.Mutex
+	policies map[string]*certPolicy
+}
+
+var certPinning = &CertPinning{policies: map[string]*certPolicy{}}
+
+func rawStrings(value any) []string {
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+	case []any:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			if item, ok := item.(string); ok {
+				values = append(values, item)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func loadCABundle(mapping map[string]any) (string, error) {
+	if bundle, ok := mapping[caBundleStringKey].(string); ok && bundle != "" {
+		return bundle, nil
+	}
+	path, ok := mapping[caBundleKey].(string)
+	if !ok || path == "" {
+		return "", nil
+	}
+	path = C.Path.Resolve(path)
+	if !C.Path.IsSafePath(path) {
+		return "", C.Path.ErrNotSafePath(path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("load ca bundle error: %w", err)
+	}
+	return string(data), nil
+}
+
+func parseCertPolicy(mapping map[string]any) (*certPolicy, string, error) {
+	policy := &certPolicy{source: rawStrings(mapping[pinnedCertsKey])}
+	server, _ := mapping["server"].(string)
+	port := 0
+	switch value := mapping["port"].(type) {
+	case int:
+		port = value
+	case string:
+		port, _ = strconv.Atoi(value)
+	}
+	policy.server = net.JoinHostPort(server, strconv.Itoa(port))
+	policy.serverName = server
+	for _, key := range []string{"sni", "servername"} {
+		if name, ok := mapping[key].(string); ok && name != "" {
+			policy.serverName = name
+		}
+	}
+	for _, value := range policy.source {
+		pin, err := parseCertPin(value)
+		if err != nil {
+			return policy, "", err
+		}
+		policy.pins = append(policy.pins, pin)
+	}
+	bundle, err := loadCABundle(mapping)
+	if err != nil {
+		return policy, "", err
+	}
+	if bundle != "" {
+		policy.roots = x509.NewCertPool()
+		if !policy.roots.AppendCertsFromPEM([]byte(bundle)) {
+			return policy, "", errors.New("ca bundle has no certificate")
+		}
+	}
+	return policy, bundle, nil
+}
+
+// Prepare takes the pinning keys out of the proxies of the profile, a lone certificate pin also
+// becomes the fingerprint of mihomo so the handshake itself enforces it, the bundles join the
+// trusted certificates so the handshake accepts the servers they sign
+func (c *CertPinning) Prepare(rawConfig *config.RawConfig) {
+	policies := map[string]*certPolicy{}
+	for _, mapping := range rawConfig.Proxy {
+		_, hasPins := mapping[pinnedCertsKey]
+		_, hasBundle := mapping[caBundleKey]
+		_, hasBundleString := mapping[caBundleStringKey]
+		if !hasPins && !hasBundle && !hasBundleString {
+			continue
+		}
+		name, _ := mapping["name"].(string)
+		proxyType, _ := mapping["type"].(string)
+		policy, bundle, err := parseCertPolicy(mapping)
+		delete(mapping, pinnedCertsKey)
+		delete(mapping, caBundleKey)
+		delete(mapping, caBundleStringKey)
+		if !certPinTypes[proxyType] {
+			log.Warnln("[CertPin] %s: %s does not support certificate pinning", name, proxyType)
+			continue
+		}
+		if err != nil {
+			// the outbound stays unusable rather than falling back to the default trust
+			log.Errorln("[CertPin] %s: %v", name, err)
+			policy.err = fmt.Errorf("certificate pin of %s: %w", name, err)
+		}
+		if bundle != "" {
+			rawConfig.TLS.CustomTrustCert = append(rawConfig.TLS.CustomTrustCert, bundle)
+		}
+		if fingerprint, _ := mapping["fingerprint"].(string); fingerprint == "" && len(policy.pins) == 1 && !policy.pins[0].spki && policy.roots == nil {
+			mapping["fingerprint"] = hex.EncodeToString(policy.pins[0].hash[:])
+		}
+		policies[name] = policy
+	}
+	c.mutex.Lock()
+	c.policies = policies
+	c.mutex.Unlock()
+}
+
+func (c *CertPinning) wrap(name string, proxy C.ProxyAdapter) C.ProxyAdapter {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	policy, ok := c.policies[name]
+	if !ok {
+		return proxy
+	}
+	return &certPinAdapter{ProxyAdapter: proxy, policy: policy}
+}
+
+func (c *CertPinning) Status() map[string]*CertPinStatus {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	status := map[string]*CertPinStatus{}
+	for name, policy := range c.policies {
+		policy.mutex.Lock()
+		item := &CertPinStatus{
+			Pins:         append([]string{}, policy.source...),
+			CABundle:     policy.roots != nil,
+			Server:       policy.server,
+			ServerName:   policy.serverName,
+			Error:        policy.lastError,
+			Fingerprints: append([]string{}, policy.chain...),
+		}
+		if policy.err != nil {
+			item.Error = policy.err.Error()
+		}
+		if !policy.verified.IsZero() {
+			item.Verified = policy.verified.UnixMilli()
+		}
+		policy.mutex.Unlock()
+		status[name] = item
+	}
+	return status
+}
+
+type certPinAdapter struct {
+	C.ProxyAdapter
+	policy *certPolicy
+}
+
+func (a *certPinAdapter) Inner() C.ProxyAdapter {
+	return a.ProxyAdapter
+}
+
+func (a *certPinAdapter) DialContext(ctx context.Context, metadata *C.Metadata) (C.Conn, error) {
+	if err := a.policy.verify(ctx, a.Name()); err != nil {
+		return nil, err
+	}
+	return a.ProxyAdapter.DialContext(ctx, metadata)
+}
+
+func (a *certPinAdapter) DialContextWithDialer(ctx context.Context, dialer C.Dialer, metadata *C.Metadata) (C.Conn, error) {
+	if err := a.policy.verify(ctx, a.Name()); err != nil {
+		return nil, err
+	}
+	return a.ProxyAdapter.DialContextWithDialer(ctx, dialer, metadata)
+}
+
+func (a *certPinAdapter) ListenPacketContext(ctx context.Context, metadata *C.Metadata) (C.PacketConn, error) {
+	if err := a.policy.verify(ctx, a.Name()); err != nil {
+		return nil, err
+	}
+	return a.ProxyAdapter.ListenPacketContext(ctx, metadata)
+}
+
+func (a *certPinAdapter) ListenPacketWithDialer(ctx context.Context, dialer C.Dialer, metadata *C.Metadata) (C.PacketConn, error) {
+	if err := a.policy.verify(ctx, a.Name()); err != nil {
+		return nil, err
+	}
+	return a.ProxyAdapter.ListenPacketWithDialer(ctx, dialer, metadata)
+}
+
+func handleGetCertPins() string {
+	data, err := json.Marshal(certPinning.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// handleProbeCertificates returns the chain a server presents so the app can offer its pins
+func handleProbeCertificates(paramsString string, fn func(string, error)) {
+	go func() {
+		var params = &ProbeCertificatesParams{}
+		if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+			fn("", err)
+			return
+		}
+		if params.Proxy != "" {
+			certPinning.mutex.Lock()
+			policy, ok := certPinning.policies[params.Proxy]
+			certPinning.mutex.Unlock()
+			if !ok {
+				fn("", fmt.Errorf("proxy %s has no certificate pin", params.Proxy))
+				return
+			}
+			params.Server, params.ServerName = policy.server, policy.serverName
+		}
+		if params.ServerName == "" {
+			params.ServerName, _, _ = net.SplitHostPort(params.Server)
+		}
+		certs, err := probeCertificates(context.Background(), params.Server, params.ServerName)
+		if err != nil {
+			fn("", err)
+			return
+		}
+		infos := make([]CertificateInfo, 0, len(certs))
+		for _, cert := range certs {
+			infos = append(infos, certificateInfo(cert))
+		}
+		data, err := json.Marshal(infos)
+		if err != nil {
+			fn("", err)
+			return
+		}
+		fn(string(data), nil)
+	}()
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/metacubex/mihomo/adapter"
+	tlsC "github.com/metacubex/mihomo/component/tls"
+	"github.com/metacubex/mihomo/config"
+	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	clientFingerprintKey           = "client-fingerprint"
+	clientFingerprintsKey          = "client-fingerprints"
+	fingerprintRotationKey         = "fingerprint-rotation"
+	fingerprintRotationIntervalKey = "fingerprint-rotation-interval"
+
+	defaultFingerprintInterval = 10 * time.Minute
+)
+
+type FingerprintRotation string
+
+const (
+	FixedFingerprintRotation      FingerprintRotation = ""
+	ConnectionFingerprintRotation FingerprintRotation = "connection"
+	IntervalFingerprintRotation   FingerprintRotation = "interval"
+)
+
+// clientFingerprintTypes are the outbounds that take the client-fingerprint key
+var clientFingerprintTypes = map[string]bool{"vmess": true, "vless": true, "trojan": true, "anytls": true}
+
+// ClientFingerprintOption lists the uTLS fingerprints of an outbound, the rotation picks a new one
+// for every connection or every interval seconds, without a rotation the first one stays
+type ClientFingerprintOption struct {
+	Fingerprints []string            `json:"fingerprints"`
+	Rotation     FingerprintRotation `json:"rotation"`
+	Interval     int64               `json:"interval"`
+}
+
+type FingerprintParams struct {
+	Proxy string `json:"proxy"`
+	*ClientFingerprintOption
+}
+
+type FingerprintStatus struct {
+	ClientFingerprintOption
+	Current string `json:"current"`
+}
+
+func checkFingerprint(name string) error {
+	if name == "none" {
+		return nil
+	}
+	if _, ok := tlsC.GetFingerprint(name); !ok {
+		return fmt.Errorf("unknown client fingerprint %s", name)
+	}
+	return nil
+}
+
+func checkClientFingerprintOption(option *ClientFingerprintOption) error {
+	if len(option.Fingerprints) == 0 {
+		return fmt.Errorf("no client fingerprint")
+	}
+	for i, fingerprint := range option.Fingerprints {
+		option.Fingerprints[i] = strings.ToLower(strings.TrimSpace(fingerprint))
+		if err := checkFingerprint(option.Fingerprints[i]); err != nil {
+			return err
+		}
+	}
+	switch option.Rotation {
+	case FixedFingerprintRotation, ConnectionFingerprintRotation, IntervalFingerprintRotation:
+	default:
+		return fmt.Errorf("unknown fingerprint rotation %s", option.Rotation)
+	}
+	if option.Interval < 0 {
+		option.Interval = 0
+	}
+	return nil
+}
+
+// fingerprintVariants holds one outbound per fingerprint, they are built from the mapping of the
+// profile because mihomo reads the fingerprint of an outbound once when it is parsed
+type fingerprintVariants struct {
+	option   *ClientFingerprintOption
+	adapters []C.ProxyAdapter
+	next     atomic.Uint64
+}
+
+func (v *fingerprintVariants) close() {
+	for _, proxy := range v.adapters {
+		_ = proxy.Close()
+	}
+}
+
+func (v *fingerprintVariants) index() int {
+	switch v.option.Rotation {
+	case ConnectionFingerprintRotation:
+		return int((v.next.Add(1) - 1) % uint64(len(v.adapters)))
+	case IntervalFingerprintRotation:
+		interval := defaultFingerprintInterval
+		if v.option.Interval > 0 {
+			interval = time.Duration(v.option.Interval) * time.Second
+		}
+		return int(time.Now().UnixNano() / int64(interval) % int64(len(v.adapters)))
+	default:
+		return 0
+	}
+}
+
+// ClientFingerprints keeps the fingerprints of the profile proxies and the ones the app set
+// through setFingerprint, only proxies of the profile itself can be rebuilt
+type ClientFingerprints struct {
+	mutex     sync.Mutex
+	mappings  map[string]map[string]any
+	profile   map[string]*ClientFingerprintOption
+	overrides map[string]*ClientFingerprintOption
+	variants  map[string]*fingerprintVariants
+}
+
+var clientFingerprints = &ClientFingerprints{
+	mappings:  map[string]map[string]any{},
+	profile:   map[string]*ClientFingerprintOption{},
+	overrides: map[string]*ClientFingerprintOption{},
+	variants:  map[string]*fingerprintVariants{},
+}
+
+func rawClientFingerprintOption(mapping map[string]any) *ClientFingerprintOption {
+	fingerprints := rawStrings(mapping[clientFingerprintsKey])
+	if len(fingerprints) == 0 {
+		return nil
+	}
+	rotation, _ := mapping[fingerprintRotationKey].(string)
+	option := &ClientFingerprintOption{Fingerprints: fingerprints, Rotation: FingerprintRotation(rotation)}
+	switch interval := mapping[fingerprintRotationIntervalKey].(type) {
+	case int:
+		option.Interval = int64(interval)
+	case uint64:
+		option.Interval = int64(interval)
+	}
+	return option
+}
+
+// Prepare keeps a copy of the proxies taking a fingerprint, the first fingerprint of a list is
+// handed to mihomo so the outbound it builds is the first variant
+func (f *ClientFingerprints) Prepare(rawConfig *config.RawConfig) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, variants := range f.variants {
+		variants.close()
+	}
+	f.mappings = map[string]map[string]any{}
+	f.profile = map[string]*ClientFingerprintOption{}
+	f.variants = map[string]*fingerprintVariants{}
+	for _, mapping := range rawConfig.Proxy {
+		name, _ := mapping["name"].(string)
+		proxyType, _ := mapping["type"].(string)
+		option := rawClientFingerprintOption(mapping)
+		delete(mapping, clientFingerprintsKey)
+		delete(mapping, fingerprintRotationKey)
+		delete(mapping, fingerprintRotationIntervalKey)
+		if name == "" || !clientFingerprintTypes[proxyType] {
+			continue
+		}
+		if option != nil {
+			if err := checkClientFingerprintOption(option); err != nil {
+				log.Warnln("[Fingerprint] %s: %v", name, err)
+				option = nil
+			} else {
+				mapping[clientFingerprintKey] = option.Fingerprints[0]
+			}
+		}
+		copied := make(map[string]any, len(mapping))
+		for key, value := range mapping {
+			copied[key] = value
+		}
+		f.mappings[name] = copied
+		if option != nil {
+			f.profile[name] = option
+		}
+	}
+}
+
+func (f *ClientFingerprints) optionLocked(name string) (*ClientFingerprintOption, bool) {
+	if option, ok := f.overrides[name]; ok {
+		return option, true
+	}
+	option, ok := f.profile[name]
+	return option, ok
+}
+
+func (f *ClientFingerprints) buildLocked(name string, option *ClientFingerprintOption) (*fingerprintVariants, error) {
+	mapping, ok := f.mappings[name]
+	if !ok {
+		return nil, fmt.Errorf("proxy %s does not take a client fingerprint", name)
+	}
+	variants := &fingerprintVariants{option: option}
+	for _, fingerprint := range option.Fingerprints {
+		copied := make(map[string]any, len(mapping))
+		for key, value := range mapping {
+			copied[key] = value
+		}
+		copied[clientFingerprintKey] = fingerprint
+		proxy, err := adapter.ParseProxy(copied)
+		if err != nil {
+			variants.close()
+			return nil, fmt.Errorf("%s with %s: %w", name, fingerprint, err)
+		}
+		variants.adapters = append(variants.adapters, proxy.(*adapter.Proxy).ProxyAdapter)
+	}
+	return variants, nil
+}
+
+// Set replaces the fingerprints of a proxy until the next profile, no fingerprint restores the
+// ones of the profile
+func (f *ClientFingerprints) Set(params *FingerprintParams) error {
+	if params.ClientFingerprintOption != nil && len(params.Fingerprints) == 0 {
+		params.ClientFingerprintOption = nil
+	}
+	if params.ClientFingerprintOption != nil {
+		if err := checkClientFingerprintOption(params.ClientFingerprintOption); err != nil {
+			return err
+		}
+	}
+	runLock.Lock()
+	defer runLock.Unlock()
+	f.mutex.Lock()
+	if _, ok := f.mappings[params.Proxy]; !ok {
+		f.mutex.Unlock()
+		return fmt.Errorf("proxy %s does not take a client fingerprint", params.Proxy)
+	}
+	if params.ClientFingerprintOption == nil {
+		delete(f.overrides, params.Proxy)
+	} else {
+		f.overrides[params.Proxy] = params.ClientFingerprintOption
+	}
+	f.mutex.Unlock()
+	rewrapOutboundsLocked()
+	return nil
+}
+
+// wrap dials an outbound with several fingerprints through its variants, a single fingerprint of
+// the profile is already the one mihomo built
+func (f *ClientFingerprints) wrap(name string, proxy C.ProxyAdapter) C.ProxyAdapter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	option, override := f.optionLocked(name)
+	if option == nil || !override && len(option.Fingerprints) < 2 {
+		if variants, ok := f.variants[name]; ok {
+			variants.close()
+			delete(f.variants, name)
+		}
+		return proxy
+	}
+	variants, ok := f.variants[name]
+	if !ok || variants.option != option {
+		built, err := f.buildLocked(name, option)
+		if err != nil {
+			log.Warnln("[Fingerprint] %v", err)
+			return proxy
+		}
+		if ok {
+			variants.close()
+		}
+		variants = built
+		f.variants[name] = variants
+	}
+	return &fingerprintAdapter{ProxyAdapter: proxy, variants: variants}
+}
+
+func (f *ClientFingerprints) Status() map[string]*FingerprintStatus {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	status := map[string]*FingerprintStatus{}
+	for name := range f.mappings {
+		option, _ := f.optionLocked(name)
+		if option == nil {
+			continue
+		}
+		item := &FingerprintStatus{ClientFingerprintOption: *option, Current: option.Fingerprints[0]}
+		if proxy, ok := tunnel.ProxiesWithProviders()[name].(*adapter.Proxy); ok {
+			if wrapped, ok := findWrapped[*fingerprintAdapter](proxy.ProxyAdapter); ok {
+				item.Current = wrapped.current()
+			}
+		}
+		status[name] = item
+	}
+	return status
+}
+
+type fingerprintAdapter struct {
+	C.ProxyAdapter
+	variants *fingerprintVariants
+	last     atomic.Int64
+}
+
+func (a *fingerprintAdapter) Inner() C.ProxyAdapter {
+	return a.ProxyAdapter
+}
+
+func (a *fingerprintAdapter) pick() C.ProxyAdapter {
+	index := a.variants.index()
+	a.last.Store(int64(index))
+	return a.variants.adapters[index]
+}
+
+func (a *fingerprintAdapter) current() string {
+	return a.variants.option.Fingerprints[a.last.Load()]
+}
+
+func (a *fingerprintAdapter) DialContext(ctx context.Context, metadata *C.Metadata) (C.Conn, error) {
+	return a.pick().DialContext(ctx, metadata)
+}
+
+func (a *fingerprintAdapter) DialContextWithDialer(ctx context.Context, dialer C.Dialer, metadata *C.Metadata) (C.Conn, error) {
+	return a.pick().DialContextWithDialer(ctx, dialer, metadata)
+}
+
+func (a *fingerprintAdapter) ListenPacketContext(ctx context.Context, metadata *C.Metadata) (C.PacketConn, error) {
+	return a.pick().ListenPacketContext(ctx, metadata)
+}
+
+func (a *fingerprintAdapter) ListenPacketWithDialer(ctx context.Context, dialer C.Dialer, metadata *C.Metadata) (C.PacketConn, error) {
+	return a.pick().ListenPacketWithDialer(ctx, dialer, metadata)
+}
+
+func (a *fingerprintAdapter) MarshalJSON() ([]byte, error) {
+	data, err := a.ProxyAdapter.MarshalJSON()
+	if err != nil {
+		return data, err
+	}
+	mapping := map[string]any{}
+	_ = json.Unmarshal(data, &mapping)
+	mapping[clientFingerprintKey] = a.current()
+	return json.Marshal(mapping)
+}
+
+func handleSetFingerprint(paramsString string) error {
+	var params = &FingerprintParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	return clientFingerprints.Set(params)
+}
+
+func handleGetFingerprints() string {
+	data, err := json.Marshal(clientFingerprints.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
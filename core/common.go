@@ -16,12 +16,12 @@ import (
 	"github.com/metacubex/mihomo/constant"
 	"github.com/metacubex/mihomo/constant/features"
 	cp "github.com/metacubex/mihomo/constant/provider"
-	"github.com/metacubex/mihomo/hub"
-	"github.com/metacubex/mihomo/hub/route"
 	"github.com/metacubex/mihomo/listener"
 	"github.com/metacubex/mihomo/log"
 	rp "github.com/metacubex/mihomo/rules/provider"
 	"github.com/metacubex/mihomo/tunnel"
+	"gopkg.in/yaml.v3"
+	"io"
 	"os"
 	"sync"
 )
@@ -113,27 +113,32 @@ func updateListeners() {
 	}
 	listeners := currentConfig.Listeners
 	general := currentConfig.General
-	listener.PatchInboundListeners(listeners, tunnel.Tunnel, true)
+	listener.PatchInboundListeners(listeners, lanTunnel, true)
 	listener.SetAllowLan(general.AllowLan)
 	inbound.SetSkipAuthPrefixes(general.SkipAuthPrefixes)
 	inbound.SetAllowedIPs(general.LanAllowedIPs)
 	inbound.SetDisAllowedIPs(general.LanDisAllowedIPs)
 	listener.SetBindAddress(general.BindAddress)
-	listener.ReCreateHTTP(general.Port, tunnel.Tunnel)
-	listener.ReCreateSocks(general.SocksPort, tunnel.Tunnel)
-	listener.ReCreateRedir(general.RedirPort, tunnel.Tunnel)
-	listener.ReCreateTProxy(general.TProxyPort, tunnel.Tunnel)
-	listener.ReCreateMixed(general.MixedPort, tunnel.Tunnel)
-	listener.ReCreateShadowSocks(general.ShadowSocksConfig, tunnel.Tunnel)
-	listener.ReCreateVmess(general.VmessConfig, tunnel.Tunnel)
-	listener.ReCreateTuic(general.TuicServer, tunnel.Tunnel)
+	listener.ReCreateHTTP(general.Port, lanTunnel)
+	listener.ReCreateSocks(general.SocksPort, lanTunnel)
+	listener.ReCreateRedir(general.RedirPort, lanTunnel)
+	listener.ReCreateTProxy(general.TProxyPort, lanTunnel)
+	listener.ReCreateMixed(general.MixedPort, lanTunnel)
+	listener.ReCreateShadowSocks(general.ShadowSocksConfig, lanTunnel)
+	listener.ReCreateVmess(general.VmessConfig, lanTunnel)
+	listener.ReCreateTuic(general.TuicServer, lanTunnel)
 	if !features.Android {
-		listener.ReCreateTun(general.Tun, tunnel.Tunnel)
+		listener.ReCreateTun(tunHelper.Apply(general.Tun), tunTunnel)
+		go publishTunState()
 	}
+	splitTunnel.Sync()
+	portForwards.Sync()
 }
 
 func stopListeners() {
 	listener.StopListener()
+	splitTunnel.Clear()
+	portForwards.Close()
 }
 
 func patchSelectGroup(mapping map[string]string) {
@@ -157,6 +162,21 @@ func patchSelectGroup(mapping map[string]string) {
 	}
 }
 
+// groupMembers returns the proxies of a group, or nil when name is not a group
+func groupMembers(proxies map[string]constant.Proxy, name string) []constant.Proxy {
+	group, ok := proxies[name].(*adapter.Proxy)
+	if !ok {
+		return nil
+	}
+	members, ok := group.ProxyAdapter.(interface {
+		GetProxies(touch bool) []constant.Proxy
+	})
+	if !ok {
+		return nil
+	}
+	return members.GetProxies(false)
+}
+
 func defaultSetupParams() *SetupParams {
 	return &SetupParams{
 		Config:      config.DefaultRawConfig(),
@@ -177,6 +197,19 @@ func readFile(path string) ([]byte, error) {
 	return data, err
 }
 
+func readSecureRawConfig(profileId string) (*config.RawConfig, error) {
+	var rawConfig *config.RawConfig
+	err := WithSecureProfileContentReader(profileId, func(r io.Reader) error {
+		rawConfig = config.DefaultRawConfig()
+		if err := yaml.NewDecoder(r).Decode(rawConfig); err != nil && err != io.EOF {
+			rawConfig = nil
+			return err
+		}
+		return nil
+	})
+	return rawConfig, err
+}
+
 func updateConfig(params *UpdateParams) {
 	runLock.Lock()
 	defer runLock.Unlock()
@@ -184,6 +217,15 @@ func updateConfig(params *UpdateParams) {
 	if params.MixedPort != nil {
 		general.MixedPort = *params.MixedPort
 	}
+	if params.RedirPort != nil {
+		general.RedirPort = *params.RedirPort
+	}
+	if params.TProxyPort != nil {
+		general.TProxyPort = *params.TProxyPort
+	}
+	if params.AllowLan != nil {
+		general.AllowLan = *params.AllowLan
+	}
 	if params.Sniffing != nil {
 		general.Sniffing = *params.Sniffing
 		tunnel.SetSniffing(general.Sniffing)
@@ -200,6 +242,10 @@ func updateConfig(params *UpdateParams) {
 		general.Interface = *params.Interface
 		dialer.DefaultInterface.Store(general.Interface)
 	}
+	if params.RoutingMark != nil {
+		general.RoutingMark = *params.RoutingMark
+		dialer.DefaultRoutingMark.Store(int32(general.RoutingMark))
+	}
 	if params.UnifiedDelay != nil {
 		general.UnifiedDelay = *params.UnifiedDelay
 		adapter.UnifiedDelay.Store(general.UnifiedDelay)
@@ -210,7 +256,7 @@ func updateConfig(params *UpdateParams) {
 	}
 	if params.LogLevel != nil {
 		general.LogLevel = *params.LogLevel
-		log.SetLevel(general.LogLevel)
+		powerState.SetLogLevel(general.LogLevel)
 	}
 	if params.IPv6 != nil {
 		general.IPv6 = *params.IPv6
@@ -218,9 +264,7 @@ func updateConfig(params *UpdateParams) {
 	}
 	if params.ExternalController != nil {
 		currentConfig.Controller.ExternalController = *params.ExternalController
-		route.ReCreateServer(&route.Config{
-			Addr: currentConfig.Controller.ExternalController,
-		})
+		applyExternalController()
 	}
 
 	if params.Tun != nil {
@@ -230,6 +274,12 @@ func updateConfig(params *UpdateParams) {
 		general.Tun.RouteAddress = *params.Tun.RouteAddress
 		general.Tun.DNSHijack = *params.Tun.DNSHijack
 		general.Tun.Stack = *params.Tun.Stack
+		if params.Tun.GSO != nil {
+			general.Tun.GSO = *params.Tun.GSO
+		}
+		if params.Tun.GSOMaxSize != nil {
+			general.Tun.GSOMaxSize = *params.Tun.GSOMaxSize
+		}
 	}
 
 	updateListeners()
@@ -240,11 +290,73 @@ func setupConfig(params *SetupParams) error {
 	defer runLock.Unlock()
 	var err error
 	constant.DefaultTestURL = params.TestURL
-	currentConfig, err = config.ParseRawConfig(params.Config)
+	quotas.SetProfile(params.ProfileId)
+	automation.SetProfile(params.ProfileId)
+	groupStates.Switch(params.ProfileId)
+	err = renderProfileTemplates(params.ProfileId, params.Config)
+	rules := params.Config.Rule
+	// a config the templates left half rendered is never handed to the features
+	if err == nil {
+		params.Config.Rule = rewritePackageRules(rules)
+		for name, subRules := range params.Config.SubRules {
+			params.Config.SubRules[name] = rewritePackageRules(subRules)
+		}
+		profileCache.CompileLocked(params.Config)
+		fakeIpStore.Prepare(params.Config)
+		udpOverTcp.Prepare(params.Config)
+		loadBalancing.Prepare(params.Config)
+		smartGroups.Prepare(params.Config)
+		geofences.Prepare(params.Config)
+		groupFilters.Prepare(params.Config)
+		certPinning.Prepare(params.Config)
+		obfsTransportLayers.Prepare(params.Config)
+		reality.Prepare(params.Config)
+		clientFingerprints.Prepare(params.Config)
+		encryptedClientHello.Prepare(params.Config)
+		tcpOptions.Prepare(params.Config)
+		startup.PrepareLocked(params.Config)
+		err = resolveSecretFields(params.Config)
+	}
+	if err == nil {
+		err = rewriteEncryptedDnsServers(&params.Config.DNS)
+	}
+	if err == nil {
+		err = setupNat64(params.Nat64)
+	}
+	if err == nil {
+		currentConfig, err = config.ParseRawConfig(params.Config)
+	}
 	if err != nil {
 		currentConfig, _ = config.ParseRawConfig(config.DefaultRawConfig())
+		rules = nil
+	}
+	currentConfig.Rules = domainMatcher.CompileLocked(currentConfig.Rules, currentConfig.SubRules)
+	nat64.PrepareTun(&currentConfig.General.Tun)
+	startup.ApplyLocked(currentConfig)
+	powerState.ApplyLocked()
+	inboundUsers.Apply(currentConfig.Users)
+	connectionTuning.ApplyKeepAlive()
+	rewrapOutboundsLocked()
+	geofences.Resolve()
+	installDnsCache()
+	installDns64()
+	installDnsLog()
+	if sniffErr := sniffing.ApplyLocked(); sniffErr != nil {
+		log.Errorln("apply sniffing error %v", sniffErr)
+	}
+	if rewriteErr := httpRewriter.Load(params.ProfileId); rewriteErr != nil {
+		log.Errorln("load http rewrite error %v", rewriteErr)
+	}
+	dnsHealth.Reset(currentConfig.DNS)
+	dnsGuard.Reset(currentConfig.DNS)
+	currentRules = append([]string{}, rules...)
+	if appFilter.Mode != OffAppFilterMode || routingRule() != nil || captivePortal.Bypassing() {
+		if filterErr := applyRulesLocked(currentRules); filterErr != nil {
+			log.Errorln("apply app filter error %v", filterErr)
+		}
 	}
-	hub.ApplyConfig(currentConfig)
+	proxyChains.ApplyLocked()
+	groupStates.Restore()
 	patchSelectGroup(params.SelectedMap)
 	updateListeners()
 	return err
@@ -0,0 +1,307 @@
+package main
+
+import (
+	b "bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/config"
+	"gopkg.in/yaml.v3"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type DiagnosticSeverity string
+
+const (
+	ErrorSeverity   DiagnosticSeverity = "error"
+	WarningSeverity DiagnosticSeverity = "warning"
+)
+
+// ConfigDiagnostic is a problem of a profile located by field path and source line
+type ConfigDiagnostic struct {
+	Severity DiagnosticSeverity `json:"severity"`
+	Path     string             `json:"path"`
+	Line     int                `json:"line"`
+	Column   int                `json:"column"`
+	Message  string             `json:"message"`
+}
+
+type ValidateProfileParams struct {
+	ProfileId string `json:"profile-id"`
+	Path      string `json:"path"`
+}
+
+var (
+	builtinProxies   = []string{"DIRECT", "REJECT", "REJECT-DROP", "PASS", "COMPATIBLE"}
+	proxyTypes       = []string{"ss", "ssr", "socks5", "http", "vmess", "vless", "snell", "trojan", "hysteria", "hysteria2", "wireguard", "tuic", "direct", "dns", "reject", "ssh", "mieru", "anytls"}
+	proxyGroupTypes  = []string{"select", "url-test", "fallback", "load-balance", "relay"}
+	yamlLinePattern  = regexp.MustCompile(`line (\d+)`)
+	targetlessRules  = []string{"AND", "OR", "NOT", "SUB-RULE", "DOMAIN-REGEX", "PROCESS-NAME-REGEX", "PROCESS-PATH-REGEX"}
+	nestedRuleFields = regexp.MustCompile(`(?i)\(\s*RULE-SET\s*,\s*([^,)]+)`)
+)
+
+type configDiagnoser struct {
+	root        *yaml.Node
+	diagnostics []ConfigDiagnostic
+}
+
+func (d *configDiagnoser) add(severity DiagnosticSeverity, message string, path ...any) {
+	diagnostic := ConfigDiagnostic{
+		Severity: severity,
+		Path:     formatConfigPath(path),
+		Message:  message,
+	}
+	if node := yamlNodeAt(d.root, path...); node != nil {
+		diagnostic.Line, diagnostic.Column = node.Line, node.Column
+	}
+	d.diagnostics = append(d.diagnostics, diagnostic)
+}
+
+// DiagnoseConfig parses a profile and reports every error and warning found instead of the first
+func DiagnoseConfig(bytes []byte) []ConfigDiagnostic {
+	return DiagnoseConfigReader(b.NewReader(bytes))
+}
+
+// DiagnoseConfigReader diagnoses a streamed profile, the config is decoded from the parsed document
+// so the profile is read once
+func DiagnoseConfigReader(r io.Reader) []ConfigDiagnostic {
+	d := &configDiagnoser{diagnostics: []ConfigDiagnostic{}}
+	document := &yaml.Node{}
+	if err := yaml.NewDecoder(r).Decode(document); err != nil && err != io.EOF {
+		d.diagnostics = append(d.diagnostics, yamlDiagnostic(err))
+		return d.diagnostics
+	}
+	rawConfig := config.DefaultRawConfig()
+	if len(document.Content) != 0 {
+		d.root = document.Content[0]
+		if err := document.Decode(rawConfig); err != nil {
+			d.diagnostics = append(d.diagnostics, yamlDiagnostic(err))
+			return d.diagnostics
+		}
+	}
+
+	names := map[string]bool{}
+	for _, name := range builtinProxies {
+		names[name] = true
+	}
+	declare := func(name string, path ...any) {
+		if name == "" {
+			d.add(ErrorSeverity, "name is required", path...)
+			return
+		}
+		if names[name] {
+			d.add(ErrorSeverity, fmt.Sprintf("duplicate name %q", name), append(path, "name")...)
+			return
+		}
+		names[name] = true
+	}
+
+	for index, mapping := range rawConfig.Proxy {
+		name, _ := mapping["name"].(string)
+		declare(name, "proxies", index)
+		if proxyType, _ := mapping["type"].(string); !containsString(proxyTypes, proxyType) {
+			d.add(ErrorSeverity, fmt.Sprintf("unknown proxy type %q", proxyType), "proxies", index, "type")
+		}
+	}
+	for _, proxyError := range ValidateProxies(rawConfig) {
+		path := []any{"proxies", proxyError.Index}
+		if proxyError.Field != "" {
+			path = append(path, proxyError.Field)
+		}
+		if strings.Contains(proxyError.Message, "unsupport proxy type") {
+			continue
+		}
+		d.add(ErrorSeverity, proxyError.Message, path...)
+	}
+	for index, mapping := range rawConfig.ProxyGroup {
+		name, _ := mapping["name"].(string)
+		declare(name, "proxy-groups", index)
+		if groupType, _ := mapping["type"].(string); !containsString(proxyGroupTypes, groupType) {
+			d.add(ErrorSeverity, fmt.Sprintf("unknown group type %q", groupType), "proxy-groups", index, "type")
+		}
+	}
+
+	for index, mapping := range rawConfig.ProxyGroup {
+		members, _ := mapping["proxies"].([]any)
+		for i, member := range members {
+			if name := fmt.Sprint(member); !names[name] {
+				d.add(ErrorSeverity, fmt.Sprintf("proxy or group %q not found", name), "proxy-groups", index, "proxies", i)
+			}
+		}
+		uses, _ := mapping["use"].([]any)
+		for i, use := range uses {
+			if _, ok := rawConfig.ProxyProvider[fmt.Sprint(use)]; !ok {
+				d.add(ErrorSeverity, fmt.Sprintf("proxy provider %q not found", use), "proxy-groups", index, "use", i)
+			}
+		}
+		includeAll, _ := mapping["include-all"].(bool)
+		includeProxies, _ := mapping["include-all-proxies"].(bool)
+		includeProviders, _ := mapping["include-all-providers"].(bool)
+		if len(members) == 0 && len(uses) == 0 && !includeAll && !includeProxies && !includeProviders {
+			d.add(ErrorSeverity, "group has no proxies or providers", "proxy-groups", index)
+		}
+	}
+
+	for index, line := range rawConfig.Rule {
+		d.diagnoseRule(line, names, rawConfig, "rules", index)
+	}
+	for name, rules := range rawConfig.SubRules {
+		for index, line := range rules {
+			d.diagnoseRule(line, names, rawConfig, "sub-rules", name, index)
+		}
+	}
+	if len(rawConfig.Rule) == 0 {
+		d.add(WarningSeverity, "profile has no rules, all traffic goes DIRECT in rule mode", "rules")
+	} else if last := strings.ToUpper(strings.TrimSpace(strings.SplitN(rawConfig.Rule[len(rawConfig.Rule)-1], ",", 2)[0])); last != "MATCH" {
+		d.add(WarningSeverity, "last rule is not MATCH, unmatched traffic goes DIRECT in rule mode", "rules", len(rawConfig.Rule)-1)
+	}
+	return d.diagnostics
+}
+
+func (d *configDiagnoser) diagnoseRule(line string, names map[string]bool, rawConfig *config.RawConfig, path ...any) {
+	fields := trimRuleFields(strings.Split(rewritePackageRule(line), ","))
+	ruleType := strings.ToUpper(fields[0])
+	if len(fields) < 2 {
+		d.add(ErrorSeverity, "rule format invalid", path...)
+		return
+	}
+	target := fields[len(fields)-1]
+	if !containsString(targetlessRules, ruleType) && ruleType != "MATCH" && len(fields) >= 3 {
+		target = fields[2]
+	} else if ruleType == "MATCH" {
+		target = fields[1]
+	}
+	if ruleType == "SUB-RULE" {
+		if _, ok := rawConfig.SubRules[target]; !ok {
+			d.add(ErrorSeverity, fmt.Sprintf("sub-rule %q not found", target), path...)
+		}
+	} else if !names[target] {
+		d.add(ErrorSeverity, fmt.Sprintf("proxy or group %q not found", target), path...)
+	}
+
+	var providers []string
+	if ruleType == "RULE-SET" {
+		providers = append(providers, fields[1])
+	}
+	for _, match := range nestedRuleFields.FindAllStringSubmatch(line, -1) {
+		providers = append(providers, strings.TrimSpace(match[1]))
+	}
+	for _, provider := range providers {
+		if _, ok := rawConfig.RuleProvider[provider]; !ok {
+			d.add(ErrorSeverity, fmt.Sprintf("rule provider %q not found", provider), path...)
+		}
+	}
+}
+
+// yamlDiagnostic converts a yaml error, which carries the line only in its text
+func yamlDiagnostic(err error) ConfigDiagnostic {
+	diagnostic := ConfigDiagnostic{
+		Severity: ErrorSeverity,
+		Message:  err.Error(),
+	}
+	var typeError *yaml.TypeError
+	if errors.As(err, &typeError) && len(typeError.Errors) != 0 {
+		diagnostic.Message = typeError.Errors[0]
+	}
+	if match := yamlLinePattern.FindStringSubmatch(diagnostic.Message); match != nil {
+		diagnostic.Line, _ = strconv.Atoi(match[1])
+	}
+	return diagnostic
+}
+
+// yamlNodeAt walks mapping keys and sequence indexes, returning the deepest node found
+func yamlNodeAt(node *yaml.Node, path ...any) *yaml.Node {
+	for _, segment := range path {
+		if node == nil {
+			return nil
+		}
+		var next *yaml.Node
+		switch key := segment.(type) {
+		case string:
+			if node.Kind != yaml.MappingNode {
+				return node
+			}
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == key {
+					next = node.Content[i+1]
+					break
+				}
+			}
+		case int:
+			if node.Kind == yaml.SequenceNode && key >= 0 && key < len(node.Content) {
+				next = node.Content[key]
+			}
+		}
+		if next == nil {
+			return node
+		}
+		node = next
+	}
+	return node
+}
+
+func formatConfigPath(path []any) string {
+	builder := strings.Builder{}
+	for _, segment := range path {
+		switch key := segment.(type) {
+		case int:
+			builder.WriteString("[" + strconv.Itoa(key) + "]")
+		default:
+			if builder.Len() != 0 {
+				builder.WriteByte('.')
+			}
+			builder.WriteString(fmt.Sprint(key))
+		}
+	}
+	return builder.String()
+}
+
+// ValidateProfile diagnoses a profile from the secure cache or, when not cached, from path
+func ValidateProfile(params *ValidateProfileParams) ([]ConfigDiagnostic, error) {
+	var diagnostics []ConfigDiagnostic
+	if params.ProfileId != "" && GetSecureMemoryService().IsProfileSecured(params.ProfileId) {
+		err := WithSecureProfileContentReader(params.ProfileId, func(r io.Reader) error {
+			diagnostics = DiagnoseConfigReader(r)
+			return nil
+		})
+		return diagnostics, err
+	}
+	if params.Path == "" {
+		return nil, fmt.Errorf("profile %s not found", params.ProfileId)
+	}
+	bytes, err := readFile(params.Path)
+	if err != nil {
+		return nil, err
+	}
+	if HasEncryptionHeader(bytes) {
+		if getEncryptionService() == nil {
+			return nil, errNoKeyProvider
+		}
+		plain, err := getEncryptionService().Decrypt(bytes)
+		if err != nil {
+			return nil, err
+		}
+		defer clearBytes(plain)
+		bytes = plain
+	}
+	return DiagnoseConfig(bytes), nil
+}
+
+func handleValidateProfile(paramsString string) (string, error) {
+	var params = &ValidateProfileParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return "", err
+	}
+	diagnostics, err := ValidateProfile(params)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(diagnostics)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/metacubex/mihomo/tunnel/statistic"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFeedLimit    = 100
+	maxFeedLimit        = 1000
+	defaultFeedInterval = time.Second
+	minFeedInterval     = 250 * time.Millisecond
+)
+
+type ConnectionSort string
+
+const (
+	StartConnectionSort         ConnectionSort = "start"
+	HostConnectionSort          ConnectionSort = "host"
+	ProcessConnectionSort       ConnectionSort = "process"
+	ProxyConnectionSort         ConnectionSort = "proxy"
+	RuleConnectionSort          ConnectionSort = "rule"
+	UploadConnectionSort        ConnectionSort = "upload"
+	DownloadConnectionSort      ConnectionSort = "download"
+	UploadSpeedConnectionSort   ConnectionSort = "upload-speed"
+	DownloadSpeedConnectionSort ConnectionSort = "download-speed"
+)
+
+// ConnectionFeedParams is one page of the connections list, the core sorts and pages so the app
+// only ever holds what it shows
+type ConnectionFeedParams struct {
+	Sort   ConnectionSort `json:"sort"`
+	Desc   bool           `json:"desc"`
+	Offset int            `json:"offset"`
+	Limit  int            `json:"limit"`
+	Filter *StreamFilter  `json:"filter"`
+	// Interval is the milliseconds between two frames
+	Interval int64 `json:"interval"`
+}
+
+type ConnectionFeedUpdateParams struct {
+	Subscription string `json:"subscription"`
+	ConnectionFeedParams
+}
+
+// ConnectionRow is a connection of the page with the speed it had since the frame before
+type ConnectionRow struct {
+	*statistic.TrackerInfo
+	UploadSpeed   int64 `json:"upload-speed"`
+	DownloadSpeed int64 `json:"download-speed"`
+}
+
+type ConnectionRowUpdate struct {
+	ConnectionUpdate
+	UploadSpeed   int64 `json:"upload-speed"`
+	DownloadSpeed int64 `json:"download-speed"`
+}
+
+// ConnectionsFrame changes the page the app holds, Order comes with every full frame and whenever
+// the page was sorted differently, a gap in Seq asks for a resync
+type ConnectionsFrame struct {
+	Subscription  string                `json:"subscription"`
+	Seq           uint64                `json:"seq"`
+	Full          bool                  `json:"full"`
+	Total         int                   `json:"total"`
+	DownloadTotal int64                 `json:"downloadTotal"`
+	UploadTotal   int64                 `json:"uploadTotal"`
+	Order         []string              `json:"order,omitempty"`
+	Added         []ConnectionRow       `json:"added"`
+	Updated       []ConnectionRowUpdate `json:"updated"`
+	Removed       []string              `json:"removed"`
+}
+
+type connectionFeed struct {
+	id       string
+	params   ConnectionFeedParams
+	filter   *StreamFilter
+	seq      uint64
+	full     bool
+	sampled  time.Time
+	previous map[string]connectionCounters
+	known    map[string]connectionCounters
+	order    []string
+	total    int
+	cancel   context.CancelFunc
+}
+
+type ConnectionFeeds struct {
+	mutex  sync.Mutex
+	feeds  map[string]*connectionFeed
+	nextId uint64
+}
+
+var connectionFeeds = &ConnectionFeeds{feeds: map[string]*connectionFeed{}}
+
+func (p *ConnectionFeedParams) normalize() error {
+	switch p.Sort {
+	case "":
+		p.Sort = StartConnectionSort
+	case StartConnectionSort, HostConnectionSort, ProcessConnectionSort, ProxyConnectionSort, RuleConnectionSort,
+		UploadConnectionSort, DownloadConnectionSort, UploadSpeedConnectionSort, DownloadSpeedConnectionSort:
+	default:
+		return fmt.Errorf("unsupported sort %s", p.Sort)
+	}
+	if p.Offset < 0 {
+		p.Offset = 0
+	}
+	if p.Limit <= 0 {
+		p.Limit = defaultFeedLimit
+	}
+	if p.Limit > maxFeedLimit {
+		p.Limit = maxFeedLimit
+	}
+	return nil
+}
+
+func (p *ConnectionFeedParams) interval() time.Duration {
+	interval := time.Duration(p.Interval) * time.Millisecond
+	if interval <= 0 {
+		interval = defaultFeedInterval
+	}
+	if interval < minFeedInterval {
+		interval = minFeedInterval
+	}
+	return interval
+}
+
+func connectionSortText(info *statistic.TrackerInfo, by ConnectionSort) string {
+	metadata := info.Metadata
+	switch by {
+	case HostConnectionSort:
+		if metadata == nil {
+			return ""
+		}
+		if metadata.Host != "" {
+			return strings.ToLower(metadata.Host)
+		}
+		return metadata.DstIP.String()
+	case ProcessConnectionSort:
+		if metadata == nil {
+			return ""
+		}
+		return strings.ToLower(metadata.Process)
+	case ProxyConnectionSort:
+		if len(info.Chain) == 0 {
+			return ""
+		}
+		return strings.ToLower(info.Chain[0])
+	case RuleConnectionSort:
+		return strings.ToLower(info.Rule)
+	}
+	return ""
+}
+
+// sortRows orders the rows of a frame, ties fall back to the id so a page does not shuffle
+func sortRows(rows []ConnectionRow, by ConnectionSort, desc bool) {
+	number := func(row ConnectionRow) (int64, bool) {
+		switch by {
+		case StartConnectionSort:
+			return row.Start.UnixNano(), true
+		case UploadConnectionSort:
+			return row.UploadTotal.Load(), true
+		case DownloadConnectionSort:
+			return row.DownloadTotal.Load(), true
+		case UploadSpeedConnectionSort:
+			return row.UploadSpeed, true
+		case DownloadSpeedConnectionSort:
+			return row.DownloadSpeed, true
+		}
+		return 0, false
+	}
+	texts := make(map[*statistic.TrackerInfo]string, len(rows))
+	for _, row := range rows {
+		if _, ok := number(row); !ok {
+			texts[row.TrackerInfo] = connectionSortText(row.TrackerInfo, by)
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		left, right := rows[i], rows[j]
+		compare := 0
+		if a, ok := number(left); ok {
+			b, _ := number(right)
+			switch {
+			case a < b:
+				compare = -1
+			case a > b:
+				compare = 1
+			}
+		} else {
+			compare = strings.Compare(texts[left.TrackerInfo], texts[right.TrackerInfo])
+		}
+		if compare == 0 {
+			return left.UUID.String() < right.UUID.String()
+		}
+		if desc {
+			return compare > 0
+		}
+		return compare < 0
+	})
+}
+
+func sameOrder(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for index := range a {
+		if a[index] != b[index] {
+			return false
+		}
+	}
+	return true
+}
+
+// frameLocked is the change of the page since the frame before, nil when nothing changed
+func (f *connectionFeed) frameLocked(snapshot *statistic.Snapshot, now time.Time) *ConnectionsFrame {
+	elapsed := now.Sub(f.sampled)
+	counters := make(map[string]connectionCounters, len(snapshot.Connections))
+	rows := make([]ConnectionRow, 0, len(snapshot.Connections))
+	for _, info := range snapshot.Connections {
+		id := info.UUID.String()
+		current := connectionCounters{
+			upload:   info.UploadTotal.Load(),
+			download: info.DownloadTotal.Load(),
+		}
+		counters[id] = current
+		if f.filter != nil && !f.filter.matchesConnection(info) {
+			continue
+		}
+		row := ConnectionRow{TrackerInfo: info}
+		if previous, ok := f.previous[id]; ok && elapsed > 0 {
+			row.UploadSpeed = (current.upload - previous.upload) * int64(time.Second) / int64(elapsed)
+			row.DownloadSpeed = (current.download - previous.download) * int64(time.Second) / int64(elapsed)
+		}
+		rows = append(rows, row)
+	}
+	f.previous = counters
+	f.sampled = now
+	sortRows(rows, f.params.Sort, f.params.Desc)
+	total := len(rows)
+	start := f.params.Offset
+	if start > total {
+		start = total
+	}
+	end := start + f.params.Limit
+	if end > total {
+		end = total
+	}
+	page := rows[start:end]
+	frame := &ConnectionsFrame{
+		Subscription:  f.id,
+		Full:          f.full,
+		Total:         total,
+		DownloadTotal: snapshot.DownloadTotal,
+		UploadTotal:   snapshot.UploadTotal,
+		Added:         []ConnectionRow{},
+		Updated:       []ConnectionRowUpdate{},
+		Removed:       []string{},
+	}
+	known := make(map[string]connectionCounters, len(page))
+	order := make([]string, 0, len(page))
+	for _, row := range page {
+		id := row.UUID.String()
+		current := counters[id]
+		known[id] = current
+		order = append(order, id)
+		previous, ok := f.known[id]
+		switch {
+		case !ok || f.full:
+			frame.Added = append(frame.Added, row)
+		case previous != current:
+			frame.Updated = append(frame.Updated, ConnectionRowUpdate{
+				ConnectionUpdate: ConnectionUpdate{
+					Id:       id,
+					Upload:   current.upload,
+					Download: current.download,
+				},
+				UploadSpeed:   row.UploadSpeed,
+				DownloadSpeed: row.DownloadSpeed,
+			})
+		}
+	}
+	if !f.full {
+		for id := range f.known {
+			if _, ok := known[id]; !ok {
+				frame.Removed = append(frame.Removed, id)
+			}
+		}
+	}
+	ordered := !sameOrder(order, f.order)
+	if f.full || ordered {
+		frame.Order = order
+	}
+	changed := f.full || ordered || total != f.total || len(frame.Added) != 0 || len(frame.Updated) != 0 || len(frame.Removed) != 0
+	f.known = known
+	f.order = order
+	f.total = total
+	f.full = false
+	if !changed {
+		return nil
+	}
+	f.seq++
+	frame.Seq = f.seq
+	return frame
+}
+
+func (c *ConnectionFeeds) tick(id string) {
+	snapshot := statistic.DefaultManager.Snapshot()
+	c.mutex.Lock()
+	feed, ok := c.feeds[id]
+	if !ok {
+		c.mutex.Unlock()
+		return
+	}
+	frame := feed.frameLocked(snapshot, time.Now())
+	c.mutex.Unlock()
+	if frame == nil {
+		return
+	}
+	sendMessage(Message{
+		Type: ConnectionsMessage,
+		Data: frame,
+	})
+}
+
+func (c *ConnectionFeeds) startLocked(feed *connectionFeed) {
+	if feed.cancel != nil {
+		feed.cancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	feed.cancel = cancel
+	interval := feed.params.interval()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(powerScaled(interval)):
+			}
+			runGuarded("connection-feed", func() {
+				c.tick(feed.id)
+			})
+		}
+	}()
+}
+
+// Subscribe answers with the first full frame, the ones after it come as messages
+func (c *ConnectionFeeds) Subscribe(params *ConnectionFeedParams) (*ConnectionsFrame, error) {
+	if err := params.normalize(); err != nil {
+		return nil, err
+	}
+	snapshot := statistic.DefaultManager.Snapshot()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.nextId++
+	feed := &connectionFeed{
+		id:     fmt.Sprintf("connections-%d", c.nextId),
+		params: *params,
+		filter: params.Filter.compile(),
+		full:   true,
+	}
+	c.feeds[feed.id] = feed
+	frame := feed.frameLocked(snapshot, time.Now())
+	c.startLocked(feed)
+	return frame, nil
+}
+
+// Update changes the sort or the page, the next frame is a full one
+func (c *ConnectionFeeds) Update(params *ConnectionFeedUpdateParams) error {
+	if err := params.normalize(); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	feed, ok := c.feeds[params.Subscription]
+	if !ok {
+		return fmt.Errorf("subscription %s not found", params.Subscription)
+	}
+	restart := feed.params.interval() != params.interval()
+	feed.params = params.ConnectionFeedParams
+	feed.filter = params.Filter.compile()
+	feed.full = true
+	if restart {
+		c.startLocked(feed)
+	}
+	return nil
+}
+
+// Resync makes the next frame a full one, the app lost one on the way
+func (c *ConnectionFeeds) Resync(id string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	feed, ok := c.feeds[id]
+	if !ok {
+		return fmt.Errorf("subscription %s not found", id)
+	}
+	feed.full = true
+	return nil
+}
+
+func (c *ConnectionFeeds) Unsubscribe(id string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	feed, ok := c.feeds[id]
+	if !ok {
+		return false
+	}
+	feed.cancel()
+	delete(c.feeds, id)
+	return true
+}
+
+func (c *ConnectionFeeds) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for id, feed := range c.feeds {
+		feed.cancel()
+		delete(c.feeds, id)
+	}
+}
+
+func handleSubscribeConnections(paramsString string) (string, error) {
+	params := &ConnectionFeedParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return "", err
+	}
+	frame, err := connectionFeeds.Subscribe(params)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func handleUpdateConnectionsSubscription(paramsString string) error {
+	params := &ConnectionFeedUpdateParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	return connectionFeeds.Update(params)
+}
+
+func handleResyncConnections(id string) error {
+	return connectionFeeds.Resync(id)
+}
+
+func handleUnsubscribeConnections(id string) bool {
+	return connectionFeeds.Unsubscribe(id)
+}
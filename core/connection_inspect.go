@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/metacubex/mihomo/tunnel/statistic"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConnectionDns is how the destination of a connection was resolved
+type ConnectionDns struct {
+	Mode              string `json:"mode"`
+	Host              string `json:"host"`
+	SniffHost         string `json:"sniff-host,omitempty"`
+	ResolvedIP        string `json:"resolved-ip,omitempty"`
+	RemoteDestination string `json:"remote-destination,omitempty"`
+}
+
+type ConnectionDetail struct {
+	Id          string         `json:"id"`
+	Network     string         `json:"network"`
+	Type        string         `json:"type"`
+	Source      string         `json:"source"`
+	Destination string         `json:"destination"`
+	Rule        string         `json:"rule"`
+	RulePayload string         `json:"rule-payload"`
+	Chain       []string       `json:"chain"`
+	Process     string         `json:"process"`
+	ProcessPath string         `json:"process-path"`
+	Uid         uint32         `json:"uid"`
+	Dns         ConnectionDns  `json:"dns"`
+	Upload      int64          `json:"upload"`
+	Download    int64          `json:"download"`
+	Start       int64          `json:"start"`
+	Age         int64          `json:"age"`
+	Pinned      bool           `json:"pinned"`
+	Uot         bool           `json:"uot"`
+	Dial        *DialTelemetry `json:"dial,omitempty"`
+	Ech         EchState       `json:"ech,omitempty"`
+}
+
+// ConnectionPins holds the connections that survive proxy switch cleanup
+type ConnectionPins struct {
+	mutex sync.Mutex
+	ids   map[string]struct{}
+}
+
+var connectionPins = &ConnectionPins{ids: map[string]struct{}{}}
+
+func (p *ConnectionPins) Pin(id string) bool {
+	if statistic.DefaultManager.Get(id) == nil {
+		return false
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.ids[id] = struct{}{}
+	return true
+}
+
+func (p *ConnectionPins) Unpin(id string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, ok := p.ids[id]; !ok {
+		return false
+	}
+	delete(p.ids, id)
+	return true
+}
+
+func (p *ConnectionPins) Pinned(id string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	_, ok := p.ids[id]
+	return ok
+}
+
+// prune forgets the pins of connections that are gone
+func (p *ConnectionPins) prune() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for id := range p.ids {
+		if statistic.DefaultManager.Get(id) == nil {
+			delete(p.ids, id)
+		}
+	}
+}
+
+func connectionDetail(tracker statistic.Tracker, now time.Time) *ConnectionDetail {
+	info := tracker.Info()
+	detail := &ConnectionDetail{
+		Id:          tracker.ID(),
+		Rule:        info.Rule,
+		RulePayload: info.RulePayload,
+		Chain:       append([]string{}, info.Chain...),
+		Upload:      info.UploadTotal.Load(),
+		Download:    info.DownloadTotal.Load(),
+		Start:       info.Start.UnixMilli(),
+		Age:         now.Sub(info.Start).Milliseconds(),
+		Pinned:      connectionPins.Pinned(tracker.ID()),
+		Uot:         isUdpOverTcp(info.Metadata, info.Chain),
+		Dial:        dialRacing.Telemetry(info.Metadata),
+		Ech:         encryptedClientHello.State(info.Metadata),
+	}
+	if metadata := info.Metadata; metadata != nil {
+		detail.Network = metadata.NetWork.String()
+		detail.Type = metadata.Type.String()
+		detail.Source = metadata.SourceAddress()
+		detail.Destination = metadata.RemoteAddress()
+		detail.Process = metadata.Process
+		detail.ProcessPath = metadata.ProcessPath
+		detail.Uid = metadata.Uid
+		detail.Dns = ConnectionDns{
+			Mode:              metadata.DNSMode.String(),
+			Host:              metadata.Host,
+			SniffHost:         metadata.SniffHost,
+			RemoteDestination: metadata.RemoteDst,
+		}
+		if metadata.DstIP.IsValid() {
+			detail.Dns.ResolvedIP = metadata.DstIP.String()
+		}
+	}
+	return detail
+}
+
+func handleInspectConnections() string {
+	connectionPins.prune()
+	now := time.Now()
+	details := make([]*ConnectionDetail, 0)
+	statistic.DefaultManager.Range(func(c statistic.Tracker) bool {
+		details = append(details, connectionDetail(c, now))
+		return true
+	})
+	sort.Slice(details, func(i, j int) bool {
+		return details[i].Start > details[j].Start
+	})
+	data, err := json.Marshal(details)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handleInspectConnection(id string) string {
+	tracker := statistic.DefaultManager.Get(id)
+	if tracker == nil {
+		return ""
+	}
+	data, err := json.Marshal(connectionDetail(tracker, time.Now()))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// handleCloseConnectionsByProxy closes the unpinned connections whose chain passes through the proxy or group
+func handleCloseConnectionsByProxy(name string) int {
+	runLock.Lock()
+	defer runLock.Unlock()
+	count := 0
+	statistic.DefaultManager.Range(func(c statistic.Tracker) bool {
+		if connectionPins.Pinned(c.ID()) {
+			return true
+		}
+		for _, proxy := range c.Info().Chain {
+			if proxy == name {
+				_ = c.Close()
+				count++
+				break
+			}
+		}
+		return true
+	})
+	return count
+}
+
+func handlePinConnection(id string) bool {
+	return connectionPins.Pin(id)
+}
+
+func handleUnpinConnection(id string) bool {
+	return connectionPins.Unpin(id)
+}
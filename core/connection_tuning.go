@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/metacubex/mihomo/component/keepalive"
+	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel/statistic"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	minConnectionReapInterval = time.Second
+	maxConnectionReapInterval = 30 * time.Second
+)
+
+// ConnectionTuningParams are in seconds, a nil keepalive field keeps what the profile set and a
+// zero timeout turns that limit off, pinned connections are never reaped
+type ConnectionTuningParams struct {
+	KeepAliveIdle     *int64 `json:"keep-alive-idle"`
+	KeepAliveInterval *int64 `json:"keep-alive-interval"`
+	DisableKeepAlive  *bool  `json:"disable-keep-alive"`
+	IdleTimeout       int64  `json:"idle-timeout"`
+	UdpIdleTimeout    int64  `json:"udp-idle-timeout"`
+	MaxLifetime       int64  `json:"max-lifetime"`
+}
+
+// SocketOptions are the settings new inbound and outbound sockets get right now
+type SocketOptions struct {
+	KeepAliveIdle     int64  `json:"keep-alive-idle"`
+	KeepAliveInterval int64  `json:"keep-alive-interval"`
+	DisableKeepAlive  bool   `json:"disable-keep-alive"`
+	KeepAliveForced   bool   `json:"keep-alive-forced"`
+	IdleTimeout       int64  `json:"idle-timeout"`
+	UdpIdleTimeout    int64  `json:"udp-idle-timeout"`
+	MaxLifetime       int64  `json:"max-lifetime"`
+	IdleClosed        int64  `json:"idle-closed"`
+	LifetimeClosed    int64  `json:"lifetime-closed"`
+	Platform          string `json:"platform"`
+}
+
+type connectionActivity struct {
+	upload   int64
+	download int64
+	active   time.Time
+}
+
+// ConnectionTuning applies the keepalive overrides after every setup and closes the tracked
+// connections that stay idle or outlive their maximum lifetime
+type ConnectionTuning struct {
+	mutex          sync.Mutex
+	params         ConnectionTuningParams
+	cancel         context.CancelFunc
+	activity       map[string]*connectionActivity
+	idleClosed     atomic.Int64
+	lifetimeClosed atomic.Int64
+}
+
+var connectionTuning = &ConnectionTuning{activity: map[string]*connectionActivity{}}
+
+func (t *ConnectionTuning) Set(params *ConnectionTuningParams) error {
+	settings := ConnectionTuningParams{}
+	if params != nil {
+		settings = *params
+	}
+	if (settings.KeepAliveIdle != nil && *settings.KeepAliveIdle < 0) ||
+		(settings.KeepAliveInterval != nil && *settings.KeepAliveInterval < 0) ||
+		settings.IdleTimeout < 0 || settings.UdpIdleTimeout < 0 || settings.MaxLifetime < 0 {
+		return errors.New("durations must not be negative")
+	}
+	t.mutex.Lock()
+	t.params = settings
+	t.mutex.Unlock()
+	t.ApplyKeepAlive()
+	t.Resume()
+	return nil
+}
+
+// ApplyKeepAlive overrides the keepalive the profile set, hub.ApplyConfig resets it on every setup
+func (t *ConnectionTuning) ApplyKeepAlive() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.params.KeepAliveIdle != nil {
+		keepalive.SetKeepAliveIdle(time.Duration(*t.params.KeepAliveIdle) * time.Second)
+	}
+	if t.params.KeepAliveInterval != nil {
+		keepalive.SetKeepAliveInterval(time.Duration(*t.params.KeepAliveInterval) * time.Second)
+	}
+	if t.params.DisableKeepAlive != nil {
+		keepalive.SetDisableKeepAlive(*t.params.DisableKeepAlive)
+	}
+}
+
+func (t *ConnectionTuning) reapInterval() time.Duration {
+	shortest := time.Duration(0)
+	for _, seconds := range []int64{t.params.IdleTimeout, t.params.UdpIdleTimeout, t.params.MaxLifetime} {
+		limit := time.Duration(seconds) * time.Second
+		if limit > 0 && (shortest == 0 || limit < shortest) {
+			shortest = limit
+		}
+	}
+	if shortest == 0 {
+		return 0
+	}
+	interval := shortest / 4
+	if interval < minConnectionReapInterval {
+		interval = minConnectionReapInterval
+	}
+	if interval > maxConnectionReapInterval {
+		interval = maxConnectionReapInterval
+	}
+	return interval
+}
+
+// Resume starts reaping when a limit is set, it is called again after a shutdown stopped it
+func (t *ConnectionTuning) Resume() {
+	t.Stop()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	interval := t.reapInterval()
+	if interval == 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.cancel = cancel
+	go func() {
+		ticker := time.NewTicker(powerScaled(interval))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			ticker.Reset(powerScaled(interval))
+			runGuarded("connection reaper", t.reap)
+		}
+	}()
+}
+
+// Stop ends reaping, the keepalive overrides stay in place
+func (t *ConnectionTuning) Stop() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.cancel != nil {
+		t.cancel()
+		t.cancel = nil
+	}
+	t.activity = map[string]*connectionActivity{}
+}
+
+func (t *ConnectionTuning) reap() {
+	t.mutex.Lock()
+	params := t.params
+	t.mutex.Unlock()
+	now := time.Now()
+	seen := map[string]struct{}{}
+	var idle, expired []statistic.Tracker
+	statistic.DefaultManager.Range(func(c statistic.Tracker) bool {
+		id := c.ID()
+		seen[id] = struct{}{}
+		info := c.Info()
+		upload, download := info.UploadTotal.Load(), info.DownloadTotal.Load()
+		t.mutex.Lock()
+		activity, ok := t.activity[id]
+		if !ok || activity.upload != upload || activity.download != download {
+			activity = &connectionActivity{upload: upload, download: download, active: now}
+			t.activity[id] = activity
+		}
+		t.mutex.Unlock()
+		if connectionPins.Pinned(id) {
+			return true
+		}
+		if params.MaxLifetime > 0 && now.Sub(info.Start) > time.Duration(params.MaxLifetime)*time.Second {
+			expired = append(expired, c)
+			return true
+		}
+		idleTimeout := params.IdleTimeout
+		if info.Metadata != nil && info.Metadata.NetWork == C.UDP && params.UdpIdleTimeout > 0 {
+			idleTimeout = params.UdpIdleTimeout
+		}
+		if idleTimeout > 0 && now.Sub(activity.active) > time.Duration(idleTimeout)*time.Second {
+			idle = append(idle, c)
+		}
+		return true
+	})
+	t.mutex.Lock()
+	for id := range t.activity {
+		if _, ok := seen[id]; !ok {
+			delete(t.activity, id)
+		}
+	}
+	t.mutex.Unlock()
+	for _, c := range expired {
+		_ = c.Close()
+	}
+	for _, c := range idle {
+		_ = c.Close()
+	}
+	t.lifetimeClosed.Add(int64(len(expired)))
+	t.idleClosed.Add(int64(len(idle)))
+	if len(expired) != 0 || len(idle) != 0 {
+		log.Debugln("[ConnectionTuning] closed %d idle and %d expired connections", len(idle), len(expired))
+	}
+}
+
+func (t *ConnectionTuning) SocketOptions() *SocketOptions {
+	t.mutex.Lock()
+	params := t.params
+	t.mutex.Unlock()
+	disabled := keepalive.DisableKeepAlive()
+	return &SocketOptions{
+		KeepAliveIdle:     int64(keepalive.KeepAliveIdle() / time.Second),
+		KeepAliveInterval: int64(keepalive.KeepAliveInterval() / time.Second),
+		DisableKeepAlive:  disabled,
+		// mihomo keeps keepalive off on android whatever is asked for
+		KeepAliveForced: runtime.GOOS == "android" && disabled,
+		IdleTimeout:     params.IdleTimeout,
+		UdpIdleTimeout:  params.UdpIdleTimeout,
+		MaxLifetime:     params.MaxLifetime,
+		IdleClosed:      t.idleClosed.Load(),
+		LifetimeClosed:  t.lifetimeClosed.Load(),
+		Platform:        runtime.GOOS,
+	}
+}
+
+func handleSetConnectionTuning(paramsString string) error {
+	var params *ConnectionTuningParams
+	if err := json.Unmarshal([]byte(paramsString), &params); err != nil {
+		return err
+	}
+	return connectionTuning.Set(params)
+}
+
+func handleGetSocketOptions() string {
+	data, err := json.Marshal(connectionTuning.SocketOptions())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -21,12 +21,16 @@ type SetupParams struct {
 	Config      *config.RawConfig `json:"config"`
 	SelectedMap map[string]string `json:"selected-map"`
 	TestURL     string            `json:"test-url"`
+	Nat64       *Nat64Params      `json:"nat64"`
+	ProfileId   string            `json:"profile-id"`
 }
 
 type UpdateParams struct {
 	Tun                *tunSchema         `json:"tun"`
 	AllowLan           *bool              `json:"allow-lan"`
 	MixedPort          *int               `json:"mixed-port"`
+	RedirPort          *int               `json:"redir-port"`
+	TProxyPort         *int               `json:"tproxy-port"`
 	FindProcessMode    *P.FindProcessMode `json:"find-process-mode"`
 	Mode               *tunnel.TunnelMode `json:"mode"`
 	LogLevel           *log.LogLevel      `json:"log-level"`
@@ -35,6 +39,7 @@ type UpdateParams struct {
 	TCPConcurrent      *bool              `json:"tcp-concurrent"`
 	ExternalController *string            `json:"external-controller"`
 	Interface          *string            `json:"interface-name"`
+	RoutingMark        *int               `json:"routing-mark"`
 	UnifiedDelay       *bool              `json:"unified-delay"`
 }
 
@@ -45,6 +50,8 @@ type tunSchema struct {
 	DNSHijack    *[]string          `yaml:"dns-hijack" json:"dns-hijack"`
 	AutoRoute    *bool              `yaml:"auto-route" json:"auto-route"`
 	RouteAddress *[]netip.Prefix    `yaml:"route-address" json:"route-address,omitempty"`
+	GSO          *bool              `yaml:"gso" json:"gso,omitempty"`
+	GSOMaxSize   *uint32            `yaml:"gso-max-size" json:"gso-max-size,omitempty"`
 }
 
 type ChangeProxyParams struct {
@@ -105,6 +112,245 @@ const (
 	crashMethod                    Method = "crash"
 	setupConfigMethod              Method = "setupConfig"
 	getConfigMethod                Method = "getConfig"
+	initEncryptionMethod           Method = "initEncryption"
+	startSecureCleanupMethod       Method = "startSecureCleanup"
+	stopSecureCleanupMethod        Method = "stopSecureCleanup"
+	getSecureCleanupStatsMethod    Method = "getSecureCleanupStats"
+	getSecureCapabilitiesMethod    Method = "getSecureCapabilities"
+	setSecureCacheLimitsMethod     Method = "setSecureCacheLimits"
+	diffProfilesMethod             Method = "diffProfiles"
+	updateProfileMethod            Method = "updateProfile"
+	createInstanceMethod           Method = "createInstance"
+	startInstanceMethod            Method = "startInstance"
+	stopInstanceMethod             Method = "stopInstance"
+	removeInstanceMethod           Method = "removeInstance"
+	invokeInstanceMethod           Method = "invokeInstance"
+	getInstancesMethod             Method = "getInstances"
+	patchRulesMethod               Method = "patchRules"
+	getRulesMethod                 Method = "getRules"
+	getTrafficByProcessMethod      Method = "getTrafficByProcess"
+	getTrafficByDomainMethod       Method = "getTrafficByDomain"
+	getTrafficHistoryMethod        Method = "getTrafficHistory"
+	clearTrafficHistoryMethod      Method = "clearTrafficHistory"
+	setTrafficRetentionMethod      Method = "setTrafficRetention"
+	startURLTestScheduleMethod     Method = "startUrlTestSchedule"
+	stopURLTestScheduleMethod      Method = "stopUrlTestSchedule"
+	getURLTestScheduleMethod       Method = "getUrlTestSchedule"
+	testDelayBatchMethod           Method = "testDelayBatch"
+	cancelDelayBatchMethod         Method = "cancelDelayBatch"
+	startFailoverMethod            Method = "startFailover"
+	stopFailoverMethod             Method = "stopFailover"
+	setAppFilterMethod             Method = "setAppFilter"
+	getAppFilterMethod             Method = "getAppFilter"
+	getWireGuardStatusMethod       Method = "getWireGuardStatus"
+	validateProxiesMethod          Method = "validateProxies"
+	encryptSecretMethod            Method = "encryptSecret"
+	validateProfileMethod          Method = "validateProfile"
+	setProfileOverrideMethod       Method = "setProfileOverride"
+	getProfileOverrideMethod       Method = "getProfileOverride"
+	getMergedProfileMethod         Method = "getMergedProfile"
+	setProfileScriptMethod         Method = "setProfileScript"
+	getProfileScriptMethod         Method = "getProfileScript"
+	testProfileScriptMethod        Method = "testProfileScript"
+	startRuleProviderUpdateMethod  Method = "startRuleProviderUpdate"
+	stopRuleProviderUpdateMethod   Method = "stopRuleProviderUpdate"
+	updateRuleProviderMethod       Method = "updateRuleProvider"
+	getRuleProviderUpdatesMethod   Method = "getRuleProviderUpdates"
+	updateGeoDatabaseMethod        Method = "updateGeoDatabase"
+	getGeoDatabaseVersionsMethod   Method = "getGeoDatabaseVersions"
+	startDnsLogMethod              Method = "startDnsLog"
+	stopDnsLogMethod               Method = "stopDnsLog"
+	getDnsLogMethod                Method = "getDnsLog"
+	clearDnsLogMethod              Method = "clearDnsLog"
+	setDnsLogCapacityMethod        Method = "setDnsLogCapacity"
+	startDnsHealthCheckMethod      Method = "startDnsHealthCheck"
+	stopDnsHealthCheckMethod       Method = "stopDnsHealthCheck"
+	getDnsStatusMethod             Method = "getDnsStatus"
+	setFakeIpPersistenceMethod     Method = "setFakeIpPersistence"
+	flushFakeIpMethod              Method = "flushFakeIp"
+	setDnsCacheMethod              Method = "setDnsCache"
+	getDnsCacheStatsMethod         Method = "getDnsCacheStats"
+	purgeDnsCacheMethod            Method = "purgeDnsCache"
+	addInboundUserMethod           Method = "addInboundUser"
+	removeInboundUserMethod        Method = "removeInboundUser"
+	getInboundUsersMethod          Method = "getInboundUsers"
+	getTrafficByUserMethod         Method = "getTrafficByUser"
+	setLanAclMethod                Method = "setLanAcl"
+	getLanAclMethod                Method = "getLanAcl"
+	addLanAclEntryMethod           Method = "addLanAclEntry"
+	removeLanAclEntryMethod        Method = "removeLanAclEntry"
+	getLanAclLogMethod             Method = "getLanAclLog"
+	clearLanAclLogMethod           Method = "clearLanAclLog"
+	benchmarkTunMethod             Method = "benchmarkTun"
+	setTunStackMethod              Method = "setTunStack"
+	getTunStackMethod              Method = "getTunStack"
+	getTunStatusMethod             Method = "getTunStatus"
+	setSplitTunnelMethod           Method = "setSplitTunnel"
+	addSplitTunnelCidrMethod       Method = "addSplitTunnelCidr"
+	removeSplitTunnelCidrMethod    Method = "removeSplitTunnelCidr"
+	getSplitTunnelMethod           Method = "getSplitTunnel"
+	inspectConnectionsMethod       Method = "inspectConnections"
+	inspectConnectionMethod        Method = "inspectConnection"
+	closeConnectionsByProxyMethod  Method = "closeConnectionsByProxy"
+	pinConnectionMethod            Method = "pinConnection"
+	unpinConnectionMethod          Method = "unpinConnection"
+	setRateLimitMethod             Method = "setRateLimit"
+	getRateLimitsMethod            Method = "getRateLimits"
+	setQuotaMethod                 Method = "setQuota"
+	removeQuotaMethod              Method = "removeQuota"
+	resetQuotaMethod               Method = "resetQuota"
+	getQuotaStatusMethod           Method = "getQuotaStatus"
+	getLogsMethod                  Method = "getLogs"
+	setModuleLogLevelMethod        Method = "setModuleLogLevel"
+	getLogLevelsMethod             Method = "getLogLevels"
+	setLogFileMethod               Method = "setLogFile"
+	getLogFileMethod               Method = "getLogFile"
+	exportLogsMethod               Method = "exportLogs"
+	clearLogsMethod                Method = "clearLogs"
+	setLogCapacityMethod           Method = "setLogCapacity"
+	exportDiagnosticsMethod        Method = "exportDiagnostics"
+	clearPanicsMethod              Method = "clearPanics"
+	setExternalControllerMethod    Method = "setExternalController"
+	getExternalControllerMethod    Method = "getExternalController"
+	startGrpcServerMethod          Method = "startGrpcServer"
+	stopGrpcServerMethod           Method = "stopGrpcServer"
+	getGrpcServerMethod            Method = "getGrpcServer"
+	subscribeEventsMethod          Method = "subscribeEvents"
+	unsubscribeEventsMethod        Method = "unsubscribeEvents"
+	ackEventsMethod                Method = "ackEvents"
+	replayEventsMethod             Method = "replayEvents"
+	getEventStreamsMethod          Method = "getEventStreams"
+	importProfileMethod            Method = "importProfile"
+	exportProfileMethod            Method = "exportProfile"
+	backupAllMethod                Method = "backupAll"
+	restoreAllMethod               Method = "restoreAll"
+	setSyncMethod                  Method = "setSync"
+	syncNowMethod                  Method = "syncNow"
+	getSyncStatusMethod            Method = "getSyncStatus"
+	setGroupStatePersistenceMethod Method = "setGroupStatePersistence"
+	getGroupStateMethod            Method = "getGroupState"
+	clearGroupStateMethod          Method = "clearGroupState"
+	setRoutingModeMethod           Method = "setRoutingMode"
+	getRoutingModeMethod           Method = "getRoutingMode"
+	setSniffingMethod              Method = "setSniffing"
+	getSniffStatsMethod            Method = "getSniffStats"
+	getHttpRewriteStatsMethod      Method = "getHttpRewriteStats"
+	setUdpOverTcpMethod            Method = "setUdpOverTcp"
+	getUdpOverTcpMethod            Method = "getUdpOverTcp"
+	setDialRacingMethod            Method = "setDialRacing"
+	getDialRacingMethod            Method = "getDialRacing"
+	setTcpOptionsMethod            Method = "setTcpOptions"
+	getTcpOptionsMethod            Method = "getTcpOptions"
+	setConnectionTuningMethod      Method = "setConnectionTuning"
+	getSocketOptionsMethod         Method = "getSocketOptions"
+	setPowerModeMethod             Method = "setPowerMode"
+	getPowerModeMethod             Method = "getPowerMode"
+	trimMemoryMethod               Method = "trimMemory"
+	setMemoryPolicyMethod          Method = "setMemoryPolicy"
+	getMemoryStatsMethod           Method = "getMemoryStats"
+	benchmarkRelayMethod           Method = "benchmarkRelay"
+	startCoreMethod                Method = "startCore"
+	getStartupStatusMethod         Method = "getStartupStatus"
+	setProfileCacheMethod          Method = "setProfileCache"
+	getProfileCacheMethod          Method = "getProfileCache"
+	clearProfileCacheMethod        Method = "clearProfileCache"
+	setDomainMatcherMethod         Method = "setDomainMatcher"
+	benchmarkRuleMatchMethod       Method = "benchmarkRuleMatch"
+	explainRouteMethod             Method = "explainRoute"
+	simulateRulesMethod            Method = "simulateRules"
+	getProvidersHealthMethod       Method = "getProvidersHealth"
+	forceUpdateProviderMethod      Method = "forceUpdateProvider"
+	setSubscriptionAlertsMethod    Method = "setSubscriptionAlerts"
+	getSubscriptionUsageMethod     Method = "getSubscriptionUsage"
+	setProxyChainMethod            Method = "setProxyChain"
+	getProxyChainsMethod           Method = "getProxyChains"
+	testProxyChainMethod           Method = "testProxyChain"
+	setLoadBalanceMethod           Method = "setLoadBalance"
+	getLoadBalanceMethod           Method = "getLoadBalance"
+	setSmartGroupMethod            Method = "setSmartGroup"
+	getSmartGroupsMethod           Method = "getSmartGroups"
+	setGeofenceMethod              Method = "setGeofence"
+	getGeofenceMethod              Method = "getGeofence"
+	setGroupFilterMethod           Method = "setGroupFilter"
+	getGroupFiltersMethod          Method = "getGroupFilters"
+	getCertPinsMethod              Method = "getCertPins"
+	probeCertificatesMethod        Method = "probeCertificates"
+	setFingerprintMethod           Method = "setFingerprint"
+	getFingerprintsMethod          Method = "getFingerprints"
+	getEchStatusMethod             Method = "getEchStatus"
+	getRealityStatusMethod         Method = "getRealityStatus"
+	getObfsTransportsMethod        Method = "getObfsTransports"
+	generateTransparentRulesMethod Method = "generateTransparentRules"
+	getTransparentProxyMethod      Method = "getTransparentProxy"
+	addForwardMethod               Method = "addForward"
+	removeForwardMethod            Method = "removeForward"
+	listForwardsMethod             Method = "listForwards"
+	setShareServerMethod           Method = "setShareServer"
+	getShareServerMethod           Method = "getShareServer"
+	generatePacMethod              Method = "generatePac"
+	setSystemProxyMethod           Method = "setSystemProxy"
+	getSystemProxyMethod           Method = "getSystemProxy"
+	installServiceMethod           Method = "installService"
+	uninstallServiceMethod         Method = "uninstallService"
+	startServiceMethod             Method = "startService"
+	stopServiceMethod              Method = "stopService"
+	getServiceStatusMethod         Method = "getServiceStatus"
+	setTunHelperMethod             Method = "setTunHelper"
+	getTunHelperMethod             Method = "getTunHelper"
+	installTunHelperMethod         Method = "installTunHelper"
+	uninstallTunHelperMethod       Method = "uninstallTunHelper"
+	setNetworkMonitorMethod        Method = "setNetworkMonitor"
+	getNetworkMonitorMethod        Method = "getNetworkMonitor"
+	notifyNetworkChangedMethod     Method = "notifyNetworkChanged"
+	setInterfaceBindingsMethod     Method = "setInterfaceBindings"
+	getInterfaceBindingsMethod     Method = "getInterfaceBindings"
+	setCaptivePortalMethod         Method = "setCaptivePortal"
+	getCaptivePortalMethod         Method = "getCaptivePortal"
+	probeCaptivePortalMethod       Method = "probeCaptivePortal"
+	setKillSwitchMethod            Method = "setKillSwitch"
+	getKillSwitchMethod            Method = "getKillSwitch"
+	setDnsGuardMethod              Method = "setDnsGuard"
+	setAutomationMethod            Method = "setAutomation"
+	getAutomationMethod            Method = "getAutomation"
+	setNetworkContextMethod        Method = "setNetworkContext"
+	evaluateAutomationMethod       Method = "evaluateAutomation"
+	setTriggerMethod               Method = "setTrigger"
+	removeTriggerMethod            Method = "removeTrigger"
+	getTriggersMethod              Method = "getTriggers"
+	testTriggerMethod              Method = "testTrigger"
+	setRemoteHostMethod            Method = "setRemoteHost"
+	getRemoteMethod                Method = "getRemote"
+	startRemotePairingMethod       Method = "startRemotePairing"
+	pairRemoteMethod               Method = "pairRemote"
+	invokeRemoteMethod             Method = "invokeRemote"
+	watchRemoteMethod              Method = "watchRemote"
+	unwatchRemoteMethod            Method = "unwatchRemote"
+	removeRemotePeerMethod         Method = "removeRemotePeer"
+	setDiscoveryMethod             Method = "setDiscovery"
+	getDiscoveryMethod             Method = "getDiscovery"
+	createControllerTokenMethod    Method = "createControllerToken"
+	rotateControllerTokenMethod    Method = "rotateControllerToken"
+	revokeControllerTokenMethod    Method = "revokeControllerToken"
+	getControllerTokenMethod       Method = "getControllerToken"
+	getControllerTokensMethod      Method = "getControllerTokens"
+	getControllerTlsMethod         Method = "getControllerTls"
+	regenerateControllerTlsMethod  Method = "regenerateControllerTls"
+	setBridgeEncodingMethod        Method = "setBridgeEncoding"
+	getBridgeEncodingMethod        Method = "getBridgeEncoding"
+	subscribeConnectionsMethod     Method = "subscribeConnections"
+	updateConnectionsMethod        Method = "updateConnectionsSubscription"
+	resyncConnectionsMethod        Method = "resyncConnections"
+	unsubscribeConnectionsMethod   Method = "unsubscribeConnections"
+	setTemplateVariableMethod      Method = "setTemplateVariable"
+	removeTemplateVariableMethod   Method = "removeTemplateVariable"
+	getTemplateVariablesMethod     Method = "getTemplateVariables"
+	previewTemplateMethod          Method = "previewTemplate"
+	setTemplateProfileMethod       Method = "setTemplateProfile"
+	getTemplateProfilesMethod      Method = "getTemplateProfiles"
+	storeSecretMethod              Method = "storeSecret"
+	getSecretRefMethod             Method = "getSecretRef"
+	deleteSecretMethod             Method = "deleteSecret"
+	getSecretsMethod               Method = "getSecrets"
 )
 
 type Method string
@@ -127,6 +373,35 @@ const (
 	DelayMessage   MessageType = "delay"
 	RequestMessage MessageType = "request"
 	LoadedMessage  MessageType = "loaded"
+
+	SecureEvictedMessage      MessageType = "secureEvicted"
+	InstanceMessageType       MessageType = "instance"
+	DelayBatchMessage         MessageType = "delayBatch"
+	ProxyChangedMessage       MessageType = "proxyChanged"
+	RuleProviderUpdateMessage MessageType = "ruleProviderUpdate"
+	DnsMessage                MessageType = "dns"
+	LanAclDeniedMessage       MessageType = "lanAclDenied"
+	QuotaMessage              MessageType = "quota"
+	ControllerConfigMessage   MessageType = "controllerConfig"
+	EventMessage              MessageType = "event"
+	SyncMessage               MessageType = "sync"
+	StartupMessage            MessageType = "startup"
+	SubscriptionAlertMessage  MessageType = "subscriptionAlert"
+	CertPinFailedMessage      MessageType = "certPinFailed"
+	TunRevokedMessage         MessageType = "tunRevoked"
+	NetworkChangedMessage     MessageType = "networkChanged"
+	PortalDetectedMessage     MessageType = "portalDetected"
+	PortalClearedMessage      MessageType = "portalCleared"
+	KillSwitchMessage         MessageType = "killSwitch"
+	AutomationMessage         MessageType = "automation"
+	RemotePairedMessage       MessageType = "remotePaired"
+	RemoteEventMessage        MessageType = "remoteEvent"
+	DiscoveryMessage          MessageType = "discovery"
+	ControllerTokenMessage    MessageType = "controllerToken"
+	ConnectionsMessage        MessageType = "connections"
+	ControllerReloadMessage   MessageType = "controllerReload"
+	ControllerRestartMessage  MessageType = "controllerRestart"
+	ControllerGeoMessage      MessageType = "controllerGeo"
 )
 
 func (message *Message) Json() (string, error) {
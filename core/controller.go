@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/hub/route"
+	"github.com/metacubex/mihomo/log"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+type controllerCorsSchema struct {
+	AllowOrigins        *[]string `json:"allow-origins"`
+	AllowPrivateNetwork *bool     `json:"allow-private-network"`
+}
+
+// ExternalControllerParams changes the Clash compatible RESTful API, nil fields are kept
+type ExternalControllerParams struct {
+	ExternalController    *string `json:"external-controller"`
+	ExternalControllerTLS *string `json:"external-controller-tls"`
+	Secret                *string `json:"secret"`
+	// Certificate and PrivateKey are a path or pem, empty ones let the core generate a certificate
+	Certificate *string               `json:"certificate"`
+	PrivateKey  *string               `json:"private-key"`
+	ExternalUI  *string               `json:"external-ui"`
+	Cors        *controllerCorsSchema `json:"cors"`
+}
+
+// ExternalControllerStatus never contains the secret itself
+type ExternalControllerStatus struct {
+	ExternalController    string   `json:"external-controller"`
+	ExternalControllerTLS string   `json:"external-controller-tls"`
+	HasSecret             bool     `json:"has-secret"`
+	HasCertificate        bool     `json:"has-certificate"`
+	ExternalUI            string   `json:"external-ui"`
+	AllowOrigins          []string `json:"allow-origins"`
+	AllowPrivateNetwork   bool     `json:"allow-private-network"`
+}
+
+// applyExternalController restarts the controller with everything of the current config, the caller holds runLock
+func applyExternalController() {
+	controller := currentConfig.Controller
+	if daemonMode && controller.Secret == "" && controller.ExternalController != "" && !isLoopbackAddress(controller.ExternalController) {
+		// the daemon runs privileged, an open controller without a secret would hand it to the lan
+		if _, port, err := net.SplitHostPort(controller.ExternalController); err == nil {
+			log.Warnln("[Daemon] external controller %s has no secret, listening on loopback", controller.ExternalController)
+			controller.ExternalController = net.JoinHostPort("127.0.0.1", port)
+		}
+	}
+	if daemonMode && controller.Secret == "" && controller.ExternalControllerTLS != "" && !isLoopbackAddress(controller.ExternalControllerTLS) {
+		if _, port, err := net.SplitHostPort(controller.ExternalControllerTLS); err == nil {
+			log.Warnln("[Daemon] external controller tls %s has no secret, listening on loopback", controller.ExternalControllerTLS)
+			controller.ExternalControllerTLS = net.JoinHostPort("127.0.0.1", port)
+		}
+	}
+	if controller.ExternalUI != "" {
+		route.SetUIPath(controller.ExternalUI)
+	}
+	// without a certificate in the config the core brings its own
+	tlsAddress := controller.ExternalControllerTLS
+	certificate, privateKey := currentConfig.TLS.Certificate, currentConfig.TLS.PrivateKey
+	if tlsAddress != "" {
+		var err error
+		if certificate, privateKey, err = controllerTls.Resolve(certificate, privateKey); err != nil {
+			log.Warnln("[Controller] tls error: %v", err)
+			tlsAddress = ""
+		}
+	}
+	// scoped tokens put the gateway on the addresses, mihomo moves to a unix socket behind it so no
+	// port of its own is left to reach past the tokens
+	address, upstream := controller.ExternalController, ""
+	controllerGateway.Close()
+	if (address != "" || tlsAddress != "") && controllerTokens.active() {
+		var err error
+		if upstream, err = gatewayUpstream(controller.ExternalControllerUnix); err != nil {
+			log.Warnln("[Controller] scoped tokens error: %v", err)
+		}
+	}
+	mihomoAddress, mihomoTlsAddress, mihomoUnixAddress := address, tlsAddress, controller.ExternalControllerUnix
+	if upstream != "" {
+		mihomoAddress, mihomoTlsAddress, mihomoUnixAddress = "", "", upstream
+	}
+	route.ReCreateServer(&route.Config{
+		Addr:        mihomoAddress,
+		TLSAddr:     mihomoTlsAddress,
+		UnixAddr:    mihomoUnixAddress,
+		PipeAddr:    controller.ExternalControllerPipe,
+		Secret:      controller.Secret,
+		Certificate: certificate,
+		PrivateKey:  privateKey,
+		EchKey:      currentConfig.TLS.EchKey,
+		DohServer:   controller.ExternalDohServer,
+		IsDebug:     currentConfig.General.LogLevel == log.DEBUG,
+		Cors: route.Cors{
+			AllowOrigins:        controller.Cors.AllowOrigins,
+			AllowPrivateNetwork: controller.Cors.AllowPrivateNetwork,
+		},
+	})
+	if upstream != "" {
+		controllerGateway.Start(address, tlsAddress, controllerTls.Certificate(), upstream, controller.Secret)
+	}
+}
+
+func handleSetExternalController(paramsString string) error {
+	var params = &ExternalControllerParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	for _, address := range []*string{params.ExternalController, params.ExternalControllerTLS} {
+		if address != nil && *address != "" {
+			if _, _, err := net.SplitHostPort(*address); err != nil {
+				return err
+			}
+		}
+	}
+	runLock.Lock()
+	defer runLock.Unlock()
+	if currentConfig == nil {
+		return errors.New("config is not ready")
+	}
+	controller := currentConfig.Controller
+	if params.ExternalController != nil {
+		controller.ExternalController = *params.ExternalController
+	}
+	if params.ExternalControllerTLS != nil {
+		controller.ExternalControllerTLS = *params.ExternalControllerTLS
+	}
+	if params.Secret != nil {
+		controller.Secret = *params.Secret
+	}
+	if params.Certificate != nil {
+		currentConfig.TLS.Certificate = *params.Certificate
+	}
+	if params.PrivateKey != nil {
+		currentConfig.TLS.PrivateKey = *params.PrivateKey
+	}
+	if params.ExternalUI != nil {
+		controller.ExternalUI = *params.ExternalUI
+	}
+	if params.Cors != nil {
+		if params.Cors.AllowOrigins != nil {
+			controller.Cors.AllowOrigins = *params.Cors.AllowOrigins
+		}
+		if params.Cors.AllowPrivateNetwork != nil {
+			controller.Cors.AllowPrivateNetwork = *params.Cors.AllowPrivateNetwork
+		}
+	}
+	if daemonMode && controller.Secret == "" && controller.ExternalController != "" && !isLoopbackAddress(controller.ExternalController) {
+		return errors.New("a secret is required to open the controller of the daemon beyond loopback")
+	}
+	if daemonMode && controller.Secret == "" && controller.ExternalControllerTLS != "" && !isLoopbackAddress(controller.ExternalControllerTLS) {
+		return errors.New("a secret is required to open the controller of the daemon beyond loopback")
+	}
+	applyExternalController()
+	return nil
+}
+
+func handleGetExternalController() string {
+	status := &ExternalControllerStatus{}
+	runLock.Lock()
+	if currentConfig != nil {
+		controller := currentConfig.Controller
+		status.ExternalController = controller.ExternalController
+		status.ExternalControllerTLS = controller.ExternalControllerTLS
+		status.HasSecret = controller.Secret != ""
+		status.HasCertificate = currentConfig.TLS.Certificate != ""
+		status.ExternalUI = controller.ExternalUI
+		status.AllowOrigins = controller.Cors.AllowOrigins
+		status.AllowPrivateNetwork = controller.Cors.AllowPrivateNetwork
+	}
+	runLock.Unlock()
+	data, err := json.Marshal(status)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// patchControllerConfigs takes PATCH /configs of dashboards through updateConfig so the core and the app stay in sync
+func patchControllerConfigs(w http.ResponseWriter, r *http.Request) {
+	params := &UpdateParams{}
+	if err := render.DecodeJSON(r.Body, params); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, route.ErrBadRequest)
+		return
+	}
+	// moving the controller away from a dashboard would cut off the app
+	params.ExternalController = nil
+	runLock.Lock()
+	ready := currentConfig != nil
+	if ready && params.Tun != nil {
+		tun := currentConfig.General.Tun
+		if params.Tun.Device == nil {
+			params.Tun.Device = &tun.Device
+		}
+		if params.Tun.Stack == nil {
+			params.Tun.Stack = &tun.Stack
+		}
+		if params.Tun.DNSHijack == nil {
+			params.Tun.DNSHijack = &tun.DNSHijack
+		}
+		if params.Tun.AutoRoute == nil {
+			params.Tun.AutoRoute = &tun.AutoRoute
+		}
+		if params.Tun.RouteAddress == nil {
+			params.Tun.RouteAddress = &tun.RouteAddress
+		}
+	}
+	runLock.Unlock()
+	if !ready {
+		render.Status(r, http.StatusServiceUnavailable)
+		render.JSON(w, r, &route.HTTPError{Message: "config is not ready"})
+		return
+	}
+	updateConfig(params)
+	go sendMessage(Message{
+		Type: ControllerConfigMessage,
+		Data: params,
+	})
+	render.NoContent(w, r)
+}
+
+// reloadControllerConfigs takes PUT /configs of dashboards to the app, the app owns the profile and sets it up again
+func reloadControllerConfigs(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Path    string `json:"path"`
+		Payload string `json:"payload"`
+	}{}
+	if err := render.DecodeJSON(r.Body, &req); err != nil && !errors.Is(err, io.EOF) {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, route.ErrBadRequest)
+		return
+	}
+	// a foreign config would leave the app showing a profile the core no longer runs
+	if req.Path != "" || req.Payload != "" {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, &route.HTTPError{Message: "the profile is managed by the app, only a reload is supported"})
+		return
+	}
+	go sendMessage(Message{
+		Type: ControllerReloadMessage,
+		Data: r.URL.Query().Get("force") == "true",
+	})
+	render.NoContent(w, r)
+}
+
+// restartControllerCore takes POST /restart to the app, the process itself is never replaced in embed mode
+func restartControllerCore(w http.ResponseWriter, r *http.Request) {
+	go sendMessage(Message{
+		Type: ControllerRestartMessage,
+	})
+	render.JSON(w, r, render.M{"status": "ok"})
+}
+
+// updateControllerGeo updates the installed databases through the geo updater, so their versions stay known to the app
+func updateControllerGeo(w http.ResponseWriter, r *http.Request) {
+	databases := map[string]string{
+		"MMDB":    constant.Path.MMDB(),
+		"ASN":     constant.Path.ASN(),
+		"GeoIp":   constant.Path.GeoIP(),
+		"GeoSite": constant.Path.GeoSite(),
+	}
+	results := make([]*GeoUpdateResult, 0, len(databases))
+	for geoType, path := range databases {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		result, err := UpdateGeoDatabase(context.Background(), &UpdateGeoDatabaseParams{
+			GeoType: geoType,
+			GeoName: filepath.Base(path),
+		})
+		if err != nil {
+			log.Errorln("[Controller] update %s error: %v", geoType, err)
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, &route.HTTPError{Message: err.Error()})
+			return
+		}
+		results = append(results, result)
+	}
+	go sendMessage(Message{
+		Type: ControllerGeoMessage,
+		Data: results,
+	})
+	render.NoContent(w, r)
+}
+
+// controllerRouter replaces the config routes that embed mode removes with ones that keep the app state
+func controllerRouter(r chi.Router) {
+	r.Patch("/configs", patchControllerConfigs)
+	r.Put("/configs", reloadControllerConfigs)
+	r.Post("/configs/geo", updateControllerGeo)
+	r.Post("/upgrade/geo", updateControllerGeo)
+	r.Post("/restart", restartControllerCore)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/metacubex/mihomo/component/ca"
+	"github.com/metacubex/mihomo/constant"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	controllerTlsFile = "tls.pem"
+	controllerTlsTTL  = 10 * 365 * 24 * time.Hour
+)
+
+// ControllerTlsStatus is what a client pins, Fingerprint is the sha256 of the certificate and Spki
+// the base64 sha256 of its public key
+type ControllerTlsStatus struct {
+	Address     string   `json:"address"`
+	Generated   bool     `json:"generated"`
+	Fingerprint string   `json:"fingerprint,omitempty"`
+	Spki        string   `json:"spki,omitempty"`
+	Names       []string `json:"names"`
+	NotAfter    int64    `json:"not-after,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// ControllerTls keeps the certificate of the controller, a generated one is kept across restarts
+// so the pins of the clients stay valid
+type ControllerTls struct {
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	pem         string
+	generated   bool
+	source      string
+	err         error
+}
+
+var controllerTls = &ControllerTls{}
+
+func newControllerCertificate() ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "FlClash controller"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(controllerTlsTTL),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	// the lan address changes, clients on it pin the key instead of checking the name
+	if address := lanAddress(); address != "" {
+		template.IPAddresses = append(template.IPAddresses, net.ParseIP(address))
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return append(data, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})...), nil
+}
+
+// generatedLocked loads the certificate of the core or makes one
+func (c *ControllerTls) generatedLocked() (string, error) {
+	path := controllerPath(controllerTlsFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		if data, err = newControllerCertificate(); err != nil {
+			return "", err
+		}
+		if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return "", err
+		}
+		if err = os.WriteFile(path, data, 0600); err != nil {
+			return "", err
+		}
+	}
+	return string(data), nil
+}
+
+// Resolve gives the certificate and key for mihomo, the ones of the config win over a generated one
+func (c *ControllerTls) Resolve(certificate, privateKey string) (string, string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	generated := certificate == "" && privateKey == ""
+	source := certificate + "\x00" + privateKey
+	if c.certificate != nil && c.source == source {
+		if generated {
+			return c.pem, c.pem, nil
+		}
+		return certificate, privateKey, nil
+	}
+	c.certificate = nil
+	c.pem = ""
+	c.err = nil
+	if generated {
+		data, err := c.generatedLocked()
+		if err != nil {
+			c.err = err
+			return "", "", err
+		}
+		certificate, privateKey = data, data
+		c.pem = data
+	}
+	loaded, err := ca.LoadTLSKeyPair(certificate, privateKey, constant.Path)
+	if err != nil {
+		c.err = err
+		return "", "", err
+	}
+	c.certificate = &loaded
+	c.generated = generated
+	c.source = source
+	return certificate, privateKey, nil
+}
+
+func (c *ControllerTls) Certificate() *tls.Certificate {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.certificate
+}
+
+// Regenerate drops the generated certificate, the clients have to pin the new one
+func (c *ControllerTls) Regenerate() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := os.Remove(controllerPath(controllerTlsFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if c.generated {
+		c.certificate = nil
+		c.source = ""
+	}
+	return nil
+}
+
+func (c *ControllerTls) Status(address string) *ControllerTlsStatus {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	status := &ControllerTlsStatus{
+		Address:   address,
+		Generated: c.generated,
+		Names:     []string{},
+	}
+	if c.err != nil {
+		status.Error = c.err.Error()
+	}
+	if c.certificate == nil || len(c.certificate.Certificate) == 0 {
+		return status
+	}
+	leaf, err := x509.ParseCertificate(c.certificate.Certificate[0])
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Fingerprint = certificateFingerprint(leaf.Raw)
+	spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	status.Spki = base64.StdEncoding.EncodeToString(spki[:])
+	status.NotAfter = leaf.NotAfter.UnixMilli()
+	status.Names = append(status.Names, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		status.Names = append(status.Names, ip.String())
+	}
+	return status
+}
+
+func handleGetControllerTls() string {
+	address := ""
+	runLock.Lock()
+	if currentConfig != nil {
+		address = currentConfig.Controller.ExternalControllerTLS
+	}
+	runLock.Unlock()
+	data, err := json.Marshal(controllerTls.Status(address))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handleRegenerateControllerTls() error {
+	if err := controllerTls.Regenerate(); err != nil {
+		return err
+	}
+	runLock.Lock()
+	defer runLock.Unlock()
+	if currentConfig == nil {
+		return errors.New("config is not ready")
+	}
+	applyExternalController()
+	return nil
+}
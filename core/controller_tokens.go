@@ -0,0 +1,674 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/render"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/hub/route"
+	"github.com/metacubex/mihomo/log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	controllerDir          = "controller"
+	controllerTokensFile   = "tokens.json"
+	controllerSocketFile   = "gateway.sock"
+	defaultTokenGrace      = 5 * time.Minute
+	controllerListenRetry  = 100 * time.Millisecond
+	controllerListenTrials = 30
+)
+
+type ControllerScope string
+
+const (
+	// ReadControllerScope may watch everything but change nothing
+	ReadControllerScope    ControllerScope = "read"
+	ControlControllerScope ControllerScope = "control"
+)
+
+// ControllerToken is a token of the external controller besides the secret, the secret itself
+// keeps full control
+type ControllerToken struct {
+	Id      string          `json:"id"`
+	Name    string          `json:"name"`
+	Scope   ControllerScope `json:"scope"`
+	Token   string          `json:"token"`
+	Created int64           `json:"created"`
+	Expires int64           `json:"expires,omitempty"`
+	// Rotate is the seconds a token lives before it is replaced, the replaced one still works for
+	// Grace seconds so the dashboard can pick up the new one
+	Rotate          int64  `json:"rotate,omitempty"`
+	Grace           int64  `json:"grace,omitempty"`
+	Rotated         int64  `json:"rotated"`
+	Previous        string `json:"previous,omitempty"`
+	PreviousExpires int64  `json:"previous-expires,omitempty"`
+	LastUsed        int64  `json:"last-used,omitempty"`
+}
+
+type ControllerTokenParams struct {
+	Id    string          `json:"id"`
+	Name  string          `json:"name"`
+	Scope ControllerScope `json:"scope"`
+	// Ttl is the seconds until the token expires, zero never expires
+	Ttl    int64 `json:"ttl"`
+	Rotate int64 `json:"rotate"`
+	Grace  int64 `json:"grace"`
+}
+
+// ControllerTokenStatus never contains the token itself
+type ControllerTokenStatus struct {
+	Id       string          `json:"id"`
+	Name     string          `json:"name"`
+	Scope    ControllerScope `json:"scope"`
+	Created  int64           `json:"created"`
+	Expires  int64           `json:"expires,omitempty"`
+	Rotate   int64           `json:"rotate,omitempty"`
+	Rotated  int64           `json:"rotated"`
+	Rotating bool            `json:"rotating"`
+	Expired  bool            `json:"expired"`
+	LastUsed int64           `json:"last-used,omitempty"`
+}
+
+type ControllerTokenEvent struct {
+	Id      string `json:"id"`
+	Rotated int64  `json:"rotated"`
+}
+
+type ControllerTokens struct {
+	mutex  sync.Mutex
+	tokens []*ControllerToken
+	loaded bool
+	timer  *time.Timer
+}
+
+var controllerTokens = &ControllerTokens{}
+
+func controllerPath(name string) string {
+	return filepath.Join(constant.Path.Resolve(controllerDir), name)
+}
+
+func (t *ControllerToken) grace() time.Duration {
+	if t.Grace <= 0 {
+		return defaultTokenGrace
+	}
+	return time.Duration(t.Grace) * time.Second
+}
+
+func (t *ControllerToken) expired(now time.Time) bool {
+	return t.Expires != 0 && now.UnixMilli() >= t.Expires
+}
+
+func (t *ControllerToken) status(now time.Time) ControllerTokenStatus {
+	return ControllerTokenStatus{
+		Id:       t.Id,
+		Name:     t.Name,
+		Scope:    t.Scope,
+		Created:  t.Created,
+		Expires:  t.Expires,
+		Rotate:   t.Rotate,
+		Rotated:  t.Rotated,
+		Rotating: t.Previous != "" && now.UnixMilli() < t.PreviousExpires,
+		Expired:  t.expired(now),
+		LastUsed: t.LastUsed,
+	}
+}
+
+// loadLocked reads the tokens, their values are sealed with the device key and the file is read
+// again once the key is there
+func (c *ControllerTokens) loadLocked() {
+	if c.loaded {
+		return
+	}
+	data, err := os.ReadFile(controllerPath(controllerTokensFile))
+	if err != nil {
+		c.loaded = true
+		return
+	}
+	var tokens []*ControllerToken
+	if err = json.Unmarshal(data, &tokens); err != nil {
+		log.Warnln("[Controller] load tokens error: %v", err)
+	}
+	for _, token := range tokens {
+		for _, field := range []*string{&token.Token, &token.Previous} {
+			plain, err := decryptSecretValue(*field)
+			if errors.Is(err, errNoKeyProvider) {
+				return
+			}
+			if err != nil {
+				log.Warnln("[Controller] token %s unavailable: %v", token.Id, err)
+			}
+			*field = plain
+		}
+	}
+	c.loaded = true
+	c.tokens = tokens
+	c.scheduleLocked(time.Now())
+}
+
+func (c *ControllerTokens) saveLocked() {
+	tokens := make([]ControllerToken, 0, len(c.tokens))
+	for _, token := range c.tokens {
+		sealed := *token
+		for _, field := range []*string{&sealed.Token, &sealed.Previous} {
+			if *field == "" {
+				continue
+			}
+			encrypted, err := EncryptSecretValue(*field)
+			if err != nil {
+				log.Warnln("[Controller] save tokens error: %v", err)
+				return
+			}
+			*field = encrypted
+		}
+		tokens = append(tokens, sealed)
+	}
+	data, err := json.Marshal(tokens)
+	if err != nil {
+		return
+	}
+	path := controllerPath(controllerTokensFile)
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err == nil {
+		err = os.WriteFile(path, data, 0600)
+	}
+	if err != nil {
+		log.Warnln("[Controller] save tokens error: %v", err)
+	}
+}
+
+func (c *ControllerTokens) findLocked(id string) (int, *ControllerToken) {
+	c.loadLocked()
+	for index, token := range c.tokens {
+		if token.Id == id {
+			return index, token
+		}
+	}
+	return -1, nil
+}
+
+// active tells the controller needs the gateway, without tokens the secret of mihomo is enough
+func (c *ControllerTokens) active() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.loadLocked()
+	return len(c.tokens) != 0
+}
+
+func (c *ControllerTokens) Create(params *ControllerTokenParams) (*ControllerToken, error) {
+	if params.Scope == "" {
+		params.Scope = ReadControllerScope
+	}
+	if params.Scope != ReadControllerScope && params.Scope != ControlControllerScope {
+		return nil, fmt.Errorf("unsupported scope %s", params.Scope)
+	}
+	if getEncryptionService() == nil {
+		return nil, errNoKeyProvider
+	}
+	if params.Id == "" {
+		id, err := newShareToken()
+		if err != nil {
+			return nil, err
+		}
+		params.Id = id[:8]
+	}
+	value, err := newShareToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	token := &ControllerToken{
+		Id:      params.Id,
+		Name:    params.Name,
+		Scope:   params.Scope,
+		Token:   value,
+		Created: now.UnixMilli(),
+		Rotate:  params.Rotate,
+		Grace:   params.Grace,
+		Rotated: now.UnixMilli(),
+	}
+	if params.Ttl > 0 {
+		token.Expires = now.Add(time.Duration(params.Ttl) * time.Second).UnixMilli()
+	}
+	c.mutex.Lock()
+	if _, previous := c.findLocked(params.Id); previous != nil {
+		c.mutex.Unlock()
+		return nil, fmt.Errorf("token %s already exists", params.Id)
+	}
+	c.tokens = append(c.tokens, token)
+	c.saveLocked()
+	c.scheduleLocked(now)
+	copied := *token
+	c.mutex.Unlock()
+	return &copied, nil
+}
+
+// rotateLocked replaces the value of the token, the old value keeps working for the grace
+func (c *ControllerTokens) rotateLocked(token *ControllerToken, now time.Time) error {
+	value, err := newShareToken()
+	if err != nil {
+		return err
+	}
+	token.Previous = token.Token
+	token.PreviousExpires = now.Add(token.grace()).UnixMilli()
+	token.Token = value
+	token.Rotated = now.UnixMilli()
+	return nil
+}
+
+func (c *ControllerTokens) Rotate(id string) (*ControllerToken, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, token := c.findLocked(id)
+	if token == nil {
+		return nil, fmt.Errorf("token %s not found", id)
+	}
+	now := time.Now()
+	if err := c.rotateLocked(token, now); err != nil {
+		return nil, err
+	}
+	c.saveLocked()
+	c.scheduleLocked(now)
+	copied := *token
+	return &copied, nil
+}
+
+// rotateDueLocked rotates the tokens whose time is up, the app is told and asks for the new value
+func (c *ControllerTokens) rotateDueLocked(now time.Time) {
+	changed := false
+	for _, token := range c.tokens {
+		if token.Rotate <= 0 || token.expired(now) {
+			continue
+		}
+		if now.Sub(time.UnixMilli(token.Rotated)) < time.Duration(token.Rotate)*time.Second {
+			continue
+		}
+		if c.rotateLocked(token, now) != nil {
+			continue
+		}
+		changed = true
+		go sendMessage(Message{
+			Type: ControllerTokenMessage,
+			Data: &ControllerTokenEvent{Id: token.Id, Rotated: token.Rotated},
+		})
+	}
+	if changed {
+		c.saveLocked()
+	}
+}
+
+// scheduleLocked arms the timer for the next rotation, the requests never rotate themselves
+func (c *ControllerTokens) scheduleLocked(now time.Time) {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	var next time.Time
+	for _, token := range c.tokens {
+		if token.Rotate <= 0 || token.expired(now) {
+			continue
+		}
+		due := time.UnixMilli(token.Rotated).Add(time.Duration(token.Rotate) * time.Second)
+		if next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+	if next.IsZero() {
+		return
+	}
+	// a rotation that failed is due again at once, the delay keeps it from spinning
+	delay := next.Sub(now)
+	if delay < time.Second {
+		delay = time.Second
+	}
+	c.timer = time.AfterFunc(delay, c.rotateDue)
+}
+
+func (c *ControllerTokens) rotateDue() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	c.rotateDueLocked(now)
+	c.scheduleLocked(now)
+}
+
+func (c *ControllerTokens) Revoke(id string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	index, token := c.findLocked(id)
+	if token == nil {
+		return false
+	}
+	c.tokens = append(c.tokens[:index], c.tokens[index+1:]...)
+	c.saveLocked()
+	c.scheduleLocked(time.Now())
+	return true
+}
+
+func (c *ControllerTokens) Get(id string) (*ControllerToken, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, token := c.findLocked(id)
+	if token == nil {
+		return nil, fmt.Errorf("token %s not found", id)
+	}
+	copied := *token
+	return &copied, nil
+}
+
+func (c *ControllerTokens) Status() []ControllerTokenStatus {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.loadLocked()
+	now := time.Now()
+	list := make([]ControllerTokenStatus, 0, len(c.tokens))
+	for _, token := range c.tokens {
+		list = append(list, token.status(now))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id < list[j].Id
+	})
+	return list
+}
+
+// scopeOf finds the scope of a presented token, the values are compared in constant time
+func (c *ControllerTokens) scopeOf(value string) (ControllerScope, bool) {
+	if value == "" {
+		return "", false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.loadLocked()
+	now := time.Now()
+	for _, token := range c.tokens {
+		if token.expired(now) {
+			continue
+		}
+		current := subtle.ConstantTimeCompare([]byte(token.Token), []byte(value)) == 1
+		previous := token.Previous != "" && now.UnixMilli() < token.PreviousExpires &&
+			subtle.ConstantTimeCompare([]byte(token.Previous), []byte(value)) == 1
+		if current || previous {
+			token.LastUsed = now.UnixMilli()
+			return token.Scope, true
+		}
+	}
+	return "", false
+}
+
+// allowsController tells what a scope may do, reading is every GET but the profiler and the GETs
+// that make the core send traffic
+func allowsController(scope ControllerScope, r *http.Request) bool {
+	if scope == ControlControllerScope {
+		return true
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	if path == "/debug" || strings.HasPrefix(path, "/debug/") {
+		return false
+	}
+	return !probesController(path)
+}
+
+// probesController tells the delay tests, the health checks and the dns queries
+func probesController(path string) bool {
+	switch {
+	case path == "/dns/query":
+		return true
+	case strings.HasPrefix(path, "/proxies/"), strings.HasPrefix(path, "/group/"):
+		return strings.HasSuffix(path, "/delay")
+	case strings.HasPrefix(path, "/providers/proxies/"):
+		return strings.HasSuffix(path, "/healthcheck")
+	}
+	return false
+}
+
+// ControllerGateway serves the external controller when scoped tokens exist, mihomo listens on
+// a unix socket behind it
+type ControllerGateway struct {
+	mutex   sync.Mutex
+	secret  string
+	cancel  context.CancelFunc
+	servers []*http.Server
+}
+
+var controllerGateway = &ControllerGateway{}
+
+func controllerToken(r *http.Request) string {
+	if r.Header.Get("Upgrade") == "websocket" {
+		// browsers cannot set headers of websockets
+		if token := r.URL.Query().Get("token"); token != "" {
+			return token
+		}
+	}
+	bearer, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || bearer != "Bearer" {
+		return ""
+	}
+	return token
+}
+
+func (g *ControllerGateway) authorize(r *http.Request) (ControllerScope, bool) {
+	token := controllerToken(r)
+	g.mutex.Lock()
+	secret := g.secret
+	g.mutex.Unlock()
+	if secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(token)) == 1 {
+		return ControlControllerScope, true
+	}
+	return controllerTokens.scopeOf(token)
+}
+
+func (g *ControllerGateway) handler(upstream string) http.Handler {
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: "mihomo"})
+	proxy.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			dialer := &net.Dialer{}
+			return dialer.DialContext(ctx, "unix", upstream)
+		},
+	}
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		query := r.URL.Query()
+		if query.Has("token") {
+			query.Del("token")
+			r.URL.RawQuery = query.Encode()
+		}
+		// the unix controller asks for nothing, the tokens stay at the gateway
+		r.Header.Del("Authorization")
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		render.Status(r, http.StatusBadGateway)
+		render.JSON(w, r, &route.HTTPError{Message: err.Error()})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// preflights carry no token, the cors of mihomo answers them
+		if r.Method == http.MethodOptions {
+			proxy.ServeHTTP(w, r)
+			return
+		}
+		scope, ok := g.authorize(r)
+		if !ok {
+			render.Status(r, http.StatusUnauthorized)
+			render.JSON(w, r, route.ErrUnauthorized)
+			return
+		}
+		if !allowsController(scope, r) {
+			render.Status(r, http.StatusForbidden)
+			render.JSON(w, r, &route.HTTPError{Message: "token is read only"})
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+// Start takes over the addresses of the controller, mihomo may still hold them for a moment
+func (g *ControllerGateway) Start(address, tlsAddress string, certificate *tls.Certificate, upstream, secret string) {
+	g.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	g.mutex.Lock()
+	g.secret = secret
+	g.cancel = cancel
+	g.mutex.Unlock()
+	handler := g.handler(upstream)
+	if address != "" {
+		go g.serve(ctx, address, &http.Server{Handler: handler}, false)
+	}
+	if tlsAddress != "" && certificate != nil {
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{*certificate}}
+		go g.serve(ctx, tlsAddress, &http.Server{Handler: handler, TLSConfig: tlsConfig}, true)
+	}
+}
+
+func (g *ControllerGateway) serve(ctx context.Context, address string, server *http.Server, secure bool) {
+	var listener net.Listener
+	var err error
+	for trial := 0; trial < controllerListenTrials; trial++ {
+		if listener, err = net.Listen("tcp", address); err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(controllerListenRetry):
+		}
+	}
+	if err != nil {
+		log.Errorln("[Controller] listen %s error: %v", address, err)
+		return
+	}
+	g.mutex.Lock()
+	if ctx.Err() != nil {
+		g.mutex.Unlock()
+		_ = listener.Close()
+		return
+	}
+	g.servers = append(g.servers, server)
+	g.mutex.Unlock()
+	if secure {
+		log.Infoln("[Controller] scoped tokens tls listening at: %s", listener.Addr().String())
+		// the certificate is in the config, ServeTLS sets up h2 as well
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		log.Infoln("[Controller] scoped tokens listening at: %s", listener.Addr().String())
+		err = server.Serve(listener)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Errorln("[Controller] serve error: %v", err)
+	}
+}
+
+func (g *ControllerGateway) Close() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.cancel != nil {
+		g.cancel()
+		g.cancel = nil
+	}
+	for _, server := range g.servers {
+		_ = server.Close()
+	}
+	g.servers = nil
+}
+
+// gatewayUpstream is the unix socket mihomo serves behind the gateway, the private one sits in a
+// directory only the core may enter. A unix controller of the config has no secret either and is
+// taken as it is
+func gatewayUpstream(unixAddress string) (string, error) {
+	if unixAddress != "" {
+		return constant.Path.Resolve(unixAddress), nil
+	}
+	dir := constant.Path.Resolve(controllerDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, controllerSocketFile), nil
+}
+
+// reapplyExternalController puts the gateway in front of the controller or takes it away
+func reapplyExternalController() {
+	runLock.Lock()
+	defer runLock.Unlock()
+	if currentConfig != nil {
+		applyExternalController()
+	}
+}
+
+func handleCreateControllerToken(paramsString string) (string, error) {
+	params := &ControllerTokenParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return "", err
+	}
+	wasActive := controllerTokens.active()
+	token, err := controllerTokens.Create(params)
+	if err != nil {
+		return "", err
+	}
+	if !wasActive {
+		reapplyExternalController()
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func handleRotateControllerToken(id string) (string, error) {
+	token, err := controllerTokens.Rotate(id)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func handleRevokeControllerToken(id string) bool {
+	if !controllerTokens.Revoke(id) {
+		return false
+	}
+	if !controllerTokens.active() {
+		reapplyExternalController()
+	}
+	return true
+}
+
+func handleGetControllerToken(id string) (string, error) {
+	token, err := controllerTokens.Get(id)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func handleGetControllerTokens() string {
+	data, err := json.Marshal(controllerTokens.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/metacubex/mihomo/constant"
+)
+
+// useTestTokens points the tokens at a temporary home, the gateway reads the global ones
+func useTestTokens(t *testing.T) *ControllerTokens {
+	t.Helper()
+	previousHome, previousTokens := constant.Path.HomeDir(), controllerTokens
+	previousService := getEncryptionService()
+	constant.SetHomeDir(t.TempDir())
+	encryptionServiceValue.Store(NewEncryptionService(NewStaticKeyProvider(strings.Repeat("k", 32))))
+	controllerTokens = &ControllerTokens{}
+	t.Cleanup(func() {
+		controllerTokens.mutex.Lock()
+		if controllerTokens.timer != nil {
+			controllerTokens.timer.Stop()
+		}
+		controllerTokens.mutex.Unlock()
+		constant.SetHomeDir(previousHome)
+		encryptionServiceValue.Store(previousService)
+		controllerTokens = previousTokens
+	})
+	return controllerTokens
+}
+
+func TestAllowsController(t *testing.T) {
+	cases := []struct {
+		scope   ControllerScope
+		method  string
+		path    string
+		allowed bool
+	}{
+		{ReadControllerScope, http.MethodGet, "/proxies", true},
+		{ReadControllerScope, http.MethodHead, "/connections", true},
+		{ReadControllerScope, http.MethodPut, "/proxies/GLOBAL", false},
+		{ReadControllerScope, http.MethodPatch, "/configs", false},
+		{ReadControllerScope, http.MethodDelete, "/connections", false},
+		{ReadControllerScope, http.MethodGet, "/debug/pprof/heap", false},
+		{ReadControllerScope, http.MethodGet, "/debug", false},
+		{ReadControllerScope, http.MethodGet, "/debugger", true},
+		{ReadControllerScope, http.MethodGet, "/proxies/GLOBAL", true},
+		{ReadControllerScope, http.MethodGet, "/proxies/GLOBAL/delay", false},
+		{ReadControllerScope, http.MethodGet, "/group/Auto/delay", false},
+		{ReadControllerScope, http.MethodGet, "/providers/proxies/sub/healthcheck", false},
+		{ReadControllerScope, http.MethodGet, "/providers/proxies/sub/node/healthcheck", false},
+		{ReadControllerScope, http.MethodGet, "/providers/proxies/sub", true},
+		{ReadControllerScope, http.MethodGet, "/dns/query", false},
+		{ControlControllerScope, http.MethodGet, "/proxies/GLOBAL/delay", true},
+		{ControlControllerScope, http.MethodPut, "/proxies/GLOBAL", true},
+		{ControlControllerScope, http.MethodGet, "/debug/pprof/heap", true},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.path, nil)
+		if allowed := allowsController(c.scope, r); allowed != c.allowed {
+			t.Errorf("%s %s %s allowed %v, want %v", c.scope, c.method, c.path, allowed, c.allowed)
+		}
+	}
+}
+
+func TestControllerTokenScopes(t *testing.T) {
+	tokens := useTestTokens(t)
+	read, err := tokens.Create(&ControllerTokenParams{Id: "read"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	control, err := tokens.Create(&ControllerTokenParams{Id: "control", Scope: ControlControllerScope})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scope, ok := tokens.scopeOf(read.Token); !ok || scope != ReadControllerScope {
+		t.Fatalf("read token has scope %q %v", scope, ok)
+	}
+	if scope, ok := tokens.scopeOf(control.Token); !ok || scope != ControlControllerScope {
+		t.Fatalf("control token has scope %q %v", scope, ok)
+	}
+	for _, value := range []string{"", "wrong", read.Token[:len(read.Token)-1]} {
+		if _, ok := tokens.scopeOf(value); ok {
+			t.Fatalf("token %q was accepted", value)
+		}
+	}
+	if _, err := tokens.Create(&ControllerTokenParams{Id: "read"}); err == nil {
+		t.Fatal("created a token id twice")
+	}
+	if _, err := tokens.Create(&ControllerTokenParams{Scope: "admin"}); err == nil {
+		t.Fatal("created a token of an unknown scope")
+	}
+	if !tokens.Revoke("read") {
+		t.Fatal("revoke failed")
+	}
+	if _, ok := tokens.scopeOf(read.Token); ok {
+		t.Fatal("revoked token was accepted")
+	}
+}
+
+func TestControllerTokenExpiry(t *testing.T) {
+	tokens := useTestTokens(t)
+	token, err := tokens.Create(&ControllerTokenParams{Id: "short", Ttl: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tokens.scopeOf(token.Token); !ok {
+		t.Fatal("fresh token was refused")
+	}
+	tokens.mutex.Lock()
+	tokens.tokens[0].Expires = time.Now().Add(-time.Second).UnixMilli()
+	tokens.mutex.Unlock()
+	if _, ok := tokens.scopeOf(token.Token); ok {
+		t.Fatal("expired token was accepted")
+	}
+}
+
+func TestControllerTokenRotation(t *testing.T) {
+	tokens := useTestTokens(t)
+	token, err := tokens.Create(&ControllerTokenParams{Id: "rotating", Grace: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := tokens.Rotate("rotating")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.Token == token.Token {
+		t.Fatal("rotation kept the value")
+	}
+	// the old value works for the grace
+	for _, value := range []string{token.Token, rotated.Token} {
+		if _, ok := tokens.scopeOf(value); !ok {
+			t.Fatalf("token %q was refused during the grace", value)
+		}
+	}
+	tokens.mutex.Lock()
+	tokens.tokens[0].PreviousExpires = time.Now().Add(-time.Second).UnixMilli()
+	tokens.mutex.Unlock()
+	if _, ok := tokens.scopeOf(token.Token); ok {
+		t.Fatal("old token was accepted after the grace")
+	}
+	// a reload sees the rotated value
+	reloaded := &ControllerTokens{}
+	if _, ok := reloaded.scopeOf(rotated.Token); !ok {
+		t.Fatal("rotated token was not persisted")
+	}
+	reloaded.mutex.Lock()
+	if reloaded.timer != nil {
+		reloaded.timer.Stop()
+	}
+	reloaded.mutex.Unlock()
+}
+
+func TestControllerTokensAreSealed(t *testing.T) {
+	tokens := useTestTokens(t)
+	token, err := tokens.Create(&ControllerTokenParams{Id: "sealed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(controllerPath(controllerTokensFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), token.Token) {
+		t.Fatal("token is stored in plain text")
+	}
+	// without the key the file is read again later instead of dropping the tokens
+	service := getEncryptionService()
+	encryptionServiceValue.Store(nil)
+	reloaded := &ControllerTokens{}
+	if _, ok := reloaded.scopeOf(token.Token); ok || reloaded.loaded {
+		t.Fatal("sealed tokens were loaded without the key")
+	}
+	encryptionServiceValue.Store(service)
+	if _, ok := reloaded.scopeOf(token.Token); !ok {
+		t.Fatal("sealed token was refused once the key is there")
+	}
+}
+
+func TestControllerTokenRotatesOnTimer(t *testing.T) {
+	tokens := useTestTokens(t)
+	token, err := tokens.Create(&ControllerTokenParams{Id: "timed", Rotate: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		current, err := tokens.Get("timed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if current.Token != token.Token {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("token was not rotated by the timer")
+}
+
+func TestControllerGatewayScopes(t *testing.T) {
+	tokens := useTestTokens(t)
+	upstream := filepath.Join(t.TempDir(), controllerSocketFile)
+	listener, err := net.Listen("unix", upstream)
+	if err != nil {
+		t.Skipf("unix sockets: %v", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" || r.URL.Query().Has("token") {
+			w.WriteHeader(http.StatusTeapot)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	go server.Serve(listener)
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+	read, err := tokens.Create(&ControllerTokenParams{Id: "read"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway := &ControllerGateway{secret: "secret"}
+	handler := gateway.handler(upstream)
+	cases := []struct {
+		method string
+		token  string
+		status int
+	}{
+		{http.MethodGet, "", http.StatusUnauthorized},
+		{http.MethodGet, "wrong", http.StatusUnauthorized},
+		{http.MethodGet, read.Token, http.StatusNoContent},
+		{http.MethodPut, read.Token, http.StatusForbidden},
+		{http.MethodPut, "secret", http.StatusNoContent},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, "/proxies", nil)
+		if c.token != "" {
+			r.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Errorf("%s with %q answered %d, want %d", c.method, c.token, w.Code, c.status)
+		}
+	}
+}
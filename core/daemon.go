@@ -0,0 +1,203 @@
+//go:build !cgo
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"github.com/metacubex/mihomo/log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const daemonCommand = "daemon"
+
+// daemonUserMethods is what the user of the app may call through the socket, the control of the
+// proxies, profiles and connections. The rest writes files, runs processes or changes the service
+// and stays with root.
+var daemonUserMethods = map[Method]struct{}{
+	getIsInitMethod:               {},
+	forceGcMethod:                 {},
+	getRunTimeMethod:              {},
+	getMemoryMethod:               {},
+	getCountryCodeMethod:          {},
+	getStartupStatusMethod:        {},
+	getServiceStatusMethod:        {},
+	getTunStatusMethod:            {},
+	validateConfigMethod:          {},
+	validateProfileMethod:         {},
+	setupConfigMethod:             {},
+	updateConfigMethod:            {},
+	updateProfileMethod:           {},
+	diffProfilesMethod:            {},
+	getCurrentProfileNameMethod:   {},
+	startListenerMethod:           {},
+	stopListenerMethod:            {},
+	getProxiesMethod:              {},
+	changeProxyMethod:             {},
+	asyncTestDelayMethod:          {},
+	testDelayBatchMethod:          {},
+	cancelDelayBatchMethod:        {},
+	getExternalProvidersMethod:    {},
+	getExternalProviderMethod:     {},
+	updateExternalProviderMethod:  {},
+	getProvidersHealthMethod:      {},
+	forceUpdateProviderMethod:     {},
+	setRoutingModeMethod:          {},
+	getRoutingModeMethod:          {},
+	getGroupStateMethod:           {},
+	getRulesMethod:                {},
+	getTrafficMethod:              {},
+	getTotalTrafficMethod:         {},
+	resetTrafficMethod:            {},
+	getTrafficByProcessMethod:     {},
+	getTrafficByDomainMethod:      {},
+	getTrafficHistoryMethod:       {},
+	getConnectionsMethod:          {},
+	closeConnectionsMethod:        {},
+	closeConnectionMethod:         {},
+	closeConnectionsByProxyMethod: {},
+	inspectConnectionsMethod:      {},
+	inspectConnectionMethod:       {},
+	pinConnectionMethod:           {},
+	unpinConnectionMethod:         {},
+	subscribeConnectionsMethod:    {},
+	updateConnectionsMethod:       {},
+	resyncConnectionsMethod:       {},
+	unsubscribeConnectionsMethod:  {},
+	startLogMethod:                {},
+	stopLogMethod:                 {},
+	getLogsMethod:                 {},
+	subscribeEventsMethod:         {},
+	unsubscribeEventsMethod:       {},
+	ackEventsMethod:               {},
+	replayEventsMethod:            {},
+	getEventStreamsMethod:         {},
+	setBridgeEncodingMethod:       {},
+	getBridgeEncodingMethod:       {},
+}
+
+type daemonServer struct {
+	mutex    sync.Mutex
+	uid      int
+	listener net.Listener
+	current  net.Conn
+}
+
+// listenControlSocket makes the socket only the owner and the group may open, uid and gid hand it
+// to the user of the app
+func listenControlSocket(path string, uid, gid int) (net.Listener, error) {
+	if err := prepareControlDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	_ = os.Chmod(path, 0660)
+	if uid >= 0 || gid >= 0 {
+		if err = os.Chown(path, uid, gid); err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+func (d *daemonServer) check(uid int) func(method Method) error {
+	return func(method Method) error {
+		if uid == 0 {
+			return nil
+		}
+		if _, ok := daemonUserMethods[method]; !ok {
+			return errors.New("method requires root")
+		}
+		return nil
+	}
+}
+
+// accept serves one app at a time, a new connection takes over from the previous one so a restarted
+// app gets the messages
+func (d *daemonServer) accept() {
+	for {
+		c, err := d.listener.Accept()
+		if err != nil {
+			return
+		}
+		uid, err := daemonPeerUid(c)
+		if err != nil || (uid > 0 && d.uid >= 0 && uid != d.uid) {
+			log.Warnln("[Daemon] refused peer uid %d: %v", uid, err)
+			_ = c.Close()
+			continue
+		}
+		d.mutex.Lock()
+		if d.current != nil {
+			_ = d.current.Close()
+		}
+		d.current = c
+		d.mutex.Unlock()
+		setConn(c)
+		go func() {
+			serveConn(c, d.check(uid))
+			d.mutex.Lock()
+			if d.current == c {
+				d.current = nil
+				setConn(nil)
+			}
+			d.mutex.Unlock()
+			_ = c.Close()
+		}()
+	}
+}
+
+func (d *daemonServer) close() {
+	_ = d.listener.Close()
+	d.mutex.Lock()
+	if d.current != nil {
+		_ = d.current.Close()
+		d.current = nil
+	}
+	d.mutex.Unlock()
+	setConn(nil)
+}
+
+// runDaemon keeps the core up behind the control socket, closing the app no longer stops the
+// proxy or the tun
+func runDaemon(args []string) error {
+	flags := flag.NewFlagSet(daemonCommand, flag.ExitOnError)
+	socket := flags.String("socket", defaultDaemonSocket(), "path of the control socket")
+	home := flags.String("home", "", "home directory of the core")
+	uid := flags.Int("uid", -1, "user allowed to connect besides root")
+	gid := flags.Int("gid", -1, "group owning the control socket")
+	user := flags.String("user", "", "windows sid of the user allowed to connect besides the administrators")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	daemonMode = true
+	controlSocket = *socket
+	daemonUser = *user
+	if *home != "" {
+		params, _ := json.Marshal(&InitParams{HomeDir: *home})
+		handleInitClash(string(params))
+	}
+	return runDaemonService(func(stop <-chan struct{}) {
+		listener, err := listenControlSocket(*socket, *uid, *gid)
+		if err != nil {
+			log.Errorln("[Daemon] listen %s error: %v", *socket, err)
+			return
+		}
+		log.Infoln("[Daemon] control socket at %s", *socket)
+		server := &daemonServer{uid: *uid, listener: listener}
+		go server.accept()
+		<-stop
+		server.close()
+		handleShutdown()
+		_ = os.Remove(*socket)
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/common/utils"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/tunnel"
+	"sync"
+	"time"
+)
+
+const defaultDelayBatchConcurrency = 16
+
+type TestDelayBatchParams struct {
+	Token       string `json:"token"`
+	GroupName   string `json:"group-name"`
+	TestUrl     string `json:"test-url"`
+	Timeout     int64  `json:"timeout"`
+	Concurrency int    `json:"concurrency"`
+}
+
+// DelayBatchResult is streamed for each proxy of a batch as soon as it completes
+type DelayBatchResult struct {
+	Token string `json:"token"`
+	Delay
+}
+
+// DelayBatchSummary is returned once a batch finishes or is canceled
+type DelayBatchSummary struct {
+	Token    string  `json:"token"`
+	Canceled bool    `json:"canceled"`
+	Delays   []Delay `json:"delays"`
+}
+
+var (
+	delayBatches     = map[string]context.CancelFunc{}
+	delayBatchesLock sync.Mutex
+)
+
+// TestDelayBatch tests every proxy of a group, calling onResult as each test completes
+func TestDelayBatch(ctx context.Context, params *TestDelayBatchParams, onResult func(delay Delay)) ([]Delay, error) {
+	proxies := groupMembers(tunnel.ProxiesWithProviders(), params.GroupName)
+	if proxies == nil {
+		return nil, fmt.Errorf("group %s not found", params.GroupName)
+	}
+	expectedStatus, err := utils.NewUnsignedRanges[uint16]("")
+	if err != nil {
+		return nil, err
+	}
+	testUrl := constant.DefaultTestURL
+	if params.TestUrl != "" {
+		testUrl = params.TestUrl
+	}
+	timeout := time.Duration(params.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultURLTestTimeout
+	}
+	concurrency := params.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultDelayBatchConcurrency
+	}
+
+	delays := make([]Delay, 0, len(proxies))
+	mutex := sync.Mutex{}
+	semaphore := make(chan struct{}, concurrency)
+	wg := sync.WaitGroup{}
+	for _, proxy := range proxies {
+		select {
+		case <-ctx.Done():
+		case semaphore <- struct{}{}:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(proxy constant.Proxy) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			testCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			delay := Delay{
+				Url:   testUrl,
+				Name:  proxy.Name(),
+				Value: -1,
+			}
+			value, err := proxy.URLTest(testCtx, testUrl, expectedStatus)
+			if ctx.Err() != nil {
+				return
+			}
+			if err == nil && value != 0 {
+				delay.Value = int32(value)
+			}
+			mutex.Lock()
+			delays = append(delays, delay)
+			mutex.Unlock()
+			onResult(delay)
+		}(proxy)
+	}
+	wg.Wait()
+	return delays, ctx.Err()
+}
+
+func handleTestDelayBatch(paramsString string, fn func(value string, err error)) {
+	var params = &TestDelayBatchParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		fn("", err)
+		return
+	}
+	if params.Token == "" {
+		fn("", errors.New("token is required"))
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	delayBatchesLock.Lock()
+	if _, exists := delayBatches[params.Token]; exists {
+		delayBatchesLock.Unlock()
+		cancel()
+		fn("", fmt.Errorf("batch %s is already running", params.Token))
+		return
+	}
+	delayBatches[params.Token] = cancel
+	delayBatchesLock.Unlock()
+
+	go func() {
+		defer func() {
+			delayBatchesLock.Lock()
+			delete(delayBatches, params.Token)
+			delayBatchesLock.Unlock()
+			cancel()
+		}()
+		delays, err := TestDelayBatch(ctx, params, func(delay Delay) {
+			sendMessage(Message{
+				Type: DelayBatchMessage,
+				Data: DelayBatchResult{Token: params.Token, Delay: delay},
+			})
+		})
+		if delays == nil && err != nil && !errors.Is(err, context.Canceled) {
+			fn("", err)
+			return
+		}
+		data, err := json.Marshal(DelayBatchSummary{
+			Token:    params.Token,
+			Canceled: errors.Is(err, context.Canceled),
+			Delays:   delays,
+		})
+		if err != nil {
+			fn("", err)
+			return
+		}
+		fn(string(data), nil)
+	}()
+}
+
+func handleCancelDelayBatch(token string) bool {
+	delayBatchesLock.Lock()
+	defer delayBatchesLock.Unlock()
+	cancel, exists := delayBatches[token]
+	if !exists {
+		return false
+	}
+	cancel()
+	return true
+}
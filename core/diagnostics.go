@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	"github.com/metacubex/mihomo/tunnel/statistic"
+	"os"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	panicStoreFile       = "panics.json"
+	maxPanicRecords      = 20
+	diagnosticsLogLimit  = 500
+	redactedPlaceholder  = "<redacted>"
+	diagnosticsStackSize = 16 * 1024
+)
+
+// redactPatterns match the secrets that end up in logs and panic values, applied in order
+var redactPatterns = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`(?i)([a-z][a-z0-9+.-]*://)[^/\s:@]+(:[^/\s@]*)?@`), "${1}" + redactedPlaceholder + "@"},
+	{regexp.MustCompile(`(?i)((?:password|passwd|passphrase|secret|token|private-key|public-key|pre-shared-key|psk|auth|uuid|key|short-id)["']?\s*[:=]\s*["']?)[^\s"',}&]+`), "${1}" + redactedPlaceholder},
+	{regexp.MustCompile(`(?i)\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`), redactedPlaceholder},
+	{regexp.MustCompile(`\b[A-Za-z0-9+/_-]{40,}={0,2}`), redactedPlaceholder},
+}
+
+func redactSecrets(value string) string {
+	for _, item := range redactPatterns {
+		value = item.pattern.ReplaceAllString(value, item.replacement)
+	}
+	return value
+}
+
+type PanicRecord struct {
+	Time   int64  `json:"time"`
+	Source string `json:"source"`
+	Value  string `json:"value"`
+	Stack  string `json:"stack"`
+}
+
+// PanicRecorder keeps the recovered panics, also across restarts through the home dir
+type PanicRecorder struct {
+	mutex   sync.Mutex
+	loaded  bool
+	records []PanicRecord
+}
+
+var panicRecorder = &PanicRecorder{}
+
+func (r *PanicRecorder) path() string {
+	return constant.Path.Resolve(panicStoreFile)
+}
+
+func (r *PanicRecorder) loadLocked() {
+	if r.loaded || !isInit {
+		return
+	}
+	r.loaded = true
+	data, err := os.ReadFile(r.path())
+	if err != nil {
+		return
+	}
+	var records []PanicRecord
+	if json.Unmarshal(data, &records) == nil {
+		r.records = append(records, r.records...)
+	}
+}
+
+func (r *PanicRecorder) Record(source string, value any, stack []byte) {
+	if len(stack) > diagnosticsStackSize {
+		stack = stack[:diagnosticsStackSize]
+	}
+	record := PanicRecord{
+		Time:   time.Now().UnixMilli(),
+		Source: source,
+		Value:  redactSecrets(fmt.Sprint(value)),
+		Stack:  string(stack),
+	}
+	r.mutex.Lock()
+	r.loadLocked()
+	r.records = append(r.records, record)
+	if len(r.records) > maxPanicRecords {
+		r.records = r.records[len(r.records)-maxPanicRecords:]
+	}
+	if isInit {
+		if data, err := json.Marshal(r.records); err == nil {
+			_ = os.WriteFile(r.path(), data, 0600)
+		}
+	}
+	r.mutex.Unlock()
+	go log.Errorln("[Panic] %s: %s", source, record.Value)
+}
+
+func (r *PanicRecorder) Records() []PanicRecord {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.loadLocked()
+	return append([]PanicRecord{}, r.records...)
+}
+
+func (r *PanicRecorder) Clear() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.records = nil
+	r.loaded = true
+	_ = os.Remove(r.path())
+}
+
+// recoverPanic must be deferred directly, it records a panic of the goroutine instead of crashing the core
+func recoverPanic(source string) {
+	if value := recover(); value != nil {
+		panicRecorder.Record(source, value, debug.Stack())
+	}
+}
+
+// runGuarded runs one step of a background loop so a panic ends the step and not the loop
+func runGuarded(source string, fn func()) {
+	defer recoverPanic(source)
+	fn()
+}
+
+type ConfigFingerprint struct {
+	Hash          string         `json:"hash"`
+	Mode          string         `json:"mode"`
+	Tun           bool           `json:"tun"`
+	TunStack      string         `json:"tun-stack"`
+	DnsEnable     bool           `json:"dns-enable"`
+	DnsMode       string         `json:"dns-mode"`
+	IPv6          bool           `json:"ipv6"`
+	AllowLan      bool           `json:"allow-lan"`
+	Proxies       int            `json:"proxies"`
+	ProxyTypes    map[string]int `json:"proxy-types"`
+	Rules         int            `json:"rules"`
+	RuleProviders int            `json:"rule-providers"`
+	Listeners     int            `json:"listeners"`
+}
+
+// configFingerprint describes the running config without names, servers or credentials
+func configFingerprint() *ConfigFingerprint {
+	runLock.Lock()
+	defer runLock.Unlock()
+	if currentConfig == nil {
+		return nil
+	}
+	general := currentConfig.General
+	fingerprint := &ConfigFingerprint{
+		Mode:          general.Mode.String(),
+		Tun:           general.Tun.Enable,
+		TunStack:      general.Tun.Stack.String(),
+		IPv6:          general.IPv6,
+		AllowLan:      general.AllowLan,
+		ProxyTypes:    map[string]int{},
+		Rules:         len(tunnel.Rules()),
+		RuleProviders: len(tunnel.RuleProviders()),
+		Listeners:     len(currentConfig.Listeners),
+	}
+	if dnsConfig := currentConfig.DNS; dnsConfig != nil {
+		fingerprint.DnsEnable = dnsConfig.Enable
+		fingerprint.DnsMode = dnsConfig.EnhancedMode.String()
+	}
+	for _, proxy := range tunnel.Proxies() {
+		fingerprint.Proxies++
+		fingerprint.ProxyTypes[proxy.Type().String()]++
+	}
+	data, _ := json.Marshal(fingerprint)
+	sum := sha256.Sum256(data)
+	fingerprint.Hash = hex.EncodeToString(sum[:8])
+	return fingerprint
+}
+
+type RuntimeMetrics struct {
+	Goroutines    int    `json:"goroutines"`
+	HeapAlloc     uint64 `json:"heap-alloc"`
+	HeapInuse     uint64 `json:"heap-inuse"`
+	Sys           uint64 `json:"sys"`
+	NumGC         uint32 `json:"num-gc"`
+	Connections   int    `json:"connections"`
+	UploadTotal   int64  `json:"upload-total"`
+	DownloadTotal int64  `json:"download-total"`
+}
+
+func runtimeMetrics() RuntimeMetrics {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	snapshot := statistic.DefaultManager.Snapshot()
+	return RuntimeMetrics{
+		Goroutines:    runtime.NumGoroutine(),
+		HeapAlloc:     stats.HeapAlloc,
+		HeapInuse:     stats.HeapInuse,
+		Sys:           stats.Sys,
+		NumGC:         stats.NumGC,
+		Connections:   len(snapshot.Connections),
+		UploadTotal:   snapshot.UploadTotal,
+		DownloadTotal: snapshot.DownloadTotal,
+	}
+}
+
+type DiagnosticsBundle struct {
+	Time       int64              `json:"time"`
+	Version    string             `json:"version"`
+	AppVersion int                `json:"app-version"`
+	GoVersion  string             `json:"go-version"`
+	Platform   string             `json:"platform"`
+	Running    bool               `json:"running"`
+	Config     *ConfigFingerprint `json:"config"`
+	Metrics    RuntimeMetrics     `json:"metrics"`
+	Panics     []PanicRecord      `json:"panics"`
+	Logs       []LogEntry         `json:"logs"`
+	Goroutines string             `json:"goroutines,omitempty"`
+}
+
+// DiagnosticsParams selects the optional parts of the bundle
+type DiagnosticsParams struct {
+	Goroutines bool `json:"goroutines"`
+	LogLimit   int  `json:"log-limit"`
+}
+
+func exportDiagnostics(params *DiagnosticsParams) *DiagnosticsBundle {
+	limit := params.LogLimit
+	if limit <= 0 {
+		limit = diagnosticsLogLimit
+	}
+	logs := logPipeline.Entries(&LogQueryParams{Limit: limit})
+	for i := range logs {
+		logs[i].Message = redactSecrets(logs[i].Message)
+	}
+	bundle := &DiagnosticsBundle{
+		Time:       time.Now().UnixMilli(),
+		Version:    constant.Version,
+		AppVersion: version,
+		GoVersion:  runtime.Version(),
+		Platform:   runtime.GOOS + "/" + runtime.GOARCH,
+		Running:    isRunning,
+		Config:     configFingerprint(),
+		Metrics:    runtimeMetrics(),
+		Panics:     panicRecorder.Records(),
+		Logs:       logs,
+	}
+	sort.Slice(bundle.Panics, func(i, j int) bool {
+		return bundle.Panics[i].Time < bundle.Panics[j].Time
+	})
+	if params.Goroutines {
+		buf := make([]byte, 1<<20)
+		bundle.Goroutines = redactSecrets(string(buf[:runtime.Stack(buf, true)]))
+	}
+	return bundle
+}
+
+func handleExportDiagnostics(paramsString string) string {
+	var params = &DiagnosticsParams{}
+	if paramsString != "" {
+		_ = json.Unmarshal([]byte(paramsString), params)
+	}
+	data, err := json.Marshal(exportDiagnostics(params))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handleClearPanics() bool {
+	panicRecorder.Clear()
+	return true
+}
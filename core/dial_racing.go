@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/common/lru"
+	"github.com/metacubex/mihomo/component/dialer"
+	"github.com/metacubex/mihomo/component/resolver"
+	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultAttemptDelay is the connection attempt delay recommended by RFC 8305
+	defaultAttemptDelay = 250
+	minAttemptDelay     = 10
+	maxAttemptDelay     = 2000
+	defaultRaceWidth    = 2
+	maxRaceWidth        = 4
+
+	dialTelemetrySize = 4096
+	dialTelemetryTTL  = 600
+)
+
+// DialRacingParams configures how outbounds reach their servers, happy eyeballs races the
+// addresses of a server hostname and the race groups dial their fastest members at once
+type DialRacingParams struct {
+	HappyEyeballs bool     `json:"happy-eyeballs"`
+	AttemptDelay  int      `json:"attempt-delay"`
+	PreferIPv4    bool     `json:"prefer-ipv4"`
+	RaceGroups    []string `json:"race-groups"`
+	RaceWidth     int      `json:"race-width"`
+}
+
+// DialTelemetry describes how the outbound connection of a tracked connection was established
+type DialTelemetry struct {
+	Proxy    string   `json:"proxy"`
+	Address  string   `json:"address"`
+	Family   string   `json:"family"`
+	Attempts int      `json:"attempts"`
+	Raced    []string `json:"raced,omitempty"`
+	Duration int64    `json:"duration"`
+}
+
+type DialRacingStats struct {
+	DialRacingParams
+	Dials      int64 `json:"dials"`
+	Fallbacks  int64 `json:"fallbacks"`
+	Races      int64 `json:"races"`
+	RaceLosses int64 `json:"race-losses"`
+}
+
+// DialRacing owns the racing layers of the outbounds and the telemetry of their recent dials
+type DialRacing struct {
+	mutex      sync.Mutex
+	params     DialRacingParams
+	groups     map[string]struct{}
+	telemetry  *lru.LruCache[*C.Metadata, *DialTelemetry]
+	dials      atomic.Int64
+	fallbacks  atomic.Int64
+	races      atomic.Int64
+	raceLosses atomic.Int64
+}
+
+var dialRacing = &DialRacing{
+	groups: map[string]struct{}{},
+	telemetry: lru.New[*C.Metadata, *DialTelemetry](
+		lru.WithSize[*C.Metadata, *DialTelemetry](dialTelemetrySize),
+		lru.WithAge[*C.Metadata, *DialTelemetry](dialTelemetryTTL),
+	),
+}
+
+type dialTraceKey struct{}
+
+// dialTrace collects the telemetry of one outbound dial through the layers it passes
+type dialTrace struct {
+	mutex     sync.Mutex
+	telemetry DialTelemetry
+}
+
+func traceFromContext(ctx context.Context) *dialTrace {
+	trace, _ := ctx.Value(dialTraceKey{}).(*dialTrace)
+	return trace
+}
+
+func (t *dialTrace) update(fn func(telemetry *DialTelemetry)) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	fn(&t.telemetry)
+}
+
+func (t *dialTrace) snapshot() DialTelemetry {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.telemetry
+}
+
+// startTrace returns the trace of the dial, the layer that creates it is the one that records it
+func startTrace(ctx context.Context) (context.Context, *dialTrace, bool) {
+	if trace := traceFromContext(ctx); trace != nil {
+		return ctx, trace, false
+	}
+	trace := &dialTrace{}
+	return context.WithValue(ctx, dialTraceKey{}, trace), trace, true
+}
+
+func (r *DialRacing) record(metadata *C.Metadata, trace *dialTrace) {
+	telemetry := trace.snapshot()
+	r.telemetry.Set(metadata, &telemetry)
+}
+
+func (r *DialRacing) Telemetry(metadata *C.Metadata) *DialTelemetry {
+	if metadata == nil {
+		return nil
+	}
+	telemetry, ok := r.telemetry.Get(metadata)
+	if !ok {
+		return nil
+	}
+	return telemetry
+}
+
+func (r *DialRacing) TrimTelemetry() {
+	r.telemetry.Clear()
+}
+
+func (r *DialRacing) Set(params *DialRacingParams) error {
+	settings := DialRacingParams{}
+	if params != nil {
+		settings = *params
+	}
+	if settings.AttemptDelay == 0 {
+		settings.AttemptDelay = defaultAttemptDelay
+	}
+	if settings.AttemptDelay < minAttemptDelay || settings.AttemptDelay > maxAttemptDelay {
+		return fmt.Errorf("attempt delay must be between %d and %d ms", minAttemptDelay, maxAttemptDelay)
+	}
+	if settings.RaceWidth == 0 {
+		settings.RaceWidth = defaultRaceWidth
+	}
+	if settings.RaceWidth < 2 || settings.RaceWidth > maxRaceWidth {
+		return fmt.Errorf("race width must be between 2 and %d", maxRaceWidth)
+	}
+	groups := map[string]struct{}{}
+	for _, name := range settings.RaceGroups {
+		groups[name] = struct{}{}
+	}
+	runLock.Lock()
+	defer runLock.Unlock()
+	r.mutex.Lock()
+	r.params = settings
+	r.groups = groups
+	r.mutex.Unlock()
+	rewrapOutboundsLocked()
+	return nil
+}
+
+func (r *DialRacing) settings() DialRacingParams {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.params
+}
+
+func (r *DialRacing) Stats() *DialRacingStats {
+	return &DialRacingStats{
+		DialRacingParams: r.settings(),
+		Dials:            r.dials.Load(),
+		Fallbacks:        r.fallbacks.Load(),
+		Races:            r.races.Load(),
+		RaceLosses:       r.raceLosses.Load(),
+	}
+}
+
+// happyEyeballsCapable tells whether the adapter dials its server through a dialer it is handed
+func happyEyeballsCapable(proxy C.ProxyAdapter) bool {
+	if _, ok := proxy.(C.Group); ok {
+		return false
+	}
+	switch proxy.SupportWithDialer() {
+	case C.ALLNet, C.TCP:
+	default:
+		return false
+	}
+	// mux sessions and dialer proxies replace the dialer they are handed
+	info := proxy.ProxyInfo()
+	if info.SMUX || info.DialerProxy != "" {
+		return false
+	}
+	_, ok := proxy.(interface{ DialOptions() []dialer.Option })
+	return ok
+}
+
+func (r *DialRacing) wrap(name string, proxy C.ProxyAdapter) C.ProxyAdapter {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.groups[name]; ok {
+		if _, isGroup := proxy.(C.Group); isGroup {
+			return &racingGroupAdapter{ProxyAdapter: proxy, name: name}
+		}
+	}
+	if r.params.HappyEyeballs && happyEyeballsCapable(proxy) {
+		return &happyEyeballsAdapter{ProxyAdapter: proxy}
+	}
+	return proxy
+}
+
+// happyEyeballsAdapter dials the server of an outbound with RFC 8305 address racing
+type happyEyeballsAdapter struct {
+	C.ProxyAdapter
+}
+
+func (a *happyEyeballsAdapter) Inner() C.ProxyAdapter {
+	return a.ProxyAdapter
+}
+
+func (a *happyEyeballsAdapter) DialContext(ctx context.Context, metadata *C.Metadata) (C.Conn, error) {
+	options := a.ProxyAdapter.(interface{ DialOptions() []dialer.Option }).DialOptions()
+	settings := dialRacing.settings()
+	ctx, trace, owned := startTrace(ctx)
+	started := time.Now()
+	conn, err := a.ProxyAdapter.DialContextWithDialer(ctx, &happyEyeballsDialer{
+		dialer: dialer.NewDialer(options...),
+		delay:  time.Duration(settings.AttemptDelay) * time.Millisecond,
+		prefer: settings.PreferIPv4,
+		trace:  trace,
+	}, metadata)
+	trace.update(func(telemetry *DialTelemetry) {
+		telemetry.Proxy = a.Name()
+		telemetry.Duration = time.Since(started).Milliseconds()
+	})
+	if err == nil && owned {
+		dialRacing.record(metadata, trace)
+	}
+	return conn, err
+}
+
+// happyEyeballsDialer starts a connection attempt every delay, alternating the address families
+// and moving on at once when an attempt fails, the first established connection wins
+type happyEyeballsDialer struct {
+	dialer C.Dialer
+	delay  time.Duration
+	prefer bool
+	trace  *dialTrace
+}
+
+type eyeballsResult struct {
+	conn net.Conn
+	ip   netip.Addr
+	err  error
+}
+
+// interleaveAddrs orders the addresses as RFC 8305 section 4 describes, starting with the preferred family
+func interleaveAddrs(ips []netip.Addr, preferIPv4 bool) []netip.Addr {
+	ipv4s, ipv6s := resolver.SortationAddr(ips)
+	first, second := ipv6s, ipv4s
+	if preferIPv4 {
+		first, second = ipv4s, ipv6s
+	}
+	ordered := make([]netip.Addr, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
+
+func addrFamily(ip netip.Addr) string {
+	if ip.Is4() {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+func (d *happyEyeballsDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	dialRacing.dials.Add(1)
+	if ip, err := netip.ParseAddr(host); err == nil {
+		d.trace.update(func(telemetry *DialTelemetry) {
+			telemetry.Address = address
+			telemetry.Family = addrFamily(ip.Unmap())
+			telemetry.Attempts = 1
+		})
+		return d.dialer.DialContext(ctx, network, address)
+	}
+	ips, err := resolver.LookupIPWithResolver(ctx, host, resolver.ProxyServerHostResolver)
+	if err != nil {
+		return nil, fmt.Errorf("dns resolve failed: %w", err)
+	}
+	for i, ip := range ips {
+		ips[i] = ip.Unmap()
+	}
+	ips = interleaveAddrs(ips, d.prefer)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no ip address for %s", host)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan eyeballsResult)
+	done := make(chan struct{})
+	defer close(done)
+
+	next, running := 0, 0
+	attempt := func() {
+		ip := ips[next]
+		next++
+		running++
+		go func() {
+			conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			select {
+			case results <- eyeballsResult{conn: conn, ip: ip, err: err}:
+			case <-done:
+				if conn != nil {
+					_ = conn.Close()
+				}
+			}
+		}()
+	}
+	attempt()
+	timer := time.NewTimer(d.delay)
+	defer timer.Stop()
+
+	var errs []error
+	for {
+		select {
+		case <-timer.C:
+			if next < len(ips) {
+				attempt()
+				timer.Reset(d.delay)
+			}
+		case result := <-results:
+			running--
+			if result.err == nil {
+				if next > 1 {
+					dialRacing.fallbacks.Add(1)
+				}
+				d.trace.update(func(telemetry *DialTelemetry) {
+					telemetry.Address = net.JoinHostPort(result.ip.String(), port)
+					telemetry.Family = addrFamily(result.ip)
+					telemetry.Attempts = next
+				})
+				return result.conn, nil
+			}
+			errs = append(errs, fmt.Errorf("connect %s failed: %w", result.ip, result.err))
+			if next < len(ips) {
+				attempt()
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(d.delay)
+			} else if running == 0 {
+				return nil, errors.Join(errs...)
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (d *happyEyeballsDialer) ListenPacket(ctx context.Context, network, address string, rAddrPort netip.AddrPort) (net.PacketConn, error) {
+	return d.dialer.ListenPacket(ctx, network, address, rAddrPort)
+}
+
+// racingGroupAdapter dials the fastest alive members of a group at once and keeps the first
+// connection that is established, the group selection itself is left alone
+type racingGroupAdapter struct {
+	C.ProxyAdapter
+	name string
+}
+
+func (a *racingGroupAdapter) Inner() C.ProxyAdapter {
+	return a.ProxyAdapter
+}
+
+func (a *racingGroupAdapter) candidates(width int) []C.Proxy {
+	proxies := tunnel.ProxiesWithProviders()
+	testUrl := ""
+	if snapshot, ok := snapshotGroup(proxies[a.name]); ok {
+		testUrl = snapshot.TestUrl
+	}
+	var alive []C.Proxy
+	for _, member := range groupMembers(proxies, a.name) {
+		if member.AliveForTestUrl(testUrl) && member.LastDelayForTestUrl(testUrl) != 0xffff {
+			alive = append(alive, member)
+		}
+	}
+	sort.SliceStable(alive, func(i, j int) bool {
+		return alive[i].LastDelayForTestUrl(testUrl) < alive[j].LastDelayForTestUrl(testUrl)
+	})
+	if len(alive) > width {
+		alive = alive[:width]
+	}
+	return alive
+}
+
+type raceResult struct {
+	conn  C.Conn
+	proxy C.Proxy
+	trace *dialTrace
+	err   error
+}
+
+func (a *racingGroupAdapter) DialContext(ctx context.Context, metadata *C.Metadata) (C.Conn, error) {
+	if metadata.NetWork != C.TCP {
+		return a.ProxyAdapter.DialContext(ctx, metadata)
+	}
+	candidates := a.candidates(dialRacing.settings().RaceWidth)
+	if len(candidates) < 2 {
+		return a.ProxyAdapter.DialContext(ctx, metadata)
+	}
+	dialRacing.races.Add(1)
+	started := time.Now()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan raceResult)
+	done := make(chan struct{})
+	defer close(done)
+	raced := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		raced = append(raced, candidate.Name())
+		go func(proxy C.Proxy) {
+			trace := &dialTrace{}
+			conn, err := proxy.DialContext(context.WithValue(ctx, dialTraceKey{}, trace), metadata.Clone())
+			select {
+			case results <- raceResult{conn: conn, proxy: proxy, trace: trace, err: err}:
+			case <-done:
+				if conn != nil {
+					dialRacing.raceLosses.Add(1)
+					_ = conn.Close()
+				}
+			}
+		}(candidate)
+	}
+	var errs []error
+	for range candidates {
+		result := <-results
+		if result.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", result.proxy.Name(), result.err))
+			continue
+		}
+		result.conn.AppendToChains(a)
+		telemetry := result.trace.snapshot()
+		telemetry.Proxy = result.proxy.Name()
+		telemetry.Raced = raced
+		telemetry.Duration = time.Since(started).Milliseconds()
+		if trace := traceFromContext(ctx); trace != nil {
+			trace.update(func(parent *DialTelemetry) {
+				*parent = telemetry
+			})
+		} else {
+			dialRacing.telemetry.Set(metadata, &telemetry)
+		}
+		log.Debugln("[DialRacing] %s won the race of %s for %s", result.proxy.Name(), a.name, metadata.RemoteAddress())
+		return result.conn, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+func handleSetDialRacing(paramsString string) error {
+	var params *DialRacingParams
+	if err := json.Unmarshal([]byte(paramsString), &params); err != nil {
+		return err
+	}
+	return dialRacing.Set(params)
+}
+
+func handleGetDialRacing() string {
+	data, err := json.Marshal(dialRacing.Stats())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/metacubex/mihomo/log"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	discoveryService       = "_flclash._tcp.local."
+	discoveryTTL           = 120
+	defaultBrowseInterval  = 30 * time.Second
+	discoveryAnnounceDelay = time.Second
+	discoveryVersion       = "1"
+)
+
+var discoveryGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// DiscoveryParams advertises this core and browses for others, android only hands multicast to
+// the core while the app holds a multicast lock
+type DiscoveryParams struct {
+	Enable    bool   `json:"enable"`
+	Name      string `json:"name"`
+	Advertise bool   `json:"advertise"`
+	// Interval is the seconds between two browse queries
+	Interval int64 `json:"interval"`
+}
+
+// DiscoveredPeer is a core seen on the lan, Paired tells the remote management knows its key
+type DiscoveredPeer struct {
+	Instance     string            `json:"instance"`
+	Name         string            `json:"name"`
+	Fingerprint  string            `json:"fingerprint,omitempty"`
+	Host         string            `json:"host"`
+	Addresses    []string          `json:"addresses"`
+	Port         int               `json:"port,omitempty"`
+	Capabilities []string          `json:"capabilities"`
+	Txt          map[string]string `json:"txt"`
+	Paired       bool              `json:"paired"`
+	LastSeen     int64             `json:"last-seen"`
+	expires      time.Time
+}
+
+type DiscoveryStatus struct {
+	DiscoveryParams
+	Running  bool              `json:"running"`
+	Instance string            `json:"instance,omitempty"`
+	Peers    []*DiscoveredPeer `json:"peers"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// Discovery speaks just enough multicast dns for the service of the cores, the responder of the
+// os is left alone and answers for everything else
+type Discovery struct {
+	mutex    sync.Mutex
+	params   DiscoveryParams
+	conn     *net.UDPConn
+	cancel   context.CancelFunc
+	instance string
+	peers    map[string]*DiscoveredPeer
+	err      error
+}
+
+var discovery = &Discovery{peers: map[string]*DiscoveredPeer{}}
+
+func (p *DiscoveryParams) interval() time.Duration {
+	if p.Interval <= 0 {
+		return defaultBrowseInterval
+	}
+	return time.Duration(p.Interval) * time.Second
+}
+
+// discoveryLabel keeps a name usable as a dns label
+func discoveryLabel(name string) string {
+	label := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-':
+			return r
+		}
+		return '-'
+	}, name)
+	label = strings.Trim(label, "-")
+	if len(label) > 48 {
+		label = label[:48]
+	}
+	if label == "" {
+		return "flclash"
+	}
+	return label
+}
+
+func (d *Discovery) Set(params *DiscoveryParams) error {
+	if params.Name == "" {
+		params.Name = defaultRemoteName()
+	}
+	d.mutex.Lock()
+	d.stopLocked()
+	d.params = *params
+	d.err = nil
+	if !params.Enable {
+		d.mutex.Unlock()
+		return nil
+	}
+	err := d.startLocked()
+	if err != nil {
+		d.err = err
+	}
+	d.mutex.Unlock()
+	return err
+}
+
+func (d *Discovery) startLocked() error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, discoveryGroup)
+	if err != nil {
+		return err
+	}
+	fingerprint := remote.Status().Fingerprint
+	suffix := fingerprint
+	if len(suffix) > 6 {
+		suffix = suffix[:6]
+	}
+	d.instance = discoveryLabel(d.params.Name) + "-" + suffix
+	d.conn = conn
+	d.peers = map[string]*DiscoveredPeer{}
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+	go d.serve(ctx, conn)
+	go d.browse(ctx, conn, d.params)
+	log.Infoln("[Discovery] started as %s", d.instance)
+	return nil
+}
+
+func (d *Discovery) stopLocked() {
+	if d.cancel == nil {
+		return
+	}
+	d.cancel()
+	d.cancel = nil
+	if d.params.Advertise {
+		d.writeLocked(d.conn, d.recordsLocked(0, nil, 0))
+	}
+	_ = d.conn.Close()
+	d.conn = nil
+}
+
+func (d *Discovery) Close() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.stopLocked()
+}
+
+// Announce tells the lan at once, the capabilities changed when a server went up or down
+func (d *Discovery) Announce() {
+	txt, port := discoveryCapabilities()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.conn != nil && d.params.Advertise {
+		d.writeLocked(d.conn, d.recordsLocked(discoveryTTL, txt, port))
+	}
+}
+
+func (d *Discovery) writeLocked(conn *net.UDPConn, msg *dns.Msg) {
+	if conn == nil || msg == nil {
+		return
+	}
+	data, err := msg.Pack()
+	if err != nil {
+		return
+	}
+	_, _ = conn.WriteToUDP(data, discoveryGroup)
+}
+
+func (d *Discovery) hostLocked() string {
+	return d.instance + ".local."
+}
+
+func (d *Discovery) instanceNameLocked() string {
+	return d.instance + "." + discoveryService
+}
+
+// discoveryCapabilities are what this core offers the others, the share server takes the run lock
+// so they are read before the lock of the discovery
+func discoveryCapabilities() (map[string]string, int) {
+	txt := map[string]string{"v": discoveryVersion}
+	status := remote.Status()
+	txt["fp"] = status.Fingerprint
+	port := 0
+	var capabilities []string
+	if status.Listening != "" {
+		_, portString, _ := net.SplitHostPort(status.Listening)
+		port, _ = strconv.Atoi(portString)
+		capabilities = append(capabilities, "remote")
+	}
+	// the provider and the device id of the sync stay off the lan, a peer only learns it syncs
+	if sync := syncEngine.Status(); sync.Provider != "" {
+		capabilities = append(capabilities, "sync")
+	}
+	if share := shareServer.Status(); share.Address != "" {
+		capabilities = append(capabilities, "share")
+	}
+	if grpc := grpcServer.Status(); grpc.Running && !isLoopbackAddress(grpc.Address) {
+		capabilities = append(capabilities, "grpc")
+	}
+	txt["caps"] = strings.Join(capabilities, ",")
+	return txt, port
+}
+
+func discoveryAddresses() []netip.Addr {
+	var addrs []netip.Addr
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for _, item := range interfaces {
+		if item.Flags&net.FlagUp == 0 || item.Flags&net.FlagLoopback != 0 || item.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		itemAddrs, err := item.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, itemAddr := range itemAddrs {
+			prefix, err := netip.ParsePrefix(itemAddr.String())
+			if err != nil {
+				continue
+			}
+			if addr := prefix.Addr(); addr.Is4() && addr.IsPrivate() {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
+
+// recordsLocked is the full record set of this core, a goodbye carries the pointer with a zero ttl
+func (d *Discovery) recordsLocked(ttl uint32, txt map[string]string, port int) *dns.Msg {
+	if d.instance == "" {
+		return nil
+	}
+	msg := &dns.Msg{}
+	msg.Response = true
+	msg.Authoritative = true
+	header := func(name string, rrType uint16, flush bool) dns.RR_Header {
+		class := uint16(dns.ClassINET)
+		if flush {
+			class |= 1 << 15
+		}
+		return dns.RR_Header{Name: name, Rrtype: rrType, Class: class, Ttl: ttl}
+	}
+	msg.Answer = append(msg.Answer, &dns.PTR{Hdr: header(discoveryService, dns.TypePTR, false), Ptr: d.instanceNameLocked()})
+	if txt == nil {
+		return msg
+	}
+	txt["name"] = d.params.Name
+	keys := make([]string, 0, len(txt))
+	for key := range txt {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([]string, 0, len(keys))
+	for _, key := range keys {
+		values = append(values, key+"="+txt[key])
+	}
+	msg.Extra = append(msg.Extra,
+		&dns.SRV{Hdr: header(d.instanceNameLocked(), dns.TypeSRV, true), Port: uint16(port), Target: d.hostLocked()},
+		&dns.TXT{Hdr: header(d.instanceNameLocked(), dns.TypeTXT, true), Txt: values},
+	)
+	for _, addr := range discoveryAddresses() {
+		msg.Extra = append(msg.Extra, &dns.A{Hdr: header(d.hostLocked(), dns.TypeA, true), A: addr.AsSlice()})
+	}
+	return msg
+}
+
+func (d *Discovery) browse(ctx context.Context, conn *net.UDPConn, params DiscoveryParams) {
+	timer := time.NewTimer(discoveryAnnounceDelay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		query := &dns.Msg{}
+		query.SetQuestion(discoveryService, dns.TypePTR)
+		query.Id = 0
+		query.RecursionDesired = false
+		txt, port := discoveryCapabilities()
+		d.mutex.Lock()
+		if ctx.Err() == nil {
+			d.writeLocked(conn, query)
+			if params.Advertise {
+				d.writeLocked(conn, d.recordsLocked(discoveryTTL, txt, port))
+			}
+		}
+		d.expireLocked()
+		d.mutex.Unlock()
+		timer.Reset(powerScaled(params.interval()))
+	}
+}
+
+func (d *Discovery) serve(ctx context.Context, conn *net.UDPConn) {
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Warnln("[Discovery] read error: %v", err)
+				d.mutex.Lock()
+				d.err = err
+				d.mutex.Unlock()
+			}
+			return
+		}
+		msg := &dns.Msg{}
+		if err = msg.Unpack(buf[:n]); err != nil {
+			continue
+		}
+		runGuarded("discovery", func() {
+			if msg.Response {
+				d.learn(msg)
+			} else {
+				d.answer(conn, msg)
+			}
+		})
+	}
+}
+
+func (d *Discovery) answer(conn *net.UDPConn, msg *dns.Msg) {
+	asked := false
+	for _, question := range msg.Question {
+		if strings.HasSuffix(strings.ToLower(question.Name), discoveryService) {
+			asked = true
+			break
+		}
+	}
+	if !asked {
+		return
+	}
+	txt, port := discoveryCapabilities()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !d.params.Advertise || d.conn != conn {
+		return
+	}
+	for _, question := range msg.Question {
+		name := strings.ToLower(question.Name)
+		if name == discoveryService || name == strings.ToLower(d.instanceNameLocked()) {
+			d.writeLocked(conn, d.recordsLocked(discoveryTTL, txt, port))
+			return
+		}
+	}
+}
+
+// learn puts the records of an answer together, the records of one core may come in any section
+func (d *Discovery) learn(msg *dns.Msg) {
+	records := append(append(append([]dns.RR{}, msg.Answer...), msg.Ns...), msg.Extra...)
+	instances := map[string]uint32{}
+	srvs := map[string]*dns.SRV{}
+	txts := map[string]*dns.TXT{}
+	hosts := map[string][]string{}
+	for _, record := range records {
+		switch record := record.(type) {
+		case *dns.PTR:
+			if strings.EqualFold(record.Hdr.Name, discoveryService) {
+				instances[record.Ptr] = record.Hdr.Ttl
+			}
+		case *dns.SRV:
+			srvs[record.Hdr.Name] = record
+		case *dns.TXT:
+			txts[record.Hdr.Name] = record
+		case *dns.A:
+			hosts[strings.ToLower(record.Hdr.Name)] = append(hosts[strings.ToLower(record.Hdr.Name)], record.A.String())
+		}
+	}
+	if len(instances) == 0 {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	own := d.instanceNameLocked()
+	for instance, ttl := range instances {
+		if strings.EqualFold(instance, own) {
+			continue
+		}
+		if ttl == 0 {
+			if _, ok := d.peers[instance]; ok {
+				delete(d.peers, instance)
+				go sendDiscoveryMessage(instance, nil)
+			}
+			continue
+		}
+		peer := &DiscoveredPeer{
+			Instance:  strings.TrimSuffix(instance, "."+discoveryService),
+			Addresses: []string{},
+			Txt:       map[string]string{},
+		}
+		if srv, ok := srvs[instance]; ok {
+			peer.Host = srv.Target
+			peer.Port = int(srv.Port)
+			peer.Addresses = append(peer.Addresses, hosts[strings.ToLower(srv.Target)]...)
+		}
+		if txt, ok := txts[instance]; ok {
+			for _, value := range txt.Txt {
+				key, item, _ := strings.Cut(value, "=")
+				peer.Txt[key] = item
+			}
+		}
+		peer.Name = peer.Txt["name"]
+		peer.Fingerprint = peer.Txt["fp"]
+		peer.Capabilities = []string{}
+		if caps := peer.Txt["caps"]; caps != "" {
+			peer.Capabilities = strings.Split(caps, ",")
+		}
+		if peer.Fingerprint != "" {
+			remote.mutex.Lock()
+			peer.Paired = remote.peerLocked(peer.Fingerprint, HostRemoteRole) != nil
+			remote.mutex.Unlock()
+		}
+		peer.LastSeen = time.Now().UnixMilli()
+		peer.expires = time.Now().Add(time.Duration(ttl) * time.Second)
+		previous, seen := d.peers[instance]
+		d.peers[instance] = peer
+		if !seen || previous.Txt["caps"] != peer.Txt["caps"] || previous.Port != peer.Port {
+			go sendDiscoveryMessage(instance, peer)
+		}
+	}
+}
+
+func (d *Discovery) expireLocked() {
+	now := time.Now()
+	for instance, peer := range d.peers {
+		if now.After(peer.expires) {
+			delete(d.peers, instance)
+			go sendDiscoveryMessage(instance, nil)
+		}
+	}
+}
+
+type DiscoveryEvent struct {
+	Instance string          `json:"instance"`
+	Peer     *DiscoveredPeer `json:"peer,omitempty"`
+	Lost     bool            `json:"lost"`
+}
+
+func sendDiscoveryMessage(instance string, peer *DiscoveredPeer) {
+	sendMessage(Message{
+		Type: DiscoveryMessage,
+		Data: &DiscoveryEvent{
+			Instance: strings.TrimSuffix(instance, "."+discoveryService),
+			Peer:     peer,
+			Lost:     peer == nil,
+		},
+	})
+}
+
+func (d *Discovery) Status() *DiscoveryStatus {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.expireLocked()
+	status := &DiscoveryStatus{
+		DiscoveryParams: d.params,
+		Running:         d.conn != nil,
+		Peers:           make([]*DiscoveredPeer, 0, len(d.peers)),
+	}
+	if d.conn != nil {
+		status.Instance = d.instance
+	}
+	for _, peer := range d.peers {
+		status.Peers = append(status.Peers, peer)
+	}
+	sort.Slice(status.Peers, func(i, j int) bool {
+		return status.Peers[i].Instance < status.Peers[j].Instance
+	})
+	if d.err != nil {
+		status.Error = d.err.Error()
+	}
+	return status
+}
+
+func handleSetDiscovery(paramsString string) error {
+	params := &DiscoveryParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	return discovery.Set(params)
+}
+
+func handleGetDiscovery() string {
+	data, err := json.Marshal(discovery.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
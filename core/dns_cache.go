@@ -0,0 +1,469 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"github.com/metacubex/mihomo/component/resolver"
+	"github.com/miekg/dns"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dnsStaleAnswerTTL  uint32 = 30
+	dnsCacheIPv6Wait          = 100 * time.Millisecond
+	defaultDnsCacheCap        = 4096
+)
+
+// DnsCacheParams configures the core dns cache, ttl values are in seconds and zero max values disable the limit
+type DnsCacheParams struct {
+	Enable      bool   `json:"enable"`
+	Size        int    `json:"size"`
+	MinTTL      uint32 `json:"min-ttl"`
+	MaxTTL      uint32 `json:"max-ttl"`
+	NegativeTTL uint32 `json:"negative-ttl"`
+	ServeStale  bool   `json:"serve-stale"`
+	StaleTTL    uint32 `json:"stale-ttl"`
+}
+
+type DnsCacheStats struct {
+	Enable       bool    `json:"enable"`
+	Size         int     `json:"size"`
+	Capacity     int     `json:"capacity"`
+	Negative     int     `json:"negative"`
+	Hits         uint64  `json:"hits"`
+	NegativeHits uint64  `json:"negative-hits"`
+	StaleHits    uint64  `json:"stale-hits"`
+	Misses       uint64  `json:"misses"`
+	HitRatio     float64 `json:"hit-ratio"`
+}
+
+type dnsCacheEntry struct {
+	key      string
+	resolver string
+	name     string
+	msg      *dns.Msg
+	expire   time.Time
+	negative bool
+}
+
+// DnsCache keeps positive and negative answers per resolver in front of the upstream resolvers
+type DnsCache struct {
+	mutex        sync.Mutex
+	params       DnsCacheParams
+	entries      map[string]*list.Element
+	order        *list.List
+	hits         uint64
+	negativeHits uint64
+	staleHits    uint64
+	misses       uint64
+}
+
+var dnsCache = &DnsCache{
+	params: DnsCacheParams{
+		Size:        defaultDnsCacheCap,
+		MaxTTL:      86400,
+		NegativeTTL: 30,
+		ServeStale:  true,
+		StaleTTL:    86400,
+	},
+	entries: map[string]*list.Element{},
+	order:   list.New(),
+}
+
+func (c *DnsCache) SetParams(params DnsCacheParams) {
+	if params.Size <= 0 {
+		params.Size = defaultDnsCacheCap
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.params = params
+	if !params.Enable {
+		c.clearLocked()
+		return
+	}
+	for c.order.Len() > params.Size {
+		c.removeLocked(c.order.Back())
+	}
+}
+
+func (c *DnsCache) Enabled() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.params.Enable
+}
+
+func dnsCacheKey(resolverName string, question dns.Question) string {
+	return resolverName + "|" + strings.ToLower(question.Name) + "|" + dns.TypeToString[question.Qtype] + "|" + dns.ClassToString[question.Qclass]
+}
+
+func (c *DnsCache) removeLocked(element *list.Element) {
+	entry := c.order.Remove(element).(*dnsCacheEntry)
+	delete(c.entries, entry.key)
+}
+
+func (c *DnsCache) clearLocked() {
+	c.entries = map[string]*list.Element{}
+	c.order.Init()
+}
+
+// lookup returns the entry for key, fresh is false when only a stale answer is left
+func (c *DnsCache) lookup(key string, now time.Time) (entry *dnsCacheEntry, fresh bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	entry = element.Value.(*dnsCacheEntry)
+	if now.Before(entry.expire) {
+		c.order.MoveToFront(element)
+		c.hits++
+		if entry.negative {
+			c.negativeHits++
+		}
+		return entry, true
+	}
+	if !c.params.ServeStale || (c.params.StaleTTL != 0 && now.Sub(entry.expire) > time.Duration(c.params.StaleTTL)*time.Second) {
+		c.removeLocked(element)
+		entry = nil
+	}
+	c.misses++
+	return entry, false
+}
+
+func (c *DnsCache) store(key string, resolverName string, question dns.Question, msg *dns.Msg, now time.Time) {
+	if question.Qtype == dns.TypeTXT && strings.HasPrefix(question.Name, "_acme-challenge.") {
+		return
+	}
+	if msg.Truncated {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ttl, negative := c.ttlLocked(msg)
+	if ttl == 0 {
+		return
+	}
+	stored := msg.Copy()
+	extra := stored.Extra[:0]
+	for _, rr := range stored.Extra {
+		// OPT RRs must not be cached
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	stored.Extra = extra
+	entry := &dnsCacheEntry{
+		key:      key,
+		resolver: resolverName,
+		name:     strings.ToLower(question.Name),
+		msg:      stored,
+		expire:   now.Add(time.Duration(ttl) * time.Second),
+		negative: negative,
+	}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.params.Size {
+		c.removeLocked(c.order.Back())
+	}
+}
+
+// ttlLocked clamps the answer ttl to the policy, negative answers follow the SOA minimum as in RFC 2308
+func (c *DnsCache) ttlLocked(msg *dns.Msg) (uint32, bool) {
+	switch {
+	case msg.Rcode == dns.RcodeNameError, msg.Rcode == dns.RcodeSuccess && len(msg.Answer) == 0:
+		if c.params.NegativeTTL == 0 {
+			return 0, true
+		}
+		ttl := c.params.NegativeTTL
+		for _, rr := range msg.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				if soa.Hdr.Ttl < ttl {
+					ttl = soa.Hdr.Ttl
+				}
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+			}
+		}
+		if ttl < c.params.MinTTL {
+			ttl = c.params.MinTTL
+		}
+		return ttl, true
+	case msg.Rcode != dns.RcodeSuccess:
+		return 0, false
+	}
+	var ttl uint32
+	for i, rr := range msg.Answer {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	if ttl < c.params.MinTTL {
+		ttl = c.params.MinTTL
+	}
+	if c.params.MaxTTL != 0 && ttl > c.params.MaxTTL {
+		ttl = c.params.MaxTTL
+	}
+	return ttl, false
+}
+
+func dnsCacheReply(request *dns.Msg, entry *dnsCacheEntry, ttl uint32) *dns.Msg {
+	msg := entry.msg.Copy()
+	msg.Id = request.Id
+	for _, records := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range records {
+			rr.Header().Ttl = ttl
+		}
+	}
+	return msg
+}
+
+// Exchange answers msg from the cache, stale answers are only used when the upstream fails
+func (c *DnsCache) Exchange(ctx context.Context, resolverName string, msg *dns.Msg, exchange func(context.Context, *dns.Msg) (*dns.Msg, error)) (*dns.Msg, error) {
+	if !c.Enabled() || len(msg.Question) == 0 {
+		return exchange(ctx, msg)
+	}
+	question := msg.Question[0]
+	key := dnsCacheKey(resolverName, question)
+	now := time.Now()
+	entry, fresh := c.lookup(key, now)
+	if fresh {
+		ttl := uint32(entry.expire.Sub(now).Seconds())
+		if ttl == 0 {
+			ttl = 1
+		}
+		return dnsCacheReply(msg, entry, ttl), nil
+	}
+	resp, err := exchange(ctx, msg)
+	if err != nil || resp == nil || resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+		if entry != nil {
+			c.mutex.Lock()
+			c.staleHits++
+			c.misses--
+			c.mutex.Unlock()
+			return dnsCacheReply(msg, entry, dnsStaleAnswerTTL), nil
+		}
+		return resp, err
+	}
+	c.store(key, resolverName, question, resp, now)
+	return resp, nil
+}
+
+// Purge drops the entries of domain, all entries when domain is empty
+func (c *DnsCache) Purge(domain string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if domain == "" {
+		count := c.order.Len()
+		c.clearLocked()
+		return count
+	}
+	name := strings.ToLower(dns.Fqdn(domain))
+	return c.removeWhereLocked(func(entry *dnsCacheEntry) bool {
+		return entry.name == name
+	})
+}
+
+func (c *DnsCache) purgeResolver(resolverName string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.removeWhereLocked(func(entry *dnsCacheEntry) bool {
+		return entry.resolver == resolverName
+	})
+}
+
+func (c *DnsCache) removeWhereLocked(match func(entry *dnsCacheEntry) bool) int {
+	count := 0
+	for element := c.order.Front(); element != nil; {
+		next := element.Next()
+		if match(element.Value.(*dnsCacheEntry)) {
+			c.removeLocked(element)
+			count++
+		}
+		element = next
+	}
+	return count
+}
+
+// Trim drops every cached answer and the caches of the resolvers themselves
+func (c *DnsCache) Trim() int {
+	c.mutex.Lock()
+	size := c.order.Len()
+	c.clearLocked()
+	c.mutex.Unlock()
+	for _, r := range []resolver.Resolver{resolver.DefaultResolver, resolver.ProxyServerHostResolver, resolver.DirectHostResolver} {
+		if r != nil {
+			r.ClearCache()
+		}
+	}
+	return size
+}
+
+func (c *DnsCache) Stats() DnsCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := DnsCacheStats{
+		Enable:       c.params.Enable,
+		Size:         c.order.Len(),
+		Capacity:     c.params.Size,
+		Hits:         c.hits,
+		NegativeHits: c.negativeHits,
+		StaleHits:    c.staleHits,
+		Misses:       c.misses,
+	}
+	for element := c.order.Front(); element != nil; element = element.Next() {
+		if element.Value.(*dnsCacheEntry).negative {
+			stats.Negative++
+		}
+	}
+	if total := c.hits + c.staleHits + c.misses; total != 0 {
+		stats.HitRatio = float64(c.hits+c.staleHits) / float64(total)
+	}
+	return stats
+}
+
+// cachingResolver serves the lookups of one resolver through the core dns cache
+type cachingResolver struct {
+	resolver.Resolver
+	name string
+}
+
+func (r *cachingResolver) ExchangeContext(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	return dnsCache.Exchange(ctx, r.name, msg, r.Resolver.ExchangeContext)
+}
+
+func (r *cachingResolver) lookupIP(ctx context.Context, host string, qType uint16) ([]netip.Addr, error) {
+	query := &dns.Msg{}
+	query.SetQuestion(dns.Fqdn(host), qType)
+	msg, err := r.ExchangeContext(ctx, query)
+	if err != nil {
+		return []netip.Addr{}, err
+	}
+	ips := make([]netip.Addr, 0, len(msg.Answer))
+	for _, answer := range msg.Answer {
+		switch record := answer.(type) {
+		case *dns.A:
+			if ip, ok := netip.AddrFromSlice(record.A.To4()); ok {
+				ips = append(ips, ip)
+			}
+		case *dns.AAAA:
+			if ip, ok := netip.AddrFromSlice(record.AAAA); ok {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return []netip.Addr{}, resolver.ErrIPNotFound
+	}
+	return ips, nil
+}
+
+func (r *cachingResolver) LookupIP(ctx context.Context, host string) ([]netip.Addr, error) {
+	if _, err := netip.ParseAddr(host); err == nil || !dnsCache.Enabled() {
+		return r.Resolver.LookupIP(ctx, host)
+	}
+	ch := make(chan []netip.Addr, 1)
+	go func() {
+		defer close(ch)
+		ips, err := r.lookupIP(ctx, host, dns.TypeAAAA)
+		if err != nil {
+			return
+		}
+		ch <- ips
+	}()
+	ips, err := r.lookupIP(ctx, host, dns.TypeA)
+	waitIPv6 := time.NewTimer(dnsCacheIPv6Wait)
+	defer waitIPv6.Stop()
+	select {
+	case ipv6s, open := <-ch:
+		if !open && err != nil {
+			return nil, resolver.ErrIPNotFound
+		}
+		ips = append(ips, ipv6s...)
+	case <-waitIPv6.C:
+	}
+	if len(ips) == 0 {
+		return nil, resolver.ErrIPNotFound
+	}
+	return ips, nil
+}
+
+func (r *cachingResolver) LookupIPv4(ctx context.Context, host string) ([]netip.Addr, error) {
+	if _, err := netip.ParseAddr(host); err == nil || !dnsCache.Enabled() {
+		return r.Resolver.LookupIPv4(ctx, host)
+	}
+	return r.lookupIP(ctx, host, dns.TypeA)
+}
+
+func (r *cachingResolver) LookupIPv6(ctx context.Context, host string) ([]netip.Addr, error) {
+	if _, err := netip.ParseAddr(host); err == nil || !dnsCache.Enabled() {
+		return r.Resolver.LookupIPv6(ctx, host)
+	}
+	return r.lookupIP(ctx, host, dns.TypeAAAA)
+}
+
+func (r *cachingResolver) ClearCache() {
+	r.Resolver.ClearCache()
+	dnsCache.purgeResolver(r.name)
+}
+
+// installDnsCache puts the cache in front of the resolvers of a newly applied config, run before installDnsLog
+func installDnsCache() {
+	wrap := func(r resolver.Resolver, name string) resolver.Resolver {
+		switch r.(type) {
+		case nil, *cachingResolver, *loggingResolver:
+			return r
+		}
+		dnsCache.purgeResolver(name)
+		return &cachingResolver{Resolver: r, name: name}
+	}
+	resolver.DefaultResolver = wrap(resolver.DefaultResolver, "default")
+	resolver.ProxyServerHostResolver = wrap(resolver.ProxyServerHostResolver, "proxy-server")
+	resolver.DirectHostResolver = wrap(resolver.DirectHostResolver, "direct")
+}
+
+func handleSetDnsCache(paramsString string) error {
+	dnsCache.mutex.Lock()
+	params := dnsCache.params
+	dnsCache.mutex.Unlock()
+	if err := json.Unmarshal([]byte(paramsString), &params); err != nil {
+		return err
+	}
+	dnsCache.SetParams(params)
+	return nil
+}
+
+func handleGetDnsCacheStats() string {
+	data, err := json.Marshal(dnsCache.Stats())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// handlePurgeDnsCache drops the cached answers of a domain, the upstream resolver caches are cleared as well
+func handlePurgeDnsCache(domain string) int {
+	count := dnsCache.Purge(domain)
+	for _, r := range []resolver.Resolver{resolver.DefaultResolver, resolver.ProxyServerHostResolver, resolver.DirectHostResolver} {
+		if logging, ok := r.(*loggingResolver); ok {
+			r = logging.Resolver
+		}
+		if caching, ok := r.(*cachingResolver); ok {
+			r = caching.Resolver
+		}
+		if r != nil {
+			r.ClearCache()
+		}
+	}
+	return count
+}
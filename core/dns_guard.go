@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/metacubex/mihomo/component/resolver"
+	"github.com/metacubex/mihomo/config"
+	"github.com/metacubex/mihomo/constant"
+	mihomoDns "github.com/metacubex/mihomo/dns"
+	"github.com/metacubex/mihomo/log"
+	"net"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	dnsGuardPlainPort = 53
+	dnsGuardDotPort   = 853
+	dnsGuardDohPort   = 443
+)
+
+// knownDohResolvers are the public resolvers apps and browsers ship with, the addresses catch the
+// queries that skip the name of the resolver
+var knownDohResolvers = map[string][]string{
+	"dns.google":                 {"8.8.8.8", "8.8.4.4", "2001:4860:4860::8888", "2001:4860:4860::8844"},
+	"cloudflare-dns.com":         {"1.1.1.1", "1.0.0.1", "2606:4700:4700::1111", "2606:4700:4700::1001"},
+	"one.one.one.one":            {"1.1.1.1", "1.0.0.1"},
+	"mozilla.cloudflare-dns.com": {"162.159.61.4", "172.64.41.4"},
+	"dns.quad9.net":              {"9.9.9.9", "149.112.112.112", "2620:fe::fe", "2620:fe::9"},
+	"doh.opendns.com":            {"208.67.222.222", "208.67.220.220"},
+	"dns.adguard-dns.com":        {"94.140.14.14", "94.140.15.15"},
+	"dns.alidns.com":             {"223.5.5.5", "223.6.6.6"},
+	"doh.pub":                    {"1.12.12.12", "120.53.53.53"},
+	"dns.nextdns.io":             nil,
+	"doh.cleanbrowsing.org":      nil,
+}
+
+type DnsGuardParams struct {
+	Enable bool `json:"enable"`
+	// DohHosts extend the built in list of resolvers whose https is refused
+	DohHosts []string `json:"doh-hosts"`
+}
+
+type DnsGuardStatus struct {
+	DnsGuardParams
+	Hijacked   int64    `json:"hijacked"`
+	BlockedDot int64    `json:"blocked-dot"`
+	BlockedDoh int64    `json:"blocked-doh"`
+	Exempt     []string `json:"exempt"`
+}
+
+// DnsGuard answers the plain dns of the tun that is not sent to the dns address of the tun and
+// refuses dns over tls and the known https resolvers, the apps fall back to plain dns and land in
+// the resolver of the core as well
+type DnsGuard struct {
+	enabled    atomic.Bool
+	mutex      sync.RWMutex
+	params     DnsGuardParams
+	hosts      map[string]struct{}
+	addrs      map[netip.Addr]struct{}
+	exempt     map[string]struct{}
+	exemptIPs  map[netip.Addr]struct{}
+	hijacked   atomic.Int64
+	blockedDot atomic.Int64
+	blockedDoh atomic.Int64
+}
+
+var dnsGuard = &DnsGuard{}
+
+func dohHostKey(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
+
+func (g *DnsGuard) Set(params *DnsGuardParams) {
+	hosts := map[string]struct{}{}
+	addrs := map[netip.Addr]struct{}{}
+	for host, ips := range knownDohResolvers {
+		hosts[host] = struct{}{}
+		for _, ip := range ips {
+			addrs[netip.MustParseAddr(ip)] = struct{}{}
+		}
+	}
+	for _, host := range params.DohHosts {
+		if addr, err := netip.ParseAddr(host); err == nil {
+			addrs[addr.Unmap()] = struct{}{}
+			continue
+		}
+		if host = dohHostKey(host); host != "" {
+			hosts[host] = struct{}{}
+		}
+	}
+	g.mutex.Lock()
+	g.params = *params
+	g.hosts = hosts
+	g.addrs = addrs
+	g.mutex.Unlock()
+	g.enabled.Store(params.Enable)
+}
+
+// Reset exempts the nameservers of the applied config, the core may reach them through the tun
+// where the sockets are not bound to the physical interface
+func (g *DnsGuard) Reset(dnsConfig *config.DNS) {
+	exempt := map[string]struct{}{}
+	exemptIPs := map[netip.Addr]struct{}{}
+	if dnsConfig != nil && dnsConfig.Enable {
+		for _, nameservers := range [][]mihomoDns.NameServer{
+			dnsConfig.NameServer,
+			dnsConfig.Fallback,
+			dnsConfig.DefaultNameserver,
+			dnsConfig.ProxyServerNameserver,
+			dnsConfig.DirectNameServer,
+		} {
+			for _, ns := range nameservers {
+				host := nameserverHost(ns)
+				if host == "" {
+					continue
+				}
+				if addr, err := netip.ParseAddr(host); err == nil {
+					exemptIPs[addr.Unmap()] = struct{}{}
+					continue
+				}
+				exempt[host] = struct{}{}
+				for _, ip := range knownDohResolvers[host] {
+					exemptIPs[netip.MustParseAddr(ip)] = struct{}{}
+				}
+			}
+		}
+	}
+	g.mutex.Lock()
+	g.exempt = exempt
+	g.exemptIPs = exemptIPs
+	g.mutex.Unlock()
+}
+
+func nameserverHost(ns mihomoDns.NameServer) string {
+	if ns.Net == "https" {
+		parsed, err := url.Parse(ns.Addr)
+		if err != nil {
+			return ""
+		}
+		return dohHostKey(parsed.Hostname())
+	}
+	host, _, err := net.SplitHostPort(ns.Addr)
+	if err != nil {
+		return dohHostKey(ns.Addr)
+	}
+	return dohHostKey(host)
+}
+
+// encrypted tells a query to a resolver the core cannot read, a fake ip gives the name back
+func (g *DnsGuard) encrypted(metadata *constant.Metadata) (bool, bool) {
+	addr := metadata.DstIP.Unmap()
+	host := dohHostKey(metadata.Host)
+	if host == "" && resolver.IsFakeIP(addr) {
+		host, _ = resolver.FindHostByIP(addr)
+		host = dohHostKey(host)
+	}
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	if _, ok := g.exemptIPs[addr]; ok {
+		return false, false
+	}
+	if _, ok := g.exempt[host]; ok && host != "" {
+		return false, false
+	}
+	switch metadata.DstPort {
+	case dnsGuardDotPort:
+		return true, false
+	case dnsGuardDohPort:
+		if _, ok := g.addrs[addr]; ok {
+			return false, true
+		}
+		_, ok := g.hosts[host]
+		return false, ok && host != ""
+	}
+	return false, false
+}
+
+// refuses counts and tells the encrypted queries the tun drops
+func (g *DnsGuard) refuses(metadata *constant.Metadata) bool {
+	dot, doh := g.encrypted(metadata)
+	switch {
+	case dot:
+		g.blockedDot.Add(1)
+	case doh:
+		g.blockedDoh.Add(1)
+	default:
+		return false
+	}
+	log.Debugln("[DNSGuard] refuse %s %s", metadata.NetWork, metadata.RemoteAddress())
+	return true
+}
+
+func (g *DnsGuard) plain(metadata *constant.Metadata) bool {
+	if metadata.DstPort != dnsGuardPlainPort || metadata.DstIP.IsLoopback() {
+		return false
+	}
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	_, exempt := g.exemptIPs[metadata.DstIP.Unmap()]
+	return !exempt
+}
+
+func (g *DnsGuard) Status() *DnsGuardStatus {
+	g.mutex.RLock()
+	status := &DnsGuardStatus{
+		DnsGuardParams: g.params,
+		Exempt:         make([]string, 0, len(g.exempt)+len(g.exemptIPs)),
+	}
+	for host := range g.exempt {
+		status.Exempt = append(status.Exempt, host)
+	}
+	for addr := range g.exemptIPs {
+		status.Exempt = append(status.Exempt, addr.String())
+	}
+	g.mutex.RUnlock()
+	sort.Strings(status.Exempt)
+	status.Hijacked = g.hijacked.Load()
+	status.BlockedDot = g.blockedDot.Load()
+	status.BlockedDoh = g.blockedDoh.Load()
+	return status
+}
+
+// dnsGuardTunnel sees what the tun did not hijack itself, the dns address of the tun never gets here
+type dnsGuardTunnel struct {
+	constant.Tunnel
+}
+
+func (t *dnsGuardTunnel) HandleTCPConn(conn net.Conn, metadata *constant.Metadata) {
+	if !dnsGuard.enabled.Load() {
+		t.Tunnel.HandleTCPConn(conn, metadata)
+		return
+	}
+	if dnsGuard.plain(metadata) {
+		dnsGuard.hijacked.Add(1)
+		log.Debugln("[DNSGuard] hijack tcp:%s", metadata.RemoteAddress())
+		_ = resolver.RelayDnsConn(context.Background(), conn, resolver.DefaultDnsReadTimeout)
+		return
+	}
+	if dnsGuard.refuses(metadata) {
+		_ = conn.Close()
+		return
+	}
+	t.Tunnel.HandleTCPConn(conn, metadata)
+}
+
+func (t *dnsGuardTunnel) HandleUDPPacket(packet constant.UDPPacket, metadata *constant.Metadata) {
+	if !dnsGuard.enabled.Load() {
+		t.Tunnel.HandleUDPPacket(packet, metadata)
+		return
+	}
+	if dnsGuard.plain(metadata) {
+		dnsGuard.hijacked.Add(1)
+		go relayGuardedDns(packet, metadata.UDPAddr())
+		return
+	}
+	if dnsGuard.refuses(metadata) {
+		packet.Drop()
+		return
+	}
+	t.Tunnel.HandleUDPPacket(packet, metadata)
+}
+
+// relayGuardedDns answers from the address the query went to, the app never sees the redirect
+func relayGuardedDns(packet constant.UDPPacket, from *net.UDPAddr) {
+	defer packet.Drop()
+	ctx, cancel := context.WithTimeout(context.Background(), resolver.DefaultDnsRelayTimeout)
+	defer cancel()
+	buf := bufferPool.Get(resolver.SafeDnsPacketSize)
+	defer bufferPool.Put(buf)
+	msg, err := resolver.RelayDnsPacket(ctx, packet.Data(), buf)
+	if err != nil {
+		return
+	}
+	_, _ = packet.WriteBack(msg, from)
+}
+
+func handleSetDnsGuard(paramsString string) error {
+	params := &DnsGuardParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	dnsGuard.Set(params)
+	return nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/metacubex/mihomo/component/resolver"
+	"github.com/miekg/dns"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultDnsLogCapacity = 1000
+
+// DnsLogEntry is one query seen by the core, Resolver names the path that answered it
+type DnsLogEntry struct {
+	Id       uint64   `json:"id"`
+	Time     int64    `json:"time"`
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Resolver string   `json:"resolver"`
+	Answer   []string `json:"answer"`
+	RCode    string   `json:"rcode"`
+	Latency  int64    `json:"latency"`
+	FakeIP   bool     `json:"fake-ip"`
+	Error    string   `json:"error,omitempty"`
+}
+
+type dnsLogBuffer struct {
+	mutex      sync.Mutex
+	entries    []DnsLogEntry
+	next       int
+	full       bool
+	id         uint64
+	subscribed atomic.Bool
+}
+
+var dnsLogs = &dnsLogBuffer{entries: make([]DnsLogEntry, defaultDnsLogCapacity)}
+
+func (b *dnsLogBuffer) add(entry DnsLogEntry) {
+	b.mutex.Lock()
+	b.id++
+	entry.Id = b.id
+	b.entries[b.next] = entry
+	b.next = (b.next + 1) % len(b.entries)
+	if b.next == 0 {
+		b.full = true
+	}
+	b.mutex.Unlock()
+	if b.subscribed.Load() {
+		sendMessage(Message{
+			Type: DnsMessage,
+			Data: entry,
+		})
+	}
+}
+
+// Entries returns the buffered queries oldest first, only those after the id since when positive
+func (b *dnsLogBuffer) Entries(since uint64) []DnsLogEntry {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	entries := make([]DnsLogEntry, 0, len(b.entries))
+	start := 0
+	if b.full {
+		start = b.next
+	}
+	count := b.next
+	if b.full {
+		count = len(b.entries)
+	}
+	for i := 0; i < count; i++ {
+		entry := b.entries[(start+i)%len(b.entries)]
+		if entry.Id > since {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Resize changes the capacity, the newest entries are kept
+func (b *dnsLogBuffer) Resize(capacity int) {
+	if capacity <= 0 {
+		capacity = defaultDnsLogCapacity
+	}
+	entries := b.Entries(0)
+	if len(entries) > capacity {
+		entries = entries[len(entries)-capacity:]
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.entries = make([]DnsLogEntry, capacity)
+	b.next = copy(b.entries, entries) % capacity
+	b.full = len(entries) == capacity
+}
+
+func (b *dnsLogBuffer) Clear() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.entries = make([]DnsLogEntry, len(b.entries))
+	b.next = 0
+	b.full = false
+}
+
+// loggingResolver records the lookups the tunnel and outbounds make through a resolver
+type loggingResolver struct {
+	resolver.Resolver
+	name string
+}
+
+func (r *loggingResolver) lookup(ctx context.Context, host string, qType string, lookup func(context.Context, string) ([]netip.Addr, error)) ([]netip.Addr, error) {
+	start := time.Now()
+	ips, err := lookup(ctx, host)
+	entry := DnsLogEntry{
+		Time:     start.UnixMilli(),
+		Name:     host,
+		Type:     qType,
+		Resolver: r.name,
+		Answer:   make([]string, 0, len(ips)),
+		RCode:    dns.RcodeToString[dns.RcodeSuccess],
+		Latency:  time.Since(start).Milliseconds(),
+	}
+	for _, ip := range ips {
+		entry.Answer = append(entry.Answer, ip.String())
+	}
+	if err != nil {
+		entry.RCode = ""
+		entry.Error = err.Error()
+	}
+	dnsLogs.add(entry)
+	return ips, err
+}
+
+func (r *loggingResolver) LookupIP(ctx context.Context, host string) ([]netip.Addr, error) {
+	return r.lookup(ctx, host, "A/AAAA", r.Resolver.LookupIP)
+}
+
+func (r *loggingResolver) LookupIPv4(ctx context.Context, host string) ([]netip.Addr, error) {
+	return r.lookup(ctx, host, "A", r.Resolver.LookupIPv4)
+}
+
+func (r *loggingResolver) LookupIPv6(ctx context.Context, host string) ([]netip.Addr, error) {
+	return r.lookup(ctx, host, "AAAA", r.Resolver.LookupIPv6)
+}
+
+func (r *loggingResolver) ExchangeContext(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	resp, err := r.Resolver.ExchangeContext(ctx, msg)
+	dnsLogs.add(dnsMsgEntry(r.name, start, msg, resp, err))
+	return resp, err
+}
+
+// loggingLocalServer records the queries hijacked from the tun device, fake-ip answers are served here
+type loggingLocalServer struct {
+	resolver.LocalServer
+}
+
+func (s *loggingLocalServer) ServeMsg(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	resp, err := s.LocalServer.ServeMsg(ctx, msg)
+	dnsLogs.add(dnsMsgEntry("dns-hijack", start, msg, resp, err))
+	return resp, err
+}
+
+func dnsMsgEntry(name string, start time.Time, msg *dns.Msg, resp *dns.Msg, err error) DnsLogEntry {
+	entry := DnsLogEntry{
+		Time:     start.UnixMilli(),
+		Resolver: name,
+		Answer:   []string{},
+		Latency:  time.Since(start).Milliseconds(),
+	}
+	if len(msg.Question) != 0 {
+		entry.Name = strings.TrimSuffix(msg.Question[0].Name, ".")
+		entry.Type = dns.TypeToString[msg.Question[0].Qtype]
+	}
+	if err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+	if resp == nil {
+		return entry
+	}
+	entry.RCode = dns.RcodeToString[resp.Rcode]
+	for _, answer := range resp.Answer {
+		var ip netip.Addr
+		switch record := answer.(type) {
+		case *dns.A:
+			ip, _ = netip.AddrFromSlice(record.A.To4())
+		case *dns.AAAA:
+			ip, _ = netip.AddrFromSlice(record.AAAA)
+		case *dns.CNAME:
+			entry.Answer = append(entry.Answer, strings.TrimSuffix(record.Target, "."))
+			continue
+		default:
+			continue
+		}
+		entry.Answer = append(entry.Answer, ip.String())
+		if resolver.IsFakeIP(ip) {
+			entry.FakeIP = true
+		}
+	}
+	return entry
+}
+
+// installDnsLog wraps the resolvers set up by the last applied config, wrappers are not stacked
+func installDnsLog() {
+	wrap := func(r resolver.Resolver, name string) resolver.Resolver {
+		if r == nil {
+			return nil
+		}
+		if _, ok := r.(*loggingResolver); ok {
+			return r
+		}
+		return &loggingResolver{Resolver: r, name: name}
+	}
+	resolver.DefaultResolver = wrap(resolver.DefaultResolver, "default")
+	resolver.ProxyServerHostResolver = wrap(resolver.ProxyServerHostResolver, "proxy-server")
+	resolver.DirectHostResolver = wrap(resolver.DirectHostResolver, "direct")
+	if server := resolver.DefaultLocalServer; server != nil {
+		if _, ok := server.(*loggingLocalServer); !ok {
+			resolver.DefaultLocalServer = &loggingLocalServer{LocalServer: server}
+		}
+	}
+}
+
+func handleStartDnsLog() {
+	dnsLogs.subscribed.Store(true)
+}
+
+func handleStopDnsLog() {
+	dnsLogs.subscribed.Store(false)
+}
+
+func handleGetDnsLog(sinceString string) string {
+	since, _ := strconv.ParseUint(sinceString, 10, 64)
+	data, err := json.Marshal(dnsLogs.Entries(since))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handleClearDnsLog() bool {
+	dnsLogs.Clear()
+	return true
+}
+
+func handleSetDnsLogCapacity(capacityString string) bool {
+	capacity, err := strconv.Atoi(capacityString)
+	if err != nil {
+		return false
+	}
+	dnsLogs.Resize(capacity)
+	return true
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/metacubex/mihomo/common/utils"
+	"github.com/metacubex/mihomo/component/dialer"
+	"github.com/metacubex/mihomo/config"
+	mihomoDns "github.com/metacubex/mihomo/dns"
+	"github.com/metacubex/mihomo/log"
+	"github.com/miekg/dns"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dnscryptScheme          = "sdns://"
+	h3Scheme                = "h3://"
+	dnscryptTimeout         = 5 * time.Second
+	defaultDnsProbeDomain   = "www.gstatic.com"
+	defaultDnsProbeInterval = time.Minute
+	defaultDnsProbeTimeout  = 5 * time.Second
+	minDnsProbeInterval     = 10 * time.Second
+	dnsProbeWindow          = 20
+	dnsLatencyWeight        = 0.3
+)
+
+// dnscryptForwarder serves plain dns on loopback and relays every query to a DNSCrypt resolver,
+// profiles reference it through the udp nameserver the stamp is rewritten to
+type dnscryptForwarder struct {
+	stamp  string
+	conn   net.PacketConn
+	client *dnscrypt.Client
+	mutex  sync.Mutex
+	info   *dnscrypt.ResolverInfo
+}
+
+var (
+	dnscryptForwarders     = map[string]*dnscryptForwarder{}
+	dnscryptForwardersLock sync.Mutex
+	// dnsServerOrigins maps rewritten nameservers back to what the profile holds
+	dnsServerOrigins = map[string]string{}
+)
+
+func newDnscryptForwarder(stamp string) (*dnscryptForwarder, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	forwarder := &dnscryptForwarder{
+		stamp: stamp,
+		conn:  conn,
+		client: &dnscrypt.Client{
+			Net:     "udp",
+			Timeout: dnscryptTimeout,
+			UDPSize: dns.DefaultMsgSize,
+		},
+	}
+	go forwarder.serve()
+	return forwarder, nil
+}
+
+func (f *dnscryptForwarder) Addr() string {
+	return f.conn.LocalAddr().String()
+}
+
+func (f *dnscryptForwarder) serve() {
+	buf := bufferPool.Get(dns.MaxMsgSize)
+	defer bufferPool.Put(buf)
+	for {
+		n, addr, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		packet := bufferPool.Get(n)
+		copy(packet, buf[:n])
+		go f.handle(packet, addr)
+	}
+}
+
+func (f *dnscryptForwarder) handle(packet []byte, addr net.Addr) {
+	msg := &dns.Msg{}
+	err := msg.Unpack(packet)
+	_ = bufferPool.Put(packet)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dnscryptTimeout)
+	defer cancel()
+	resp, err := f.Exchange(ctx, msg)
+	if err != nil {
+		log.Debugln("[DNSCrypt] %s exchange failed: %v", f.stamp, err)
+		resp = (&dns.Msg{}).SetRcode(msg, dns.RcodeServerFailure)
+	}
+	out := bufferPool.Get(dns.MaxMsgSize)
+	defer bufferPool.Put(out)
+	data, err := resp.PackBuffer(out)
+	if err != nil {
+		return
+	}
+	_, _ = f.conn.WriteTo(data, addr)
+}
+
+// resolverInfo fetches the resolver certificate once and again after it expires or a query fails
+func (f *dnscryptForwarder) resolverInfo() (*dnscrypt.ResolverInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.info != nil && f.info.ResolverCert != nil && int64(f.info.ResolverCert.NotAfter) > time.Now().Unix() {
+		return f.info, nil
+	}
+	info, err := f.client.Dial(f.stamp)
+	if err != nil {
+		return nil, err
+	}
+	f.info = info
+	return info, nil
+}
+
+func (f *dnscryptForwarder) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	info, err := f.resolverInfo()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialer.DialContext(ctx, "udp", info.ServerAddress)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	resp, err := f.client.ExchangeConn(conn, msg, info)
+	if err != nil {
+		f.mutex.Lock()
+		f.info = nil
+		f.mutex.Unlock()
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (f *dnscryptForwarder) Close() error {
+	return f.conn.Close()
+}
+
+// rewriteDnsServer maps the schemes mihomo can not parse to equivalent nameservers,
+// h3:// becomes https with h3 forced and sdns:// stamps are served by a local forwarder
+func rewriteDnsServer(server string, used map[string]bool) (string, error) {
+	switch {
+	case strings.HasPrefix(server, h3Scheme):
+		rewritten := "https://" + strings.TrimPrefix(server, h3Scheme)
+		if strings.Contains(rewritten, "#") {
+			rewritten += "&h3=true"
+		} else {
+			rewritten += "#h3=true"
+		}
+		dnsServerOrigins[dnsOriginKey(rewritten)] = server
+		return rewritten, nil
+	case strings.HasPrefix(server, dnscryptScheme):
+		// the fragment would select an outbound, the forwarder always dials directly
+		stamp, _, _ := strings.Cut(server, "#")
+		forwarder, ok := dnscryptForwarders[stamp]
+		if !ok {
+			var err error
+			if forwarder, err = newDnscryptForwarder(stamp); err != nil {
+				return "", fmt.Errorf("dnscrypt %s: %v", stamp, err)
+			}
+			dnscryptForwarders[stamp] = forwarder
+		}
+		used[stamp] = true
+		rewritten := "udp://" + forwarder.Addr()
+		dnsServerOrigins[dnsOriginKey(rewritten)] = server
+		return rewritten, nil
+	}
+	return server, nil
+}
+
+// dnsOriginKey normalizes a nameserver like the profile parser, which drops the fragment and adds the default port
+func dnsOriginKey(server string) string {
+	server, _, _ = strings.Cut(server, "#")
+	u, err := url.Parse(server)
+	if err != nil || u.Port() != "" {
+		return server
+	}
+	switch u.Scheme {
+	case "https":
+		u.Host = net.JoinHostPort(u.Hostname(), "443")
+	case "udp":
+		u.Host = net.JoinHostPort(u.Hostname(), "53")
+	}
+	return u.String()
+}
+
+func rewriteDnsServers(servers []string, used map[string]bool) ([]string, error) {
+	rewritten := make([]string, len(servers))
+	for i, server := range servers {
+		var err error
+		if rewritten[i], err = rewriteDnsServer(server, used); err != nil {
+			return nil, err
+		}
+	}
+	return rewritten, nil
+}
+
+// rewriteEncryptedDnsServers prepares every nameserver list of the profile before parsing,
+// forwarders of stamps the profile no longer uses are closed
+func rewriteEncryptedDnsServers(rawDns *config.RawDNS) error {
+	dnscryptForwardersLock.Lock()
+	defer dnscryptForwardersLock.Unlock()
+	used := map[string]bool{}
+	dnsServerOrigins = map[string]string{}
+	var err error
+	for _, servers := range []*[]string{
+		&rawDns.NameServer,
+		&rawDns.Fallback,
+		&rawDns.DefaultNameserver,
+		&rawDns.ProxyServerNameserver,
+		&rawDns.DirectNameServer,
+	} {
+		if *servers, err = rewriteDnsServers(*servers, used); err != nil {
+			return err
+		}
+	}
+	if rawDns.NameServerPolicy != nil {
+		for pair := rawDns.NameServerPolicy.Oldest(); pair != nil; pair = pair.Next() {
+			servers, err := utils.ToStringSlice(pair.Value)
+			if err != nil {
+				continue
+			}
+			rewritten, err := rewriteDnsServers(servers, used)
+			if err != nil {
+				return err
+			}
+			pair.Value = rewritten
+		}
+	}
+	for stamp, forwarder := range dnscryptForwarders {
+		if !used[stamp] {
+			_ = forwarder.Close()
+			delete(dnscryptForwarders, stamp)
+		}
+	}
+	return nil
+}
+
+func closeDnscryptForwarders() {
+	dnscryptForwardersLock.Lock()
+	defer dnscryptForwardersLock.Unlock()
+	for stamp, forwarder := range dnscryptForwarders {
+		_ = forwarder.Close()
+		delete(dnscryptForwarders, stamp)
+	}
+}
+
+type DnsHealthParams struct {
+	Domain   string `json:"domain"`
+	Interval int64  `json:"interval"`
+	Timeout  int64  `json:"timeout"`
+}
+
+// DnsUpstreamStatus is the health of one nameserver, Rank orders the upstreams of a role by score
+type DnsUpstreamStatus struct {
+	Server              string  `json:"server"`
+	Net                 string  `json:"net"`
+	Role                string  `json:"role"`
+	Rank                int     `json:"rank"`
+	Score               float64 `json:"score"`
+	Latency             int64   `json:"latency"`
+	Successes           int     `json:"successes"`
+	Failures            int     `json:"failures"`
+	ConsecutiveFailures int     `json:"consecutive-failures"`
+	LastError           string  `json:"last-error,omitempty"`
+	LastCheck           int64   `json:"last-check"`
+}
+
+type dnsUpstream struct {
+	status   DnsUpstreamStatus
+	resolver mihomoDns.Resolvers
+	results  []bool
+}
+
+type dnsHealthMonitor struct {
+	mutex     sync.Mutex
+	cancel    context.CancelFunc
+	upstreams []*dnsUpstream
+}
+
+var dnsHealth = &dnsHealthMonitor{}
+
+// dnsServerName formats a parsed nameserver the way the profile wrote it
+func dnsServerName(ns mihomoDns.NameServer) (string, string) {
+	netType := ns.Net
+	var server string
+	switch ns.Net {
+	case "":
+		netType = "udp"
+		server = "udp://" + ns.Addr
+	case "tcp":
+		server = "tcp://" + ns.Addr
+	case "tcp-tls":
+		netType = "tls"
+		server = "tls://" + ns.Addr
+	case "https":
+		server = ns.Addr
+		if ns.PreferH3 || ns.Params["h3"] == "true" {
+			netType = "h3"
+		}
+	case "quic":
+		server = "quic://" + ns.Addr
+	default:
+		server = ns.Net + "://" + ns.Addr
+	}
+	dnscryptForwardersLock.Lock()
+	origin, ok := dnsServerOrigins[server]
+	dnscryptForwardersLock.Unlock()
+	if ok {
+		if strings.HasPrefix(origin, dnscryptScheme) {
+			netType = "dnscrypt"
+		}
+		return origin, netType
+	}
+	return server, netType
+}
+
+// Reset rebuilds the upstream list from the applied dns config, history of unchanged servers is kept
+func (m *dnsHealthMonitor) Reset(dnsConfig *config.DNS) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	previous := map[string]*dnsUpstream{}
+	for _, upstream := range m.upstreams {
+		previous[upstream.status.Role+" "+upstream.status.Server] = upstream
+	}
+	m.upstreams = nil
+	if dnsConfig == nil || !dnsConfig.Enable {
+		return
+	}
+	roles := []struct {
+		role        string
+		nameservers []mihomoDns.NameServer
+	}{
+		{"nameserver", dnsConfig.NameServer},
+		{"fallback", dnsConfig.Fallback},
+		{"default-nameserver", dnsConfig.DefaultNameserver},
+		{"proxy-server-nameserver", dnsConfig.ProxyServerNameserver},
+		{"direct-nameserver", dnsConfig.DirectNameServer},
+	}
+	for _, role := range roles {
+		for _, ns := range role.nameservers {
+			server, netType := dnsServerName(ns)
+			upstream, ok := previous[role.role+" "+server]
+			if !ok {
+				upstream = &dnsUpstream{status: DnsUpstreamStatus{Server: server, Net: netType, Role: role.role}}
+			}
+			upstream.resolver = mihomoDns.NewResolver(mihomoDns.Config{
+				Main:    []mihomoDns.NameServer{ns},
+				Default: dnsConfig.DefaultNameserver,
+				IPv6:    dnsConfig.IPv6,
+			})
+			m.upstreams = append(m.upstreams, upstream)
+		}
+	}
+}
+
+// Start probes every upstream periodically, a running monitor is replaced
+func (m *dnsHealthMonitor) Start(params DnsHealthParams) {
+	if params.Domain == "" {
+		params.Domain = defaultDnsProbeDomain
+	}
+	interval := time.Duration(params.Interval) * time.Millisecond
+	if interval <= 0 {
+		interval = defaultDnsProbeInterval
+	}
+	if interval < minDnsProbeInterval {
+		interval = minDnsProbeInterval
+	}
+	timeout := time.Duration(params.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultDnsProbeTimeout
+	}
+	m.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	m.mutex.Lock()
+	m.cancel = cancel
+	m.mutex.Unlock()
+	go func() {
+		for {
+			runGuarded("dns-health", func() {
+				m.Probe(ctx, params.Domain, timeout)
+			})
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(powerScaled(interval)):
+			}
+		}
+	}()
+}
+
+// Stop cancels the running monitor
+func (m *dnsHealthMonitor) Stop() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.cancel != nil {
+		m.cancel()
+		m.cancel = nil
+	}
+}
+
+// Probe queries every upstream once in parallel bypassing its cache
+func (m *dnsHealthMonitor) Probe(ctx context.Context, domain string, timeout time.Duration) {
+	m.mutex.Lock()
+	upstreams := append([]*dnsUpstream{}, m.upstreams...)
+	m.mutex.Unlock()
+	wg := sync.WaitGroup{}
+	for _, upstream := range upstreams {
+		wg.Add(1)
+		go func(upstream *dnsUpstream) {
+			defer wg.Done()
+			probeCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			msg := &dns.Msg{}
+			msg.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+			upstream.resolver.ClearCache()
+			start := time.Now()
+			resp, err := upstream.resolver.ExchangeContext(probeCtx, msg)
+			if err == nil && resp.Rcode != dns.RcodeSuccess {
+				err = errors.New(dns.RcodeToString[resp.Rcode])
+			}
+			m.record(upstream, time.Since(start), err)
+		}(upstream)
+	}
+	wg.Wait()
+}
+
+func (m *dnsHealthMonitor) record(upstream *dnsUpstream, latency time.Duration, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	status := &upstream.status
+	status.LastCheck = time.Now().UnixMilli()
+	upstream.results = append(upstream.results, err == nil)
+	if len(upstream.results) > dnsProbeWindow {
+		upstream.results = upstream.results[1:]
+	}
+	if err != nil {
+		status.Failures++
+		status.ConsecutiveFailures++
+		status.LastError = err.Error()
+	} else {
+		status.Successes++
+		status.ConsecutiveFailures = 0
+		status.LastError = ""
+		if status.Latency == 0 {
+			status.Latency = latency.Milliseconds()
+		} else {
+			status.Latency = int64(dnsLatencyWeight*float64(latency.Milliseconds()) + (1-dnsLatencyWeight)*float64(status.Latency))
+		}
+	}
+	successes := 0
+	for _, ok := range upstream.results {
+		if ok {
+			successes++
+		}
+	}
+	// success rate dominates, latency only separates upstreams that answer
+	score := 100 * float64(successes) / float64(len(upstream.results))
+	if successes != 0 {
+		score -= float64(status.Latency) / 20
+	}
+	if score < 0 {
+		score = 0
+	}
+	status.Score = score
+}
+
+// Status returns all upstreams with the fallback order of each role
+func (m *dnsHealthMonitor) Status() []DnsUpstreamStatus {
+	m.mutex.Lock()
+	statuses := make([]DnsUpstreamStatus, 0, len(m.upstreams))
+	for _, upstream := range m.upstreams {
+		statuses = append(statuses, upstream.status)
+	}
+	m.mutex.Unlock()
+	roles := map[string]int{}
+	for _, status := range statuses {
+		if _, ok := roles[status.Role]; !ok {
+			roles[status.Role] = len(roles)
+		}
+	}
+	sort.SliceStable(statuses, func(i, j int) bool {
+		if statuses[i].Role != statuses[j].Role {
+			return roles[statuses[i].Role] < roles[statuses[j].Role]
+		}
+		return statuses[i].Score > statuses[j].Score
+	})
+	ranks := map[string]int{}
+	for i := range statuses {
+		ranks[statuses[i].Role]++
+		statuses[i].Rank = ranks[statuses[i].Role]
+	}
+	return statuses
+}
+
+func handleStartDnsHealthCheck(paramsString string) string {
+	var params = DnsHealthParams{}
+	if err := json.Unmarshal([]byte(paramsString), &params); err != nil {
+		return err.Error()
+	}
+	dnsHealth.Start(params)
+	return ""
+}
+
+func handleStopDnsHealthCheck() bool {
+	dnsHealth.Stop()
+	return true
+}
+
+// DnsStatus is the health of the upstreams with what the guard took from the apps
+type DnsStatus struct {
+	Upstreams []DnsUpstreamStatus `json:"upstreams"`
+	Guard     *DnsGuardStatus     `json:"guard"`
+}
+
+func handleGetDnsStatus() string {
+	data, err := json.Marshal(&DnsStatus{
+		Upstreams: dnsHealth.Status(),
+		Guard:     dnsGuard.Status(),
+	})
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/metacubex/mihomo/component/trie"
+	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/hub/route"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDomainRun        = 8
+	defaultMatchIterations  = 10000
+	maxMatchIterations      = 1000000
+	maxMatchBenchmarkDomain = 64
+)
+
+// mphSlot is what the perfect hash finds for a key, the fingerprint sorts out keys that were
+// never inserted since the hash maps every string to some slot
+type mphSlot struct {
+	fingerprint uint64
+	exact       int32
+	suffix      int32
+}
+
+// domainIndex is a minimal perfect hash from the domains of a run to the first rule, exact or
+// suffix, that names them
+type domainIndex struct {
+	seeds []int32
+	slots []mphSlot
+}
+
+func domainHash(seed uint32, key string) uint64 {
+	hash := uint64(14695981039346656037) ^ uint64(seed)*0x9e3779b97f4a7c15
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= 1099511628211
+	}
+	// fnv alone spreads short keys badly over small tables
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	return hash
+}
+
+// newDomainIndex places the keys with hash and displace, the buckets with most keys are placed
+// first and a bucket of one takes any free slot directly
+func newDomainIndex(entries map[string]mphSlot) *domainIndex {
+	size := len(entries)
+	index := &domainIndex{seeds: make([]int32, size), slots: make([]mphSlot, size)}
+	if size == 0 {
+		return index
+	}
+	buckets := make([][]string, size)
+	for key := range entries {
+		bucket := domainHash(0, key) % uint64(size)
+		buckets[bucket] = append(buckets[bucket], key)
+	}
+	order := make([]int, 0, size)
+	for i := range buckets {
+		if len(buckets[i]) != 0 {
+			order = append(order, i)
+		}
+	}
+	sortByBucketSize(order, buckets)
+	used := make([]bool, size)
+	free := 0
+	for _, bucket := range order {
+		keys := buckets[bucket]
+		if len(keys) == 1 {
+			for used[free] {
+				free++
+			}
+			used[free] = true
+			index.seeds[bucket] = -int32(free) - 1
+			index.place(free, keys[0], entries[keys[0]])
+			continue
+		}
+		for seed := uint32(1); ; seed++ {
+			placed := make([]int, 0, len(keys))
+			ok := true
+			for _, key := range keys {
+				slot := int(domainHash(seed, key) % uint64(size))
+				if used[slot] || containsInt(placed, slot) {
+					ok = false
+					break
+				}
+				placed = append(placed, slot)
+			}
+			if !ok {
+				continue
+			}
+			for i, key := range keys {
+				used[placed[i]] = true
+				index.place(placed[i], key, entries[key])
+			}
+			index.seeds[bucket] = int32(seed)
+			break
+		}
+	}
+	return index
+}
+
+func (d *domainIndex) place(slot int, key string, entry mphSlot) {
+	entry.fingerprint = domainHash(0xffffffff, key)
+	d.slots[slot] = entry
+}
+
+func (d *domainIndex) lookup(key string) (mphSlot, bool) {
+	size := uint64(len(d.slots))
+	if size == 0 {
+		return mphSlot{}, false
+	}
+	seed := d.seeds[domainHash(0, key)%size]
+	var slot uint64
+	if seed < 0 {
+		slot = uint64(-seed - 1)
+	} else {
+		slot = domainHash(uint32(seed), key) % size
+	}
+	entry := d.slots[slot]
+	if entry.fingerprint != domainHash(0xffffffff, key) {
+		return mphSlot{}, false
+	}
+	return entry, true
+}
+
+func sortByBucketSize(order []int, buckets [][]string) {
+	// counting sort, the buckets rarely hold more than a handful of keys
+	maxSize := 0
+	for _, bucket := range order {
+		if len(buckets[bucket]) > maxSize {
+			maxSize = len(buckets[bucket])
+		}
+	}
+	sorted := order[:0:0]
+	for size := maxSize; size > 0; size-- {
+		for _, bucket := range order {
+			if len(buckets[bucket]) == size {
+				sorted = append(sorted, bucket)
+			}
+		}
+	}
+	copy(order, sorted)
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// domainRunRule stands for a run of DOMAIN and DOMAIN-SUFFIX rules, the succinct trie rejects the
+// hosts no rule of the run names and the perfect hash finds the first rule that does
+type domainRunRule struct {
+	set      *trie.DomainSet
+	filtered bool
+	index    *domainIndex
+	adapters []string
+	rules    []C.Rule
+}
+
+func newDomainRunRule(rules []C.Rule) *domainRunRule {
+	domainTrie := trie.New[struct{}]()
+	entries := map[string]mphSlot{}
+	run := &domainRunRule{rules: rules, adapters: make([]string, len(rules)), filtered: true}
+	for i, rule := range rules {
+		payload := rule.Payload()
+		run.adapters[i] = rule.Adapter()
+		entry, ok := entries[payload]
+		if !ok {
+			entry = mphSlot{exact: -1, suffix: -1}
+		}
+		key := payload
+		if rule.RuleType() == C.DomainSuffix {
+			key = "+." + payload
+			if entry.suffix < 0 {
+				entry.suffix = int32(i)
+			}
+		} else if entry.exact < 0 {
+			entry.exact = int32(i)
+		}
+		if err := domainTrie.Insert(key, struct{}{}); err != nil {
+			// a payload the trie cannot hold would be rejected by it, so every host goes to the hash
+			run.filtered = false
+		}
+		entries[payload] = entry
+	}
+	run.set = domainTrie.NewDomainSet()
+	run.index = newDomainIndex(entries)
+	return run
+}
+
+// first returns the position of the first rule of the run matching host, -1 if none does
+func (r *domainRunRule) first(host string) int {
+	if _, valid := trie.ValidAndSplitDomain(host); r.filtered && valid && !r.set.Has(host) {
+		return -1
+	}
+	best := int32(-1)
+	if entry, ok := r.index.lookup(host); ok {
+		best = entry.exact
+		if entry.suffix >= 0 && (best < 0 || entry.suffix < best) {
+			best = entry.suffix
+		}
+	}
+	for i := 0; i < len(host); i++ {
+		if host[i] != '.' {
+			continue
+		}
+		if entry, ok := r.index.lookup(host[i+1:]); ok && entry.suffix >= 0 && (best < 0 || entry.suffix < best) {
+			best = entry.suffix
+		}
+	}
+	return int(best)
+}
+
+func (r *domainRunRule) RuleType() C.RuleType {
+	return C.DomainSuffix
+}
+
+func (r *domainRunRule) Match(metadata *C.Metadata, _ C.RuleMatchHelper) (bool, string) {
+	if i := r.first(metadata.RuleHost()); i >= 0 {
+		return true, r.adapters[i]
+	}
+	return false, ""
+}
+
+func (r *domainRunRule) Adapter() string {
+	return r.adapters[0]
+}
+
+func (r *domainRunRule) Payload() string {
+	return strconv.Itoa(len(r.rules)) + " domains"
+}
+
+func (r *domainRunRule) ProviderNames() []string {
+	return nil
+}
+
+type DomainMatcherParams struct {
+	Disable bool `json:"disable"`
+	MinRun  int  `json:"min-run"`
+}
+
+type DomainMatcherStats struct {
+	DomainMatcherParams
+	Rules    int `json:"rules"`
+	Compiled int `json:"compiled"`
+	Runs     int `json:"runs"`
+	Domains  int `json:"domains"`
+}
+
+type RuleMatchParams struct {
+	Domains    []string `json:"domains"`
+	Iterations int      `json:"iterations"`
+}
+
+type RuleMatchResult struct {
+	Domain     string  `json:"domain"`
+	Adapter    string  `json:"adapter"`
+	Rule       string  `json:"rule"`
+	Consistent bool    `json:"consistent"`
+	LinearNs   float64 `json:"linear-ns"`
+	CompiledNs float64 `json:"compiled-ns"`
+}
+
+type RuleMatchBenchmark struct {
+	DomainMatcherStats
+	Iterations int                `json:"iterations"`
+	Results    []*RuleMatchResult `json:"results"`
+}
+
+// DomainMatcher folds the runs of domain rules of every rule list into domainRunRule, it keeps
+// the rules as parsed so the benchmark can compare both
+type DomainMatcher struct {
+	mutex    sync.Mutex
+	params   DomainMatcherParams
+	linear   []C.Rule
+	compiled []C.Rule
+	runs     int
+	domains  int
+}
+
+var domainMatcher = &DomainMatcher{}
+
+func (m *DomainMatcher) Set(params *DomainMatcherParams) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.params = DomainMatcherParams{}
+	if params != nil {
+		m.params = *params
+	}
+}
+
+func (m *DomainMatcher) minRun() int {
+	if m.params.MinRun > 0 {
+		return m.params.MinRun
+	}
+	return defaultDomainRun
+}
+
+func (m *DomainMatcher) fold(rules []C.Rule) ([]C.Rule, int, int) {
+	if m.params.Disable {
+		return rules, 0, 0
+	}
+	result := make([]C.Rule, 0, len(rules))
+	runs, domains := 0, 0
+	start := 0
+	flush := func(end int) {
+		if end-start >= m.minRun() {
+			result = append(result, newDomainRunRule(rules[start:end]))
+			runs++
+			domains += end - start
+		} else {
+			result = append(result, rules[start:end]...)
+		}
+	}
+	for i, rule := range rules {
+		switch rule.RuleType() {
+		case C.Domain, C.DomainSuffix:
+			if _, ok := rule.(*domainRunRule); !ok {
+				continue
+			}
+		}
+		flush(i)
+		result = append(result, rule)
+		start = i + 1
+	}
+	flush(len(rules))
+	return result, runs, domains
+}
+
+// CompileLocked folds the rules and the sub rules in place, the sub rules map is the one the
+// SUB-RULE rules hold so it is only touched before the tunnel gets it
+func (m *DomainMatcher) CompileLocked(rules []C.Rule, subRules map[string][]C.Rule) []C.Rule {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	compiled, runs, domains := m.fold(rules)
+	for name, list := range subRules {
+		folded, subRuns, subDomains := m.fold(list)
+		subRules[name] = folded
+		runs += subRuns
+		domains += subDomains
+	}
+	m.linear = rules
+	m.compiled = compiled
+	m.runs = runs
+	m.domains = domains
+	return compiled
+}
+
+func (m *DomainMatcher) statsLocked() DomainMatcherStats {
+	return DomainMatcherStats{
+		DomainMatcherParams: m.params,
+		Rules:               len(m.linear),
+		Compiled:            len(m.compiled),
+		Runs:                m.runs,
+		Domains:             m.domains,
+	}
+}
+
+func matchRules(rules []C.Rule, metadata *C.Metadata) (C.Rule, string) {
+	for _, rule := range rules {
+		if matched, adapter := rule.Match(metadata, C.RuleMatchHelper{}); matched {
+			return rule, adapter
+		}
+	}
+	return nil, ""
+}
+
+func timeMatches(rules []C.Rule, metadata *C.Metadata, iterations int) float64 {
+	start := time.Now()
+	for i := 0; i < iterations; i++ {
+		matchRules(rules, metadata)
+	}
+	return float64(time.Since(start).Nanoseconds()) / float64(iterations)
+}
+
+// Benchmark matches each domain against the rules as parsed and as folded, the process and ip
+// rules are evaluated without resolving or looking up anything
+func (m *DomainMatcher) Benchmark(params *RuleMatchParams) (*RuleMatchBenchmark, error) {
+	if len(params.Domains) == 0 {
+		return nil, errors.New("domains is empty")
+	}
+	if len(params.Domains) > maxMatchBenchmarkDomain {
+		params.Domains = params.Domains[:maxMatchBenchmarkDomain]
+	}
+	iterations := params.Iterations
+	if iterations <= 0 {
+		iterations = defaultMatchIterations
+	}
+	if iterations > maxMatchIterations {
+		iterations = maxMatchIterations
+	}
+	m.mutex.Lock()
+	linear, compiled := m.linear, m.compiled
+	benchmark := &RuleMatchBenchmark{DomainMatcherStats: m.statsLocked(), Iterations: iterations}
+	m.mutex.Unlock()
+	for _, domain := range params.Domains {
+		metadata := &C.Metadata{NetWork: C.TCP, Host: strings.ToLower(strings.TrimSpace(domain)), DstPort: 443}
+		result := &RuleMatchResult{Domain: metadata.Host}
+		linearRule, linearAdapter := matchRules(linear, metadata)
+		compiledRule, compiledAdapter := matchRules(compiled, metadata)
+		result.Adapter = compiledAdapter
+		if compiledRule != nil {
+			result.Rule = compiledRule.RuleType().String() + "," + compiledRule.Payload()
+		}
+		result.Consistent = (linearRule == nil) == (compiledRule == nil) && linearAdapter == compiledAdapter
+		result.LinearNs = timeMatches(linear, metadata, iterations)
+		result.CompiledNs = timeMatches(compiled, metadata, iterations)
+		benchmark.Results = append(benchmark.Results, result)
+	}
+	return benchmark, nil
+}
+
+func handleSetDomainMatcher(paramsString string) bool {
+	var params *DomainMatcherParams
+	if err := json.Unmarshal([]byte(paramsString), &params); err != nil {
+		return false
+	}
+	domainMatcher.Set(params)
+	return true
+}
+
+func handleBenchmarkRuleMatch(paramsString string) (string, error) {
+	params := &RuleMatchParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return "", err
+	}
+	benchmark, err := domainMatcher.Benchmark(params)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(benchmark)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// getRuleMatch runs the benchmark for dashboards, GET /rule-match?domain=a&domain=b&iterations=n
+func getRuleMatch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	params := &RuleMatchParams{Domains: query["domain"]}
+	params.Iterations, _ = strconv.Atoi(query.Get("iterations"))
+	benchmark, err := domainMatcher.Benchmark(params)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, &route.HTTPError{Message: err.Error()})
+		return
+	}
+	render.JSON(w, r, benchmark)
+}
+
+func domainMatcherRouter(r chi.Router) {
+	r.Get("/rule-match", getRuleMatch)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	C "github.com/metacubex/mihomo/constant"
+	RC "github.com/metacubex/mihomo/rules/common"
+)
+
+// domainRules mixes exact and suffix rules whose payloads repeat, so the first rule naming a host
+// is not always the only one
+func domainRules(count int) []C.Rule {
+	rules := make([]C.Rule, 0, count+3)
+	for i := 0; i < count; i++ {
+		adapter := fmt.Sprintf("proxy-%d", i%7)
+		switch i % 3 {
+		case 0:
+			rules = append(rules, RC.NewDomain(fmt.Sprintf("host%d.example.com", i), adapter))
+		case 1:
+			rules = append(rules, RC.NewDomainSuffix(fmt.Sprintf("site%d.example.org", i), adapter))
+		default:
+			rules = append(rules, RC.NewDomainSuffix(fmt.Sprintf("host%d.example.com", i-2), adapter))
+		}
+	}
+	rules = append(rules, RC.NewDomainSuffix("example.net", "net"), RC.NewDomain("example.net", "exact"))
+	return append(rules, RC.NewMatch("final"))
+}
+
+func domainHosts(count int) []string {
+	hosts := []string{"example.net", "a.example.net", "missing.example.com", "example.com", "localhost", "", "..", "a..b"}
+	for i := 0; i < count; i++ {
+		hosts = append(hosts,
+			fmt.Sprintf("host%d.example.com", i),
+			fmt.Sprintf("www.host%d.example.com", i),
+			fmt.Sprintf("site%d.example.org", i),
+			fmt.Sprintf("a.b.site%d.example.org", i),
+			fmt.Sprintf("xsite%d.example.org", i),
+		)
+	}
+	return hosts
+}
+
+func TestDomainIndexLookup(t *testing.T) {
+	for _, size := range []int{0, 1, 2, 7, 100, 1000} {
+		entries := map[string]mphSlot{}
+		for i := 0; i < size; i++ {
+			entries[fmt.Sprintf("d%d.test", i)] = mphSlot{exact: int32(i), suffix: -1}
+		}
+		index := newDomainIndex(entries)
+		for key, want := range entries {
+			entry, ok := index.lookup(key)
+			if !ok || entry.exact != want.exact {
+				t.Fatalf("size %d: lookup %s = %v %v, want %v", size, key, entry, ok, want)
+			}
+		}
+		if _, ok := index.lookup("missing.test"); ok {
+			t.Fatalf("size %d: found a key never inserted", size)
+		}
+	}
+}
+
+func TestDomainMatcherFoldsLikeLinear(t *testing.T) {
+	rules := domainRules(300)
+	matcher := &DomainMatcher{}
+	compiled := matcher.CompileLocked(rules, nil)
+	if matcher.runs != 1 || matcher.domains != 302 || len(compiled) != 2 {
+		t.Fatalf("folded into %d rules with %d runs of %d domains", len(compiled), matcher.runs, matcher.domains)
+	}
+	for _, host := range domainHosts(300) {
+		metadata := &C.Metadata{NetWork: C.TCP, Host: host, DstPort: 443}
+		_, linear := matchRules(rules, metadata)
+		_, folded := matchRules(compiled, metadata)
+		if linear != folded {
+			t.Fatalf("%q matched %s folded, %s linear", host, folded, linear)
+		}
+	}
+}
+
+func TestDomainMatcherKeepsShortRuns(t *testing.T) {
+	rules := domainRules(4)
+	matcher := &DomainMatcher{}
+	if compiled := matcher.CompileLocked(rules, nil); len(compiled) != len(rules) {
+		t.Fatalf("a run shorter than %d was folded", defaultDomainRun)
+	}
+	matcher.Set(&DomainMatcherParams{Disable: true})
+	if compiled := matcher.CompileLocked(domainRules(300), nil); matcher.runs != 0 || len(compiled) != 303 {
+		t.Fatal("disabled matcher folded rules")
+	}
+}
+
+func TestDomainMatcherFoldsSubRules(t *testing.T) {
+	subRules := map[string][]C.Rule{"sub": domainRules(50)}
+	matcher := &DomainMatcher{}
+	matcher.CompileLocked(domainRules(2), subRules)
+	if len(subRules["sub"]) != 2 || matcher.runs != 1 {
+		t.Fatalf("sub rules folded into %d rules with %d runs", len(subRules["sub"]), matcher.runs)
+	}
+}
+
+// BenchmarkRuleMatch matches over the rules as parsed and as folded, the miss walks every rule of
+// the linear list
+func BenchmarkRuleMatch(b *testing.B) {
+	rules := domainRules(3000)
+	compiled := (&DomainMatcher{}).CompileLocked(rules, nil)
+	for _, host := range []string{"www.host2997.example.com", "a.example.net", "missing.example.com"} {
+		metadata := &C.Metadata{NetWork: C.TCP, Host: host, DstPort: 443}
+		b.Run("linear/"+host, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				matchRules(rules, metadata)
+			}
+		})
+		b.Run("folded/"+host, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				matchRules(compiled, metadata)
+			}
+		})
+	}
+}
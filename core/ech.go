@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/metacubex/mihomo/adapter"
+	"github.com/metacubex/mihomo/common/lru"
+	"github.com/metacubex/mihomo/config"
+	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	utls "github.com/metacubex/utls"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	echOptsKey     = "ech-opts"
+	echFallbackKey = "fallback"
+
+	echStatusSize = 4096
+	echStatusTTL  = 600
+)
+
+type EchState string
+
+const (
+	EchAccepted EchState = "accepted"
+	EchFallback EchState = "fallback"
+)
+
+type EchStatus struct {
+	Static    bool   `json:"static"`
+	Fallback  bool   `json:"fallback"`
+	Accepted  int64  `json:"accepted"`
+	Fallbacks int64  `json:"fallbacks"`
+	Failures  int64  `json:"failures"`
+	Error     string `json:"error,omitempty"`
+}
+
+// echPolicy is the ech-opts of an outbound, with fallback a server that rejects ECH or whose
+// HTTPS record is missing is dialed again without it, which shows the server name on the wire
+type echPolicy struct {
+	static    bool
+	fallback  bool
+	mapping   map[string]any
+	plain     C.ProxyAdapter
+	accepted  atomic.Int64
+	fallbacks atomic.Int64
+	failures  atomic.Int64
+	mutex     sync.Mutex
+	err       string
+}
+
+func (p *echPolicy) setError(err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err == nil {
+		p.err = ""
+		return
+	}
+	p.err = err.Error()
+}
+
+// plainAdapter builds the outbound without ech-opts the first time a fallback needs it
+func (p *echPolicy) plainAdapter() (C.ProxyAdapter, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.plain != nil {
+		return p.plain, nil
+	}
+	proxy, err := adapter.ParseProxy(p.mapping)
+	if err != nil {
+		return nil, err
+	}
+	p.plain = proxy.(*adapter.Proxy).ProxyAdapter
+	return p.plain, nil
+}
+
+func (p *echPolicy) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.plain != nil {
+		_ = p.plain.Close()
+		p.plain = nil
+	}
+}
+
+// isEchError reports whether a dial failed on ECH itself, either the config list could not be
+// resolved or the server rejected it
+func isEchError(err error) bool {
+	var rejection *utls.ECHRejectionError
+	if errors.As(err, &rejection) {
+		return true
+	}
+	message := err.Error()
+	return strings.Contains(message, "resolve ECH config error") || strings.Contains(message, "server rejected ECH")
+}
+
+// Ech keeps the ECH outbounds of the profile and the outcome of their recent dials
+type Ech struct {
+	mutex    sync.Mutex
+	policies map[string]*echPolicy
+	states   *lru.LruCache[*C.Metadata, EchState]
+}
+
+var encryptedClientHello = &Ech{
+	policies: map[string]*echPolicy{},
+	states: lru.New[*C.Metadata, EchState](
+		lru.WithSize[*C.Metadata, EchState](echStatusSize),
+		lru.WithAge[*C.Metadata, EchState](echStatusTTL),
+	),
+}
+
+// Prepare reads the fallback key of ech-opts, mihomo itself resolves the config list from the
+// HTTPS record of the server or takes the static one
+func (e *Ech) Prepare(rawConfig *config.RawConfig) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for _, policy := range e.policies {
+		policy.close()
+	}
+	e.policies = map[string]*echPolicy{}
+	e.states.Clear()
+	for _, mapping := range rawConfig.Proxy {
+		name, _ := mapping["name"].(string)
+		options, ok := mapping[echOptsKey].(map[string]any)
+		if !ok {
+			continue
+		}
+		fallback, _ := options[echFallbackKey].(bool)
+		delete(options, echFallbackKey)
+		if enable, _ := options["enable"].(bool); !enable || name == "" {
+			continue
+		}
+		static, _ := options["config"].(string)
+		plain := make(map[string]any, len(mapping))
+		for key, value := range mapping {
+			plain[key] = value
+		}
+		delete(plain, echOptsKey)
+		e.policies[name] = &echPolicy{static: static != "", fallback: fallback, mapping: plain}
+	}
+}
+
+func (e *Ech) wrap(name string, proxy C.ProxyAdapter) C.ProxyAdapter {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	policy, ok := e.policies[name]
+	if !ok {
+		return proxy
+	}
+	return &echAdapter{ProxyAdapter: proxy, policy: policy}
+}
+
+func (e *Ech) record(metadata *C.Metadata, state EchState) {
+	e.states.Set(metadata, state)
+}
+
+// State is whether the outbound connection of a tracked connection was dialed with ECH or fell back
+func (e *Ech) State(metadata *C.Metadata) EchState {
+	if metadata == nil {
+		return ""
+	}
+	state, _ := e.states.Get(metadata)
+	return state
+}
+
+func (e *Ech) Status() map[string]*EchStatus {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	status := map[string]*EchStatus{}
+	for name, policy := range e.policies {
+		policy.mutex.Lock()
+		lastError := policy.err
+		policy.mutex.Unlock()
+		status[name] = &EchStatus{
+			Static:    policy.static,
+			Fallback:  policy.fallback,
+			Accepted:  policy.accepted.Load(),
+			Fallbacks: policy.fallbacks.Load(),
+			Failures:  policy.failures.Load(),
+			Error:     lastError,
+		}
+	}
+	return status
+}
+
+type echAdapter struct {
+	C.ProxyAdapter
+	policy *echPolicy
+}
+
+func (a *echAdapter) Inner() C.ProxyAdapter {
+	return a.ProxyAdapter
+}
+
+// dial runs the ECH dial and the plain one after it when the policy falls back
+func (a *echAdapter) dial(metadata *C.Metadata, ech func() error, plain func(C.ProxyAdapter) error) error {
+	err := ech()
+	if err == nil {
+		a.policy.accepted.Add(1)
+		a.policy.setError(nil)
+		encryptedClientHello.record(metadata, EchAccepted)
+		return nil
+	}
+	if !isEchError(err) {
+		return err
+	}
+	a.policy.setError(err)
+	if !a.policy.fallback {
+		a.policy.failures.Add(1)
+		return err
+	}
+	proxy, buildErr := a.policy.plainAdapter()
+	if buildErr != nil {
+		a.policy.failures.Add(1)
+		return err
+	}
+	log.Warnln("[ECH] %s fell back to plain tls: %v", a.Name(), err)
+	if err = plain(proxy); err != nil {
+		a.policy.failures.Add(1)
+		return err
+	}
+	a.policy.fallbacks.Add(1)
+	encryptedClientHello.record(metadata, EchFallback)
+	return nil
+}
+
+func (a *echAdapter) DialContext(ctx context.Context, metadata *C.Metadata) (conn C.Conn, err error) {
+	err = a.dial(metadata, func() (err error) {
+		conn, err = a.ProxyAdapter.DialContext(ctx, metadata)
+		return
+	}, func(proxy C.ProxyAdapter) (err error) {
+		conn, err = proxy.DialContext(ctx, metadata)
+		return
+	})
+	return
+}
+
+func (a *echAdapter) DialContextWithDialer(ctx context.Context, dialer C.Dialer, metadata *C.Metadata) (conn C.Conn, err error) {
+	err = a.dial(metadata, func() (err error) {
+		conn, err = a.ProxyAdapter.DialContextWithDialer(ctx, dialer, metadata)
+		return
+	}, func(proxy C.ProxyAdapter) (err error) {
+		conn, err = proxy.DialContextWithDialer(ctx, dialer, metadata)
+		return
+	})
+	return
+}
+
+func (a *echAdapter) ListenPacketContext(ctx context.Context, metadata *C.Metadata) (conn C.PacketConn, err error) {
+	err = a.dial(metadata, func() (err error) {
+		conn, err = a.ProxyAdapter.ListenPacketContext(ctx, metadata)
+		return
+	}, func(proxy C.ProxyAdapter) (err error) {
+		conn, err = proxy.ListenPacketContext(ctx, metadata)
+		return
+	})
+	return
+}
+
+func (a *echAdapter) ListenPacketWithDialer(ctx context.Context, dialer C.Dialer, metadata *C.Metadata) (conn C.PacketConn, err error) {
+	err = a.dial(metadata, func() (err error) {
+		conn, err = a.ProxyAdapter.ListenPacketWithDialer(ctx, dialer, metadata)
+		return
+	}, func(proxy C.ProxyAdapter) (err error) {
+		conn, err = proxy.ListenPacketWithDialer(ctx, dialer, metadata)
+		return
+	})
+	return
+}
+
+func handleGetEchStatus() string {
+	data, err := json.Marshal(encryptedClientHello.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
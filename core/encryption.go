@@ -0,0 +1,796 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"golang.org/x/crypto/argon2"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// encryptionHeader identifies files encrypted by the app (mirrors EncryptionService.dart)
+var encryptionHeader = []byte{0xEE, 0xCC, 0x55, 0x88}
+
+// keyedEncryptionHeader is followed by the id of the key, data sealed by any provider but the
+// static one carries it since the Dart layer only reads the static one
+var keyedEncryptionHeader = []byte{0xEE, 0xCC, 0x55, 0x89}
+
+const encryptionKeyIdSize = 8
+
+var errNoKeyProvider = errors.New("no key provider available")
+
+// KeyProvider supplies the master key used by the encryption service
+type KeyProvider interface {
+	// Name identifies the provider in logs and status reports
+	Name() string
+	// Available reports whether the provider can currently supply a key
+	Available() bool
+	// MasterKey returns a 32-byte key; callers must clear it after use
+	MasterKey() ([]byte, error)
+}
+
+// staticKeyProvider derives the key from the application secret
+type staticKeyProvider struct {
+	secret []byte
+}
+
+// NewStaticKeyProvider creates a provider compatible with keys used by the Dart layer
+func NewStaticKeyProvider(secret string) KeyProvider {
+	return &staticKeyProvider{secret: []byte(secret)}
+}
+
+func (p *staticKeyProvider) Name() string {
+	return "static"
+}
+
+func (p *staticKeyProvider) Available() bool {
+	return len(p.secret) >= 32
+}
+
+func (p *staticKeyProvider) MasterKey() ([]byte, error) {
+	if !p.Available() {
+		return nil, errors.New("static secret is shorter than 32 bytes")
+	}
+	key := make([]byte, 32)
+	copy(key, p.secret[:32])
+	return key, nil
+}
+
+// passphraseKeyProvider derives the key from a user passphrase with Argon2id, once per provider
+type passphraseKeyProvider struct {
+	passphrase []byte
+	salt       []byte
+	mutex      sync.Mutex
+	key        []byte
+}
+
+// NewPassphraseKeyProvider creates a provider deriving keys from a passphrase, a nil salt is the
+// random one of this install
+func NewPassphraseKeyProvider(passphrase string, salt []byte) KeyProvider {
+	return &passphraseKeyProvider{passphrase: []byte(passphrase), salt: salt}
+}
+
+func (p *passphraseKeyProvider) Name() string {
+	return "passphrase"
+}
+
+func (p *passphraseKeyProvider) Available() bool {
+	return len(p.passphrase) > 0
+}
+
+func (p *passphraseKeyProvider) MasterKey() ([]byte, error) {
+	if !p.Available() {
+		return nil, errors.New("passphrase is empty")
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.key == nil {
+		salt := p.salt
+		if len(salt) == 0 {
+			var err error
+			if salt, err = installSalt(); err != nil {
+				return nil, err
+			}
+		}
+		p.key = argon2.IDKey(p.passphrase, salt, 1, 64*1024, 4, 32)
+	}
+	key := make([]byte, len(p.key))
+	copy(key, p.key)
+	return key, nil
+}
+
+// installSalt is the salt of the passphrase key, made once so two installs with the same passphrase
+// still derive different keys
+func installSalt() ([]byte, error) {
+	path := filepath.Join(constant.Path.Resolve(encryptionDir), passphraseSaltFile)
+	salt, err := os.ReadFile(path)
+	if err == nil {
+		if len(salt) != passphraseSaltSize {
+			return nil, errors.New("invalid passphrase salt")
+		}
+		return salt, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	salt = make([]byte, passphraseSaltSize)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(path, salt, 0600); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// hostKeyProvider holds a key handed over by the host app, e.g. unwrapped from Android Keystore
+type hostKeyProvider struct {
+	key []byte
+}
+
+// NewHostKeyProvider creates a provider from key material supplied over the bridge
+func NewHostKeyProvider(key []byte) KeyProvider {
+	return &hostKeyProvider{key: key}
+}
+
+func (p *hostKeyProvider) Name() string {
+	return "host"
+}
+
+func (p *hostKeyProvider) Available() bool {
+	return len(p.key) == 32
+}
+
+func (p *hostKeyProvider) MasterKey() ([]byte, error) {
+	if !p.Available() {
+		return nil, errors.New("host key must be 32 bytes")
+	}
+	key := make([]byte, 32)
+	copy(key, p.key)
+	return key, nil
+}
+
+// chainKeyProvider returns the key of the first available provider
+type chainKeyProvider struct {
+	providers []KeyProvider
+}
+
+// NewChainKeyProvider creates a fallback chain of providers, tried in order
+func NewChainKeyProvider(providers ...KeyProvider) KeyProvider {
+	chain := &chainKeyProvider{}
+	for _, provider := range providers {
+		if provider != nil {
+			chain.providers = append(chain.providers, provider)
+		}
+	}
+	return chain
+}
+
+func (p *chainKeyProvider) Name() string {
+	if provider := p.active(); provider != nil {
+		return provider.Name()
+	}
+	return "none"
+}
+
+func (p *chainKeyProvider) Available() bool {
+	return p.active() != nil
+}
+
+func (p *chainKeyProvider) MasterKey() ([]byte, error) {
+	_, key, err := p.masterKey()
+	return key, err
+}
+
+// masterKey returns the key with the provider that supplied it
+func (p *chainKeyProvider) masterKey() (KeyProvider, []byte, error) {
+	var lastErr error = errNoKeyProvider
+	for _, provider := range p.providers {
+		if !provider.Available() {
+			continue
+		}
+		key, err := provider.MasterKey()
+		if err == nil {
+			return provider, key, nil
+		}
+		lastErr = fmt.Errorf("%s: %v", provider.Name(), err)
+	}
+	return nil, nil, lastErr
+}
+
+// candidates are the available providers in order, data of an earlier setup may be sealed with
+// any of them
+func (p *chainKeyProvider) candidates() []KeyProvider {
+	var candidates []KeyProvider
+	for _, provider := range p.providers {
+		if provider.Available() {
+			candidates = append(candidates, provider)
+		}
+	}
+	return candidates
+}
+
+// provider returns the available provider with the name
+func (p *chainKeyProvider) provider(name string) KeyProvider {
+	for _, provider := range p.candidates() {
+		if provider.Name() == name {
+			return provider
+		}
+	}
+	return nil
+}
+
+func (p *chainKeyProvider) active() KeyProvider {
+	for _, provider := range p.providers {
+		if provider.Available() {
+			return provider
+		}
+	}
+	return nil
+}
+
+// EncryptionService encrypts and decrypts profile data with a key from its provider
+type EncryptionService struct {
+	provider KeyProvider
+	mutex    sync.RWMutex
+}
+
+// encryptionServiceValue is set once by the first init, later inits only swap its provider
+var encryptionServiceValue atomic.Pointer[EncryptionService]
+
+func getEncryptionService() *EncryptionService {
+	return encryptionServiceValue.Load()
+}
+
+// NewEncryptionService creates an encryption service backed by the given provider
+func NewEncryptionService(provider KeyProvider) *EncryptionService {
+	return &EncryptionService{provider: provider}
+}
+
+// SetKeyProvider replaces the provider used for subsequent operations
+func (es *EncryptionService) SetKeyProvider(provider KeyProvider) {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	es.provider = provider
+}
+
+// ProviderName returns the name of the provider currently supplying the key
+func (es *EncryptionService) ProviderName() string {
+	es.mutex.RLock()
+	defer es.mutex.RUnlock()
+	if es.provider == nil {
+		return "none"
+	}
+	return es.provider.Name()
+}
+
+// withKey fetches the master key for one operation and clears it afterwards
+func (es *EncryptionService) withKey(operation func(key []byte) error) error {
+	es.mutex.RLock()
+	provider := es.provider
+	es.mutex.RUnlock()
+	if provider == nil {
+		return errNoKeyProvider
+	}
+	key, err := provider.MasterKey()
+	if err != nil {
+		return err
+	}
+	defer clearBytes(key)
+	return operation(key)
+}
+
+// withSealKey is withKey for sealing, legacy tells the static key whose data keeps the header the
+// Dart layer reads
+func (es *EncryptionService) withSealKey(operation func(key []byte, legacy bool) error) error {
+	es.mutex.RLock()
+	provider := es.provider
+	es.mutex.RUnlock()
+	if provider == nil {
+		return errNoKeyProvider
+	}
+	var key []byte
+	var err error
+	if chain, ok := provider.(*chainKeyProvider); ok {
+		provider, key, err = chain.masterKey()
+	} else {
+		key, err = provider.MasterKey()
+	}
+	if err != nil {
+		return err
+	}
+	defer clearBytes(key)
+	_, legacy := provider.(*staticKeyProvider)
+	return operation(key, legacy)
+}
+
+// encryptionKeyId names a key in the keyed header without revealing it
+func encryptionKeyId(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("flclash encryption key id"))
+	return mac.Sum(nil)[:encryptionKeyIdSize]
+}
+
+// withKeyId runs operation with the key of the provider whose id the data carries
+func (es *EncryptionService) withKeyId(id []byte, operation func(key []byte) error) error {
+	es.mutex.RLock()
+	provider := es.provider
+	es.mutex.RUnlock()
+	if provider == nil {
+		return errNoKeyProvider
+	}
+	candidates := []KeyProvider{provider}
+	if chain, ok := provider.(*chainKeyProvider); ok {
+		candidates = chain.candidates()
+	}
+	for _, candidate := range candidates {
+		key, err := candidate.MasterKey()
+		if err != nil {
+			continue
+		}
+		if !hmac.Equal(encryptionKeyId(key), id) {
+			clearBytes(key)
+			continue
+		}
+		err = operation(key)
+		clearBytes(key)
+		return err
+	}
+	return errNoKeyProvider
+}
+
+// withDecryptKey runs operation with the key that unpads tail, the previous block and the last block
+// of the data. Only data without a key id goes through it, the static key or the providers of
+// earlier versions sealed it.
+func (es *EncryptionService) withDecryptKey(tail []byte, operation func(key []byte) error) error {
+	es.mutex.RLock()
+	provider := es.provider
+	es.mutex.RUnlock()
+	if provider == nil {
+		return errNoKeyProvider
+	}
+	chain, ok := provider.(*chainKeyProvider)
+	if !ok || len(tail) != aes.BlockSize*2 {
+		return es.withKey(operation)
+	}
+	candidates := chain.candidates()
+	if len(candidates) < 2 {
+		return es.withKey(operation)
+	}
+	last := make([]byte, aes.BlockSize)
+	defer clearBytes(last)
+	for _, candidate := range candidates {
+		key, err := candidate.MasterKey()
+		if err != nil {
+			continue
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			clearBytes(key)
+			continue
+		}
+		cipher.NewCBCDecrypter(block, tail[:aes.BlockSize]).CryptBlocks(last, tail[aes.BlockSize:])
+		if _, err = pkcs7Unpad(last, aes.BlockSize); err != nil {
+			clearBytes(key)
+			continue
+		}
+		err = operation(key)
+		clearBytes(key)
+		return err
+	}
+	return errors.New("invalid padding")
+}
+
+// withDataKey picks the key by the id of the data, or by the padding of tail for data without one
+func (es *EncryptionService) withDataKey(id []byte, tail []byte, operation func(key []byte) error) error {
+	if id != nil {
+		return es.withKeyId(id, operation)
+	}
+	return es.withDecryptKey(tail, operation)
+}
+
+// HasEncryptionHeader checks if data carries the app encryption header
+func HasEncryptionHeader(data []byte) bool {
+	return bytes.HasPrefix(data, encryptionHeader) || bytes.HasPrefix(data, keyedEncryptionHeader)
+}
+
+// Encrypt encrypts data using AES-256-CBC in the format used by the Dart layer
+func (es *EncryptionService) Encrypt(data []byte) ([]byte, error) {
+	if HasEncryptionHeader(data) {
+		return data, nil
+	}
+	var result []byte
+	err := es.withSealKey(func(key []byte, legacy bool) error {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		iv := make([]byte, aes.BlockSize)
+		if _, err := rand.Read(iv); err != nil {
+			return err
+		}
+		header := encryptionHeader
+		if !legacy {
+			header = append(append([]byte{}, keyedEncryptionHeader...), encryptionKeyId(key)...)
+		}
+		padded := pkcs7Pad(data, aes.BlockSize)
+		defer clearBytes(padded)
+		result = make([]byte, len(header)+len(iv)+len(padded))
+		n := copy(result, header)
+		n += copy(result[n:], iv)
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(result[n:], padded)
+		return nil
+	})
+	return result, err
+}
+
+// Decrypt decrypts data produced by Encrypt; data without header is returned as is
+func (es *EncryptionService) Decrypt(data []byte) ([]byte, error) {
+	if !HasEncryptionHeader(data) {
+		return data, nil
+	}
+	payload := data[len(encryptionHeader):]
+	var id []byte
+	if bytes.HasPrefix(data, keyedEncryptionHeader) {
+		if len(payload) < encryptionKeyIdSize {
+			return nil, errors.New("invalid encrypted data length")
+		}
+		id, payload = payload[:encryptionKeyIdSize], payload[encryptionKeyIdSize:]
+	}
+	if len(payload) < aes.BlockSize*2 || len(payload)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid encrypted data length")
+	}
+	var result []byte
+	err := es.withDataKey(id, payload[len(payload)-aes.BlockSize*2:], func(key []byte) error {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		iv, encrypted := payload[:aes.BlockSize], payload[aes.BlockSize:]
+		decrypted := make([]byte, len(encrypted))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, encrypted)
+		result, err = pkcs7Unpad(decrypted, aes.BlockSize)
+		if err != nil {
+			clearBytes(decrypted)
+		}
+		return err
+	})
+	return result, err
+}
+
+// DecryptReader streams the decryption of r to operation without buffering the whole plaintext, a
+// reader that seeks lets the key be picked by the last blocks like Decrypt
+func (es *EncryptionService) DecryptReader(r io.Reader, operation func(io.Reader) error) error {
+	header := make([]byte, len(encryptionHeader))
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if n < len(header) || !HasEncryptionHeader(header) {
+		return operation(io.MultiReader(bytes.NewReader(header[:n]), r))
+	}
+	var id []byte
+	if bytes.Equal(header, keyedEncryptionHeader) {
+		id = make([]byte, encryptionKeyIdSize)
+		if _, err := io.ReadFull(r, id); err != nil {
+			return errors.New("invalid encrypted data length")
+		}
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(r, iv); err != nil {
+		return errors.New("invalid encrypted data length")
+	}
+	var tail []byte
+	if id == nil {
+		if tail, err = readCipherTail(r, iv); err != nil {
+			return err
+		}
+	}
+	return es.withDataKey(id, tail, func(key []byte) error {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		reader := &cbcDecryptReader{
+			source: r,
+			mode:   cipher.NewCBCDecrypter(block, iv),
+			chunk:  make([]byte, secureChunkSize),
+		}
+		defer reader.clear()
+		return operation(reader)
+	})
+}
+
+// cipherTailReader knows the end of its data without reading up to it, like the secure cache
+type cipherTailReader interface {
+	tail(n int) ([]byte, int64, error)
+}
+
+// readCipherTail reads the last two blocks of a seeking reader and returns to where it was, nil when
+// the reader does not seek
+func readCipherTail(r io.Reader, iv []byte) ([]byte, error) {
+	if tailReader, ok := r.(cipherTailReader); ok {
+		data, size, err := tailReader.tail(aes.BlockSize * 2)
+		if err != nil {
+			return nil, err
+		}
+		if size < aes.BlockSize || size%aes.BlockSize != 0 {
+			return nil, errors.New("invalid encrypted data length")
+		}
+		if size == aes.BlockSize {
+			data = append(append([]byte{}, iv...), data[len(data)-aes.BlockSize:]...)
+		}
+		return data, nil
+	}
+	seeker, ok := r.(io.ReadSeeker)
+	if !ok {
+		return nil, nil
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, nil
+	}
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	size := end - start
+	if size < aes.BlockSize || size%aes.BlockSize != 0 {
+		return nil, errors.New("invalid encrypted data length")
+	}
+	tail := make([]byte, aes.BlockSize*2)
+	if size == aes.BlockSize {
+		copy(tail, iv)
+		_, err = seeker.Seek(start, io.SeekStart)
+		if err == nil {
+			_, err = io.ReadFull(seeker, tail[aes.BlockSize:])
+		}
+	} else {
+		_, err = seeker.Seek(end-int64(len(tail)), io.SeekStart)
+		if err == nil {
+			_, err = io.ReadFull(seeker, tail)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err = seeker.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return tail, nil
+}
+
+// cbcDecryptReader decrypts AES-CBC data chunk by chunk, holding back the last block for unpadding
+type cbcDecryptReader struct {
+	source io.Reader
+	mode   cipher.BlockMode
+	chunk  []byte
+	buf    []byte
+	tail   []byte
+	ready  []byte
+	err    error
+}
+
+func (r *cbcDecryptReader) Read(p []byte) (int, error) {
+	for len(r.ready) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.fill()
+	}
+	n := copy(p, r.ready)
+	r.ready = r.ready[n:]
+	return n, nil
+}
+
+func (r *cbcDecryptReader) fill() {
+	clearBytes(r.buf)
+	n, err := io.ReadFull(r.source, r.chunk)
+	if n%aes.BlockSize != 0 {
+		r.err = errors.New("invalid encrypted data length")
+		return
+	}
+	r.mode.CryptBlocks(r.chunk[:n], r.chunk[:n])
+	r.buf = append(r.buf[:0], r.tail...)
+	r.buf = append(r.buf, r.chunk[:n]...)
+	clearBytes(r.chunk[:n])
+	clearBytes(r.tail)
+	r.tail = r.tail[:0]
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		r.ready, r.err = pkcs7Unpad(r.buf, aes.BlockSize)
+		if r.err == nil {
+			r.err = io.EOF
+		}
+		return
+	}
+	if err != nil {
+		r.err = err
+		return
+	}
+	split := len(r.buf) - aes.BlockSize
+	r.tail = append(r.tail, r.buf[split:]...)
+	r.ready = r.buf[:split]
+}
+
+func (r *cbcDecryptReader) clear() {
+	clearBytes(r.chunk)
+	clearBytes(r.buf)
+	clearBytes(r.tail)
+	r.ready = nil
+}
+
+func pkcs7Pad(data []byte, blockSize int) []byte {
+	padding := blockSize - len(data)%blockSize
+	padded := make([]byte, len(data)+padding)
+	copy(padded, data)
+	for i := len(data); i < len(padded); i++ {
+		padded[i] = byte(padding)
+	}
+	return padded
+}
+
+func pkcs7Unpad(data []byte, blockSize int) ([]byte, error) {
+	if len(data) == 0 || len(data)%blockSize != 0 {
+		return nil, errors.New("invalid padding")
+	}
+	padding := int(data[len(data)-1])
+	if padding == 0 || padding > blockSize {
+		return nil, errors.New("invalid padding")
+	}
+	for _, b := range data[len(data)-padding:] {
+		if int(b) != padding {
+			return nil, errors.New("invalid padding")
+		}
+	}
+	return data[:len(data)-padding], nil
+}
+
+// clearBytes securely clears a byte slice
+func clearBytes(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
+
+type InitEncryptionParams struct {
+	Secret     string   `json:"secret"`
+	Passphrase string   `json:"passphrase"`
+	HostKey    string   `json:"host-key"`
+	Providers  []string `json:"providers"`
+}
+
+// buildKeyProvider assembles the provider chain requested by the host app
+func buildKeyProvider(params *InitEncryptionParams) KeyProvider {
+	available := map[string]KeyProvider{
+		"platform": newPlatformKeyProvider(),
+	}
+	if params.HostKey != "" {
+		if key, err := base64.StdEncoding.DecodeString(params.HostKey); err == nil {
+			available["host"] = NewHostKeyProvider(key)
+		}
+	}
+	if params.Passphrase != "" {
+		available["passphrase"] = NewPassphraseKeyProvider(params.Passphrase, nil)
+	}
+	if params.Secret != "" {
+		available["static"] = NewStaticKeyProvider(params.Secret)
+	}
+	order := params.Providers
+	if len(order) == 0 {
+		// the app seals the profiles with its static secret, the keystore of the platform is only
+		// used once the app asks for it
+		order = []string{"host", "static", "passphrase"}
+	}
+	providers := make([]KeyProvider, 0, len(order))
+	for _, name := range order {
+		if provider, ok := available[name]; ok {
+			providers = append(providers, provider)
+		}
+	}
+	return NewChainKeyProvider(providers...)
+}
+
+func handleInitEncryption(paramsString string) bool {
+	var params = &InitEncryptionParams{}
+	if err := UnmarshalJson([]byte(paramsString), params); err != nil {
+		// Plain secret for compatibility with older callers
+		params.Secret = paramsString
+	}
+	provider := buildKeyProvider(params)
+	if !provider.Available() {
+		return false
+	}
+	if !encryptionServiceValue.CompareAndSwap(nil, NewEncryptionService(provider)) {
+		getEncryptionService().SetKeyProvider(provider)
+	}
+	GetSecureMemoryService().SetEncryptionService(getEncryptionService())
+	migrateSealedStores()
+	// the sync credentials are sealed, a remote of an earlier run only starts once the key is here
+	syncEngine.Resume()
+	return true
+}
+
+const (
+	encryptionDir          = "encryption"
+	encryptionProviderFile = "provider"
+	passphraseSaltFile     = "passphrase.salt"
+	passphraseSaltSize     = 16
+	// legacyKeyProvider sealed everything before the app could choose a provider
+	legacyKeyProvider = "static"
+)
+
+// migrateSealedStores seals the secrets of the core with the key of the provider in use after the
+// app switched providers. The other files of the core open with the key they were sealed with and
+// are sealed with the new one when they are written next.
+func migrateSealedStores() {
+	if !isInit || getEncryptionService() == nil {
+		return
+	}
+	path := filepath.Join(constant.Path.Resolve(encryptionDir), encryptionProviderFile)
+	previous := legacyKeyProvider
+	if data, err := os.ReadFile(path); err == nil {
+		previous = strings.TrimSpace(string(data))
+	}
+	active := getEncryptionService().ProviderName()
+	if previous != active {
+		es := getEncryptionService()
+		es.mutex.RLock()
+		chain, _ := es.provider.(*chainKeyProvider)
+		es.mutex.RUnlock()
+		var from KeyProvider
+		if chain != nil {
+			from = chain.provider(previous)
+		}
+		if from == nil {
+			log.Warnln("[Encryption] secrets are sealed by %s, it is not available to move them to %s", previous, active)
+			return
+		}
+		sealed := NewEncryptionService(from)
+		if err := vault.reseal(sealed); err != nil {
+			log.Warnln("[Encryption] reseal vault error: %v", err)
+			return
+		}
+		if err := templateVariables.reseal(sealed); err != nil {
+			log.Warnln("[Encryption] reseal template variables error: %v", err)
+			return
+		}
+		log.Infoln("[Encryption] moved the secrets from %s to %s", previous, active)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+	_ = os.WriteFile(path, []byte(active), 0600)
+}
+
+// resealSecretValue opens an encrypted value with from and seals it with the encryption service
+func resealSecretValue(value string, from *EncryptionService) (string, error) {
+	if !strings.HasPrefix(value, encryptedValuePrefix) {
+		return value, nil
+	}
+	encrypted, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedValuePrefix))
+	if err != nil {
+		return "", err
+	}
+	plain, err := from.Decrypt(encrypted)
+	if err != nil {
+		return "", err
+	}
+	defer clearBytes(plain)
+	return EncryptSecretValue(string(plain))
+}
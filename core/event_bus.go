@@ -0,0 +1,391 @@
+package main
+
+import (
+	"core/state"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/tunnel/statistic"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type EventTopic string
+
+const (
+	ProxyChangedTopic   EventTopic = "proxy-changed"
+	TrafficTickTopic    EventTopic = "traffic-tick"
+	DnsQueryTopic       EventTopic = "dns-query"
+	TunStateTopic       EventTopic = "tun-state"
+	LogTopic            EventTopic = "log"
+	ProfileUpdatedTopic EventTopic = "profile-updated"
+)
+
+const (
+	defaultEventWindow   = 64
+	defaultEventCapacity = 1024
+	maxEventCapacity     = 16384
+)
+
+// messageTopics maps the messages of sendMessage to their stream, other messages use their type as topic
+var messageTopics = map[MessageType]EventTopic{
+	ProxyChangedMessage: ProxyChangedTopic,
+	DnsMessage:          DnsQueryTopic,
+	LogMessage:          LogTopic,
+}
+
+func topicOf(messageType MessageType) EventTopic {
+	if topic, ok := messageTopics[messageType]; ok {
+		return topic
+	}
+	return EventTopic(messageType)
+}
+
+type Event struct {
+	Seq   uint64     `json:"seq"`
+	Topic EventTopic `json:"topic"`
+	Time  int64      `json:"time"`
+	Data  any        `json:"data"`
+}
+
+// EventBatch is the data of an EventMessage, dropped counts the events evicted from a full stream since the last batch
+type EventBatch struct {
+	Subscription string  `json:"subscription"`
+	Events       []Event `json:"events"`
+	Dropped      uint64  `json:"dropped"`
+}
+
+type EventSubscribeParams struct {
+	Topics   []EventTopic `json:"topics"`
+	Window   int          `json:"window"`
+	Capacity int          `json:"capacity"`
+	// Filter is evaluated before an event is queued, a dropped event takes no seq
+	Filter *StreamFilter `json:"filter"`
+}
+
+type EventAckParams struct {
+	Subscription string `json:"subscription"`
+	Seq          uint64 `json:"seq"`
+}
+
+type EventReplayParams struct {
+	Subscription string `json:"subscription"`
+	After        uint64 `json:"after"`
+}
+
+type EventStreamStatus struct {
+	Subscription string        `json:"subscription"`
+	Topics       []EventTopic  `json:"topics"`
+	Filter       *StreamFilter `json:"filter,omitempty"`
+	Seq          uint64        `json:"seq"`
+	Acked        uint64        `json:"acked"`
+	Pending      int           `json:"pending"`
+	Dropped      uint64        `json:"dropped"`
+}
+
+// eventStream keeps its events until they are acked, at most window of them are in flight
+type eventStream struct {
+	id       string
+	topics   []EventTopic
+	filter   *StreamFilter
+	window   int
+	capacity int
+	seq      uint64
+	acked    uint64
+	sent     uint64
+	queue    []Event
+	dropped  uint64
+	lost     uint64
+}
+
+func (s *eventStream) wants(topic EventTopic) bool {
+	for _, item := range s.topics {
+		if item == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// EventBus delivers typed streams over the bridge with sequence numbers and ack based backpressure
+type EventBus struct {
+	mutex   sync.Mutex
+	streams map[string]*eventStream
+	topics  atomic.Value
+	nextId  atomic.Uint64
+}
+
+var eventBus = &EventBus{
+	streams: map[string]*eventStream{},
+}
+
+// refreshTopicsLocked keeps a copy of the subscribed topics for the lock free Has
+func (b *EventBus) refreshTopicsLocked() {
+	topics := map[EventTopic]bool{}
+	for _, stream := range b.streams {
+		for _, topic := range stream.topics {
+			topics[topic] = true
+		}
+	}
+	b.topics.Store(topics)
+}
+
+func (b *EventBus) Has(topic EventTopic) bool {
+	topics, _ := b.topics.Load().(map[EventTopic]bool)
+	return topics[topic]
+}
+
+func (b *EventBus) Subscribe(params *EventSubscribeParams) (string, error) {
+	if len(params.Topics) == 0 {
+		return "", errors.New("topics are required")
+	}
+	window := params.Window
+	if window <= 0 {
+		window = defaultEventWindow
+	}
+	capacity := params.Capacity
+	if capacity <= 0 {
+		capacity = defaultEventCapacity
+	}
+	if capacity > maxEventCapacity {
+		capacity = maxEventCapacity
+	}
+	if window > capacity {
+		window = capacity
+	}
+	stream := &eventStream{
+		id:       fmt.Sprintf("events-%d", b.nextId.Add(1)),
+		topics:   append([]EventTopic{}, params.Topics...),
+		filter:   params.Filter.compile(),
+		window:   window,
+		capacity: capacity,
+	}
+	b.mutex.Lock()
+	b.streams[stream.id] = stream
+	b.refreshTopicsLocked()
+	b.mutex.Unlock()
+	return stream.id, nil
+}
+
+func (b *EventBus) Unsubscribe(id string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.streams, id)
+	b.refreshTopicsLocked()
+}
+
+func (b *EventBus) Clear() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.streams = map[string]*eventStream{}
+	b.refreshTopicsLocked()
+}
+
+// Publish reports whether a stream took the event
+func (b *EventBus) Publish(topic EventTopic, data any) bool {
+	if !b.Has(topic) {
+		return false
+	}
+	now := time.Now().UnixMilli()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	claimed := false
+	for _, stream := range b.streams {
+		if !stream.wants(topic) {
+			continue
+		}
+		// a filtered event is still claimed, it must not reach the app untyped either
+		claimed = true
+		if !stream.filter.matches(data) {
+			continue
+		}
+		stream.seq++
+		stream.queue = append(stream.queue, Event{
+			Seq:   stream.seq,
+			Topic: topic,
+			Time:  now,
+			Data:  data,
+		})
+		if len(stream.queue) > stream.capacity {
+			evicted := len(stream.queue) - stream.capacity
+			stream.queue = append([]Event{}, stream.queue[evicted:]...)
+			stream.dropped += uint64(evicted)
+			stream.lost += uint64(evicted)
+		}
+		b.flushLocked(stream)
+	}
+	return claimed
+}
+
+// PublishMessage lets the streams take a message of sendMessage before it goes out untyped
+func (b *EventBus) PublishMessage(message Message) bool {
+	return b.Publish(topicOf(message.Type), message.Data)
+}
+
+// flushLocked sends the events that fit into the window of the stream
+func (b *EventBus) flushLocked(stream *eventStream) {
+	limit := stream.acked + uint64(stream.window)
+	events := []Event{}
+	for _, event := range stream.queue {
+		if event.Seq > stream.sent && event.Seq <= limit {
+			events = append(events, event)
+		}
+	}
+	if len(events) == 0 && stream.dropped == 0 {
+		return
+	}
+	if len(events) > 0 {
+		stream.sent = events[len(events)-1].Seq
+	}
+	batch := &EventBatch{
+		Subscription: stream.id,
+		Events:       events,
+		Dropped:      stream.dropped,
+	}
+	stream.dropped = 0
+	postMessage(Message{
+		Type: EventMessage,
+		Data: batch,
+	})
+}
+
+// Ack releases the events up to seq and sends what the window allows next
+func (b *EventBus) Ack(id string, seq uint64) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	stream, ok := b.streams[id]
+	if !ok {
+		return fmt.Errorf("subscription %s not found", id)
+	}
+	if seq > stream.seq {
+		seq = stream.seq
+	}
+	if seq <= stream.acked {
+		return nil
+	}
+	stream.acked = seq
+	index := 0
+	for index < len(stream.queue) && stream.queue[index].Seq <= seq {
+		index++
+	}
+	stream.queue = stream.queue[index:]
+	if stream.sent < seq {
+		stream.sent = seq
+	}
+	b.flushLocked(stream)
+	return nil
+}
+
+// Replay returns the retained events after the given seq, used after the listener was rebuilt
+func (b *EventBus) Replay(id string, after uint64) (*EventBatch, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	stream, ok := b.streams[id]
+	if !ok {
+		return nil, fmt.Errorf("subscription %s not found", id)
+	}
+	batch := &EventBatch{
+		Subscription: stream.id,
+		Events:       []Event{},
+	}
+	for _, event := range stream.queue {
+		if event.Seq > after {
+			batch.Events = append(batch.Events, event)
+		}
+	}
+	if len(batch.Events) > 0 && batch.Events[len(batch.Events)-1].Seq > stream.sent {
+		stream.sent = batch.Events[len(batch.Events)-1].Seq
+	}
+	// events past the ack that are no longer retained were evicted
+	start := after
+	if stream.acked > start {
+		start = stream.acked
+	}
+	first := stream.seq + 1
+	if len(stream.queue) > 0 {
+		first = stream.queue[0].Seq
+	}
+	if first > start+1 {
+		batch.Dropped = first - start - 1
+	}
+	return batch, nil
+}
+
+func (b *EventBus) Status() []EventStreamStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	statuses := make([]EventStreamStatus, 0, len(b.streams))
+	for _, stream := range b.streams {
+		statuses = append(statuses, EventStreamStatus{
+			Subscription: stream.id,
+			Topics:       stream.topics,
+			Filter:       stream.filter,
+			Seq:          stream.seq,
+			Acked:        stream.acked,
+			Pending:      len(stream.queue),
+			Dropped:      stream.lost,
+		})
+	}
+	return statuses
+}
+
+// publishTrafficTick sends the current speed once per traffic sample
+func publishTrafficTick() {
+	if !eventBus.Has(TrafficTickTopic) {
+		return
+	}
+	up, down := statistic.DefaultManager.Current(state.CurrentState.OnlyStatisticsProxy)
+	if bridgeEncoding.SkipTraffic(up, down) {
+		return
+	}
+	eventBus.Publish(TrafficTickTopic, map[string]int64{
+		"up":   up,
+		"down": down,
+	})
+}
+
+func handleSubscribeEvents(paramsString string) (string, error) {
+	var params = &EventSubscribeParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return "", err
+	}
+	return eventBus.Subscribe(params)
+}
+
+func handleUnsubscribeEvents(id string) bool {
+	eventBus.Unsubscribe(id)
+	return true
+}
+
+func handleAckEvents(paramsString string) error {
+	var params = &EventAckParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	return eventBus.Ack(params.Subscription, params.Seq)
+}
+
+func handleReplayEvents(paramsString string) (string, error) {
+	var params = &EventReplayParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return "", err
+	}
+	batch, err := eventBus.Replay(params.Subscription, params.After)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func handleGetEventStreams() string {
+	data, err := json.Marshal(eventBus.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/component/resolver"
+	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/tunnel"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type ExplainRouteParams struct {
+	Host        string  `json:"host"`
+	IP          string  `json:"ip"`
+	Port        uint16  `json:"port"`
+	Network     string  `json:"network"`
+	Process     string  `json:"process"`
+	ProcessPath string  `json:"process-path"`
+	Uid         *uint32 `json:"uid"`
+	NoResolve   bool    `json:"no-resolve"`
+}
+
+type ExplainedRule struct {
+	Index       int      `json:"index"`
+	Type        string   `json:"type"`
+	Payload     string   `json:"payload"`
+	Adapter     string   `json:"adapter"`
+	Providers   []string `json:"providers,omitempty"`
+	Compiled    bool     `json:"compiled,omitempty"`
+	SubRules    string   `json:"sub-rules,omitempty"`
+	SkipReason  string   `json:"skip-reason,omitempty"`
+	FoldedIndex *int     `json:"folded-index,omitempty"`
+}
+
+type ChainHop struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// RouteExplanation is what the tunnel would do with a connection of the params, nothing is dialed
+type RouteExplanation struct {
+	Mode     string           `json:"mode"`
+	Host     string           `json:"host"`
+	DstIP    string           `json:"dst-ip,omitempty"`
+	DNSMode  string           `json:"dns-mode"`
+	Resolved bool             `json:"resolved"`
+	Rule     *ExplainedRule   `json:"rule,omitempty"`
+	Path     []*ExplainedRule `json:"path,omitempty"`
+	Skipped  []*ExplainedRule `json:"skipped,omitempty"`
+	Outbound string           `json:"outbound"`
+	Chain    []ChainHop       `json:"chain"`
+	Duration int64            `json:"duration"`
+}
+
+func explainMetadata(params *ExplainRouteParams) (*C.Metadata, error) {
+	metadata := &C.Metadata{
+		NetWork:     C.TCP,
+		Type:        C.INNER,
+		DstPort:     params.Port,
+		Host:        strings.TrimSuffix(params.Host, "."),
+		Process:     params.Process,
+		ProcessPath: params.ProcessPath,
+	}
+	switch strings.ToLower(params.Network) {
+	case "", "tcp":
+	case "udp":
+		metadata.NetWork = C.UDP
+	default:
+		return nil, fmt.Errorf("unknown network %s", params.Network)
+	}
+	if params.IP != "" {
+		ip, err := netip.ParseAddr(params.IP)
+		if err != nil {
+			return nil, err
+		}
+		metadata.DstIP = ip.Unmap()
+	}
+	// the same as the tunnel does with an ip in the host
+	if ip, err := netip.ParseAddr(metadata.Host); err == nil {
+		metadata.DstIP = ip.Unmap()
+		metadata.Host = ""
+	}
+	if metadata.Host == "" && !metadata.DstIP.IsValid() {
+		return nil, errors.New("host or ip is required")
+	}
+	if metadata.Process == "" && metadata.ProcessPath != "" {
+		metadata.Process = filepath.Base(metadata.ProcessPath)
+	}
+	if params.Uid != nil {
+		metadata.Uid = *params.Uid
+	}
+	return metadata, nil
+}
+
+// preHandleExplainMetadata follows the enhanced mode handling of the tunnel
+func preHandleExplainMetadata(metadata *C.Metadata) error {
+	if resolver.MappingEnabled() && metadata.Host == "" && metadata.DstIP.IsValid() {
+		host, exist := resolver.FindHostByIP(metadata.DstIP)
+		if exist {
+			metadata.Host = host
+			metadata.DNSMode = C.DNSMapping
+			if resolver.FakeIPEnabled() {
+				metadata.DstIP = netip.Addr{}
+				metadata.DNSMode = C.DNSFakeIP
+			} else if node, ok := resolver.DefaultHosts.Search(host, false); ok {
+				metadata.DstIP, _ = node.RandIP()
+			} else if node != nil && node.IsDomain {
+				metadata.Host = node.Domain
+			}
+		} else if resolver.IsFakeIP(metadata.DstIP) {
+			return fmt.Errorf("fake DNS record %s missing", metadata.DstIP)
+		}
+	} else if node, ok := resolver.DefaultHosts.Search(metadata.Host, true); ok {
+		metadata.Host = node.Domain
+	}
+	return nil
+}
+
+func explainRule(index int, rule C.Rule, adapter string) *ExplainedRule {
+	explained := &ExplainedRule{
+		Index:     index,
+		Type:      rule.RuleType().String(),
+		Payload:   rule.Payload(),
+		Adapter:   adapter,
+		Providers: rule.ProviderNames(),
+	}
+	for _, name := range explained.Providers {
+		if strings.HasPrefix(name, compiledProviderPrefix) {
+			explained.Compiled = true
+		}
+	}
+	return explained
+}
+
+// explainMatched reports a folded domain run as the original rule that matched
+func explainMatched(index int, rule C.Rule, adapter string, metadata *C.Metadata) *ExplainedRule {
+	if run, ok := rule.(*domainRunRule); ok {
+		if i := run.first(metadata.RuleHost()); i >= 0 {
+			explained := explainRule(index, run.rules[i], adapter)
+			explained.FoldedIndex = &i
+			return explained
+		}
+	}
+	return explainRule(index, rule, adapter)
+}
+
+// explainMatch walks the rules the way the tunnel does and keeps the matches it passed over
+func explainMatch(explanation *RouteExplanation, rules []C.Rule, subRules map[string][]C.Rule, proxies map[string]C.Proxy, metadata *C.Metadata, helper C.RuleMatchHelper) (C.Proxy, *ExplainedRule) {
+	for index, rule := range rules {
+		matched, ada := rule.Match(metadata, helper)
+		if !matched {
+			continue
+		}
+		explained := explainMatched(index, rule, ada, metadata)
+		adapter, ok := proxies[ada]
+		if !ok {
+			explained.SkipReason = fmt.Sprintf("proxy %s not found", ada)
+			explanation.Skipped = append(explanation.Skipped, explained)
+			continue
+		}
+		passed := false
+		for adapter := adapter; adapter != nil; adapter = adapter.Unwrap(metadata, false) {
+			if adapter.Type() == C.Pass {
+				passed = true
+				break
+			}
+		}
+		if passed {
+			explained.SkipReason = "pass"
+			explanation.Skipped = append(explanation.Skipped, explained)
+			continue
+		}
+		if metadata.NetWork == C.UDP && !adapter.SupportUDP() {
+			explained.SkipReason = "udp not supported"
+			explanation.Skipped = append(explanation.Skipped, explained)
+			continue
+		}
+		if rule.RuleType() == C.SubRules {
+			explanation.Path = explainSubRules(rule.Adapter(), subRules, metadata, helper, nil)
+		}
+		return adapter, explained
+	}
+	return proxies["DIRECT"], nil
+}
+
+// explainSubRules finds the rules that decided a SUB-RULE, the logic rule only returns the adapter
+func explainSubRules(name string, subRules map[string][]C.Rule, metadata *C.Metadata, helper C.RuleMatchHelper, path []*ExplainedRule) []*ExplainedRule {
+	if len(path) >= 8 {
+		return path
+	}
+	for index, rule := range subRules[name] {
+		matched, ada := rule.Match(metadata, helper)
+		if !matched {
+			continue
+		}
+		explained := explainMatched(index, rule, ada, metadata)
+		explained.SubRules = name
+		path = append(path, explained)
+		if rule.RuleType() == C.SubRules {
+			return explainSubRules(rule.Adapter(), subRules, metadata, helper, path)
+		}
+		return path
+	}
+	return path
+}
+
+// explainChain follows the groups down to the proxy that would dial
+func explainChain(adapter C.Proxy, metadata *C.Metadata) []ChainHop {
+	chain := []ChainHop{}
+	for hop := adapter; hop != nil && len(chain) < 32; hop = hop.Unwrap(metadata, false) {
+		chain = append(chain, ChainHop{Name: hop.Name(), Type: hop.Type().String()})
+	}
+	return chain
+}
+
+func explainRoute(params *ExplainRouteParams) (*RouteExplanation, error) {
+	metadata, err := explainMetadata(params)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	if err = preHandleExplainMetadata(metadata); err != nil {
+		return nil, err
+	}
+	mode := tunnel.Mode()
+	explanation := &RouteExplanation{
+		Mode: mode.String(),
+	}
+	resolved := false
+	if node, ok := resolver.DefaultHosts.Search(metadata.Host, false); ok {
+		metadata.DstIP, _ = node.RandIP()
+		resolved = true
+	}
+	helper := C.RuleMatchHelper{
+		ResolveIP: func() {
+			if resolved || params.NoResolve || metadata.Host == "" || metadata.Resolved() {
+				return
+			}
+			resolved = true
+			ctx, cancel := context.WithTimeout(context.Background(), resolver.DefaultDNSTimeout)
+			defer cancel()
+			if ip, err := resolver.ResolveIP(ctx, metadata.Host); err == nil {
+				metadata.DstIP = ip
+				explanation.Resolved = true
+			}
+		},
+	}
+	proxies := tunnel.Proxies()
+	var adapter C.Proxy
+	switch mode {
+	case tunnel.Direct:
+		adapter = proxies["DIRECT"]
+	case tunnel.Global:
+		adapter = proxies["GLOBAL"]
+	default:
+		var subRules map[string][]C.Rule
+		runLock.Lock()
+		if currentConfig != nil {
+			subRules = currentConfig.SubRules
+		}
+		runLock.Unlock()
+		adapter, explanation.Rule = explainMatch(explanation, tunnel.Rules(), subRules, proxies, metadata, helper)
+	}
+	if adapter == nil {
+		return nil, errors.New("no outbound for the route")
+	}
+	explanation.Host = metadata.Host
+	if metadata.DstIP.IsValid() {
+		explanation.DstIP = metadata.DstIP.String()
+	}
+	explanation.DNSMode = metadata.DNSMode.String()
+	explanation.Outbound = adapter.Name()
+	explanation.Chain = explainChain(adapter, metadata)
+	explanation.Duration = time.Since(start).Microseconds()
+	return explanation, nil
+}
+
+func handleExplainRoute(paramsString string) (string, error) {
+	var params = &ExplainRouteParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return "", err
+	}
+	explanation, err := explainRoute(params)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(explanation)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/adapter"
+	"github.com/metacubex/mihomo/adapter/outboundgroup"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFailoverProbe     = "www.gstatic.com:443"
+	defaultFailoverInterval  = 30 * time.Second
+	defaultFailoverTimeout   = 5 * time.Second
+	defaultFailoverThreshold = 3
+)
+
+type FailoverParams struct {
+	Groups    []string `json:"groups"`
+	Probe     string   `json:"probe"`
+	TLS       bool     `json:"tls"`
+	Interval  int64    `json:"interval"`
+	Timeout   int64    `json:"timeout"`
+	Threshold int      `json:"threshold"`
+}
+
+// ProxyChanged is emitted when the monitor switches the selection of a group
+type ProxyChanged struct {
+	GroupName string `json:"group-name"`
+	ProxyName string `json:"proxy-name"`
+	Previous  string `json:"previous"`
+	Failures  int    `json:"failures"`
+}
+
+type failoverMonitor struct {
+	mutex    sync.Mutex
+	cancel   context.CancelFunc
+	failures map[string]int
+	seeded   map[string]int
+}
+
+var failover = &failoverMonitor{}
+
+// Start probes the active proxy of each selector group and fails over after consecutive failures
+func (m *failoverMonitor) Start(params FailoverParams) error {
+	if len(params.Groups) == 0 {
+		return errors.New("no groups to monitor")
+	}
+	if params.Probe == "" {
+		params.Probe = defaultFailoverProbe
+	}
+	host, portString, err := net.SplitHostPort(params.Probe)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid probe port %s", portString)
+	}
+	interval := time.Duration(params.Interval) * time.Millisecond
+	if interval <= 0 {
+		interval = defaultFailoverInterval
+	}
+	timeout := time.Duration(params.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultFailoverTimeout
+	}
+	if params.Threshold <= 0 {
+		params.Threshold = defaultFailoverThreshold
+	}
+
+	m.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	m.mutex.Lock()
+	m.cancel = cancel
+	m.failures = map[string]int{}
+	for groupName, failures := range m.seeded {
+		m.failures[groupName] = failures
+	}
+	m.seeded = nil
+	m.mutex.Unlock()
+
+	probe := &constant.Metadata{
+		NetWork: constant.TCP,
+		Host:    host,
+		DstPort: uint16(port),
+	}
+	go func() {
+		ticker := time.NewTicker(powerScaled(interval))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			ticker.Reset(powerScaled(interval))
+			for _, groupName := range params.Groups {
+				runGuarded("failover", func() {
+					m.check(ctx, groupName, probe, params.TLS, timeout, params.Threshold)
+				})
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop ends monitoring
+func (m *failoverMonitor) Stop() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.cancel != nil {
+		m.cancel()
+		m.cancel = nil
+	}
+}
+
+// Failures returns the consecutive probe failures of every monitored group
+func (m *failoverMonitor) Failures() map[string]int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	failures := make(map[string]int, len(m.failures))
+	for groupName, count := range m.failures {
+		failures[groupName] = count
+	}
+	return failures
+}
+
+// Seed carries failure counts over from the previous run, they apply to the running or the next monitor
+func (m *failoverMonitor) Seed(failures map[string]int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.cancel == nil {
+		m.seeded = failures
+		return
+	}
+	for groupName, count := range failures {
+		m.failures[groupName] = count
+	}
+}
+
+func (m *failoverMonitor) check(ctx context.Context, groupName string, probe *constant.Metadata, useTLS bool, timeout time.Duration, threshold int) {
+	proxies := tunnel.ProxiesWithProviders()
+	group, ok := proxies[groupName].(*adapter.Proxy)
+	if !ok {
+		return
+	}
+	selector, ok := group.ProxyAdapter.(*outboundgroup.Selector)
+	if !ok {
+		return
+	}
+	current := selector.Now()
+	proxy, ok := proxies[current]
+	if !ok {
+		return
+	}
+
+	err := probeProxy(ctx, proxy, probe, useTLS, timeout)
+	if ctx.Err() != nil {
+		return
+	}
+	m.mutex.Lock()
+	if err == nil {
+		delete(m.failures, groupName)
+		m.mutex.Unlock()
+		return
+	}
+	m.failures[groupName]++
+	failures := m.failures[groupName]
+	m.mutex.Unlock()
+	log.Warnln("[Failover] %s/%s probe failed (%d/%d): %v", groupName, current, failures, threshold, err)
+	if failures < threshold {
+		return
+	}
+
+	next := nextBestProxy(groupMembers(proxies, groupName), current)
+	if next == "" {
+		return
+	}
+	runLock.Lock()
+	err = selector.Set(next)
+	runLock.Unlock()
+	if err != nil {
+		log.Warnln("[Failover] switch %s to %s failed: %v", groupName, next, err)
+		return
+	}
+	m.mutex.Lock()
+	delete(m.failures, groupName)
+	m.mutex.Unlock()
+	groupStates.Release(groupName)
+	groupStates.Capture()
+	groupStates.Save()
+	log.Infoln("[Failover] %s switched from %s to %s", groupName, current, next)
+	sendMessage(Message{
+		Type: ProxyChangedMessage,
+		Data: ProxyChanged{
+			GroupName: groupName,
+			ProxyName: next,
+			Previous:  current,
+			Failures:  failures,
+		},
+	})
+}
+
+// probeProxy opens a TCP connection through proxy and optionally completes a TLS handshake
+func probeProxy(ctx context.Context, proxy constant.Proxy, probe *constant.Metadata, useTLS bool, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := proxy.DialContext(ctx, probe.Clone())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if !useTLS {
+		return nil
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: probe.Host})
+	return tlsConn.HandshakeContext(ctx)
+}
+
+// nextBestProxy prefers the alive member with the lowest recorded delay, then the next member in order
+func nextBestProxy(members []constant.Proxy, current string) string {
+	best, bestDelay := "", uint16(0)
+	for _, member := range members {
+		if member.Name() == current || !member.AliveForTestUrl(constant.DefaultTestURL) {
+			continue
+		}
+		delay := member.LastDelayForTestUrl(constant.DefaultTestURL)
+		if delay == 0 || delay == 0xffff {
+			continue
+		}
+		if best == "" || delay < bestDelay {
+			best, bestDelay = member.Name(), delay
+		}
+	}
+	if best != "" {
+		return best
+	}
+	for i, member := range members {
+		if member.Name() == current && len(members) > 1 {
+			return members[(i+1)%len(members)].Name()
+		}
+	}
+	return ""
+}
+
+func handleStartFailover(paramsString string) string {
+	var params = FailoverParams{}
+	if err := json.Unmarshal([]byte(paramsString), &params); err != nil {
+		return err.Error()
+	}
+	if err := failover.Start(params); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func handleStopFailover() bool {
+	failover.Stop()
+	return true
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/metacubex/bbolt"
+	"github.com/metacubex/mihomo/component/profile/cachefile"
+	"github.com/metacubex/mihomo/component/resolver"
+	"github.com/metacubex/mihomo/config"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const fakeIpStoreFile = "fakeip.enc"
+
+// fakeIpBucket is the cache file bucket the fake-ip pool keeps its mappings and offset in
+var fakeIpBucket = []byte("fakeip")
+
+type fakeIpRecord struct {
+	Key   []byte `json:"k"`
+	Value []byte `json:"v"`
+}
+
+// FakeIpStore keeps the fake-ip pool in an encrypted file while the core is down
+type FakeIpStore struct {
+	mutex    sync.Mutex
+	enabled  bool
+	restored bool
+}
+
+var fakeIpStore = &FakeIpStore{}
+
+func (s *FakeIpStore) path() string {
+	return constant.Path.Resolve(fakeIpStoreFile)
+}
+
+func (s *FakeIpStore) SetEnabled(enabled bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.enabled = enabled
+	if !enabled {
+		s.restored = false
+		_ = os.Remove(s.path())
+	}
+}
+
+// Prepare makes the pool use the cache file and loads the saved mappings into it once
+func (s *FakeIpStore) Prepare(rawConfig *config.RawConfig) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.enabled {
+		return
+	}
+	rawConfig.Profile.StoreFakeIP = true
+	if s.restored {
+		return
+	}
+	s.restored = true
+	if err := s.restore(); err != nil {
+		log.Warnln("[FakeIP] restore mapping error: %v", err)
+	}
+}
+
+func (s *FakeIpStore) restore() error {
+	data, err := os.ReadFile(s.path())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if getEncryptionService() == nil {
+		return errNoKeyProvider
+	}
+	plain, err := getEncryptionService().Decrypt(data)
+	if err != nil {
+		return err
+	}
+	defer clearBytes(plain)
+	var records []fakeIpRecord
+	if err = json.Unmarshal(plain, &records); err != nil {
+		return err
+	}
+	db := cachefile.Cache().DB
+	if db == nil {
+		return errors.New("cache file is not available")
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if bucket := tx.Bucket(fakeIpBucket); bucket != nil && bucket.Stats().KeyN != 0 {
+			return nil
+		}
+		bucket, err := tx.CreateBucketIfNotExists(fakeIpBucket)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if err = bucket.Put(record.Key, record.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Infoln("[FakeIP] restored %d records", len(records))
+	return nil
+}
+
+// Save writes the current pool to the encrypted file, clear also drops the plaintext copy in the cache file
+func (s *FakeIpStore) Save(clear bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.enabled {
+		return
+	}
+	if err := s.save(clear); err != nil {
+		log.Warnln("[FakeIP] save mapping error: %v", err)
+	}
+	if clear {
+		s.restored = false
+	}
+}
+
+func (s *FakeIpStore) save(clear bool) error {
+	if getEncryptionService() == nil {
+		return errNoKeyProvider
+	}
+	db := cachefile.Cache().DB
+	if db == nil {
+		return nil
+	}
+	var records []fakeIpRecord
+	err := db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(fakeIpBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			records = append(records, fakeIpRecord{
+				Key:   append([]byte{}, k...),
+				Value: append([]byte{}, v...),
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	plain, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	defer clearBytes(plain)
+	data, err := getEncryptionService().Encrypt(plain)
+	if err != nil {
+		return err
+	}
+	path := s.path()
+	if err = os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	if !clear {
+		return nil
+	}
+	return db.Update(func(tx *bbolt.Tx) error {
+		if tx.Bucket(fakeIpBucket) == nil {
+			return nil
+		}
+		return tx.DeleteBucket(fakeIpBucket)
+	})
+}
+
+// Flush clears the live pool and the saved mappings
+func (s *FakeIpStore) Flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := resolver.FlushFakeIP(); err != nil {
+		return err
+	}
+	if err := os.Remove(s.path()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func handleSetFakeIpPersistence(enabledString string) bool {
+	enabled, err := strconv.ParseBool(enabledString)
+	if err != nil {
+		return false
+	}
+	fakeIpStore.SetEnabled(enabled)
+	return true
+}
+
+func handleFlushFakeIp() error {
+	runLock.Lock()
+	defer runLock.Unlock()
+	return fakeIpStore.Flush()
+}
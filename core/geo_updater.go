@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/component/geodata"
+	mihomoHttp "github.com/metacubex/mihomo/component/http"
+	"github.com/metacubex/mihomo/component/mmdb"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"github.com/oschwald/maxminddb-golang"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	geoVersionsFile    = "geo-versions.json"
+	geoDownloadTimeout = 10 * time.Minute
+	maxGeoDatabaseSize = 256 << 20
+)
+
+type UpdateGeoDatabaseParams struct {
+	GeoType string `json:"geo-type"`
+	GeoName string `json:"geo-name"`
+	// Mirrors are tried in order, the configured geox url is used when empty
+	Mirrors []string `json:"mirrors"`
+	SHA256  string   `json:"sha256"`
+	// Checksum validates the download against the .sha256sum file published beside it
+	Checksum bool   `json:"checksum"`
+	Proxy    string `json:"proxy"`
+	Force    bool   `json:"force"`
+}
+
+// GeoDatabaseVersion identifies the installed copy of a database by the validators of its source
+type GeoDatabaseVersion struct {
+	GeoType      string `json:"geo-type"`
+	GeoName      string `json:"geo-name"`
+	Exists       bool   `json:"exists"`
+	Size         int64  `json:"size"`
+	SHA256       string `json:"sha256"`
+	Source       string `json:"source"`
+	ETag         string `json:"etag"`
+	LastModified string `json:"last-modified"`
+	UpdateAt     int64  `json:"update-at"`
+	CheckAt      int64  `json:"check-at"`
+	Age          int64  `json:"age"`
+	// PartialETag is the validator of an interrupted download kept in <name>.part
+	PartialETag string `json:"partial-etag,omitempty"`
+}
+
+type GeoUpdateResult struct {
+	GeoDatabaseVersion
+	Updated bool `json:"updated"`
+}
+
+var (
+	geoVersions     map[string]*GeoDatabaseVersion
+	geoVersionsLock sync.Mutex
+	// geoUpdating serializes downloads, concurrent updates of one file would share the part file
+	geoUpdating sync.Mutex
+)
+
+func defaultGeoUrl(geoType string) (string, error) {
+	switch geoType {
+	case "MMDB":
+		return geodata.MmdbUrl(), nil
+	case "ASN":
+		return geodata.ASNUrl(), nil
+	case "GeoIp":
+		return geodata.GeoIpUrl(), nil
+	case "GeoSite":
+		return geodata.GeoSiteUrl(), nil
+	}
+	return "", fmt.Errorf("unknown geo type %s", geoType)
+}
+
+func loadGeoVersionsLocked() {
+	if geoVersions != nil {
+		return
+	}
+	geoVersions = map[string]*GeoDatabaseVersion{}
+	data, err := os.ReadFile(constant.Path.Resolve(geoVersionsFile))
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &geoVersions); err != nil {
+		log.Warnln("[Geo] invalid %s: %v", geoVersionsFile, err)
+		geoVersions = map[string]*GeoDatabaseVersion{}
+	}
+}
+
+func storeGeoVersion(version GeoDatabaseVersion) {
+	geoVersionsLock.Lock()
+	defer geoVersionsLock.Unlock()
+	loadGeoVersionsLocked()
+	version.Age = 0
+	geoVersions[version.GeoName] = &version
+	data, err := json.Marshal(geoVersions)
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(constant.Path.Resolve(geoVersionsFile), data, 0644); err != nil {
+		log.Warnln("[Geo] save %s failed: %v", geoVersionsFile, err)
+	}
+}
+
+func getGeoVersion(geoType string, geoName string) GeoDatabaseVersion {
+	geoVersionsLock.Lock()
+	loadGeoVersionsLocked()
+	version := GeoDatabaseVersion{GeoType: geoType, GeoName: geoName}
+	if stored, ok := geoVersions[geoName]; ok {
+		version = *stored
+	}
+	geoVersionsLock.Unlock()
+	version.GeoType = geoType
+	if info, err := os.Stat(constant.Path.Resolve(geoName)); err == nil {
+		version.Exists = true
+		version.Size = info.Size()
+		if version.UpdateAt == 0 {
+			version.UpdateAt = info.ModTime().UnixMilli()
+		}
+		version.Age = time.Now().UnixMilli() - version.UpdateAt
+	}
+	return version
+}
+
+// UpdateGeoDatabase downloads a geo database from the first working mirror, it resumes
+// interrupted downloads and only replaces the installed file after validation
+func UpdateGeoDatabase(ctx context.Context, params *UpdateGeoDatabaseParams) (*GeoUpdateResult, error) {
+	if params.GeoName == "" || strings.ContainsAny(params.GeoName, `/\`) {
+		return nil, errors.New("invalid geo name")
+	}
+	mirrors := params.Mirrors
+	if len(mirrors) == 0 {
+		url, err := defaultGeoUrl(params.GeoType)
+		if err != nil {
+			return nil, err
+		}
+		mirrors = []string{url}
+	} else if _, err := defaultGeoUrl(params.GeoType); err != nil {
+		return nil, err
+	}
+
+	geoUpdating.Lock()
+	defer geoUpdating.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, geoDownloadTimeout)
+	defer cancel()
+
+	version := getGeoVersion(params.GeoType, params.GeoName)
+	var errs []string
+	for _, mirror := range mirrors {
+		result, err := updateGeoFromMirror(ctx, params, mirror, version)
+		if err == nil {
+			return result, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		log.Warnln("[Geo] download %s from %s failed: %v", params.GeoName, mirror, err)
+		errs = append(errs, fmt.Sprintf("%s: %v", mirror, err))
+		// the partial file belongs to the failed mirror
+		version = getGeoVersion(params.GeoType, params.GeoName)
+	}
+	return nil, fmt.Errorf("all mirrors failed: %s", strings.Join(errs, "; "))
+}
+
+func updateGeoFromMirror(ctx context.Context, params *UpdateGeoDatabaseParams, mirror string, version GeoDatabaseVersion) (*GeoUpdateResult, error) {
+	path := constant.Path.Resolve(params.GeoName)
+	partPath := path + ".part"
+	var offset int64
+	if info, err := os.Stat(partPath); err == nil && version.Source == mirror && version.PartialETag != "" {
+		offset = info.Size()
+	}
+
+	header := map[string][]string{}
+	if offset > 0 {
+		header["Range"] = []string{"bytes=" + strconv.FormatInt(offset, 10) + "-"}
+		header["If-Range"] = []string{version.PartialETag}
+	} else if version.Exists && version.Source == mirror && !params.Force {
+		if version.ETag != "" {
+			header["If-None-Match"] = []string{version.ETag}
+		}
+		if version.LastModified != "" {
+			header["If-Modified-Since"] = []string{version.LastModified}
+		}
+	}
+	resp, err := mihomoHttp.HttpRequestWithProxy(ctx, mirror, http.MethodGet, header, nil, params.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		version.CheckAt = time.Now().UnixMilli()
+		storeGeoVersion(version)
+		return &GeoUpdateResult{GeoDatabaseVersion: getGeoVersion(params.GeoType, params.GeoName)}, nil
+	case http.StatusPartialContent:
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	case http.StatusOK:
+		offset = 0
+	default:
+		return nil, fmt.Errorf("server responded %s", resp.Status)
+	}
+
+	etag := resp.Header.Get("ETag")
+	version.Source = mirror
+	version.PartialETag = etag
+	storeGeoVersion(version)
+
+	if err := os.MkdirAll(filepath.Dir(partPath), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	written, err := io.Copy(file, io.LimitReader(resp.Body, maxGeoDatabaseSize-offset+1))
+	_ = file.Close()
+	if err != nil {
+		return nil, fmt.Errorf("download interrupted after %d bytes: %v", offset+written, err)
+	}
+	if offset+written > maxGeoDatabaseSize {
+		_ = os.Remove(partPath)
+		return nil, errors.New("geo database exceeds maximum size")
+	}
+
+	data, err := os.ReadFile(partPath)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	if err := checkGeoDigest(ctx, params, mirror, digest); err != nil {
+		_ = os.Remove(partPath)
+		return nil, err
+	}
+	if err := installGeoDatabase(params.GeoType, path, partPath, data); err != nil {
+		_ = os.Remove(partPath)
+		return nil, err
+	}
+
+	now := time.Now().UnixMilli()
+	version.SHA256 = digest
+	version.ETag = etag
+	version.LastModified = resp.Header.Get("Last-Modified")
+	version.PartialETag = ""
+	version.UpdateAt = now
+	version.CheckAt = now
+	storeGeoVersion(version)
+	log.Infoln("[Geo] %s updated from %s", params.GeoName, mirror)
+	return &GeoUpdateResult{
+		GeoDatabaseVersion: getGeoVersion(params.GeoType, params.GeoName),
+		Updated:            true,
+	}, nil
+}
+
+func checkGeoDigest(ctx context.Context, params *UpdateGeoDatabaseParams, mirror string, digest string) error {
+	if params.SHA256 != "" && !strings.EqualFold(params.SHA256, digest) {
+		return fmt.Errorf("sha256 mismatch, expected %s got %s", params.SHA256, digest)
+	}
+	if !params.Checksum {
+		return nil
+	}
+	resp, err := mihomoHttp.HttpRequestWithProxy(ctx, mirror+".sha256sum", http.MethodGet, nil, nil, params.Proxy)
+	if err != nil {
+		return fmt.Errorf("fetch checksum: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch checksum: server responded %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return fmt.Errorf("fetch checksum: %v", err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 || !strings.EqualFold(fields[0], digest) {
+		return errors.New("sha256 mismatch with published checksum")
+	}
+	return nil
+}
+
+// installGeoDatabase validates data with the loader of its type and moves it over the installed file
+func installGeoDatabase(geoType string, path string, partPath string, data []byte) error {
+	switch geoType {
+	case "MMDB", "ASN":
+		instance, err := maxminddb.FromBytes(data)
+		if err != nil {
+			return fmt.Errorf("invalid %s database file: %v", geoType, err)
+		}
+		_ = instance.Close()
+	case "GeoIp", "GeoSite":
+		loader, err := geodata.GetGeoDataLoader("standard")
+		if err != nil {
+			return err
+		}
+		if geoType == "GeoIp" {
+			_, err = loader.LoadIPByBytes(data, "cn")
+		} else {
+			_, err = loader.LoadSiteByBytes(data, "cn")
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s database file: %v", geoType, err)
+		}
+	}
+
+	// mmdb is loaded with mmap, the reader is closed before the file is replaced
+	switch {
+	case geoType == "MMDB" && path == constant.Path.MMDB():
+		if reader := mmdb.IPInstance().Reader; reader != nil {
+			_ = reader.Close()
+		}
+		defer mmdb.ReloadIP()
+	case geoType == "ASN" && path == constant.Path.ASN():
+		if reader := mmdb.ASNInstance().Reader; reader != nil {
+			_ = reader.Close()
+		}
+		defer mmdb.ReloadASN()
+	case geoType == "GeoIp":
+		defer geodata.ClearGeoIPCache()
+	case geoType == "GeoSite":
+		defer geodata.ClearGeoSiteCache()
+	}
+	return os.Rename(partPath, path)
+}
+
+// GetGeoDatabaseVersions reports the installed version and age of every known database
+func GetGeoDatabaseVersions() []GeoDatabaseVersion {
+	databases := map[string]string{
+		filepath.Base(constant.Path.MMDB()):    "MMDB",
+		filepath.Base(constant.Path.ASN()):     "ASN",
+		filepath.Base(constant.Path.GeoIP()):   "GeoIp",
+		filepath.Base(constant.Path.GeoSite()): "GeoSite",
+	}
+	geoVersionsLock.Lock()
+	loadGeoVersionsLocked()
+	for name, version := range geoVersions {
+		databases[name] = version.GeoType
+	}
+	geoVersionsLock.Unlock()
+	versions := make([]GeoDatabaseVersion, 0, len(databases))
+	for name, geoType := range databases {
+		versions = append(versions, getGeoVersion(geoType, name))
+	}
+	return versions
+}
+
+func handleUpdateGeoDatabase(paramsString string, fn func(value string, err error)) {
+	go func() {
+		var params = &UpdateGeoDatabaseParams{}
+		if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+			fn("", err)
+			return
+		}
+		result, err := UpdateGeoDatabase(context.Background(), params)
+		if err != nil {
+			fn("", err)
+			return
+		}
+		data, err := json.Marshal(result)
+		fn(string(data), err)
+	}()
+}
+
+func handleGetGeoDatabaseVersions() string {
+	data, err := json.Marshal(GetGeoDatabaseVersions())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
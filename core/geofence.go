@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/metacubex/mihomo/adapter"
+	"github.com/metacubex/mihomo/component/mmdb"
+	"github.com/metacubex/mihomo/component/resolver"
+	"github.com/metacubex/mihomo/config"
+	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	geofenceKey            = "geofence"
+	nearestGeofenceCode    = "NEAREST"
+	defaultGeofenceTimeout = 5 * time.Second
+	geofenceResolvers      = 16
+)
+
+// geofenceRegions lets an expression name a whole region, nearest falls back to the region of
+// the home country after the country itself
+var geofenceRegions = map[string][]string{
+	"EAST-ASIA":      {"CN", "HK", "MO", "TW", "JP", "KR", "MN"},
+	"SOUTHEAST-ASIA": {"SG", "MY", "TH", "VN", "ID", "PH", "KH", "LA", "MM"},
+	"SOUTH-ASIA":     {"IN", "PK", "BD", "LK", "NP"},
+	"MIDDLE-EAST":    {"AE", "SA", "TR", "IL", "IR", "QA", "KW", "BH", "OM", "JO"},
+	"EUROPE": {"GB", "IE", "DE", "FR", "NL", "BE", "LU", "CH", "AT", "IT", "ES", "PT", "SE", "NO", "FI",
+		"DK", "IS", "PL", "CZ", "SK", "HU", "RO", "BG", "GR", "UA", "LT", "LV", "EE", "RU", "RS", "HR", "SI"},
+	"NORTH-AMERICA": {"US", "CA", "MX"},
+	"SOUTH-AMERICA": {"BR", "AR", "CL", "CO", "PE", "VE", "UY"},
+	"OCEANIA":       {"AU", "NZ"},
+	"AFRICA":        {"ZA", "EG", "NG", "KE", "MA"},
+}
+
+type GeofenceParams struct {
+	HomeCountry string            `json:"home-country"`
+	Groups      map[string]string `json:"groups"`
+}
+
+type GeofenceMember struct {
+	Name    string `json:"name"`
+	Country string `json:"country"`
+	Allowed bool   `json:"allowed"`
+	// Tier is the position of the member in the prefer list, -1 when it is not preferred
+	Tier int `json:"tier"`
+}
+
+type GeofenceGroup struct {
+	Expression string           `json:"expression"`
+	Now        string           `json:"now"`
+	Members    []GeofenceMember `json:"members"`
+}
+
+type GeofenceStatus struct {
+	HomeCountry string                    `json:"home-country"`
+	Groups      map[string]*GeofenceGroup `json:"groups"`
+}
+
+// geofenceSpec is a parsed expression like "exclude CN,RU; prefer nearest", every clause
+// takes countries or regions
+type geofenceSpec struct {
+	expression string
+	include    map[string]bool
+	exclude    map[string]bool
+	prefer     [][]string
+}
+
+func geofenceCodes(list string) []string {
+	var codes []string
+	for _, code := range strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '|'
+	}) {
+		codes = append(codes, strings.ToUpper(code))
+	}
+	return codes
+}
+
+func expandGeofenceCode(code string) []string {
+	if region, ok := geofenceRegions[code]; ok {
+		return region
+	}
+	return []string{code}
+}
+
+func parseGeofence(expression string) (*geofenceSpec, error) {
+	spec := &geofenceSpec{expression: expression}
+	for _, clause := range strings.Split(expression, ";") {
+		clause = strings.TrimSpace(clause)
+		if clause == "" {
+			continue
+		}
+		verb, list, _ := strings.Cut(clause, " ")
+		codes := geofenceCodes(list)
+		if len(codes) == 0 {
+			return nil, fmt.Errorf("geofence clause %q has no country", clause)
+		}
+		switch strings.ToLower(verb) {
+		case "include":
+			if spec.include == nil {
+				spec.include = map[string]bool{}
+			}
+			for _, code := range codes {
+				for _, country := range expandGeofenceCode(code) {
+					spec.include[country] = true
+				}
+			}
+		case "exclude":
+			if spec.exclude == nil {
+				spec.exclude = map[string]bool{}
+			}
+			for _, code := range codes {
+				for _, country := range expandGeofenceCode(code) {
+					spec.exclude[country] = true
+				}
+			}
+		case "prefer":
+			for _, code := range codes {
+				if code == nearestGeofenceCode {
+					spec.prefer = append(spec.prefer, []string{code})
+					continue
+				}
+				spec.prefer = append(spec.prefer, expandGeofenceCode(code))
+			}
+		default:
+			return nil, fmt.Errorf("unknown geofence clause %q", verb)
+		}
+	}
+	return spec, nil
+}
+
+// allowed keeps a member unless its country is excluded or missing from the include list, a node
+// whose country is not known yet only passes when there is no include list
+func (s *geofenceSpec) allowed(country string) bool {
+	if country == "" {
+		return s.include == nil
+	}
+	if s.exclude[country] {
+		return false
+	}
+	return s.include == nil || s.include[country]
+}
+
+func (s *geofenceSpec) tier(country, home string) int {
+	if country == "" {
+		return -1
+	}
+	for i, codes := range s.prefer {
+		for _, code := range codes {
+			if code == nearestGeofenceCode {
+				if home == "" {
+					continue
+				}
+				if country == home {
+					return i
+				}
+				for _, region := range geofenceRegions {
+					if containsString(region, home) && containsString(region, country) {
+						return i
+					}
+				}
+				continue
+			}
+			if code == country {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Geofences filters the members of groups by the country of their server, the servers are
+// resolved when a profile loads and again for the nodes a provider brings later
+type Geofences struct {
+	mutex     sync.Mutex
+	home      string
+	profile   map[string]*geofenceSpec
+	overrides map[string]*geofenceSpec
+	countries map[string]string
+	resolving map[string]bool
+	queue     chan string
+}
+
+var geofences = &Geofences{
+	profile:   map[string]*geofenceSpec{},
+	overrides: map[string]*geofenceSpec{},
+	countries: map[string]string{},
+	resolving: map[string]bool{},
+}
+
+// Prepare takes the geofence key out of the groups of the profile, mihomo does not know it
+func (g *Geofences) Prepare(rawConfig *config.RawConfig) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.profile = map[string]*geofenceSpec{}
+	for _, mapping := range rawConfig.ProxyGroup {
+		name, _ := mapping["name"].(string)
+		expression, ok := mapping[geofenceKey].(string)
+		if !ok {
+			continue
+		}
+		delete(mapping, geofenceKey)
+		spec, err := parseGeofence(expression)
+		if err != nil {
+			log.Warnln("[Geofence] group %s: %v", name, err)
+			continue
+		}
+		g.profile[name] = spec
+	}
+}
+
+func (g *Geofences) specLocked(name string) *geofenceSpec {
+	if spec, ok := g.overrides[name]; ok {
+		return spec
+	}
+	return g.profile[name]
+}
+
+func (g *Geofences) Set(params *GeofenceParams) error {
+	overrides := map[string]*geofenceSpec{}
+	for name, expression := range params.Groups {
+		spec, err := parseGeofence(expression)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		overrides[name] = spec
+	}
+	runLock.Lock()
+	defer runLock.Unlock()
+	g.mutex.Lock()
+	g.home = strings.ToUpper(strings.TrimSpace(params.HomeCountry))
+	g.overrides = overrides
+	g.mutex.Unlock()
+	rewrapOutboundsLocked()
+	return nil
+}
+
+func serverHost(proxy C.Proxy) string {
+	host, _, err := net.SplitHostPort(proxy.Addr())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+func lookupCountry(host string) string {
+	if _, err := os.Stat(C.Path.MMDB()); err != nil {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultGeofenceTimeout)
+	defer cancel()
+	ip, err := resolver.ResolveIPWithResolver(ctx, host, resolver.ProxyServerHostResolver)
+	if err != nil {
+		log.Debugln("[Geofence] resolve %s failed: %v", host, err)
+		return ""
+	}
+	for _, code := range mmdb.IPInstance().LookupCode(ip.AsSlice()) {
+		if len(code) == 2 {
+			return strings.ToUpper(code)
+		}
+	}
+	return ""
+}
+
+// country returns the country of a server, an unknown server is queued for the resolver
+func (g *Geofences) country(host string) string {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	country, ok := g.countries[host]
+	if !ok && !g.resolving[host] {
+		g.resolving[host] = true
+		if g.queue == nil {
+			g.queue = make(chan string, 1024)
+			for i := 0; i < geofenceResolvers; i++ {
+				go g.resolveLoop()
+			}
+		}
+		select {
+		case g.queue <- host:
+		default:
+			delete(g.resolving, host)
+		}
+	}
+	return country
+}
+
+func (g *Geofences) resolveLoop() {
+	for host := range g.queue {
+		country := lookupCountry(host)
+		g.mutex.Lock()
+		g.countries[host] = country
+		delete(g.resolving, host)
+		g.mutex.Unlock()
+	}
+}
+
+// Resolve queues the servers of all nodes after a profile loaded so the groups are filtered by
+// the time they are used
+func (g *Geofences) Resolve() {
+	g.mutex.Lock()
+	if len(g.profile) == 0 && len(g.overrides) == 0 {
+		g.mutex.Unlock()
+		return
+	}
+	g.mutex.Unlock()
+	for _, proxy := range tunnel.ProxiesWithProviders() {
+		if host := serverHost(proxy); host != "" {
+			g.country(host)
+		}
+	}
+}
+
+func (g *Geofences) wrap(name string, proxy C.ProxyAdapter) C.ProxyAdapter {
+	if _, ok := unwrapAdapter(proxy).(interface{ GetProxies(touch bool) []C.Proxy }); !ok {
+		return proxy
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	spec := g.specLocked(name)
+	if spec == nil {
+		return proxy
+	}
+	return &geofenceAdapter{ProxyAdapter: proxy, spec: spec}
+}
+
+func (g *Geofences) Status() *GeofenceStatus {
+	g.mutex.Lock()
+	status := &GeofenceStatus{HomeCountry: g.home, Groups: map[string]*GeofenceGroup{}}
+	g.mutex.Unlock()
+	for name, proxy := range tunnel.Proxies() {
+		outbound, ok := proxy.(*adapter.Proxy)
+		if !ok {
+			continue
+		}
+		wrapped, ok := findWrapped[*geofenceAdapter](outbound.ProxyAdapter)
+		if !ok {
+			continue
+		}
+		group := &GeofenceGroup{Expression: wrapped.spec.expression, Members: []GeofenceMember{}}
+		for _, member := range wrapped.members(false) {
+			country, allowed, tier := wrapped.classify(member)
+			group.Members = append(group.Members, GeofenceMember{
+				Name:    member.Name(),
+				Country: country,
+				Allowed: allowed,
+				Tier:    tier,
+			})
+		}
+		if now := wrapped.pick(nil, false); now != nil {
+			group.Now = now.Name()
+		}
+		status.Groups[name] = group
+	}
+	return status
+}
+
+type geofenceAdapter struct {
+	C.ProxyAdapter
+	spec *geofenceSpec
+}
+
+func (a *geofenceAdapter) Inner() C.ProxyAdapter {
+	return a.ProxyAdapter
+}
+
+func (a *geofenceAdapter) members(touch bool) []C.Proxy {
+	return groupProxies(a.ProxyAdapter, touch)
+}
+
+// classify returns the country of a member and where it stands, members without a server such
+// as nested groups are always allowed
+func (a *geofenceAdapter) classify(member C.Proxy) (string, bool, int) {
+	host := serverHost(member)
+	if host == "" {
+		return "", true, -1
+	}
+	country := geofences.country(host)
+	geofences.mutex.Lock()
+	home := geofences.home
+	geofences.mutex.Unlock()
+	return country, a.spec.allowed(country), a.spec.tier(country, home)
+}
+
+// GetProxies returns the allowed members, the best preferred tier with an alive member first
+func (a *geofenceAdapter) GetProxies(touch bool) []C.Proxy {
+	members := a.members(touch)
+	testUrl := groupTestUrl(a.ProxyAdapter)
+	allowed := make([]C.Proxy, 0, len(members))
+	tiers := make([]int, 0, len(members))
+	best := -1
+	for _, member := range members {
+		_, ok, tier := a.classify(member)
+		if !ok {
+			continue
+		}
+		allowed = append(allowed, member)
+		tiers = append(tiers, tier)
+		if tier >= 0 && (best < 0 || tier < best) && member.AliveForTestUrl(testUrl) {
+			best = tier
+		}
+	}
+	if best < 0 {
+		return allowed
+	}
+	preferred := make([]C.Proxy, 0, len(allowed))
+	for i, member := range allowed {
+		if tiers[i] == best {
+			preferred = append(preferred, member)
+		}
+	}
+	return preferred
+}
+
+// pick keeps the choice of the group when the geofence allows it
+func (a *geofenceAdapter) pick(metadata *C.Metadata, touch bool) C.Proxy {
+	return pickGroupMember(a.ProxyAdapter, a.GetProxies(touch), metadata, touch)
+}
+
+func (a *geofenceAdapter) Unwrap(metadata *C.Metadata, touch bool) C.Proxy {
+	if proxy := a.pick(metadata, touch); proxy != nil {
+		return proxy
+	}
+	return a.ProxyAdapter.Unwrap(metadata, touch)
+}
+
+func (a *geofenceAdapter) DialContext(ctx context.Context, metadata *C.Metadata) (C.Conn, error) {
+	proxy := a.pick(metadata, true)
+	if proxy == nil {
+		return a.ProxyAdapter.DialContext(ctx, metadata)
+	}
+	conn, err := proxy.DialContext(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+	conn.AppendToChains(a)
+	return conn, nil
+}
+
+func (a *geofenceAdapter) ListenPacketContext(ctx context.Context, metadata *C.Metadata) (C.PacketConn, error) {
+	proxy := a.pick(metadata, true)
+	if proxy == nil {
+		return a.ProxyAdapter.ListenPacketContext(ctx, metadata)
+	}
+	pc, err := proxy.ListenPacketContext(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+	pc.AppendToChains(a)
+	return pc, nil
+}
+
+func (a *geofenceAdapter) MarshalJSON() ([]byte, error) {
+	data, err := a.ProxyAdapter.MarshalJSON()
+	if err != nil {
+		return data, err
+	}
+	mapping := map[string]any{}
+	_ = json.Unmarshal(data, &mapping)
+	all := []string{}
+	for _, member := range a.members(false) {
+		if _, ok, _ := a.classify(member); ok {
+			all = append(all, member.Name())
+		}
+	}
+	// a selector still lists every allowed member, the preference only drives the pick
+	mapping["all"] = all
+	if now := a.pick(nil, false); now != nil {
+		mapping["now"] = now.Name()
+	}
+	mapping["geofence"] = a.spec.expression
+	return json.Marshal(mapping)
+}
+
+func handleSetGeofence(paramsString string) error {
+	var params = &GeofenceParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	return geofences.Set(params)
+}
+
+func handleGetGeofence() string {
+	data, err := json.Marshal(geofences.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
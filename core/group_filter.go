@@ -0,0 +1,675 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/metacubex/mihomo/adapter"
+	"github.com/metacubex/mihomo/config"
+	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	groupFilterKey = "filter-expression"
+	// dynamicFilterTTL bounds how long the members of an expression on delay, alive or country
+	// are reused, expressions on static fields are only evaluated again when the members change
+	dynamicFilterTTL = 5 * time.Second
+)
+
+type GroupFilterParams struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+}
+
+type GroupFilterStatus struct {
+	Expression string   `json:"expression"`
+	Total      int      `json:"total"`
+	Matched    []string `json:"matched"`
+}
+
+type filterSubject struct {
+	proxy   C.Proxy
+	testUrl string
+}
+
+func (s *filterSubject) text(field string) string {
+	switch field {
+	case "name":
+		return s.proxy.Name()
+	case "type":
+		return strings.ToLower(s.proxy.Type().String())
+	case "server":
+		return serverHost(s.proxy)
+	case "country":
+		if host := serverHost(s.proxy); host != "" {
+			return geofences.country(host)
+		}
+	}
+	return ""
+}
+
+func (s *filterSubject) number(field string) float64 {
+	switch field {
+	case "delay":
+		// a member that is not alive has the largest delay so bounds leave it out
+		return float64(s.proxy.LastDelayForTestUrl(s.testUrl))
+	case "port":
+		_, port, _ := net.SplitHostPort(s.proxy.Addr())
+		value, _ := strconv.Atoi(port)
+		return float64(value)
+	}
+	return 0
+}
+
+func (s *filterSubject) flag(field string) bool {
+	switch field {
+	case "udp":
+		return s.proxy.SupportUDP()
+	case "alive":
+		return s.proxy.AliveForTestUrl(s.testUrl)
+	}
+	return false
+}
+
+type filterFieldKind int
+
+const (
+	textFilterField filterFieldKind = iota
+	numberFilterField
+	flagFilterField
+)
+
+var filterFields = map[string]filterFieldKind{
+	"name":    textFilterField,
+	"type":    textFilterField,
+	"server":  textFilterField,
+	"country": textFilterField,
+	"delay":   numberFilterField,
+	"port":    numberFilterField,
+	"udp":     flagFilterField,
+	"alive":   flagFilterField,
+}
+
+var dynamicFilterFields = map[string]bool{"delay": true, "alive": true, "country": true}
+
+type filterNode interface {
+	eval(subject *filterSubject) bool
+}
+
+type filterAnd struct{ left, right filterNode }
+
+func (n *filterAnd) eval(subject *filterSubject) bool {
+	return n.left.eval(subject) && n.right.eval(subject)
+}
+
+type filterOr struct{ left, right filterNode }
+
+func (n *filterOr) eval(subject *filterSubject) bool {
+	return n.left.eval(subject) || n.right.eval(subject)
+}
+
+type filterNot struct{ node filterNode }
+
+func (n *filterNot) eval(subject *filterSubject) bool {
+	return !n.node.eval(subject)
+}
+
+type filterFlag struct {
+	field string
+	value bool
+}
+
+func (n *filterFlag) eval(subject *filterSubject) bool {
+	return subject.flag(n.field) == n.value
+}
+
+type filterText struct {
+	field  string
+	op     string
+	values []string
+	regexp *regexp.Regexp
+}
+
+func (n *filterText) eval(subject *filterSubject) bool {
+	value := subject.text(n.field)
+	switch n.op {
+	case "=~":
+		return n.regexp.MatchString(value)
+	case "!~":
+		return !n.regexp.MatchString(value)
+	case "!=":
+		return !strings.EqualFold(value, n.values[0])
+	}
+	for _, candidate := range n.values {
+		if strings.EqualFold(value, candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+type filterNumber struct {
+	field  string
+	op     string
+	values []float64
+}
+
+func (n *filterNumber) eval(subject *filterSubject) bool {
+	value := subject.number(n.field)
+	switch n.op {
+	case "<":
+		return value < n.values[0]
+	case "<=":
+		return value <= n.values[0]
+	case ">":
+		return value > n.values[0]
+	case ">=":
+		return value >= n.values[0]
+	case "!=":
+		return value != n.values[0]
+	}
+	for _, candidate := range n.values {
+		if value == candidate {
+			return true
+		}
+	}
+	return false
+}
+
+type filterToken struct {
+	kind  string
+	value string
+	pos   int
+}
+
+func lexFilter(source string) ([]filterToken, error) {
+	var tokens []filterToken
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"' || r == '\'':
+			var builder strings.Builder
+			j := i + 1
+			for ; j < len(runes) && runes[j] != r; j++ {
+				if runes[j] == '\\' && j+1 < len(runes) && (runes[j+1] == r || runes[j+1] == '\\') {
+					j++
+				}
+				builder.WriteRune(runes[j])
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, filterToken{kind: "string", value: builder.String(), pos: i})
+			i = j + 1
+		case unicode.IsDigit(r):
+			j := i
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, filterToken{kind: "number", value: string(runes[i:j]), pos: i})
+			i = j
+		case unicode.IsLetter(r) || r == '_':
+			j := i
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_' || runes[j] == '-') {
+				j++
+			}
+			word := string(runes[i:j])
+			switch strings.ToLower(word) {
+			case "and":
+				tokens = append(tokens, filterToken{kind: "&&", pos: i})
+			case "or":
+				tokens = append(tokens, filterToken{kind: "||", pos: i})
+			case "not":
+				tokens = append(tokens, filterToken{kind: "!", pos: i})
+			default:
+				tokens = append(tokens, filterToken{kind: "ident", value: word, pos: i})
+			}
+			i = j
+		default:
+			if i+1 < len(runes) {
+				switch op := string(runes[i : i+2]); op {
+				case "&&", "||", "==", "!=", "=~", "!~", "<=", ">=":
+					tokens = append(tokens, filterToken{kind: op, pos: i})
+					i += 2
+					continue
+				}
+			}
+			switch r {
+			case '!', '(', ')', ',', '<', '>':
+				tokens = append(tokens, filterToken{kind: string(r), pos: i})
+				i++
+			case '=':
+				tokens = append(tokens, filterToken{kind: "==", pos: i})
+				i++
+			default:
+				return nil, fmt.Errorf("unexpected %q at %d", r, i)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens  []filterToken
+	index   int
+	end     int
+	dynamic bool
+}
+
+func (p *filterParser) peek() filterToken {
+	if p.index < len(p.tokens) {
+		return p.tokens[p.index]
+	}
+	return filterToken{kind: "end", pos: p.end}
+}
+
+func (p *filterParser) next() filterToken {
+	token := p.peek()
+	if p.index < len(p.tokens) {
+		p.index++
+	}
+	return token
+}
+
+func (p *filterParser) expect(kind string) error {
+	if token := p.next(); token.kind != kind {
+		return fmt.Errorf("expected %s at %d", kind, token.pos)
+	}
+	return nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterOr{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == "&&" {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterAnd{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	switch p.peek().kind {
+	case "!":
+		p.next()
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &filterNot{node: node}, nil
+	case "(":
+		p.next()
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expect(")")
+	}
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseValues() ([]filterToken, error) {
+	if p.peek().kind != "(" {
+		token := p.next()
+		if token.kind != "string" && token.kind != "number" && token.kind != "ident" {
+			return nil, fmt.Errorf("expected a value at %d", token.pos)
+		}
+		return []filterToken{token}, nil
+	}
+	p.next()
+	var values []filterToken
+	for {
+		token := p.next()
+		if token.kind != "string" && token.kind != "number" && token.kind != "ident" {
+			return nil, fmt.Errorf("expected a value at %d", token.pos)
+		}
+		values = append(values, token)
+		if p.peek().kind == "," {
+			p.next()
+			continue
+		}
+		return values, p.expect(")")
+	}
+}
+
+func (p *filterParser) parseComparison() (filterNode, error) {
+	token := p.next()
+	if token.kind != "ident" {
+		return nil, fmt.Errorf("expected a field at %d", token.pos)
+	}
+	field := strings.ToLower(token.value)
+	kind, ok := filterFields[field]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %s at %d", token.value, token.pos)
+	}
+	p.dynamic = p.dynamic || dynamicFilterFields[field]
+	op := p.peek()
+	if kind == flagFilterField {
+		switch op.kind {
+		case "==", "!=":
+			p.next()
+			value := p.next()
+			flag := strings.ToLower(value.value)
+			if value.kind != "ident" || flag != "true" && flag != "false" {
+				return nil, fmt.Errorf("expected true or false at %d", value.pos)
+			}
+			return &filterFlag{field: field, value: (flag == "true") == (op.kind == "==")}, nil
+		}
+		return &filterFlag{field: field, value: true}, nil
+	}
+	p.next()
+	if op.kind == "ident" && strings.ToLower(op.value) == "in" {
+		op.kind = "in"
+	}
+	switch op.kind {
+	case "==", "!=", "in":
+	case "=~", "!~":
+		if kind != textFilterField {
+			return nil, fmt.Errorf("%s does not take a pattern at %d", field, op.pos)
+		}
+	case "<", "<=", ">", ">=":
+		if kind != numberFilterField {
+			return nil, fmt.Errorf("%s is not a number at %d", field, op.pos)
+		}
+	default:
+		return nil, fmt.Errorf("expected an operator after %s at %d", field, op.pos)
+	}
+	values, err := p.parseValues()
+	if err != nil {
+		return nil, err
+	}
+	if op.kind != "in" && len(values) != 1 {
+		return nil, fmt.Errorf("%s takes a single value at %d", op.kind, op.pos)
+	}
+	if kind == numberFilterField {
+		node := &filterNumber{field: field, op: op.kind}
+		for _, value := range values {
+			number, err := strconv.ParseFloat(value.value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("expected a number at %d", value.pos)
+			}
+			node.values = append(node.values, number)
+		}
+		return node, nil
+	}
+	node := &filterText{field: field, op: op.kind}
+	for _, value := range values {
+		node.values = append(node.values, value.value)
+	}
+	if op.kind == "=~" || op.kind == "!~" {
+		if node.regexp, err = regexp.Compile(node.values[0]); err != nil {
+			return nil, fmt.Errorf("invalid pattern at %d: %v", values[0].pos, err)
+		}
+	}
+	return node, nil
+}
+
+// filterExpression is a compiled expression like
+// name =~ "HK|JP" && !(type in (ss, ssr)) && udp && delay < 300
+type filterExpression struct {
+	source  string
+	root    filterNode
+	dynamic bool
+}
+
+func parseFilterExpression(source string) (*filterExpression, error) {
+	tokens, err := lexFilter(source)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty filter expression")
+	}
+	parser := &filterParser{tokens: tokens, end: len([]rune(source))}
+	root, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token := parser.peek(); token.kind != "end" {
+		return nil, fmt.Errorf("unexpected %s at %d", token.kind, token.pos)
+	}
+	return &filterExpression{source: source, root: root, dynamic: parser.dynamic}, nil
+}
+
+func (e *filterExpression) match(proxy C.Proxy, testUrl string) bool {
+	return e.root.eval(&filterSubject{proxy: proxy, testUrl: testUrl})
+}
+
+// GroupFilters keeps the filter expressions of the groups, a profile sets them with the
+// filter-expression key and the app may replace them until the next profile
+type GroupFilters struct {
+	mutex     sync.Mutex
+	profile   map[string]*filterExpression
+	overrides map[string]*filterExpression
+}
+
+var groupFilters = &GroupFilters{
+	profile:   map[string]*filterExpression{},
+	overrides: map[string]*filterExpression{},
+}
+
+func (f *GroupFilters) Prepare(rawConfig *config.RawConfig) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.profile = map[string]*filterExpression{}
+	f.overrides = map[string]*filterExpression{}
+	for _, mapping := range rawConfig.ProxyGroup {
+		name, _ := mapping["name"].(string)
+		source, ok := mapping[groupFilterKey].(string)
+		if !ok {
+			continue
+		}
+		delete(mapping, groupFilterKey)
+		expression, err := parseFilterExpression(source)
+		if err != nil {
+			log.Warnln("[GroupFilter] group %s: %v", name, err)
+			continue
+		}
+		f.profile[name] = expression
+	}
+}
+
+// Set replaces the expression of a group, an empty expression goes back to the profile
+func (f *GroupFilters) Set(params *GroupFilterParams) error {
+	var expression *filterExpression
+	if strings.TrimSpace(params.Expression) != "" {
+		var err error
+		if expression, err = parseFilterExpression(params.Expression); err != nil {
+			return err
+		}
+	}
+	runLock.Lock()
+	defer runLock.Unlock()
+	if _, ok := tunnel.Proxies()[params.Name]; !ok {
+		return fmt.Errorf("group %s not found", params.Name)
+	}
+	f.mutex.Lock()
+	if expression == nil {
+		delete(f.overrides, params.Name)
+	} else {
+		f.overrides[params.Name] = expression
+	}
+	f.mutex.Unlock()
+	rewrapOutboundsLocked()
+	return nil
+}
+
+func (f *GroupFilters) wrap(name string, proxy C.ProxyAdapter) C.ProxyAdapter {
+	if _, ok := unwrapAdapter(proxy).(interface{ GetProxies(touch bool) []C.Proxy }); !ok {
+		return proxy
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	expression, ok := f.overrides[name]
+	if !ok {
+		expression = f.profile[name]
+	}
+	if expression == nil {
+		return proxy
+	}
+	return &filterAdapter{ProxyAdapter: proxy, expression: expression}
+}
+
+func (f *GroupFilters) Status() map[string]*GroupFilterStatus {
+	status := map[string]*GroupFilterStatus{}
+	for name, proxy := range tunnel.Proxies() {
+		outbound, ok := proxy.(*adapter.Proxy)
+		if !ok {
+			continue
+		}
+		wrapped, ok := findWrapped[*filterAdapter](outbound.ProxyAdapter)
+		if !ok {
+			continue
+		}
+		group := &GroupFilterStatus{
+			Expression: wrapped.expression.source,
+			Total:      len(groupProxies(wrapped.ProxyAdapter, false)),
+			Matched:    []string{},
+		}
+		for _, member := range wrapped.GetProxies(false) {
+			group.Matched = append(group.Matched, member.Name())
+		}
+		status[name] = group
+	}
+	return status
+}
+
+// filterAdapter narrows a group to the members matching its expression, the result is cached
+// by the member names so nodes a provider brings are evaluated as soon as they show up
+type filterAdapter struct {
+	C.ProxyAdapter
+	expression *filterExpression
+	mutex      sync.Mutex
+	key        string
+	at         time.Time
+	matched    []C.Proxy
+}
+
+func (a *filterAdapter) Inner() C.ProxyAdapter {
+	return a.ProxyAdapter
+}
+
+func (a *filterAdapter) GetProxies(touch bool) []C.Proxy {
+	members := groupProxies(a.ProxyAdapter, touch)
+	var key strings.Builder
+	for _, member := range members {
+		key.WriteString(member.Name())
+		key.WriteByte(0)
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if key.String() == a.key && (!a.expression.dynamic || time.Since(a.at) < dynamicFilterTTL) {
+		return a.matched
+	}
+	testUrl := groupTestUrl(a.ProxyAdapter)
+	matched := make([]C.Proxy, 0, len(members))
+	for _, member := range members {
+		if a.expression.match(member, testUrl) {
+			matched = append(matched, member)
+		}
+	}
+	a.key, a.at, a.matched = key.String(), time.Now(), matched
+	return matched
+}
+
+func (a *filterAdapter) Unwrap(metadata *C.Metadata, touch bool) C.Proxy {
+	if proxy := pickGroupMember(a.ProxyAdapter, a.GetProxies(touch), metadata, touch); proxy != nil {
+		return proxy
+	}
+	return a.ProxyAdapter.Unwrap(metadata, touch)
+}
+
+func (a *filterAdapter) DialContext(ctx context.Context, metadata *C.Metadata) (C.Conn, error) {
+	proxy := pickGroupMember(a.ProxyAdapter, a.GetProxies(true), metadata, true)
+	if proxy == nil {
+		return nil, fmt.Errorf("no member of %s matches %s", a.Name(), a.expression.source)
+	}
+	conn, err := proxy.DialContext(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+	conn.AppendToChains(a)
+	return conn, nil
+}
+
+func (a *filterAdapter) ListenPacketContext(ctx context.Context, metadata *C.Metadata) (C.PacketConn, error) {
+	proxy := pickGroupMember(a.ProxyAdapter, a.GetProxies(true), metadata, true)
+	if proxy == nil {
+		return nil, fmt.Errorf("no member of %s matches %s", a.Name(), a.expression.source)
+	}
+	pc, err := proxy.ListenPacketContext(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+	pc.AppendToChains(a)
+	return pc, nil
+}
+
+func (a *filterAdapter) MarshalJSON() ([]byte, error) {
+	data, err := a.ProxyAdapter.MarshalJSON()
+	if err != nil {
+		return data, err
+	}
+	mapping := map[string]any{}
+	_ = json.Unmarshal(data, &mapping)
+	all := []string{}
+	for _, member := range a.GetProxies(false) {
+		all = append(all, member.Name())
+	}
+	mapping["all"] = all
+	if now := a.Unwrap(nil, false); now != nil {
+		mapping["now"] = now.Name()
+	}
+	mapping[groupFilterKey] = a.expression.source
+	return json.Marshal(mapping)
+}
+
+func handleSetGroupFilter(paramsString string) error {
+	var params = &GroupFilterParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	return groupFilters.Set(params)
+}
+
+func handleGetGroupFilters() string {
+	data, err := json.Marshal(groupFilters.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/metacubex/mihomo/adapter"
+	"github.com/metacubex/mihomo/adapter/outboundgroup"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	groupStateFile = "groups.enc"
+
+	// groupWinnerHold is how long a restored winner is pinned while the first health checks run
+	groupWinnerHold     = 2 * time.Minute
+	groupWinnerInterval = 2 * time.Second
+)
+
+// GroupState is what a profile's groups looked like when it was last active
+type GroupState struct {
+	Selected map[string]string `json:"selected"`
+	Fixed    map[string]string `json:"fixed"`
+	Winners  map[string]string `json:"winners"`
+	Failures map[string]int    `json:"failures"`
+	Updated  int64             `json:"updated"`
+}
+
+type groupSnapshot struct {
+	Type    string `json:"type"`
+	Now     string `json:"now"`
+	Fixed   string `json:"fixed"`
+	TestUrl string `json:"testUrl"`
+}
+
+// GroupStateStore keeps the group state of every profile in an encrypted file
+type GroupStateStore struct {
+	mutex   sync.Mutex
+	enabled bool
+	loaded  bool
+	dirty   bool
+	profile string
+	states  map[string]*GroupState
+	holds   map[string]time.Time
+}
+
+var groupStates = &GroupStateStore{
+	enabled: true,
+	states:  map[string]*GroupState{},
+	holds:   map[string]time.Time{},
+}
+
+func (s *GroupStateStore) path() string {
+	return constant.Path.Resolve(groupStateFile)
+}
+
+func (s *GroupStateStore) SetEnabled(enabled bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.enabled = enabled
+	if !enabled {
+		s.states = map[string]*GroupState{}
+		s.loaded = false
+		s.dirty = false
+		_ = os.Remove(s.path())
+	}
+}
+
+func (s *GroupStateStore) loadLocked() {
+	if s.loaded || !isInit {
+		return
+	}
+	s.loaded = true
+	data, err := os.ReadFile(s.path())
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil && getEncryptionService() == nil {
+		err = errNoKeyProvider
+	}
+	var plain []byte
+	if err == nil {
+		plain, err = getEncryptionService().Decrypt(data)
+	}
+	if err == nil {
+		defer clearBytes(plain)
+		err = json.Unmarshal(plain, &s.states)
+	}
+	if err != nil {
+		log.Warnln("[GroupState] load error: %v", err)
+		s.states = map[string]*GroupState{}
+	}
+}
+
+func (s *GroupStateStore) saveLocked() error {
+	if getEncryptionService() == nil {
+		return errNoKeyProvider
+	}
+	plain, err := json.Marshal(s.states)
+	if err != nil {
+		return err
+	}
+	defer clearBytes(plain)
+	data, err := getEncryptionService().Encrypt(plain)
+	if err != nil {
+		return err
+	}
+	path := s.path()
+	if err = os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+func snapshotGroup(proxy constant.Proxy) (*groupSnapshot, bool) {
+	outbound, ok := proxy.(*adapter.Proxy)
+	if !ok {
+		return nil, false
+	}
+	switch outbound.ProxyAdapter.(type) {
+	case *outboundgroup.Selector, *outboundgroup.URLTest, *outboundgroup.Fallback:
+	default:
+		return nil, false
+	}
+	data, err := outbound.MarshalJSON()
+	if err != nil {
+		return nil, false
+	}
+	snapshot := &groupSnapshot{}
+	if json.Unmarshal(data, snapshot) != nil {
+		return nil, false
+	}
+	return snapshot, true
+}
+
+// Capture records the groups of the active profile, the caller holds runLock
+func (s *GroupStateStore) Capture() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.enabled || s.profile == "" {
+		return
+	}
+	s.loadLocked()
+	state := &GroupState{
+		Selected: map[string]string{},
+		Fixed:    map[string]string{},
+		Winners:  map[string]string{},
+		Failures: failover.Failures(),
+		Updated:  time.Now().UnixMilli(),
+	}
+	for name, proxy := range tunnel.ProxiesWithProviders() {
+		snapshot, ok := snapshotGroup(proxy)
+		if !ok {
+			continue
+		}
+		if snapshot.Type == constant.Selector.String() {
+			state.Selected[name] = snapshot.Now
+			continue
+		}
+		if _, held := s.holds[name]; held {
+			// still pinned by a restore, keep what was saved before
+			if previous, ok := s.states[s.profile]; ok {
+				if winner, ok := previous.Winners[name]; ok {
+					state.Winners[name] = winner
+				}
+			}
+			continue
+		}
+		if snapshot.Fixed != "" {
+			state.Fixed[name] = snapshot.Fixed
+		} else if snapshot.Now != "" {
+			state.Winners[name] = snapshot.Now
+		}
+	}
+	s.states[s.profile] = state
+	s.dirty = true
+}
+
+// Switch captures the outgoing profile before a setup replaces its groups
+func (s *GroupStateStore) Switch(profile string) {
+	s.Capture()
+	s.mutex.Lock()
+	s.profile = profile
+	s.holds = map[string]time.Time{}
+	s.mutex.Unlock()
+}
+
+// Restore applies the saved state of the active profile, the caller holds runLock
+func (s *GroupStateStore) Restore() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.enabled || s.profile == "" {
+		return
+	}
+	s.loadLocked()
+	state, ok := s.states[s.profile]
+	if !ok {
+		return
+	}
+	restored := 0
+	proxies := tunnel.ProxiesWithProviders()
+	for name, proxy := range proxies {
+		outbound, ok := proxy.(*adapter.Proxy)
+		if !ok {
+			continue
+		}
+		selector, ok := outbound.ProxyAdapter.(outboundgroup.SelectAble)
+		if !ok {
+			continue
+		}
+		_, isSelector := selector.(*outboundgroup.Selector)
+		target, hold := state.Selected[name], false
+		if !isSelector {
+			target = state.Fixed[name]
+			if target == "" {
+				target, hold = state.Winners[name], true
+			}
+		}
+		// ForceSet skips the probe a fallback Set runs, so the membership is checked here
+		if target == "" || !hasGroupMember(proxies, name, target) {
+			continue
+		}
+		selector.ForceSet(target)
+		if hold {
+			s.holds[name] = time.Now()
+		}
+		restored++
+	}
+	failover.Seed(state.Failures)
+	if len(s.holds) != 0 {
+		go s.release(s.profile)
+	}
+	log.Infoln("[GroupState] restored %d groups of %s", restored, s.profile)
+}
+
+func hasGroupMember(proxies map[string]constant.Proxy, name string, member string) bool {
+	for _, proxy := range groupMembers(proxies, name) {
+		if proxy.Name() == member {
+			return true
+		}
+	}
+	return false
+}
+
+// release hands the pinned url-test and fallback groups back to their own selection after their first health check
+func (s *GroupStateStore) release(profile string) {
+	ticker := time.NewTicker(groupWinnerInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mutex.Lock()
+		if s.profile != profile || len(s.holds) == 0 {
+			s.mutex.Unlock()
+			return
+		}
+		proxies := tunnel.ProxiesWithProviders()
+		for name, since := range s.holds {
+			outbound, ok := proxies[name].(*adapter.Proxy)
+			if !ok {
+				delete(s.holds, name)
+				continue
+			}
+			snapshot, ok := snapshotGroup(outbound)
+			if !ok {
+				delete(s.holds, name)
+				continue
+			}
+			tested := false
+			for _, member := range groupMembers(proxies, name) {
+				if len(member.DelayHistory()) != 0 || len(member.ExtraDelayHistories()[snapshot.TestUrl].History) != 0 {
+					tested = true
+					break
+				}
+			}
+			if !tested && time.Since(since) < groupWinnerHold {
+				continue
+			}
+			delete(s.holds, name)
+			if selector, ok := outbound.ProxyAdapter.(outboundgroup.SelectAble); ok {
+				selector.ForceSet("")
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// Release stops pinning a group, called when the user picks a proxy
+func (s *GroupStateStore) Release(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.holds, name)
+}
+
+// Save writes the captured state to disk
+func (s *GroupStateStore) Save() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.enabled || !s.dirty {
+		return
+	}
+	if err := s.saveLocked(); err != nil {
+		log.Warnln("[GroupState] save error: %v", err)
+	}
+}
+
+func (s *GroupStateStore) State(profile string) *GroupState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.loadLocked()
+	if profile == "" {
+		profile = s.profile
+	}
+	return s.states[profile]
+}
+
+func (s *GroupStateStore) Forget(profile string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.loadLocked()
+	if _, ok := s.states[profile]; !ok {
+		return
+	}
+	delete(s.states, profile)
+	if err := s.saveLocked(); err != nil {
+		log.Warnln("[GroupState] save error: %v", err)
+	}
+}
+
+func handleSetGroupStatePersistence(enabledString string) bool {
+	enabled, err := strconv.ParseBool(enabledString)
+	if err != nil {
+		return false
+	}
+	groupStates.SetEnabled(enabled)
+	return true
+}
+
+func handleClearGroupState(profileId string) bool {
+	groupStates.Forget(profileId)
+	return true
+}
+
+func handleGetGroupState(profileId string) string {
+	state := groupStates.State(profileId)
+	if state == nil {
+		return ""
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
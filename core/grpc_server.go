@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"github.com/metacubex/mihomo/component/ca"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+const (
+	grpcServiceName      = "flclash.core.Core"
+	grpcEventBufferSize  = 256
+	grpcAuthorizationKey = "authorization"
+)
+
+// GrpcServerParams starts the control plane, a token is required even on loopback where every local
+// user and any page of a browser may reach it, beyond loopback tls is required as well
+type GrpcServerParams struct {
+	Address     string `json:"address"`
+	Token       string `json:"token"`
+	Certificate string `json:"certificate"`
+	PrivateKey  string `json:"private-key"`
+}
+
+type GrpcServerStatus struct {
+	Running     bool   `json:"running"`
+	Address     string `json:"address"`
+	TLS         bool   `json:"tls"`
+	HasToken    bool   `json:"has-token"`
+	Subscribers int    `json:"subscribers"`
+}
+
+// coreServiceServer is the handler type of the Core service, see core.proto
+type coreServiceServer interface {
+	invoke(ctx context.Context, request *wrapperspb.StringValue) (*wrapperspb.StringValue, error)
+	events(stream grpc.ServerStream) error
+}
+
+// GrpcServer serves the actions of the bridge and its messages over gRPC
+type GrpcServer struct {
+	mutex       sync.Mutex
+	server      *grpc.Server
+	listener    net.Listener
+	token       string
+	tls         bool
+	subscribers map[chan []byte]struct{}
+	subsMutex   sync.RWMutex
+}
+
+var grpcServer = &GrpcServer{
+	subscribers: map[chan []byte]struct{}{},
+}
+
+var grpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: grpcServiceName,
+	HandlerType: (*coreServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Invoke",
+			Handler:    grpcInvokeHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Events",
+			Handler:       grpcEventsHandler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "core.proto",
+}
+
+func grpcInvokeHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	request := &wrapperspb.StringValue{}
+	if err := dec(request); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(coreServiceServer).invoke(ctx, request)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/" + grpcServiceName + "/Invoke",
+	}
+	return interceptor(ctx, request, info, func(ctx context.Context, req any) (any, error) {
+		return srv.(coreServiceServer).invoke(ctx, req.(*wrapperspb.StringValue))
+	})
+}
+
+func grpcEventsHandler(srv any, stream grpc.ServerStream) error {
+	if err := stream.RecvMsg(&emptypb.Empty{}); err != nil {
+		return err
+	}
+	return srv.(coreServiceServer).events(stream)
+}
+
+// grpcMethods is the control surface of the plane, the profiles, proxies, connections and events.
+// Whatever writes files, runs processes or stops the core stays with the app.
+var grpcMethods = map[Method]struct{}{
+	getIsInitMethod:               {},
+	getRunTimeMethod:              {},
+	getMemoryMethod:               {},
+	validateConfigMethod:          {},
+	validateProfileMethod:         {},
+	setupConfigMethod:             {},
+	updateConfigMethod:            {},
+	updateProfileMethod:           {},
+	diffProfilesMethod:            {},
+	getCurrentProfileNameMethod:   {},
+	getProxiesMethod:              {},
+	changeProxyMethod:             {},
+	asyncTestDelayMethod:          {},
+	testDelayBatchMethod:          {},
+	cancelDelayBatchMethod:        {},
+	getExternalProvidersMethod:    {},
+	getExternalProviderMethod:     {},
+	updateExternalProviderMethod:  {},
+	getProvidersHealthMethod:      {},
+	forceUpdateProviderMethod:     {},
+	getTrafficMethod:              {},
+	getTotalTrafficMethod:         {},
+	getConnectionsMethod:          {},
+	closeConnectionsMethod:        {},
+	closeConnectionMethod:         {},
+	closeConnectionsByProxyMethod: {},
+	inspectConnectionsMethod:      {},
+	inspectConnectionMethod:       {},
+	subscribeEventsMethod:         {},
+	unsubscribeEventsMethod:       {},
+	ackEventsMethod:               {},
+	replayEventsMethod:            {},
+	getEventStreamsMethod:         {},
+}
+
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.IsLoopback()
+}
+
+func authorizeGrpc(ctx context.Context, token string) error {
+	if token == "" {
+		return status.Error(codes.Unauthenticated, "no token is set")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	expected := []byte("Bearer " + token)
+	for _, value := range md.Get(grpcAuthorizationKey) {
+		if subtle.ConstantTimeCompare([]byte(value), expected) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid token")
+}
+
+// invoke runs one action, the request and the response carry the same json as the socket bridge
+func (s *GrpcServer) invoke(ctx context.Context, request *wrapperspb.StringValue) (*wrapperspb.StringValue, error) {
+	action := &Action{}
+	if err := json.Unmarshal([]byte(request.GetValue()), action); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if action.Method == "" {
+		return nil, status.Error(codes.InvalidArgument, "method is required")
+	}
+	if _, ok := grpcMethods[action.Method]; !ok {
+		return nil, status.Errorf(codes.PermissionDenied, "%s is not allowed", action.Method)
+	}
+	reply := make(chan ActionResult, 1)
+	go handleAction(action, ActionResult{
+		Id:     action.Id,
+		Method: action.Method,
+		reply:  reply,
+	})
+	select {
+	case result := <-reply:
+		data, err := result.Json()
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return wrapperspb.String(string(data)), nil
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// events streams every message of the core until the client goes away
+func (s *GrpcServer) events(stream grpc.ServerStream) error {
+	ch := make(chan []byte, grpcEventBufferSize)
+	s.subsMutex.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.subsMutex.Unlock()
+	defer func() {
+		s.subsMutex.Lock()
+		delete(s.subscribers, ch)
+		s.subsMutex.Unlock()
+	}()
+	for {
+		select {
+		case data := <-ch:
+			if err := stream.SendMsg(wrapperspb.String(string(data))); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// Publish fans a message out to the event streams, slow streams drop messages instead of blocking the core
+func (s *GrpcServer) Publish(message Message) {
+	s.subsMutex.RLock()
+	defer s.subsMutex.RUnlock()
+	if len(s.subscribers) == 0 {
+		return
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	for ch := range s.subscribers {
+		select {
+		case ch <- data:
+		default:
+		}
+	}
+}
+
+func (s *GrpcServer) Start(params *GrpcServerParams) error {
+	if params.Address == "" {
+		return errors.New("address is required")
+	}
+	if params.Token == "" {
+		return errors.New("token is required")
+	}
+	// the token would cross the network in the clear, only loopback may go without tls
+	if !isLoopbackAddress(params.Address) && (params.Certificate == "" || params.PrivateKey == "") {
+		return errors.New("a certificate and a private key are required beyond loopback")
+	}
+	var options []grpc.ServerOption
+	useTLS := params.Certificate != "" || params.PrivateKey != ""
+	if useTLS {
+		certificate, err := ca.LoadTLSKeyPair(params.Certificate, params.PrivateKey, constant.Path)
+		if err != nil {
+			return err
+		}
+		options = append(options, grpc.Creds(credentials.NewTLS(&tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			MinVersion:   tls.VersionTLS12,
+		})))
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stopLocked()
+	listener, err := net.Listen("tcp", params.Address)
+	if err != nil {
+		return err
+	}
+	token := params.Token
+	s.token = token
+	s.tls = useTLS
+	options = append(options,
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := authorizeGrpc(ctx, token); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := authorizeGrpc(stream.Context(), token); err != nil {
+				return err
+			}
+			return handler(srv, stream)
+		}),
+	)
+	server := grpc.NewServer(options...)
+	server.RegisterService(&grpcServiceDesc, s)
+	s.server = server
+	s.listener = listener
+	log.Infoln("[gRPC] listening at: %s", listener.Addr().String())
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+			log.Errorln("[gRPC] serve error: %s", err)
+		}
+	}()
+	return nil
+}
+
+func (s *GrpcServer) stopLocked() {
+	if s.server == nil {
+		return
+	}
+	s.server.Stop()
+	s.server = nil
+	s.listener = nil
+	s.token = ""
+	s.tls = false
+}
+
+func (s *GrpcServer) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stopLocked()
+}
+
+func (s *GrpcServer) Status() *GrpcServerStatus {
+	s.mutex.Lock()
+	info := &GrpcServerStatus{
+		Running:  s.server != nil,
+		TLS:      s.tls,
+		HasToken: s.token != "",
+	}
+	if s.listener != nil {
+		info.Address = s.listener.Addr().String()
+	}
+	s.mutex.Unlock()
+	s.subsMutex.RLock()
+	info.Subscribers = len(s.subscribers)
+	s.subsMutex.RUnlock()
+	return info
+}
+
+func handleStartGrpcServer(paramsString string) error {
+	var params = &GrpcServerParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	return grpcServer.Start(params)
+}
+
+func handleStopGrpcServer() bool {
+	grpcServer.Stop()
+	return true
+}
+
+func handleGetGrpcServer() string {
+	data, err := json.Marshal(grpcServer.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
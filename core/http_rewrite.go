@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/common/utils"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type HttpRewriteAction string
+
+const (
+	AddHeaderRewriteAction     HttpRewriteAction = "add-header"
+	RemoveHeaderRewriteAction  HttpRewriteAction = "remove-header"
+	ReplaceHeaderRewriteAction HttpRewriteAction = "replace-header"
+	RedirectRewriteAction      HttpRewriteAction = "redirect"
+
+	httpRewriteProfileKey = "http-rewrite"
+	// httpRewritePeek is enough to tell a request line from tls or other binary protocols
+	httpRewritePeek       = 8
+	httpRewriteBufferSize = 64 * 1024
+)
+
+var defaultHttpRewritePorts = []string{"80", "8080"}
+
+var httpRewriteMethods = []string{"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "TRACE "}
+
+// HttpRewriteRule edits the plain http requests whose url, written as http://host/path?query, matches url
+type HttpRewriteRule struct {
+	Url      string            `yaml:"url" json:"url"`
+	Action   HttpRewriteAction `yaml:"action" json:"action"`
+	Header   string            `yaml:"header" json:"header"`
+	Value    string            `yaml:"value" json:"value"`
+	Pattern  string            `yaml:"pattern" json:"pattern"`
+	Location string            `yaml:"location" json:"location"`
+	Status   int               `yaml:"status" json:"status"`
+}
+
+// HttpRewriteConfig is read from the http-rewrite section of the profile
+type HttpRewriteConfig struct {
+	Ports []string          `yaml:"ports" json:"ports"`
+	Rules []HttpRewriteRule `yaml:"rules" json:"rules"`
+}
+
+type HttpRewriteStats struct {
+	Rules     int   `json:"rules"`
+	Requests  int64 `json:"requests"`
+	Rewritten int64 `json:"rewritten"`
+	Redirects int64 `json:"redirects"`
+}
+
+type httpRewriteRule struct {
+	HttpRewriteRule
+	url     *regexp.Regexp
+	pattern *regexp.Regexp
+}
+
+type httpRewriteSet struct {
+	ports utils.IntRanges[uint16]
+	rules []*httpRewriteRule
+}
+
+// HttpRewriter applies the rules of the active profile to unencrypted http, tls is never touched
+type HttpRewriter struct {
+	mutex     sync.Mutex
+	set       *httpRewriteSet
+	requests  atomic.Int64
+	rewritten atomic.Int64
+	redirects atomic.Int64
+}
+
+var httpRewriter = &HttpRewriter{}
+
+func compileHttpRewrite(config *HttpRewriteConfig) (*httpRewriteSet, error) {
+	ports := config.Ports
+	if len(ports) == 0 {
+		ports = defaultHttpRewritePorts
+	}
+	ranges, err := utils.NewUnsignedRangesFromList[uint16](ports)
+	if err != nil {
+		return nil, fmt.Errorf("ports: %v", err)
+	}
+	set := &httpRewriteSet{ports: ranges}
+	for i, rule := range config.Rules {
+		compiled := &httpRewriteRule{HttpRewriteRule: rule}
+		if compiled.url, err = regexp.Compile(rule.Url); err != nil {
+			return nil, fmt.Errorf("rules[%d] url: %v", i, err)
+		}
+		switch rule.Action {
+		case AddHeaderRewriteAction, RemoveHeaderRewriteAction:
+			if rule.Header == "" {
+				return nil, fmt.Errorf("rules[%d]: header is required", i)
+			}
+		case ReplaceHeaderRewriteAction:
+			if rule.Header == "" {
+				return nil, fmt.Errorf("rules[%d]: header is required", i)
+			}
+			if rule.Pattern != "" {
+				if compiled.pattern, err = regexp.Compile(rule.Pattern); err != nil {
+					return nil, fmt.Errorf("rules[%d] pattern: %v", i, err)
+				}
+			}
+		case RedirectRewriteAction:
+			if rule.Location == "" {
+				return nil, fmt.Errorf("rules[%d]: location is required", i)
+			}
+			switch rule.Status {
+			case 0:
+				compiled.Status = http.StatusFound
+			case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+			default:
+				return nil, fmt.Errorf("rules[%d]: invalid redirect status %d", i, rule.Status)
+			}
+		default:
+			return nil, fmt.Errorf("rules[%d]: unknown action %s", i, rule.Action)
+		}
+		set.rules = append(set.rules, compiled)
+	}
+	return set, nil
+}
+
+// Load reads the rules of a profile, a profile without the section turns the rewriting off
+func (r *HttpRewriter) Load(profileId string) error {
+	var config *HttpRewriteConfig
+	if profileId != "" {
+		content, err := GetMergedProfile(profileId)
+		if err != nil {
+			log.Debugln("[HttpRewrite] profile %s unavailable: %v", profileId, err)
+			return r.Set(nil)
+		}
+		defer clearBytes(content)
+		var section struct {
+			HttpRewrite *HttpRewriteConfig `yaml:"http-rewrite"`
+		}
+		if err := yaml.Unmarshal(content, &section); err != nil {
+			return err
+		}
+		config = section.HttpRewrite
+	}
+	return r.Set(config)
+}
+
+func (r *HttpRewriter) Set(config *HttpRewriteConfig) error {
+	var set *httpRewriteSet
+	if config != nil && len(config.Rules) != 0 {
+		var err error
+		if set, err = compileHttpRewrite(config); err != nil {
+			return fmt.Errorf("%s: %v", httpRewriteProfileKey, err)
+		}
+	}
+	r.mutex.Lock()
+	r.set = set
+	r.mutex.Unlock()
+	return nil
+}
+
+func (r *HttpRewriter) current() *httpRewriteSet {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.set
+}
+
+func (r *HttpRewriter) Stats() HttpRewriteStats {
+	stats := HttpRewriteStats{
+		Requests:  r.requests.Load(),
+		Rewritten: r.rewritten.Load(),
+		Redirects: r.redirects.Load(),
+	}
+	if set := r.current(); set != nil {
+		stats.Rules = len(set.rules)
+	}
+	return stats
+}
+
+// apply edits request in place and returns the redirect location when a redirect rule matched
+func (s *httpRewriteSet) apply(request *http.Request) (string, int, bool) {
+	target := "http://" + request.Host + request.URL.RequestURI()
+	changed := false
+	for _, rule := range s.rules {
+		match := rule.url.FindStringSubmatchIndex(target)
+		if match == nil {
+			continue
+		}
+		switch rule.Action {
+		case AddHeaderRewriteAction:
+			request.Header.Add(rule.Header, rule.Value)
+		case RemoveHeaderRewriteAction:
+			request.Header.Del(rule.Header)
+		case ReplaceHeaderRewriteAction:
+			values := request.Header.Values(rule.Header)
+			if len(values) == 0 {
+				continue
+			}
+			for i, value := range values {
+				if rule.pattern != nil {
+					values[i] = rule.pattern.ReplaceAllString(value, rule.Value)
+				} else {
+					values[i] = rule.Value
+				}
+			}
+		case RedirectRewriteAction:
+			location := rule.url.ExpandString(nil, rule.Location, target, match)
+			return string(location), rule.Status, changed
+		}
+		changed = true
+	}
+	return "", 0, changed
+}
+
+// httpRewriteTunnel parses the client side of plain http connections and forwards the edited requests
+type httpRewriteTunnel struct {
+	constant.Tunnel
+}
+
+var rewriteTunnel constant.Tunnel = &httpRewriteTunnel{Tunnel: historyTunnel}
+
+func (t *httpRewriteTunnel) HandleTCPConn(conn net.Conn, metadata *constant.Metadata) {
+	set := httpRewriter.current()
+	if set == nil || !set.ports.Check(metadata.DstPort) {
+		t.Tunnel.HandleTCPConn(conn, metadata)
+		return
+	}
+	t.Tunnel.HandleTCPConn(newHttpRewriteConn(conn, set), metadata)
+}
+
+// httpRewriteConn edits the requests read from the client, reads stay on the client conn so the
+// deadlines the tunnel sets while peeking apply, a header is only parsed once it is fully buffered
+type httpRewriteConn struct {
+	net.Conn
+	reader      *bufio.Reader
+	set         *httpRewriteSet
+	pending     []byte
+	body        int64
+	passthrough bool
+	closed      bool
+}
+
+var httpRewriteReaders = sync.Pool{
+	New: func() any {
+		return bufio.NewReaderSize(nil, httpRewriteBufferSize)
+	},
+}
+
+func newHttpRewriteConn(conn net.Conn, set *httpRewriteSet) net.Conn {
+	reader := httpRewriteReaders.Get().(*bufio.Reader)
+	reader.Reset(conn)
+	return &httpRewriteConn{
+		Conn:   conn,
+		reader: reader,
+		set:    set,
+	}
+}
+
+// releaseReader hands the buffer back once a passthrough connection has drained it, reads go to
+// the socket from then on
+func (c *httpRewriteConn) releaseReader() {
+	if c.reader == nil || c.reader.Buffered() != 0 {
+		return
+	}
+	c.reader.Reset(nil)
+	httpRewriteReaders.Put(c.reader)
+	c.reader = nil
+}
+
+func isHttpRequest(prefix []byte) bool {
+	for _, method := range httpRewriteMethods {
+		if strings.HasPrefix(string(prefix), method) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerLength peeks until the end of the request header, 0 means it is not http or does not fit the buffer
+func (c *httpRewriteConn) headerLength() (int, error) {
+	prefix, err := c.reader.Peek(httpRewritePeek)
+	if err != nil {
+		// a short first write that ended the stream is passed on, a deadline is retried with the buffer intact
+		if len(prefix) != 0 && !errors.Is(err, os.ErrDeadlineExceeded) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if !isHttpRequest(prefix) {
+		return 0, nil
+	}
+	for {
+		buffered := c.reader.Buffered()
+		data, _ := c.reader.Peek(buffered)
+		if index := bytes.Index(data, []byte("\r\n\r\n")); index >= 0 {
+			return index + 4, nil
+		}
+		if buffered >= httpRewriteBufferSize {
+			return 0, nil
+		}
+		if _, err = c.reader.Peek(buffered + 1); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// next parses one request and queues its edited header, the body is passed unchanged
+func (c *httpRewriteConn) next() error {
+	length, err := c.headerLength()
+	if err != nil {
+		return err
+	}
+	if length == 0 {
+		// anything but http is passed as it is for the rest of the connection
+		c.passthrough = true
+		return nil
+	}
+	request, err := http.ReadRequest(c.reader)
+	if err != nil {
+		return err
+	}
+	httpRewriter.requests.Add(1)
+	location, status, changed := c.set.apply(request)
+	if location != "" {
+		httpRewriter.redirects.Add(1)
+		response := fmt.Sprintf("HTTP/1.1 %d %s\r\nLocation: %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status), location)
+		_, _ = c.Conn.Write([]byte(response))
+		log.Debugln("[HttpRewrite] redirect %s to %s", request.Host, location)
+		c.closed = true
+		return io.EOF
+	}
+	if changed {
+		httpRewriter.rewritten.Add(1)
+	}
+	header := &bytes.Buffer{}
+	fmt.Fprintf(header, "%s %s %s\r\n", request.Method, request.RequestURI, request.Proto)
+	if request.Host != "" {
+		fmt.Fprintf(header, "Host: %s\r\n", request.Host)
+	}
+	chunked := len(request.TransferEncoding) != 0
+	if chunked {
+		fmt.Fprintf(header, "Transfer-Encoding: %s\r\n", strings.Join(request.TransferEncoding, ", "))
+	}
+	_ = request.Header.Write(header)
+	header.WriteString("\r\n")
+	c.pending = header.Bytes()
+	if chunked {
+		// the chunk framing is not followed, later requests on this connection are not edited
+		c.passthrough = true
+	} else if request.ContentLength > 0 {
+		c.body = request.ContentLength
+	}
+	return nil
+}
+
+func (c *httpRewriteConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		switch {
+		case c.closed:
+			return 0, io.EOF
+		case c.passthrough:
+			if c.releaseReader(); c.reader == nil {
+				return c.Conn.Read(b)
+			}
+			return c.reader.Read(b)
+		case c.body > 0:
+			if int64(len(b)) > c.body {
+				b = b[:c.body]
+			}
+			n, err := c.reader.Read(b)
+			c.body -= int64(n)
+			return n, err
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *httpRewriteConn) Upstream() any {
+	return c.Conn
+}
+
+// ReaderReplaceable is true once the connection is passed through and nothing is left in the
+// buffer, the relay then copies from the socket without this conn in the way
+func (c *httpRewriteConn) ReaderReplaceable() bool {
+	if !c.passthrough || c.closed || len(c.pending) != 0 {
+		return false
+	}
+	c.releaseReader()
+	return c.reader == nil
+}
+
+// ReaderPossiblyReplaceable makes the relay come back after each read until the first request
+// tells whether the connection is http at all
+func (c *httpRewriteConn) ReaderPossiblyReplaceable() bool {
+	return !c.closed && (!c.passthrough || c.reader != nil)
+}
+
+func (c *httpRewriteConn) WriterReplaceable() bool {
+	return true
+}
+
+func handleGetHttpRewriteStats() string {
+	data, err := json.Marshal(httpRewriter.Stats())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
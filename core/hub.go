@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"github.com/metacubex/mihomo/adapter"
 	"github.com/metacubex/mihomo/adapter/outboundgroup"
-	"github.com/metacubex/mihomo/common/observable"
 	"github.com/metacubex/mihomo/common/utils"
 	"github.com/metacubex/mihomo/component/mmdb"
 	"github.com/metacubex/mihomo/component/resolver"
@@ -16,6 +15,7 @@ import (
 	"github.com/metacubex/mihomo/constant"
 	cp "github.com/metacubex/mihomo/constant/provider"
 	"github.com/metacubex/mihomo/hub/executor"
+	"github.com/metacubex/mihomo/hub/route"
 	"github.com/metacubex/mihomo/listener"
 	"github.com/metacubex/mihomo/log"
 	"github.com/metacubex/mihomo/tunnel"
@@ -30,7 +30,6 @@ import (
 var (
 	isInit            = false
 	externalProviders = map[string]cp.Provider{}
-	logSubscriber     observable.Subscription[log.Event]
 )
 
 func handleInitClash(paramsString string) bool {
@@ -42,8 +41,17 @@ func handleInitClash(paramsString string) bool {
 	version = params.Version
 	if !isInit {
 		constant.SetHomeDir(params.HomeDir)
+		systemProxy.Recover()
 		isInit = true
+		migrateSealedStores()
 	}
+	logPipeline.Start()
+	syncEngine.Resume()
+	connectionTuning.Resume()
+	networkMonitor.Resume()
+	captivePortal.Resume()
+	killSwitch.Resume()
+	automation.Resume()
 	return isInit
 }
 
@@ -61,6 +69,11 @@ func handleStopListener() bool {
 	defer runLock.Unlock()
 	isRunning = false
 	listener.StopListener()
+	splitTunnel.Clear()
+	portForwards.Close()
+	resolver.StoreFakePoolState()
+	fakeIpStore.Save(false)
+	go publishTunState()
 	return true
 }
 
@@ -76,8 +89,34 @@ func handleForceGc() {
 }
 
 func handleShutdown() bool {
+	GetSecureMemoryService().StopAutoCleanup()
+	stopAllInstances()
+	urlTestSchedule.Stop()
+	failover.Stop()
+	ruleProviderUpdates.Stop()
+	dnsHealth.Stop()
+	syncEngine.Stop()
+	connectionTuning.Stop()
+	networkMonitor.Stop()
+	captivePortal.Stop()
+	killSwitch.Stop()
+	automation.Stop()
+	closeDnscryptForwarders()
+	trafficAccounting.Flush()
+	quotas.Save()
+	groupStates.Capture()
+	groupStates.Save()
+	logPipeline.CloseFile()
+	systemProxy.Restore()
 	stopListeners()
+	shareServer.Close()
+	remote.Close()
+	discovery.Close()
+	controllerGateway.Close()
 	executor.Shutdown()
+	fakeIpStore.Save(true)
+	eventBus.Clear()
+	connectionFeeds.Clear()
 	runtime.GC()
 	isInit = false
 	return true
@@ -121,6 +160,11 @@ func handleChangeProxy(data string, fn func(string string)) {
 			fn("Group is not selectable")
 			return
 		}
+		previous := ""
+		now, ok := adapterProxy.ProxyAdapter.(interface{ Now() string })
+		if ok {
+			previous = now.Now()
+		}
 		if proxyName == "" {
 			selector.ForceSet(proxyName)
 		} else {
@@ -130,6 +174,21 @@ func handleChangeProxy(data string, fn func(string string)) {
 			fn(err.Error())
 			return
 		}
+		groupStates.Release(groupName)
+		groupStates.Capture()
+		groupStates.Save()
+		if ok {
+			proxyName = now.Now()
+		}
+		// the hooks and the event bus see a change of the user like one of the failover
+		go sendMessage(Message{
+			Type: ProxyChangedMessage,
+			Data: ProxyChanged{
+				GroupName: groupName,
+				ProxyName: proxyName,
+				Previous:  previous,
+			},
+		})
 
 		fn("")
 		return
@@ -166,6 +225,7 @@ func handleGetTotalTraffic() string {
 
 func handleResetTraffic() {
 	statistic.DefaultManager.ResetStatistic()
+	trafficAccounting.Reset()
 }
 
 func handleAsyncTestDelay(paramsString string, fn func(string)) {
@@ -222,16 +282,25 @@ func handleAsyncTestDelay(paramsString string, fn func(string)) {
 	})
 }
 
-func handleGetConnections() string {
+// handleGetConnections encodes for the bridge as the app asked for, other callers get the snapshot
+func handleGetConnections(bridged bool) any {
 	runLock.Lock()
 	defer runLock.Unlock()
 	snapshot := statistic.DefaultManager.Snapshot()
-	data, err := json.Marshal(snapshot)
+	if !bridged {
+		data, err := json.Marshal(snapshot)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return ""
+		}
+		return string(data)
+	}
+	data, err := json.Marshal(bridgeEncoding.Connections(snapshot))
 	if err != nil {
 		fmt.Println("Error:", err)
 		return ""
 	}
-	return string(data)
+	return bridgeEncoding.EncodeString(string(data))
 }
 
 func handleCloseConnections() bool {
@@ -243,6 +312,9 @@ func handleCloseConnections() bool {
 
 func closeConnections() {
 	statistic.DefaultManager.Range(func(c statistic.Tracker) bool {
+		if connectionPins.Pinned(c.ID()) {
+			return true
+		}
 		err := c.Close()
 		if err != nil {
 			return false
@@ -348,6 +420,7 @@ func handleUpdateExternalProvider(providerName string, fn func(value string)) {
 			return
 		}
 		err := externalProvider.Update()
+		providerAttempts.record(providerName, err)
 		if err != nil {
 			fn(err.Error())
 			return
@@ -374,31 +447,14 @@ func handleSideLoadExternalProvider(providerName string, data []byte, fn func(va
 	}()
 }
 
+// handleStartLog forwards the entries passing the pipeline levels to the app
 func handleStartLog() {
-	if logSubscriber != nil {
-		log.UnSubscribe(logSubscriber)
-		logSubscriber = nil
-	}
-	logSubscriber = log.Subscribe()
-	go func() {
-		for logData := range logSubscriber {
-			if logData.LogLevel < log.Level() {
-				continue
-			}
-			message := &Message{
-				Type: LogMessage,
-				Data: logData,
-			}
-			sendMessage(*message)
-		}
-	}()
+	logPipeline.Start()
+	logPipeline.forward.Store(true)
 }
 
 func handleStopLog() {
-	if logSubscriber != nil {
-		log.UnSubscribe(logSubscriber)
-		logSubscriber = nil
-	}
+	logPipeline.forward.Store(false)
 }
 
 func handleGetCountryCode(ip string, fn func(value string)) {
@@ -466,6 +522,8 @@ func handleSetupConfig(bytes []byte) string {
 }
 
 func init() {
+	route.SetEmbedMode(true)
+	route.Register(metricsRouter, controllerRouter, domainMatcherRouter, streamRouter)
 	adapter.UrlTestHook = func(url string, name string, delay uint16) {
 		delayData := &Delay{
 			Url:  url,
@@ -482,6 +540,8 @@ func init() {
 		})
 	}
 	statistic.DefaultRequestNotify = func(c statistic.Tracker) {
+		trafficAccounting.Track(c)
+		sniffing.Observe(c)
 		sendMessage(Message{
 			Type: RequestMessage,
 			Data: c,
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/metacubex/mihomo/component/auth"
+	authStore "github.com/metacubex/mihomo/listener/auth"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type InboundUserParams struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// InboundUser is an account accepted by the mixed, http and socks inbounds, config users come from the profile
+type InboundUser struct {
+	Username string `json:"username"`
+	Source   string `json:"source"`
+	TrafficCounter
+	Connections int `json:"connections"`
+}
+
+type InboundUsers struct {
+	mutex   sync.Mutex
+	config  []auth.AuthUser
+	runtime map[string]string
+}
+
+var inboundUsers = &InboundUsers{
+	runtime: map[string]string{},
+}
+
+// Apply installs the profile users together with the ones added at runtime, runtime users win on conflict
+func (u *InboundUsers) Apply(users []auth.AuthUser) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.config = append([]auth.AuthUser{}, users...)
+	u.applyLocked()
+}
+
+func (u *InboundUsers) applyLocked() {
+	users := make([]auth.AuthUser, 0, len(u.config)+len(u.runtime))
+	for _, user := range u.config {
+		if _, ok := u.runtime[user.User]; !ok {
+			users = append(users, user)
+		}
+	}
+	for name, pass := range u.runtime {
+		users = append(users, auth.AuthUser{User: name, Pass: pass})
+	}
+	authStore.Default.SetAuthenticator(auth.NewAuthenticator(users))
+}
+
+func (u *InboundUsers) Add(username string, password string) error {
+	if username == "" || strings.Contains(username, ":") {
+		return errors.New("invalid username")
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.runtime[username] = password
+	u.applyLocked()
+	return nil
+}
+
+// Remove drops a runtime user, profile users can only be removed by editing the profile
+func (u *InboundUsers) Remove(username string) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if _, ok := u.runtime[username]; !ok {
+		return false
+	}
+	delete(u.runtime, username)
+	u.applyLocked()
+	return true
+}
+
+func (u *InboundUsers) List() []InboundUser {
+	u.mutex.Lock()
+	sources := map[string]string{}
+	for _, user := range u.config {
+		sources[user.User] = "config"
+	}
+	for name := range u.runtime {
+		sources[name] = "runtime"
+	}
+	u.mutex.Unlock()
+	usages := map[string]TrafficUsage{}
+	for _, usage := range trafficAccounting.Query(UserTrafficDimension, &TrafficStatsParams{}) {
+		usages[usage.Name] = usage
+	}
+	users := make([]InboundUser, 0, len(sources))
+	for name, source := range sources {
+		usage := usages[name]
+		users = append(users, InboundUser{
+			Username:       name,
+			Source:         source,
+			TrafficCounter: usage.TrafficCounter,
+			Connections:    usage.Connections,
+		})
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users
+}
+
+func handleAddInboundUser(paramsString string) error {
+	var params = &InboundUserParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	return inboundUsers.Add(params.Username, params.Password)
+}
+
+func handleRemoveInboundUser(username string) bool {
+	return inboundUsers.Remove(username)
+}
+
+func handleGetInboundUsers() string {
+	data, err := json.Marshal(inboundUsers.List())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/log"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const instanceConnectTimeout = 10 * time.Second
+
+// CoreInstance is an additional core running in its own process with an independent config
+type CoreInstance struct {
+	Id      string
+	HomeDir string
+	Running bool
+	Pid     int
+
+	cmd     *exec.Cmd
+	conn    net.Conn
+	pending map[string]chan instanceResult
+	mutex   sync.Mutex
+	seq     atomic.Uint64
+	// starting is set from the check of Start until it is done, a second Start must not launch another process
+	starting bool
+}
+
+type instanceResult struct {
+	Id     string          `json:"id"`
+	Method Method          `json:"method"`
+	Data   json.RawMessage `json:"data"`
+	Code   int             `json:"code"`
+}
+
+type InstanceInfo struct {
+	Id      string `json:"id"`
+	HomeDir string `json:"home-dir"`
+	Running bool   `json:"running"`
+	Pid     int    `json:"pid"`
+}
+
+type InstanceParams struct {
+	Id      string `json:"id"`
+	HomeDir string `json:"home-dir"`
+	Setup   string `json:"setup"`
+}
+
+type InvokeInstanceParams struct {
+	Id     string `json:"id"`
+	Method Method `json:"method"`
+	Data   string `json:"data"`
+}
+
+type InstanceMessage struct {
+	Id      string          `json:"id"`
+	Message json.RawMessage `json:"message"`
+}
+
+var (
+	instances     = map[string]*CoreInstance{}
+	instancesLock sync.Mutex
+)
+
+// CreateInstance registers a new instance handle
+func CreateInstance(id, homeDir string) (*CoreInstance, error) {
+	if id == "" || homeDir == "" {
+		return nil, errors.New("instance id and home dir are required")
+	}
+	instancesLock.Lock()
+	defer instancesLock.Unlock()
+	if _, exists := instances[id]; exists {
+		return nil, fmt.Errorf("instance %s already exists", id)
+	}
+	instance := &CoreInstance{
+		Id:      id,
+		HomeDir: homeDir,
+		pending: map[string]chan instanceResult{},
+	}
+	instances[id] = instance
+	return instance, nil
+}
+
+func getInstance(id string) (*CoreInstance, error) {
+	instancesLock.Lock()
+	defer instancesLock.Unlock()
+	instance, exists := instances[id]
+	if !exists {
+		return nil, fmt.Errorf("instance %s not found", id)
+	}
+	return instance, nil
+}
+
+// Start launches the instance process and applies its setup params
+func (ci *CoreInstance) Start(setup string) error {
+	ci.mutex.Lock()
+	if ci.Running {
+		ci.mutex.Unlock()
+		return fmt.Errorf("instance %s is already running", ci.Id)
+	}
+	if ci.starting {
+		ci.mutex.Unlock()
+		return fmt.Errorf("instance %s is already starting", ci.Id)
+	}
+	ci.starting = true
+	ci.mutex.Unlock()
+	defer func() {
+		ci.mutex.Lock()
+		ci.starting = false
+		ci.mutex.Unlock()
+	}()
+
+	executable, err := coreExecutable()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(ci.HomeDir, 0755); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	cmd := exec.Command(executable, strconv.Itoa(port))
+	cmd.Dir = ci.HomeDir
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	_ = listener.(*net.TCPListener).SetDeadline(time.Now().Add(instanceConnectTimeout))
+	conn, err := listener.Accept()
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("instance %s did not connect: %v", ci.Id, err)
+	}
+
+	ci.mutex.Lock()
+	ci.cmd = cmd
+	ci.conn = conn
+	ci.Running = true
+	ci.Pid = cmd.Process.Pid
+	ci.mutex.Unlock()
+	go ci.readLoop(conn)
+	go ci.waitExit(cmd)
+
+	initParams, _ := json.Marshal(InitParams{HomeDir: ci.HomeDir, Version: version})
+	if _, err := ci.Invoke(initClashMethod, string(initParams)); err != nil {
+		ci.Stop()
+		return err
+	}
+	if setup != "" {
+		data, err := ci.Invoke(setupConfigMethod, setup)
+		if err != nil {
+			ci.Stop()
+			return err
+		}
+		var message string
+		if json.Unmarshal(data, &message) == nil && message != "" {
+			log.Warnln("[Instance] %s setup: %s", ci.Id, message)
+		}
+	}
+	_, err = ci.Invoke(startListenerMethod, "")
+	return err
+}
+
+// Invoke forwards an action to the instance and waits for its result
+func (ci *CoreInstance) Invoke(method Method, data string) (json.RawMessage, error) {
+	ci.mutex.Lock()
+	if !ci.Running {
+		ci.mutex.Unlock()
+		return nil, fmt.Errorf("instance %s is not running", ci.Id)
+	}
+	id := strconv.FormatUint(ci.seq.Add(1), 10)
+	ch := make(chan instanceResult, 1)
+	ci.pending[id] = ch
+	conn := ci.conn
+	ci.mutex.Unlock()
+
+	defer func() {
+		ci.mutex.Lock()
+		delete(ci.pending, id)
+		ci.mutex.Unlock()
+	}()
+
+	payload, err := json.Marshal(Action{Id: id, Method: method, Data: data})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(payload, '\n')); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	select {
+	case result, ok := <-ch:
+		if !ok {
+			return nil, fmt.Errorf("instance %s exited", ci.Id)
+		}
+		if result.Code != 0 {
+			return nil, fmt.Errorf("instance %s: %s", ci.Id, string(result.Data))
+		}
+		return result.Data, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("instance %s: %s timed out", ci.Id, method)
+	}
+}
+
+// Stop shuts the instance process down
+func (ci *CoreInstance) Stop() {
+	ci.mutex.Lock()
+	cmd, conn := ci.cmd, ci.conn
+	running := ci.Running
+	ci.mutex.Unlock()
+	if !running {
+		return
+	}
+	_, _ = ci.Invoke(shutdownMethod, "")
+	if conn != nil {
+		_ = conn.Close()
+	}
+	if cmd != nil && cmd.Process != nil {
+		_ = cmd.Process.Kill()
+	}
+}
+
+func (ci *CoreInstance) readLoop(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var result instanceResult
+		if err := json.Unmarshal(line, &result); err != nil {
+			continue
+		}
+		if result.Method == messageMethod {
+			sendMessage(Message{
+				Type: InstanceMessageType,
+				Data: InstanceMessage{Id: ci.Id, Message: result.Data},
+			})
+			continue
+		}
+		ci.mutex.Lock()
+		if ch, exists := ci.pending[result.Id]; exists {
+			ch <- result
+			delete(ci.pending, result.Id)
+		}
+		ci.mutex.Unlock()
+	}
+}
+
+func (ci *CoreInstance) waitExit(cmd *exec.Cmd) {
+	_ = cmd.Wait()
+	ci.mutex.Lock()
+	defer ci.mutex.Unlock()
+	if ci.cmd != cmd {
+		return
+	}
+	ci.Running = false
+	ci.Pid = 0
+	ci.cmd = nil
+	if ci.conn != nil {
+		_ = ci.conn.Close()
+		ci.conn = nil
+	}
+	for id, ch := range ci.pending {
+		close(ch)
+		delete(ci.pending, id)
+	}
+	log.Infoln("[Instance] %s exited", ci.Id)
+}
+
+func handleCreateInstance(paramsString string) string {
+	var params = &InstanceParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err.Error()
+	}
+	if _, err := CreateInstance(params.Id, params.HomeDir); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func handleStartInstance(paramsString string, fn func(value string)) {
+	go func() {
+		var params = &InstanceParams{}
+		if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+			fn(err.Error())
+			return
+		}
+		instance, err := getInstance(params.Id)
+		if err != nil {
+			fn(err.Error())
+			return
+		}
+		if err := instance.Start(params.Setup); err != nil {
+			fn(err.Error())
+			return
+		}
+		fn("")
+	}()
+}
+
+func handleStopInstance(id string) bool {
+	instance, err := getInstance(id)
+	if err != nil {
+		return false
+	}
+	instance.Stop()
+	return true
+}
+
+func handleRemoveInstance(id string) bool {
+	instance, err := getInstance(id)
+	if err != nil {
+		return false
+	}
+	instance.Stop()
+	instancesLock.Lock()
+	delete(instances, id)
+	instancesLock.Unlock()
+	return true
+}
+
+func handleInvokeInstance(paramsString string, fn func(value string, err error)) {
+	go func() {
+		var params = &InvokeInstanceParams{}
+		if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+			fn("", err)
+			return
+		}
+		instance, err := getInstance(params.Id)
+		if err != nil {
+			fn("", err)
+			return
+		}
+		data, err := instance.Invoke(params.Method, params.Data)
+		if err != nil {
+			fn("", err)
+			return
+		}
+		fn(string(data), nil)
+	}()
+}
+
+func handleGetInstances() string {
+	instancesLock.Lock()
+	list := make([]InstanceInfo, 0, len(instances))
+	for _, instance := range instances {
+		instance.mutex.Lock()
+		list = append(list, InstanceInfo{
+			Id:      instance.Id,
+			HomeDir: instance.HomeDir,
+			Running: instance.Running,
+			Pid:     instance.Pid,
+		})
+		instance.mutex.Unlock()
+	}
+	instancesLock.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	data, err := json.Marshal(list)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func stopAllInstances() {
+	instancesLock.Lock()
+	list := make([]*CoreInstance, 0, len(instances))
+	for _, instance := range instances {
+		list = append(list, instance)
+	}
+	instancesLock.Unlock()
+	for _, instance := range list {
+		instance.Stop()
+	}
+}
@@ -0,0 +1,10 @@
+//go:build cgo
+
+package main
+
+import "errors"
+
+// coreExecutable is unavailable when the core is embedded as a library
+func coreExecutable() (string, error) {
+	return "", errors.New("multiple instances require the standalone core")
+}
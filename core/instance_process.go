@@ -0,0 +1,10 @@
+//go:build !cgo
+
+package main
+
+import "os"
+
+// coreExecutable returns the binary used to spawn additional instances
+func coreExecutable() (string, error) {
+	return os.Executable()
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/adapter/outbound"
+	"github.com/metacubex/mihomo/component/dialer"
+	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"sync"
+)
+
+// OutboundBinding forces the sockets of an outbound to its server out of an interface or with a
+// routing mark, an empty interface and a zero mark leave the profile and the default route alone
+type OutboundBinding struct {
+	Interface   string `json:"interface-name"`
+	RoutingMark int    `json:"routing-mark"`
+}
+
+type InterfaceBindingParams struct {
+	Outbounds map[string]*OutboundBinding `json:"outbounds"`
+}
+
+type InterfaceBindingStatus struct {
+	OutboundBinding
+	Applied bool   `json:"applied"`
+	Error   string `json:"error,omitempty"`
+}
+
+// InterfaceBindings owns the binding layers, an outbound only gets one when it dials its server
+// through a dialer the core can hand it, a direct outbound is replaced by a bound direct
+type InterfaceBindings struct {
+	mutex    sync.Mutex
+	bindings map[string]*OutboundBinding
+	applied  map[string]error
+}
+
+var interfaceBindings = &InterfaceBindings{
+	bindings: map[string]*OutboundBinding{},
+	applied:  map[string]error{},
+}
+
+func (b *OutboundBinding) options() []dialer.Option {
+	var options []dialer.Option
+	if b.Interface != "" {
+		options = append(options, dialer.WithInterface(b.Interface))
+	}
+	if b.RoutingMark != 0 {
+		options = append(options, dialer.WithRoutingMark(b.RoutingMark))
+	}
+	return options
+}
+
+func (i *InterfaceBindings) Set(params *InterfaceBindingParams) error {
+	bindings := map[string]*OutboundBinding{}
+	for name, binding := range params.Outbounds {
+		if binding == nil || (binding.Interface == "" && binding.RoutingMark == 0) {
+			continue
+		}
+		if binding.RoutingMark < 0 {
+			return fmt.Errorf("routing mark of %s must not be negative", name)
+		}
+		bindings[name] = binding
+	}
+	runLock.Lock()
+	defer runLock.Unlock()
+	i.mutex.Lock()
+	i.bindings = bindings
+	i.applied = map[string]error{}
+	i.mutex.Unlock()
+	rewrapOutboundsLocked()
+	return nil
+}
+
+// bindingCapable refuses the outbounds whose sockets the core cannot reach, mux sessions and
+// dialer proxies replace the dialer they are handed
+func bindingCapable(proxy C.ProxyAdapter) error {
+	if _, ok := unwrapAdapter(proxy).(C.Group); ok {
+		return errors.New("a group has no server, bind its members")
+	}
+	if unwrapAdapter(proxy).Type() == C.Direct {
+		return nil
+	}
+	if proxy.SupportWithDialer() == C.InvalidNet {
+		return fmt.Errorf("%s outbounds open their sockets themselves", proxy.Type())
+	}
+	info := proxy.ProxyInfo()
+	if info.SMUX {
+		return errors.New("the mux session dials its own connections")
+	}
+	if info.DialerProxy != "" {
+		return fmt.Errorf("the server is reached through %s", info.DialerProxy)
+	}
+	if _, ok := unwrapAdapter(proxy).(interface{ DialOptions() []dialer.Option }); !ok {
+		return errors.New("the outbound has no dial options")
+	}
+	return nil
+}
+
+func (i *InterfaceBindings) wrap(name string, proxy C.ProxyAdapter) C.ProxyAdapter {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	binding, ok := i.bindings[name]
+	if !ok {
+		return proxy
+	}
+	if err := bindingCapable(proxy); err != nil {
+		if _, seen := i.applied[name]; !seen {
+			log.Warnln("[Binding] %s cannot be bound: %v", name, err)
+		}
+		i.applied[name] = err
+		return proxy
+	}
+	i.applied[name] = nil
+	bound := &bindingAdapter{ProxyAdapter: proxy, binding: *binding}
+	if unwrapAdapter(proxy).Type() == C.Direct {
+		bound.direct = outbound.NewDirectWithOption(outbound.DirectOption{
+			BasicOption: outbound.BasicOption{
+				Interface:   binding.Interface,
+				RoutingMark: binding.RoutingMark,
+			},
+			Name: proxy.Name(),
+		})
+	}
+	return bound
+}
+
+func (i *InterfaceBindings) Status() map[string]*InterfaceBindingStatus {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	status := map[string]*InterfaceBindingStatus{}
+	for name, binding := range i.bindings {
+		item := &InterfaceBindingStatus{OutboundBinding: *binding}
+		if err, ok := i.applied[name]; ok {
+			item.Applied = err == nil
+			if err != nil {
+				item.Error = err.Error()
+			}
+		} else {
+			item.Error = "no such outbound in the profile"
+		}
+		status[name] = item
+	}
+	return status
+}
+
+// bindingAdapter dials the server through a dialer carrying the binding, the options come after
+// the ones of the profile and win
+type bindingAdapter struct {
+	C.ProxyAdapter
+	binding OutboundBinding
+	direct  *outbound.Direct
+}
+
+func (a *bindingAdapter) Inner() C.ProxyAdapter {
+	return a.ProxyAdapter
+}
+
+// DialOptions lets the happy eyeballs layer above build its dialer with the binding
+func (a *bindingAdapter) DialOptions() []dialer.Option {
+	options := unwrapAdapter(a.ProxyAdapter).(interface{ DialOptions() []dialer.Option }).DialOptions()
+	return append(options, a.binding.options()...)
+}
+
+func (a *bindingAdapter) dialer() C.Dialer {
+	return dialer.NewDialer(a.DialOptions()...)
+}
+
+func (a *bindingAdapter) DialContext(ctx context.Context, metadata *C.Metadata) (C.Conn, error) {
+	if a.direct != nil {
+		return a.direct.DialContext(ctx, metadata)
+	}
+	return a.ProxyAdapter.DialContextWithDialer(ctx, a.dialer(), metadata)
+}
+
+func (a *bindingAdapter) ListenPacketContext(ctx context.Context, metadata *C.Metadata) (C.PacketConn, error) {
+	if a.direct != nil {
+		return a.direct.ListenPacketContext(ctx, metadata)
+	}
+	switch a.ProxyAdapter.SupportWithDialer() {
+	case C.ALLNet, C.UDP:
+		return a.ProxyAdapter.ListenPacketWithDialer(ctx, a.dialer(), metadata)
+	}
+	return a.ProxyAdapter.ListenPacketContext(ctx, metadata)
+}
+
+func handleSetInterfaceBindings(paramsString string) error {
+	params := &InterfaceBindingParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	return interfaceBindings.Set(params)
+}
+
+func handleGetInterfaceBindings() string {
+	data, err := json.Marshal(interfaceBindings.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,98 @@
+//go:build darwin
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync"
+)
+
+const (
+	keychainService = "FlClash"
+	keychainAccount = "core-master-key"
+	// keychainItemNotFound is the exit status of security for errSecItemNotFound, any other failure
+	// such as a denied prompt or a locked keychain must not replace the key
+	keychainItemNotFound = 44
+)
+
+// keychainKeyProvider keeps a random master key in the macOS login keychain
+type keychainKeyProvider struct {
+	mutex sync.Mutex
+	key   []byte
+}
+
+func newPlatformKeyProvider() KeyProvider {
+	return &keychainKeyProvider{}
+}
+
+func (p *keychainKeyProvider) Name() string {
+	return "keychain"
+}
+
+func (p *keychainKeyProvider) Available() bool {
+	_, err := exec.LookPath("security")
+	return err == nil
+}
+
+// MasterKey reads the key once, every operation after that spares the keychain a process
+func (p *keychainKeyProvider) MasterKey() ([]byte, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.key == nil {
+		key, err := p.find()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == keychainItemNotFound {
+			key, err = p.generate()
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.key = key
+	}
+	key := make([]byte, len(p.key))
+	copy(key, p.key)
+	return key, nil
+}
+
+func (p *keychainKeyProvider) find() ([]byte, error) {
+	output, err := exec.Command("security", "find-generic-password", "-s", keychainService, "-a", keychainAccount, "-w").Output()
+	if err != nil {
+		return nil, err
+	}
+	defer clearBytes(output)
+	key, err := hex.DecodeString(string(bytes.TrimSpace(output)))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		clearBytes(key)
+		return nil, errors.New("keychain key must be 32 bytes")
+	}
+	return key, nil
+}
+
+// generate creates a new master key and stores it in the keychain, the command goes through the
+// stdin of security so the key never shows in the arguments of a process
+func (p *keychainKeyProvider) generate() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	command := []byte(fmt.Sprintf("add-generic-password -s %s -a %s -w %s\n", keychainService, keychainAccount, hex.EncodeToString(key)))
+	defer clearBytes(command)
+	add := exec.Command("security", "-i")
+	add.Stdin = bytes.NewReader(command)
+	if err := add.Run(); err != nil {
+		clearBytes(key)
+		return nil, err
+	}
+	clearBytes(key)
+	// the interactive mode of security exits cleanly on a failed command, the key is what the
+	// keychain holds afterwards
+	return p.find()
+}
@@ -0,0 +1,8 @@
+//go:build !windows && !darwin
+
+package main
+
+// newPlatformKeyProvider returns nil; on Android the Keystore key is handed over as a host key
+func newPlatformKeyProvider() KeyProvider {
+	return nil
+}
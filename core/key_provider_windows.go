@@ -0,0 +1,144 @@
+//go:build windows
+
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"github.com/metacubex/mihomo/constant"
+	"golang.org/x/sys/windows"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+)
+
+const dpapiKeyFile = "master.key.dpapi"
+
+// dpapiKeyProvider keeps a random master key on disk protected by Windows DPAPI
+type dpapiKeyProvider struct {
+	path  string
+	mutex sync.Mutex
+	key   []byte
+}
+
+func newPlatformKeyProvider() KeyProvider {
+	return &dpapiKeyProvider{path: constant.Path.Resolve(dpapiKeyFile)}
+}
+
+func (p *dpapiKeyProvider) Name() string {
+	return "dpapi"
+}
+
+func (p *dpapiKeyProvider) Available() bool {
+	return p.path != ""
+}
+
+// MasterKey unprotects the key once, concurrent first calls must not generate two keys
+func (p *dpapiKeyProvider) MasterKey() ([]byte, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.key == nil {
+		key, err := p.find()
+		if errors.Is(err, os.ErrNotExist) {
+			key, err = p.generate()
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.key = key
+	}
+	key := make([]byte, len(p.key))
+	copy(key, p.key)
+	return key, nil
+}
+
+func (p *dpapiKeyProvider) find() ([]byte, error) {
+	protected, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := dpapiUnprotect(protected)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		clearBytes(key)
+		return nil, errors.New("dpapi key must be 32 bytes")
+	}
+	return key, nil
+}
+
+// generate creates a new master key and persists it protected by DPAPI
+func (p *dpapiKeyProvider) generate() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	protected, err := dpapiProtect(key)
+	if err != nil {
+		clearBytes(key)
+		return nil, err
+	}
+	if err := writeFileAtomic(p.path, protected); err != nil {
+		clearBytes(key)
+		return nil, err
+	}
+	return key, nil
+}
+
+// writeFileAtomic renames a complete file into place, a crash while writing must not leave a
+// truncated key that locks every profile
+func writeFileAtomic(path string, data []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	name := file.Name()
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(name, path)
+	}
+	if err != nil {
+		_ = os.Remove(name)
+	}
+	return err
+}
+
+func newDataBlob(data []byte) *windows.DataBlob {
+	if len(data) == 0 {
+		return &windows.DataBlob{}
+	}
+	return &windows.DataBlob{Size: uint32(len(data)), Data: &data[0]}
+}
+
+func blobBytes(blob *windows.DataBlob) []byte {
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(blob.Data)))
+	data := make([]byte, blob.Size)
+	copy(data, unsafe.Slice(blob.Data, blob.Size))
+	return data
+}
+
+func dpapiProtect(data []byte) ([]byte, error) {
+	var out windows.DataBlob
+	err := windows.CryptProtectData(newDataBlob(data), nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out)
+	if err != nil {
+		return nil, err
+	}
+	return blobBytes(&out), nil
+}
+
+func dpapiUnprotect(data []byte) ([]byte, error) {
+	var out windows.DataBlob
+	err := windows.CryptUnprotectData(newDataBlob(data), nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out)
+	if err != nil {
+		return nil, err
+	}
+	return blobBytes(&out), nil
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/metacubex/mihomo/adapter"
+	"github.com/metacubex/mihomo/component/resolver"
+	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	"github.com/metacubex/mihomo/tunnel/statistic"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultKillSwitchInterval = 3 * time.Second
+	maxKillSwitchDepth        = 8
+)
+
+var errKillSwitch = errors.New("blocked by the kill switch")
+
+type KillSwitchState string
+
+const (
+	DisarmedKillSwitch KillSwitchState = "disarmed"
+	ArmedKillSwitch    KillSwitchState = "armed"
+	EngagedKillSwitch  KillSwitchState = "engaged"
+)
+
+type KillSwitchParams struct {
+	Enable bool `json:"enable"`
+	// Groups are watched for a live pick, empty watches GLOBAL in global mode and the target of
+	// the final rule otherwise
+	Groups []string `json:"groups"`
+	// RequireTun engages the switch whenever the tun is not up
+	RequireTun bool `json:"require-tun"`
+}
+
+type KillSwitchStatus struct {
+	KillSwitchParams
+	State   KillSwitchState `json:"state"`
+	Reason  string          `json:"reason,omitempty"`
+	Since   int64           `json:"since"`
+	Blocked int64           `json:"blocked"`
+}
+
+// KillSwitch blocks the traffic of the apps once the tunnel or the watched proxy is gone, only
+// lan destinations and the probes of the core itself still get out
+type KillSwitch struct {
+	mutex   sync.Mutex
+	params  KillSwitchParams
+	cancel  context.CancelFunc
+	engaged atomic.Bool
+	reason  string
+	since   time.Time
+	blocked atomic.Int64
+}
+
+var killSwitch = &KillSwitch{since: time.Now()}
+
+func (k *KillSwitch) Set(params *KillSwitchParams) {
+	k.mutex.Lock()
+	k.params = *params
+	k.mutex.Unlock()
+	runLock.Lock()
+	rewrapOutboundsLocked()
+	runLock.Unlock()
+	k.Resume()
+}
+
+func (k *KillSwitch) Resume() {
+	k.Stop()
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if !k.params.Enable {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	k.cancel = cancel
+	go func() {
+		ticker := time.NewTicker(powerScaled(defaultKillSwitchInterval))
+		defer ticker.Stop()
+		for {
+			runGuarded("kill switch", k.check)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			ticker.Reset(powerScaled(defaultKillSwitchInterval))
+		}
+	}()
+}
+
+// Stop disarms the switch, blocked traffic flows again at once
+func (k *KillSwitch) Stop() {
+	k.mutex.Lock()
+	if k.cancel != nil {
+		k.cancel()
+		k.cancel = nil
+	}
+	k.mutex.Unlock()
+	k.transition(false, "")
+}
+
+func (k *KillSwitch) wrap(_ string, proxy C.ProxyAdapter) C.ProxyAdapter {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if !k.params.Enable {
+		return proxy
+	}
+	if _, ok := unwrapAdapter(proxy).(C.Group); ok {
+		return proxy
+	}
+	return &killSwitchAdapter{ProxyAdapter: proxy}
+}
+
+// watchedNames returns the groups whose pick decides, the caller holds no lock of the switch
+func watchedNames(groups []string) []string {
+	if len(groups) > 0 {
+		return groups
+	}
+	switch tunnel.Mode() {
+	case tunnel.Global:
+		return []string{"GLOBAL"}
+	case tunnel.Direct:
+		return nil
+	}
+	rules := tunnel.Rules()
+	for i := len(rules) - 1; i >= 0; i-- {
+		if rules[i].RuleType() == C.MATCH {
+			return []string{rules[i].Adapter()}
+		}
+	}
+	return nil
+}
+
+// pickAvailable follows the picks of the groups down to an outbound and asks it for the result of
+// the last test of the group above, a chosen DIRECT is what the user wants and counts as up
+func pickAvailable(proxies map[string]C.Proxy, name string) bool {
+	testUrl := ""
+	for i := 0; i < maxKillSwitchDepth; i++ {
+		proxy, ok := proxies[name]
+		if !ok {
+			return false
+		}
+		switch proxy.Type() {
+		case C.Direct, C.Compatible:
+			return true
+		case C.Reject, C.RejectDrop:
+			return false
+		}
+		group, ok := proxy.(*adapter.Proxy)
+		if !ok {
+			return proxy.AliveForTestUrl(testUrl)
+		}
+		now, ok := group.ProxyAdapter.(interface{ Now() string })
+		if !ok {
+			return proxy.AliveForTestUrl(testUrl)
+		}
+		if url := groupTestUrl(group.ProxyAdapter); url != "" {
+			testUrl = url
+		}
+		if now.Now() == "" {
+			return false
+		}
+		name = now.Now()
+	}
+	return false
+}
+
+func (k *KillSwitch) check() {
+	k.mutex.Lock()
+	params := k.params
+	k.mutex.Unlock()
+	runLock.Lock()
+	running := isRunning && currentConfig != nil
+	runLock.Unlock()
+	if !running {
+		k.transition(false, "")
+		return
+	}
+	if params.RequireTun {
+		if _, up := currentTunConfig(); !up {
+			k.transition(true, "the tun is down")
+			return
+		}
+	}
+	proxies := tunnel.Proxies()
+	for _, name := range watchedNames(params.Groups) {
+		if !pickAvailable(proxies, name) {
+			k.transition(true, name+" has no live proxy")
+			return
+		}
+	}
+	k.transition(false, "")
+}
+
+func (k *KillSwitch) transition(engaged bool, reason string) {
+	k.mutex.Lock()
+	if k.engaged.Load() == engaged && k.reason == reason {
+		k.mutex.Unlock()
+		return
+	}
+	changed := k.engaged.Load() != engaged
+	k.engaged.Store(engaged)
+	k.reason = reason
+	if changed {
+		k.since = time.Now()
+	}
+	status := k.statusLocked()
+	k.mutex.Unlock()
+	if !changed {
+		return
+	}
+	if engaged {
+		log.Warnln("[KillSwitch] engaged, %s", reason)
+		closeLeakingConnections()
+	} else {
+		log.Infoln("[KillSwitch] released")
+	}
+	go sendMessage(Message{
+		Type: KillSwitchMessage,
+		Data: status,
+	})
+}
+
+// closeLeakingConnections ends the connections already out of the lan when the switch engages
+func closeLeakingConnections() {
+	statistic.DefaultManager.Range(func(c statistic.Tracker) bool {
+		metadata := c.Info().Metadata
+		if metadata == nil || !metadata.SrcIP.IsValid() {
+			return true
+		}
+		if metadata.DstIP.IsValid() && lanAddr(metadata.DstIP) {
+			return true
+		}
+		_ = c.Close()
+		return true
+	})
+}
+
+func lanAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified()
+}
+
+// localHostAddr looks a host up in the hosts and the fake-ip mappings only, a query to any
+// upstream would leak while the tunnel is down
+func localHostAddr(host string) (netip.Addr, bool) {
+	if node, ok := resolver.DefaultHosts.Search(host, false); ok {
+		for _, ip := range node.IPs {
+			if lanAddr(ip) {
+				return ip, true
+			}
+		}
+		if len(node.IPs) > 0 {
+			return node.IPs[0], true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// allows lets the probes of the core through, their metadata has no source, and the lan and the
+// login of a captive portal for the apps, a host that does not resolve locally is blocked
+func (k *KillSwitch) allows(metadata *C.Metadata) bool {
+	if !k.engaged.Load() || !metadata.SrcIP.IsValid() {
+		return true
+	}
+	host := metadata.Host
+	if host == "" && metadata.DstIP.IsValid() && resolver.IsFakeIP(metadata.DstIP) {
+		host, _ = resolver.FindHostByIP(metadata.DstIP)
+	}
+	if host != "" && captivePortal.allows(host) {
+		return true
+	}
+	addr := metadata.DstIP
+	if addr.IsValid() && resolver.IsFakeIP(addr) {
+		addr = netip.Addr{}
+	}
+	if !addr.IsValid() && host != "" {
+		if resolved, ok := localHostAddr(host); ok {
+			addr = resolved
+		}
+	}
+	if addr.IsValid() && lanAddr(addr) {
+		return true
+	}
+	k.blocked.Add(1)
+	return false
+}
+
+func (k *KillSwitch) statusLocked() *KillSwitchStatus {
+	state := DisarmedKillSwitch
+	if k.params.Enable {
+		state = ArmedKillSwitch
+	}
+	if k.engaged.Load() {
+		state = EngagedKillSwitch
+	}
+	return &KillSwitchStatus{
+		KillSwitchParams: k.params,
+		State:            state,
+		Reason:           k.reason,
+		Since:            k.since.UnixMilli(),
+		Blocked:          k.blocked.Load(),
+	}
+}
+
+func (k *KillSwitch) Status() *KillSwitchStatus {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.statusLocked()
+}
+
+// killSwitchAdapter refuses the dial, the inbound answers with a reset or drops the packet
+type killSwitchAdapter struct {
+	C.ProxyAdapter
+}
+
+func (a *killSwitchAdapter) Inner() C.ProxyAdapter {
+	return a.ProxyAdapter
+}
+
+func (a *killSwitchAdapter) DialContext(ctx context.Context, metadata *C.Metadata) (C.Conn, error) {
+	if !killSwitch.allows(metadata) {
+		return nil, errKillSwitch
+	}
+	return a.ProxyAdapter.DialContext(ctx, metadata)
+}
+
+func (a *killSwitchAdapter) DialContextWithDialer(ctx context.Context, dialer C.Dialer, metadata *C.Metadata) (C.Conn, error) {
+	if !killSwitch.allows(metadata) {
+		return nil, errKillSwitch
+	}
+	return a.ProxyAdapter.DialContextWithDialer(ctx, dialer, metadata)
+}
+
+func (a *killSwitchAdapter) ListenPacketWithDialer(ctx context.Context, dialer C.Dialer, metadata *C.Metadata) (C.PacketConn, error) {
+	if !killSwitch.allows(metadata) {
+		return nil, errKillSwitch
+	}
+	return a.ProxyAdapter.ListenPacketWithDialer(ctx, dialer, metadata)
+}
+
+func (a *killSwitchAdapter) ListenPacketContext(ctx context.Context, metadata *C.Metadata) (C.PacketConn, error) {
+	if !killSwitch.allows(metadata) {
+		return nil, errKillSwitch
+	}
+	return a.ProxyAdapter.ListenPacketContext(ctx, metadata)
+}
+
+func handleSetKillSwitch(paramsString string) error {
+	params := &KillSwitchParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	killSwitch.Set(params)
+	return nil
+}
+
+func handleGetKillSwitch() string {
+	data, err := json.Marshal(killSwitch.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	lanAclLogSize       = 200
+	lanAclEventInterval = 10 * time.Second
+	lanAclMacCacheTTL   = 30 * time.Second
+)
+
+type LanAclParams struct {
+	Enable bool     `json:"enable"`
+	Cidrs  []string `json:"cidrs"`
+	Macs   []string `json:"macs"`
+}
+
+// LanAclEntryParams adds or removes a single cidr or mac, one of them must be set
+type LanAclEntryParams struct {
+	Cidr string `json:"cidr"`
+	Mac  string `json:"mac"`
+}
+
+// LanAclDenial is a connection from a lan client that is not on the list
+type LanAclDenial struct {
+	Time        int64  `json:"time"`
+	Source      string `json:"source"`
+	Mac         string `json:"mac"`
+	Inbound     string `json:"inbound"`
+	Destination string `json:"destination"`
+}
+
+type lanAclMac struct {
+	mac string
+	at  time.Time
+}
+
+// LanAcl restricts the lan facing inbounds to the listed client cidrs and macs
+type LanAcl struct {
+	mutex     sync.Mutex
+	enable    bool
+	prefixes  []netip.Prefix
+	macs      map[string]struct{}
+	denials   []LanAclDenial
+	notified  map[netip.Addr]time.Time
+	macMutex  sync.Mutex
+	macsCache map[netip.Addr]lanAclMac
+}
+
+var lanAcl = &LanAcl{
+	macs:      map[string]struct{}{},
+	notified:  map[netip.Addr]time.Time{},
+	macsCache: map[netip.Addr]lanAclMac{},
+}
+
+func parseLanAclCidr(value string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(value); err == nil {
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func parseLanAclMac(value string) (string, error) {
+	mac, err := net.ParseMAC(value)
+	if err != nil {
+		return "", err
+	}
+	return mac.String(), nil
+}
+
+func (a *LanAcl) Set(params *LanAclParams) error {
+	prefixes := make([]netip.Prefix, 0, len(params.Cidrs))
+	for _, value := range params.Cidrs {
+		prefix, err := parseLanAclCidr(value)
+		if err != nil {
+			return err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	macs := make(map[string]struct{}, len(params.Macs))
+	for _, value := range params.Macs {
+		mac, err := parseLanAclMac(value)
+		if err != nil {
+			return err
+		}
+		macs[mac] = struct{}{}
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.enable = params.Enable
+	a.prefixes = prefixes
+	a.macs = macs
+	return nil
+}
+
+func (a *LanAcl) Add(params *LanAclEntryParams) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	switch {
+	case params.Cidr != "":
+		prefix, err := parseLanAclCidr(params.Cidr)
+		if err != nil {
+			return err
+		}
+		for _, item := range a.prefixes {
+			if item == prefix {
+				return nil
+			}
+		}
+		a.prefixes = append(a.prefixes, prefix)
+	case params.Mac != "":
+		mac, err := parseLanAclMac(params.Mac)
+		if err != nil {
+			return err
+		}
+		a.macs[mac] = struct{}{}
+	default:
+		return errors.New("cidr or mac is required")
+	}
+	return nil
+}
+
+func (a *LanAcl) Remove(params *LanAclEntryParams) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if params.Cidr != "" {
+		prefix, err := parseLanAclCidr(params.Cidr)
+		if err != nil {
+			return false
+		}
+		for i, item := range a.prefixes {
+			if item == prefix {
+				a.prefixes = append(a.prefixes[:i], a.prefixes[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+	mac, err := parseLanAclMac(params.Mac)
+	if err != nil {
+		return false
+	}
+	if _, ok := a.macs[mac]; !ok {
+		return false
+	}
+	delete(a.macs, mac)
+	return true
+}
+
+func (a *LanAcl) Params() *LanAclParams {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	params := &LanAclParams{
+		Enable: a.enable,
+		Cidrs:  make([]string, 0, len(a.prefixes)),
+		Macs:   make([]string, 0, len(a.macs)),
+	}
+	for _, prefix := range a.prefixes {
+		params.Cidrs = append(params.Cidrs, prefix.String())
+	}
+	for mac := range a.macs {
+		params.Macs = append(params.Macs, mac)
+	}
+	return params
+}
+
+func (a *LanAcl) Denials() []LanAclDenial {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return append([]LanAclDenial{}, a.denials...)
+}
+
+func (a *LanAcl) ClearDenials() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.denials = nil
+	a.notified = map[netip.Addr]time.Time{}
+}
+
+// mac looks the client up in the neighbor table, results are cached since udp checks every packet
+func (a *LanAcl) mac(addr netip.Addr, now time.Time) string {
+	a.macMutex.Lock()
+	defer a.macMutex.Unlock()
+	if cached, ok := a.macsCache[addr]; ok && now.Sub(cached.at) < lanAclMacCacheTTL {
+		return cached.mac
+	}
+	for cachedAddr, cached := range a.macsCache {
+		if now.Sub(cached.at) >= lanAclMacCacheTTL {
+			delete(a.macsCache, cachedAddr)
+		}
+	}
+	mac := lookupNeighborMac(addr)
+	a.macsCache[addr] = lanAclMac{mac: mac, at: now}
+	return mac
+}
+
+// Allow reports whether the source of metadata may use the inbound, loopback clients are always allowed
+func (a *LanAcl) Allow(metadata *constant.Metadata) bool {
+	addr := metadata.SrcIP.Unmap()
+	if !addr.IsValid() || addr.IsLoopback() || addr.IsUnspecified() {
+		return true
+	}
+	a.mutex.Lock()
+	if !a.enable {
+		a.mutex.Unlock()
+		return true
+	}
+	for _, prefix := range a.prefixes {
+		if prefix.Contains(addr) {
+			a.mutex.Unlock()
+			return true
+		}
+	}
+	checkMac := len(a.macs) != 0
+	a.mutex.Unlock()
+	now := time.Now()
+	mac := ""
+	if checkMac {
+		mac = a.mac(addr, now)
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, ok := a.macs[mac]; ok && mac != "" {
+		return true
+	}
+	denial := LanAclDenial{
+		Time:        now.UnixMilli(),
+		Source:      metadata.SourceAddress(),
+		Mac:         mac,
+		Inbound:     metadata.Type.String(),
+		Destination: metadata.RemoteAddress(),
+	}
+	if len(a.denials) >= lanAclLogSize {
+		a.denials = a.denials[1:]
+	}
+	a.denials = append(a.denials, denial)
+	if last, ok := a.notified[addr]; !ok || now.Sub(last) >= lanAclEventInterval {
+		a.notified[addr] = now
+		log.Warnln("[LAN] denied %s %s --> %s", denial.Inbound, denial.Source, denial.Destination)
+		go sendMessage(Message{
+			Type: LanAclDeniedMessage,
+			Data: denial,
+		})
+	}
+	return false
+}
+
+// lanAclTunnel enforces the acl in front of the tunnel for the inbounds reachable from the lan
+type lanAclTunnel struct {
+	constant.Tunnel
+}
+
+var lanTunnel constant.Tunnel = &lanAclTunnel{Tunnel: rewriteTunnel}
+
+func (t *lanAclTunnel) HandleTCPConn(conn net.Conn, metadata *constant.Metadata) {
+	if !lanAcl.Allow(metadata) {
+		_ = conn.Close()
+		return
+	}
+	t.Tunnel.HandleTCPConn(conn, metadata)
+}
+
+func (t *lanAclTunnel) HandleUDPPacket(packet constant.UDPPacket, metadata *constant.Metadata) {
+	if !lanAcl.Allow(metadata) {
+		packet.Drop()
+		return
+	}
+	t.Tunnel.HandleUDPPacket(packet, metadata)
+}
+
+func parseLanAclEntry(paramsString string) (*LanAclEntryParams, error) {
+	var params = &LanAclEntryParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return nil, err
+	}
+	params.Cidr = strings.TrimSpace(params.Cidr)
+	params.Mac = strings.TrimSpace(params.Mac)
+	return params, nil
+}
+
+func handleSetLanAcl(paramsString string) error {
+	var params = &LanAclParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	return lanAcl.Set(params)
+}
+
+func handleGetLanAcl() string {
+	data, err := json.Marshal(lanAcl.Params())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handleAddLanAclEntry(paramsString string) error {
+	params, err := parseLanAclEntry(paramsString)
+	if err != nil {
+		return err
+	}
+	return lanAcl.Add(params)
+}
+
+func handleRemoveLanAclEntry(paramsString string) bool {
+	params, err := parseLanAclEntry(paramsString)
+	if err != nil {
+		return false
+	}
+	return lanAcl.Remove(params)
+}
+
+func handleGetLanAclLog() string {
+	data, err := json.Marshal(lanAcl.Denials())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handleClearLanAclLog() bool {
+	lanAcl.ClearDenials()
+	return true
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// lookupNeighborMac reads the kernel arp table, ipv6 neighbors and restricted /proc on newer Android yield no mac
+func lookupNeighborMac(addr netip.Addr) string {
+	file, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] != addr.String() {
+			continue
+		}
+		if mac, err := net.ParseMAC(fields[3]); err == nil && fields[3] != "00:00:00:00:00:00" {
+			return mac.String()
+		}
+	}
+	return ""
+}
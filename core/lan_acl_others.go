@@ -0,0 +1,39 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+	"net/netip"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+var neighborMacRegexp = regexp.MustCompile(`([0-9A-Fa-f]{1,2}[:-]){5}[0-9A-Fa-f]{1,2}`)
+
+// lookupNeighborMac asks the system arp tool for the client, the output format differs between platforms
+func lookupNeighborMac(addr netip.Addr) string {
+	output, err := exec.Command("arp", "-a", addr.String()).Output()
+	if err != nil {
+		return ""
+	}
+	match := neighborMacRegexp.FindString(string(output))
+	if match == "" {
+		return ""
+	}
+	// macOS prints octets without leading zeros
+	octets := strings.FieldsFunc(match, func(r rune) bool {
+		return r == ':' || r == '-'
+	})
+	for i, octet := range octets {
+		if len(octet) == 1 {
+			octets[i] = "0" + octet
+		}
+	}
+	mac, err := net.ParseMAC(strings.Join(octets, ":"))
+	if err != nil {
+		return ""
+	}
+	return mac.String()
+}
@@ -66,13 +66,23 @@ func invokeAction(paramsChar *C.char, port C.longlong) {
 }
 
 func sendMessage(message Message) {
+	grpcServer.Publish(message)
+	triggers.Publish(message)
+	remote.Publish(message)
+	if eventBus.PublishMessage(message) {
+		return
+	}
+	postMessage(message)
+}
+
+func postMessage(message Message) {
 	if messagePort == -1 {
 		return
 	}
 	result := ActionResult{
 		Method: messageMethod,
 		Port:   messagePort,
-		Data:   message,
+		Data:   bridgeEncoding.Message(message),
 	}
 	result.send()
 }
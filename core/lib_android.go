@@ -19,10 +19,12 @@ import (
 	"github.com/metacubex/mihomo/listener/sing_tun"
 	"github.com/metacubex/mihomo/log"
 	"golang.org/x/sync/semaphore"
+	"golang.org/x/sys/unix"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
@@ -31,6 +33,8 @@ import (
 type TunHandler struct {
 	listener *sing_tun.Listener
 	callback unsafe.Pointer
+	fd       int
+	done     chan struct{}
 
 	limit *semaphore.Weighted
 }
@@ -38,7 +42,10 @@ type TunHandler struct {
 func (t *TunHandler) close() {
 	_ = t.limit.Acquire(context.TODO(), 4)
 	defer t.limit.Release(4)
-	removeTunHook()
+	if t.done != nil {
+		close(t.done)
+		t.done = nil
+	}
 	if t.listener != nil {
 		_ = t.listener.Close()
 	}
@@ -68,6 +75,10 @@ func (t *TunHandler) handleResolveProcess(source, target net.Addr) string {
 	if t.listener == nil {
 		return ""
 	}
+	return resolveSocketProcess(t.callback, source, target)
+}
+
+func resolveSocketProcess(callback unsafe.Pointer, source, target net.Addr) string {
 	var protocol int
 	uid := -1
 	switch source.Network() {
@@ -79,7 +90,7 @@ func (t *TunHandler) handleResolveProcess(source, target net.Addr) string {
 	if version < 29 {
 		uid = platform.QuerySocketUidFromProcFs(source, target)
 	}
-	return ResolveProcess(t.callback, protocol, source.String(), target.String(), uid)
+	return ResolveProcess(callback, protocol, source.String(), target.String(), uid)
 }
 
 var (
@@ -87,37 +98,98 @@ var (
 	runTime    *time.Time
 	errBlocked = errors.New("blocked")
 	tunHandler *TunHandler
+	// hookHandler mirrors tunHandler for the socket hook, which must never wait on tunLock
+	hookHandler atomic.Pointer[TunHandler]
+	// tunSession numbers startTUN and stopTun in call order, appliedTunSession is the last one handled
+	tunSession        atomic.Uint64
+	appliedTunSession uint64
 )
 
-func handleStopTun() {
-	tunLock.Lock()
-	defer tunLock.Unlock()
+// acceptTunSession drops a call that a later startTUN or stopTun has already overtaken
+func acceptTunSession(session uint64) bool {
+	if session < appliedTunSession {
+		return false
+	}
+	appliedTunSession = session
+	return true
+}
+
+func stopTunLocked() {
 	runTime = nil
+	hookHandler.Store(nil)
 	if tunHandler != nil {
 		tunHandler.close()
+		tunHandler = nil
 	}
+	removeTunHook()
 }
 
-func handleStartTun(fd int, callback unsafe.Pointer) {
-	handleStopTun()
+func handleStopTun(session uint64) {
 	tunLock.Lock()
 	defer tunLock.Unlock()
+	if !acceptTunSession(session) {
+		return
+	}
+	stopTunLocked()
+	go publishTunState()
+}
+
+// handleStartTun brings the new fd up before the running session goes away, a VpnService restart
+// never leaves a window without a listener
+func handleStartTun(session uint64, fd int, callback unsafe.Pointer) {
+	tunLock.Lock()
+	defer tunLock.Unlock()
+	if !acceptTunSession(session) {
+		log.Warnln("[TUN] drop the fd %d of an overtaken start", fd)
+		if fd != 0 {
+			_ = unix.Close(fd)
+		}
+		if callback != nil {
+			releaseObject(callback)
+		}
+		return
+	}
 	now := time.Now()
-	runTime = &now
-	if fd != 0 {
-		tunHandler = &TunHandler{
-			callback: callback,
-			limit:    semaphore.NewWeighted(4),
+	if fd == 0 || currentConfig == nil {
+		if fd != 0 {
+			log.Errorln("[TUN] start on fd %d error: no config is applied", fd)
+			_ = unix.Close(fd)
 		}
-		initTunHook()
-		tunListener, _ := t.Start(fd, currentConfig.General.Tun.Device, currentConfig.General.Tun.Stack)
-		if tunListener != nil {
-			log.Infoln("TUN address: %v", tunListener.Address())
-			tunHandler.listener = tunListener
-		} else {
-			removeTunHook()
+		stopTunLocked()
+		if callback != nil {
+			releaseObject(callback)
 		}
+		runTime = &now
+		go publishTunState()
+		return
+	}
+	handler := &TunHandler{
+		callback: callback,
+		fd:       fd,
+		done:     make(chan struct{}),
+		limit:    semaphore.NewWeighted(4),
+	}
+	initTunHook()
+	tunListener, err := t.Start(fd, currentConfig.General.Tun.Device, currentConfig.General.Tun.Stack, tunTunnel)
+	if tunListener == nil {
+		log.Errorln("[TUN] start on fd %d error: %v", fd, err)
+		handler.close()
+		stopTunLocked()
+		runTime = &now
+		go publishTunState()
+		return
+	}
+	log.Infoln("TUN address: %v", tunListener.Address())
+	handler.listener = tunListener
+	previous := tunHandler
+	tunHandler = handler
+	hookHandler.Store(handler)
+	if previous != nil {
+		previous.close()
 	}
+	runTime = &now
+	go watchTunRevoke(handler, handler.done)
+	go publishTunState()
 }
 
 func handleGetRunTime() string {
@@ -133,7 +205,12 @@ func initTunHook() {
 			return errBlocked
 		}
 		return conn.Control(func(fd uintptr) {
-			tunHandler.handleProtect(int(fd))
+			if protector.protect(int(fd)) {
+				return
+			}
+			if handler := hookHandler.Load(); handler != nil {
+				handler.handleProtect(int(fd))
+			}
 		})
 	}
 	process.DefaultPackageNameResolver = func(metadata *constant.Metadata) (string, error) {
@@ -141,11 +218,19 @@ func initTunHook() {
 		if src == nil || dst == nil {
 			return "", process.ErrInvalidNetwork
 		}
-		return tunHandler.handleResolveProcess(src, dst), nil
+		if handler := hookHandler.Load(); handler != nil {
+			return handler.handleResolveProcess(src, dst), nil
+		}
+		return protector.resolveProcess(src, dst), nil
 	}
 }
 
+// removeTunHook keeps the hook while a protector is registered, sockets between two sessions still
+// have to leave the VpnService
 func removeTunHook() {
+	if protector.registered() {
+		return
+	}
 	dialer.DefaultSocketHook = nil
 	process.DefaultPackageNameResolver = nil
 }
@@ -153,6 +238,9 @@ func removeTunHook() {
 func handleGetAndroidVpnOptions() string {
 	tunLock.Lock()
 	defer tunLock.Unlock()
+	if currentConfig == nil {
+		return ""
+	}
 	options := state.AndroidVpnOptions{
 		Enable:           state.CurrentState.VpnProps.Enable,
 		Port:             currentConfig.General.MixedPort,
@@ -178,6 +266,8 @@ func handleUpdateDns(value string) {
 		log.Infoln("[DNS] updateDns %s", value)
 		dns.UpdateSystemDNS(strings.Split(value, ","))
 		dns.FlushCacheWithDefaultResolver()
+		// the app sends the dns of every network it sees, netlink is closed to apps on android
+		networkMonitor.Notify("connectivity")
 	}()
 }
 
@@ -226,12 +316,18 @@ func quickStart(initParamsChar *C.char, paramsChar *C.char, stateParamsChar *C.c
 
 //export startTUN
 func startTUN(fd C.int, callback unsafe.Pointer) bool {
+	session := tunSession.Add(1)
 	go func() {
-		handleStartTun(int(fd), callback)
+		handleStartTun(session, int(fd), callback)
 	}()
 	return true
 }
 
+//export setProtector
+func setProtector(callback unsafe.Pointer) {
+	handleSetProtector(callback)
+}
+
 //export getRunTime
 func getRunTime() *C.char {
 	return C.CString(handleGetRunTime())
@@ -239,8 +335,9 @@ func getRunTime() *C.char {
 
 //export stopTun
 func stopTun() {
+	session := tunSession.Add(1)
 	go func() {
-		handleStopTun()
+		handleStopTun(session)
 	}()
 }
 
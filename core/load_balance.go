@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/metacubex/mihomo/adapter"
+	"github.com/metacubex/mihomo/adapter/outboundgroup"
+	"github.com/metacubex/mihomo/config"
+	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	"hash/fnv"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+type LoadBalanceStrategy string
+
+const (
+	ConsistentHashingStrategy  LoadBalanceStrategy = "consistent-hashing"
+	RoundRobinStrategy         LoadBalanceStrategy = "round-robin"
+	StickySessionsStrategy     LoadBalanceStrategy = "sticky-sessions"
+	LeastConnectionsStrategy   LoadBalanceStrategy = "least-connections"
+	WeightedRoundRobinStrategy LoadBalanceStrategy = "weighted-round-robin"
+
+	loadBalanceWeightsKey = "weights"
+)
+
+// LoadBalanceOption picks the strategy of a load-balance group, weights default to 1 per member
+type LoadBalanceOption struct {
+	Strategy LoadBalanceStrategy `json:"strategy"`
+	Weights  map[string]int      `json:"weights"`
+}
+
+// LoadBalanceParams overrides the strategy of the profile groups by name
+type LoadBalanceParams struct {
+	Groups map[string]*LoadBalanceOption `json:"groups"`
+}
+
+type LoadBalanceMember struct {
+	Weight int   `json:"weight"`
+	Active int64 `json:"active"`
+	Alive  bool  `json:"alive"`
+}
+
+type LoadBalanceGroup struct {
+	LoadBalanceOption
+	Members map[string]*LoadBalanceMember `json:"members"`
+}
+
+// LoadBalancing runs the strategies mihomo lacks in front of its load-balance groups, a profile
+// names them in the strategy key and the group is built with round-robin underneath
+type LoadBalancing struct {
+	mutex     sync.Mutex
+	profile   map[string]*LoadBalanceOption
+	overrides map[string]*LoadBalanceOption
+	states    map[string]*loadBalanceState
+}
+
+var loadBalancing = &LoadBalancing{
+	profile:   map[string]*LoadBalanceOption{},
+	overrides: map[string]*LoadBalanceOption{},
+	states:    map[string]*loadBalanceState{},
+}
+
+func checkLoadBalanceStrategy(strategy LoadBalanceStrategy) error {
+	switch strategy {
+	case ConsistentHashingStrategy, RoundRobinStrategy, StickySessionsStrategy, LeastConnectionsStrategy, WeightedRoundRobinStrategy:
+		return nil
+	default:
+		return fmt.Errorf("unknown load balance strategy %s", strategy)
+	}
+}
+
+// handledByCore tells whether the core has to pick the members, the native strategies of a
+// profile stay in mihomo unless weights are set
+func (o *LoadBalanceOption) handledByCore() bool {
+	switch o.Strategy {
+	case LeastConnectionsStrategy, WeightedRoundRobinStrategy:
+		return true
+	default:
+		return len(o.Weights) != 0
+	}
+}
+
+func rawLoadBalanceWeights(value any) map[string]int {
+	weights := map[string]int{}
+	mapping, ok := value.(map[string]any)
+	if !ok {
+		return weights
+	}
+	for name, weight := range mapping {
+		switch weight := weight.(type) {
+		case int:
+			weights[name] = weight
+		case uint64:
+			weights[name] = int(weight)
+		case float64:
+			weights[name] = int(weight)
+		}
+	}
+	return weights
+}
+
+// Prepare reads the strategies of the profile groups and hands mihomo one it knows
+func (l *LoadBalancing) Prepare(rawConfig *config.RawConfig) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.profile = map[string]*LoadBalanceOption{}
+	for _, mapping := range rawConfig.ProxyGroup {
+		name, _ := mapping["name"].(string)
+		if groupType, _ := mapping["type"].(string); name == "" || groupType != "load-balance" {
+			continue
+		}
+		strategy, _ := mapping["strategy"].(string)
+		option := &LoadBalanceOption{
+			Strategy: LoadBalanceStrategy(strategy),
+			Weights:  rawLoadBalanceWeights(mapping[loadBalanceWeightsKey]),
+		}
+		delete(mapping, loadBalanceWeightsKey)
+		if option.Strategy == "" {
+			option.Strategy = ConsistentHashingStrategy
+		}
+		if err := checkLoadBalanceStrategy(option.Strategy); err != nil {
+			continue
+		}
+		if option.Strategy == LeastConnectionsStrategy || option.Strategy == WeightedRoundRobinStrategy {
+			mapping["strategy"] = string(RoundRobinStrategy)
+		}
+		l.profile[name] = option
+	}
+}
+
+// optionLocked returns the option of a group, a runtime override always runs in the core since
+// the group was built with the strategy of the profile
+func (l *LoadBalancing) optionLocked(name string) (*LoadBalanceOption, bool) {
+	if option, ok := l.overrides[name]; ok {
+		return option, true
+	}
+	option := l.profile[name]
+	return option, option != nil && option.handledByCore()
+}
+
+func (l *LoadBalancing) Set(params *LoadBalanceParams) error {
+	overrides := map[string]*LoadBalanceOption{}
+	if params != nil {
+		for name, option := range params.Groups {
+			if option == nil {
+				continue
+			}
+			if err := checkLoadBalanceStrategy(option.Strategy); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			overrides[name] = option
+		}
+	}
+	runLock.Lock()
+	defer runLock.Unlock()
+	l.mutex.Lock()
+	l.overrides = overrides
+	l.mutex.Unlock()
+	rewrapOutboundsLocked()
+	return nil
+}
+
+// wrap puts the strategy of the core in front of a load-balance group that needs it, the active
+// connections of a group survive the rewrap
+func (l *LoadBalancing) wrap(name string, proxy C.ProxyAdapter) C.ProxyAdapter {
+	if _, ok := proxy.(*outboundgroup.LoadBalance); !ok {
+		return proxy
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	option, handled := l.optionLocked(name)
+	if !handled {
+		return proxy
+	}
+	state, ok := l.states[name]
+	if !ok {
+		state = &loadBalanceState{active: map[string]*atomic.Int64{}, current: map[string]int{}}
+		l.states[name] = state
+	}
+	testUrl := ""
+	if data, err := proxy.MarshalJSON(); err == nil {
+		var snapshot struct {
+			TestUrl string `json:"testUrl"`
+		}
+		_ = json.Unmarshal(data, &snapshot)
+		testUrl = snapshot.TestUrl
+	}
+	return &loadBalanceAdapter{ProxyAdapter: proxy, option: option, state: state, testUrl: testUrl}
+}
+
+func (l *LoadBalancing) Status() map[string]*LoadBalanceGroup {
+	runLock.Lock()
+	defer runLock.Unlock()
+	status := map[string]*LoadBalanceGroup{}
+	for name, proxy := range tunnel.Proxies() {
+		outbound, ok := proxy.(*adapter.Proxy)
+		if !ok {
+			continue
+		}
+		wrapped, ok := findWrapped[*loadBalanceAdapter](outbound.ProxyAdapter)
+		if !ok {
+			continue
+		}
+		group := &LoadBalanceGroup{LoadBalanceOption: *wrapped.option, Members: map[string]*LoadBalanceMember{}}
+		for _, member := range wrapped.members(false) {
+			group.Members[member.Name()] = &LoadBalanceMember{
+				Weight: wrapped.weight(member),
+				Active: wrapped.state.counter(member.Name()).Load(),
+				Alive:  member.AliveForTestUrl(wrapped.testUrl),
+			}
+		}
+		status[name] = group
+	}
+	return status
+}
+
+type loadBalanceState struct {
+	mutex   sync.Mutex
+	active  map[string]*atomic.Int64
+	current map[string]int
+}
+
+func (s *loadBalanceState) counter(name string) *atomic.Int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	counter, ok := s.active[name]
+	if !ok {
+		counter = &atomic.Int64{}
+		s.active[name] = counter
+	}
+	return counter
+}
+
+type loadBalanceAdapter struct {
+	C.ProxyAdapter
+	option  *LoadBalanceOption
+	state   *loadBalanceState
+	testUrl string
+}
+
+func (a *loadBalanceAdapter) Inner() C.ProxyAdapter {
+	return a.ProxyAdapter
+}
+
+func (a *loadBalanceAdapter) members(touch bool) []C.Proxy {
+	group, ok := a.ProxyAdapter.(interface{ GetProxies(touch bool) []C.Proxy })
+	if !ok {
+		return nil
+	}
+	return group.GetProxies(touch)
+}
+
+func (a *loadBalanceAdapter) weight(proxy C.Proxy) int {
+	if weight, ok := a.option.Weights[proxy.Name()]; ok {
+		if weight < 0 {
+			return 0
+		}
+		return weight
+	}
+	return 1
+}
+
+// candidates are the alive members with a weight, every member when none of them is alive
+func (a *loadBalanceAdapter) candidates(touch bool) []C.Proxy {
+	members := a.members(touch)
+	candidates := make([]C.Proxy, 0, len(members))
+	for _, member := range members {
+		if a.weight(member) > 0 && member.AliveForTestUrl(a.testUrl) {
+			candidates = append(candidates, member)
+		}
+	}
+	if len(candidates) == 0 {
+		return members
+	}
+	return candidates
+}
+
+func loadBalanceKey(metadata *C.Metadata) string {
+	if metadata == nil {
+		return ""
+	}
+	if metadata.Host != "" {
+		return metadata.Host
+	}
+	if metadata.DstIP.IsValid() {
+		return metadata.DstIP.String()
+	}
+	return ""
+}
+
+// pickHashed is weighted rendezvous hashing, a destination keeps its member as long as it is alive
+// and only the destinations of a member that went away move
+func (a *loadBalanceAdapter) pickHashed(candidates []C.Proxy, key string) C.Proxy {
+	var (
+		best  C.Proxy
+		score = math.Inf(-1)
+	)
+	for _, candidate := range candidates {
+		hash := fnv.New64a()
+		_, _ = hash.Write([]byte(key))
+		_, _ = hash.Write([]byte{0})
+		_, _ = hash.Write([]byte(candidate.Name()))
+		// map the hash into (0, 1) so the log never sees 0
+		unit := (float64(hash.Sum64()>>11) + 0.5) / float64(1<<53)
+		weight := float64(a.weight(candidate))
+		if weight <= 0 {
+			weight = 1
+		}
+		if current := -weight / math.Log(unit); current > score {
+			best, score = candidate, current
+		}
+	}
+	return best
+}
+
+// pickRoundRobin is the smooth weighted round-robin of nginx
+func (a *loadBalanceAdapter) pickRoundRobin(candidates []C.Proxy) C.Proxy {
+	a.state.mutex.Lock()
+	defer a.state.mutex.Unlock()
+	var (
+		best  C.Proxy
+		total int
+	)
+	for _, candidate := range candidates {
+		weight := a.weight(candidate)
+		if weight <= 0 {
+			weight = 1
+		}
+		total += weight
+		a.state.current[candidate.Name()] += weight
+		if best == nil || a.state.current[candidate.Name()] > a.state.current[best.Name()] {
+			best = candidate
+		}
+	}
+	a.state.current[best.Name()] -= total
+	return best
+}
+
+// pickLeastConnections takes the member with the fewest active connections for its weight
+func (a *loadBalanceAdapter) pickLeastConnections(candidates []C.Proxy) C.Proxy {
+	var (
+		best      C.Proxy
+		bestScore float64
+	)
+	for _, candidate := range candidates {
+		weight := a.weight(candidate)
+		if weight <= 0 {
+			weight = 1
+		}
+		score := float64(a.state.counter(candidate.Name()).Load()+1) / float64(weight)
+		if best == nil || score < bestScore {
+			best, bestScore = candidate, score
+		}
+	}
+	return best
+}
+
+func (a *loadBalanceAdapter) Unwrap(metadata *C.Metadata, touch bool) C.Proxy {
+	candidates := a.candidates(touch)
+	if len(candidates) == 0 {
+		return a.ProxyAdapter.Unwrap(metadata, touch)
+	}
+	switch a.option.Strategy {
+	case LeastConnectionsStrategy:
+		return a.pickLeastConnections(candidates)
+	case ConsistentHashingStrategy:
+		return a.pickHashed(candidates, loadBalanceKey(metadata))
+	case StickySessionsStrategy:
+		source := ""
+		if metadata != nil {
+			source = metadata.SrcIP.String()
+		}
+		return a.pickHashed(candidates, source+"-"+loadBalanceKey(metadata))
+	default:
+		return a.pickRoundRobin(candidates)
+	}
+}
+
+func (a *loadBalanceAdapter) DialContext(ctx context.Context, metadata *C.Metadata) (C.Conn, error) {
+	proxy := a.Unwrap(metadata, true)
+	if proxy == nil {
+		return a.ProxyAdapter.DialContext(ctx, metadata)
+	}
+	conn, err := proxy.DialContext(ctx, metadata)
+	if err != nil {
+		log.Debugln("[LoadBalance] %s dial through %s failed: %v", a.Name(), proxy.Name(), err)
+		return nil, err
+	}
+	conn.AppendToChains(a)
+	counter := a.state.counter(proxy.Name())
+	counter.Add(1)
+	return &loadBalanceConn{Conn: conn, active: counter}, nil
+}
+
+func (a *loadBalanceAdapter) ListenPacketContext(ctx context.Context, metadata *C.Metadata) (C.PacketConn, error) {
+	proxy := a.Unwrap(metadata, true)
+	if proxy == nil {
+		return a.ProxyAdapter.ListenPacketContext(ctx, metadata)
+	}
+	pc, err := proxy.ListenPacketContext(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+	pc.AppendToChains(a)
+	counter := a.state.counter(proxy.Name())
+	counter.Add(1)
+	return &loadBalancePacketConn{PacketConn: pc, active: counter}, nil
+}
+
+// loadBalanceConn counts the connection of a member until it is closed
+type loadBalanceConn struct {
+	C.Conn
+	active *atomic.Int64
+	once   sync.Once
+}
+
+func (c *loadBalanceConn) Close() error {
+	c.once.Do(func() {
+		c.active.Add(-1)
+	})
+	return c.Conn.Close()
+}
+
+func (c *loadBalanceConn) Upstream() any {
+	return c.Conn
+}
+
+func (c *loadBalanceConn) ReaderReplaceable() bool {
+	return true
+}
+
+func (c *loadBalanceConn) WriterReplaceable() bool {
+	return true
+}
+
+type loadBalancePacketConn struct {
+	C.PacketConn
+	active *atomic.Int64
+	once   sync.Once
+}
+
+func (c *loadBalancePacketConn) Close() error {
+	c.once.Do(func() {
+		c.active.Add(-1)
+	})
+	return c.PacketConn.Close()
+}
+
+func (c *loadBalancePacketConn) Upstream() any {
+	return c.PacketConn
+}
+
+func handleSetLoadBalance(paramsString string) error {
+	var params = &LoadBalanceParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	return loadBalancing.Set(params)
+}
+
+func handleGetLoadBalance() string {
+	data, err := json.Marshal(loadBalancing.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	logPipelineDir      = "logs"
+	logPipelineFile     = "core.log"
+	defaultLogCapacity  = 1000
+	defaultLogFileSize  = 1 << 20
+	defaultLogFileCount = 3
+	defaultLogModule    = "core"
+	maxLogModuleNameLen = 32
+	logFileLineSize     = 64 * 1024
+)
+
+// LogEntry is a structured log line, Module is taken from the bracketed prefix mihomo and the core use
+type LogEntry struct {
+	Seq     uint64       `json:"seq"`
+	Time    int64        `json:"time"`
+	Level   log.LogLevel `json:"level"`
+	Module  string       `json:"module"`
+	Message string       `json:"message"`
+}
+
+type LogQueryParams struct {
+	Since  uint64        `json:"since"`
+	Level  *log.LogLevel `json:"level"`
+	Module string        `json:"module"`
+	Limit  int           `json:"limit"`
+}
+
+type ModuleLogLevelParams struct {
+	Module string        `json:"module"`
+	Level  *log.LogLevel `json:"level"`
+}
+
+type LogLevels struct {
+	Global  log.LogLevel            `json:"global"`
+	Modules map[string]log.LogLevel `json:"modules"`
+}
+
+// LogFileParams enables the encrypted rotating files, one base64 line per entry
+type LogFileParams struct {
+	Enable   bool  `json:"enable"`
+	MaxSize  int64 `json:"max-size"`
+	MaxFiles int   `json:"max-files"`
+}
+
+type LogFileStatus struct {
+	LogFileParams
+	Size  int64  `json:"size"`
+	Error string `json:"error,omitempty"`
+}
+
+// LogPipeline keeps every log event of the core in a ring buffer and optionally in rotating files
+type LogPipeline struct {
+	mutex     sync.Mutex
+	startOnce sync.Once
+	entries   []LogEntry
+	next      int
+	full      bool
+	seq       uint64
+	levels    map[string]log.LogLevel
+	forward   atomic.Bool
+	fileMutex sync.Mutex
+	file      LogFileParams
+	writer    *os.File
+	size      int64
+	fileError string
+}
+
+var logPipeline = &LogPipeline{
+	entries: make([]LogEntry, defaultLogCapacity),
+	levels:  map[string]log.LogLevel{},
+	file: LogFileParams{
+		MaxSize:  defaultLogFileSize,
+		MaxFiles: defaultLogFileCount,
+	},
+}
+
+// Start subscribes to the log once, errors of the pipeline itself are kept in the status to avoid a log loop
+func (p *LogPipeline) Start() {
+	p.startOnce.Do(func() {
+		subscriber := log.Subscribe()
+		go func() {
+			for event := range subscriber {
+				runGuarded("log", func() {
+					p.handle(event)
+				})
+			}
+		}()
+	})
+}
+
+func logModule(payload string) (string, string) {
+	if !strings.HasPrefix(payload, "[") {
+		return defaultLogModule, payload
+	}
+	end := strings.IndexByte(payload, ']')
+	if end <= 1 || end > maxLogModuleNameLen {
+		return defaultLogModule, payload
+	}
+	return strings.ToLower(payload[1:end]), strings.TrimSpace(payload[end+1:])
+}
+
+func (p *LogPipeline) levelLocked(module string) log.LogLevel {
+	if level, ok := p.levels[module]; ok {
+		return level
+	}
+	return log.Level()
+}
+
+func (p *LogPipeline) handle(event log.Event) {
+	module, message := logModule(event.Payload)
+	p.mutex.Lock()
+	if event.LogLevel < p.levelLocked(module) {
+		p.mutex.Unlock()
+		return
+	}
+	p.seq++
+	entry := LogEntry{
+		Seq:     p.seq,
+		Time:    time.Now().UnixMilli(),
+		Level:   event.LogLevel,
+		Module:  module,
+		Message: message,
+	}
+	p.entries[p.next] = entry
+	p.next = (p.next + 1) % len(p.entries)
+	if p.next == 0 {
+		p.full = true
+	}
+	p.mutex.Unlock()
+	if p.forward.Load() {
+		sendMessage(Message{
+			Type: LogMessage,
+			Data: event,
+		})
+	}
+	p.write(&entry)
+}
+
+// Entries returns the buffered entries oldest first that match the query
+func (p *LogPipeline) Entries(params *LogQueryParams) []LogEntry {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	entries := make([]LogEntry, 0)
+	start := 0
+	count := p.next
+	if p.full {
+		start = p.next
+		count = len(p.entries)
+	}
+	module := strings.ToLower(params.Module)
+	for i := 0; i < count; i++ {
+		entry := p.entries[(start+i)%len(p.entries)]
+		if entry.Seq <= params.Since {
+			continue
+		}
+		if params.Level != nil && entry.Level < *params.Level {
+			continue
+		}
+		if module != "" && entry.Module != module {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if params.Limit > 0 && len(entries) > params.Limit {
+		entries = entries[len(entries)-params.Limit:]
+	}
+	return entries
+}
+
+// Resize changes the capacity, the newest entries are kept
+func (p *LogPipeline) Resize(capacity int) {
+	if capacity <= 0 {
+		capacity = defaultLogCapacity
+	}
+	entries := p.Entries(&LogQueryParams{})
+	if len(entries) > capacity {
+		entries = entries[len(entries)-capacity:]
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.entries = make([]LogEntry, capacity)
+	p.next = copy(p.entries, entries) % capacity
+	p.full = len(entries) == capacity
+}
+
+func (p *LogPipeline) Clear() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.entries = make([]LogEntry, len(p.entries))
+	p.next = 0
+	p.full = false
+}
+
+// SetModuleLevel overrides the level of one module, a nil level returns it to the global level
+func (p *LogPipeline) SetModuleLevel(params *ModuleLogLevelParams) error {
+	module := strings.ToLower(strings.TrimSpace(params.Module))
+	if module == "" {
+		return errors.New("log module is required")
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if params.Level == nil {
+		delete(p.levels, module)
+		return nil
+	}
+	p.levels[module] = *params.Level
+	return nil
+}
+
+func (p *LogPipeline) Levels() LogLevels {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	levels := LogLevels{
+		Global:  log.Level(),
+		Modules: make(map[string]log.LogLevel, len(p.levels)),
+	}
+	for module, level := range p.levels {
+		levels.Modules[module] = level
+	}
+	return levels
+}
+
+func (p *LogPipeline) dir() string {
+	return constant.Path.Resolve(logPipelineDir)
+}
+
+func (p *LogPipeline) filePath(index int) string {
+	if index == 0 {
+		return filepath.Join(p.dir(), logPipelineFile)
+	}
+	return filepath.Join(p.dir(), strings.TrimSuffix(logPipelineFile, ".log")+"."+strconv.Itoa(index)+".log")
+}
+
+func (p *LogPipeline) SetFile(params *LogFileParams) error {
+	if params.MaxSize <= 0 {
+		params.MaxSize = defaultLogFileSize
+	}
+	if params.MaxFiles <= 0 {
+		params.MaxFiles = defaultLogFileCount
+	}
+	if params.Enable && getEncryptionService() == nil {
+		return errNoKeyProvider
+	}
+	p.fileMutex.Lock()
+	defer p.fileMutex.Unlock()
+	p.file = *params
+	p.fileError = ""
+	if !params.Enable {
+		p.closeLocked()
+	}
+	return nil
+}
+
+func (p *LogPipeline) FileStatus() LogFileStatus {
+	p.fileMutex.Lock()
+	defer p.fileMutex.Unlock()
+	return LogFileStatus{
+		LogFileParams: p.file,
+		Size:          p.size,
+		Error:         p.fileError,
+	}
+}
+
+func (p *LogPipeline) closeLocked() {
+	if p.writer != nil {
+		_ = p.writer.Close()
+		p.writer = nil
+	}
+	p.size = 0
+}
+
+func (p *LogPipeline) openLocked() error {
+	if err := os.MkdirAll(p.dir(), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(p.filePath(0), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	p.writer = file
+	p.size = info.Size()
+	return nil
+}
+
+// rotateLocked shifts core.log to core.1.log and so on, the oldest file beyond MaxFiles is dropped
+func (p *LogPipeline) rotateLocked() error {
+	p.closeLocked()
+	_ = os.Remove(p.filePath(p.file.MaxFiles - 1))
+	for i := p.file.MaxFiles - 2; i >= 0; i-- {
+		if err := os.Rename(p.filePath(i), p.filePath(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return p.openLocked()
+}
+
+func (p *LogPipeline) write(entry *LogEntry) {
+	p.fileMutex.Lock()
+	defer p.fileMutex.Unlock()
+	if !p.file.Enable || getEncryptionService() == nil || !isInit {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	encrypted, err := getEncryptionService().Encrypt(data)
+	if err != nil {
+		p.fileError = err.Error()
+		return
+	}
+	line := base64.StdEncoding.EncodeToString(encrypted) + "\n"
+	if p.writer == nil {
+		if err = p.openLocked(); err != nil {
+			p.fileError = err.Error()
+			return
+		}
+	}
+	if p.size > 0 && p.size+int64(len(line)) > p.file.MaxSize {
+		if err = p.rotateLocked(); err != nil {
+			p.fileError = err.Error()
+			return
+		}
+	}
+	n, err := p.writer.WriteString(line)
+	p.size += int64(n)
+	if err != nil {
+		p.fileError = err.Error()
+	}
+}
+
+// Export decrypts the log files oldest first into json lines for a bug report
+func (p *LogPipeline) Export() (string, error) {
+	if getEncryptionService() == nil {
+		return "", errNoKeyProvider
+	}
+	p.fileMutex.Lock()
+	defer p.fileMutex.Unlock()
+	var buffer bytes.Buffer
+	for i := p.file.MaxFiles - 1; i >= 0; i-- {
+		file, err := os.Open(p.filePath(i))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, logFileLineSize), 4*logFileLineSize)
+		for scanner.Scan() {
+			encrypted, err := base64.StdEncoding.DecodeString(scanner.Text())
+			if err != nil {
+				continue
+			}
+			data, err := getEncryptionService().Decrypt(encrypted)
+			if err != nil {
+				continue
+			}
+			buffer.Write(data)
+			buffer.WriteByte('\n')
+		}
+		_ = file.Close()
+	}
+	return buffer.String(), nil
+}
+
+// CloseFile closes the current log file, called on shutdown
+func (p *LogPipeline) CloseFile() {
+	p.fileMutex.Lock()
+	defer p.fileMutex.Unlock()
+	p.closeLocked()
+}
+
+// ClearFiles removes all log files, a new one is opened by the next entry
+func (p *LogPipeline) ClearFiles() error {
+	p.fileMutex.Lock()
+	defer p.fileMutex.Unlock()
+	p.closeLocked()
+	for i := 0; i < p.file.MaxFiles; i++ {
+		if err := os.Remove(p.filePath(i)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func handleGetLogs(paramsString string) string {
+	var params = &LogQueryParams{}
+	if paramsString != "" {
+		if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+			return ""
+		}
+	}
+	data, err := json.Marshal(logPipeline.Entries(params))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handleSetModuleLogLevel(paramsString string) error {
+	var params = &ModuleLogLevelParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	return logPipeline.SetModuleLevel(params)
+}
+
+func handleGetLogLevels() string {
+	data, err := json.Marshal(logPipeline.Levels())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handleSetLogFile(paramsString string) error {
+	var params = &LogFileParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	return logPipeline.SetFile(params)
+}
+
+func handleGetLogFile() string {
+	data, err := json.Marshal(logPipeline.FileStatus())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handleExportLogs() (string, error) {
+	return logPipeline.Export()
+}
+
+func handleClearLogs() error {
+	logPipeline.Clear()
+	return logPipeline.ClearFiles()
+}
+
+func handleSetLogCapacity(capacityString string) bool {
+	capacity, err := strconv.Atoi(capacityString)
+	if err != nil {
+		return false
+	}
+	logPipeline.Resize(capacity)
+	return true
+}
@@ -13,5 +13,19 @@ func main() {
 		fmt.Println("Arguments error")
 		os.Exit(1)
 	}
+	var run func(args []string) error
+	switch args[1] {
+	case daemonCommand:
+		run = runDaemon
+	case tunHelperCommand:
+		run = runTunHelper
+	}
+	if run != nil {
+		if err := run(args[2:]); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
 	startServer(args[1])
 }
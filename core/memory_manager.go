@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/component/resolver"
+	"github.com/metacubex/mihomo/log"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+type MemoryPressure string
+
+const (
+	NoMemoryPressure       MemoryPressure = "normal"
+	ModerateMemoryPressure MemoryPressure = "moderate"
+	CriticalMemoryPressure MemoryPressure = "critical"
+
+	// the collection targets while the platform reports pressure
+	moderateGCPercent = 50
+	criticalGCPercent = 25
+	maxBallastMB      = 256
+)
+
+// MemoryPolicyParams tunes the collector, a zero gc percent follows the power mode, a zero limit
+// leaves the heap unbounded and the ballast raises the heap the collector starts from
+type MemoryPolicyParams struct {
+	GCPercent     int   `json:"gc-percent"`
+	MemoryLimitMB int64 `json:"memory-limit"`
+	BallastMB     int   `json:"ballast"`
+}
+
+type MemoryTrim struct {
+	Pressure   MemoryPressure `json:"pressure"`
+	DnsEntries int            `json:"dns-entries"`
+	SecureKeys int            `json:"secure-entries"`
+	FakeIp     bool           `json:"fake-ip"`
+	Released   uint64         `json:"released"`
+	Time       int64          `json:"time"`
+}
+
+type MemoryStats struct {
+	HeapAlloc    uint64             `json:"heap-alloc"`
+	HeapInuse    uint64             `json:"heap-inuse"`
+	HeapIdle     uint64             `json:"heap-idle"`
+	HeapReleased uint64             `json:"heap-released"`
+	StackInuse   uint64             `json:"stack-inuse"`
+	Sys          uint64             `json:"sys"`
+	NumGC        uint32             `json:"num-gc"`
+	Goroutines   int                `json:"goroutines"`
+	GCPercent    int                `json:"gc-percent"`
+	MemoryLimit  int64              `json:"memory-limit"`
+	Ballast      int                `json:"ballast"`
+	Pressure     MemoryPressure     `json:"pressure"`
+	Policy       MemoryPolicyParams `json:"policy"`
+	Trims        int64              `json:"trims"`
+	LastTrim     *MemoryTrim        `json:"last-trim"`
+	BufferPool   *BufferPoolStats   `json:"buffer-pool"`
+}
+
+// MemoryManager owns the collector settings, the power mode, the policy and the reported pressure
+// all pick a gc percent and the lowest one wins
+type MemoryManager struct {
+	mutex     sync.Mutex
+	policy    MemoryPolicyParams
+	pressure  MemoryPressure
+	gcPercent int
+	ballast   []byte
+	trims     int64
+	lastTrim  *MemoryTrim
+}
+
+var memoryManager = &MemoryManager{pressure: NoMemoryPressure, gcPercent: 100}
+
+func (m *MemoryManager) targetLocked() int {
+	target := powerState.profile().gc
+	if m.policy.GCPercent > 0 && m.policy.GCPercent < target {
+		target = m.policy.GCPercent
+	}
+	switch m.pressure {
+	case ModerateMemoryPressure:
+		if moderateGCPercent < target {
+			target = moderateGCPercent
+		}
+	case CriticalMemoryPressure:
+		if criticalGCPercent < target {
+			target = criticalGCPercent
+		}
+	}
+	return target
+}
+
+func (m *MemoryManager) applyGCLocked() {
+	target := m.targetLocked()
+	if target != m.gcPercent {
+		debug.SetGCPercent(target)
+		m.gcPercent = target
+	}
+}
+
+// ApplyGC recomputes the gc percent after the power mode changed
+func (m *MemoryManager) ApplyGC() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.applyGCLocked()
+}
+
+func (m *MemoryManager) SetPolicy(params *MemoryPolicyParams) error {
+	policy := MemoryPolicyParams{}
+	if params != nil {
+		policy = *params
+	}
+	if policy.GCPercent < 0 || policy.MemoryLimitMB < 0 || policy.BallastMB < 0 {
+		return errors.New("memory policy values must not be negative")
+	}
+	if policy.BallastMB > maxBallastMB {
+		return fmt.Errorf("ballast is limited to %d MB", maxBallastMB)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.policy = policy
+	if policy.MemoryLimitMB > 0 {
+		debug.SetMemoryLimit(policy.MemoryLimitMB << 20)
+	} else {
+		debug.SetMemoryLimit(math.MaxInt64)
+	}
+	if len(m.ballast) != policy.BallastMB<<20 {
+		// the ballast is never written so its pages are not backed until touched
+		m.ballast = nil
+		if policy.BallastMB > 0 {
+			m.ballast = make([]byte, policy.BallastMB<<20)
+		}
+	}
+	m.applyGCLocked()
+	return nil
+}
+
+// Trim releases the caches the core can rebuild, a critical pressure also drops the fake-ip
+// mappings and the ballast, the gc percent stays lowered until the pressure is reported normal
+func (m *MemoryManager) Trim(pressure MemoryPressure) (*MemoryTrim, error) {
+	switch pressure {
+	case "":
+		pressure = ModerateMemoryPressure
+	case NoMemoryPressure, ModerateMemoryPressure, CriticalMemoryPressure:
+	default:
+		return nil, fmt.Errorf("unknown memory pressure %s", pressure)
+	}
+	m.mutex.Lock()
+	m.pressure = pressure
+	m.applyGCLocked()
+	if pressure == CriticalMemoryPressure {
+		m.ballast = nil
+	}
+	m.mutex.Unlock()
+	trim := &MemoryTrim{Pressure: pressure, Time: time.Now().UnixMilli()}
+	if pressure == NoMemoryPressure {
+		return trim, nil
+	}
+
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	trim.DnsEntries = dnsCache.Trim()
+	sniffing.TrimCache()
+	dialRacing.TrimTelemetry()
+	secureMemory := GetSecureMemoryService()
+	trim.SecureKeys, _ = secureMemory.CacheSize()
+	secureMemory.ClearAllSecureCache()
+	if pressure == CriticalMemoryPressure {
+		runLock.Lock()
+		fakeIpStore.Save(false)
+		if err := resolver.FlushFakeIP(); err != nil {
+			log.Warnln("[Memory] flush fake-ip error: %v", err)
+		} else {
+			trim.FakeIp = true
+		}
+		runLock.Unlock()
+	}
+	debug.FreeOSMemory()
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	if after.HeapReleased > before.HeapReleased {
+		trim.Released = after.HeapReleased - before.HeapReleased
+	}
+
+	m.mutex.Lock()
+	m.trims++
+	m.lastTrim = trim
+	m.mutex.Unlock()
+	log.Infoln("[Memory] trimmed on %s pressure, released %d bytes", pressure, trim.Released)
+	return trim, nil
+}
+
+func (m *MemoryManager) Stats() *MemoryStats {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return &MemoryStats{
+		HeapAlloc:    memStats.HeapAlloc,
+		HeapInuse:    memStats.HeapInuse,
+		HeapIdle:     memStats.HeapIdle,
+		HeapReleased: memStats.HeapReleased,
+		StackInuse:   memStats.StackInuse,
+		Sys:          memStats.Sys,
+		NumGC:        memStats.NumGC,
+		Goroutines:   runtime.NumGoroutine(),
+		GCPercent:    m.gcPercent,
+		MemoryLimit:  debug.SetMemoryLimit(-1),
+		Ballast:      len(m.ballast),
+		Pressure:     m.pressure,
+		Policy:       m.policy,
+		Trims:        m.trims,
+		LastTrim:     m.lastTrim,
+		BufferPool:   bufferPool.Stats(),
+	}
+}
+
+func handleTrimMemory(pressure string) (string, error) {
+	trim, err := memoryManager.Trim(MemoryPressure(pressure))
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(trim)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func handleSetMemoryPolicy(paramsString string) error {
+	var params *MemoryPolicyParams
+	if err := json.Unmarshal([]byte(paramsString), &params); err != nil {
+		return err
+	}
+	return memoryManager.SetPolicy(params)
+}
+
+func handleGetMemoryStats() string {
+	data, err := json.Marshal(memoryManager.Stats())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"github.com/go-chi/chi/v5"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/tunnel"
+	"github.com/metacubex/mihomo/tunnel/statistic"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsWriter formats the Prometheus text exposition format
+type metricsWriter struct {
+	buffer bytes.Buffer
+}
+
+func (w *metricsWriter) family(name string, kind string, help string) {
+	w.buffer.WriteString("# HELP " + name + " " + help + "\n")
+	w.buffer.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+// sample writes one value, labels are name and value pairs
+func (w *metricsWriter) sample(name string, value float64, labels ...string) {
+	w.buffer.WriteString(name)
+	if len(labels) > 0 {
+		w.buffer.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.buffer.WriteByte(',')
+			}
+			w.buffer.WriteString(labels[i] + `="` + metricsLabelEscaper.Replace(labels[i+1]) + `"`)
+		}
+		w.buffer.WriteByte('}')
+	}
+	w.buffer.WriteByte(' ')
+	w.buffer.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	w.buffer.WriteByte('\n')
+}
+
+func (w *metricsWriter) gauge(name string, help string, value float64) {
+	w.family(name, "gauge", help)
+	w.sample(name, value)
+}
+
+func (w *metricsWriter) counter(name string, help string, value float64) {
+	w.family(name, "counter", help)
+	w.sample(name, value)
+}
+
+func writeConnectionMetrics(w *metricsWriter) {
+	snapshot := statistic.DefaultManager.Snapshot()
+	up, down := statistic.DefaultManager.Now()
+	networks := map[string]int{}
+	for _, info := range snapshot.Connections {
+		if metadata := info.Metadata; metadata != nil {
+			networks[metadata.NetWork.String()]++
+		}
+	}
+	w.family("flclash_connections", "gauge", "Active connections by network.")
+	for _, network := range []string{"tcp", "udp"} {
+		w.sample("flclash_connections", float64(networks[network]), "network", network)
+	}
+	w.counter("flclash_upload_bytes_total", "Bytes uploaded since the statistics were reset.", float64(snapshot.UploadTotal))
+	w.counter("flclash_download_bytes_total", "Bytes downloaded since the statistics were reset.", float64(snapshot.DownloadTotal))
+	w.gauge("flclash_upload_speed_bytes", "Current upload speed in bytes per second.", float64(up))
+	w.gauge("flclash_download_speed_bytes", "Current download speed in bytes per second.", float64(down))
+}
+
+func writeRuntimeMetrics(w *metricsWriter) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	w.gauge("flclash_memory_bytes", "Memory in use as reported by the core.", float64(statistic.DefaultManager.Memory()))
+	w.gauge("flclash_go_heap_alloc_bytes", "Bytes of allocated heap objects.", float64(stats.HeapAlloc))
+	w.gauge("flclash_go_sys_bytes", "Bytes of memory obtained from the OS.", float64(stats.Sys))
+	w.counter("flclash_go_gc_total", "Completed GC cycles.", float64(stats.NumGC))
+	w.gauge("flclash_goroutines", "Number of goroutines.", float64(runtime.NumGoroutine()))
+	running := 0.0
+	if isRunning {
+		running = 1
+	}
+	w.gauge("flclash_running", "Whether the listeners are running.", running)
+}
+
+func writeDnsMetrics(w *metricsWriter) {
+	statuses := dnsHealth.Status()
+	if len(statuses) > 0 {
+		w.family("flclash_dns_upstream_latency_milliseconds", "gauge", "Latency of the last probe of a nameserver.")
+		for _, status := range statuses {
+			w.sample("flclash_dns_upstream_latency_milliseconds", float64(status.Latency), "server", status.Server, "role", status.Role)
+		}
+		w.family("flclash_dns_upstream_failures_total", "counter", "Failed probes of a nameserver.")
+		for _, status := range statuses {
+			w.sample("flclash_dns_upstream_failures_total", float64(status.Failures), "server", status.Server, "role", status.Role)
+		}
+	}
+	stats := dnsCache.Stats()
+	w.gauge("flclash_dns_cache_entries", "Entries in the dns cache.", float64(stats.Size))
+	w.family("flclash_dns_cache_lookups_total", "counter", "Dns cache lookups by result.")
+	w.sample("flclash_dns_cache_lookups_total", float64(stats.Hits), "result", "hit")
+	w.sample("flclash_dns_cache_lookups_total", float64(stats.NegativeHits), "result", "negative")
+	w.sample("flclash_dns_cache_lookups_total", float64(stats.StaleHits), "result", "stale")
+	w.sample("flclash_dns_cache_lookups_total", float64(stats.Misses), "result", "miss")
+}
+
+func writeProxyMetrics(w *metricsWriter) {
+	proxies := tunnel.ProxiesWithProviders()
+	names := make([]string, 0, len(proxies))
+	for name := range proxies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	testURL := constant.DefaultTestURL
+	w.family("flclash_proxy_delay_milliseconds", "gauge", "Last delay of a proxy for the test url, 0 when unknown or down.")
+	for _, name := range names {
+		proxy := proxies[name]
+		w.sample("flclash_proxy_delay_milliseconds", float64(proxy.LastDelayForTestUrl(testURL)), "proxy", name, "type", proxy.Type().String())
+	}
+	w.family("flclash_proxy_alive", "gauge", "Whether a proxy passed its last test.")
+	for _, name := range names {
+		alive := 0.0
+		if proxies[name].AliveForTestUrl(testURL) {
+			alive = 1
+		}
+		w.sample("flclash_proxy_alive", alive, "proxy", name)
+	}
+}
+
+func handleMetrics(w http.ResponseWriter, _ *http.Request) {
+	writer := &metricsWriter{}
+	writeConnectionMetrics(writer)
+	writeRuntimeMetrics(writer)
+	writeDnsMetrics(writer)
+	writeProxyMetrics(writer)
+	w.Header().Set("Content-Type", metricsContentType)
+	_, _ = w.Write(writer.buffer.Bytes())
+}
+
+// metricsRouter is mounted behind the controller secret next to the mihomo routes
+func metricsRouter(r chi.Router) {
+	r.Get("/metrics", handleMetrics)
+}
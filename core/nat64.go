@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/metacubex/mihomo/component/resolver"
+	"github.com/metacubex/mihomo/constant"
+	LC "github.com/metacubex/mihomo/listener/config"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultNat64Prefix   = "64:ff9b::/96"
+	defaultTunInet6Range = "fdfe:dcba:9876::1/126"
+)
+
+// Nat64Params is part of the profile setup, dns64 answers AAAA queries of v4 only names from the prefix
+type Nat64Params struct {
+	Enable bool   `json:"enable"`
+	Prefix string `json:"prefix"`
+	DNS64  bool   `json:"dns64"`
+}
+
+type Nat64Status struct {
+	Enable      bool   `json:"enable"`
+	Prefix      string `json:"prefix"`
+	DNS64       bool   `json:"dns64"`
+	Synthesized uint64 `json:"synthesized"`
+	Translated  uint64 `json:"translated"`
+}
+
+// Nat64 maps a /96 prefix onto the v4 space so v6 clients of the tun reach v4 only destinations
+type Nat64 struct {
+	mutex       sync.RWMutex
+	enable      bool
+	dns64       bool
+	prefix      netip.Prefix
+	synthesized atomic.Uint64
+	translated  atomic.Uint64
+}
+
+var nat64 = &Nat64{prefix: netip.MustParsePrefix(defaultNat64Prefix)}
+
+func (n *Nat64) Set(params *Nat64Params) error {
+	prefix := netip.MustParsePrefix(defaultNat64Prefix)
+	if params.Prefix != "" {
+		var err error
+		prefix, err = netip.ParsePrefix(params.Prefix)
+		if err != nil {
+			return err
+		}
+		if !prefix.Addr().Is6() || prefix.Addr().Is4In6() || prefix.Bits() != 96 {
+			return errors.New("nat64 prefix must be an ipv6 /96")
+		}
+		prefix = prefix.Masked()
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.enable = params.Enable
+	n.dns64 = params.Enable && params.DNS64
+	n.prefix = prefix
+	return nil
+}
+
+func setupNat64(params *Nat64Params) error {
+	if params == nil {
+		params = &Nat64Params{}
+	}
+	return nat64.Set(params)
+}
+
+func (n *Nat64) current() (enable bool, dns64 bool, prefix netip.Prefix) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.enable, n.dns64, n.prefix
+}
+
+func synthesizeNat64(prefix netip.Prefix, addr netip.Addr) netip.Addr {
+	bytes := prefix.Addr().As16()
+	v4 := addr.As4()
+	copy(bytes[12:], v4[:])
+	return netip.AddrFrom16(bytes)
+}
+
+func extractNat64(prefix netip.Prefix, addr netip.Addr) (netip.Addr, bool) {
+	if !addr.Is6() || addr.Is4In6() || !prefix.Contains(addr) {
+		return netip.Addr{}, false
+	}
+	bytes := addr.As16()
+	return netip.AddrFrom4([4]byte(bytes[12:])), true
+}
+
+// translate points metadata at the embedded v4 address, fake-ips are then looked up by the tunnel as usual
+func (n *Nat64) translate(metadata *constant.Metadata) (netip.Prefix, bool) {
+	enable, _, prefix := n.current()
+	if !enable {
+		return prefix, false
+	}
+	addr, ok := extractNat64(prefix, metadata.DstIP)
+	if !ok {
+		return prefix, false
+	}
+	metadata.DstIP = addr
+	n.translated.Add(1)
+	return prefix, true
+}
+
+// PrepareTun gives the tun a v6 address and routes the prefix when explicit routes are configured
+func (n *Nat64) PrepareTun(tun *LC.Tun) {
+	enable, _, prefix := n.current()
+	if !enable {
+		return
+	}
+	if len(tun.Inet6Address) == 0 {
+		tun.Inet6Address = []netip.Prefix{netip.MustParsePrefix(defaultTunInet6Range)}
+	}
+	if len(tun.RouteAddress) == 0 {
+		return
+	}
+	for _, route := range tun.RouteAddress {
+		if route.Bits() <= prefix.Bits() && route.Contains(prefix.Addr()) {
+			return
+		}
+	}
+	tun.RouteAddress = append(tun.RouteAddress, prefix)
+}
+
+func (n *Nat64) Status() Nat64Status {
+	enable, dns64, prefix := n.current()
+	return Nat64Status{
+		Enable:      enable,
+		Prefix:      prefix.String(),
+		DNS64:       dns64,
+		Synthesized: n.synthesized.Load(),
+		Translated:  n.translated.Load(),
+	}
+}
+
+// nat64Tunnel translates the destinations of the tun inbound before the tunnel sees them
+type nat64Tunnel struct {
+	constant.Tunnel
+}
+
+var tunTunnel constant.Tunnel = &nat64Tunnel{Tunnel: &dnsGuardTunnel{Tunnel: &splitTunnelTunnel{Tunnel: rewriteTunnel}}}
+
+func (t *nat64Tunnel) HandleTCPConn(conn net.Conn, metadata *constant.Metadata) {
+	nat64.translate(metadata)
+	t.Tunnel.HandleTCPConn(conn, metadata)
+}
+
+func (t *nat64Tunnel) HandleUDPPacket(packet constant.UDPPacket, metadata *constant.Metadata) {
+	if prefix, ok := nat64.translate(metadata); ok {
+		packet = &nat64Packet{UDPPacket: packet, prefix: prefix}
+	}
+	t.Tunnel.HandleUDPPacket(packet, metadata)
+}
+
+// nat64Packet writes replies back from the synthesized address the client sent to
+type nat64Packet struct {
+	constant.UDPPacket
+	prefix netip.Prefix
+}
+
+func (p *nat64Packet) WriteBack(b []byte, addr net.Addr) (int, error) {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		if ip := udpAddr.AddrPort(); ip.Addr().Unmap().Is4() {
+			addr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(synthesizeNat64(p.prefix, ip.Addr().Unmap()), ip.Port()))
+		}
+	}
+	return p.UDPPacket.WriteBack(b, addr)
+}
+
+// dns64LocalServer synthesizes AAAA answers for hijacked queries of names that only have A records
+type dns64LocalServer struct {
+	resolver.LocalServer
+}
+
+func (s *dns64LocalServer) ServeMsg(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	resp, err := s.LocalServer.ServeMsg(ctx, msg)
+	_, dns64, prefix := nat64.current()
+	if !dns64 || err != nil || resp == nil || resp.Rcode != dns.RcodeSuccess || len(msg.Question) == 0 || msg.Question[0].Qtype != dns.TypeAAAA {
+		return resp, err
+	}
+	for _, answer := range resp.Answer {
+		if _, ok := answer.(*dns.AAAA); ok {
+			return resp, err
+		}
+	}
+	query := msg.Copy()
+	query.Question[0].Qtype = dns.TypeA
+	aResp, aErr := s.LocalServer.ServeMsg(ctx, query)
+	if aErr != nil || aResp == nil || aResp.Rcode != dns.RcodeSuccess {
+		return resp, err
+	}
+	answers := make([]dns.RR, 0, len(aResp.Answer))
+	for _, answer := range aResp.Answer {
+		switch record := answer.(type) {
+		case *dns.CNAME:
+			answers = append(answers, record)
+		case *dns.A:
+			ip, ok := netip.AddrFromSlice(record.A.To4())
+			if !ok {
+				continue
+			}
+			header := record.Hdr
+			header.Rrtype = dns.TypeAAAA
+			answers = append(answers, &dns.AAAA{
+				Hdr:  header,
+				AAAA: synthesizeNat64(prefix, ip).AsSlice(),
+			})
+		}
+	}
+	if !hasDnsRecord(answers, dns.TypeAAAA) {
+		return resp, err
+	}
+	synthesized := resp.Copy()
+	synthesized.Answer = answers
+	synthesized.Ns = nil
+	nat64.synthesized.Add(1)
+	return synthesized, nil
+}
+
+func hasDnsRecord(records []dns.RR, rrType uint16) bool {
+	for _, record := range records {
+		if record.Header().Rrtype == rrType {
+			return true
+		}
+	}
+	return false
+}
+
+// installDns64 wraps the local server of a newly applied config, run before installDnsLog
+func installDns64() {
+	switch resolver.DefaultLocalServer.(type) {
+	case nil, *dns64LocalServer, *loggingLocalServer:
+		return
+	}
+	resolver.DefaultLocalServer = &dns64LocalServer{LocalServer: resolver.DefaultLocalServer}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/metacubex/mihomo/component/dialer"
+	"github.com/metacubex/mihomo/component/iface"
+	"github.com/metacubex/mihomo/component/resolver"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultNetworkDebounce = time.Second
+	networkResolveTimeout  = 5 * time.Second
+	networkResolvers       = 8
+)
+
+// networkProbes are only connected, a udp connect sends nothing and tells which source the
+// kernel picks for the default route
+var networkProbes = []string{"1.1.1.1:53", "[2606:4700:4700::1111]:53"}
+
+type NetworkMonitorParams struct {
+	Enable bool `json:"enable"`
+	// Debounce is the quiet time in milliseconds before a burst of changes is handled
+	Debounce        int64 `json:"debounce"`
+	KeepConnections bool  `json:"keep-connections"`
+}
+
+// NetworkSnapshot is what the monitor compares, the interfaces of the tun are left out
+type NetworkSnapshot struct {
+	Interface  string   `json:"interface"`
+	Addresses  []string `json:"addresses"`
+	Interfaces []string `json:"interfaces"`
+}
+
+func (s *NetworkSnapshot) equal(other *NetworkSnapshot) bool {
+	return s.Interface == other.Interface &&
+		strings.Join(s.Addresses, ",") == strings.Join(other.Addresses, ",") &&
+		strings.Join(s.Interfaces, ";") == strings.Join(other.Interfaces, ";")
+}
+
+type NetworkChange struct {
+	Previous  *NetworkSnapshot `json:"previous"`
+	Current   *NetworkSnapshot `json:"current"`
+	Rebound   bool             `json:"rebound"`
+	Resolved  int              `json:"resolved"`
+	Closed    bool             `json:"closed"`
+	Source    string           `json:"source"`
+	Timestamp int64            `json:"timestamp"`
+}
+
+type NetworkMonitorStatus struct {
+	NetworkMonitorParams
+	Running    bool             `json:"running"`
+	Backend    string           `json:"backend"`
+	Error      string           `json:"error,omitempty"`
+	Changes    int              `json:"changes"`
+	LastChange int64            `json:"last-change"`
+	Current    *NetworkSnapshot `json:"current"`
+}
+
+// NetworkMonitor turns the notifications of the os into network changes and recovers the core
+// from them, dead sockets of the old network are closed and the servers are looked up again
+type NetworkMonitor struct {
+	mutex      sync.Mutex
+	params     NetworkMonitorParams
+	cancel     context.CancelFunc
+	trigger    chan string
+	current    *NetworkSnapshot
+	err        error
+	changes    int
+	lastChange time.Time
+}
+
+var networkMonitor = &NetworkMonitor{params: NetworkMonitorParams{Enable: true}}
+
+func (m *NetworkMonitor) debounce() time.Duration {
+	if m.params.Debounce <= 0 {
+		return defaultNetworkDebounce
+	}
+	return time.Duration(m.params.Debounce) * time.Millisecond
+}
+
+func (m *NetworkMonitor) Set(params *NetworkMonitorParams) {
+	m.mutex.Lock()
+	m.params = *params
+	m.mutex.Unlock()
+	m.Resume()
+}
+
+func (m *NetworkMonitor) Resume() {
+	m.Stop()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.params.Enable {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	m.trigger = make(chan string, 1)
+	m.current = takeNetworkSnapshot()
+	m.err = nil
+	trigger := m.trigger
+	go func() {
+		err := watchNetwork(ctx, func() {
+			m.Notify(networkBackend())
+		})
+		if err != nil && ctx.Err() == nil {
+			log.Warnln("[Network] watch with %s error: %v", networkBackend(), err)
+			m.mutex.Lock()
+			m.err = err
+			m.mutex.Unlock()
+		}
+	}()
+	go m.loop(ctx, trigger, m.debounce())
+}
+
+func (m *NetworkMonitor) Stop() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.cancel != nil {
+		m.cancel()
+		m.cancel = nil
+	}
+	m.trigger = nil
+}
+
+// Notify wakes the monitor, the app calls it too where the os keeps its events from the core
+func (m *NetworkMonitor) Notify(source string) {
+	m.mutex.Lock()
+	trigger := m.trigger
+	m.mutex.Unlock()
+	if trigger == nil {
+		return
+	}
+	select {
+	case trigger <- source:
+	default:
+	}
+}
+
+func (m *NetworkMonitor) loop(ctx context.Context, trigger chan string, debounce time.Duration) {
+	for {
+		var source string
+		select {
+		case <-ctx.Done():
+			return
+		case source = <-trigger:
+		}
+		timer := time.NewTimer(debounce)
+	quiet:
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-trigger:
+				timer.Reset(debounce)
+			case <-timer.C:
+				break quiet
+			}
+		}
+		runGuarded("network monitor", func() {
+			m.check(source)
+		})
+	}
+}
+
+func (m *NetworkMonitor) check(source string) {
+	iface.FlushCache()
+	current := takeNetworkSnapshot()
+	m.mutex.Lock()
+	previous := m.current
+	if previous != nil && previous.equal(current) {
+		m.mutex.Unlock()
+		return
+	}
+	m.current = current
+	m.changes++
+	m.lastChange = time.Now()
+	keep := m.params.KeepConnections
+	m.mutex.Unlock()
+	change := &NetworkChange{
+		Previous:  previous,
+		Current:   current,
+		Source:    source,
+		Timestamp: time.Now().UnixMilli(),
+	}
+	change.Rebound = rebindDefaultInterface(current.Interface)
+	resolver.ResetConnection()
+	dnsCache.Trim()
+	if !keep {
+		runLock.Lock()
+		closeConnections()
+		runLock.Unlock()
+		change.Closed = true
+	}
+	change.Resolved = resolveProxyServers()
+	log.Infoln("[Network] changed to %s by %s, %d servers resolved", current.Interface, source, change.Resolved)
+	go sendMessage(Message{
+		Type: NetworkChangedMessage,
+		Data: change,
+	})
+	captivePortal.Notify()
+}
+
+func (m *NetworkMonitor) Status() *NetworkMonitorStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	status := &NetworkMonitorStatus{
+		NetworkMonitorParams: m.params,
+		Running:              m.cancel != nil,
+		Backend:              networkBackend(),
+		Changes:              m.changes,
+		Current:              m.current,
+	}
+	if m.err != nil {
+		status.Error = m.err.Error()
+	}
+	if !m.lastChange.IsZero() {
+		status.LastChange = m.lastChange.UnixMilli()
+	}
+	return status
+}
+
+// networkTun tells the interfaces of the running tun, the device name alone misses a VpnService
+type networkTun struct {
+	device   string
+	prefixes []netip.Prefix
+}
+
+func currentNetworkTun() *networkTun {
+	tun, running := currentTunConfig()
+	if !running {
+		return &networkTun{}
+	}
+	return &networkTun{
+		device:   tun.Device,
+		prefixes: append(append([]netip.Prefix{}, tun.Inet4Address...), tun.Inet6Address...),
+	}
+}
+
+func (t *networkTun) owns(item *iface.Interface) bool {
+	if t.device != "" && item.Name == t.device {
+		return true
+	}
+	for _, address := range item.Addresses {
+		for _, prefix := range t.prefixes {
+			if prefix.Contains(address.Addr()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// probeDefaultInterface finds the interface of the default route, behind an auto route tun the
+// probe lands on the tun and the interface the dialer binds to is the answer
+func probeDefaultInterface(tun *networkTun) (string, []string) {
+	var name string
+	var addresses []string
+	for _, probe := range networkProbes {
+		c, err := net.Dial("udp", probe)
+		if err != nil {
+			continue
+		}
+		local, _ := c.LocalAddr().(*net.UDPAddr)
+		_ = c.Close()
+		if local == nil {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(local.IP)
+		if !ok {
+			continue
+		}
+		found, err := iface.ResolveInterfaceByAddr(addr.Unmap())
+		if err != nil || tun.owns(found) {
+			continue
+		}
+		if name == "" {
+			name = found.Name
+		}
+		addresses = append(addresses, addr.Unmap().String())
+	}
+	if name == "" {
+		name = dialer.DefaultInterface.Load()
+	}
+	return name, addresses
+}
+
+func takeNetworkSnapshot() *NetworkSnapshot {
+	tun := currentNetworkTun()
+	snapshot := &NetworkSnapshot{}
+	snapshot.Interface, snapshot.Addresses = probeDefaultInterface(tun)
+	interfaces, err := iface.Interfaces()
+	if err != nil {
+		return snapshot
+	}
+	for name, item := range interfaces {
+		if item.Flags&net.FlagUp == 0 || item.Flags&net.FlagLoopback != 0 || tun.owns(item) {
+			continue
+		}
+		var addresses []string
+		for _, prefix := range item.Addresses {
+			addresses = append(addresses, prefix.String())
+		}
+		if len(addresses) == 0 {
+			continue
+		}
+		sort.Strings(addresses)
+		snapshot.Interfaces = append(snapshot.Interfaces, name+"="+strings.Join(addresses, ","))
+	}
+	sort.Strings(snapshot.Interfaces)
+	return snapshot
+}
+
+// rebindDefaultInterface moves the dialer to the new default interface unless the profile names
+// one or the tun watches the routes itself
+func rebindDefaultInterface(name string) bool {
+	if name == "" {
+		return false
+	}
+	runLock.Lock()
+	pinned := currentConfig != nil && (currentConfig.General.Interface != "" ||
+		(currentConfig.General.Tun.Enable && currentConfig.General.Tun.AutoDetectInterface))
+	runLock.Unlock()
+	current := dialer.DefaultInterface.Load()
+	if pinned || current == "" || current == name {
+		return false
+	}
+	dialer.DefaultInterface.Store(name)
+	log.Infoln("[Network] bind to %s instead of %s", name, current)
+	return true
+}
+
+// resolveProxyServers looks the servers up on the new network so the first dials do not wait
+func resolveProxyServers() int {
+	hosts := map[string]struct{}{}
+	for _, proxy := range tunnel.Proxies() {
+		host := serverHost(proxy)
+		if host == "" {
+			continue
+		}
+		if _, err := netip.ParseAddr(host); err == nil {
+			continue
+		}
+		hosts[host] = struct{}{}
+	}
+	if len(hosts) == 0 || resolver.ProxyServerHostResolver == nil {
+		return 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), networkResolveTimeout)
+	defer cancel()
+	queue := make(chan string, len(hosts))
+	for host := range hosts {
+		queue <- host
+	}
+	close(queue)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	resolved := 0
+	for i := 0; i < networkResolvers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for host := range queue {
+				if _, err := resolver.ResolveIPWithResolver(ctx, host, resolver.ProxyServerHostResolver); err != nil {
+					log.Debugln("[Network] resolve %s error: %v", host, err)
+					continue
+				}
+				mutex.Lock()
+				resolved++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return resolved
+}
+
+func handleSetNetworkMonitor(paramsString string) error {
+	params := &NetworkMonitorParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	networkMonitor.Set(params)
+	return nil
+}
+
+func handleGetNetworkMonitor() string {
+	data, err := json.Marshal(networkMonitor.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handleNotifyNetworkChanged(source string) {
+	if source == "" {
+		source = "app"
+	}
+	networkMonitor.Notify(source)
+}
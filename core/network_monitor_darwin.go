@@ -0,0 +1,51 @@
+//go:build darwin
+
+package main
+
+import (
+	"context"
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+func networkBackend() string {
+	return "route socket"
+}
+
+// watchNetwork reads the routing socket that SCNetworkReachability is built on, the core is built
+// without cgo and cannot link SystemConfiguration
+func watchNetwork(ctx context.Context, notify func()) error {
+	fd, err := unix.Socket(unix.AF_ROUTE, unix.SOCK_RAW, unix.AF_UNSPEC)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	unix.CloseOnExec(fd)
+	if err = unix.SetNonblock(fd, true); err != nil {
+		_ = unix.Close(fd)
+		return err
+	}
+	file := os.NewFile(uintptr(fd), "route")
+	go func() {
+		<-ctx.Done()
+		_ = file.Close()
+	}()
+	buffer := make([]byte, 1<<16)
+	for {
+		n, err := file.Read(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		// rt_msghdr starts with the length, the version and the type of the message
+		if n < 4 {
+			continue
+		}
+		switch int(buffer[3]) {
+		case unix.RTM_ADD, unix.RTM_DELETE, unix.RTM_CHANGE, unix.RTM_NEWADDR, unix.RTM_DELADDR,
+			unix.RTM_IFINFO:
+			notify()
+		}
+	}
+}
@@ -0,0 +1,63 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"golang.org/x/sys/unix"
+	"os"
+	"syscall"
+)
+
+// networkGroups are the rtnetlink multicast groups of links, addresses and routes
+const networkGroups = unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR |
+	unix.RTMGRP_IPV4_ROUTE | unix.RTMGRP_IPV6_ROUTE
+
+func networkBackend() string {
+	return "netlink"
+}
+
+// watchNetwork listens to rtnetlink, android refuses the bind to apps since api 30 and the app
+// reports the changes of its ConnectivityManager instead
+func watchNetwork(ctx context.Context, notify func()) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_ROUTE)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	if err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: networkGroups}); err != nil {
+		_ = unix.Close(fd)
+		return os.NewSyscallError("bind", err)
+	}
+	file := os.NewFile(uintptr(fd), "netlink")
+	go func() {
+		<-ctx.Done()
+		_ = file.Close()
+	}()
+	buffer := make([]byte, 1<<16)
+	for {
+		n, err := file.Read(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			// the kernel dropped messages for a full buffer, something changed all the same
+			if errors.Is(err, unix.ENOBUFS) {
+				notify()
+				continue
+			}
+			return err
+		}
+		messages, err := syscall.ParseNetlinkMessage(buffer[:n])
+		if err != nil {
+			continue
+		}
+		for _, message := range messages {
+			switch message.Header.Type {
+			case unix.RTM_NEWLINK, unix.RTM_DELLINK, unix.RTM_NEWADDR, unix.RTM_DELADDR,
+				unix.RTM_NEWROUTE, unix.RTM_DELROUTE:
+				notify()
+			}
+		}
+	}
+}
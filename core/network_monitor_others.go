@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+func networkBackend() string {
+	return "none"
+}
+
+func watchNetwork(_ context.Context, _ func()) error {
+	return errors.New("network monitor is not supported on this platform")
+}
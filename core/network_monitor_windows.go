@@ -0,0 +1,75 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"golang.org/x/sys/windows"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	procNotifyRouteChange2 = windows.NewLazySystemDLL("iphlpapi.dll").NewProc("NotifyRouteChange2")
+
+	// networkCallback is created once, windows callbacks are never freed
+	networkCallback     uintptr
+	networkCallbackOnce sync.Once
+	networkNotify       atomic.Pointer[func()]
+)
+
+func networkBackend() string {
+	return "iphlpapi"
+}
+
+func networkChanged(_, _, _ uintptr) uintptr {
+	if notify := networkNotify.Load(); notify != nil {
+		(*notify)()
+	}
+	return 0
+}
+
+func notifyRouteChange2(callback uintptr, handle *windows.Handle) error {
+	if err := procNotifyRouteChange2.Find(); err != nil {
+		return err
+	}
+	r, _, _ := procNotifyRouteChange2.Call(uintptr(windows.AF_UNSPEC), callback, 0, 0, uintptr(unsafe.Pointer(handle)))
+	if r != 0 {
+		return syscall.Errno(r)
+	}
+	return nil
+}
+
+// watchNetwork registers for the interface, address and route notifications of iphlpapi, they
+// arrive on a thread pool of the os until they are cancelled
+func watchNetwork(ctx context.Context, notify func()) error {
+	networkCallbackOnce.Do(func() {
+		networkCallback = windows.NewCallback(networkChanged)
+	})
+	current := &notify
+	networkNotify.Store(current)
+	var handles []windows.Handle
+	defer func() {
+		for _, handle := range handles {
+			_ = windows.CancelMibChangeNotify2(handle)
+		}
+		networkNotify.CompareAndSwap(current, nil)
+	}()
+	var handle windows.Handle
+	if err := windows.NotifyIpInterfaceChange(windows.AF_UNSPEC, networkCallback, nil, false, &handle); err != nil {
+		return err
+	}
+	handles = append(handles, handle)
+	if err := windows.NotifyUnicastIpAddressChange(windows.AF_UNSPEC, networkCallback, nil, false, &handle); err != nil {
+		return err
+	}
+	handles = append(handles, handle)
+	if err := notifyRouteChange2(networkCallback, &handle); err != nil {
+		return err
+	}
+	handles = append(handles, handle)
+	<-ctx.Done()
+	return nil
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/metacubex/mihomo/common/structure"
+	"github.com/metacubex/mihomo/component/dialer"
+	"github.com/metacubex/mihomo/config"
+	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/transport/restls"
+	obfs "github.com/metacubex/mihomo/transport/simple-obfs"
+	shadowtls "github.com/metacubex/mihomo/transport/sing-shadowtls"
+	v2rayObfs "github.com/metacubex/mihomo/transport/v2ray-plugin"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+)
+
+const obfsChainKey = "obfs-chain"
+
+// obfsChainTypes are the outbounds whose server stream can carry an obfuscation layer
+var obfsChainTypes = map[string]bool{
+	"ss": true, "trojan": true, "vmess": true, "vless": true, "anytls": true, "snell": true,
+}
+
+// ObfsLayer wraps the connection to the server of an outbound
+type ObfsLayer func(ctx context.Context, conn net.Conn) (net.Conn, error)
+
+// ObfsTransportFactory builds a layer from its entry of obfs-chain, server is the host and port
+// of the outbound and fingerprint its client-fingerprint
+type ObfsTransportFactory func(server, fingerprint string, options map[string]any) (ObfsLayer, error)
+
+var (
+	obfsTransportsMutex sync.RWMutex
+	obfsTransports      = map[string]ObfsTransportFactory{}
+)
+
+// RegisterObfsTransport makes a transport available to the obfs-chain of every profile, the
+// layers of a chain are applied in order, the first one on the tcp connection to the server
+func RegisterObfsTransport(name string, factory ObfsTransportFactory) {
+	obfsTransportsMutex.Lock()
+	defer obfsTransportsMutex.Unlock()
+	obfsTransports[name] = factory
+}
+
+func obfsTransport(name string) (ObfsTransportFactory, bool) {
+	obfsTransportsMutex.RLock()
+	defer obfsTransportsMutex.RUnlock()
+	factory, ok := obfsTransports[name]
+	return factory, ok
+}
+
+func obfsTransportNames() []string {
+	obfsTransportsMutex.RLock()
+	defer obfsTransportsMutex.RUnlock()
+	names := make([]string, 0, len(obfsTransports))
+	for name := range obfsTransports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var obfsDecoder = structure.NewDecoder(structure.Option{TagName: "obfs", WeaklyTypedInput: true})
+
+type simpleObfsOptions struct {
+	Mode string `obfs:"mode"`
+	Host string `obfs:"host,omitempty"`
+}
+
+type v2rayPluginOptions struct {
+	Mode                     string            `obfs:"mode,omitempty"`
+	Host                     string            `obfs:"host,omitempty"`
+	Path                     string            `obfs:"path,omitempty"`
+	TLS                      bool              `obfs:"tls,omitempty"`
+	Fingerprint              string            `obfs:"fingerprint,omitempty"`
+	Headers                  map[string]string `obfs:"headers,omitempty"`
+	SkipCertVerify           bool              `obfs:"skip-cert-verify,omitempty"`
+	Mux                      bool              `obfs:"mux,omitempty"`
+	V2rayHttpUpgrade         bool              `obfs:"v2ray-http-upgrade,omitempty"`
+	V2rayHttpUpgradeFastOpen bool              `obfs:"v2ray-http-upgrade-fast-open,omitempty"`
+}
+
+type shadowTlsOptions struct {
+	Password       string   `obfs:"password,omitempty"`
+	Host           string   `obfs:"host"`
+	Fingerprint    string   `obfs:"fingerprint,omitempty"`
+	SkipCertVerify bool     `obfs:"skip-cert-verify,omitempty"`
+	Version        int      `obfs:"version,omitempty"`
+	ALPN           []string `obfs:"alpn,omitempty"`
+}
+
+type restlsOptions struct {
+	Password     string `obfs:"password"`
+	Host         string `obfs:"host"`
+	VersionHint  string `obfs:"version-hint"`
+	RestlsScript string `obfs:"restls-script,omitempty"`
+}
+
+func init() {
+	RegisterObfsTransport("simple-obfs", func(server, _ string, options map[string]any) (ObfsLayer, error) {
+		opts := simpleObfsOptions{Host: "bing.com"}
+		if err := obfsDecoder.Decode(options, &opts); err != nil {
+			return nil, err
+		}
+		_, port, _ := net.SplitHostPort(server)
+		switch opts.Mode {
+		case "http":
+			return func(_ context.Context, conn net.Conn) (net.Conn, error) {
+				return obfs.NewHTTPObfs(conn, opts.Host, port), nil
+			}, nil
+		case "tls":
+			return func(_ context.Context, conn net.Conn) (net.Conn, error) {
+				return obfs.NewTLSObfs(conn, opts.Host), nil
+			}, nil
+		default:
+			return nil, fmt.Errorf("unknown simple-obfs mode %q, expected http or tls", opts.Mode)
+		}
+	})
+	RegisterObfsTransport("v2ray-plugin", func(_, _ string, options map[string]any) (ObfsLayer, error) {
+		opts := v2rayPluginOptions{Mode: "websocket", Host: "bing.com", Mux: true}
+		if err := obfsDecoder.Decode(options, &opts); err != nil {
+			return nil, err
+		}
+		if opts.Mode != "websocket" {
+			return nil, fmt.Errorf("unknown v2ray-plugin mode %q, only websocket is supported", opts.Mode)
+		}
+		option := &v2rayObfs.Option{
+			Host:                     opts.Host,
+			Path:                     opts.Path,
+			Headers:                  opts.Headers,
+			TLS:                      opts.TLS,
+			SkipCertVerify:           opts.SkipCertVerify,
+			Fingerprint:              opts.Fingerprint,
+			Mux:                      opts.Mux,
+			V2rayHttpUpgrade:         opts.V2rayHttpUpgrade,
+			V2rayHttpUpgradeFastOpen: opts.V2rayHttpUpgradeFastOpen,
+		}
+		return func(ctx context.Context, conn net.Conn) (net.Conn, error) {
+			return v2rayObfs.NewV2rayObfs(ctx, conn, option)
+		}, nil
+	})
+	RegisterObfsTransport(shadowtls.Mode, func(_, fingerprint string, options map[string]any) (ObfsLayer, error) {
+		opts := shadowTlsOptions{Version: 3}
+		if err := obfsDecoder.Decode(options, &opts); err != nil {
+			return nil, err
+		}
+		if opts.Host == "" {
+			return nil, fmt.Errorf("shadow-tls requires host")
+		}
+		if opts.Version != 1 && opts.Password == "" {
+			return nil, fmt.Errorf("shadow-tls v%d requires password", opts.Version)
+		}
+		option := &shadowtls.ShadowTLSOption{
+			Password:          opts.Password,
+			Host:              opts.Host,
+			Fingerprint:       opts.Fingerprint,
+			ClientFingerprint: fingerprint,
+			SkipCertVerify:    opts.SkipCertVerify,
+			Version:           opts.Version,
+			ALPN:              opts.ALPN,
+		}
+		if option.ALPN == nil {
+			option.ALPN = shadowtls.DefaultALPN
+		}
+		return func(ctx context.Context, conn net.Conn) (net.Conn, error) {
+			return shadowtls.NewShadowTLS(ctx, conn, option)
+		}, nil
+	})
+	RegisterObfsTransport(restls.Mode, func(_, fingerprint string, options map[string]any) (ObfsLayer, error) {
+		opts := restlsOptions{}
+		if err := obfsDecoder.Decode(options, &opts); err != nil {
+			return nil, err
+		}
+		restlsConfig, err := restls.NewRestlsConfig(opts.Host, opts.Password, opts.VersionHint, opts.RestlsScript, fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context, conn net.Conn) (net.Conn, error) {
+			return restls.NewRestls(ctx, conn, restlsConfig)
+		}, nil
+	})
+}
+
+type obfsChain struct {
+	names  []string
+	layers []ObfsLayer
+}
+
+// parseObfsChain builds the layers of an obfs-chain, every entry names its transport in type
+func parseObfsChain(mapping map[string]any) (*obfsChain, error) {
+	entries, ok := mapping[obfsChainKey].([]any)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a list", obfsChainKey)
+	}
+	server := net.JoinHostPort(fmt.Sprint(mapping["server"]), fmt.Sprint(mapping["port"]))
+	fingerprint, _ := mapping[clientFingerprintKey].(string)
+	chain := &obfsChain{}
+	for index, entry := range entries {
+		options, ok := entry.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s[%d] must be a mapping", obfsChainKey, index)
+		}
+		name, _ := options["type"].(string)
+		factory, ok := obfsTransport(name)
+		if !ok {
+			return nil, fmt.Errorf("%s[%d]: unknown transport %q", obfsChainKey, index, name)
+		}
+		layer, err := factory(server, fingerprint, options)
+		if err != nil {
+			return nil, fmt.Errorf("%s[%d] %s: %w", obfsChainKey, index, name, err)
+		}
+		chain.names = append(chain.names, name)
+		chain.layers = append(chain.layers, layer)
+	}
+	if len(chain.layers) == 0 {
+		return nil, fmt.Errorf("%s is empty", obfsChainKey)
+	}
+	return chain, nil
+}
+
+func validateObfsChainHints(mapping map[string]any) []ProxyError {
+	if _, ok := mapping[obfsChainKey]; !ok {
+		return nil
+	}
+	proxyType, _ := mapping["type"].(string)
+	if !obfsChainTypes[proxyType] {
+		return []ProxyError{{Field: obfsChainKey, Message: fmt.Sprintf("%s outbounds cannot carry an obfuscation chain", proxyType)}}
+	}
+	if _, err := parseObfsChain(mapping); err != nil {
+		return []ProxyError{{Field: obfsChainKey, Message: err.Error()}}
+	}
+	return nil
+}
+
+type obfsPolicy struct {
+	chain *obfsChain
+	err   error
+}
+
+type ObfsChainStatus struct {
+	Layers []string `json:"layers"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// ObfsTransports keeps the obfuscation chains of the profile outbounds
+type ObfsTransports struct {
+	mutex    sync.Mutex
+	policies map[string]*obfsPolicy
+}
+
+var obfsTransportLayers = &ObfsTransports{policies: map[string]*obfsPolicy{}}
+
+// Prepare takes the obfs-chain of every outbound, mihomo does not know the key, an outbound whose
+// chain is invalid fails its dials rather than reach its server without the obfuscation
+func (o *ObfsTransports) Prepare(rawConfig *config.RawConfig) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.policies = map[string]*obfsPolicy{}
+	for _, mapping := range rawConfig.Proxy {
+		if _, ok := mapping[obfsChainKey]; !ok {
+			continue
+		}
+		name, _ := mapping["name"].(string)
+		proxyType, _ := mapping["type"].(string)
+		policy := &obfsPolicy{}
+		if !obfsChainTypes[proxyType] {
+			policy.err = fmt.Errorf("%s outbounds cannot carry an obfuscation chain", proxyType)
+		} else {
+			policy.chain, policy.err = parseObfsChain(mapping)
+		}
+		delete(mapping, obfsChainKey)
+		if policy.err != nil {
+			log.Warnln("[Obfs] %s: %v", name, policy.err)
+		}
+		o.policies[name] = policy
+	}
+}
+
+func (o *ObfsTransports) wrap(name string, proxy C.ProxyAdapter) C.ProxyAdapter {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	policy, ok := o.policies[name]
+	if !ok {
+		return proxy
+	}
+	if policy.err == nil && !happyEyeballsCapable(unwrapAdapter(proxy)) {
+		policy.err = fmt.Errorf("%s replaces the dialer of its server, the chain cannot be applied", name)
+		log.Warnln("[Obfs] %v", policy.err)
+	}
+	return &obfsAdapter{ProxyAdapter: proxy, chain: policy.chain, err: policy.err}
+}
+
+func (o *ObfsTransports) Status() map[string]*ObfsChainStatus {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	status := map[string]*ObfsChainStatus{}
+	for name, policy := range o.policies {
+		item := &ObfsChainStatus{Layers: []string{}}
+		if policy.chain != nil {
+			item.Layers = policy.chain.names
+		}
+		if policy.err != nil {
+			item.Error = policy.err.Error()
+		}
+		status[name] = item
+	}
+	return status
+}
+
+type obfsAdapter struct {
+	C.ProxyAdapter
+	chain *obfsChain
+	err   error
+}
+
+func (a *obfsAdapter) Inner() C.ProxyAdapter {
+	return a.ProxyAdapter
+}
+
+func (a *obfsAdapter) dialer(base C.Dialer) (C.Dialer, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+	if base == nil {
+		options := unwrapAdapter(a.ProxyAdapter).(interface{ DialOptions() []dialer.Option }).DialOptions()
+		base = dialer.NewDialer(options...)
+	}
+	return &obfsDialer{dialer: base, chain: a.chain}, nil
+}
+
+func (a *obfsAdapter) DialContext(ctx context.Context, metadata *C.Metadata) (C.Conn, error) {
+	return a.DialContextWithDialer(ctx, nil, metadata)
+}
+
+func (a *obfsAdapter) DialContextWithDialer(ctx context.Context, base C.Dialer, metadata *C.Metadata) (C.Conn, error) {
+	obfsDialer, err := a.dialer(base)
+	if err != nil {
+		return nil, err
+	}
+	return a.ProxyAdapter.DialContextWithDialer(ctx, obfsDialer, metadata)
+}
+
+func (a *obfsAdapter) ListenPacketContext(ctx context.Context, metadata *C.Metadata) (C.PacketConn, error) {
+	return a.ListenPacketWithDialer(ctx, nil, metadata)
+}
+
+func (a *obfsAdapter) ListenPacketWithDialer(ctx context.Context, base C.Dialer, metadata *C.Metadata) (C.PacketConn, error) {
+	obfsDialer, err := a.dialer(base)
+	if err != nil {
+		return nil, err
+	}
+	return a.ProxyAdapter.ListenPacketWithDialer(ctx, obfsDialer, metadata)
+}
+
+// obfsDialer applies the chain to the tcp connections an outbound opens to its server, the udp
+// of outbounds with a native udp relay is left as it is
+type obfsDialer struct {
+	dialer C.Dialer
+	chain  *obfsChain
+}
+
+func (d *obfsDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	for index, layer := range d.chain.layers {
+		wrapped, err := layer(ctx, conn)
+		if err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("%s connect error: %w", d.chain.names[index], err)
+		}
+		conn = wrapped
+	}
+	return conn, nil
+}
+
+func (d *obfsDialer) ListenPacket(ctx context.Context, network, address string, rAddrPort netip.AddrPort) (net.PacketConn, error) {
+	return d.dialer.ListenPacket(ctx, network, address, rAddrPort)
+}
+
+func handleGetObfsTransports() string {
+	data, err := json.Marshal(map[string]any{
+		"transports": obfsTransportNames(),
+		"chains":     obfsTransportLayers.Status(),
+	})
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
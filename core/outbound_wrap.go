@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/metacubex/mihomo/adapter"
+	"github.com/metacubex/mihomo/adapter/outboundgroup"
+	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/tunnel"
+)
+
+// wrappedAdapter is an outbound layer added by the core around the adapter a profile created
+type wrappedAdapter interface {
+	C.ProxyAdapter
+	Inner() C.ProxyAdapter
+}
+
+func unwrapAdapter(proxy C.ProxyAdapter) C.ProxyAdapter {
+	for {
+		wrapped, ok := proxy.(wrappedAdapter)
+		if !ok {
+			return proxy
+		}
+		proxy = wrapped.Inner()
+	}
+}
+
+func findWrapped[T wrappedAdapter](proxy C.ProxyAdapter) (T, bool) {
+	for {
+		if found, ok := proxy.(T); ok {
+			return found, true
+		}
+		wrapped, ok := proxy.(wrappedAdapter)
+		if !ok {
+			var zero T
+			return zero, false
+		}
+		proxy = wrapped.Inner()
+	}
+}
+
+// groupProxies returns the members of a group as the outermost layer offering them sees them
+func groupProxies(proxy C.ProxyAdapter, touch bool) []C.Proxy {
+	for {
+		if group, ok := proxy.(interface{ GetProxies(touch bool) []C.Proxy }); ok {
+			return group.GetProxies(touch)
+		}
+		wrapped, ok := proxy.(wrappedAdapter)
+		if !ok {
+			return nil
+		}
+		proxy = wrapped.Inner()
+	}
+}
+
+func groupTestUrl(proxy C.ProxyAdapter) string {
+	data, err := unwrapAdapter(proxy).MarshalJSON()
+	if err != nil {
+		return ""
+	}
+	var snapshot struct {
+		TestUrl string `json:"testUrl"`
+	}
+	_ = json.Unmarshal(data, &snapshot)
+	return snapshot.TestUrl
+}
+
+// pickGroupMember keeps the choice of the group when it is among the candidates and otherwise
+// takes the fastest candidate for a url-test group or the first alive one
+func pickGroupMember(group C.ProxyAdapter, candidates []C.Proxy, metadata *C.Metadata, touch bool) C.Proxy {
+	if len(candidates) == 0 {
+		return nil
+	}
+	if chosen := group.Unwrap(metadata, touch); chosen != nil {
+		for _, candidate := range candidates {
+			if candidate.Name() == chosen.Name() {
+				return chosen
+			}
+		}
+	}
+	testUrl := groupTestUrl(group)
+	_, fastest := unwrapAdapter(group).(*outboundgroup.URLTest)
+	var best C.Proxy
+	for _, candidate := range candidates {
+		if !candidate.AliveForTestUrl(testUrl) {
+			continue
+		}
+		if !fastest {
+			return candidate
+		}
+		if best == nil || candidate.LastDelayForTestUrl(testUrl) < best.LastDelayForTestUrl(testUrl) {
+			best = candidate
+		}
+	}
+	if best == nil {
+		return candidates[0]
+	}
+	return best
+}
+
+// rewrapOutboundsLocked rebuilds the layers of every outbound in place so the groups holding them
+// follow, the innermost layer is added first, the caller holds runLock
+func rewrapOutboundsLocked() {
+	for name, proxy := range tunnel.ProxiesWithProviders() {
+		outbound, ok := proxy.(*adapter.Proxy)
+		if !ok {
+			continue
+		}
+		wrapped := unwrapAdapter(outbound.ProxyAdapter)
+		wrapped = clientFingerprints.wrap(name, wrapped)
+		wrapped = encryptedClientHello.wrap(name, wrapped)
+		wrapped = reality.wrap(name, wrapped)
+		wrapped = obfsTransportLayers.wrap(name, wrapped)
+		wrapped = certPinning.wrap(name, wrapped)
+		wrapped = loadBalancing.wrap(name, wrapped)
+		wrapped = smartGroups.wrap(name, wrapped)
+		wrapped = groupFilters.wrap(name, wrapped)
+		wrapped = geofences.wrap(name, wrapped)
+		wrapped = interfaceBindings.wrap(name, wrapped)
+		wrapped = dialRacing.wrap(name, wrapped)
+		wrapped = udpOverTcp.wrap(name, wrapped)
+		wrapped = killSwitch.wrap(name, wrapped)
+		outbound.ProxyAdapter = wrapped
+	}
+}
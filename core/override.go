@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/config"
+	"github.com/metacubex/mihomo/constant"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const overridesDir = "overrides"
+
+// ProfileOverride holds user patches applied on top of a subscription profile
+type ProfileOverride struct {
+	PrependRules       []string         `yaml:"prepend-rules" json:"prepend-rules"`
+	AppendRules        []string         `yaml:"append-rules" json:"append-rules"`
+	PrependProxies     []map[string]any `yaml:"prepend-proxies" json:"prepend-proxies"`
+	AppendProxies      []map[string]any `yaml:"append-proxies" json:"append-proxies"`
+	PrependProxyGroups []map[string]any `yaml:"prepend-proxy-groups" json:"prepend-proxy-groups"`
+	AppendProxyGroups  []map[string]any `yaml:"append-proxy-groups" json:"append-proxy-groups"`
+	// DNS replaces the dns section of the profile as a whole
+	DNS map[string]any `yaml:"dns" json:"dns"`
+	// Merge is deep merged into the profile, maps merge recursively and other values replace
+	Merge map[string]any `yaml:"merge" json:"merge"`
+}
+
+type SetProfileOverrideParams struct {
+	ProfileId string `json:"profile-id"`
+	Override  string `json:"override"`
+}
+
+// MergeProfile applies override to the base profile and returns the merged yaml
+func MergeProfile(base []byte, override *ProfileOverride) ([]byte, error) {
+	profile := map[string]any{}
+	if err := yaml.Unmarshal(base, &profile); err != nil {
+		return nil, err
+	}
+	return mergeProfileMap(profile, override)
+}
+
+// mergeProfileMap applies override to a decoded profile and encodes the result
+func mergeProfileMap(profile map[string]any, override *ProfileOverride) ([]byte, error) {
+	if override.Merge != nil {
+		deepMerge(profile, override.Merge)
+	}
+	if override.DNS != nil {
+		profile["dns"] = override.DNS
+	}
+	profile["proxies"] = mergeNamedList(profile["proxies"], override.PrependProxies, override.AppendProxies)
+	profile["proxy-groups"] = mergeNamedList(profile["proxy-groups"], override.PrependProxyGroups, override.AppendProxyGroups)
+
+	rules, _ := profile["rules"].([]any)
+	merged := make([]any, 0, len(override.PrependRules)+len(rules)+len(override.AppendRules))
+	for _, rule := range override.PrependRules {
+		merged = append(merged, rule)
+	}
+	merged = append(merged, rules...)
+	for _, rule := range override.AppendRules {
+		merged = append(merged, rule)
+	}
+	profile["rules"] = merged
+	return yaml.Marshal(profile)
+}
+
+// mergeNamedList inserts entries around the base list, entries replace base entries of the same name
+func mergeNamedList(base any, prefix, suffix []map[string]any) []any {
+	names := map[string]bool{}
+	for _, entry := range prefix {
+		names[fmt.Sprint(entry["name"])] = true
+	}
+	for _, entry := range suffix {
+		names[fmt.Sprint(entry["name"])] = true
+	}
+	baseList, _ := base.([]any)
+	merged := make([]any, 0, len(prefix)+len(baseList)+len(suffix))
+	for _, entry := range prefix {
+		merged = append(merged, entry)
+	}
+	for _, entry := range baseList {
+		if mapping, ok := entry.(map[string]any); ok && names[fmt.Sprint(mapping["name"])] {
+			continue
+		}
+		merged = append(merged, entry)
+	}
+	for _, entry := range suffix {
+		merged = append(merged, entry)
+	}
+	return merged
+}
+
+func deepMerge(dst, src map[string]any) {
+	for key, value := range src {
+		srcMap, srcIsMap := value.(map[string]any)
+		dstMap, dstIsMap := dst[key].(map[string]any)
+		if srcIsMap && dstIsMap {
+			deepMerge(dstMap, srcMap)
+			continue
+		}
+		dst[key] = value
+	}
+}
+
+func overridePath(profileId string) (string, error) {
+	if profileId == "" || strings.ContainsAny(profileId, `/\`) || strings.Contains(profileId, "..") {
+		return "", errors.New("invalid profile id")
+	}
+	return filepath.Join(constant.Path.Resolve(overridesDir), profileId+".yaml"), nil
+}
+
+// GetProfileOverride loads the stored override of a profile, nil when none is set
+func GetProfileOverride(profileId string) (*ProfileOverride, []byte, error) {
+	path, err := overridePath(profileId)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	override := &ProfileOverride{}
+	if err := yaml.Unmarshal(data, override); err != nil {
+		return nil, nil, err
+	}
+	return override, data, nil
+}
+
+// SetProfileOverride validates and stores the override document of a profile
+func SetProfileOverride(profileId string, document []byte) error {
+	path, err := overridePath(profileId)
+	if err != nil {
+		return err
+	}
+	override := &ProfileOverride{}
+	if err := yaml.Unmarshal(document, override); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, document, 0644)
+}
+
+// RemoveProfileOverride deletes the override of a profile
+func RemoveProfileOverride(profileId string) error {
+	path, err := overridePath(profileId)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// applyProfileOverride merges the stored override of profileId into content, runs its script and validates the result
+func applyProfileOverride(profileId string, content []byte) ([]byte, bool, error) {
+	merged, overridden, err := applyOverrideDocument(profileId, content)
+	if err != nil {
+		return nil, false, err
+	}
+	transformed, scripted, err := applyProfileScript(profileId, merged)
+	if overridden && (err != nil || scripted) {
+		clearBytes(merged)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return transformed, overridden || scripted, nil
+}
+
+func applyOverrideDocument(profileId string, content []byte) ([]byte, bool, error) {
+	override, _, err := GetProfileOverride(profileId)
+	if err != nil || override == nil {
+		return content, false, err
+	}
+	merged, err := MergeProfile(content, override)
+	if err != nil {
+		return nil, false, fmt.Errorf("apply override: %v", err)
+	}
+	return validateOverride(merged)
+}
+
+// applyOverrideReader is applyOverrideDocument for a streamed profile, the override is merged into
+// the decoded document so the profile is never read whole. The result belongs to the caller either way
+func applyOverrideReader(profileId string, r io.Reader) ([]byte, bool, error) {
+	override, _, err := GetProfileOverride(profileId)
+	if err != nil {
+		return nil, false, err
+	}
+	if override == nil {
+		content, err := readAllSecure(r)
+		return content, false, err
+	}
+	profile := map[string]any{}
+	if err := yaml.NewDecoder(r).Decode(&profile); err != nil && err != io.EOF {
+		return nil, false, fmt.Errorf("apply override: %v", err)
+	}
+	merged, err := mergeProfileMap(profile, override)
+	if err != nil {
+		return nil, false, fmt.Errorf("apply override: %v", err)
+	}
+	return validateOverride(merged)
+}
+
+func validateOverride(merged []byte) ([]byte, bool, error) {
+	if _, err := config.UnmarshalRawConfig(merged); err != nil {
+		clearBytes(merged)
+		return nil, false, fmt.Errorf("apply override: %v", err)
+	}
+	return merged, true, nil
+}
+
+func handleSetProfileOverride(paramsString string) string {
+	var params = &SetProfileOverrideParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err.Error()
+	}
+	var err error
+	if strings.TrimSpace(params.Override) == "" {
+		err = RemoveProfileOverride(params.ProfileId)
+	} else {
+		err = SetProfileOverride(params.ProfileId, []byte(params.Override))
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// GetMergedProfile returns the cached subscription of profileId with its override and script applied
+func GetMergedProfile(profileId string) ([]byte, error) {
+	var merged []byte
+	err := WithSecureProfileContentReader(profileId, func(r io.Reader) error {
+		content, _, err := applyOverrideReader(profileId, r)
+		if err != nil {
+			return err
+		}
+		transformed, scripted, err := applyProfileScript(profileId, content)
+		if err != nil || scripted {
+			clearBytes(content)
+		}
+		merged = transformed
+		return err
+	})
+	return merged, err
+}
+
+func handleGetMergedProfile(profileId string) (string, error) {
+	merged, err := GetMergedProfile(profileId)
+	if err != nil {
+		return "", err
+	}
+	defer clearBytes(merged)
+	return string(merged), nil
+}
+
+func handleGetProfileOverride(profileId string) string {
+	_, data, err := GetProfileOverride(profileId)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
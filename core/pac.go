@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/adapter"
+	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/tunnel"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+const (
+	pacDirect = iota
+	pacProxy
+	pacReject
+)
+
+const maxPacGroupDepth = 8
+
+type GeneratePacParams struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+type PacResult struct {
+	Pac     string `json:"pac"`
+	Proxy   string `json:"proxy"`
+	Rules   int    `json:"rules"`
+	Skipped int    `json:"skipped"`
+}
+
+// pacProxyPort is the port a pac client reaches the core on, mixed first since it takes both http
+// and socks
+func pacProxyPort() (int, bool) {
+	runLock.Lock()
+	defer runLock.Unlock()
+	if currentConfig == nil {
+		return 0, false
+	}
+	general := currentConfig.General
+	if general.MixedPort != 0 {
+		return general.MixedPort, true
+	}
+	return general.Port, false
+}
+
+// pacRoute follows the groups to what they select now, so the pac has to be generated again once
+// a selection changes
+func pacRoute(proxies map[string]C.Proxy, name string) int {
+	for i := 0; i < maxPacGroupDepth; i++ {
+		proxy, ok := proxies[name]
+		if !ok {
+			return pacProxy
+		}
+		switch proxy.Type() {
+		case C.Direct, C.Compatible:
+			return pacDirect
+		case C.Reject, C.RejectDrop:
+			return pacReject
+		}
+		group, ok := proxy.(*adapter.Proxy)
+		if !ok {
+			return pacProxy
+		}
+		now, ok := group.ProxyAdapter.(interface{ Now() string })
+		if !ok || now.Now() == "" {
+			return pacProxy
+		}
+		name = now.Now()
+	}
+	return pacProxy
+}
+
+// pacResolves tells the ip rules matching a resolved host from the no-resolve ones, the rule only
+// asks for the ip when it may resolve
+func pacResolves(rule C.Rule) bool {
+	resolves := false
+	rule.Match(&C.Metadata{Host: "pac.invalid"}, C.RuleMatchHelper{ResolveIP: func() {
+		resolves = true
+	}})
+	return resolves
+}
+
+func flattenPacRules(rules []C.Rule) []C.Rule {
+	flat := make([]C.Rule, 0, len(rules))
+	for _, rule := range rules {
+		if run, ok := rule.(*domainRunRule); ok {
+			flat = append(flat, run.rules...)
+			continue
+		}
+		flat = append(flat, rule)
+	}
+	return flat
+}
+
+// pacEntry compiles a rule into the [kind, payload, route] triple of the script, the rules a
+// browser cannot see like process, port or rule set ones have none
+func pacEntry(rule C.Rule, route int) ([]any, bool) {
+	payload := strings.ToLower(rule.Payload())
+	switch rule.RuleType() {
+	case C.Domain:
+		return []any{"d", payload, route}, true
+	case C.DomainSuffix:
+		return []any{"s", payload, route}, true
+	case C.DomainKeyword:
+		return []any{"k", payload, route}, true
+	case C.IPCIDR:
+		prefix, err := netip.ParsePrefix(rule.Payload())
+		if err != nil || !prefix.Addr().Is4() {
+			// isInNet only knows ipv4
+			return nil, false
+		}
+		mask := net.IP(net.CIDRMask(prefix.Bits(), 32)).String()
+		kind := "i"
+		if pacResolves(rule) {
+			kind = "r"
+		}
+		return []any{kind, prefix.Masked().Addr().String(), mask, route}, true
+	}
+	return nil, false
+}
+
+const pacScript = `var routes = %s;
+var rules = %s;
+
+function FindProxyForURL(url, host) {
+  host = host.toLowerCase();
+  if (isPlainHostName(host)) {
+    return "DIRECT";
+  }
+  var literal = /^\d+\.\d+\.\d+\.\d+$/.test(host);
+  var ip = literal ? host : undefined;
+  for (var i = 0; i < rules.length; i++) {
+    var rule = rules[i];
+    var kind = rule[0];
+    if (kind == "d") {
+      if (host == rule[1]) return routes[rule[2]];
+    } else if (kind == "s") {
+      if (host == rule[1] || dnsDomainIs(host, "." + rule[1])) return routes[rule[2]];
+    } else if (kind == "k") {
+      if (host.indexOf(rule[1]) >= 0) return routes[rule[2]];
+    } else if (kind == "i" || kind == "r") {
+      if (ip === undefined && kind == "r") ip = dnsResolve(host);
+      if (ip && isInNet(ip, rule[1], rule[2])) return routes[rule[3]];
+    }
+  }
+  return routes[%d];
+}
+`
+
+// compilePac turns the domain and ipv4 rules of the tunnel into a pac pointing at host:port, the
+// first match wins as in the tunnel and the rules a browser cannot evaluate are skipped
+func compilePac(host string, port int, mixed bool) (*PacResult, error) {
+	if port == 0 {
+		return nil, errors.New("no http or mixed port is open")
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	proxyRoute := "PROXY " + address
+	if mixed {
+		proxyRoute += "; SOCKS5 " + address
+	}
+	// a refused port makes the browser give up instead of falling back to direct
+	routes := []string{"DIRECT", proxyRoute, "PROXY 127.0.0.1:9"}
+	result := &PacResult{Proxy: address}
+	entries := make([]any, 0)
+	final := pacProxy
+	proxies := tunnel.Proxies()
+	switch tunnel.Mode() {
+	case tunnel.Global:
+	case tunnel.Direct:
+		final = pacDirect
+	default:
+		final = pacDirect
+		for _, rule := range flattenPacRules(tunnel.Rules()) {
+			route := pacRoute(proxies, rule.Adapter())
+			if rule.RuleType() == C.MATCH {
+				final = route
+				break
+			}
+			entry, ok := pacEntry(rule, route)
+			if !ok {
+				result.Skipped++
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	}
+	result.Rules = len(entries)
+	routesData, err := json.Marshal(routes)
+	if err != nil {
+		return nil, err
+	}
+	entriesData, err := json.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+	result.Pac = fmt.Sprintf(pacScript, routesData, entriesData, final)
+	return result, nil
+}
+
+func handleGeneratePac(paramsString string) (string, error) {
+	var params = &GeneratePacParams{}
+	if paramsString != "" {
+		if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+			return "", err
+		}
+	}
+	if params.Host == "" {
+		params.Host = "127.0.0.1"
+	}
+	port, mixed := pacProxyPort()
+	if params.Port != 0 {
+		port = params.Port
+	}
+	result, err := compilePac(params.Host, port, mixed)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,141 @@
+package platform
+
+import (
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// memoryLocks counts the locks of every page, buffers sharing a page keep it pinned until the last
+// of them is unlocked since the kernel only knows whole pages
+type memoryLocks struct {
+	mutex     sync.Mutex
+	pages     map[uintptr]int
+	buffers   map[memorySpan]*bufferLocks
+	failures  int
+	succeeded bool
+}
+
+type memorySpan struct {
+	base uintptr
+	size int
+}
+
+// bufferLocks tells the locks of a buffer that pinned its pages from the ones that failed
+type bufferLocks struct {
+	locked int
+	failed int
+}
+
+var locks = &memoryLocks{
+	pages:   map[uintptr]int{},
+	buffers: map[memorySpan]*bufferLocks{},
+}
+
+var pageSize = uintptr(os.Getpagesize())
+
+func spanOf(b []byte) memorySpan {
+	return memorySpan{base: uintptr(unsafe.Pointer(&b[0])), size: len(b)}
+}
+
+func (s memorySpan) firstPage() uintptr {
+	return s.base &^ (pageSize - 1)
+}
+
+func (s memorySpan) end() uintptr {
+	return s.base + uintptr(s.size)
+}
+
+// LockMemory pins b in physical memory so it is never swapped to disk
+func LockMemory(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	locks.mutex.Lock()
+	defer locks.mutex.Unlock()
+	span := spanOf(b)
+	buffer := locks.buffers[span]
+	if buffer == nil {
+		buffer = &bufferLocks{}
+		locks.buffers[span] = buffer
+	}
+	err := lockMemory(b)
+	if err != nil {
+		buffer.failed++
+		locks.failures++
+		return err
+	}
+	buffer.locked++
+	locks.succeeded = true
+	for page := span.firstPage(); page < span.end(); page += pageSize {
+		locks.pages[page]++
+	}
+	return nil
+}
+
+// UnlockMemory releases a buffer pinned by LockMemory, only the pages no other buffer holds are
+// unlocked
+func UnlockMemory(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	locks.mutex.Lock()
+	defer locks.mutex.Unlock()
+	span := spanOf(b)
+	buffer := locks.buffers[span]
+	if buffer == nil {
+		return
+	}
+	if buffer.locked == 0 {
+		buffer.failed--
+		locks.failures--
+	} else {
+		buffer.locked--
+		locks.unlockPages(b, span)
+	}
+	if buffer.locked == 0 && buffer.failed == 0 {
+		delete(locks.buffers, span)
+	}
+}
+
+// unlockPages unlocks the runs of pages of b whose count drops to zero, the part of b within a
+// page stands for the whole page
+func (l *memoryLocks) unlockPages(b []byte, span memorySpan) {
+	start := -1
+	offset := func(page uintptr) int {
+		if page < span.base {
+			return 0
+		}
+		if page > span.end() {
+			return span.size
+		}
+		return int(page - span.base)
+	}
+	flush := func(page uintptr) {
+		if start >= 0 {
+			_ = unlockMemory(b[start:offset(page)])
+			start = -1
+		}
+	}
+	page := span.firstPage()
+	for ; page < span.end(); page += pageSize {
+		l.pages[page]--
+		if l.pages[page] > 0 {
+			flush(page)
+			continue
+		}
+		delete(l.pages, page)
+		if start < 0 {
+			start = offset(page)
+		}
+	}
+	flush(page)
+}
+
+// MemoryLockActive reports whether every buffer held locked right now is pinned, at least one lock
+// has to have worked
+func MemoryLockActive() bool {
+	locks.mutex.Lock()
+	defer locks.mutex.Unlock()
+	return locks.succeeded && locks.failures == 0
+}
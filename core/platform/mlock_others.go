@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !windows
+
+package platform
+
+import "errors"
+
+func MemoryLockSupported() bool {
+	return false
+}
+
+func lockMemory(_ []byte) error {
+	return errors.New("memory locking is not supported")
+}
+
+func unlockMemory(_ []byte) error {
+	return nil
+}
@@ -0,0 +1,48 @@
+package platform
+
+import "testing"
+
+func TestUnlockKeepsSharedPagesLocked(t *testing.T) {
+	page := make([]byte, 2*int(pageSize))
+	// two buffers within one page
+	first, second := page[8:16], page[32:40]
+	if err := LockMemory(first); err != nil {
+		t.Skipf("memory locking is not available: %v", err)
+	}
+	if err := LockMemory(second); err != nil {
+		t.Fatal(err)
+	}
+	shared := spanOf(first).firstPage()
+	if shared != spanOf(second).firstPage() {
+		t.Skip("the buffers landed on different pages")
+	}
+	UnlockMemory(first)
+	if count := locks.pages[shared]; count != 1 {
+		t.Fatalf("page is held %d times after unlocking one buffer", count)
+	}
+	UnlockMemory(second)
+	if _, ok := locks.pages[shared]; ok {
+		t.Fatal("page is still counted after unlocking every buffer")
+	}
+	if len(locks.buffers) != 0 {
+		t.Fatalf("%d buffers are still tracked", len(locks.buffers))
+	}
+}
+
+func TestMemoryLockActiveReportsFailures(t *testing.T) {
+	buffer := make([]byte, 64)
+	if err := LockMemory(buffer); err != nil {
+		if MemoryLockActive() {
+			t.Fatal("active while a buffer failed to lock")
+		}
+		UnlockMemory(buffer)
+		if locks.failures != 0 {
+			t.Fatalf("%d failures left after unlocking", locks.failures)
+		}
+		return
+	}
+	if !MemoryLockActive() {
+		t.Fatal("inactive with every buffer locked")
+	}
+	UnlockMemory(buffer)
+}
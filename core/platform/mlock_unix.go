@@ -0,0 +1,17 @@
+//go:build linux || darwin
+
+package platform
+
+import "syscall"
+
+func MemoryLockSupported() bool {
+	return true
+}
+
+func lockMemory(b []byte) error {
+	return syscall.Mlock(b)
+}
+
+func unlockMemory(b []byte) error {
+	return syscall.Munlock(b)
+}
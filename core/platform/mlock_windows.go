@@ -0,0 +1,20 @@
+//go:build windows
+
+package platform
+
+import (
+	"golang.org/x/sys/windows"
+	"unsafe"
+)
+
+func MemoryLockSupported() bool {
+	return true
+}
+
+func lockMemory(b []byte) error {
+	return windows.VirtualLock(uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)))
+}
+
+func unlockMemory(b []byte) error {
+	return windows.VirtualUnlock(uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)))
+}
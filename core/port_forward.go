@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/adapter/inbound"
+	"github.com/metacubex/mihomo/constant"
+	LT "github.com/metacubex/mihomo/listener/tunnel"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	"github.com/metacubex/mihomo/tunnel/statistic"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	portForwardStoreFile = "forwards.json"
+	portForwardInPrefix  = "forward-"
+)
+
+// PortForwardParams makes the core listen on Listen and carry every connection to Target through
+// Proxy like ssh -L does, a bare port listens on loopback and no proxy follows the rules
+type PortForwardParams struct {
+	Id      string   `json:"id"`
+	Listen  string   `json:"listen"`
+	Target  string   `json:"target"`
+	Proxy   string   `json:"proxy"`
+	Network []string `json:"network"`
+}
+
+type PortForwardStatus struct {
+	PortForwardParams
+	Address     string `json:"address,omitempty"`
+	Connections int    `json:"connections"`
+	Error       string `json:"error,omitempty"`
+}
+
+type portForward struct {
+	params PortForwardParams
+	tcp    *LT.Listener
+	udp    *LT.PacketConn
+	err    error
+}
+
+func (f *portForward) listening() bool {
+	return f.tcp != nil || f.udp != nil
+}
+
+func (f *portForward) start() {
+	inName := portForwardInPrefix + f.params.Id
+	var errs []error
+	for _, network := range f.params.Network {
+		switch network {
+		case "tcp":
+			listener, err := LT.New(f.params.Listen, f.params.Target, f.params.Proxy, lanTunnel, inbound.WithInName(inName))
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			f.tcp = listener
+		case "udp":
+			listener, err := LT.NewUDP(f.params.Listen, f.params.Target, f.params.Proxy, lanTunnel, inbound.WithInName(inName))
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			f.udp = listener
+		}
+	}
+	f.err = errors.Join(errs...)
+	if f.err != nil {
+		log.Warnln("[Forward] %s %s -> %s: %v", f.params.Id, f.params.Listen, f.params.Target, f.err)
+		return
+	}
+	log.Infoln("[Forward] %s listening at %s -> %s", f.params.Id, f.params.Listen, f.params.Target)
+}
+
+func (f *portForward) stop() {
+	if f.tcp != nil {
+		_ = f.tcp.Close()
+		f.tcp = nil
+	}
+	if f.udp != nil {
+		_ = f.udp.Close()
+		f.udp = nil
+	}
+}
+
+func (f *portForward) address() string {
+	if f.tcp != nil {
+		return f.tcp.Address()
+	}
+	if f.udp != nil {
+		return f.udp.Address()
+	}
+	return ""
+}
+
+// PortForwards keeps the forwards the app added, they outlive profiles and restarts and listen
+// while the core listens
+type PortForwards struct {
+	mutex    sync.Mutex
+	loaded   bool
+	forwards map[string]*portForward
+}
+
+var portForwards = &PortForwards{forwards: map[string]*portForward{}}
+
+func (p *PortForwards) path() string {
+	return constant.Path.Resolve(portForwardStoreFile)
+}
+
+func (p *PortForwards) loadLocked() {
+	if p.loaded {
+		return
+	}
+	p.loaded = true
+	data, err := os.ReadFile(p.path())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnln("[Forward] load error: %v", err)
+		}
+		return
+	}
+	var params []PortForwardParams
+	if err = json.Unmarshal(data, &params); err != nil {
+		log.Warnln("[Forward] load error: %v", err)
+		return
+	}
+	for _, item := range params {
+		p.forwards[item.Id] = &portForward{params: item}
+	}
+}
+
+func (p *PortForwards) saveLocked() {
+	params := make([]PortForwardParams, 0, len(p.forwards))
+	for _, forward := range p.forwards {
+		params = append(params, forward.params)
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		return
+	}
+	if err = os.WriteFile(p.path(), data, 0644); err != nil {
+		log.Warnln("[Forward] save error: %v", err)
+	}
+}
+
+func checkPortForward(params *PortForwardParams) error {
+	if params.Id == "" {
+		return errors.New("forward id is required")
+	}
+	if port, err := strconv.Atoi(params.Listen); err == nil {
+		params.Listen = net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	}
+	if _, port, err := net.SplitHostPort(params.Listen); err != nil || port == "" {
+		return fmt.Errorf("invalid listen address %s", params.Listen)
+	}
+	host, port, err := net.SplitHostPort(params.Target)
+	if err != nil || host == "" {
+		return fmt.Errorf("invalid target %s, expected host:port", params.Target)
+	}
+	if value, err := strconv.Atoi(port); err != nil || value <= 0 || value > 65535 {
+		return fmt.Errorf("invalid target port %s", port)
+	}
+	if len(params.Network) == 0 {
+		params.Network = []string{"tcp"}
+	}
+	for _, network := range params.Network {
+		if network != "tcp" && network != "udp" {
+			return fmt.Errorf("unknown network %s, expected tcp or udp", network)
+		}
+	}
+	if params.Proxy != "" {
+		if _, ok := tunnel.ProxiesWithProviders()[params.Proxy]; !ok {
+			return fmt.Errorf("proxy %s not found", params.Proxy)
+		}
+	}
+	return nil
+}
+
+// Add replaces the forward with the same id and starts it at once when the core is listening
+func (p *PortForwards) Add(params *PortForwardParams) error {
+	if err := checkPortForward(params); err != nil {
+		return err
+	}
+	runLock.Lock()
+	defer runLock.Unlock()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.loadLocked()
+	if current, ok := p.forwards[params.Id]; ok {
+		current.stop()
+	}
+	forward := &portForward{params: *params}
+	if isRunning {
+		forward.start()
+		if forward.err != nil && !forward.listening() {
+			return forward.err
+		}
+	}
+	p.forwards[params.Id] = forward
+	p.saveLocked()
+	return nil
+}
+
+func (p *PortForwards) Remove(id string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.loadLocked()
+	forward, ok := p.forwards[id]
+	if !ok {
+		return false
+	}
+	forward.stop()
+	delete(p.forwards, id)
+	p.saveLocked()
+	return true
+}
+
+// Sync starts the forwards that are not listening yet, updateListeners calls it
+func (p *PortForwards) Sync() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.loadLocked()
+	for _, forward := range p.forwards {
+		if !forward.listening() {
+			forward.start()
+		}
+	}
+}
+
+func (p *PortForwards) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, forward := range p.forwards {
+		forward.stop()
+	}
+}
+
+func (p *PortForwards) List() []*PortForwardStatus {
+	connections := map[string]int{}
+	statistic.DefaultManager.Range(func(c statistic.Tracker) bool {
+		if metadata := c.Info().Metadata; metadata != nil {
+			connections[metadata.InName]++
+		}
+		return true
+	})
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.loadLocked()
+	list := make([]*PortForwardStatus, 0, len(p.forwards))
+	for id, forward := range p.forwards {
+		status := &PortForwardStatus{
+			PortForwardParams: forward.params,
+			Address:           forward.address(),
+			Connections:       connections[portForwardInPrefix+id],
+		}
+		if forward.err != nil {
+			status.Error = forward.err.Error()
+		}
+		list = append(list, status)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id < list[j].Id
+	})
+	return list
+}
+
+func handleAddForward(paramsString string) error {
+	var params = &PortForwardParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	return portForwards.Add(params)
+}
+
+func handleRemoveForward(id string) bool {
+	return portForwards.Remove(id)
+}
+
+func handleListForwards() string {
+	data, err := json.Marshal(portForwards.List())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
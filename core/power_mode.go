@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/metacubex/mihomo/log"
+	"sync"
+	"time"
+)
+
+type PowerMode string
+
+const (
+	LowPowerMode         PowerMode = "low"
+	NormalPowerMode      PowerMode = "normal"
+	PerformancePowerMode PowerMode = "performance"
+)
+
+// powerProfile is what a mode changes, the interval scale applies to every poller of the core
+type powerProfile struct {
+	scale    float64
+	gc       int
+	minLevel log.LogLevel
+}
+
+var powerProfiles = map[PowerMode]powerProfile{
+	// fewer wakeups, fewer collections and only warnings make it to the log
+	LowPowerMode:         {scale: 4, gc: 200, minLevel: log.WARNING},
+	NormalPowerMode:      {scale: 1, gc: 100, minLevel: log.DEBUG},
+	PerformancePowerMode: {scale: 0.5, gc: 100, minLevel: log.DEBUG},
+}
+
+type PowerStatus struct {
+	Mode      PowerMode `json:"mode"`
+	Scale     float64   `json:"scale"`
+	GCPercent int       `json:"gc-percent"`
+	LogLevel  string    `json:"log-level"`
+	Since     int64     `json:"since"`
+}
+
+// PowerState remembers the mode the app reported and the log level the config asked for
+type PowerState struct {
+	mutex    sync.Mutex
+	mode     PowerMode
+	logLevel log.LogLevel
+	since    time.Time
+}
+
+var powerState = &PowerState{mode: NormalPowerMode, logLevel: log.INFO, since: time.Now()}
+
+func (p *PowerState) profile() powerProfile {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return powerProfiles[p.mode]
+}
+
+// powerScaled stretches or shrinks a polling interval by the active mode
+func powerScaled(interval time.Duration) time.Duration {
+	scale := powerState.profile().scale
+	if scale == 1 {
+		return interval
+	}
+	return time.Duration(float64(interval) * scale)
+}
+
+func (p *PowerState) effectiveLevelLocked() log.LogLevel {
+	level := p.logLevel
+	if minLevel := powerProfiles[p.mode].minLevel; level < minLevel {
+		level = minLevel
+	}
+	return level
+}
+
+// SetLogLevel records the level of the config and applies it raised to the floor of the mode
+func (p *PowerState) SetLogLevel(level log.LogLevel) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.logLevel = level
+	log.SetLevel(p.effectiveLevelLocked())
+}
+
+// ApplyLocked reinstates the mode after hub.ApplyConfig set the log level of the profile
+func (p *PowerState) ApplyLocked() {
+	p.SetLogLevel(log.Level())
+}
+
+func (p *PowerState) Set(mode PowerMode) error {
+	if _, ok := powerProfiles[mode]; !ok {
+		return fmt.Errorf("unknown power mode %s", mode)
+	}
+	p.mutex.Lock()
+	if p.mode == mode {
+		p.mutex.Unlock()
+		return nil
+	}
+	previous := p.mode
+	p.mode = mode
+	p.since = time.Now()
+	log.SetLevel(p.effectiveLevelLocked())
+	p.mutex.Unlock()
+	memoryManager.ApplyGC()
+	log.Infoln("[Power] %s to %s", previous, mode)
+	return nil
+}
+
+func (p *PowerState) Status() *PowerStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	profile := powerProfiles[p.mode]
+	return &PowerStatus{
+		Mode:      p.mode,
+		Scale:     profile.scale,
+		GCPercent: profile.gc,
+		LogLevel:  p.effectiveLevelLocked().String(),
+		Since:     p.since.UnixMilli(),
+	}
+}
+
+func handleSetPowerMode(mode string) error {
+	return powerState.Set(PowerMode(mode))
+}
+
+func handleGetPowerMode() string {
+	data, err := json.Marshal(powerState.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
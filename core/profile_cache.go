@@ -0,0 +1,543 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/config"
+	"github.com/metacubex/mihomo/constant"
+	P "github.com/metacubex/mihomo/constant/provider"
+	"github.com/metacubex/mihomo/log"
+	RP "github.com/metacubex/mihomo/rules/provider"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	profileCacheDir         = "compiled"
+	profileCacheRulesDir    = "rules"
+	compiledProviderPrefix  = "compiled-"
+	defaultProfileCacheSize = 16
+	// shorter runs of rules are cheaper to match one by one than to load as a rule set
+	minCompiledRuleRun = 32
+	// rule sets no entry used for this long are removed with the evicted entries
+	compiledRuleSetTTL = 30 * 24 * time.Hour
+)
+
+type ProfileCacheParams struct {
+	Enable     bool `json:"enable"`
+	MaxEntries int  `json:"max-entries"`
+}
+
+type ProfileCacheStats struct {
+	ProfileCacheParams
+	Entries  int    `json:"entries"`
+	RuleSets int    `json:"rule-sets"`
+	Bytes    int64  `json:"bytes"`
+	Hits     int64  `json:"hits"`
+	Misses   int64  `json:"misses"`
+	Compiled int    `json:"compiled"`
+	LastKey  string `json:"last-key"`
+	LastTime int64  `json:"last-time"`
+}
+
+type compiledSource struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mod-time"`
+}
+
+// compiledProfile is one entry of the cache, it holds the rules with their long runs replaced by
+// rule sets and the providers that point at the compiled files
+type compiledProfile struct {
+	Rules         []string                  `json:"rules"`
+	SubRules      map[string][]string       `json:"sub-rules"`
+	RuleProviders map[string]map[string]any `json:"rule-providers"`
+	Sources       []compiledSource          `json:"sources"`
+	Compiled      int                       `json:"compiled"`
+}
+
+// ProfileCache turns domain and ipcidr rules into mrs rule sets, which load as built tries
+// instead of being parsed again, the entries are encrypted and keyed by the hash of the rules
+type ProfileCache struct {
+	mutex    sync.Mutex
+	params   ProfileCacheParams
+	hits     int64
+	misses   int64
+	compiled int
+	lastKey  string
+	lastTime time.Time
+}
+
+var profileCache = &ProfileCache{params: ProfileCacheParams{MaxEntries: defaultProfileCacheSize}}
+
+func (c *ProfileCache) dir() string {
+	return constant.Path.Resolve(profileCacheDir)
+}
+
+func (c *ProfileCache) rulesDir() string {
+	return filepath.Join(c.dir(), profileCacheRulesDir)
+}
+
+func (c *ProfileCache) Set(params *ProfileCacheParams) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.params = ProfileCacheParams{MaxEntries: defaultProfileCacheSize}
+	if params != nil {
+		c.params = *params
+	}
+	if c.params.MaxEntries <= 0 {
+		c.params.MaxEntries = defaultProfileCacheSize
+	}
+}
+
+func profileCacheKey(rawConfig *config.RawConfig) (string, error) {
+	data, err := json.Marshal(struct {
+		Rules         []string                  `json:"rules"`
+		SubRules      map[string][]string       `json:"sub-rules"`
+		RuleProviders map[string]map[string]any `json:"rule-providers"`
+	}{rawConfig.Rule, rawConfig.SubRules, rawConfig.RuleProvider})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// CompileLocked swaps the rules and providers of the profile for their compiled form, any error
+// leaves the profile as it is
+func (c *ProfileCache) CompileLocked(rawConfig *config.RawConfig) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.params.Enable || getEncryptionService() == nil {
+		return
+	}
+	key, err := profileCacheKey(rawConfig)
+	if err != nil {
+		return
+	}
+	entry, err := c.load(key)
+	if err == nil {
+		c.hits++
+	} else {
+		if !os.IsNotExist(err) {
+			log.Warnln("[ProfileCache] load %s error: %v", key[:8], err)
+		}
+		c.misses++
+		if entry, err = c.compile(key, rawConfig); err != nil {
+			log.Warnln("[ProfileCache] compile error: %v", err)
+			return
+		}
+		if err = c.store(key, entry); err != nil {
+			log.Warnln("[ProfileCache] store error: %v", err)
+		}
+		c.evict()
+	}
+	rawConfig.Rule = entry.Rules
+	rawConfig.SubRules = entry.SubRules
+	if rawConfig.RuleProvider == nil {
+		rawConfig.RuleProvider = map[string]map[string]any{}
+	}
+	for name, mapping := range entry.RuleProviders {
+		rawConfig.RuleProvider[name] = mapping
+	}
+	c.compiled = entry.Compiled
+	c.lastKey = key
+	c.lastTime = time.Now()
+}
+
+func (c *ProfileCache) entryPath(key string) string {
+	return filepath.Join(c.dir(), key+".enc")
+}
+
+// load reads an entry and checks that the rule sets and the sources it was built from are unchanged
+func (c *ProfileCache) load(key string) (*compiledProfile, error) {
+	data, err := os.ReadFile(c.entryPath(key))
+	if err != nil {
+		return nil, err
+	}
+	plain, err := getEncryptionService().Decrypt(data)
+	if err != nil {
+		return nil, err
+	}
+	defer clearBytes(plain)
+	entry := &compiledProfile{}
+	if err = json.Unmarshal(plain, entry); err != nil {
+		return nil, err
+	}
+	for _, source := range entry.Sources {
+		info, err := os.Stat(source.Path)
+		if err != nil || info.Size() != source.Size || info.ModTime().UnixNano() != source.ModTime {
+			return nil, fmt.Errorf("source %s changed", filepath.Base(source.Path))
+		}
+	}
+	now := time.Now()
+	for _, mapping := range entry.RuleProviders {
+		path, _ := mapping["path"].(string)
+		if _, err = os.Stat(path); err != nil {
+			return nil, err
+		}
+		_ = os.Chtimes(path, now, now)
+	}
+	_ = os.Chtimes(c.entryPath(key), now, now)
+	return entry, nil
+}
+
+func (c *ProfileCache) store(key string, entry *compiledProfile) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	defer clearBytes(data)
+	encrypted, err := getEncryptionService().Encrypt(data)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(c.dir(), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(c.entryPath(key), encrypted, 0600)
+}
+
+// ruleSet writes the payload as an mrs file named by its hash, an existing file is reused
+func (c *ProfileCache) ruleSet(payload []byte, behavior P.RuleBehavior, format P.RuleFormat) (string, error) {
+	sum := sha256.Sum256(append([]byte{behavior.Byte(), byte(format)}, payload...))
+	path := filepath.Join(c.rulesDir(), hex.EncodeToString(sum[:])+".mrs")
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	if err := os.MkdirAll(c.rulesDir(), 0700); err != nil {
+		return "", err
+	}
+	buffer := &bytes.Buffer{}
+	if err := RP.ConvertToMrs(payload, behavior, format, buffer); err != nil {
+		return "", err
+	}
+	temp := path + ".tmp"
+	if err := os.WriteFile(temp, buffer.Bytes(), 0600); err != nil {
+		return "", err
+	}
+	return path, os.Rename(temp, path)
+}
+
+func compiledProvider(behavior, path string) map[string]any {
+	return map[string]any{
+		"type":     "file",
+		"behavior": behavior,
+		"format":   "mrs",
+		"path":     path,
+	}
+}
+
+func (c *ProfileCache) compile(key string, rawConfig *config.RawConfig) (*compiledProfile, error) {
+	entry := &compiledProfile{
+		SubRules:      map[string][]string{},
+		RuleProviders: map[string]map[string]any{},
+	}
+	for name, mapping := range rawConfig.RuleProvider {
+		compiled, source, err := c.compileProvider(mapping)
+		if err != nil {
+			log.Debugln("[ProfileCache] keep rule provider %s: %v", name, err)
+			continue
+		}
+		if compiled == nil {
+			continue
+		}
+		entry.RuleProviders[name] = compiled
+		if source != nil {
+			entry.Sources = append(entry.Sources, *source)
+		}
+		entry.Compiled++
+	}
+	compiler := &ruleCompiler{cache: c, prefix: compiledProviderPrefix + key[:8] + "-", taken: rawConfig.RuleProvider, entry: entry}
+	entry.Rules = compiler.compile(rawConfig.Rule)
+	for name, subRules := range rawConfig.SubRules {
+		entry.SubRules[name] = compiler.compile(subRules)
+	}
+	if compiler.err != nil {
+		return nil, compiler.err
+	}
+	return entry, nil
+}
+
+// compileProvider converts a file or inline domain and ipcidr provider, http providers keep their
+// download path so their updates still land where mihomo reads them
+func (c *ProfileCache) compileProvider(mapping map[string]any) (map[string]any, *compiledSource, error) {
+	behaviorName, _ := mapping["behavior"].(string)
+	behavior, err := P.ParseBehavior(behaviorName)
+	if err != nil || behavior == P.Classical {
+		return nil, nil, nil
+	}
+	formatName, _ := mapping["format"].(string)
+	format, err := P.ParseRuleFormat(formatName)
+	if err != nil || format == P.MrsRule {
+		return nil, nil, nil
+	}
+	switch kind, _ := mapping["type"].(string); kind {
+	case "inline":
+		payload, ok := mapping["payload"].([]any)
+		if !ok {
+			return nil, nil, errors.New("payload is not a list")
+		}
+		lines := make([]string, 0, len(payload))
+		for _, line := range payload {
+			lines = append(lines, fmt.Sprint(line))
+		}
+		path, err := c.ruleSet([]byte(strings.Join(lines, "\n")), behavior, P.TextRule)
+		if err != nil {
+			return nil, nil, err
+		}
+		return compiledProvider(behaviorName, path), nil, nil
+	case "file":
+		source, _ := mapping["path"].(string)
+		source = constant.Path.Resolve(source)
+		info, err := os.Stat(source)
+		if err != nil {
+			return nil, nil, err
+		}
+		content, err := os.ReadFile(source)
+		if err != nil {
+			return nil, nil, err
+		}
+		path, err := c.ruleSet(content, behavior, format)
+		if err != nil {
+			return nil, nil, err
+		}
+		return compiledProvider(behaviorName, path), &compiledSource{Path: source, Size: info.Size(), ModTime: info.ModTime().UnixNano()}, nil
+	}
+	return nil, nil, nil
+}
+
+type compilableRule struct {
+	rule      string
+	behavior  string
+	value     string
+	noResolve bool
+}
+
+// parseCompilableRule accepts the rules a domain or ipcidr set matches the same way
+func parseCompilableRule(rule string) (*compilableRule, string, bool) {
+	parts := strings.Split(rule, ",")
+	if len(parts) < 3 {
+		return nil, "", false
+	}
+	kind := strings.ToUpper(strings.TrimSpace(parts[0]))
+	value := strings.TrimSpace(parts[1])
+	target := strings.TrimSpace(parts[2])
+	compilable := &compilableRule{rule: rule}
+	switch kind {
+	case "DOMAIN", "DOMAIN-SUFFIX":
+		// a set reads * as a wildcard where the rule matches it literally
+		if len(parts) != 3 || strings.Contains(value, "*") {
+			return nil, "", false
+		}
+		compilable.behavior = "domain"
+		compilable.value = value
+		if kind == "DOMAIN-SUFFIX" {
+			compilable.value = "+." + strings.TrimPrefix(value, ".")
+		}
+	case "IP-CIDR", "IP-CIDR6":
+		switch {
+		case len(parts) == 3:
+		case len(parts) == 4 && strings.TrimSpace(parts[3]) == "no-resolve":
+			compilable.noResolve = true
+		default:
+			return nil, "", false
+		}
+		compilable.behavior = "ipcidr"
+		compilable.value = value
+	default:
+		return nil, "", false
+	}
+	return compilable, target, true
+}
+
+type ruleCompiler struct {
+	cache  *ProfileCache
+	prefix string
+	taken  map[string]map[string]any
+	entry  *compiledProfile
+	count  int
+	err    error
+}
+
+// compile replaces each run of rules with one target by rule sets, a run matches the same target
+// whatever rule of it hits so the domains go first and the addresses, which may resolve, after
+func (r *ruleCompiler) compile(rules []string) []string {
+	result := make([]string, 0, len(rules))
+	var run []*compilableRule
+	runTarget := ""
+	flush := func() {
+		result = append(result, r.flush(run, runTarget)...)
+		run = nil
+	}
+	for _, rule := range rules {
+		compilable, target, ok := parseCompilableRule(rule)
+		if !ok {
+			flush()
+			result = append(result, rule)
+			continue
+		}
+		if len(run) != 0 && target != runTarget {
+			flush()
+		}
+		runTarget = target
+		run = append(run, compilable)
+	}
+	flush()
+	return result
+}
+
+func (r *ruleCompiler) flush(run []*compilableRule, target string) []string {
+	if len(run) < minCompiledRuleRun || r.err != nil {
+		return originalRules(run)
+	}
+	type partition struct {
+		behavior  string
+		noResolve bool
+	}
+	order := []partition{{"domain", false}, {"ipcidr", false}, {"ipcidr", true}}
+	groups := map[partition][]*compilableRule{}
+	for _, rule := range run {
+		key := partition{rule.behavior, rule.noResolve}
+		groups[key] = append(groups[key], rule)
+	}
+	var result []string
+	for _, key := range order {
+		group := groups[key]
+		if len(group) < minCompiledRuleRun {
+			result = append(result, originalRules(group)...)
+			continue
+		}
+		values := make([]string, 0, len(group))
+		for _, rule := range group {
+			values = append(values, rule.value)
+		}
+		behavior, _ := P.ParseBehavior(key.behavior)
+		path, err := r.cache.ruleSet([]byte(strings.Join(values, "\n")), behavior, P.TextRule)
+		if err != nil {
+			r.err = err
+			return originalRules(run)
+		}
+		name := r.name()
+		r.entry.RuleProviders[name] = compiledProvider(key.behavior, path)
+		r.entry.Compiled++
+		line := "RULE-SET," + name + "," + target
+		if key.noResolve {
+			line += ",no-resolve"
+		}
+		result = append(result, line)
+	}
+	return result
+}
+
+func (r *ruleCompiler) name() string {
+	for {
+		r.count++
+		name := fmt.Sprintf("%s%d", r.prefix, r.count)
+		if _, ok := r.taken[name]; !ok {
+			return name
+		}
+	}
+}
+
+func originalRules(run []*compilableRule) []string {
+	rules := make([]string, 0, len(run))
+	for _, rule := range run {
+		rules = append(rules, rule.rule)
+	}
+	return rules
+}
+
+// evict keeps the newest entries and drops the rule sets none of them touched for a while
+func (c *ProfileCache) evict() {
+	entries, _ := filepath.Glob(filepath.Join(c.dir(), "*.enc"))
+	if len(entries) > c.params.MaxEntries {
+		sort.Slice(entries, func(i, j int) bool {
+			return modTime(entries[i]).After(modTime(entries[j]))
+		})
+		for _, path := range entries[c.params.MaxEntries:] {
+			_ = os.Remove(path)
+		}
+	}
+	ruleSets, _ := filepath.Glob(filepath.Join(c.rulesDir(), "*.mrs"))
+	for _, path := range ruleSets {
+		if time.Since(modTime(path)) > compiledRuleSetTTL {
+			_ = os.Remove(path)
+		}
+	}
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func (c *ProfileCache) Clear() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.hits, c.misses, c.compiled = 0, 0, 0
+	c.lastKey = ""
+	c.lastTime = time.Time{}
+	return os.RemoveAll(c.dir())
+}
+
+func (c *ProfileCache) Stats() *ProfileCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := &ProfileCacheStats{
+		ProfileCacheParams: c.params,
+		Hits:               c.hits,
+		Misses:             c.misses,
+		Compiled:           c.compiled,
+		LastKey:            c.lastKey,
+	}
+	if !c.lastTime.IsZero() {
+		stats.LastTime = c.lastTime.UnixMilli()
+	}
+	_ = filepath.Walk(c.dir(), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		switch filepath.Ext(path) {
+		case ".enc":
+			stats.Entries++
+		case ".mrs":
+			stats.RuleSets++
+		}
+		stats.Bytes += info.Size()
+		return nil
+	})
+	return stats
+}
+
+func handleSetProfileCache(paramsString string) bool {
+	var params *ProfileCacheParams
+	if err := json.Unmarshal([]byte(paramsString), &params); err != nil {
+		return false
+	}
+	profileCache.Set(params)
+	return true
+}
+
+func handleGetProfileCache() string {
+	data, err := json.Marshal(profileCache.Stats())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handleClearProfileCache() error {
+	return profileCache.Clear()
+}
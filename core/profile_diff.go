@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/metacubex/mihomo/config"
+	"reflect"
+	"sort"
+)
+
+type DiffProfilesParams struct {
+	OldId string `json:"old-id"`
+	NewId string `json:"new-id"`
+}
+
+// NamedDiff lists added, removed and changed entries keyed by name
+type NamedDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+}
+
+// RuleDiff lists rules present in only one of the profiles
+type RuleDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// ProfileDiff is the structured difference between two profiles
+type ProfileDiff struct {
+	Proxies        NamedDiff `json:"proxies"`
+	ProxyGroups    NamedDiff `json:"proxy-groups"`
+	ProxyProviders NamedDiff `json:"proxy-providers"`
+	RuleProviders  NamedDiff `json:"rule-providers"`
+	Rules          RuleDiff  `json:"rules"`
+	RulesReordered bool      `json:"rules-reordered"`
+}
+
+// IsEmpty reports whether both profiles are equivalent
+func (d *ProfileDiff) IsEmpty() bool {
+	for _, n := range []NamedDiff{d.Proxies, d.ProxyGroups, d.ProxyProviders, d.RuleProviders} {
+		if len(n.Added) != 0 || len(n.Removed) != 0 || len(n.Changed) != 0 {
+			return false
+		}
+	}
+	return len(d.Rules.Added) == 0 && len(d.Rules.Removed) == 0 && !d.RulesReordered
+}
+
+// DiffRawConfigs computes the difference from oldConfig to newConfig
+func DiffRawConfigs(oldConfig, newConfig *config.RawConfig) *ProfileDiff {
+	diff := &ProfileDiff{
+		Proxies:        diffNamed(namedEntries(oldConfig.Proxy), namedEntries(newConfig.Proxy)),
+		ProxyGroups:    diffNamed(namedEntries(oldConfig.ProxyGroup), namedEntries(newConfig.ProxyGroup)),
+		ProxyProviders: diffNamed(oldConfig.ProxyProvider, newConfig.ProxyProvider),
+		RuleProviders:  diffNamed(oldConfig.RuleProvider, newConfig.RuleProvider),
+	}
+	diff.Rules.Added, diff.Rules.Removed = diffRules(oldConfig.Rule, newConfig.Rule)
+	diff.RulesReordered = len(diff.Rules.Added) == 0 && len(diff.Rules.Removed) == 0 &&
+		!reflect.DeepEqual(oldConfig.Rule, newConfig.Rule)
+	return diff
+}
+
+// namedEntries indexes proxies or groups by their name field
+func namedEntries(entries []map[string]any) map[string]map[string]any {
+	named := make(map[string]map[string]any, len(entries))
+	for _, entry := range entries {
+		if name, ok := entry["name"].(string); ok {
+			named[name] = entry
+		}
+	}
+	return named
+}
+
+func diffNamed(oldEntries, newEntries map[string]map[string]any) NamedDiff {
+	diff := NamedDiff{
+		Added:   []string{},
+		Removed: []string{},
+		Changed: []string{},
+	}
+	for name, newEntry := range newEntries {
+		oldEntry, exists := oldEntries[name]
+		if !exists {
+			diff.Added = append(diff.Added, name)
+		} else if !reflect.DeepEqual(oldEntry, newEntry) {
+			diff.Changed = append(diff.Changed, name)
+		}
+	}
+	for name := range oldEntries {
+		if _, exists := newEntries[name]; !exists {
+			diff.Removed = append(diff.Removed, name)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+	return diff
+}
+
+// diffRules compares rules as multisets, keeping the order of each side
+func diffRules(oldRules, newRules []string) (added []string, removed []string) {
+	added, removed = []string{}, []string{}
+	counts := make(map[string]int, len(oldRules))
+	for _, rule := range oldRules {
+		counts[rule]++
+	}
+	for _, rule := range newRules {
+		if counts[rule] > 0 {
+			counts[rule]--
+			continue
+		}
+		added = append(added, rule)
+	}
+	for _, rule := range oldRules {
+		if counts[rule] > 0 {
+			counts[rule]--
+			removed = append(removed, rule)
+		}
+	}
+	return added, removed
+}
+
+// DiffProfiles computes the difference between two profiles held in the secure cache
+func DiffProfiles(oldId, newId string) (*ProfileDiff, error) {
+	oldConfig, err := readSecureRawConfig(oldId)
+	if err != nil {
+		return nil, fmt.Errorf("profile %s: %v", oldId, err)
+	}
+	newConfig, err := readSecureRawConfig(newId)
+	if err != nil {
+		return nil, fmt.Errorf("profile %s: %v", newId, err)
+	}
+	return DiffRawConfigs(oldConfig, newConfig), nil
+}
+
+func handleDiffProfiles(paramsString string) (string, error) {
+	var params = &DiffProfilesParams{}
+	err := json.Unmarshal([]byte(paramsString), params)
+	if err != nil {
+		return "", err
+	}
+	diff, err := DiffProfiles(params.OldId, params.NewId)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(diff)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"gopkg.in/yaml.v3"
+	"strings"
+)
+
+type ExportProfileParams struct {
+	ProfileId     string `json:"profile-id"`
+	Redact        bool   `json:"redact"`
+	RedactServers bool   `json:"redact-servers"`
+}
+
+// exportSecretKeys are replaced wherever they appear, together with every value holding an encrypted secret
+var exportSecretKeys = map[string]bool{
+	"password":               true,
+	"uuid":                   true,
+	"private-key":            true,
+	"private-key-passphrase": true,
+	"pre-shared-key":         true,
+	"psk":                    true,
+	"auth":                   true,
+	"auth-str":               true,
+	"auth_str":               true,
+	"obfs-password":          true,
+	"short-id":               true,
+	"token":                  true,
+	"secret":                 true,
+	"username":               true,
+	"authorization":          true,
+	"authentication":         true,
+	"users":                  true,
+	"ech-config":             true,
+}
+
+// exportServerKeys are only replaced when the servers are redacted as well
+var exportServerKeys = map[string]bool{
+	"server":   true,
+	"servers":  true,
+	"endpoint": true,
+	"ip":       true,
+	"ipv6":     true,
+}
+
+type profileRedactor struct {
+	servers bool
+}
+
+func (r *profileRedactor) placeholder(node *yaml.Node) {
+	if node.Kind == yaml.ScalarNode {
+		if isVaultRef(node.Value) {
+			return
+		}
+		node.Value = redactedPlaceholder
+		node.Tag = "!!str"
+		node.Style = 0
+		return
+	}
+	for _, child := range node.Content {
+		r.placeholder(child)
+	}
+}
+
+// redact walks the document, section is the top level key that holds node
+func (r *profileRedactor) redact(node *yaml.Node, section string) {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			r.redact(child, section)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := strings.ToLower(node.Content[i].Value)
+			value := node.Content[i+1]
+			switch {
+			case exportSecretKeys[key]:
+				r.placeholder(value)
+			case r.servers && exportServerKeys[key]:
+				r.placeholder(value)
+			case key == "url" && section == "proxy-providers":
+				// subscription urls carry the account token
+				r.placeholder(value)
+			case section == "":
+				r.redact(value, key)
+			default:
+				r.redact(value, section)
+			}
+		}
+	case yaml.ScalarNode:
+		if strings.HasPrefix(node.Value, encryptedValuePrefix) {
+			r.placeholder(node)
+			return
+		}
+		node.Value = redactSecrets(node.Value)
+	}
+}
+
+// containsVaultValue tells whether the profile holds a value of the vault verbatim
+func containsVaultValue(data []byte, plains []vaultPlain) bool {
+	for _, plain := range plains {
+		if bytes.Contains(data, []byte(plain.value)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExportProfile returns the effective profile as yaml, optionally with the secrets replaced by placeholders,
+// the values stored in the vault always leave as their refs
+func ExportProfile(params *ExportProfileParams) ([]byte, error) {
+	if params.ProfileId == "" {
+		return nil, errors.New("profile id is required")
+	}
+	merged, err := GetMergedProfile(params.ProfileId)
+	if err != nil {
+		return nil, err
+	}
+	defer clearBytes(merged)
+	plains := vault.plains()
+	referenced := containsVaultValue(merged, plains)
+	if !params.Redact && !referenced {
+		return append([]byte{}, merged...), nil
+	}
+	document := &yaml.Node{}
+	if err := yaml.Unmarshal(merged, document); err != nil {
+		return nil, err
+	}
+	if referenced {
+		referenceVaultSecrets(document, plains)
+	}
+	if params.Redact {
+		redactor := &profileRedactor{servers: params.RedactServers}
+		redactor.redact(document, "")
+	}
+	buffer := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(buffer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(document); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func handleExportProfile(paramsString string) (string, error) {
+	var params = &ExportProfileParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return "", err
+	}
+	data, err := ExportProfile(params)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,774 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/common/convert"
+	"gopkg.in/yaml.v3"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	importFormatClash   = "clash"
+	importFormatSingBox = "sing-box"
+	importFormatLinks   = "share-links"
+
+	importDefaultGroup = "PROXY"
+)
+
+type ImportProfileParams struct {
+	Content string `json:"content"`
+}
+
+// ImportWarning points at the part of the source that was dropped or changed, source is a tag or a line number
+type ImportWarning struct {
+	Source  string `json:"source"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+type ImportProfileResult struct {
+	Format   string          `json:"format"`
+	Config   string          `json:"config"`
+	Proxies  int             `json:"proxies"`
+	Groups   int             `json:"groups"`
+	Rules    int             `json:"rules"`
+	Warnings []ImportWarning `json:"warnings"`
+}
+
+type importedProfile struct {
+	Proxies     []map[string]any `yaml:"proxies"`
+	ProxyGroups []map[string]any `yaml:"proxy-groups"`
+	Rules       []string         `yaml:"rules"`
+}
+
+type profileImporter struct {
+	names    map[string]int
+	warnings []ImportWarning
+}
+
+func (p *profileImporter) warn(source string, field string, format string, args ...any) {
+	p.warnings = append(p.warnings, ImportWarning{
+		Source:  source,
+		Field:   field,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// uniqueName keeps proxy names distinct the same way the mihomo converter does
+func (p *profileImporter) uniqueName(name string) string {
+	if name == "" {
+		name = "proxy"
+	}
+	index, ok := p.names[name]
+	if !ok {
+		p.names[name] = 0
+		return name
+	}
+	index++
+	p.names[name] = index
+	return fmt.Sprintf("%s-%02d", name, index)
+}
+
+// missingEndpoint names the part of the address a proxy lacks, a proxy without one cannot be dialed
+func missingEndpoint(proxy map[string]any) string {
+	if server, _ := proxy["server"].(string); strings.TrimSpace(server) == "" {
+		return "server"
+	}
+	port := 0
+	switch value := proxy["port"].(type) {
+	case int:
+		port = value
+	case float64:
+		port = int(value)
+	case string:
+		port, _ = strconv.Atoi(value)
+	}
+	if port <= 0 || port > 65535 {
+		return "port"
+	}
+	return ""
+}
+
+// importShareLinks converts each link alone so a bad line turns into a warning instead of failing the blob
+func (p *profileImporter) importShareLinks(content []byte) *importedProfile {
+	profile := &importedProfile{}
+	lines := strings.Split(string(convert.DecodeBase64(content)), "\n")
+	for index, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		source := fmt.Sprintf("line %d", index+1)
+		scheme, _, found := strings.Cut(line, "://")
+		if !found {
+			p.warn(source, "", "not a share link")
+			continue
+		}
+		proxies, err := convert.ConvertsV2Ray([]byte(line))
+		if err != nil || len(proxies) == 0 {
+			p.warn(source, "", "unsupported or invalid %s link", strings.ToLower(scheme))
+			continue
+		}
+		for _, proxy := range proxies {
+			if missing := missingEndpoint(proxy); missing != "" {
+				p.warn(source, missing, "the %s link has no %s, it was skipped", strings.ToLower(scheme), missing)
+				continue
+			}
+			name, _ := proxy["name"].(string)
+			proxy["name"] = p.uniqueName(name)
+			profile.Proxies = append(profile.Proxies, proxy)
+		}
+	}
+	return profile
+}
+
+// singBoxObject records the keys that were read so the rest can be reported
+type singBoxObject struct {
+	values map[string]any
+	used   map[string]bool
+}
+
+func newSingBoxObject(value any) *singBoxObject {
+	values, _ := value.(map[string]any)
+	if values == nil {
+		values = map[string]any{}
+	}
+	return &singBoxObject{values: values, used: map[string]bool{}}
+}
+
+func (o *singBoxObject) get(key string) (any, bool) {
+	value, ok := o.values[key]
+	if ok {
+		o.used[key] = true
+	}
+	return value, ok
+}
+
+func (o *singBoxObject) string(key string) string {
+	value, _ := o.get(key)
+	result, _ := value.(string)
+	return result
+}
+
+func (o *singBoxObject) int(key string) int {
+	value, _ := o.get(key)
+	result, _ := value.(float64)
+	return int(result)
+}
+
+func (o *singBoxObject) bool(key string) bool {
+	value, _ := o.get(key)
+	result, _ := value.(bool)
+	return result
+}
+
+// strings accepts the single value and the list form sing-box allows for most options
+func (o *singBoxObject) strings(key string) []string {
+	value, _ := o.get(key)
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+	case float64:
+		return []string{fmt.Sprint(value)}
+	case []any:
+		result := make([]string, 0, len(value))
+		for _, item := range value {
+			if text, ok := item.(string); ok {
+				result = append(result, text)
+			} else if number, ok := item.(float64); ok {
+				result = append(result, fmt.Sprint(number))
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+func (o *singBoxObject) object(key string) *singBoxObject {
+	value, ok := o.get(key)
+	if !ok {
+		return nil
+	}
+	return newSingBoxObject(value)
+}
+
+func (o *singBoxObject) unused() []string {
+	var keys []string
+	for key := range o.values {
+		if !o.used[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (p *profileImporter) reportUnused(source string, prefix string, object *singBoxObject) {
+	for _, key := range object.unused() {
+		p.warn(source, prefix+key, "unsupported field")
+	}
+}
+
+func (p *profileImporter) applySingBoxTLS(source string, outbound *singBoxObject, proxy map[string]any, sniKey string) {
+	tlsObject := outbound.object("tls")
+	if tlsObject == nil {
+		return
+	}
+	if !tlsObject.bool("enabled") {
+		p.reportUnused(source, "tls.", tlsObject)
+		return
+	}
+	if proxy["type"] == "vmess" || proxy["type"] == "vless" {
+		proxy["tls"] = true
+	}
+	if serverName := tlsObject.string("server_name"); serverName != "" {
+		proxy[sniKey] = serverName
+	}
+	if tlsObject.bool("insecure") {
+		proxy["skip-cert-verify"] = true
+	}
+	if alpn := tlsObject.strings("alpn"); len(alpn) > 0 {
+		proxy["alpn"] = alpn
+	}
+	if utls := tlsObject.object("utls"); utls != nil {
+		if utls.bool("enabled") {
+			fingerprint := utls.string("fingerprint")
+			if fingerprint == "" {
+				fingerprint = "chrome"
+			}
+			proxy["client-fingerprint"] = fingerprint
+		}
+		p.reportUnused(source, "tls.utls.", utls)
+	}
+	if reality := tlsObject.object("reality"); reality != nil {
+		if reality.bool("enabled") {
+			proxy["reality-opts"] = map[string]any{
+				"public-key": reality.string("public_key"),
+				"short-id":   reality.string("short_id"),
+			}
+		}
+		p.reportUnused(source, "tls.reality.", reality)
+	}
+	p.reportUnused(source, "tls.", tlsObject)
+}
+
+func (p *profileImporter) applySingBoxTransport(source string, outbound *singBoxObject, proxy map[string]any) {
+	transport := outbound.object("transport")
+	if transport == nil {
+		return
+	}
+	switch kind := transport.string("type"); kind {
+	case "ws", "httpupgrade":
+		proxy["network"] = "ws"
+		options := map[string]any{}
+		if path := transport.string("path"); path != "" {
+			options["path"] = path
+		}
+		if headers := transport.object("headers"); headers != nil {
+			options["headers"] = headers.values
+		}
+		if kind == "httpupgrade" {
+			options["v2ray-http-upgrade"] = true
+			if host := transport.string("host"); host != "" {
+				options["headers"] = map[string]any{"Host": host}
+			}
+		} else if earlyData := transport.int("max_early_data"); earlyData > 0 {
+			options["max-early-data"] = earlyData
+			options["early-data-header-name"] = transport.string("early_data_header_name")
+		}
+		proxy["ws-opts"] = options
+	case "grpc":
+		proxy["network"] = "grpc"
+		proxy["grpc-opts"] = map[string]any{
+			"grpc-service-name": transport.string("service_name"),
+		}
+	case "http":
+		proxy["network"] = "h2"
+		proxy["h2-opts"] = map[string]any{
+			"host": transport.strings("host"),
+			"path": transport.string("path"),
+		}
+	default:
+		p.warn(source, "transport.type", "transport %s is not supported", kind)
+		return
+	}
+	p.reportUnused(source, "transport.", transport)
+}
+
+func (p *profileImporter) applySingBoxMultiplex(source string, outbound *singBoxObject, proxy map[string]any) {
+	multiplex := outbound.object("multiplex")
+	if multiplex == nil {
+		return
+	}
+	if multiplex.bool("enabled") {
+		smux := map[string]any{"enabled": true}
+		if protocol := multiplex.string("protocol"); protocol != "" {
+			smux["protocol"] = protocol
+		}
+		if value := multiplex.int("max_connections"); value > 0 {
+			smux["max-connections"] = value
+		}
+		if value := multiplex.int("min_streams"); value > 0 {
+			smux["min-streams"] = value
+		}
+		if value := multiplex.int("max_streams"); value > 0 {
+			smux["max-streams"] = value
+		}
+		if multiplex.bool("padding") {
+			smux["padding"] = true
+		}
+		proxy["smux"] = smux
+	}
+	p.reportUnused(source, "multiplex.", multiplex)
+}
+
+func applySingBoxPacketEncoding(outbound *singBoxObject, proxy map[string]any) {
+	switch outbound.string("packet_encoding") {
+	case "xudp":
+		proxy["xudp"] = true
+	case "packetaddr":
+		proxy["packet-addr"] = true
+	}
+}
+
+// convertSingBoxOutbound returns nil for outbounds that have no proxy counterpart
+func (p *profileImporter) convertSingBoxOutbound(outbound *singBoxObject, name string) map[string]any {
+	source := name
+	kind := outbound.string("type")
+	proxy := map[string]any{
+		"name":   name,
+		"server": outbound.string("server"),
+		"port":   outbound.int("server_port"),
+	}
+	switch kind {
+	case "shadowsocks":
+		proxy["type"] = "ss"
+		proxy["cipher"] = outbound.string("method")
+		proxy["password"] = outbound.string("password")
+		proxy["udp"] = outbound.string("network") != "tcp"
+		if plugin := outbound.string("plugin"); plugin != "" {
+			p.warn(source, "plugin", "plugin %s is not converted", plugin)
+			outbound.get("plugin_opts")
+		}
+		outbound.get("network")
+	case "vmess":
+		proxy["type"] = "vmess"
+		proxy["uuid"] = outbound.string("uuid")
+		proxy["alterId"] = outbound.int("alter_id")
+		cipher := outbound.string("security")
+		if cipher == "" {
+			cipher = "auto"
+		}
+		proxy["cipher"] = cipher
+		proxy["udp"] = true
+		applySingBoxPacketEncoding(outbound, proxy)
+		p.applySingBoxTLS(source, outbound, proxy, "servername")
+		p.applySingBoxTransport(source, outbound, proxy)
+	case "vless":
+		proxy["type"] = "vless"
+		proxy["uuid"] = outbound.string("uuid")
+		if flow := outbound.string("flow"); flow != "" {
+			proxy["flow"] = flow
+		}
+		proxy["udp"] = true
+		applySingBoxPacketEncoding(outbound, proxy)
+		p.applySingBoxTLS(source, outbound, proxy, "servername")
+		p.applySingBoxTransport(source, outbound, proxy)
+	case "trojan":
+		proxy["type"] = "trojan"
+		proxy["password"] = outbound.string("password")
+		proxy["udp"] = true
+		p.applySingBoxTLS(source, outbound, proxy, "sni")
+		p.applySingBoxTransport(source, outbound, proxy)
+	case "hysteria2":
+		proxy["type"] = "hysteria2"
+		proxy["password"] = outbound.string("password")
+		if up := outbound.int("up_mbps"); up > 0 {
+			proxy["up"] = fmt.Sprintf("%d Mbps", up)
+		}
+		if down := outbound.int("down_mbps"); down > 0 {
+			proxy["down"] = fmt.Sprintf("%d Mbps", down)
+		}
+		if obfs := outbound.object("obfs"); obfs != nil {
+			proxy["obfs"] = obfs.string("type")
+			proxy["obfs-password"] = obfs.string("password")
+			p.reportUnused(source, "obfs.", obfs)
+		}
+		p.applySingBoxTLS(source, outbound, proxy, "sni")
+	case "tuic":
+		proxy["type"] = "tuic"
+		proxy["uuid"] = outbound.string("uuid")
+		proxy["password"] = outbound.string("password")
+		if congestion := outbound.string("congestion_control"); congestion != "" {
+			proxy["congestion-controller"] = congestion
+		}
+		if mode := outbound.string("udp_relay_mode"); mode != "" {
+			proxy["udp-relay-mode"] = mode
+		}
+		if outbound.bool("zero_rtt_handshake") {
+			proxy["reduce-rtt"] = true
+		}
+		p.applySingBoxTLS(source, outbound, proxy, "sni")
+	case "socks":
+		proxy["type"] = "socks5"
+		if version := outbound.string("version"); version != "" && version != "5" {
+			p.warn(source, "version", "socks version %s is not supported, using 5", version)
+		}
+		if username := outbound.string("username"); username != "" {
+			proxy["username"] = username
+			proxy["password"] = outbound.string("password")
+		}
+		proxy["udp"] = outbound.string("network") != "tcp"
+	case "http":
+		proxy["type"] = "http"
+		if username := outbound.string("username"); username != "" {
+			proxy["username"] = username
+			proxy["password"] = outbound.string("password")
+		}
+		if tlsObject := outbound.object("tls"); tlsObject != nil && tlsObject.bool("enabled") {
+			proxy["tls"] = true
+			proxy["sni"] = tlsObject.string("server_name")
+			proxy["skip-cert-verify"] = tlsObject.bool("insecure")
+			p.reportUnused(source, "tls.", tlsObject)
+		}
+	case "wireguard":
+		proxy["type"] = "wireguard"
+		proxy["private-key"] = outbound.string("private_key")
+		proxy["public-key"] = outbound.string("peer_public_key")
+		if psk := outbound.string("pre_shared_key"); psk != "" {
+			proxy["pre-shared-key"] = psk
+		}
+		for _, address := range outbound.strings("local_address") {
+			ip, _, _ := strings.Cut(address, "/")
+			if strings.Contains(ip, ":") {
+				proxy["ipv6"] = ip
+			} else {
+				proxy["ip"] = ip
+			}
+		}
+		if mtu := outbound.int("mtu"); mtu > 0 {
+			proxy["mtu"] = mtu
+		}
+		if reserved, ok := outbound.get("reserved"); ok {
+			proxy["reserved"] = reserved
+		}
+		proxy["udp"] = true
+	default:
+		p.warn(source, "type", "outbound type %s is not supported", kind)
+		return nil
+	}
+	if missing := missingEndpoint(proxy); missing != "" {
+		field := "server"
+		if missing == "port" {
+			field = "server_port"
+		}
+		p.warn(source, field, "the outbound has no %s, it was skipped", missing)
+		return nil
+	}
+	if detour := outbound.string("detour"); detour != "" {
+		proxy["dialer-proxy"] = detour
+	}
+	p.applySingBoxMultiplex(source, outbound, proxy)
+	outbound.get("tag")
+	outbound.get("type")
+	p.reportUnused(source, "", outbound)
+	return proxy
+}
+
+func parseSingBoxDuration(value string, fallback int) int {
+	if value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < time.Second {
+		return fallback
+	}
+	return int(duration.Seconds())
+}
+
+// singBoxRuleTypes maps the route rule matchers to clash rule types, sing-box ors matchers of one category and ands the categories
+var singBoxRuleTypes = []struct {
+	key      string
+	ruleType string
+	category string
+}{
+	{"domain", "DOMAIN", "domain"},
+	{"domain_suffix", "DOMAIN-SUFFIX", "domain"},
+	{"domain_keyword", "DOMAIN-KEYWORD", "domain"},
+	{"domain_regex", "DOMAIN-REGEX", "domain"},
+	{"geosite", "GEOSITE", "domain"},
+	{"geoip", "GEOIP", "ip"},
+	{"ip_cidr", "IP-CIDR", "ip"},
+	{"source_ip_cidr", "SRC-IP-CIDR", "source-ip"},
+	{"port", "DST-PORT", "port"},
+	{"source_port", "SRC-PORT", "source-port"},
+	{"process_name", "PROCESS-NAME", "process"},
+	{"process_path", "PROCESS-PATH", "process"},
+	{"package_name", "PACKAGE-NAME", "process"},
+	{"network", "NETWORK", "network"},
+}
+
+// singBoxRule turns the matchers of one route rule into clash rules, several categories become one AND rule
+func singBoxRule(rule *singBoxObject, target string) []string {
+	var categories []string
+	payloads := map[string][]string{}
+	for _, item := range singBoxRuleTypes {
+		for _, payload := range rule.strings(item.key) {
+			if _, ok := payloads[item.category]; !ok {
+				categories = append(categories, item.category)
+			}
+			payloads[item.category] = append(payloads[item.category], item.ruleType+","+payload)
+		}
+	}
+	switch len(categories) {
+	case 0:
+		return nil
+	case 1:
+		rules := payloads[categories[0]]
+		for i, rule := range rules {
+			rules[i] = rule + "," + target
+		}
+		return rules
+	}
+	parts := make([]string, 0, len(categories))
+	for _, category := range categories {
+		items := payloads[category]
+		if len(items) == 1 {
+			parts = append(parts, "("+items[0]+")")
+			continue
+		}
+		parts = append(parts, "(OR,(("+strings.Join(items, "),(")+")))")
+	}
+	return []string{"AND,(" + strings.Join(parts, ",") + ")," + target}
+}
+
+func (p *profileImporter) convertSingBoxRules(route *singBoxObject, targets map[string]string, fallback string) []string {
+	var rules []string
+	value, _ := route.get("rules")
+	items, _ := value.([]any)
+	for index, item := range items {
+		rule := newSingBoxObject(item)
+		source := fmt.Sprintf("route.rules[%d]", index)
+		target := targets[rule.string("outbound")]
+		switch action := rule.string("action"); action {
+		case "", "route":
+		case "reject":
+			target = "REJECT"
+		default:
+			p.warn(source, "action", "action %s is not converted", action)
+			continue
+		}
+		if target == "" {
+			p.warn(source, "outbound", "outbound is missing or not converted")
+			continue
+		}
+		matched := singBoxRule(rule, target)
+		for _, key := range rule.unused() {
+			p.warn(source, key, "unsupported rule matcher, the rule was skipped")
+			matched = nil
+		}
+		rules = append(rules, matched...)
+	}
+	if final := targets[route.string("final")]; final != "" {
+		fallback = final
+	}
+	p.reportUnused("route", "", route)
+	return append(rules, "MATCH,"+fallback)
+}
+
+func (p *profileImporter) importSingBox(root map[string]any) *importedProfile {
+	profile := &importedProfile{}
+	config := newSingBoxObject(root)
+	value, _ := config.get("outbounds")
+	items, _ := value.([]any)
+	targets := map[string]string{}
+	var groups []*singBoxObject
+	var groupNames []string
+	for _, item := range items {
+		outbound := newSingBoxObject(item)
+		tag := outbound.string("tag")
+		switch outbound.string("type") {
+		case "direct":
+			targets[tag] = "DIRECT"
+		case "block":
+			targets[tag] = "REJECT"
+		case "dns":
+			p.warn(tag, "type", "dns outbounds are handled by the dns settings of the profile")
+		case "selector", "urltest":
+			name := p.uniqueName(tag)
+			targets[tag] = name
+			groups = append(groups, outbound)
+			groupNames = append(groupNames, name)
+		default:
+			name := p.uniqueName(tag)
+			if proxy := p.convertSingBoxOutbound(outbound, name); proxy != nil {
+				targets[tag] = name
+				profile.Proxies = append(profile.Proxies, proxy)
+			}
+		}
+	}
+	for index, outbound := range groups {
+		name := groupNames[index]
+		group := map[string]any{"name": name}
+		var members []string
+		for _, tag := range outbound.strings("outbounds") {
+			if target := targets[tag]; target != "" {
+				members = append(members, target)
+			} else {
+				p.warn(name, "outbounds", "member %s was not converted", tag)
+			}
+		}
+		if outbound.string("type") == "urltest" {
+			group["type"] = "url-test"
+			if url := outbound.string("url"); url != "" {
+				group["url"] = url
+			}
+			group["interval"] = parseSingBoxDuration(outbound.string("interval"), 180)
+			if tolerance := outbound.int("tolerance"); tolerance > 0 {
+				group["tolerance"] = tolerance
+			}
+			outbound.get("idle_timeout")
+		} else {
+			group["type"] = "select"
+			if selected := targets[outbound.string("default")]; selected != "" {
+				for i, member := range members {
+					if member == selected {
+						members[0], members[i] = members[i], members[0]
+						break
+					}
+				}
+			}
+		}
+		if len(members) == 0 {
+			members = []string{"DIRECT"}
+		}
+		outbound.get("interrupt_exist_connections")
+		outbound.get("tag")
+		outbound.get("type")
+		group["proxies"] = members
+		p.reportUnused(name, "", outbound)
+		profile.ProxyGroups = append(profile.ProxyGroups, group)
+	}
+	fallback := ""
+	if len(groupNames) > 0 {
+		fallback = groupNames[0]
+	}
+	if route := config.object("route"); route != nil {
+		if fallback == "" && len(profile.Proxies) > 0 {
+			p.addDefaultGroup(profile)
+			fallback = importDefaultGroup
+		}
+		if fallback == "" {
+			fallback = "DIRECT"
+		}
+		profile.Rules = p.convertSingBoxRules(route, targets, fallback)
+	}
+	for _, key := range []string{"dns", "inbounds", "experimental", "ntp", "endpoints", "certificate"} {
+		if _, ok := config.get(key); ok {
+			p.warn(key, "", "not converted, the profile settings of FlClash apply")
+		}
+	}
+	config.get("log")
+	p.reportUnused("config", "", config)
+	return profile
+}
+
+// addDefaultGroup gives imported proxies a selector and a catch-all rule so the profile is usable right away
+func (p *profileImporter) addDefaultGroup(profile *importedProfile) {
+	if len(profile.ProxyGroups) > 0 || len(profile.Proxies) == 0 {
+		return
+	}
+	names := make([]string, 0, len(profile.Proxies))
+	for _, proxy := range profile.Proxies {
+		names = append(names, proxy["name"].(string))
+	}
+	profile.ProxyGroups = []map[string]any{{
+		"name":    importDefaultGroup,
+		"type":    "select",
+		"proxies": names,
+	}}
+}
+
+func importProfile(content []byte) (*ImportProfileResult, error) {
+	importer := &profileImporter{names: map[string]int{}}
+	result := &ImportProfileResult{}
+	var profile *importedProfile
+	trimmed := strings.TrimSpace(string(content))
+	if trimmed == "" {
+		return nil, errors.New("content is empty")
+	}
+	var root map[string]any
+	if strings.HasPrefix(trimmed, "{") && json.Unmarshal([]byte(trimmed), &root) == nil {
+		if _, ok := root["outbounds"]; !ok {
+			return nil, errors.New("json content is not a sing-box config")
+		}
+		result.Format = importFormatSingBox
+		profile = importer.importSingBox(root)
+	} else if yaml.Unmarshal([]byte(trimmed), &root) == nil && root["proxies"] != nil {
+		result.Format = importFormatClash
+		result.Config = trimmed
+		if proxies, ok := root["proxies"].([]any); ok {
+			result.Proxies = len(proxies)
+		}
+		if groups, ok := root["proxy-groups"].([]any); ok {
+			result.Groups = len(groups)
+		}
+		if rules, ok := root["rules"].([]any); ok {
+			result.Rules = len(rules)
+		}
+		result.Warnings = []ImportWarning{}
+		return result, nil
+	} else {
+		result.Format = importFormatLinks
+		profile = importer.importShareLinks([]byte(trimmed))
+	}
+	if len(profile.Proxies) == 0 {
+		return nil, errors.Join(errors.New("no proxies could be imported"), warningsError(importer.warnings))
+	}
+	if len(profile.Rules) == 0 {
+		importer.addDefaultGroup(profile)
+		profile.Rules = []string{"MATCH," + profile.ProxyGroups[0]["name"].(string)}
+	}
+	data, err := yaml.Marshal(profile)
+	if err != nil {
+		return nil, err
+	}
+	result.Config = string(data)
+	result.Proxies = len(profile.Proxies)
+	result.Groups = len(profile.ProxyGroups)
+	result.Rules = len(profile.Rules)
+	result.Warnings = importer.warnings
+	if result.Warnings == nil {
+		result.Warnings = []ImportWarning{}
+	}
+	return result, nil
+}
+
+func warningsError(warnings []ImportWarning) error {
+	var errs []error
+	for _, warning := range warnings {
+		errs = append(errs, fmt.Errorf("%s: %s", warning.Source, warning.Message))
+	}
+	return errors.Join(errs...)
+}
+
+func handleImportProfile(paramsString string) (string, error) {
+	var params = &ImportProfileParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return "", err
+	}
+	result, err := importProfile([]byte(params.Content))
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
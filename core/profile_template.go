@@ -0,0 +1,562 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/config"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+const (
+	templateDir           = "templates"
+	templateVariablesFile = "variables.json"
+	templateProfilesFile  = "profiles.json"
+	templateMarker        = "{{"
+	// templateEnvPrefix is the part of the process environment a shared profile may read, the rest
+	// may hold credentials of other programs
+	templateEnvPrefix  = "FLCLASH_"
+	templateSecretMask = "******"
+)
+
+// TemplateVariable is a value of this device for the templates of the profiles, an empty Profile
+// applies to every profile and a secret one is kept encrypted
+type TemplateVariable struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	Secret  bool   `json:"secret"`
+	Profile string `json:"profile,omitempty"`
+}
+
+type TemplateVariableKey struct {
+	Name    string `json:"name"`
+	Profile string `json:"profile"`
+}
+
+// TemplateProfileParams marks a profile as templated, the others are loaded as they are so a
+// subscription can not read the variables and secrets of the device
+type TemplateProfileParams struct {
+	Profile string `json:"profile"`
+	Enable  bool   `json:"enable"`
+}
+
+type TemplatePreviewParams struct {
+	Profile  string `json:"profile"`
+	Template string `json:"template"`
+}
+
+type TemplateVariables struct {
+	mutex     sync.Mutex
+	variables []*TemplateVariable
+	profiles  []string
+	loaded    bool
+}
+
+var templateVariables = &TemplateVariables{}
+
+func templatePath(name string) string {
+	return filepath.Join(constant.Path.Resolve(templateDir), name)
+}
+
+func (t *TemplateVariables) loadLocked() {
+	if t.loaded {
+		return
+	}
+	t.loaded = true
+	if data, err := os.ReadFile(templatePath(templateVariablesFile)); err == nil {
+		if err = json.Unmarshal(data, &t.variables); err != nil {
+			log.Warnln("[Template] load variables error: %v", err)
+		}
+	}
+	if data, err := os.ReadFile(templatePath(templateProfilesFile)); err == nil {
+		if err = json.Unmarshal(data, &t.profiles); err != nil {
+			log.Warnln("[Template] load profiles error: %v", err)
+		}
+	}
+}
+
+func (t *TemplateVariables) saveLocked() error {
+	return writeTemplateFile(templateVariablesFile, t.variables)
+}
+
+func writeTemplateFile(name string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	path := templatePath(name)
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+func (t *TemplateVariables) templatedLocked(profile string) (int, bool) {
+	t.loadLocked()
+	for index, item := range t.profiles {
+		if item == profile {
+			return index, true
+		}
+	}
+	return -1, false
+}
+
+// SetProfile marks or unmarks a profile as templated
+func (t *TemplateVariables) SetProfile(params *TemplateProfileParams) error {
+	if params.Profile == "" {
+		return errors.New("profile is required")
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	index, templated := t.templatedLocked(params.Profile)
+	if templated == params.Enable {
+		return nil
+	}
+	if params.Enable {
+		t.profiles = append(t.profiles, params.Profile)
+	} else {
+		t.profiles = append(t.profiles[:index], t.profiles[index+1:]...)
+	}
+	return writeTemplateFile(templateProfilesFile, t.profiles)
+}
+
+func (t *TemplateVariables) Templated(profile string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	_, templated := t.templatedLocked(profile)
+	return templated
+}
+
+func (t *TemplateVariables) Profiles() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.loadLocked()
+	profiles := append([]string{}, t.profiles...)
+	sort.Strings(profiles)
+	return profiles
+}
+
+func (t *TemplateVariables) findLocked(name, profile string) (int, *TemplateVariable) {
+	t.loadLocked()
+	for index, variable := range t.variables {
+		if variable.Name == name && variable.Profile == profile {
+			return index, variable
+		}
+	}
+	return -1, nil
+}
+
+func (t *TemplateVariables) Set(variable *TemplateVariable) error {
+	if variable.Name == "" {
+		return errors.New("name is required")
+	}
+	if variable.Secret && !strings.HasPrefix(variable.Value, encryptedValuePrefix) {
+		encrypted, err := EncryptSecretValue(variable.Value)
+		if err != nil {
+			return err
+		}
+		variable.Value = encrypted
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, previous := t.findLocked(variable.Name, variable.Profile); previous != nil {
+		*previous = *variable
+	} else {
+		copied := *variable
+		t.variables = append(t.variables, &copied)
+	}
+	return t.saveLocked()
+}
+
+// reseal moves the secret values sealed by from to the key in use
+func (t *TemplateVariables) reseal(from *EncryptionService) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.loadLocked()
+	resealed := false
+	for _, variable := range t.variables {
+		if !variable.Secret {
+			continue
+		}
+		value, err := resealSecretValue(variable.Value, from)
+		if err != nil {
+			return fmt.Errorf("%s: %v", variable.Name, err)
+		}
+		variable.Value = value
+		resealed = true
+	}
+	if !resealed {
+		return nil
+	}
+	return t.saveLocked()
+}
+
+// templateBackup is what a bundle holds of the templates, the secret values are plain in it
+type templateBackup struct {
+	Variables []TemplateVariable `json:"variables"`
+	Profiles  []string           `json:"profiles"`
+}
+
+func (t *TemplateVariables) backup() (*templateBackup, error) {
+	t.mutex.Lock()
+	t.loadLocked()
+	backup := &templateBackup{
+		Variables: make([]TemplateVariable, 0, len(t.variables)),
+		Profiles:  append([]string{}, t.profiles...),
+	}
+	for _, variable := range t.variables {
+		backup.Variables = append(backup.Variables, *variable)
+	}
+	t.mutex.Unlock()
+	for index, variable := range backup.Variables {
+		if !variable.Secret {
+			continue
+		}
+		plain, err := decryptSecretValue(variable.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", variable.Name, err)
+		}
+		backup.Variables[index].Value = plain
+	}
+	return backup, nil
+}
+
+// restore sets the variables of a bundle and marks its templated profiles, the secret ones are
+// sealed with the key in use
+func (t *TemplateVariables) restore(backup *templateBackup) error {
+	variables := make([]*TemplateVariable, 0, len(backup.Variables))
+	for _, variable := range backup.Variables {
+		if variable.Name == "" {
+			return errors.New("name is required")
+		}
+		copied := variable
+		if copied.Secret {
+			encrypted, err := EncryptSecretValue(copied.Value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", copied.Name, err)
+			}
+			copied.Value = encrypted
+		}
+		variables = append(variables, &copied)
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, variable := range variables {
+		if index, _ := t.findLocked(variable.Name, variable.Profile); index >= 0 {
+			t.variables[index] = variable
+		} else {
+			t.variables = append(t.variables, variable)
+		}
+	}
+	for _, profile := range backup.Profiles {
+		if _, templated := t.templatedLocked(profile); !templated && profile != "" {
+			t.profiles = append(t.profiles, profile)
+		}
+	}
+	if err := t.saveLocked(); err != nil {
+		return err
+	}
+	return writeTemplateFile(templateProfilesFile, t.profiles)
+}
+
+func (t *TemplateVariables) Remove(key *TemplateVariableKey) (bool, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	index, variable := t.findLocked(key.Name, key.Profile)
+	if variable == nil {
+		return false, nil
+	}
+	t.variables = append(t.variables[:index], t.variables[index+1:]...)
+	return true, t.saveLocked()
+}
+
+// List masks the secret values, they never leave the core
+func (t *TemplateVariables) List() []TemplateVariable {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.loadLocked()
+	list := make([]TemplateVariable, 0, len(t.variables))
+	for _, variable := range t.variables {
+		copied := *variable
+		if copied.Secret {
+			copied.Value = templateSecretMask
+		}
+		list = append(list, copied)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Profile != list[j].Profile {
+			return list[i].Profile < list[j].Profile
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// lookup prefers the variable of the profile over the one of every profile
+func (t *TemplateVariables) lookup(profile, name string) (TemplateVariable, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if profile != "" {
+		if _, variable := t.findLocked(name, profile); variable != nil {
+			return *variable, true
+		}
+	}
+	if _, variable := t.findLocked(name, ""); variable != nil {
+		return *variable, true
+	}
+	return TemplateVariable{}, false
+}
+
+// profileTemplate renders the strings of one profile, preview hides what the secrets resolve to and
+// vaultOnly only renders the vault refs of a profile granted secrets but not marked as templated
+type profileTemplate struct {
+	profile   string
+	preview   bool
+	vaultOnly bool
+	funcs     template.FuncMap
+}
+
+func newProfileTemplate(profile string, preview bool) *profileTemplate {
+	p := &profileTemplate{profile: profile, preview: preview}
+	p.funcs = template.FuncMap{
+		"env":    p.env,
+		"envOr":  p.envOr,
+		"secret": p.secret,
+		"vault":  p.vault,
+	}
+	return p
+}
+
+func (p *profileTemplate) lookupEnv(name string) (string, bool, error) {
+	if p.vaultOnly {
+		return "", false, fmt.Errorf("profile %s is not templated", p.profile)
+	}
+	if variable, ok := templateVariables.lookup(p.profile, name); ok {
+		if variable.Secret {
+			return "", false, fmt.Errorf("variable %s is a secret, use secret", name)
+		}
+		return variable.Value, true, nil
+	}
+	if strings.HasPrefix(name, templateEnvPrefix) {
+		value, ok := os.LookupEnv(name)
+		return value, ok, nil
+	}
+	return "", false, nil
+}
+
+func (p *profileTemplate) env(name string) (string, error) {
+	value, ok, err := p.lookupEnv(name)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("variable %s is not set", name)
+	}
+	return value, nil
+}
+
+func (p *profileTemplate) envOr(name, fallback string) (string, error) {
+	value, ok, err := p.lookupEnv(name)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return fallback, nil
+	}
+	return value, nil
+}
+
+// secret takes the name of a secret variable or an encrypted value itself
+func (p *profileTemplate) secret(name string) (string, error) {
+	if p.vaultOnly {
+		return "", fmt.Errorf("profile %s is not templated", p.profile)
+	}
+	value := name
+	if !strings.HasPrefix(name, encryptedValuePrefix) {
+		variable, ok := templateVariables.lookup(p.profile, name)
+		if !ok || !variable.Secret {
+			return "", fmt.Errorf("secret %s is not set", name)
+		}
+		value = variable.Value
+	}
+	plain, err := decryptSecretValue(value)
+	if err != nil {
+		return "", fmt.Errorf("secret %s: %v", name, err)
+	}
+	if p.preview {
+		return templateSecretMask, nil
+	}
+	return plain, nil
+}
+
+// vault takes the name of a secret of the vault, the profile has to be granted it
+func (p *profileTemplate) vault(name string) (string, error) {
+	plain, err := vault.Resolve(p.profile, name)
+	if err != nil {
+		return "", err
+	}
+	if p.preview {
+		return templateSecretMask, nil
+	}
+	return plain, nil
+}
+
+func (p *profileTemplate) render(text string) (string, error) {
+	if !strings.Contains(text, templateMarker) {
+		return text, nil
+	}
+	parsed, err := template.New("profile").Option("missingkey=error").Funcs(p.funcs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	builder := &strings.Builder{}
+	if err = parsed.Execute(builder, nil); err != nil {
+		return "", err
+	}
+	return builder.String(), nil
+}
+
+// walk renders every string the value holds in place, the maps and slices of the proxies and
+// providers included
+func (p *profileTemplate) walk(value reflect.Value, path string) error {
+	switch value.Kind() {
+	case reflect.String:
+		if !value.CanSet() || !strings.Contains(value.String(), templateMarker) {
+			return nil
+		}
+		if p.vaultOnly && !isVaultRef(value.String()) {
+			return nil
+		}
+		rendered, err := p.render(value.String())
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		value.SetString(rendered)
+	case reflect.Pointer:
+		if !value.IsNil() {
+			return p.walk(value.Elem(), path)
+		}
+	case reflect.Interface:
+		if value.IsNil() || !value.CanSet() {
+			return nil
+		}
+		elem := reflect.New(value.Elem().Type()).Elem()
+		elem.Set(value.Elem())
+		if err := p.walk(elem, path); err != nil {
+			return err
+		}
+		value.Set(elem)
+	case reflect.Struct:
+		valueType := value.Type()
+		for index := 0; index < value.NumField(); index++ {
+			field := valueType.Field(index)
+			if !field.IsExported() {
+				continue
+			}
+			name := field.Name
+			if tag := strings.Split(field.Tag.Get("yaml"), ",")[0]; tag != "" && tag != "-" {
+				name = tag
+			}
+			if err := p.walk(value.Field(index), joinTemplatePath(path, name)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for index := 0; index < value.Len(); index++ {
+			if err := p.walk(value.Index(index), fmt.Sprintf("%s[%d]", path, index)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		iterator := value.MapRange()
+		for iterator.Next() {
+			elem := reflect.New(iterator.Value().Type()).Elem()
+			elem.Set(iterator.Value())
+			if err := p.walk(elem, joinTemplatePath(path, fmt.Sprint(iterator.Key().Interface()))); err != nil {
+				return err
+			}
+			value.SetMapIndex(iterator.Key(), elem)
+		}
+	}
+	return nil
+}
+
+func joinTemplatePath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// renderProfileTemplates resolves the templates of the profile before anything else reads it, only
+// a profile the user marked as templated is rendered, one granted secrets of the vault gets its
+// vault refs resolved
+func renderProfileTemplates(profileId string, rawConfig *config.RawConfig) error {
+	if rawConfig == nil || profileId == "" {
+		return nil
+	}
+	p := newProfileTemplate(profileId, false)
+	if !templateVariables.Templated(profileId) {
+		if !vault.Granted(profileId) {
+			return nil
+		}
+		p.vaultOnly = true
+	}
+	return p.walk(reflect.ValueOf(rawConfig), "")
+}
+
+func handleSetTemplateVariable(paramsString string) error {
+	variable := &TemplateVariable{}
+	if err := json.Unmarshal([]byte(paramsString), variable); err != nil {
+		return err
+	}
+	return templateVariables.Set(variable)
+}
+
+func handleRemoveTemplateVariable(paramsString string) (bool, error) {
+	key := &TemplateVariableKey{}
+	if err := json.Unmarshal([]byte(paramsString), key); err != nil {
+		return false, err
+	}
+	return templateVariables.Remove(key)
+}
+
+func handleGetTemplateVariables() string {
+	data, err := json.Marshal(templateVariables.List())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handleSetTemplateProfile(paramsString string) error {
+	params := &TemplateProfileParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	return templateVariables.SetProfile(params)
+}
+
+func handleGetTemplateProfiles() string {
+	data, err := json.Marshal(templateVariables.Profiles())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handlePreviewTemplate(paramsString string) (string, error) {
+	params := &TemplatePreviewParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return "", err
+	}
+	return newProfileTemplate(params.Profile, true).render(params.Template)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/metacubex/mihomo/adapter/provider"
+	cp "github.com/metacubex/mihomo/constant/provider"
+	"github.com/metacubex/mihomo/tunnel"
+	"sort"
+	"sync"
+	"time"
+)
+
+type SubscriptionUsage struct {
+	Upload    int64 `json:"upload"`
+	Download  int64 `json:"download"`
+	Total     int64 `json:"total"`
+	Expire    int64 `json:"expire"`
+	Used      int64 `json:"used"`
+	Remaining int64 `json:"remaining"`
+	Expired   bool  `json:"expired"`
+	// Source is header or embedded when the usage was read from a profile download
+	Source string `json:"source,omitempty"`
+}
+
+type ProviderHealth struct {
+	Name         string             `json:"name"`
+	Kind         string             `json:"kind"`
+	Type         string             `json:"type"`
+	VehicleType  string             `json:"vehicle-type"`
+	Behavior     string             `json:"behavior,omitempty"`
+	Path         string             `json:"path,omitempty"`
+	Count        int                `json:"count"`
+	Alive        *int               `json:"alive,omitempty"`
+	UpdateAt     int64              `json:"update-at"`
+	LastAttempt  int64              `json:"last-attempt,omitempty"`
+	LastError    string             `json:"last-error,omitempty"`
+	Failures     int                `json:"failures"`
+	Subscription *SubscriptionUsage `json:"subscription,omitempty"`
+}
+
+type providerAttempt struct {
+	at       time.Time
+	err      string
+	failures int
+}
+
+// ProviderAttempts keeps the result of the last update issued through the core of every provider,
+// the background updates of mihomo only log their errors
+type ProviderAttempts struct {
+	mutex    sync.Mutex
+	attempts map[string]providerAttempt
+}
+
+var providerAttempts = &ProviderAttempts{attempts: map[string]providerAttempt{}}
+
+func (a *ProviderAttempts) record(name string, err error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	attempt := providerAttempt{at: time.Now()}
+	if err != nil {
+		attempt.err = err.Error()
+		attempt.failures = a.attempts[name].failures + 1
+	}
+	a.attempts[name] = attempt
+}
+
+func (a *ProviderAttempts) get(name string) (providerAttempt, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	attempt, ok := a.attempts[name]
+	return attempt, ok
+}
+
+func subscriptionUsage(info *provider.SubscriptionInfo) *SubscriptionUsage {
+	if info == nil {
+		return nil
+	}
+	usage := &SubscriptionUsage{
+		Upload:   info.Upload,
+		Download: info.Download,
+		Total:    info.Total,
+		Expire:   info.Expire,
+		Used:     info.Upload + info.Download,
+	}
+	if usage.Total > 0 {
+		usage.Remaining = usage.Total - usage.Used
+		if usage.Remaining < 0 {
+			usage.Remaining = 0
+		}
+	}
+	usage.Expired = usage.Expire > 0 && time.Unix(usage.Expire, 0).Before(time.Now())
+	return usage
+}
+
+func providerHealth(p cp.Provider) *ProviderHealth {
+	health := &ProviderHealth{
+		Name:        p.Name(),
+		Type:        p.Type().String(),
+		VehicleType: p.VehicleType().String(),
+	}
+	if fetcher, ok := p.(vehicleProvider); ok {
+		health.Path = fetcher.Vehicle().Path()
+	}
+	switch p := p.(type) {
+	case cp.ProxyProvider:
+		health.Kind = "proxy"
+		health.Count = p.Count()
+		alive := 0
+		url := p.HealthCheckURL()
+		for _, proxy := range p.Proxies() {
+			if proxy.AliveForTestUrl(url) {
+				alive++
+			}
+		}
+		health.Alive = &alive
+		if psp, ok := p.(*provider.ProxySetProvider); ok {
+			health.UpdateAt = psp.UpdatedAt().UnixMilli()
+			health.Subscription = subscriptionUsage(psp.GetSubscriptionInfo())
+		}
+	case cp.RuleProvider:
+		health.Kind = "rule"
+		health.Count = p.Count()
+		health.Behavior = p.Behavior().String()
+		if updated, ok := p.(interface{ UpdatedAt() time.Time }); ok {
+			health.UpdateAt = updated.UpdatedAt().UnixMilli()
+		}
+	}
+	if attempt, ok := providerAttempts.get(health.Name); ok {
+		health.LastAttempt = attempt.at.UnixMilli()
+		health.LastError = attempt.err
+		health.Failures = attempt.failures
+	}
+	return health
+}
+
+func providersHealth() []*ProviderHealth {
+	healths := make([]*ProviderHealth, 0)
+	for _, p := range tunnel.Providers() {
+		if p.VehicleType() != cp.Compatible {
+			healths = append(healths, providerHealth(p))
+		}
+	}
+	for _, p := range tunnel.RuleProviders() {
+		if p.VehicleType() != cp.Compatible {
+			healths = append(healths, providerHealth(p))
+		}
+	}
+	sort.Slice(healths, func(i, j int) bool {
+		if healths[i].Kind != healths[j].Kind {
+			return healths[i].Kind < healths[j].Kind
+		}
+		return healths[i].Name < healths[j].Name
+	})
+	return healths
+}
+
+// forceUpdateProvider fetches a provider now whatever its interval, remote rule providers go
+// through the rule provider updater so their integrity is still verified
+func forceUpdateProvider(name string) (*ProviderHealth, error) {
+	if p, ok := tunnel.RuleProviders()[name]; ok && p.VehicleType() == cp.HTTP {
+		update := ruleProviderUpdates.Update(context.Background(), name)
+		if update.Error != "" {
+			return nil, errors.New(update.Error)
+		}
+		return providerHealth(p), nil
+	}
+	var p cp.Provider
+	if proxyProvider, ok := tunnel.Providers()[name]; ok {
+		p = proxyProvider
+	} else if ruleProvider, ok := tunnel.RuleProviders()[name]; ok {
+		p = ruleProvider
+	}
+	if p == nil || p.VehicleType() == cp.Compatible {
+		return nil, errors.New("external provider is not exist")
+	}
+	err := p.Update()
+	providerAttempts.record(name, err)
+	if err != nil {
+		return nil, err
+	}
+	return providerHealth(p), nil
+}
+
+func handleGetProvidersHealth() string {
+	data, err := json.Marshal(providersHealth())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handleForceUpdateProvider(name string, fn func(string, error)) {
+	go func() {
+		health, err := forceUpdateProvider(name)
+		if err != nil {
+			fn("", err)
+			return
+		}
+		data, err := json.Marshal(health)
+		if err != nil {
+			fn("", err)
+			return
+		}
+		fn(string(data), nil)
+	}()
+}
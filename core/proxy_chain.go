@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/adapter"
+	"github.com/metacubex/mihomo/adapter/outbound"
+	"github.com/metacubex/mihomo/common/utils"
+	"github.com/metacubex/mihomo/component/dialer"
+	"github.com/metacubex/mihomo/component/proxydialer"
+	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxProxyChainHops        = 8
+	defaultProxyChainTimeout = 5 * time.Second
+)
+
+type ProxyChainParams struct {
+	Name    string   `json:"name"`
+	Proxies []string `json:"proxies"`
+}
+
+type ProxyChainInfo struct {
+	Name    string   `json:"name"`
+	Proxies []string `json:"proxies"`
+	Ready   bool     `json:"ready"`
+	Error   string   `json:"error,omitempty"`
+}
+
+type TestProxyChainParams struct {
+	Name    string `json:"name"`
+	TestUrl string `json:"test-url"`
+	Timeout int64  `json:"timeout"`
+}
+
+type ProxyChainHopDelay struct {
+	Name  string `json:"name"`
+	Delay int32  `json:"delay"`
+}
+
+// ProxyChainDelay holds the delay through the whole chain next to the one of every hop on its own
+type ProxyChainDelay struct {
+	Name  string               `json:"name"`
+	Url   string               `json:"url"`
+	Delay int32                `json:"delay"`
+	Hops  []ProxyChainHopDelay `json:"hops"`
+}
+
+// proxyChainAdapter dials the last hop through the dialer of the hops in front of it, the same
+// way dialer-proxy of a profile does, groups are unwrapped on every dial
+type proxyChainAdapter struct {
+	*outbound.Base
+	hops []C.Proxy
+}
+
+func newProxyChainAdapter(name string, hops []C.Proxy) *proxyChainAdapter {
+	udp := true
+	for _, hop := range hops {
+		udp = udp && hop.SupportUDP()
+	}
+	return &proxyChainAdapter{
+		Base: outbound.NewBase(outbound.BaseOption{
+			Name: name,
+			Type: C.Relay,
+			UDP:  udp,
+		}),
+		hops: hops,
+	}
+}
+
+func (c *proxyChainAdapter) resolve(metadata *C.Metadata, touch bool) []C.Proxy {
+	resolved := make([]C.Proxy, 0, len(c.hops))
+	for _, hop := range c.hops {
+		for next := hop.Unwrap(metadata, touch); next != nil; next = next.Unwrap(metadata, touch) {
+			hop = next
+		}
+		if hop.Type() == C.Direct || hop.Type() == C.Compatible {
+			continue
+		}
+		resolved = append(resolved, hop)
+	}
+	return resolved
+}
+
+func (c *proxyChainAdapter) dialer(hops []C.Proxy) C.Dialer {
+	var d C.Dialer = dialer.NewDialer()
+	for _, hop := range hops {
+		d = proxydialer.New(hop, d, false)
+	}
+	return d
+}
+
+func (c *proxyChainAdapter) DialContext(ctx context.Context, metadata *C.Metadata) (C.Conn, error) {
+	hops := c.resolve(metadata, true)
+	if len(hops) == 0 {
+		return outbound.NewDirect().DialContext(ctx, metadata)
+	}
+	last := hops[len(hops)-1]
+	conn, err := last.DialContextWithDialer(ctx, c.dialer(hops[:len(hops)-1]), metadata)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(hops) - 2; i >= 0; i-- {
+		conn.AppendToChains(hops[i])
+	}
+	conn.AppendToChains(c)
+	return conn, nil
+}
+
+func (c *proxyChainAdapter) ListenPacketContext(ctx context.Context, metadata *C.Metadata) (C.PacketConn, error) {
+	hops := c.resolve(metadata, true)
+	if len(hops) == 0 {
+		return outbound.NewDirect().ListenPacketContext(ctx, metadata)
+	}
+	last := hops[len(hops)-1]
+	pc, err := last.ListenPacketWithDialer(ctx, c.dialer(hops[:len(hops)-1]), metadata)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(hops) - 2; i >= 0; i-- {
+		pc.AppendToChains(hops[i])
+	}
+	pc.AppendToChains(c)
+	return pc, nil
+}
+
+func (c *proxyChainAdapter) Addr() string {
+	hops := c.resolve(nil, false)
+	if len(hops) == 0 {
+		return ""
+	}
+	return hops[len(hops)-1].Addr()
+}
+
+func (c *proxyChainAdapter) MarshalJSON() ([]byte, error) {
+	all := make([]string, 0, len(c.hops))
+	for _, hop := range c.hops {
+		all = append(all, hop.Name())
+	}
+	return json.Marshal(map[string]any{
+		"name": c.Name(),
+		"type": c.Type().String(),
+		"udp":  c.SupportUDP(),
+		"all":  all,
+	})
+}
+
+// ProxyChains keeps the chains built at runtime, they are added to the proxies of the tunnel
+// again after every setup because a new profile replaces the whole map
+type ProxyChains struct {
+	mutex  sync.Mutex
+	chains map[string][]string
+	errors map[string]string
+}
+
+var proxyChains = &ProxyChains{chains: map[string][]string{}, errors: map[string]string{}}
+
+func isProxyChain(proxy C.Proxy) bool {
+	outbound, ok := proxy.(*adapter.Proxy)
+	if !ok {
+		return false
+	}
+	_, ok = outbound.ProxyAdapter.(*proxyChainAdapter)
+	return ok
+}
+
+func buildProxyChain(name string, hopNames []string, proxies map[string]C.Proxy) (C.Proxy, error) {
+	if len(hopNames) < 2 {
+		return nil, errors.New("a chain needs at least two proxies")
+	}
+	if len(hopNames) > maxProxyChainHops {
+		return nil, fmt.Errorf("a chain has at most %d proxies", maxProxyChainHops)
+	}
+	hops := make([]C.Proxy, 0, len(hopNames))
+	for _, hopName := range hopNames {
+		hop, ok := proxies[hopName]
+		if !ok {
+			return nil, fmt.Errorf("proxy %s not found", hopName)
+		}
+		if isProxyChain(hop) {
+			return nil, fmt.Errorf("proxy %s is a chain", hopName)
+		}
+		hops = append(hops, hop)
+	}
+	return adapter.NewProxy(newProxyChainAdapter(name, hops)), nil
+}
+
+// ApplyLocked rebuilds every chain over the current proxies, the caller holds runLock
+func (p *ProxyChains) ApplyLocked() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	current := tunnel.Proxies()
+	changed := false
+	proxies := make(map[string]C.Proxy, len(current)+len(p.chains))
+	for name, proxy := range current {
+		if isProxyChain(proxy) {
+			changed = true
+			continue
+		}
+		proxies[name] = proxy
+	}
+	lookup := tunnel.ProxiesWithProviders()
+	p.errors = map[string]string{}
+	for name, hopNames := range p.chains {
+		if _, ok := proxies[name]; ok {
+			p.errors[name] = "name is used by the profile"
+			continue
+		}
+		chain, err := buildProxyChain(name, hopNames, lookup)
+		if err != nil {
+			log.Warnln("[ProxyChain] %s: %v", name, err)
+			p.errors[name] = err.Error()
+			continue
+		}
+		proxies[name] = chain
+		changed = true
+	}
+	if changed {
+		tunnel.UpdateProxies(proxies, tunnel.Providers())
+	}
+}
+
+// Set adds or replaces a chain, an empty list of proxies removes it
+func (p *ProxyChains) Set(params *ProxyChainParams) (*ProxyChainInfo, error) {
+	hopNames := make([]string, 0, len(params.Proxies))
+	for _, hopName := range params.Proxies {
+		if hopName = strings.TrimSpace(hopName); hopName != "" {
+			hopNames = append(hopNames, hopName)
+		}
+	}
+	name := strings.TrimSpace(params.Name)
+	if name == "" {
+		name = strings.Join(hopNames, " -> ")
+	}
+	if name == "" {
+		return nil, errors.New("chain name is required")
+	}
+	runLock.Lock()
+	defer runLock.Unlock()
+	p.mutex.Lock()
+	if len(hopNames) == 0 {
+		delete(p.chains, name)
+	} else {
+		if proxy, ok := tunnel.Proxies()[name]; ok && !isProxyChain(proxy) {
+			p.mutex.Unlock()
+			return nil, fmt.Errorf("name %s is used by the profile", name)
+		}
+		if _, err := buildProxyChain(name, hopNames, tunnel.ProxiesWithProviders()); err != nil {
+			p.mutex.Unlock()
+			return nil, err
+		}
+		p.chains[name] = hopNames
+	}
+	p.mutex.Unlock()
+	p.ApplyLocked()
+	return &ProxyChainInfo{Name: name, Proxies: hopNames, Ready: len(hopNames) != 0}, nil
+}
+
+func (p *ProxyChains) List() []ProxyChainInfo {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	infos := make([]ProxyChainInfo, 0, len(p.chains))
+	for name, hopNames := range p.chains {
+		err := p.errors[name]
+		infos = append(infos, ProxyChainInfo{
+			Name:    name,
+			Proxies: append([]string{}, hopNames...),
+			Ready:   err == "",
+			Error:   err,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// testProxyChain measures the url test through the whole chain, the hops are tested on their own
+// so the cost of every extra hop shows up
+func testProxyChain(params *TestProxyChainParams) (*ProxyChainDelay, error) {
+	chain, ok := tunnel.Proxies()[params.Name]
+	if !ok || !isProxyChain(chain) {
+		return nil, fmt.Errorf("chain %s not found", params.Name)
+	}
+	expectedStatus, err := utils.NewUnsignedRanges[uint16]("")
+	if err != nil {
+		return nil, err
+	}
+	testUrl := C.DefaultTestURL
+	if params.TestUrl != "" {
+		testUrl = params.TestUrl
+	}
+	timeout := time.Duration(params.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultProxyChainTimeout
+	}
+	test := func(proxy C.Proxy) int32 {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		delay, err := proxy.URLTest(ctx, testUrl, expectedStatus)
+		if err != nil || delay == 0 {
+			return -1
+		}
+		return int32(delay)
+	}
+	result := &ProxyChainDelay{Name: params.Name, Url: testUrl}
+	hops := chain.(*adapter.Proxy).ProxyAdapter.(*proxyChainAdapter).hops
+	var wg sync.WaitGroup
+	result.Hops = make([]ProxyChainHopDelay, len(hops))
+	for i, hop := range hops {
+		wg.Add(1)
+		go func(i int, hop C.Proxy) {
+			defer wg.Done()
+			result.Hops[i] = ProxyChainHopDelay{Name: hop.Name(), Delay: test(hop)}
+		}(i, hop)
+	}
+	result.Delay = test(chain)
+	wg.Wait()
+	return result, nil
+}
+
+func handleSetProxyChain(paramsString string) (string, error) {
+	var params = &ProxyChainParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		// a bare list of proxy names is accepted too
+		if err := json.Unmarshal([]byte(paramsString), &params.Proxies); err != nil {
+			return "", err
+		}
+	}
+	info, err := proxyChains.Set(params)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func handleGetProxyChains() string {
+	data, err := json.Marshal(proxyChains.List())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handleTestProxyChain(paramsString string, fn func(string, error)) {
+	go func() {
+		var params = &TestProxyChainParams{}
+		if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+			fn("", err)
+			return
+		}
+		result, err := testProxyChain(params)
+		if err != nil {
+			fn("", err)
+			return
+		}
+		data, err := json.Marshal(result)
+		if err != nil {
+			fn("", err)
+			return
+		}
+		fn(string(data), nil)
+	}()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/metacubex/mihomo/adapter"
+	"github.com/metacubex/mihomo/adapter/outbound"
+	"github.com/metacubex/mihomo/config"
+	"golang.org/x/crypto/ssh"
+	"strings"
+)
+
+// ProxyError describes why a proxy of a profile cannot be used
+type ProxyError struct {
+	Index   int    `json:"index"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+var tuicCongestionControllers = []string{"cubic", "new_reno", "bbr"}
+
+// ValidateProxies builds every proxy of the profile and reports all failures instead of the first
+func ValidateProxies(rawConfig *config.RawConfig) []ProxyError {
+	errs := []ProxyError{}
+	for index, mapping := range rawConfig.Proxy {
+		name, _ := mapping["name"].(string)
+		proxyType, _ := mapping["type"].(string)
+		base := ProxyError{Index: index, Name: name, Type: proxyType}
+
+		if err := resolveProxySecrets(mapping); err != nil {
+			base.Message = err.Error()
+			errs = append(errs, base)
+			continue
+		}
+		hints := validateProxyHints(mapping)
+		for _, hint := range hints {
+			hint.Index, hint.Name, hint.Type = base.Index, base.Name, base.Type
+			errs = append(errs, hint)
+		}
+		if len(hints) != 0 {
+			continue
+		}
+		proxy, err := adapter.ParseProxy(mapping)
+		if err != nil {
+			base.Message = err.Error()
+			errs = append(errs, base)
+			continue
+		}
+		_ = proxy.Close()
+	}
+	return errs
+}
+
+// validateProxyHints checks the fields the proxy parsers silently ignore or default when malformed
+func validateProxyHints(mapping map[string]any) []ProxyError {
+	var errs []ProxyError
+	field := func(key string) string {
+		value, ok := mapping[key]
+		if !ok || value == nil {
+			return ""
+		}
+		return strings.TrimSpace(fmt.Sprint(value))
+	}
+	proxyType, _ := mapping["type"].(string)
+	errs = append(errs, validateObfsChainHints(mapping)...)
+	switch proxyType {
+	case "hysteria", "hysteria2":
+		for _, key := range []string{"up", "down"} {
+			if value := field(key); value != "" && outbound.StringToBps(value) == 0 {
+				errs = append(errs, ProxyError{
+					Field:   key,
+					Message: fmt.Sprintf("invalid bandwidth %q, expected a number in Mbps or a value like \"100 Mbps\"", value),
+				})
+			}
+		}
+		if proxyType == "hysteria2" {
+			if obfs := field("obfs"); obfs != "" {
+				if obfs != "salamander" {
+					errs = append(errs, ProxyError{Field: "obfs", Message: fmt.Sprintf("unknown obfs %q, only salamander is supported", obfs)})
+				} else if field("obfs-password") == "" {
+					errs = append(errs, ProxyError{Field: "obfs-password", Message: "salamander obfs requires obfs-password"})
+				}
+			}
+			if field("password") == "" {
+				errs = append(errs, ProxyError{Field: "password", Message: "password is required"})
+			}
+		}
+	case "ssh":
+		if field("username") == "" {
+			errs = append(errs, ProxyError{Field: "username", Message: "username is required"})
+		}
+		if field("password") == "" && field("private-key") == "" {
+			errs = append(errs, ProxyError{Field: "password", Message: "password or private-key is required"})
+		}
+		hostKeys, _ := mapping["host-key"].([]any)
+		for _, hostKey := range hostKeys {
+			if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(fmt.Sprint(hostKey))); err != nil {
+				errs = append(errs, ProxyError{Field: "host-key", Message: fmt.Sprintf("invalid host key %q: %v", hostKey, err)})
+			}
+		}
+	case "vless":
+		errs = append(errs, validateRealityHints(mapping)...)
+	case "tuic":
+		if field("token") == "" {
+			if field("uuid") == "" || field("password") == "" {
+				errs = append(errs, ProxyError{Field: "uuid", Message: "tuic v5 requires uuid and password, v4 requires token"})
+			}
+		}
+		if controller := field("congestion-controller"); controller != "" && !containsString(tuicCongestionControllers, controller) {
+			errs = append(errs, ProxyError{
+				Field:   "congestion-controller",
+				Message: fmt.Sprintf("unknown congestion controller %q, expected one of %s", controller, strings.Join(tuicCongestionControllers, ", ")),
+			})
+		}
+		if mode := field("udp-relay-mode"); mode != "" && mode != "native" && mode != "quic" {
+			errs = append(errs, ProxyError{Field: "udp-relay-mode", Message: fmt.Sprintf("unknown udp relay mode %q, expected native or quic", mode)})
+		}
+	}
+	return errs
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func handleValidateProxies(bytes []byte) string {
+	rawConfig, err := config.UnmarshalRawConfig(bytes)
+	if err != nil {
+		data, _ := json.Marshal([]ProxyError{{Index: -1, Message: err.Error()}})
+		return string(data)
+	}
+	data, err := json.Marshal(ValidateProxies(rawConfig))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
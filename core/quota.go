@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	quotaStoreFile     = "quota.json"
+	quotaSaveInterval  = time.Minute
+	defaultQuotaWarnAt = 80
+)
+
+type QuotaScope string
+
+const (
+	ProfileQuotaScope QuotaScope = "profile"
+	ProxyQuotaScope   QuotaScope = "proxy"
+)
+
+type QuotaPeriod string
+
+const (
+	DailyQuotaPeriod   QuotaPeriod = "daily"
+	MonthlyQuotaPeriod QuotaPeriod = "monthly"
+)
+
+type QuotaAction string
+
+const (
+	WarnQuotaAction   QuotaAction = "warn"
+	DirectQuotaAction QuotaAction = "direct"
+	StopQuotaAction   QuotaAction = "stop"
+)
+
+// QuotaParams limits the traffic of a profile or of the connections through a proxy within a period, in bytes
+type QuotaParams struct {
+	Id       string      `json:"id"`
+	Scope    QuotaScope  `json:"scope"`
+	Target   string      `json:"target"`
+	Period   QuotaPeriod `json:"period"`
+	ResetDay int         `json:"reset-day"`
+	Limit    int64       `json:"limit"`
+	WarnAt   int         `json:"warn-at"`
+	Action   QuotaAction `json:"action"`
+}
+
+type quotaUsage struct {
+	PeriodStart  int64              `json:"period-start"`
+	Up           int64              `json:"up"`
+	Down         int64              `json:"down"`
+	Warned       bool               `json:"warned"`
+	Exceeded     bool               `json:"exceeded"`
+	PreviousMode *tunnel.TunnelMode `json:"previous-mode,omitempty"`
+}
+
+type QuotaStatus struct {
+	QuotaParams
+	Used        int64 `json:"used"`
+	Remaining   int64 `json:"remaining"`
+	PeriodStart int64 `json:"period-start"`
+	PeriodEnd   int64 `json:"period-end"`
+	Warned      bool  `json:"warned"`
+	Exceeded    bool  `json:"exceeded"`
+	Active      bool  `json:"active"`
+}
+
+type QuotaEventState string
+
+const (
+	WarningQuotaEvent  QuotaEventState = "warning"
+	ExceededQuotaEvent QuotaEventState = "exceeded"
+	ResetQuotaEvent    QuotaEventState = "reset"
+)
+
+type QuotaEvent struct {
+	State  QuotaEventState `json:"state"`
+	Status QuotaStatus     `json:"status"`
+}
+
+type quotaEntry struct {
+	params QuotaParams
+	usage  quotaUsage
+}
+
+type quotaSnapshot struct {
+	Quotas []QuotaParams          `json:"quotas"`
+	Usage  map[string]*quotaUsage `json:"usage"`
+}
+
+// Quotas adds the sampled traffic of the accounting to each quota and acts once a limit is crossed
+type Quotas struct {
+	mutex    sync.Mutex
+	loaded   bool
+	dirty    bool
+	lastSave time.Time
+	profile  string
+	entries  map[string]*quotaEntry
+}
+
+var quotas = &Quotas{
+	entries: map[string]*quotaEntry{},
+}
+
+func (q *Quotas) path() string {
+	return constant.Path.Resolve(quotaStoreFile)
+}
+
+func quotaPeriod(params *QuotaParams, now time.Time) (time.Time, time.Time) {
+	year, month, day := now.Date()
+	if params.Period == DailyQuotaPeriod {
+		start := time.Date(year, month, day, 0, 0, 0, 0, now.Location())
+		return start, start.AddDate(0, 0, 1)
+	}
+	start := time.Date(year, month, params.ResetDay, 0, 0, 0, 0, now.Location())
+	if day < params.ResetDay {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start, start.AddDate(0, 1, 0)
+}
+
+func (q *Quotas) loadLocked() {
+	if q.loaded {
+		return
+	}
+	q.loaded = true
+	data, err := os.ReadFile(q.path())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnln("[Quota] load error: %v", err)
+		}
+		return
+	}
+	snapshot := &quotaSnapshot{}
+	if err = json.Unmarshal(data, snapshot); err != nil {
+		log.Warnln("[Quota] load error: %v", err)
+		return
+	}
+	for _, params := range snapshot.Quotas {
+		entry := &quotaEntry{params: params}
+		if usage, ok := snapshot.Usage[params.Id]; ok && usage != nil {
+			entry.usage = *usage
+		}
+		q.entries[params.Id] = entry
+	}
+}
+
+func (q *Quotas) saveLocked() {
+	snapshot := &quotaSnapshot{
+		Quotas: make([]QuotaParams, 0, len(q.entries)),
+		Usage:  make(map[string]*quotaUsage, len(q.entries)),
+	}
+	for id, entry := range q.entries {
+		usage := entry.usage
+		snapshot.Quotas = append(snapshot.Quotas, entry.params)
+		snapshot.Usage[id] = &usage
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return
+	}
+	if err = os.WriteFile(q.path(), data, 0644); err != nil {
+		log.Warnln("[Quota] save error: %v", err)
+		return
+	}
+	q.dirty = false
+	q.lastSave = time.Now()
+}
+
+// Save writes the usage to disk, called on shutdown
+func (q *Quotas) Save() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.loaded && q.dirty {
+		q.saveLocked()
+	}
+}
+
+func (q *Quotas) Set(params *QuotaParams) error {
+	if params.Id == "" {
+		return errors.New("quota id is required")
+	}
+	if params.Scope != ProfileQuotaScope && params.Scope != ProxyQuotaScope {
+		return errors.New("invalid quota scope")
+	}
+	if params.Target == "" {
+		return errors.New("quota target is required")
+	}
+	if params.Period == "" {
+		params.Period = MonthlyQuotaPeriod
+	}
+	if params.Period != DailyQuotaPeriod && params.Period != MonthlyQuotaPeriod {
+		return errors.New("invalid quota period")
+	}
+	if params.Limit <= 0 {
+		return errors.New("quota limit must be positive")
+	}
+	if params.ResetDay < 1 || params.ResetDay > 28 {
+		params.ResetDay = 1
+	}
+	if params.WarnAt <= 0 || params.WarnAt > 100 {
+		params.WarnAt = defaultQuotaWarnAt
+	}
+	if params.Action == "" {
+		params.Action = WarnQuotaAction
+	}
+	if params.Action != WarnQuotaAction && params.Action != DirectQuotaAction && params.Action != StopQuotaAction {
+		return errors.New("invalid quota action")
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.loadLocked()
+	entry, ok := q.entries[params.Id]
+	if !ok || entry.params.Scope != params.Scope || entry.params.Target != params.Target || entry.params.Period != params.Period {
+		entry = &quotaEntry{}
+		q.entries[params.Id] = entry
+	}
+	entry.params = *params
+	q.saveLocked()
+	return nil
+}
+
+func (q *Quotas) Remove(id string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.loadLocked()
+	if _, ok := q.entries[id]; !ok {
+		return false
+	}
+	delete(q.entries, id)
+	q.saveLocked()
+	return true
+}
+
+func (q *Quotas) Reset(id string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.loadLocked()
+	entry, ok := q.entries[id]
+	if !ok {
+		return false
+	}
+	q.resetLocked(entry, entry.usage.PeriodStart)
+	q.saveLocked()
+	return true
+}
+
+// SetProfile selects the profile the traffic is counted for, called on every setup
+func (q *Quotas) SetProfile(profile string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.profile = profile
+}
+
+func (q *Quotas) activeLocked(entry *quotaEntry) bool {
+	return entry.params.Scope != ProfileQuotaScope || entry.params.Target == q.profile
+}
+
+// Add counts traffic sampled from a connection with the given chain
+func (q *Quotas) Add(chain []string, up int64, down int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.entries) == 0 {
+		return
+	}
+	for _, entry := range q.entries {
+		if !q.activeLocked(entry) {
+			continue
+		}
+		if entry.params.Scope == ProxyQuotaScope && !containsString(chain, entry.params.Target) {
+			continue
+		}
+		entry.usage.Up += up
+		entry.usage.Down += down
+		q.dirty = true
+	}
+}
+
+func (q *Quotas) statusLocked(entry *quotaEntry, now time.Time) QuotaStatus {
+	_, end := quotaPeriod(&entry.params, now)
+	used := entry.usage.Up + entry.usage.Down
+	remaining := entry.params.Limit - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	return QuotaStatus{
+		QuotaParams: entry.params,
+		Used:        used,
+		Remaining:   remaining,
+		PeriodStart: entry.usage.PeriodStart,
+		PeriodEnd:   end.UnixMilli(),
+		Warned:      entry.usage.Warned,
+		Exceeded:    entry.usage.Exceeded,
+		Active:      q.activeLocked(entry),
+	}
+}
+
+func (q *Quotas) resetLocked(entry *quotaEntry, periodStart int64) {
+	if entry.usage.Exceeded && entry.params.Action == DirectQuotaAction && entry.usage.PreviousMode != nil {
+		go restoreQuotaMode(*entry.usage.PreviousMode)
+	}
+	entry.usage = quotaUsage{PeriodStart: periodStart}
+}
+
+// Check rolls quotas over into a new period and fires the events and actions of crossed thresholds
+func (q *Quotas) Check(now time.Time) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.loadLocked()
+	var events []QuotaEvent
+	for _, entry := range q.entries {
+		start, _ := quotaPeriod(&entry.params, now)
+		if entry.usage.PeriodStart != start.UnixMilli() {
+			notify := entry.usage.PeriodStart != 0 && (entry.usage.Warned || entry.usage.Exceeded)
+			q.resetLocked(entry, start.UnixMilli())
+			q.dirty = true
+			if notify {
+				events = append(events, QuotaEvent{State: ResetQuotaEvent, Status: q.statusLocked(entry, now)})
+			}
+			continue
+		}
+		if !q.activeLocked(entry) {
+			continue
+		}
+		used := entry.usage.Up + entry.usage.Down
+		if !entry.usage.Exceeded && used >= entry.params.Limit {
+			entry.usage.Exceeded = true
+			entry.usage.Warned = true
+			q.dirty = true
+			if entry.params.Action == DirectQuotaAction {
+				mode := tunnel.Mode()
+				entry.usage.PreviousMode = &mode
+			}
+			events = append(events, QuotaEvent{State: ExceededQuotaEvent, Status: q.statusLocked(entry, now)})
+			go enforceQuota(entry.params)
+			continue
+		}
+		if !entry.usage.Warned && used*100 >= entry.params.Limit*int64(entry.params.WarnAt) {
+			entry.usage.Warned = true
+			q.dirty = true
+			events = append(events, QuotaEvent{State: WarningQuotaEvent, Status: q.statusLocked(entry, now)})
+		}
+	}
+	if q.dirty && now.Sub(q.lastSave) >= quotaSaveInterval {
+		q.saveLocked()
+	}
+	for _, event := range events {
+		if event.State == ResetQuotaEvent {
+			log.Infoln("[Quota] %s reset for the new period", event.Status.Id)
+		} else {
+			log.Warnln("[Quota] %s %s: %d/%d bytes", event.Status.Id, event.State, event.Status.Used, event.Status.Limit)
+		}
+		go sendMessage(Message{
+			Type: QuotaMessage,
+			Data: event,
+		})
+	}
+}
+
+func (q *Quotas) Status() []QuotaStatus {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.loadLocked()
+	now := time.Now()
+	list := make([]QuotaStatus, 0, len(q.entries))
+	for _, entry := range q.entries {
+		list = append(list, q.statusLocked(entry, now))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id < list[j].Id
+	})
+	return list
+}
+
+func setQuotaMode(mode tunnel.TunnelMode) {
+	runLock.Lock()
+	defer runLock.Unlock()
+	if currentConfig != nil {
+		currentConfig.General.Mode = mode
+	}
+	tunnel.SetMode(mode)
+	closeConnections()
+}
+
+func restoreQuotaMode(mode tunnel.TunnelMode) {
+	if tunnel.Mode() != tunnel.Direct {
+		return
+	}
+	log.Infoln("[Quota] new period, restore mode %s", mode)
+	setQuotaMode(mode)
+}
+
+func enforceQuota(params QuotaParams) {
+	switch params.Action {
+	case DirectQuotaAction:
+		log.Warnln("[Quota] %s exceeded, switch to direct", params.Id)
+		setQuotaMode(tunnel.Direct)
+	case StopQuotaAction:
+		log.Warnln("[Quota] %s exceeded, stop listeners", params.Id)
+		handleStopListener()
+	}
+}
+
+func handleSetQuota(paramsString string) error {
+	var params = &QuotaParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	return quotas.Set(params)
+}
+
+func handleRemoveQuota(id string) bool {
+	return quotas.Remove(id)
+}
+
+func handleResetQuota(id string) bool {
+	return quotas.Reset(id)
+}
+
+func handleGetQuotaStatus() string {
+	data, err := json.Marshal(quotas.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/tunnel"
+	"github.com/metacubex/mihomo/tunnel/statistic"
+	"golang.org/x/time/rate"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const minRateLimitBurst = 16 * 1024
+
+type RateLimitScope string
+
+const (
+	GlobalRateLimitScope     RateLimitScope = "global"
+	ProxyRateLimitScope      RateLimitScope = "proxy"
+	RuleRateLimitScope       RateLimitScope = "rule"
+	ConnectionRateLimitScope RateLimitScope = "connection"
+)
+
+// RateLimitParams caps a scope in bytes per second, zero leaves a direction unlimited and zero for both removes it.
+// Proxy targets match any name in the chain, rule targets match the rule type or "type,payload".
+type RateLimitParams struct {
+	Scope    RateLimitScope `json:"scope"`
+	Target   string         `json:"target"`
+	Upload   int64          `json:"upload"`
+	Download int64          `json:"download"`
+}
+
+type rateLimit struct {
+	params   RateLimitParams
+	upload   *rate.Limiter
+	download *rate.Limiter
+}
+
+func newRateLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	burst := int(bytesPerSecond)
+	if burst < minRateLimitBurst {
+		burst = minRateLimitBurst
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+}
+
+// RateLimiter keeps shared token buckets, every connection waits on all the buckets that apply to it
+type RateLimiter struct {
+	mutex   sync.RWMutex
+	version atomic.Uint64
+	active  atomic.Bool
+	global  *rateLimit
+	limits  map[RateLimitScope]map[string]*rateLimit
+}
+
+var rateLimiter = &RateLimiter{
+	limits: map[RateLimitScope]map[string]*rateLimit{
+		ProxyRateLimitScope:      {},
+		RuleRateLimitScope:       {},
+		ConnectionRateLimitScope: {},
+	},
+}
+
+func (r *RateLimiter) Set(params *RateLimitParams) error {
+	if params.Scope == "" {
+		params.Scope = GlobalRateLimitScope
+	}
+	if params.Upload < 0 || params.Download < 0 {
+		return errors.New("rate limit must not be negative")
+	}
+	var limit *rateLimit
+	if params.Upload > 0 || params.Download > 0 {
+		limit = &rateLimit{
+			params:   *params,
+			upload:   newRateLimiter(params.Upload),
+			download: newRateLimiter(params.Download),
+		}
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if params.Scope == GlobalRateLimitScope {
+		params.Target = ""
+		r.global = limit
+		r.changed()
+		return nil
+	}
+	limits, ok := r.limits[params.Scope]
+	if !ok {
+		return errors.New("invalid rate limit scope")
+	}
+	if params.Target == "" {
+		return errors.New("rate limit target is required")
+	}
+	if limit == nil {
+		delete(limits, params.Target)
+	} else {
+		limits[params.Target] = limit
+	}
+	r.changed()
+	return nil
+}
+
+func (r *RateLimiter) changed() {
+	active := r.global != nil
+	for _, limits := range r.limits {
+		if len(limits) != 0 {
+			active = true
+		}
+	}
+	r.active.Store(active)
+	r.version.Add(1)
+}
+
+func (r *RateLimiter) List() []RateLimitParams {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	list := make([]RateLimitParams, 0)
+	if r.global != nil {
+		list = append(list, r.global.params)
+	}
+	for _, limits := range r.limits {
+		for _, limit := range limits {
+			list = append(list, limit.params)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Scope != list[j].Scope {
+			return list[i].Scope < list[j].Scope
+		}
+		return list[i].Target < list[j].Target
+	})
+	return list
+}
+
+func (r *RateLimiter) resolve(tracker statistic.Tracker) []*rateLimit {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var limits []*rateLimit
+	if r.global != nil {
+		limits = append(limits, r.global)
+	}
+	if tracker == nil {
+		return limits
+	}
+	info := tracker.Info()
+	if limit, ok := r.limits[ConnectionRateLimitScope][tracker.ID()]; ok {
+		limits = append(limits, limit)
+	}
+	for _, proxy := range info.Chain {
+		if limit, ok := r.limits[ProxyRateLimitScope][proxy]; ok {
+			limits = append(limits, limit)
+		}
+	}
+	if limit, ok := r.limits[RuleRateLimitScope][info.Rule]; ok {
+		limits = append(limits, limit)
+	}
+	if limit, ok := r.limits[RuleRateLimitScope][info.Rule+","+info.RulePayload]; ok {
+		limits = append(limits, limit)
+	}
+	return limits
+}
+
+// rateLimitConn shapes the inbound side of a tcp connection, reads are uploads and writes are downloads
+type rateLimitConn struct {
+	net.Conn
+	metadata *constant.Metadata
+	mutex    sync.Mutex
+	version  uint64
+	tracker  statistic.Tracker
+	limits   []*rateLimit
+}
+
+// current resolves the buckets again when the limits change, the tracker is found once the tunnel has dialed
+func (c *rateLimitConn) current() []*rateLimit {
+	if !rateLimiter.active.Load() {
+		return nil
+	}
+	version := rateLimiter.version.Load()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.version == version && c.tracker != nil {
+		return c.limits
+	}
+	if c.tracker == nil {
+		statistic.DefaultManager.Range(func(t statistic.Tracker) bool {
+			if t.Info().Metadata == c.metadata {
+				c.tracker = t
+				return false
+			}
+			return true
+		})
+	}
+	c.version = version
+	c.limits = rateLimiter.resolve(c.tracker)
+	return c.limits
+}
+
+func waitRateLimits(limits []*rateLimit, download bool, n int) {
+	for _, limit := range limits {
+		limiter := limit.upload
+		if download {
+			limiter = limit.download
+		}
+		if limiter != nil {
+			_ = limiter.WaitN(context.Background(), n)
+		}
+	}
+}
+
+func maxRateLimitChunk(limits []*rateLimit, download bool, n int) int {
+	for _, limit := range limits {
+		limiter := limit.upload
+		if download {
+			limiter = limit.download
+		}
+		if limiter != nil && limiter.Burst() < n {
+			n = limiter.Burst()
+		}
+	}
+	return n
+}
+
+func (c *rateLimitConn) Read(b []byte) (int, error) {
+	limits := c.current()
+	if len(limits) == 0 {
+		return c.Conn.Read(b)
+	}
+	n, err := c.Conn.Read(b[:maxRateLimitChunk(limits, false, len(b))])
+	if n > 0 {
+		waitRateLimits(limits, false, n)
+	}
+	return n, err
+}
+
+func (c *rateLimitConn) Write(b []byte) (int, error) {
+	limits := c.current()
+	if len(limits) == 0 {
+		return c.Conn.Write(b)
+	}
+	written := 0
+	for written < len(b) {
+		chunk := maxRateLimitChunk(limits, true, len(b)-written)
+		waitRateLimits(limits, true, chunk)
+		n, err := c.Conn.Write(b[written : written+chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (c *rateLimitConn) Upstream() any {
+	return c.Conn
+}
+
+// ReaderReplaceable lets the relay read the inbound socket itself, so an unshaped connection is
+// spliced on linux, a limit set later does not reach the connections already relayed this way
+func (c *rateLimitConn) ReaderReplaceable() bool {
+	return len(c.current()) == 0
+}
+
+func (c *rateLimitConn) WriterReplaceable() bool {
+	return len(c.current()) == 0
+}
+
+func (r *RateLimiter) globalLimit() *rateLimit {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.global
+}
+
+// rateLimitPacket polices udp replies of a session started while a global limit was set
+type rateLimitPacket struct {
+	constant.UDPPacket
+	limit *rateLimit
+}
+
+func (p *rateLimitPacket) WriteBack(b []byte, addr net.Addr) (int, error) {
+	if p.limit.download != nil && !p.limit.download.AllowN(time.Now(), len(b)) {
+		return len(b), nil
+	}
+	return p.UDPPacket.WriteBack(b, addr)
+}
+
+// rateLimitTunnel shapes tcp with every scope, udp has no tracker to match so only the global limit polices it
+type rateLimitTunnel struct {
+	constant.Tunnel
+}
+
+var limitedTunnel constant.Tunnel = &rateLimitTunnel{Tunnel: tunnel.Tunnel}
+
+func (t *rateLimitTunnel) HandleTCPConn(conn net.Conn, metadata *constant.Metadata) {
+	t.Tunnel.HandleTCPConn(&rateLimitConn{Conn: conn, metadata: metadata}, metadata)
+}
+
+func (t *rateLimitTunnel) HandleUDPPacket(packet constant.UDPPacket, metadata *constant.Metadata) {
+	limit := rateLimiter.globalLimit()
+	if limit == nil {
+		t.Tunnel.HandleUDPPacket(packet, metadata)
+		return
+	}
+	if limit.upload != nil && !limit.upload.AllowN(time.Now(), len(packet.Data())) {
+		packet.Drop()
+		return
+	}
+	t.Tunnel.HandleUDPPacket(&rateLimitPacket{UDPPacket: packet, limit: limit}, metadata)
+}
+
+func handleSetRateLimit(paramsString string) error {
+	var params = &RateLimitParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	return rateLimiter.Set(params)
+}
+
+func handleGetRateLimits() string {
+	data, err := json.Marshal(rateLimiter.List())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
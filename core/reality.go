@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/config"
+	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	realityOptsKey     = "reality-opts"
+	realitySpiderXKey  = "spider-x"
+	realityFingerprint = "chrome"
+	realityLogInterval = 30 * time.Second
+)
+
+// realityNetworks are the vless transports mihomo runs REALITY on
+var realityNetworks = []string{"tcp", "grpc"}
+
+type RealityStatus struct {
+	Server     string `json:"server"`
+	ServerName string `json:"server-name"`
+	ShortId    string `json:"short-id"`
+	SpiderX    string `json:"spider-x,omitempty"`
+	Failures   int64  `json:"failures"`
+	Error      string `json:"error,omitempty"`
+	Diagnosis  string `json:"diagnosis,omitempty"`
+}
+
+type realityState struct {
+	mutex  sync.Mutex
+	status RealityStatus
+	logged time.Time
+}
+
+// validateRealityHints checks the reality-opts of a vless proxy, mihomo only reports a bad key and
+// ignores the options entirely when the handshake would not use uTLS
+func validateRealityHints(mapping map[string]any) []ProxyError {
+	options, ok := mapping[realityOptsKey].(map[string]any)
+	if !ok {
+		return nil
+	}
+	var errs []ProxyError
+	text := func(value any) string {
+		if value == nil {
+			return ""
+		}
+		return strings.TrimSpace(fmt.Sprint(value))
+	}
+	publicKey := text(options["public-key"])
+	if publicKey == "" {
+		errs = append(errs, ProxyError{Field: "reality-opts.public-key", Message: "public-key is required"})
+	} else if key, err := base64.RawURLEncoding.DecodeString(publicKey); err != nil || len(key) != 32 {
+		errs = append(errs, ProxyError{Field: "reality-opts.public-key", Message: "public-key must be a base64url x25519 key of 32 bytes"})
+	}
+	if shortId := text(options["short-id"]); shortId != "" {
+		if _, err := hex.DecodeString(shortId); err != nil || len(shortId) > 16 {
+			errs = append(errs, ProxyError{Field: "reality-opts.short-id", Message: fmt.Sprintf("invalid short-id %q, expected up to 16 hex digits in pairs", shortId)})
+		}
+	}
+	if spiderX := text(options[realitySpiderXKey]); spiderX != "" && !strings.HasPrefix(spiderX, "/") {
+		errs = append(errs, ProxyError{Field: "reality-opts.spider-x", Message: fmt.Sprintf("invalid spider-x %q, expected a path starting with /", spiderX)})
+	}
+	if enabled, _ := mapping["tls"].(bool); !enabled {
+		errs = append(errs, ProxyError{Field: "tls", Message: "REALITY requires tls: true"})
+	}
+	if text(mapping["servername"]) == "" {
+		errs = append(errs, ProxyError{Field: "servername", Message: "REALITY requires the servername of the site the server borrows"})
+	}
+	if network := text(mapping["network"]); network != "" && !containsString(realityNetworks, network) {
+		errs = append(errs, ProxyError{Field: "network", Message: fmt.Sprintf("REALITY does not run over %s, expected one of %s", network, strings.Join(realityNetworks, ", "))})
+	}
+	if text(mapping[clientFingerprintKey]) == "none" {
+		errs = append(errs, ProxyError{Field: clientFingerprintKey, Message: "REALITY needs a uTLS client fingerprint"})
+	}
+	return errs
+}
+
+// realityDiagnosis explains a failed REALITY handshake in terms of the settings to check
+func realityDiagnosis(err error) string {
+	message := err.Error()
+	var netErr net.Error
+	switch {
+	case strings.Contains(message, "REALITY authentication failed"):
+		return "the server answered as the borrowed site, check public-key and short-id or whether the server runs REALITY for this servername"
+	case strings.Contains(message, "REALITY public key"), strings.Contains(message, "REALITY short"):
+		return "the reality-opts of the profile are malformed"
+	case strings.Contains(message, "nil ecdheKey"), strings.Contains(message, "nil keyShareKeys"):
+		return "the client fingerprint offers no x25519 key share, use a chrome or firefox fingerprint"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "the handshake timed out, the server may be unreachable or the servername filtered"
+	case strings.Contains(message, "connection reset"), strings.Contains(message, "EOF"):
+		return "the connection was reset during the handshake, the servername may be blocked on this network"
+	case strings.Contains(message, "connection refused"):
+		return "the server refused the connection, check server and port"
+	case strings.Contains(message, "tls:"):
+		return "the tls handshake failed, check servername and client-fingerprint"
+	default:
+		return ""
+	}
+}
+
+// Reality keeps the REALITY outbounds of the profile and the last handshake failure of each
+type Reality struct {
+	mutex  sync.Mutex
+	states map[string]*realityState
+}
+
+var reality = &Reality{states: map[string]*realityState{}}
+
+// Prepare gives REALITY outbounds without a client fingerprint the chrome one, mihomo skips
+// REALITY for a plain tls handshake, spider-x is kept for the status only since the crawl mihomo
+// runs after a failed authentication always requests the root of the borrowed site
+func (r *Reality) Prepare(rawConfig *config.RawConfig) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.states = map[string]*realityState{}
+	for _, mapping := range rawConfig.Proxy {
+		name, _ := mapping["name"].(string)
+		proxyType, _ := mapping["type"].(string)
+		options, ok := mapping[realityOptsKey].(map[string]any)
+		if !ok || proxyType != "vless" || name == "" {
+			continue
+		}
+		spiderX, _ := options[realitySpiderXKey].(string)
+		delete(options, realitySpiderXKey)
+		if fingerprint, _ := mapping[clientFingerprintKey].(string); fingerprint == "" {
+			mapping[clientFingerprintKey] = realityFingerprint
+		}
+		server, _ := mapping["server"].(string)
+		serverName, _ := mapping["servername"].(string)
+		shortId, _ := options["short-id"].(string)
+		r.states[name] = &realityState{status: RealityStatus{
+			Server:     net.JoinHostPort(server, fmt.Sprint(mapping["port"])),
+			ServerName: serverName,
+			ShortId:    shortId,
+			SpiderX:    spiderX,
+		}}
+	}
+}
+
+func (r *Reality) wrap(name string, proxy C.ProxyAdapter) C.ProxyAdapter {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	state, ok := r.states[name]
+	if !ok {
+		return proxy
+	}
+	return &realityAdapter{ProxyAdapter: proxy, state: state}
+}
+
+func (r *Reality) Status() map[string]RealityStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	status := map[string]RealityStatus{}
+	for name, state := range r.states {
+		state.mutex.Lock()
+		status[name] = state.status
+		state.mutex.Unlock()
+	}
+	return status
+}
+
+type realityAdapter struct {
+	C.ProxyAdapter
+	state *realityState
+}
+
+func (a *realityAdapter) Inner() C.ProxyAdapter {
+	return a.ProxyAdapter
+}
+
+// observe records a failed handshake and writes it to the log, at most once per interval so a
+// broken server does not flood the log stream
+func (a *realityAdapter) observe(err error) {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	diagnosis := realityDiagnosis(err)
+	a.state.mutex.Lock()
+	defer a.state.mutex.Unlock()
+	a.state.status.Failures++
+	a.state.status.Error = err.Error()
+	a.state.status.Diagnosis = diagnosis
+	if time.Since(a.state.logged) < realityLogInterval {
+		return
+	}
+	a.state.logged = time.Now()
+	if diagnosis == "" {
+		log.Errorln("[REALITY] %s connection to %s as %s failed: %v", a.Name(), a.state.status.Server, a.state.status.ServerName, err)
+		return
+	}
+	log.Errorln("[REALITY] %s connection to %s as %s failed, %s: %v", a.Name(), a.state.status.Server, a.state.status.ServerName, diagnosis, err)
+}
+
+func (a *realityAdapter) DialContext(ctx context.Context, metadata *C.Metadata) (C.Conn, error) {
+	conn, err := a.ProxyAdapter.DialContext(ctx, metadata)
+	a.observe(err)
+	return conn, err
+}
+
+func (a *realityAdapter) DialContextWithDialer(ctx context.Context, dialer C.Dialer, metadata *C.Metadata) (C.Conn, error) {
+	conn, err := a.ProxyAdapter.DialContextWithDialer(ctx, dialer, metadata)
+	a.observe(err)
+	return conn, err
+}
+
+func (a *realityAdapter) ListenPacketContext(ctx context.Context, metadata *C.Metadata) (C.PacketConn, error) {
+	conn, err := a.ProxyAdapter.ListenPacketContext(ctx, metadata)
+	a.observe(err)
+	return conn, err
+}
+
+func (a *realityAdapter) ListenPacketWithDialer(ctx context.Context, dialer C.Dialer, metadata *C.Metadata) (C.PacketConn, error) {
+	conn, err := a.ProxyAdapter.ListenPacketWithDialer(ctx, dialer, metadata)
+	a.observe(err)
+	return conn, err
+}
+
+func handleGetRealityStatus() string {
+	data, err := json.Marshal(reality.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
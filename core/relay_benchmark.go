@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	N "github.com/metacubex/mihomo/common/net"
+	"github.com/metacubex/mihomo/constant"
+	"io"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultRelayBenchmarkDuration = 3 * time.Second
+	maxRelayBenchmarkDuration     = 30 * time.Second
+	relayBenchmarkChunk           = 32 * 1024
+)
+
+type RelayBenchmarkParams struct {
+	Duration int64 `json:"duration"`
+}
+
+type RelayRun struct {
+	Bytes       int64   `json:"bytes"`
+	Duration    int64   `json:"duration"`
+	BytesPerSec float64 `json:"bytes-per-sec"`
+}
+
+// RelayBenchmark compares the loopback relay of bare sockets with the one of sockets wrapped the
+// way the tunnel wraps inbound connections, close numbers mean the wrappers keep the direct path
+type RelayBenchmark struct {
+	Platform string    `json:"platform"`
+	Splice   bool      `json:"splice"`
+	Direct   *RelayRun `json:"direct"`
+	Wrapped  *RelayRun `json:"wrapped"`
+}
+
+// relayLoop is a relay between two loopback connections, what is written to client ends in a sink
+type relayLoop struct {
+	client   net.Conn
+	sink     net.Listener
+	front    net.Listener
+	received atomic.Int64
+	done     chan struct{}
+}
+
+func startRelay(wrap func(net.Conn) net.Conn) (*relayLoop, error) {
+	sink, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	front, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		_ = sink.Close()
+		return nil, err
+	}
+	loop := &relayLoop{sink: sink, front: front, done: make(chan struct{})}
+	go func() {
+		defer close(loop.done)
+		conn, err := sink.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		n, _ := io.Copy(io.Discard, conn)
+		loop.received.Store(n)
+	}()
+	go func() {
+		inbound, err := front.Accept()
+		if err != nil {
+			return
+		}
+		outbound, err := net.Dial("tcp", sink.Addr().String())
+		if err != nil {
+			_ = inbound.Close()
+			return
+		}
+		N.Relay(wrap(inbound), outbound)
+	}()
+
+	if loop.client, err = net.Dial("tcp", front.Addr().String()); err != nil {
+		loop.closeListeners()
+		return nil, err
+	}
+	return loop, nil
+}
+
+func (l *relayLoop) closeListeners() {
+	_ = l.sink.Close()
+	_ = l.front.Close()
+}
+
+// finish closes the client and waits until the sink has everything, it returns the bytes received
+func (l *relayLoop) finish(ctx context.Context) (int64, error) {
+	defer l.closeListeners()
+	_ = l.client.Close()
+	select {
+	case <-l.done:
+		return l.received.Load(), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// runRelay pushes zeros through a relay between two loopback connections until the duration ends
+func runRelay(ctx context.Context, duration time.Duration, wrap func(net.Conn) net.Conn) (*RelayRun, error) {
+	loop, err := startRelay(wrap)
+	if err != nil {
+		return nil, err
+	}
+	chunk := bufferPool.Get(relayBenchmarkChunk)
+	defer bufferPool.Put(chunk)
+	start := time.Now()
+	deadline := start.Add(duration)
+	_ = loop.client.SetWriteDeadline(deadline)
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		if _, err = loop.client.Write(chunk); err != nil {
+			break
+		}
+	}
+	received, err := loop.finish(ctx)
+	if err != nil {
+		return nil, err
+	}
+	elapsed := time.Since(start)
+	return &RelayRun{
+		Bytes:       received,
+		Duration:    elapsed.Milliseconds(),
+		BytesPerSec: float64(received) / elapsed.Seconds(),
+	}, nil
+}
+
+func directRelayConn(conn net.Conn) net.Conn {
+	return conn
+}
+
+// wrappedRelayConn wraps conn the way the tunnel wraps inbound connections
+func wrappedRelayConn(conn net.Conn) net.Conn {
+	return &rateLimitConn{Conn: newHttpRewriteConn(conn, &httpRewriteSet{}), metadata: &constant.Metadata{}}
+}
+
+func runRelayBenchmark(ctx context.Context, duration time.Duration) (*RelayBenchmark, error) {
+	benchmark := &RelayBenchmark{
+		Platform: runtime.GOOS,
+		Splice:   runtime.GOOS == "linux" || runtime.GOOS == "android",
+	}
+	var err error
+	benchmark.Direct, err = runRelay(ctx, duration/2, directRelayConn)
+	if err != nil {
+		return nil, err
+	}
+	benchmark.Wrapped, err = runRelay(ctx, duration/2, wrappedRelayConn)
+	if err != nil {
+		return nil, err
+	}
+	return benchmark, nil
+}
+
+func handleBenchmarkRelay(paramsString string, fn func(string, error)) {
+	go func() {
+		var params = &RelayBenchmarkParams{}
+		if paramsString != "" {
+			if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+				fn("", err)
+				return
+			}
+		}
+		duration := time.Duration(params.Duration) * time.Millisecond
+		if duration <= 0 {
+			duration = defaultRelayBenchmarkDuration
+		}
+		if duration > maxRelayBenchmarkDuration {
+			duration = maxRelayBenchmarkDuration
+		}
+		benchmark, err := runRelayBenchmark(context.Background(), duration)
+		if err != nil {
+			fn("", err)
+			return
+		}
+		data, err := json.Marshal(benchmark)
+		if err != nil {
+			fn("", err)
+			return
+		}
+		fn(string(data), nil)
+	}()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+var relayWrappers = []struct {
+	name string
+	wrap func(net.Conn) net.Conn
+}{
+	{"direct", directRelayConn},
+	{"wrapped", wrappedRelayConn},
+}
+
+func TestRelayDeliversEverything(t *testing.T) {
+	for _, relay := range relayWrappers {
+		loop, err := startRelay(relay.wrap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunk := make([]byte, relayBenchmarkChunk)
+		const chunks = 64
+		for i := 0; i < chunks; i++ {
+			if _, err := loop.client.Write(chunk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		received, err := loop.finish(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("%s: %v", relay.name, err)
+		}
+		if received != chunks*relayBenchmarkChunk {
+			t.Fatalf("%s: received %d bytes, want %d", relay.name, received, chunks*relayBenchmarkChunk)
+		}
+	}
+}
+
+func TestRunRelayBenchmark(t *testing.T) {
+	benchmark, err := runRelayBenchmark(context.Background(), 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if benchmark.Direct.Bytes == 0 || benchmark.Wrapped.Bytes == 0 {
+		t.Fatalf("relay moved nothing, direct %d wrapped %d", benchmark.Direct.Bytes, benchmark.Wrapped.Bytes)
+	}
+}
+
+// BenchmarkRelay compares bare and wrapped inbound connections, the wrapped one should stay close
+// when the wrappers keep the direct path
+func BenchmarkRelay(b *testing.B) {
+	for _, relay := range relayWrappers {
+		b.Run(relay.name, func(b *testing.B) {
+			loop, err := startRelay(relay.wrap)
+			if err != nil {
+				b.Fatal(err)
+			}
+			chunk := make([]byte, relayBenchmarkChunk)
+			b.SetBytes(relayBenchmarkChunk)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := loop.client.Write(chunk); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if _, err := loop.finish(context.Background()); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
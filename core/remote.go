@@ -0,0 +1,1040 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	remoteDir            = "remote"
+	remoteIdentityFile   = "identity.pem"
+	remotePeersFile      = "peers.json"
+	remoteScheme         = "flclash-remote"
+	defaultRemoteAddress = "0.0.0.0:7896"
+	remotePairingTTL     = 5 * time.Minute
+	maxPairingAttempts   = 5
+	remoteInvokeTimeout  = 30 * time.Second
+	remoteEventBuffer    = 256
+	maxRemoteEventSize   = 4 * 1024 * 1024
+	maxRemoteInvokeSize  = 1024 * 1024
+	remoteIdentityTTL    = 10 * 365 * 24 * time.Hour
+)
+
+type RemoteRole string
+
+const (
+	// ControllerRemoteRole is a peer that controls this core
+	ControllerRemoteRole RemoteRole = "controller"
+	// HostRemoteRole is a peer this core controls
+	HostRemoteRole RemoteRole = "host"
+)
+
+// RemotePeer is pinned by the sha256 of its certificate, the certificates are self signed and the
+// fingerprint traded through the qr code is the only trust there is
+type RemotePeer struct {
+	Fingerprint string     `json:"fingerprint"`
+	Name        string     `json:"name"`
+	Role        RemoteRole `json:"role"`
+	Address     string     `json:"address,omitempty"`
+	ReadOnly    bool       `json:"read-only"`
+	Paired      int64      `json:"paired"`
+	LastSeen    int64      `json:"last-seen,omitempty"`
+}
+
+type RemoteHostParams struct {
+	Enable  bool   `json:"enable"`
+	Address string `json:"address"`
+	Name    string `json:"name"`
+}
+
+type RemotePairingParams struct {
+	// Host is put in the code instead of the first lan address
+	Host     string `json:"host"`
+	ReadOnly bool   `json:"read-only"`
+}
+
+type RemotePairing struct {
+	Uri     string `json:"uri"`
+	Expires int64  `json:"expires"`
+}
+
+type RemotePairParams struct {
+	Uri  string `json:"uri"`
+	Name string `json:"name"`
+}
+
+type RemoteInvokeParams struct {
+	Peer   string `json:"peer"`
+	Method Method `json:"method"`
+	Data   any    `json:"data"`
+}
+
+type RemoteRemoveParams struct {
+	Fingerprint string     `json:"fingerprint"`
+	Role        RemoteRole `json:"role"`
+}
+
+// RemoteEvent carries a message of a watched host, Message is the message as the host sent it
+type RemoteEvent struct {
+	Peer    string          `json:"peer"`
+	Message json.RawMessage `json:"message,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+type RemoteStatus struct {
+	RemoteHostParams
+	Running     bool          `json:"running"`
+	Listening   string        `json:"listening,omitempty"`
+	Fingerprint string        `json:"fingerprint"`
+	Pairing     bool          `json:"pairing"`
+	Peers       []*RemotePeer `json:"peers"`
+	Watching    []string      `json:"watching"`
+	Error       string        `json:"error,omitempty"`
+}
+
+type remotePairingState struct {
+	code     string
+	readOnly bool
+	expires  time.Time
+	attempts int
+}
+
+type remotePairRequest struct {
+	Name  string `json:"name"`
+	Proof string `json:"proof"`
+}
+
+type remotePairResponse struct {
+	Name string `json:"name"`
+}
+
+// Remote pairs this core with the cores of other devices, a host serves its actions and messages
+// over mutual tls to the controllers it paired with
+type Remote struct {
+	mutex       sync.Mutex
+	params      RemoteHostParams
+	identity    *tls.Certificate
+	fingerprint string
+	peers       []*RemotePeer
+	loaded      bool
+	server      *http.Server
+	listener    net.Listener
+	pairing     *remotePairingState
+	err         error
+	subscribers map[chan []byte]RemotePeer
+	subsMutex   sync.RWMutex
+	watches     map[string]context.CancelFunc
+}
+
+var remote = &Remote{
+	subscribers: map[chan []byte]RemotePeer{},
+	watches:     map[string]context.CancelFunc{},
+}
+
+func remotePath(name string) string {
+	return filepath.Join(constant.Path.Resolve(remoteDir), name)
+}
+
+func certificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+func pairingProof(code string, host string, controller string) string {
+	mac := hmac.New(sha256.New, []byte(code))
+	mac.Write([]byte(host + "|" + controller))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func defaultRemoteName() string {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return "FlClash"
+	}
+	return name
+}
+
+// identityLocked loads the key pair of this core or makes one, both roles use the same one
+func (r *Remote) identityLocked() (*tls.Certificate, error) {
+	if r.identity != nil {
+		return r.identity, nil
+	}
+	path := remotePath(remoteIdentityFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if data, err = newRemoteIdentity(); err != nil {
+			return nil, err
+		}
+		if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		if err = os.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+	}
+	certificate, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	r.identity = &certificate
+	r.fingerprint = certificateFingerprint(certificate.Certificate[0])
+	return r.identity, nil
+}
+
+func newRemoteIdentity() ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "FlClash remote"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(remoteIdentityTTL),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return append(data, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})...), nil
+}
+
+func (r *Remote) loadPeersLocked() {
+	if r.loaded {
+		return
+	}
+	r.loaded = true
+	data, err := os.ReadFile(remotePath(remotePeersFile))
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &r.peers); err != nil {
+		log.Warnln("[Remote] load peers error: %v", err)
+	}
+}
+
+func (r *Remote) savePeersLocked() {
+	data, err := json.Marshal(r.peers)
+	if err != nil {
+		return
+	}
+	path := remotePath(remotePeersFile)
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err == nil {
+		err = os.WriteFile(path, data, 0600)
+	}
+	if err != nil {
+		log.Warnln("[Remote] save peers error: %v", err)
+	}
+}
+
+func (r *Remote) peerLocked(fingerprint string, role RemoteRole) *RemotePeer {
+	r.loadPeersLocked()
+	for _, peer := range r.peers {
+		if peer.Fingerprint == fingerprint && peer.Role == role {
+			return peer
+		}
+	}
+	return nil
+}
+
+func (r *Remote) putPeerLocked(peer *RemotePeer) {
+	if previous := r.peerLocked(peer.Fingerprint, peer.Role); previous != nil {
+		*previous = *peer
+	} else {
+		r.peers = append(r.peers, peer)
+	}
+	r.savePeersLocked()
+}
+
+func (r *Remote) Set(params *RemoteHostParams) error {
+	if params.Address == "" {
+		params.Address = defaultRemoteAddress
+	}
+	if _, _, err := net.SplitHostPort(params.Address); err != nil {
+		return err
+	}
+	if params.Name == "" {
+		params.Name = defaultRemoteName()
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.stopLocked()
+	r.params = *params
+	r.err = nil
+	return r.syncListenerLocked()
+}
+
+func (r *Remote) hasControllersLocked() bool {
+	r.loadPeersLocked()
+	for _, peer := range r.peers {
+		if peer.Role == ControllerRemoteRole {
+			return true
+		}
+	}
+	return false
+}
+
+// syncListenerLocked listens only while there is a controller to serve or a pairing to take, an
+// enabled host nobody paired with keeps the port closed
+func (r *Remote) syncListenerLocked() error {
+	pairing := r.pairing != nil && time.Now().Before(r.pairing.expires)
+	want := r.params.Enable && (pairing || r.hasControllersLocked())
+	running := r.server != nil
+	if want && !running {
+		if err := r.startLocked(); err != nil {
+			r.err = err
+			return err
+		}
+		r.err = nil
+	}
+	if !want {
+		r.closeServerLocked()
+	}
+	if want != running {
+		// the port is part of what the discovery advertises
+		go discovery.Announce()
+	}
+	return nil
+}
+
+// expirePairing closes the port once an unused pairing ran out
+func (r *Remote) expirePairing() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.pairing != nil && !time.Now().Before(r.pairing.expires) {
+		r.pairing = nil
+	}
+	_ = r.syncListenerLocked()
+}
+
+func (r *Remote) startLocked() error {
+	identity, err := r.identityLocked()
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", r.params.Address)
+	if err != nil {
+		return err
+	}
+	listener = tls.NewListener(listener, &tls.Config{
+		Certificates: []tls.Certificate{*identity},
+		ClientAuth:   tls.RequireAnyClientCert,
+		MinVersion:   tls.VersionTLS13,
+	})
+	server := &http.Server{Handler: r.router(), ReadHeaderTimeout: 10 * time.Second}
+	r.server = server
+	r.listener = listener
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Warnln("[Remote] serve error: %v", err)
+		}
+	}()
+	log.Infoln("[Remote] listening at %s", listener.Addr().String())
+	return nil
+}
+
+func (r *Remote) stopLocked() {
+	r.pairing = nil
+	r.closeServerLocked()
+}
+
+func (r *Remote) closeServerLocked() {
+	if r.server == nil {
+		return
+	}
+	_ = r.server.Close()
+	r.server = nil
+	r.listener = nil
+}
+
+func (r *Remote) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.stopLocked()
+	for peer, cancel := range r.watches {
+		cancel()
+		delete(r.watches, peer)
+	}
+}
+
+func clientFingerprint(request *http.Request) string {
+	if request.TLS == nil || len(request.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return certificateFingerprint(request.TLS.PeerCertificates[0].Raw)
+}
+
+func (r *Remote) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		fingerprint := clientFingerprint(request)
+		r.mutex.Lock()
+		peer := r.peerLocked(fingerprint, ControllerRemoteRole)
+		if peer != nil {
+			peer.LastSeen = time.Now().UnixMilli()
+		}
+		r.mutex.Unlock()
+		if peer == nil {
+			http.Error(w, "not paired", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, request.WithContext(context.WithValue(request.Context(), remotePeerKey{}, *peer)))
+	})
+}
+
+type remotePeerKey struct{}
+
+func (r *Remote) router() http.Handler {
+	router := chi.NewRouter()
+	router.Post("/pair", r.handlePair)
+	router.Group(func(router chi.Router) {
+		router.Use(r.authorize)
+		router.Post("/invoke", r.handleInvoke)
+		router.Get("/events", r.handleEvents)
+	})
+	return router
+}
+
+func (r *Remote) handlePair(w http.ResponseWriter, request *http.Request) {
+	fingerprint := clientFingerprint(request)
+	body := &remotePairRequest{}
+	if err := json.NewDecoder(io.LimitReader(request.Body, 4096)).Decode(body); err != nil || fingerprint == "" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	r.mutex.Lock()
+	pairing := r.pairing
+	if pairing == nil || time.Now().After(pairing.expires) {
+		r.pairing = nil
+		r.mutex.Unlock()
+		http.Error(w, "no pairing in progress", http.StatusForbidden)
+		return
+	}
+	expected := pairingProof(pairing.code, r.fingerprint, fingerprint)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(body.Proof)) != 1 {
+		pairing.attempts++
+		if pairing.attempts >= maxPairingAttempts {
+			r.pairing = nil
+		}
+		r.mutex.Unlock()
+		log.Warnln("[Remote] pairing refused from %s", request.RemoteAddr)
+		http.Error(w, "wrong code", http.StatusForbidden)
+		return
+	}
+	r.pairing = nil
+	name := body.Name
+	if name == "" {
+		name = "controller"
+	}
+	peer := &RemotePeer{
+		Fingerprint: fingerprint,
+		Name:        name,
+		Role:        ControllerRemoteRole,
+		ReadOnly:    pairing.readOnly,
+		Paired:      time.Now().UnixMilli(),
+	}
+	r.putPeerLocked(peer)
+	hostName := r.params.Name
+	r.mutex.Unlock()
+	log.Infoln("[Remote] paired with %s", name)
+	go sendMessage(Message{
+		Type: RemotePairedMessage,
+		Data: peer,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(&remotePairResponse{Name: hostName})
+}
+
+// remoteReadMethods let a read only peer look at the proxies and the traffic, nothing of them hands
+// out a credential of the profiles
+var remoteReadMethods = map[Method]struct{}{
+	getProxiesMethod:            {},
+	getExternalProvidersMethod:  {},
+	getExternalProviderMethod:   {},
+	getProvidersHealthMethod:    {},
+	getSubscriptionUsageMethod:  {},
+	getCurrentProfileNameMethod: {},
+	getRoutingModeMethod:        {},
+	getRunTimeMethod:            {},
+	getMemoryMethod:             {},
+	getTrafficMethod:            {},
+	getTotalTrafficMethod:       {},
+	getTrafficHistoryMethod:     {},
+	getConnectionsMethod:        {},
+}
+
+// remoteReadMessages are what a read only peer sees of the stream, the same the read methods hand
+// out, the logs, the requests and the connections name the hosts and apps of the device
+var remoteReadMessages = map[MessageType]struct{}{
+	DelayMessage:             {},
+	DelayBatchMessage:        {},
+	LoadedMessage:            {},
+	ProxyChangedMessage:      {},
+	SubscriptionAlertMessage: {},
+}
+
+// remoteControlMethods are added for a peer paired for control, it selects proxies and updates the
+// profiles but never reaches the files, the processes or the service of the host
+var remoteControlMethods = map[Method]struct{}{
+	changeProxyMethod:            {},
+	asyncTestDelayMethod:         {},
+	testDelayBatchMethod:         {},
+	cancelDelayBatchMethod:       {},
+	updateProfileMethod:          {},
+	updateExternalProviderMethod: {},
+	forceUpdateProviderMethod:    {},
+}
+
+// remoteAllowed keeps the pairing to the owner of the device, a read only peer may only look
+func remoteAllowed(method Method, readOnly bool) bool {
+	if _, ok := remoteReadMethods[method]; ok {
+		return true
+	}
+	_, ok := remoteControlMethods[method]
+	return ok && !readOnly
+}
+
+func (r *Remote) handleInvoke(w http.ResponseWriter, request *http.Request) {
+	peer := request.Context().Value(remotePeerKey{}).(RemotePeer)
+	action := &Action{}
+	body := http.MaxBytesReader(w, request.Body, maxRemoteInvokeSize)
+	if err := json.NewDecoder(body).Decode(action); err != nil || action.Method == "" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if !remoteAllowed(action.Method, peer.ReadOnly) {
+		http.Error(w, fmt.Sprintf("%s is not allowed", action.Method), http.StatusForbidden)
+		return
+	}
+	reply := make(chan ActionResult, 1)
+	go handleAction(action, ActionResult{
+		Id:     action.Id,
+		Method: action.Method,
+		reply:  reply,
+	})
+	ctx, cancel := context.WithTimeout(request.Context(), remoteInvokeTimeout)
+	defer cancel()
+	select {
+	case result := <-reply:
+		data, err := result.Json()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	case <-ctx.Done():
+		http.Error(w, ctx.Err().Error(), http.StatusGatewayTimeout)
+	}
+}
+
+// handleEvents streams the messages of the core as json lines until the peer goes away or is removed
+func (r *Remote) handleEvents(w http.ResponseWriter, request *http.Request) {
+	peer := request.Context().Value(remotePeerKey{}).(RemotePeer)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch := make(chan []byte, remoteEventBuffer)
+	r.subsMutex.Lock()
+	r.subscribers[ch] = peer
+	r.subsMutex.Unlock()
+	defer func() {
+		r.subsMutex.Lock()
+		delete(r.subscribers, ch)
+		r.subsMutex.Unlock()
+	}()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case data, ok := <-ch:
+			if !ok {
+				return
+			}
+			if _, err := w.Write(append(data, '\n')); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-request.Context().Done():
+			return
+		}
+	}
+}
+
+// Publish fans a message out to the watching controllers, a slow one drops messages
+func (r *Remote) Publish(message Message) {
+	r.subsMutex.RLock()
+	defer r.subsMutex.RUnlock()
+	if len(r.subscribers) == 0 || message.Type == RemoteEventMessage {
+		return
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	_, readable := remoteReadMessages[message.Type]
+	for ch, peer := range r.subscribers {
+		if peer.ReadOnly && !readable {
+			continue
+		}
+		select {
+		case ch <- data:
+		default:
+		}
+	}
+}
+
+func lanAddress() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	for _, item := range addrs {
+		prefix, err := netip.ParsePrefix(item.String())
+		if err != nil {
+			continue
+		}
+		if addr := prefix.Addr(); addr.Is4() && addr.IsPrivate() {
+			return addr.String()
+		}
+	}
+	return ""
+}
+
+// StartPairing opens the server for one controller, the code it returns is shown as a qr code
+func (r *Remote) StartPairing(params *RemotePairingParams) (*RemotePairing, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.params.Enable {
+		return nil, errors.New("the remote host is not enabled")
+	}
+	code, err := newShareToken()
+	if err != nil {
+		return nil, err
+	}
+	previous := r.pairing
+	r.pairing = &remotePairingState{
+		code:     code,
+		readOnly: params.ReadOnly,
+		expires:  time.Now().Add(remotePairingTTL),
+	}
+	if err = r.syncListenerLocked(); err != nil {
+		r.pairing = previous
+		return nil, err
+	}
+	time.AfterFunc(remotePairingTTL, r.expirePairing)
+	host := params.Host
+	_, port, _ := net.SplitHostPort(r.listener.Addr().String())
+	if host == "" {
+		if listen, _, _ := net.SplitHostPort(r.params.Address); listen != "" && listen != "0.0.0.0" && listen != "::" {
+			host = listen
+		} else {
+			host = lanAddress()
+		}
+	}
+	if host == "" {
+		r.pairing = previous
+		_ = r.syncListenerLocked()
+		return nil, errors.New("no lan address, set the host of the code")
+	}
+	query := url.Values{}
+	query.Set("fp", r.fingerprint)
+	query.Set("code", code)
+	query.Set("name", r.params.Name)
+	uri := &url.URL{Scheme: remoteScheme, Host: net.JoinHostPort(host, port), RawQuery: query.Encode()}
+	return &RemotePairing{Uri: uri.String(), Expires: r.pairing.expires.UnixMilli()}, nil
+}
+
+// clientLocked dials a host pinned to its fingerprint with the identity of this core
+func (r *Remote) clientLocked(fingerprint string) (*http.Client, error) {
+	identity, err := r.identityLocked()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				Certificates:       []tls.Certificate{*identity},
+				InsecureSkipVerify: true,
+				MinVersion:         tls.VersionTLS13,
+				VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+					if len(rawCerts) == 0 || certificateFingerprint(rawCerts[0]) != fingerprint {
+						return errors.New("the host is not the one of the code")
+					}
+					return nil
+				},
+			},
+		},
+	}, nil
+}
+
+// Pair redeems a code of a host, the host is pinned from then on
+func (r *Remote) Pair(params *RemotePairParams) (*RemotePeer, error) {
+	uri, err := url.Parse(params.Uri)
+	if err != nil {
+		return nil, err
+	}
+	query := uri.Query()
+	if uri.Scheme != remoteScheme || uri.Host == "" || query.Get("fp") == "" || query.Get("code") == "" {
+		return nil, errors.New("not a pairing code")
+	}
+	fingerprint := strings.ToLower(query.Get("fp"))
+	name := params.Name
+	if name == "" {
+		name = defaultRemoteName()
+	}
+	r.mutex.Lock()
+	client, err := r.clientLocked(fingerprint)
+	own := r.fingerprint
+	r.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(&remotePairRequest{
+		Name:  name,
+		Proof: pairingProof(query.Get("code"), fingerprint, own),
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), remoteInvokeTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+uri.Host+"/pair", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return nil, fmt.Errorf("pairing refused: %s", strings.TrimSpace(string(message)))
+	}
+	answer := &remotePairResponse{}
+	if err = json.NewDecoder(response.Body).Decode(answer); err != nil {
+		return nil, err
+	}
+	if answer.Name == "" {
+		answer.Name = query.Get("name")
+	}
+	peer := &RemotePeer{
+		Fingerprint: fingerprint,
+		Name:        answer.Name,
+		Role:        HostRemoteRole,
+		Address:     uri.Host,
+		Paired:      time.Now().UnixMilli(),
+	}
+	r.mutex.Lock()
+	r.putPeerLocked(peer)
+	r.mutex.Unlock()
+	log.Infoln("[Remote] paired with host %s at %s", peer.Name, peer.Address)
+	return peer, nil
+}
+
+func (r *Remote) hostClient(fingerprint string) (*RemotePeer, *http.Client, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	peer := r.peerLocked(fingerprint, HostRemoteRole)
+	if peer == nil {
+		return nil, nil, fmt.Errorf("host %s is not paired", fingerprint)
+	}
+	client, err := r.clientLocked(peer.Fingerprint)
+	if err != nil {
+		return nil, nil, err
+	}
+	peer.LastSeen = time.Now().UnixMilli()
+	copied := *peer
+	return &copied, client, nil
+}
+
+// Invoke runs an action on a host, the result is the json the host answered with
+func (r *Remote) Invoke(params *RemoteInvokeParams) (string, error) {
+	peer, client, err := r.hostClient(params.Peer)
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(&Action{Method: params.Method, Data: params.Data})
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), remoteInvokeTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+peer.Address+"/invoke", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(response.Body, maxRemoteEventSize))
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(data)))
+	}
+	return string(data), nil
+}
+
+// Watch forwards the messages of a host as remote events until Unwatch
+func (r *Remote) Watch(fingerprint string) error {
+	peer, client, err := r.hostClient(fingerprint)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.mutex.Lock()
+	if previous, ok := r.watches[fingerprint]; ok {
+		previous()
+	}
+	r.watches[fingerprint] = cancel
+	r.mutex.Unlock()
+	go func() {
+		err := watchRemoteHost(ctx, client, peer)
+		if ctx.Err() != nil {
+			return
+		}
+		r.mutex.Lock()
+		delete(r.watches, fingerprint)
+		r.mutex.Unlock()
+		event := &RemoteEvent{Peer: fingerprint, Error: "stream closed"}
+		if err != nil {
+			event.Error = err.Error()
+		}
+		sendMessage(Message{
+			Type: RemoteEventMessage,
+			Data: event,
+		})
+	}()
+	return nil
+}
+
+func watchRemoteHost(ctx context.Context, client *http.Client, peer *RemotePeer) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+peer.Address+"/events", nil)
+	if err != nil {
+		return err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", response.Status)
+	}
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxRemoteEventSize)
+	for scanner.Scan() {
+		line := append([]byte{}, scanner.Bytes()...)
+		sendMessage(Message{
+			Type: RemoteEventMessage,
+			Data: &RemoteEvent{Peer: peer.Fingerprint, Message: line},
+		})
+	}
+	return scanner.Err()
+}
+
+func (r *Remote) Unwatch(fingerprint string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if cancel, ok := r.watches[fingerprint]; ok {
+		cancel()
+		delete(r.watches, fingerprint)
+	}
+}
+
+// Remove forgets a peer, the streams of a removed controller are closed at once
+func (r *Remote) Remove(params *RemoteRemoveParams) bool {
+	r.mutex.Lock()
+	r.loadPeersLocked()
+	removed := false
+	peers := r.peers[:0]
+	for _, peer := range r.peers {
+		if peer.Fingerprint == params.Fingerprint && (params.Role == "" || peer.Role == params.Role) {
+			removed = true
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	r.peers = peers
+	if removed {
+		r.savePeersLocked()
+		_ = r.syncListenerLocked()
+	}
+	if cancel, ok := r.watches[params.Fingerprint]; ok && params.Role != ControllerRemoteRole {
+		cancel()
+		delete(r.watches, params.Fingerprint)
+	}
+	r.mutex.Unlock()
+	if removed && params.Role != HostRemoteRole {
+		r.subsMutex.Lock()
+		for ch, peer := range r.subscribers {
+			if peer.Fingerprint == params.Fingerprint {
+				close(ch)
+				delete(r.subscribers, ch)
+			}
+		}
+		r.subsMutex.Unlock()
+	}
+	return removed
+}
+
+func (r *Remote) Status() *RemoteStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.loadPeersLocked()
+	if _, err := r.identityLocked(); err != nil && r.err == nil {
+		r.err = err
+	}
+	status := &RemoteStatus{
+		RemoteHostParams: r.params,
+		Running:          r.server != nil,
+		Fingerprint:      r.fingerprint,
+		Pairing:          r.pairing != nil && time.Now().Before(r.pairing.expires),
+		Peers:            make([]*RemotePeer, 0, len(r.peers)),
+		Watching:         make([]string, 0, len(r.watches)),
+	}
+	if r.listener != nil {
+		status.Listening = r.listener.Addr().String()
+	}
+	for _, peer := range r.peers {
+		copied := *peer
+		status.Peers = append(status.Peers, &copied)
+	}
+	for fingerprint := range r.watches {
+		status.Watching = append(status.Watching, fingerprint)
+	}
+	sort.Strings(status.Watching)
+	if r.err != nil {
+		status.Error = r.err.Error()
+	}
+	return status
+}
+
+func handleSetRemoteHost(paramsString string) error {
+	params := &RemoteHostParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	if err := remote.Set(params); err != nil {
+		return err
+	}
+	go discovery.Announce()
+	return nil
+}
+
+func handleGetRemote() string {
+	data, err := json.Marshal(remote.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handleStartRemotePairing(paramsString string) (string, error) {
+	params := &RemotePairingParams{}
+	if paramsString != "" {
+		if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+			return "", err
+		}
+	}
+	pairing, err := remote.StartPairing(params)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(pairing)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func handlePairRemote(paramsString string) (string, error) {
+	params := &RemotePairParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return "", err
+	}
+	peer, err := remote.Pair(params)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(peer)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func handleInvokeRemote(paramsString string) (string, error) {
+	params := &RemoteInvokeParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return "", err
+	}
+	return remote.Invoke(params)
+}
+
+func handleWatchRemote(fingerprint string) error {
+	return remote.Watch(fingerprint)
+}
+
+func handleUnwatchRemote(fingerprint string) {
+	remote.Unwatch(fingerprint)
+}
+
+func handleRemoveRemotePeer(paramsString string) (bool, error) {
+	params := &RemoteRemoveParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return false, err
+	}
+	return remote.Remove(params), nil
+}
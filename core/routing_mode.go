@@ -0,0 +1,493 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/common/lru"
+	"github.com/metacubex/mihomo/common/utils"
+	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type RoutingMode string
+
+const (
+	OffRoutingMode    RoutingMode = "off"
+	ScriptRoutingMode RoutingMode = "script"
+	TableRoutingMode  RoutingMode = "table"
+
+	// routeFallbackRules lets undecided connections continue with the profile rules
+	routeFallbackRules = "rules"
+
+	defaultRouteCacheSize = 4096
+	defaultRouteCacheTTL  = 300
+	// routeScriptMaxSteps bounds one decision, routing runs for every new connection
+	routeScriptMaxSteps = 200_000
+	routeScriptTimeout  = 50 * time.Millisecond
+)
+
+// RouteEntry is one row of a decision table, all fields that are set must match
+type RouteEntry struct {
+	Domain        []string `json:"domain"`
+	DomainSuffix  []string `json:"domain-suffix"`
+	DomainKeyword []string `json:"domain-keyword"`
+	IpCidr        []string `json:"ip-cidr"`
+	Port          string   `json:"port"`
+	Network       string   `json:"network"`
+	Process       []string `json:"process"`
+	Target        string   `json:"target"`
+}
+
+// RoutingModeParams configures the custom mode, script defines route(conn) returning a proxy name or None
+type RoutingModeParams struct {
+	Mode      RoutingMode  `json:"mode"`
+	Script    string       `json:"script"`
+	Table     []RouteEntry `json:"table"`
+	Fallback  string       `json:"fallback"`
+	Resolve   bool         `json:"resolve"`
+	Process   bool         `json:"process"`
+	CacheSize int          `json:"cache-size"`
+	CacheTTL  int64        `json:"cache-ttl"`
+}
+
+type RoutingModeStatus struct {
+	Mode      RoutingMode `json:"mode"`
+	Fallback  string      `json:"fallback"`
+	Decisions int64       `json:"decisions"`
+	CacheHits int64       `json:"cache-hits"`
+	Errors    int64       `json:"errors"`
+	LastError string      `json:"last-error,omitempty"`
+}
+
+type routeEntry struct {
+	domains  map[string]bool
+	suffixes []string
+	keywords []string
+	prefixes []netip.Prefix
+	ports    utils.IntRanges[uint16]
+	network  string
+	process  map[string]bool
+	target   string
+}
+
+// routeDecider evaluates a connection, an empty target leaves it undecided
+type routeDecider interface {
+	decide(metadata *C.Metadata) (string, error)
+}
+
+type routeTable []*routeEntry
+
+type routeScript struct {
+	entry starlark.Callable
+}
+
+// customRoute is placed in front of the profile rules while the custom mode is on
+type customRoute struct {
+	params    RoutingModeParams
+	decider   routeDecider
+	cache     *lru.LruCache[string, string]
+	decisions atomic.Int64
+	hits      atomic.Int64
+	errors    atomic.Int64
+	lastError atomic.Value
+}
+
+var (
+	routingMutex sync.Mutex
+	routing      *customRoute
+)
+
+var routeScriptModules = starlark.StringDict{
+	"net": &starlarkstruct.Module{
+		Name: "net",
+		Members: starlark.StringDict{
+			"in_cidr":       starlark.NewBuiltin("net.in_cidr", routeScriptInCidr),
+			"domain_suffix": starlark.NewBuiltin("net.domain_suffix", routeScriptDomainSuffix),
+		},
+	},
+}
+
+func init() {
+	for name, module := range scriptModules {
+		routeScriptModules[name] = module
+	}
+}
+
+func routeScriptInCidr(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var ip, cidr string
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 2, &ip, &cidr); err != nil {
+		return nil, err
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn.Name(), err)
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return starlark.False, nil
+	}
+	return starlark.Bool(prefix.Contains(addr.Unmap())), nil
+}
+
+func routeScriptDomainSuffix(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var host, suffix string
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 2, &host, &suffix); err != nil {
+		return nil, err
+	}
+	return starlark.Bool(matchDomainSuffix(strings.ToLower(host), strings.ToLower(suffix))), nil
+}
+
+func matchDomainSuffix(host string, suffix string) bool {
+	suffix = strings.TrimPrefix(suffix, ".")
+	return host == suffix || strings.HasSuffix(host, "."+suffix)
+}
+
+func compileRouteTable(entries []RouteEntry) (routeTable, error) {
+	table := make(routeTable, 0, len(entries))
+	for i, entry := range entries {
+		if entry.Target == "" {
+			return nil, fmt.Errorf("table[%d]: target is required", i)
+		}
+		compiled := &routeEntry{
+			domains: map[string]bool{},
+			process: map[string]bool{},
+			network: strings.ToLower(entry.Network),
+			target:  entry.Target,
+		}
+		for _, domain := range entry.Domain {
+			compiled.domains[strings.ToLower(domain)] = true
+		}
+		for _, suffix := range entry.DomainSuffix {
+			compiled.suffixes = append(compiled.suffixes, strings.ToLower(suffix))
+		}
+		for _, keyword := range entry.DomainKeyword {
+			compiled.keywords = append(compiled.keywords, strings.ToLower(keyword))
+		}
+		for _, cidr := range entry.IpCidr {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("table[%d]: %v", i, err)
+			}
+			compiled.prefixes = append(compiled.prefixes, prefix)
+		}
+		if entry.Port != "" {
+			ports, err := utils.NewUnsignedRanges[uint16](entry.Port)
+			if err != nil {
+				return nil, fmt.Errorf("table[%d]: %v", i, err)
+			}
+			compiled.ports = ports
+		}
+		if compiled.network != "" && compiled.network != "tcp" && compiled.network != "udp" {
+			return nil, fmt.Errorf("table[%d]: unknown network %s", i, entry.Network)
+		}
+		for _, process := range entry.Process {
+			compiled.process[process] = true
+		}
+		table = append(table, compiled)
+	}
+	return table, nil
+}
+
+func (e *routeEntry) match(metadata *C.Metadata) bool {
+	host := strings.ToLower(metadata.Host)
+	if len(e.domains) != 0 || len(e.suffixes) != 0 || len(e.keywords) != 0 {
+		matched := e.domains[host]
+		for _, suffix := range e.suffixes {
+			matched = matched || matchDomainSuffix(host, suffix)
+		}
+		for _, keyword := range e.keywords {
+			matched = matched || strings.Contains(host, keyword)
+		}
+		if !matched || host == "" {
+			return false
+		}
+	}
+	if len(e.prefixes) != 0 {
+		if !metadata.DstIP.IsValid() {
+			return false
+		}
+		matched := false
+		for _, prefix := range e.prefixes {
+			if prefix.Contains(metadata.DstIP.Unmap()) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(e.ports) != 0 && !e.ports.Check(metadata.DstPort) {
+		return false
+	}
+	if e.network != "" && e.network != metadata.NetWork.String() {
+		return false
+	}
+	if len(e.process) != 0 && !e.process[metadata.Process] && !e.process[metadata.ProcessPath] {
+		return false
+	}
+	return true
+}
+
+func (t routeTable) decide(metadata *C.Metadata) (string, error) {
+	for _, entry := range t {
+		if entry.match(metadata) {
+			return entry.target, nil
+		}
+	}
+	return "", nil
+}
+
+func compileRouteScript(script string) (*routeScript, error) {
+	if script == "" {
+		return nil, errors.New("script is empty")
+	}
+	if len(script) > scriptMaxSize {
+		return nil, errors.New("script exceeds maximum size")
+	}
+	thread := &starlark.Thread{
+		Name: "route",
+		Load: func(_ *starlark.Thread, module string) (starlark.StringDict, error) {
+			return nil, fmt.Errorf("load of %s is not allowed", module)
+		},
+	}
+	thread.SetMaxExecutionSteps(scriptMaxSteps)
+	timer := time.AfterFunc(scriptTimeout, func() {
+		thread.Cancel("script timed out")
+	})
+	defer timer.Stop()
+	globals, err := starlark.ExecFileOptions(scriptFileOptions, thread, "route.star", script, routeScriptModules)
+	if err != nil {
+		return nil, scriptError(err)
+	}
+	entry, ok := globals["route"].(starlark.Callable)
+	if !ok {
+		return nil, errors.New("script must define route(conn)")
+	}
+	// frozen globals can be shared by the threads of concurrent connections
+	globals.Freeze()
+	return &routeScript{entry: entry}, nil
+}
+
+func (s *routeScript) decide(metadata *C.Metadata) (string, error) {
+	dstIP, srcIP := "", ""
+	if metadata.DstIP.IsValid() {
+		dstIP = metadata.DstIP.Unmap().String()
+	}
+	if metadata.SrcIP.IsValid() {
+		srcIP = metadata.SrcIP.Unmap().String()
+	}
+	conn := starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"network":      starlark.String(metadata.NetWork.String()),
+		"type":         starlark.String(metadata.Type.String()),
+		"host":         starlark.String(metadata.Host),
+		"ip":           starlark.String(dstIP),
+		"port":         starlark.MakeInt(int(metadata.DstPort)),
+		"src_ip":       starlark.String(srcIP),
+		"src_port":     starlark.MakeInt(int(metadata.SrcPort)),
+		"in_name":      starlark.String(metadata.InName),
+		"process":      starlark.String(metadata.Process),
+		"process_path": starlark.String(metadata.ProcessPath),
+		"uid":          starlark.MakeUint(uint(metadata.Uid)),
+	})
+	thread := &starlark.Thread{
+		Name: "route",
+		Print: func(_ *starlark.Thread, msg string) {
+			log.Debugln("[Route] %s", msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(routeScriptMaxSteps)
+	timer := time.AfterFunc(routeScriptTimeout, func() {
+		thread.Cancel("route timed out")
+	})
+	defer timer.Stop()
+	result, err := starlark.Call(thread, s.entry, starlark.Tuple{conn}, nil)
+	if err != nil {
+		return "", scriptError(err)
+	}
+	switch result := result.(type) {
+	case starlark.NoneType:
+		return "", nil
+	case starlark.String:
+		return string(result), nil
+	}
+	return "", fmt.Errorf("route must return a proxy name or None, got %s", result.Type())
+}
+
+func newCustomRoute(params RoutingModeParams) (*customRoute, error) {
+	route := &customRoute{params: params}
+	var err error
+	switch params.Mode {
+	case ScriptRoutingMode:
+		route.decider, err = compileRouteScript(params.Script)
+	case TableRoutingMode:
+		route.decider, err = compileRouteTable(params.Table)
+	default:
+		return nil, fmt.Errorf("unknown routing mode %s", params.Mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if params.CacheSize <= 0 {
+		params.CacheSize = defaultRouteCacheSize
+	}
+	if params.CacheTTL <= 0 {
+		params.CacheTTL = defaultRouteCacheTTL
+	}
+	route.params = params
+	route.cache = lru.New[string, string](
+		lru.WithSize[string, string](params.CacheSize),
+		lru.WithAge[string, string](params.CacheTTL),
+	)
+	return route, nil
+}
+
+// cacheKey holds everything a decision may depend on, the source port is left out so decisions are shared
+func (r *customRoute) cacheKey(metadata *C.Metadata) string {
+	return strings.Join([]string{
+		metadata.NetWork.String(),
+		metadata.Host,
+		metadata.DstIP.String(),
+		strconv.Itoa(int(metadata.DstPort)),
+		metadata.Process,
+		metadata.ProcessPath,
+		metadata.InName,
+	}, "|")
+}
+
+func (r *customRoute) RuleType() C.RuleType {
+	return C.MATCH
+}
+
+func (r *customRoute) Match(metadata *C.Metadata, helper C.RuleMatchHelper) (bool, string) {
+	if r.params.Resolve && helper.ResolveIP != nil {
+		helper.ResolveIP()
+	}
+	if r.params.Process && helper.FindProcess != nil {
+		helper.FindProcess()
+	}
+	key := r.cacheKey(metadata)
+	target, ok := r.cache.Get(key)
+	if ok {
+		r.hits.Add(1)
+	} else {
+		var err error
+		target, err = r.decider.decide(metadata)
+		if err != nil {
+			r.errors.Add(1)
+			r.lastError.Store(err.Error())
+			log.Warnln("[Route] %s: %v", metadata.RemoteAddress(), err)
+			target = ""
+		}
+		r.cache.Set(key, target)
+	}
+	r.decisions.Add(1)
+	if target == "" {
+		target = r.params.Fallback
+	}
+	if target == "" || target == routeFallbackRules {
+		return false, ""
+	}
+	return true, target
+}
+
+func (r *customRoute) Adapter() string {
+	return r.params.Fallback
+}
+
+func (r *customRoute) Payload() string {
+	return string(r.params.Mode)
+}
+
+func (r *customRoute) ProviderNames() []string {
+	return nil
+}
+
+func (r *customRoute) Status() RoutingModeStatus {
+	status := RoutingModeStatus{
+		Mode:      r.params.Mode,
+		Fallback:  r.params.Fallback,
+		Decisions: r.decisions.Load(),
+		CacheHits: r.hits.Load(),
+		Errors:    r.errors.Load(),
+	}
+	if lastError, ok := r.lastError.Load().(string); ok {
+		status.LastError = lastError
+	}
+	return status
+}
+
+// routingRule returns the rule of the custom mode, nil while it is off
+func routingRule() C.Rule {
+	routingMutex.Lock()
+	defer routingMutex.Unlock()
+	if routing == nil {
+		return nil
+	}
+	return routing
+}
+
+// SetRoutingMode switches the custom mode, it routes through the rule engine so the tunnel is put in rule mode
+func SetRoutingMode(params RoutingModeParams) error {
+	var route *customRoute
+	if params.Mode != "" && params.Mode != OffRoutingMode {
+		if params.Fallback == "" {
+			params.Fallback = routeFallbackRules
+		}
+		var err error
+		if route, err = newCustomRoute(params); err != nil {
+			return err
+		}
+	}
+	runLock.Lock()
+	defer runLock.Unlock()
+	if route != nil && currentConfig != nil && params.Fallback != routeFallbackRules {
+		if _, ok := tunnel.ProxiesWithProviders()[params.Fallback]; !ok {
+			return fmt.Errorf("fallback %s not found", params.Fallback)
+		}
+	}
+	routingMutex.Lock()
+	routing = route
+	routingMutex.Unlock()
+	if currentConfig == nil {
+		return nil
+	}
+	if route != nil && tunnel.Mode() != tunnel.Rule {
+		currentConfig.General.Mode = tunnel.Rule
+		tunnel.SetMode(tunnel.Rule)
+	}
+	return applyRulesLocked(currentRules)
+}
+
+func handleSetRoutingMode(paramsString string) error {
+	var params = RoutingModeParams{}
+	if err := json.Unmarshal([]byte(paramsString), &params); err != nil {
+		return err
+	}
+	return SetRoutingMode(params)
+}
+
+func handleGetRoutingMode() string {
+	routingMutex.Lock()
+	route := routing
+	routingMutex.Unlock()
+	status := RoutingModeStatus{Mode: OffRoutingMode}
+	if route != nil {
+		status = route.Status()
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
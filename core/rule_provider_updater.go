@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mihomoHttp "github.com/metacubex/mihomo/component/http"
+	"github.com/metacubex/mihomo/constant/provider"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRuleProviderInterval = 24 * time.Hour
+	minRuleProviderInterval     = 10 * time.Minute
+	ruleProviderTimeout         = 60 * time.Second
+	maxRuleProviderSize         = 64 << 20
+)
+
+// mrsMagic is the zstd frame header of binary rule sets, they are not diffed by entry
+var mrsMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// RuleProviderIntegrity describes how the content of a rule provider is verified before it is applied
+type RuleProviderIntegrity struct {
+	// SHA256 pins the hex digest of the content
+	SHA256 string `json:"sha256"`
+	// SHA256Url points to a digest file whose first field is the hex digest
+	SHA256Url string `json:"sha256-url"`
+	// PublicKey is a base64 ed25519 key, the signature defaults to the provider url with .sig appended
+	PublicKey    string `json:"public-key"`
+	SignatureUrl string `json:"signature-url"`
+}
+
+type RuleProviderUpdateParams struct {
+	// Providers limits the schedule to these names, all http providers are updated when empty
+	Providers []string                         `json:"providers"`
+	Interval  int64                            `json:"interval"`
+	Integrity map[string]RuleProviderIntegrity `json:"integrity"`
+}
+
+// RuleProviderUpdate is emitted after every update attempt of a provider
+type RuleProviderUpdate struct {
+	Name     string `json:"name"`
+	Changed  bool   `json:"changed"`
+	Verified bool   `json:"verified"`
+	Added    int    `json:"added"`
+	Removed  int    `json:"removed"`
+	Count    int    `json:"count"`
+	Error    string `json:"error,omitempty"`
+	UpdateAt int64  `json:"update-at"`
+}
+
+type ruleProviderUpdater struct {
+	mutex   sync.Mutex
+	cancel  context.CancelFunc
+	params  RuleProviderUpdateParams
+	updates map[string]RuleProviderUpdate
+}
+
+var ruleProviderUpdates = &ruleProviderUpdater{updates: map[string]RuleProviderUpdate{}}
+
+// vehicleProvider is implemented by providers backed by a resource fetcher
+type vehicleProvider interface {
+	Vehicle() provider.Vehicle
+}
+
+// Start replaces any running schedule with params
+func (u *ruleProviderUpdater) Start(params RuleProviderUpdateParams) error {
+	interval := time.Duration(params.Interval) * time.Millisecond
+	if interval <= 0 {
+		interval = defaultRuleProviderInterval
+	}
+	if interval < minRuleProviderInterval {
+		interval = minRuleProviderInterval
+	}
+	for name, integrity := range params.Integrity {
+		if integrity.PublicKey == "" {
+			continue
+		}
+		if key, err := base64.StdEncoding.DecodeString(integrity.PublicKey); err != nil || len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("rule provider %s: invalid public key", name)
+		}
+	}
+
+	u.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	u.mutex.Lock()
+	u.cancel = cancel
+	u.params = params
+	u.mutex.Unlock()
+	go u.run(ctx, interval)
+	return nil
+}
+
+// Stop cancels the running schedule
+func (u *ruleProviderUpdater) Stop() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.cancel != nil {
+		u.cancel()
+		u.cancel = nil
+	}
+}
+
+func (u *ruleProviderUpdater) run(ctx context.Context, interval time.Duration) {
+	for {
+		u.mutex.Lock()
+		names := u.params.Providers
+		u.mutex.Unlock()
+		if len(names) == 0 {
+			for name, ruleProvider := range tunnel.RuleProviders() {
+				if ruleProvider.VehicleType() == provider.HTTP {
+					names = append(names, name)
+				}
+			}
+		}
+		for _, name := range names {
+			if ctx.Err() != nil {
+				return
+			}
+			u.Update(ctx, name)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(powerScaled(interval)):
+		}
+	}
+}
+
+// Update fetches, verifies and applies one provider, the result is also emitted as an event
+func (u *ruleProviderUpdater) Update(ctx context.Context, name string) RuleProviderUpdate {
+	u.mutex.Lock()
+	integrity := u.params.Integrity[name]
+	u.mutex.Unlock()
+	update, err := updateRuleProvider(ctx, name, integrity)
+	providerAttempts.record(name, err)
+	update.Name = name
+	update.UpdateAt = time.Now().UnixMilli()
+	if err != nil {
+		update.Error = err.Error()
+		log.Warnln("[RuleProvider] update %s failed: %v", name, err)
+	} else if update.Changed {
+		log.Infoln("[RuleProvider] %s updated, %d added, %d removed", name, update.Added, update.Removed)
+	}
+	u.mutex.Lock()
+	u.updates[name] = update
+	u.mutex.Unlock()
+	sendMessage(Message{
+		Type: RuleProviderUpdateMessage,
+		Data: update,
+	})
+	return update
+}
+
+// Updates returns the last update result of every provider
+func (u *ruleProviderUpdater) Updates() []RuleProviderUpdate {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	updates := make([]RuleProviderUpdate, 0, len(u.updates))
+	for _, update := range u.updates {
+		updates = append(updates, update)
+	}
+	return updates
+}
+
+func updateRuleProvider(ctx context.Context, name string, integrity RuleProviderIntegrity) (RuleProviderUpdate, error) {
+	update := RuleProviderUpdate{}
+	ruleProvider, ok := tunnel.RuleProviders()[name]
+	if !ok {
+		return update, fmt.Errorf("rule provider %s not found", name)
+	}
+	update.Count = ruleProvider.Count()
+	fetcher, ok := ruleProvider.(vehicleProvider)
+	if !ok || ruleProvider.VehicleType() != provider.HTTP {
+		return update, fmt.Errorf("rule provider %s is not a remote provider", name)
+	}
+	vehicle := fetcher.Vehicle()
+
+	ctx, cancel := context.WithTimeout(ctx, ruleProviderTimeout)
+	defer cancel()
+	body, err := downloadRuleResource(ctx, vehicle.Url(), vehicle.Proxy())
+	if err != nil {
+		return update, err
+	}
+	verified, err := verifyRuleProvider(ctx, body, vehicle, integrity)
+	if err != nil {
+		return update, err
+	}
+	update.Verified = verified
+
+	previous, _ := os.ReadFile(vehicle.Path())
+	same, err := sideUpdateRuleProvider(ruleProvider, body)
+	if err != nil {
+		return update, err
+	}
+	previousCount := update.Count
+	update.Count = ruleProvider.Count()
+	if same {
+		return update, nil
+	}
+	update.Changed = true
+	update.Added, update.Removed = diffRulePayload(previous, body, previousCount, update.Count)
+	return update, nil
+}
+
+func downloadRuleResource(ctx context.Context, url string, proxy string) ([]byte, error) {
+	resp, err := mihomoHttp.HttpRequestWithProxy(ctx, url, http.MethodGet, nil, nil, proxy)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s responded %s", url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRuleProviderSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxRuleProviderSize {
+		return nil, errors.New("rule provider exceeds maximum size")
+	}
+	return body, nil
+}
+
+// verifyRuleProvider checks every configured digest and signature, it reports false when none is configured
+func verifyRuleProvider(ctx context.Context, body []byte, vehicle provider.Vehicle, integrity RuleProviderIntegrity) (bool, error) {
+	verified := false
+	sum := sha256.Sum256(body)
+	digest := hex.EncodeToString(sum[:])
+	if integrity.SHA256 != "" {
+		if !strings.EqualFold(integrity.SHA256, digest) {
+			return false, fmt.Errorf("sha256 mismatch, expected %s got %s", integrity.SHA256, digest)
+		}
+		verified = true
+	}
+	if integrity.SHA256Url != "" {
+		data, err := downloadRuleResource(ctx, integrity.SHA256Url, vehicle.Proxy())
+		if err != nil {
+			return false, fmt.Errorf("fetch sha256: %v", err)
+		}
+		fields := strings.Fields(string(data))
+		if len(fields) == 0 || !strings.EqualFold(fields[0], digest) {
+			return false, fmt.Errorf("sha256 mismatch with %s", integrity.SHA256Url)
+		}
+		verified = true
+	}
+	if integrity.PublicKey != "" {
+		key, err := base64.StdEncoding.DecodeString(integrity.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return false, errors.New("invalid public key")
+		}
+		signatureUrl := integrity.SignatureUrl
+		if signatureUrl == "" {
+			signatureUrl = vehicle.Url() + ".sig"
+		}
+		data, err := downloadRuleResource(ctx, signatureUrl, vehicle.Proxy())
+		if err != nil {
+			return false, fmt.Errorf("fetch signature: %v", err)
+		}
+		signature := data
+		if len(signature) != ed25519.SignatureSize {
+			if signature, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(data))); err != nil {
+				return false, errors.New("invalid signature encoding")
+			}
+		}
+		if !ed25519.Verify(key, body, signature) {
+			return false, errors.New("signature verification failed")
+		}
+		verified = true
+	}
+	return verified, nil
+}
+
+// sideUpdateRuleProvider feeds verified content to the provider fetcher, which parses it,
+// writes the cache file and swaps the rule tree in one step. SideUpdate returns the
+// unexported strategy type, so it can only be reached through reflection.
+func sideUpdateRuleProvider(ruleProvider provider.RuleProvider, body []byte) (bool, error) {
+	method := reflect.ValueOf(ruleProvider).MethodByName("SideUpdate")
+	if !method.IsValid() || method.Type().NumIn() != 1 || method.Type().NumOut() != 3 {
+		return false, fmt.Errorf("rule provider %s can not be updated in place", ruleProvider.Name())
+	}
+	results := method.Call([]reflect.Value{reflect.ValueOf(body)})
+	if err, _ := results[2].Interface().(error); err != nil {
+		return false, err
+	}
+	return results[1].Bool(), nil
+}
+
+// diffRulePayload counts entries added and removed between two text or yaml rule sets,
+// binary rule sets only report the difference of their counts
+func diffRulePayload(previous, current []byte, previousCount, count int) (int, int) {
+	if bytes.HasPrefix(current, mrsMagic) || bytes.HasPrefix(previous, mrsMagic) {
+		if count >= previousCount {
+			return count - previousCount, 0
+		}
+		return 0, previousCount - count
+	}
+	before := rulePayloadEntries(previous)
+	after := rulePayloadEntries(current)
+	added, removed := 0, 0
+	for entry := range after {
+		if !before[entry] {
+			added++
+		}
+	}
+	for entry := range before {
+		if !after[entry] {
+			removed++
+		}
+	}
+	return added, removed
+}
+
+func rulePayloadEntries(content []byte) map[string]bool {
+	entries := map[string]bool{}
+	if len(content) == 0 || bytes.HasPrefix(content, mrsMagic) {
+		return entries
+	}
+	payload := &struct {
+		Payload []string `yaml:"payload"`
+	}{}
+	if err := yaml.Unmarshal(content, payload); err == nil && len(payload.Payload) != 0 {
+		for _, entry := range payload.Payload {
+			entries[strings.TrimSpace(entry)] = true
+		}
+		return entries
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		entries[line] = true
+	}
+	return entries
+}
+
+func handleStartRuleProviderUpdate(paramsString string) string {
+	var params = RuleProviderUpdateParams{}
+	if err := json.Unmarshal([]byte(paramsString), &params); err != nil {
+		return err.Error()
+	}
+	if err := ruleProviderUpdates.Start(params); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func handleStopRuleProviderUpdate() bool {
+	ruleProviderUpdates.Stop()
+	return true
+}
+
+func handleUpdateRuleProvider(name string, fn func(value string)) {
+	go func() {
+		update := ruleProviderUpdates.Update(context.Background(), name)
+		data, _ := json.Marshal(update)
+		fn(string(data))
+	}()
+}
+
+func handleGetRuleProviderUpdates() string {
+	data, err := json.Marshal(ruleProviderUpdates.Updates())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/tunnel"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	connectionHistorySize  = 1000
+	defaultSimulationLimit = 200
+)
+
+type closedConnection struct {
+	metadata *C.Metadata
+	closed   time.Time
+}
+
+// ConnectionHistory keeps the metadata of the last closed tcp connections, the tunnel handles a
+// connection until it is closed so the metadata is final once it is recorded
+type ConnectionHistory struct {
+	mutex   sync.Mutex
+	entries []closedConnection
+	next    int
+}
+
+var connectionHistory = &ConnectionHistory{}
+
+func (h *ConnectionHistory) record(metadata *C.Metadata) {
+	entry := closedConnection{metadata: metadata.Clone(), closed: time.Now()}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if len(h.entries) < connectionHistorySize {
+		h.entries = append(h.entries, entry)
+		return
+	}
+	h.entries[h.next] = entry
+	h.next = (h.next + 1) % connectionHistorySize
+}
+
+// last returns up to limit connections, the most recently closed first
+func (h *ConnectionHistory) last(limit int) []closedConnection {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if limit <= 0 || limit > len(h.entries) {
+		limit = len(h.entries)
+	}
+	entries := make([]closedConnection, 0, limit)
+	for i := 0; i < limit; i++ {
+		index := (h.next - 1 - i + 2*len(h.entries)) % len(h.entries)
+		entries = append(entries, h.entries[index])
+	}
+	return entries
+}
+
+type connectionHistoryTunnel struct {
+	C.Tunnel
+}
+
+var historyTunnel C.Tunnel = &connectionHistoryTunnel{Tunnel: limitedTunnel}
+
+func (t *connectionHistoryTunnel) HandleTCPConn(conn net.Conn, metadata *C.Metadata) {
+	t.Tunnel.HandleTCPConn(conn, metadata)
+	connectionHistory.record(metadata)
+}
+
+type SimulateRulesParams struct {
+	Rules      []string        `json:"rules"`
+	Operations []RuleOperation `json:"operations"`
+	Limit      int             `json:"limit"`
+	All        bool            `json:"all"`
+}
+
+type SimulatedOutcome struct {
+	Rule     *ExplainedRule `json:"rule,omitempty"`
+	Outbound string         `json:"outbound"`
+	Chain    []string       `json:"chain"`
+}
+
+type SimulatedConnection struct {
+	Network     string            `json:"network"`
+	Host        string            `json:"host"`
+	Destination string            `json:"destination"`
+	Process     string            `json:"process"`
+	Closed      int64             `json:"closed"`
+	Changed     bool              `json:"changed"`
+	Current     *SimulatedOutcome `json:"current"`
+	Proposed    *SimulatedOutcome `json:"proposed"`
+}
+
+// RuleSimulation compares the routes of the closed connections under the running and the
+// proposed rules, connections only show up when their outbound chain changes unless all is set
+type RuleSimulation struct {
+	Connections  int                    `json:"connections"`
+	Changed      int                    `json:"changed"`
+	RuleChanged  int                    `json:"rule-changed"`
+	Results      []*SimulatedConnection `json:"results"`
+	Duration     int64                  `json:"duration"`
+	ProposedSize int                    `json:"proposed-size"`
+}
+
+func simulateOutcome(rules []C.Rule, subRules map[string][]C.Rule, proxies map[string]C.Proxy, metadata *C.Metadata) *SimulatedOutcome {
+	if list, ok := subRules[metadata.SpecialRules]; ok {
+		rules = list
+	}
+	// the recorded metadata already carries the resolved ip and process of the connection
+	adapter, rule := explainMatch(&RouteExplanation{}, rules, subRules, proxies, metadata, C.RuleMatchHelper{
+		ResolveIP:   func() {},
+		FindProcess: func() {},
+	})
+	outcome := &SimulatedOutcome{Rule: rule, Chain: []string{}}
+	if adapter == nil {
+		return outcome
+	}
+	outcome.Outbound = adapter.Name()
+	for _, hop := range explainChain(adapter, metadata) {
+		outcome.Chain = append(outcome.Chain, hop.Name)
+	}
+	return outcome
+}
+
+func sameRule(a, b *ExplainedRule) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Type == b.Type && a.Payload == b.Payload && a.Adapter == b.Adapter
+}
+
+// SimulateRules re-evaluates the last closed connections against proposed rules without applying them
+func SimulateRules(params *SimulateRulesParams) (*RuleSimulation, error) {
+	runLock.Lock()
+	if currentConfig == nil {
+		runLock.Unlock()
+		return nil, errors.New("config not loaded")
+	}
+	if len(params.Rules) == 0 && len(params.Operations) == 0 {
+		runLock.Unlock()
+		return nil, errors.New("rules or operations required")
+	}
+	lines := params.Rules
+	if len(params.Operations) != 0 {
+		lines = make([]string, len(currentRules))
+		copy(lines, currentRules)
+		for _, operation := range params.Operations {
+			var err error
+			if lines, err = applyRuleOperation(lines, operation); err != nil {
+				runLock.Unlock()
+				return nil, err
+			}
+		}
+	}
+	proposed, err := parseRulesLocked(lines)
+	subRules := currentConfig.SubRules
+	runLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	limit := params.Limit
+	if limit <= 0 {
+		limit = defaultSimulationLimit
+	}
+	current := tunnel.Rules()
+	proxies := tunnel.Proxies()
+	simulation := &RuleSimulation{Results: []*SimulatedConnection{}, ProposedSize: len(proposed)}
+	for _, entry := range connectionHistory.last(limit) {
+		before := simulateOutcome(current, subRules, proxies, entry.metadata.Clone())
+		after := simulateOutcome(proposed, subRules, proxies, entry.metadata.Clone())
+		simulation.Connections++
+		changed := strings.Join(before.Chain, ",") != strings.Join(after.Chain, ",")
+		if changed {
+			simulation.Changed++
+		}
+		if !sameRule(before.Rule, after.Rule) {
+			simulation.RuleChanged++
+		}
+		if !changed && !params.All {
+			continue
+		}
+		simulation.Results = append(simulation.Results, &SimulatedConnection{
+			Network:     entry.metadata.NetWork.String(),
+			Host:        entry.metadata.Host,
+			Destination: entry.metadata.RemoteAddress(),
+			Process:     entry.metadata.Process,
+			Closed:      entry.closed.UnixMilli(),
+			Changed:     changed,
+			Current:     before,
+			Proposed:    after,
+		})
+	}
+	simulation.Duration = time.Since(start).Milliseconds()
+	return simulation, nil
+}
+
+func handleSimulateRules(paramsString string) (string, error) {
+	var params = &SimulateRulesParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return "", err
+	}
+	simulation, err := SimulateRules(params)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(simulation)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	C "github.com/metacubex/mihomo/constant"
+	R "github.com/metacubex/mihomo/rules"
+	"github.com/metacubex/mihomo/tunnel"
+	"strings"
+)
+
+type RuleOperationType string
+
+const (
+	AddRuleOperation     RuleOperationType = "add"
+	RemoveRuleOperation  RuleOperationType = "remove"
+	ReplaceRuleOperation RuleOperationType = "replace"
+	MoveRuleOperation    RuleOperationType = "move"
+)
+
+// RuleOperation is a single edit of the rule list, an index of -1 addresses the end
+type RuleOperation struct {
+	Type  RuleOperationType `json:"type"`
+	Index int               `json:"index"`
+	To    int               `json:"to"`
+	Rule  string            `json:"rule"`
+}
+
+type PatchRulesParams struct {
+	Operations []RuleOperation `json:"operations"`
+}
+
+var currentRules []string
+
+// PatchRules applies operations to the running rule list and swaps it in as a whole
+func PatchRules(operations []RuleOperation) ([]string, error) {
+	runLock.Lock()
+	defer runLock.Unlock()
+	if currentConfig == nil {
+		return nil, errors.New("config not loaded")
+	}
+
+	lines := make([]string, len(currentRules))
+	copy(lines, currentRules)
+	for i, operation := range operations {
+		var err error
+		lines, err = applyRuleOperation(lines, operation)
+		if err != nil {
+			return nil, fmt.Errorf("operation[%d] %s: %v", i, operation.Type, err)
+		}
+	}
+
+	if err := applyRulesLocked(lines); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// parseRulesLocked parses lines behind the app filter and custom mode rules the way they run in the tunnel
+func parseRulesLocked(lines []string) ([]C.Rule, error) {
+	ruleProviders := tunnel.RuleProviders()
+	// the captive portal bypass goes in front of everything, the login must never hit the tunnel
+	filterRules := append(captivePortal.rules(), appFilterRules(appFilter)...)
+	parsed := make([]C.Rule, 0, len(filterRules)+len(lines))
+	for idx, line := range append(filterRules, lines...) {
+		rule, err := parseRuleLine(line, currentConfig.SubRules)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d] [%s] error: %v", idx-len(filterRules), line, err)
+		}
+		for _, name := range rule.ProviderNames() {
+			if _, ok := ruleProviders[name]; !ok {
+				return nil, fmt.Errorf("rules[%d] [%s] error: rule set [%s] not found", idx-len(filterRules), line, name)
+			}
+		}
+		parsed = append(parsed, rule)
+	}
+	if rule := routingRule(); rule != nil {
+		// the custom mode decides behind the app filter and in front of the profile rules
+		parsed = append(parsed[:len(filterRules)], append([]C.Rule{rule}, parsed[len(filterRules):]...)...)
+	}
+	return domainMatcher.CompileLocked(parsed, nil), nil
+}
+
+// applyRulesLocked parses lines and swaps them into the tunnel
+func applyRulesLocked(lines []string) error {
+	parsed, err := parseRulesLocked(lines)
+	if err != nil {
+		return err
+	}
+	tunnel.UpdateRules(parsed, currentConfig.SubRules, tunnel.RuleProviders())
+	currentConfig.Rules = parsed
+	currentRules = lines
+	return nil
+}
+
+func applyRuleOperation(lines []string, operation RuleOperation) ([]string, error) {
+	index := operation.Index
+	switch operation.Type {
+	case AddRuleOperation:
+		if index < 0 || index > len(lines) {
+			index = len(lines)
+		}
+		rule := strings.TrimSpace(operation.Rule)
+		if rule == "" {
+			return nil, errors.New("rule is empty")
+		}
+		lines = append(lines, "")
+		copy(lines[index+1:], lines[index:])
+		lines[index] = rule
+		return lines, nil
+	case RemoveRuleOperation:
+		if index < 0 || index >= len(lines) {
+			return nil, fmt.Errorf("index %d out of range", index)
+		}
+		return append(lines[:index], lines[index+1:]...), nil
+	case ReplaceRuleOperation:
+		if index < 0 || index >= len(lines) {
+			return nil, fmt.Errorf("index %d out of range", index)
+		}
+		rule := strings.TrimSpace(operation.Rule)
+		if rule == "" {
+			return nil, errors.New("rule is empty")
+		}
+		lines[index] = rule
+		return lines, nil
+	case MoveRuleOperation:
+		to := operation.To
+		if index < 0 || index >= len(lines) || to < 0 || to >= len(lines) {
+			return nil, fmt.Errorf("move %d to %d out of range", index, to)
+		}
+		rule := lines[index]
+		lines = append(lines[:index], lines[index+1:]...)
+		lines = append(lines, "")
+		copy(lines[to+1:], lines[to:])
+		lines[to] = rule
+		return lines, nil
+	default:
+		return nil, errors.New("unknown operation")
+	}
+}
+
+// parseRuleLine mirrors the rule parsing of the config package for a single line
+func parseRuleLine(line string, subRules map[string][]C.Rule) (C.Rule, error) {
+	rule := trimRuleFields(strings.Split(rewritePackageRule(line), ","))
+	var (
+		payload  string
+		target   string
+		params   []string
+		ruleName = strings.ToUpper(rule[0])
+	)
+
+	l := len(rule)
+	if l < 2 {
+		return nil, errors.New("format invalid")
+	}
+	switch ruleName {
+	case "NOT", "OR", "AND", "SUB-RULE", "DOMAIN-REGEX", "PROCESS-NAME-REGEX", "PROCESS-PATH-REGEX":
+		target = rule[l-1]
+		payload = strings.Join(rule[1:l-1], ",")
+	default:
+		if l < 4 {
+			rule = append(rule, make([]string, 4-l)...)
+		}
+		if ruleName == "MATCH" {
+			l = 2
+		}
+		if l >= 3 {
+			l = 3
+			payload = rule[1]
+		}
+		target = rule[l-1]
+		params = rule[l:]
+	}
+
+	if _, ok := tunnel.Proxies()[target]; !ok {
+		if ruleName != "SUB-RULE" {
+			return nil, fmt.Errorf("proxy [%s] not found", target)
+		} else if _, ok = subRules[target]; !ok {
+			return nil, fmt.Errorf("sub-rule [%s] not found", target)
+		}
+	}
+
+	return R.ParseRule(ruleName, payload, target, trimRuleFields(params), subRules)
+}
+
+func trimRuleFields(fields []string) []string {
+	trimmed := make([]string, 0, len(fields))
+	for _, field := range fields {
+		trimmed = append(trimmed, strings.Trim(field, " "))
+	}
+	return trimmed
+}
+
+func handlePatchRules(paramsString string) (string, error) {
+	var params = &PatchRulesParams{}
+	err := json.Unmarshal([]byte(paramsString), params)
+	if err != nil {
+		return "", err
+	}
+	lines, err := PatchRules(params.Operations)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(lines)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func handleGetRules() string {
+	runLock.Lock()
+	defer runLock.Unlock()
+	data, err := json.Marshal(currentRules)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/config"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+	"gopkg.in/yaml.v3"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	scriptsDir = "scripts"
+	// scriptTimeout bounds the wall time of one script run
+	scriptTimeout = 5 * time.Second
+	// scriptMaxSteps bounds the computation of one script run independent of the device speed
+	scriptMaxSteps = 50_000_000
+	scriptMaxSize  = 256 * 1024
+)
+
+type SetProfileScriptParams struct {
+	ProfileId string `json:"profile-id"`
+	Script    string `json:"script"`
+}
+
+type TestProfileScriptParams struct {
+	ProfileId string `json:"profile-id"`
+	// Script is run instead of the stored script when set
+	Script string `json:"script"`
+}
+
+// scriptFileOptions enables the dialect extensions that let scripts loop over proxies with while and sets
+var scriptFileOptions = &syntax.FileOptions{
+	Set:             true,
+	While:           true,
+	TopLevelControl: true,
+}
+
+// scriptModules are the only values predeclared for a script, it has no file or network access
+var scriptModules = starlark.StringDict{
+	"re": &starlarkstruct.Module{
+		Name: "re",
+		Members: starlark.StringDict{
+			"match":   starlark.NewBuiltin("re.match", scriptRegexMatch),
+			"sub":     starlark.NewBuiltin("re.sub", scriptRegexSub),
+			"findall": starlark.NewBuiltin("re.findall", scriptRegexFindAll),
+		},
+	},
+}
+
+func scriptPath(profileId string) (string, error) {
+	if profileId == "" || strings.ContainsAny(profileId, `/\`) || strings.Contains(profileId, "..") {
+		return "", errors.New("invalid profile id")
+	}
+	return filepath.Join(constant.Path.Resolve(scriptsDir), profileId+".star"), nil
+}
+
+// GetProfileScript loads the stored script of a profile, empty when none is set
+func GetProfileScript(profileId string) (string, error) {
+	path, err := scriptPath(profileId)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// SetProfileScript compiles and stores the script of a profile
+func SetProfileScript(profileId string, script string) error {
+	path, err := scriptPath(profileId)
+	if err != nil {
+		return err
+	}
+	if len(script) > scriptMaxSize {
+		return errors.New("script exceeds maximum size")
+	}
+	if _, _, err := starlark.SourceProgramOptions(scriptFileOptions, profileId+".star", script, scriptModules.Has); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(script), 0644)
+}
+
+// RemoveProfileScript deletes the script of a profile
+func RemoveProfileScript(profileId string) error {
+	path, err := scriptPath(profileId)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// RunProfileScript calls main(config) of script with the parsed profile and returns the yaml of its result
+func RunProfileScript(name string, script string, content []byte) ([]byte, error) {
+	profile := map[string]any{}
+	if err := yaml.Unmarshal(content, &profile); err != nil {
+		return nil, err
+	}
+	value, err := toStarlarkValue(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	thread := &starlark.Thread{
+		Name: name,
+		Print: func(_ *starlark.Thread, msg string) {
+			log.Infoln("[Script] %s: %s", name, msg)
+		},
+		Load: func(_ *starlark.Thread, module string) (starlark.StringDict, error) {
+			return nil, fmt.Errorf("load of %s is not allowed", module)
+		},
+	}
+	thread.SetMaxExecutionSteps(scriptMaxSteps)
+	timer := time.AfterFunc(scriptTimeout, func() {
+		thread.Cancel("script timed out")
+	})
+	defer timer.Stop()
+
+	globals, err := starlark.ExecFileOptions(scriptFileOptions, thread, name+".star", script, scriptModules)
+	if err != nil {
+		return nil, scriptError(err)
+	}
+	entry, ok := globals["main"].(starlark.Callable)
+	if !ok {
+		return nil, errors.New("script must define main(config)")
+	}
+	result, err := starlark.Call(thread, entry, starlark.Tuple{value}, nil)
+	if err != nil {
+		return nil, scriptError(err)
+	}
+	if result == starlark.None {
+		result = value
+	}
+	transformed, err := fromStarlarkValue(result)
+	if err != nil {
+		return nil, fmt.Errorf("script result: %v", err)
+	}
+	if _, ok := transformed.(map[string]any); !ok {
+		return nil, fmt.Errorf("script result: main must return a dict, got %s", result.Type())
+	}
+	return yaml.Marshal(transformed)
+}
+
+// scriptError keeps the starlark call stack, it points the user to the failing line
+func scriptError(err error) error {
+	var evalError *starlark.EvalError
+	if errors.As(err, &evalError) {
+		return errors.New(evalError.Backtrace())
+	}
+	return err
+}
+
+// applyProfileScript runs the stored script of profileId over content and validates the result
+func applyProfileScript(profileId string, content []byte) ([]byte, bool, error) {
+	script, err := GetProfileScript(profileId)
+	if err != nil || script == "" {
+		return content, false, err
+	}
+	transformed, err := RunProfileScript(profileId, script, content)
+	if err != nil {
+		return nil, false, fmt.Errorf("apply script: %v", err)
+	}
+	if _, err := config.UnmarshalRawConfig(transformed); err != nil {
+		clearBytes(transformed)
+		return nil, false, fmt.Errorf("apply script: %v", err)
+	}
+	return transformed, true, nil
+}
+
+func toStarlarkValue(value any) (starlark.Value, error) {
+	switch value := value.(type) {
+	case nil:
+		return starlark.None, nil
+	case bool:
+		return starlark.Bool(value), nil
+	case int:
+		return starlark.MakeInt(value), nil
+	case int64:
+		return starlark.MakeInt64(value), nil
+	case uint64:
+		return starlark.MakeUint64(value), nil
+	case float64:
+		return starlark.Float(value), nil
+	case string:
+		return starlark.String(value), nil
+	case []any:
+		elems := make([]starlark.Value, 0, len(value))
+		for _, item := range value {
+			elem, err := toStarlarkValue(item)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, elem)
+		}
+		return starlark.NewList(elems), nil
+	case map[string]any:
+		dict := starlark.NewDict(len(value))
+		for key, item := range value {
+			elem, err := toStarlarkValue(item)
+			if err != nil {
+				return nil, err
+			}
+			if err := dict.SetKey(starlark.String(key), elem); err != nil {
+				return nil, err
+			}
+		}
+		return dict, nil
+	case time.Time:
+		return starlark.String(value.Format(time.RFC3339)), nil
+	}
+	return nil, fmt.Errorf("unsupported value %T", value)
+}
+
+func fromStarlarkValue(value starlark.Value) (any, error) {
+	switch value := value.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(value), nil
+	case starlark.Int:
+		if i, ok := value.Int64(); ok {
+			return i, nil
+		}
+		return nil, fmt.Errorf("integer %s out of range", value)
+	case starlark.Float:
+		if math.IsNaN(float64(value)) || math.IsInf(float64(value), 0) {
+			return nil, fmt.Errorf("invalid float %s", value)
+		}
+		return float64(value), nil
+	case starlark.String:
+		return string(value), nil
+	case starlark.Indexable:
+		items := make([]any, 0, value.Len())
+		for i := 0; i < value.Len(); i++ {
+			item, err := fromStarlarkValue(value.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	case *starlark.Dict:
+		mapping := make(map[string]any, value.Len())
+		for _, item := range value.Items() {
+			key, ok := item[0].(starlark.String)
+			if !ok {
+				return nil, fmt.Errorf("dict key %s is not a string", item[0])
+			}
+			elem, err := fromStarlarkValue(item[1])
+			if err != nil {
+				return nil, err
+			}
+			mapping[string(key)] = elem
+		}
+		return mapping, nil
+	}
+	return nil, fmt.Errorf("unsupported value %s", value.Type())
+}
+
+func scriptRegexMatch(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var pattern, s string
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 2, &pattern, &s); err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn.Name(), err)
+	}
+	return starlark.Bool(re.MatchString(s)), nil
+}
+
+func scriptRegexSub(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var pattern, repl, s string
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 3, &pattern, &repl, &s); err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn.Name(), err)
+	}
+	return starlark.String(re.ReplaceAllString(s, repl)), nil
+}
+
+func scriptRegexFindAll(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var pattern, s string
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 2, &pattern, &s); err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn.Name(), err)
+	}
+	matches := re.FindAllString(s, -1)
+	elems := make([]starlark.Value, 0, len(matches))
+	for _, match := range matches {
+		elems = append(elems, starlark.String(match))
+	}
+	return starlark.NewList(elems), nil
+}
+
+func handleSetProfileScript(paramsString string) string {
+	var params = &SetProfileScriptParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err.Error()
+	}
+	var err error
+	if strings.TrimSpace(params.Script) == "" {
+		err = RemoveProfileScript(params.ProfileId)
+	} else {
+		err = SetProfileScript(params.ProfileId, params.Script)
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func handleGetProfileScript(profileId string) string {
+	script, err := GetProfileScript(profileId)
+	if err != nil {
+		return ""
+	}
+	return script
+}
+
+// handleTestProfileScript runs a script against the cached profile with its override, nothing is stored
+func handleTestProfileScript(paramsString string) (string, error) {
+	var params = &TestProfileScriptParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return "", err
+	}
+	script := params.Script
+	if script == "" {
+		var err error
+		if script, err = GetProfileScript(params.ProfileId); err != nil {
+			return "", err
+		}
+	}
+	var transformed []byte
+	err := WithSecureProfileContentReader(params.ProfileId, func(r io.Reader) error {
+		merged, _, err := applyOverrideReader(params.ProfileId, r)
+		if err != nil {
+			return err
+		}
+		defer clearBytes(merged)
+		transformed, err = RunProfileScript(params.ProfileId, script, merged)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	defer clearBytes(transformed)
+	if _, err := config.UnmarshalRawConfig(transformed); err != nil {
+		return "", err
+	}
+	return string(transformed), nil
+}
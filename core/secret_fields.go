@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/config"
+	"strings"
+)
+
+// encryptedValuePrefix marks profile values holding base64 of an encryption service payload
+const encryptedValuePrefix = "enc:"
+
+// secretProxyFields lists the proxy fields that may carry encrypted key material
+var secretProxyFields = map[string][]string{
+	"ssh": {"password", "private-key", "private-key-passphrase"},
+}
+
+// EncryptSecretValue encrypts a secret for embedding into a profile
+func EncryptSecretValue(value string) (string, error) {
+	if getEncryptionService() == nil {
+		return "", errNoKeyProvider
+	}
+	plain := []byte(value)
+	defer clearBytes(plain)
+	encrypted, err := getEncryptionService().Encrypt(plain)
+	if err != nil {
+		return "", err
+	}
+	return encryptedValuePrefix + base64.StdEncoding.EncodeToString(encrypted), nil
+}
+
+// decryptSecretValue returns values without prefix unchanged
+func decryptSecretValue(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedValuePrefix) {
+		return value, nil
+	}
+	if getEncryptionService() == nil {
+		return "", errNoKeyProvider
+	}
+	encrypted, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedValuePrefix))
+	if err != nil {
+		return "", err
+	}
+	if !HasEncryptionHeader(encrypted) {
+		return "", errors.New("missing encryption header")
+	}
+	plain, err := getEncryptionService().Decrypt(encrypted)
+	if err != nil {
+		return "", err
+	}
+	defer clearBytes(plain)
+	return string(plain), nil
+}
+
+// resolveSecretFields decrypts encrypted secret fields of the profile proxies in place right before parsing
+func resolveSecretFields(rawConfig *config.RawConfig) error {
+	for index, mapping := range rawConfig.Proxy {
+		if err := resolveProxySecrets(mapping); err != nil {
+			name, _ := mapping["name"].(string)
+			return fmt.Errorf("proxy[%d] %s %v", index, name, err)
+		}
+	}
+	return nil
+}
+
+func resolveProxySecrets(mapping map[string]any) error {
+	proxyType, _ := mapping["type"].(string)
+	for _, field := range secretProxyFields[proxyType] {
+		value, ok := mapping[field].(string)
+		if !ok {
+			continue
+		}
+		plain, err := decryptSecretValue(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", field, err)
+		}
+		mapping[field] = plain
+	}
+	return nil
+}
+
+func handleEncryptSecret(value string) (string, error) {
+	return EncryptSecretValue(value)
+}
@@ -1,23 +1,50 @@
 package main
 
 import (
+	"core/platform"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// SecureMemoryEntry represents an obfuscated memory entry
+// SecureMemoryEntry represents an AES-256-GCM sealed memory entry
 type SecureMemoryEntry struct {
 	obfuscatedData []byte
 	key            []byte
+	nonce          []byte
 	timestamp      int64
+	lastAccess     atomic.Int64
+	// readers stream the entry outside the lock of the cache, the last one wipes a cleared entry
+	readerMux sync.Mutex
+	readers   int
+	retired   bool
 }
 
+// acquire keeps the entry intact for a reader, called with the cache locked
+func (entry *SecureMemoryEntry) acquire() {
+	entry.readerMux.Lock()
+	entry.readers++
+	entry.readerMux.Unlock()
+}
+
+var errSecureEntryTampered = errors.New("secure cache entry failed integrity check")
+
 // SecureMemoryService manages secure in-memory storage of profile data
 type SecureMemoryService struct {
-	cache map[string]*SecureMemoryEntry
-	mutex sync.RWMutex
+	cache      map[string]*SecureMemoryEntry
+	encryption *EncryptionService
+	mutex      sync.RWMutex
+	cleanup    *secureCleanupTask
+	stats      SecureCleanupStats
+	limits     SecureCacheLimits
+	onEvicted  func(profileId string)
 }
 
 var (
@@ -28,55 +55,109 @@ var (
 // GetSecureMemoryService returns the singleton instance
 func GetSecureMemoryService() *SecureMemoryService {
 	secureMemoryOnce.Do(func() {
-		secureMemoryService = &SecureMemoryService{
-			cache: make(map[string]*SecureMemoryEntry),
-		}
+		secureMemoryService = NewSecureMemoryService(getEncryptionService())
+		secureMemoryService.SetEvictionCallback(func(profileId string) {
+			sendMessage(Message{
+				Type: SecureEvictedMessage,
+				Data: profileId,
+			})
+		})
 	})
 	return secureMemoryService
 }
 
-// StoreSecureProfile stores encrypted profile data in obfuscated format
+// NewSecureMemoryService creates a service decrypting profiles with the given encryption service
+func NewSecureMemoryService(encryption *EncryptionService) *SecureMemoryService {
+	return &SecureMemoryService{
+		cache:      make(map[string]*SecureMemoryEntry),
+		encryption: encryption,
+	}
+}
+
+// SetEncryptionService injects the encryption service used to decrypt profiles
+func (sms *SecureMemoryService) SetEncryptionService(encryption *EncryptionService) {
+	sms.mutex.Lock()
+	defer sms.mutex.Unlock()
+	sms.encryption = encryption
+}
+
+// StoreSecureProfile stores encrypted profile data sealed with a per-entry key
 func (sms *SecureMemoryService) StoreSecureProfile(profileId string, encryptedData []byte) error {
+	evicted, err := sms.storeSecureProfile(profileId, encryptedData)
+	sms.notifyEvicted(evicted)
+	return err
+}
+
+func (sms *SecureMemoryService) storeSecureProfile(profileId string, encryptedData []byte) ([]string, error) {
 	sms.mutex.Lock()
 	defer sms.mutex.Unlock()
 
-	// Generate random obfuscation key
-	obfuscationKey := make([]byte, 32)
-	if _, err := rand.Read(obfuscationKey); err != nil {
-		return fmt.Errorf("failed to generate obfuscation key: %v", err)
+	// Generate random per-entry key and nonce
+	entryKey := make([]byte, 32)
+	if _, err := rand.Read(entryKey); err != nil {
+		return nil, fmt.Errorf("failed to generate entry key: %v", err)
+	}
+	_ = platform.LockMemory(entryKey)
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		sms.releaseByteSlice(entryKey)
+		return nil, fmt.Errorf("failed to generate entry nonce: %v", err)
+	}
+
+	// Seal the encrypted data, binding it to the profile id
+	sealedData, err := sms.obfuscateData(profileId, encryptedData, entryKey, nonce)
+	if err != nil {
+		sms.releaseByteSlice(entryKey)
+		return nil, err
+	}
+	// the limit is on what the cache holds, the tags of the chunks included
+	if sms.limits.MaxBytes > 0 && int64(len(sealedData)) > sms.limits.MaxBytes {
+		sms.releaseByteSlice(entryKey)
+		return nil, fmt.Errorf("profile %s exceeds secure cache limit of %d bytes", profileId, sms.limits.MaxBytes)
 	}
 
-	// Apply obfuscation to the encrypted data
-	obfuscatedData := sms.obfuscateData(encryptedData, obfuscationKey)
+	if old, exists := sms.cache[profileId]; exists {
+		sms.clearEntry(old)
+	}
 
-	sms.cache[profileId] = &SecureMemoryEntry{
-		obfuscatedData: obfuscatedData,
-		key:            obfuscationKey,
+	entry := &SecureMemoryEntry{
+		obfuscatedData: sealedData,
+		key:            entryKey,
+		nonce:          nonce,
 		timestamp:      time.Now().UnixMilli(),
 	}
+	entry.lastAccess.Store(time.Now().UnixNano())
+	sms.cache[profileId] = entry
 
-	return nil
+	return sms.evictLocked(profileId), nil
 }
 
 // WithSecureProfile provides temporary access to decrypted profile data
 func (sms *SecureMemoryService) WithSecureProfile(profileId string, operation func([]byte) error) error {
 	sms.mutex.RLock()
 	entry, exists := sms.cache[profileId]
-	sms.mutex.RUnlock()
-
 	if !exists {
+		sms.mutex.RUnlock()
 		return fmt.Errorf("profile %s not found in secure cache", profileId)
 	}
+	entry.lastAccess.Store(time.Now().UnixNano())
 
-	// De-obfuscate the data
-	encryptedData := sms.deobfuscateData(entry.obfuscatedData, entry.key)
+	// Open the sealed data, rejecting tampered entries
+	encryptedData, err := sms.deobfuscateData(profileId, entry)
+	encryption := sms.encryption
+	sms.mutex.RUnlock()
+	if err != nil {
+		sms.clearTampered(profileId, entry)
+		return fmt.Errorf("profile %s: %v", profileId, err)
+	}
+	_ = platform.LockMemory(encryptedData)
+	defer sms.releaseByteSlice(encryptedData)
 
 	// Decrypt using encryption service
 	var decryptedData []byte
-	var err error
-	
-	if encryptionService != nil {
-		decryptedData, err = encryptionService.Decrypt(encryptedData)
+
+	if encryption != nil {
+		decryptedData, err = encryption.Decrypt(encryptedData)
 		if err != nil {
 			return fmt.Errorf("failed to decrypt profile: %v", err)
 		}
@@ -86,11 +167,13 @@ func (sms *SecureMemoryService) WithSecureProfile(profileId string, operation fu
 	}
 
 	// Execute operation with decrypted data
+	_ = platform.LockMemory(decryptedData)
 	defer func() {
 		// Clear decrypted data from memory immediately after use
 		for i := range decryptedData {
 			decryptedData[i] = 0
 		}
+		platform.UnlockMemory(decryptedData)
 	}()
 
 	return operation(decryptedData)
@@ -111,8 +194,7 @@ func (sms *SecureMemoryService) ClearSecureProfile(profileId string) {
 
 	if entry, exists := sms.cache[profileId]; exists {
 		// Clear sensitive data
-		sms.clearByteSlice(entry.obfuscatedData)
-		sms.clearByteSlice(entry.key)
+		sms.clearEntry(entry)
 		delete(sms.cache, profileId)
 	}
 }
@@ -123,54 +205,124 @@ func (sms *SecureMemoryService) ClearAllSecureCache() {
 	defer sms.mutex.Unlock()
 
 	for _, entry := range sms.cache {
-		sms.clearByteSlice(entry.obfuscatedData)
-		sms.clearByteSlice(entry.key)
+		sms.clearEntry(entry)
 	}
 	sms.cache = make(map[string]*SecureMemoryEntry)
 }
 
-// CleanupExpiredEntries removes entries older than maxAgeMinutes
-func (sms *SecureMemoryService) CleanupExpiredEntries(maxAgeMinutes int) {
+// CleanupExpiredEntries removes entries older than maxAgeMinutes and returns how many were purged
+func (sms *SecureMemoryService) CleanupExpiredEntries(maxAgeMinutes int) int {
+	return sms.cleanupOlderThan(time.Duration(maxAgeMinutes) * time.Minute)
+}
+
+// cleanupOlderThan removes entries older than maxAge
+func (sms *SecureMemoryService) cleanupOlderThan(maxAge time.Duration) int {
 	sms.mutex.Lock()
 	defer sms.mutex.Unlock()
 
-	maxAge := int64(maxAgeMinutes * 60 * 1000) // Convert to milliseconds
+	maxAgeMillis := maxAge.Milliseconds()
 	now := time.Now().UnixMilli()
+	purged := 0
 
 	for profileId, entry := range sms.cache {
-		if now-entry.timestamp > maxAge {
-			sms.clearByteSlice(entry.obfuscatedData)
-			sms.clearByteSlice(entry.key)
+		if now-entry.timestamp > maxAgeMillis {
+			sms.clearEntry(entry)
 			delete(sms.cache, profileId)
+			purged++
 		}
 	}
+	return purged
 }
 
-// obfuscateData applies XOR-based obfuscation with salt
-func (sms *SecureMemoryService) obfuscateData(data, key []byte) []byte {
-	obfuscated := make([]byte, len(data))
-	for i, b := range data {
-		keyByte := key[i%len(key)]
-		saltByte := sms.generateSalt(i)
-		obfuscated[i] = b ^ keyByte ^ saltByte
+// obfuscateData seals data with AES-256-GCM in chunks bound to the profile id
+func (sms *SecureMemoryService) obfuscateData(profileId string, data, key, nonce []byte) ([]byte, error) {
+	aead, err := sms.newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	chunks := len(data)/secureChunkSize + 1
+	sealed := make([]byte, 0, len(data)+chunks*aead.Overhead())
+	for index, offset := uint64(0), 0; ; index++ {
+		end := offset + secureChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		final := end == len(data)
+		sealed = aead.Seal(sealed, chunkNonce(nonce, index), data[offset:end], chunkAdditionalData(profileId, index, final))
+		if final {
+			return sealed, nil
+		}
+		offset = end
 	}
-	return obfuscated
 }
 
-// deobfuscateData reverses the obfuscation
-func (sms *SecureMemoryService) deobfuscateData(obfuscatedData, key []byte) []byte {
-	data := make([]byte, len(obfuscatedData))
-	for i, b := range obfuscatedData {
-		keyByte := key[i%len(key)]
-		saltByte := sms.generateSalt(i)
-		data[i] = b ^ keyByte ^ saltByte
+// deobfuscateData opens a sealed entry and verifies its integrity
+func (sms *SecureMemoryService) deobfuscateData(profileId string, entry *SecureMemoryEntry) ([]byte, error) {
+	reader, err := sms.newChunkReader(profileId, entry)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.close()
+	data := make([]byte, 0, reader.plainSize())
+	for {
+		chunk, err := reader.next()
+		if err == io.EOF {
+			return data, nil
+		}
+		if err != nil {
+			clearBytes(data)
+			return nil, err
+		}
+		data = append(data, chunk...)
 	}
-	return data
 }
 
-// generateSalt creates position-based salt
-func (sms *SecureMemoryService) generateSalt(position int) byte {
-	return byte((position*31 + 17) & 0xFF)
+// newAEAD creates an AES-256-GCM cipher for the given key
+func (sms *SecureMemoryService) newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create entry cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create entry cipher: %v", err)
+	}
+	return aead, nil
+}
+
+// clearEntry securely clears all key material of an entry, or leaves that to its last reader
+func (sms *SecureMemoryService) clearEntry(entry *SecureMemoryEntry) {
+	entry.readerMux.Lock()
+	if entry.readers > 0 {
+		entry.retired = true
+		entry.readerMux.Unlock()
+		return
+	}
+	entry.readerMux.Unlock()
+	sms.wipeEntry(entry)
+}
+
+// release ends a read of acquire, wiping the entry when it was cleared meanwhile
+func (sms *SecureMemoryService) release(entry *SecureMemoryEntry) {
+	entry.readerMux.Lock()
+	entry.readers--
+	wipe := entry.readers == 0 && entry.retired
+	entry.readerMux.Unlock()
+	if wipe {
+		sms.wipeEntry(entry)
+	}
+}
+
+func (sms *SecureMemoryService) wipeEntry(entry *SecureMemoryEntry) {
+	sms.clearByteSlice(entry.obfuscatedData)
+	sms.releaseByteSlice(entry.key)
+	sms.clearByteSlice(entry.nonce)
+}
+
+// releaseByteSlice clears a byte slice and unpins it from physical memory
+func (sms *SecureMemoryService) releaseByteSlice(slice []byte) {
+	sms.clearByteSlice(slice)
+	platform.UnlockMemory(slice)
 }
 
 // clearByteSlice securely clears a byte slice
@@ -194,8 +346,32 @@ func SecureReadProfileFile(profileId, path string) error {
 	return sms.StoreSecureProfile(profileId, encryptedData)
 }
 
-// WithSecureProfileContent provides secure access to profile content
+// WithSecureProfileContent provides secure access to profile content, the loaders of the core use
+// WithSecureProfileContentReader so the plaintext is never whole in memory
 func WithSecureProfileContent(profileId string, operation func([]byte) error) error {
 	sms := GetSecureMemoryService()
 	return sms.WithSecureProfile(profileId, operation)
-} 
\ No newline at end of file
+}
+
+// SecureMemoryCapabilities reports which memory hardening features are active
+type SecureMemoryCapabilities struct {
+	MemoryLockSupported bool   `json:"memory-lock-supported"`
+	MemoryLockActive    bool   `json:"memory-lock-active"`
+	KeyProvider         string `json:"key-provider"`
+}
+
+func handleGetSecureMemoryCapabilities() string {
+	capabilities := SecureMemoryCapabilities{
+		MemoryLockSupported: platform.MemoryLockSupported(),
+		MemoryLockActive:    platform.MemoryLockActive(),
+		KeyProvider:         "none",
+	}
+	if getEncryptionService() != nil {
+		capabilities.KeyProvider = getEncryptionService().ProviderName()
+	}
+	data, err := json.Marshal(capabilities)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
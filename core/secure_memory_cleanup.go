@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/metacubex/mihomo/log"
+	"math/rand"
+	"time"
+)
+
+// SecureCleanupStats reports the activity of the automatic cleanup
+type SecureCleanupStats struct {
+	Running     bool  `json:"running"`
+	Runs        int64 `json:"runs"`
+	PurgedTotal int64 `json:"purged-total"`
+	LastPurged  int   `json:"last-purged"`
+	LastRunAt   int64 `json:"last-run-at"`
+	Entries     int   `json:"entries"`
+	Bytes       int64 `json:"bytes"`
+}
+
+type SecureCleanupParams struct {
+	Interval int64 `json:"interval"`
+	MaxAge   int64 `json:"max-age"`
+}
+
+// secureCleanupTask tracks the running cleanup goroutine
+type secureCleanupTask struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// StartAutoCleanup periodically purges entries older than maxAge until ctx is done or StopAutoCleanup is called
+func (sms *SecureMemoryService) StartAutoCleanup(ctx context.Context, interval, maxAge time.Duration) {
+	if interval <= 0 {
+		sms.StopAutoCleanup()
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	task := &secureCleanupTask{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	// the task is swapped in under the lock, whoever replaces a task stops it so none is left running
+	sms.mutex.Lock()
+	previous := sms.cleanup
+	sms.cleanup = task
+	sms.stats.Running = true
+	sms.mutex.Unlock()
+	previous.stop()
+
+	go func() {
+		defer close(task.done)
+		defer func() {
+			sms.mutex.Lock()
+			if sms.cleanup == task {
+				sms.cleanup = nil
+				sms.stats.Running = false
+			}
+			sms.mutex.Unlock()
+		}()
+
+		timer := time.NewTimer(powerScaled(jitterInterval(interval)))
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+				purged := sms.cleanupOlderThan(maxAge)
+				sms.recordCleanup(purged)
+				if purged > 0 {
+					log.Debugln("[SecureMemory] purged %d expired entries", purged)
+				}
+				timer.Reset(powerScaled(jitterInterval(interval)))
+			}
+		}
+	}()
+}
+
+// StopAutoCleanup stops the cleanup goroutine and waits for it to exit
+func (sms *SecureMemoryService) StopAutoCleanup() {
+	sms.mutex.Lock()
+	task := sms.cleanup
+	sms.cleanup = nil
+	sms.stats.Running = false
+	sms.mutex.Unlock()
+	task.stop()
+}
+
+// stop cancels the task and waits for its goroutine, the lock of the cache must not be held
+func (task *secureCleanupTask) stop() {
+	if task == nil {
+		return
+	}
+	task.cancel()
+	<-task.done
+}
+
+// CleanupStats returns a snapshot of the cleanup metrics
+func (sms *SecureMemoryService) CleanupStats() SecureCleanupStats {
+	sms.mutex.RLock()
+	defer sms.mutex.RUnlock()
+	stats := sms.stats
+	stats.Entries = len(sms.cache)
+	stats.Bytes = sms.cacheBytesLocked()
+	return stats
+}
+
+func (sms *SecureMemoryService) recordCleanup(purged int) {
+	sms.mutex.Lock()
+	defer sms.mutex.Unlock()
+	sms.stats.Runs++
+	sms.stats.PurgedTotal += int64(purged)
+	sms.stats.LastPurged = purged
+	sms.stats.LastRunAt = time.Now().UnixMilli()
+}
+
+// jitterInterval spreads runs by up to ±10% of the interval
+func jitterInterval(interval time.Duration) time.Duration {
+	spread := int64(interval) / 5
+	if spread <= 0 {
+		return interval
+	}
+	return interval - time.Duration(spread/2) + time.Duration(rand.Int63n(spread))
+}
+
+func handleStartSecureCleanup(paramsString string) string {
+	var params = &SecureCleanupParams{}
+	err := json.Unmarshal([]byte(paramsString), params)
+	if err != nil {
+		return err.Error()
+	}
+	GetSecureMemoryService().StartAutoCleanup(
+		context.Background(),
+		time.Duration(params.Interval)*time.Millisecond,
+		time.Duration(params.MaxAge)*time.Millisecond,
+	)
+	return ""
+}
+
+func handleStopSecureCleanup() bool {
+	GetSecureMemoryService().StopAutoCleanup()
+	return true
+}
+
+func handleGetSecureCleanupStats() string {
+	data, err := json.Marshal(GetSecureMemoryService().CleanupStats())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,103 @@
+package main
+
+import "encoding/json"
+
+// SecureCacheLimits caps the size of the secure cache; zero disables a limit
+type SecureCacheLimits struct {
+	MaxBytes   int64 `json:"max-bytes"`
+	MaxEntries int   `json:"max-entries"`
+}
+
+// SetCacheLimits applies new limits, evicting least recently used entries if needed
+func (sms *SecureMemoryService) SetCacheLimits(limits SecureCacheLimits) {
+	sms.mutex.Lock()
+	sms.limits = limits
+	evicted := sms.evictLocked("")
+	sms.mutex.Unlock()
+	sms.notifyEvicted(evicted)
+}
+
+// SetEvictionCallback registers a callback invoked for every evicted profile
+func (sms *SecureMemoryService) SetEvictionCallback(callback func(profileId string)) {
+	sms.mutex.Lock()
+	defer sms.mutex.Unlock()
+	sms.onEvicted = callback
+}
+
+// CacheSize returns the number of entries and sealed bytes held in the cache
+func (sms *SecureMemoryService) CacheSize() (int, int64) {
+	sms.mutex.RLock()
+	defer sms.mutex.RUnlock()
+	return len(sms.cache), sms.cacheBytesLocked()
+}
+
+func (sms *SecureMemoryService) cacheBytesLocked() int64 {
+	var total int64
+	for _, entry := range sms.cache {
+		total += int64(len(entry.obfuscatedData))
+	}
+	return total
+}
+
+// evictLocked removes least recently used entries until the cache fits its limits, sparing keep
+func (sms *SecureMemoryService) evictLocked(keep string) []string {
+	if sms.limits.MaxBytes <= 0 && sms.limits.MaxEntries <= 0 {
+		return nil
+	}
+	var evicted []string
+	total := sms.cacheBytesLocked()
+	for sms.overLimitLocked(total) {
+		victim := ""
+		var oldest int64
+		for profileId, entry := range sms.cache {
+			if profileId == keep {
+				continue
+			}
+			if access := entry.lastAccess.Load(); victim == "" || access < oldest {
+				victim, oldest = profileId, access
+			}
+		}
+		if victim == "" {
+			break
+		}
+		entry := sms.cache[victim]
+		total -= int64(len(entry.obfuscatedData))
+		sms.clearEntry(entry)
+		delete(sms.cache, victim)
+		evicted = append(evicted, victim)
+	}
+	return evicted
+}
+
+func (sms *SecureMemoryService) overLimitLocked(total int64) bool {
+	if sms.limits.MaxEntries > 0 && len(sms.cache) > sms.limits.MaxEntries {
+		return true
+	}
+	return sms.limits.MaxBytes > 0 && total > sms.limits.MaxBytes
+}
+
+// notifyEvicted invokes the eviction callback outside of the cache lock
+func (sms *SecureMemoryService) notifyEvicted(evicted []string) {
+	if len(evicted) == 0 {
+		return
+	}
+	sms.mutex.RLock()
+	callback := sms.onEvicted
+	sms.mutex.RUnlock()
+	if callback == nil {
+		return
+	}
+	for _, profileId := range evicted {
+		callback(profileId)
+	}
+}
+
+func handleSetSecureCacheLimits(paramsString string) string {
+	var limits = SecureCacheLimits{}
+	err := json.Unmarshal([]byte(paramsString), &limits)
+	if err != nil {
+		return err.Error()
+	}
+	GetSecureMemoryService().SetCacheLimits(limits)
+	return ""
+}
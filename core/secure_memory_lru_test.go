@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// storeAccessed stores the profiles in order, each one accessed later than the one before
+func storeAccessed(t *testing.T, sms *SecureMemoryService, size int, profileIds ...string) {
+	t.Helper()
+	for i, profileId := range profileIds {
+		if err := sms.StoreSecureProfile(profileId, bytes.Repeat([]byte{'x'}, size)); err != nil {
+			t.Fatal(err)
+		}
+		sms.mutex.RLock()
+		sms.cache[profileId].lastAccess.Store(int64(i + 1))
+		sms.mutex.RUnlock()
+	}
+}
+
+func cachedProfiles(sms *SecureMemoryService) []string {
+	sms.mutex.RLock()
+	defer sms.mutex.RUnlock()
+	profileIds := make([]string, 0, len(sms.cache))
+	for profileId := range sms.cache {
+		profileIds = append(profileIds, profileId)
+	}
+	sort.Strings(profileIds)
+	return profileIds
+}
+
+func TestSecureCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	sms := NewSecureMemoryService(nil)
+	var evicted []string
+	sms.SetEvictionCallback(func(profileId string) {
+		evicted = append(evicted, profileId)
+	})
+	sms.SetCacheLimits(SecureCacheLimits{MaxEntries: 2})
+	storeAccessed(t, sms, 10, "a", "b")
+	// reading a makes b the least recently used
+	if _, err := readSecureProfile(sms, "a"); err != nil {
+		t.Fatal(err)
+	}
+	storeAccessed(t, sms, 10, "c")
+	if got := cachedProfiles(sms); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Fatalf("cache holds %v after eviction", got)
+	}
+	if !reflect.DeepEqual(evicted, []string{"b"}) {
+		t.Fatalf("evicted %v, want [b]", evicted)
+	}
+}
+
+func TestSecureCacheEvictsByBytes(t *testing.T) {
+	sms := NewSecureMemoryService(nil)
+	storeAccessed(t, sms, 100, "a", "b", "c")
+	_, total := sms.CacheSize()
+	sms.SetCacheLimits(SecureCacheLimits{MaxBytes: total - 1})
+	if got := cachedProfiles(sms); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Fatalf("cache holds %v after shrinking", got)
+	}
+	entries, size := sms.CacheSize()
+	if entries != 2 || size > total-1 {
+		t.Fatalf("cache has %d entries of %d bytes over the limit of %d", entries, size, total-1)
+	}
+}
+
+func TestSecureCacheSparesTheStoredProfile(t *testing.T) {
+	sms := NewSecureMemoryService(nil)
+	storeAccessed(t, sms, 100, "a")
+	_, size := sms.CacheSize()
+	sms.SetCacheLimits(SecureCacheLimits{MaxBytes: size + 50})
+	// b alone fits, it pushes a out instead of being evicted as the newest entry
+	if err := sms.StoreSecureProfile("b", bytes.Repeat([]byte{'x'}, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if got := cachedProfiles(sms); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Fatalf("cache holds %v", got)
+	}
+	if err := sms.StoreSecureProfile("c", bytes.Repeat([]byte{'x'}, 200)); err == nil {
+		t.Fatal("stored a profile over the byte limit")
+	}
+	if got := cachedProfiles(sms); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Fatalf("a rejected profile changed the cache to %v", got)
+	}
+}
+
+func TestSecureCacheWithoutLimits(t *testing.T) {
+	sms := NewSecureMemoryService(nil)
+	storeAccessed(t, sms, 10, "a", "b", "c")
+	sms.SetCacheLimits(SecureCacheLimits{})
+	if entries, _ := sms.CacheSize(); entries != 3 {
+		t.Fatalf("cache without limits evicted down to %d entries", entries)
+	}
+}
+
+func TestSecureCacheLimitCountsTheSealedSize(t *testing.T) {
+	sms := NewSecureMemoryService(nil)
+	sms.SetCacheLimits(SecureCacheLimits{MaxBytes: 100})
+	// the plain text fits the limit, the tag of the chunk does not
+	if err := sms.StoreSecureProfile("a", bytes.Repeat([]byte{'x'}, 100)); err == nil {
+		t.Fatal("stored a profile whose sealed size is over the limit")
+	}
+	if entries, _ := sms.CacheSize(); entries != 0 {
+		t.Fatalf("cache holds %d entries", entries)
+	}
+}
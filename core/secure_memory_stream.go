@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// secureChunkSize is the plaintext size of one sealed chunk
+const secureChunkSize = 64 * 1024
+
+// chunkNonce derives the nonce of a chunk from the entry nonce
+func chunkNonce(base []byte, index uint64) []byte {
+	nonce := make([]byte, len(base))
+	copy(nonce, base)
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], index)
+	for i := range counter {
+		nonce[len(nonce)-len(counter)+i] ^= counter[i]
+	}
+	return nonce
+}
+
+// chunkAdditionalData binds a chunk to its profile, position and finality to prevent reordering and truncation
+func chunkAdditionalData(profileId string, index uint64, final bool) []byte {
+	data := make([]byte, 0, len(profileId)+9)
+	data = append(data, profileId...)
+	data = binary.BigEndian.AppendUint64(data, index)
+	if final {
+		return append(data, 1)
+	}
+	return append(data, 0)
+}
+
+// secureChunkReader opens the chunks of a sealed entry one at a time
+type secureChunkReader struct {
+	aead      cipher.AEAD
+	profileId string
+	nonce     []byte
+	sealed    []byte
+	offset    int
+	index     uint64
+	buf       []byte
+	pending   []byte
+	read      int64
+	done      bool
+	tampered  bool
+}
+
+func (sms *SecureMemoryService) newChunkReader(profileId string, entry *SecureMemoryEntry) (*secureChunkReader, error) {
+	aead, err := sms.newAEAD(entry.key)
+	if err != nil {
+		return nil, err
+	}
+	return &secureChunkReader{
+		aead:      aead,
+		profileId: profileId,
+		nonce:     entry.nonce,
+		sealed:    entry.obfuscatedData,
+	}, nil
+}
+
+// plainSize returns the total size of the opened data
+func (r *secureChunkReader) plainSize() int {
+	sealedChunk := secureChunkSize + r.aead.Overhead()
+	chunks := (len(r.sealed) + sealedChunk - 1) / sealedChunk
+	return len(r.sealed) - chunks*r.aead.Overhead()
+}
+
+// next opens the following chunk; the returned slice is only valid until the next call
+func (r *secureChunkReader) next() ([]byte, error) {
+	clearBytes(r.buf)
+	if r.done {
+		return nil, io.EOF
+	}
+	size := secureChunkSize + r.aead.Overhead()
+	if remaining := len(r.sealed) - r.offset; remaining < size {
+		size = remaining
+	}
+	final := r.offset+size == len(r.sealed)
+	chunk := r.sealed[r.offset : r.offset+size]
+	var err error
+	r.buf, err = r.aead.Open(r.buf[:0], chunkNonce(r.nonce, r.index), chunk, chunkAdditionalData(r.profileId, r.index, final))
+	if err != nil {
+		r.tampered = true
+		r.done = true
+		return nil, errSecureEntryTampered
+	}
+	r.offset += size
+	r.index++
+	r.done = final
+	return r.buf, nil
+}
+
+func (r *secureChunkReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		chunk, err := r.next()
+		if err != nil {
+			return 0, err
+		}
+		r.pending = chunk
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	r.read += int64(n)
+	return n, nil
+}
+
+// openChunk opens the chunk at index on its own, the reading position stays where it is
+func (r *secureChunkReader) openChunk(index int) ([]byte, error) {
+	sealedChunk := secureChunkSize + r.aead.Overhead()
+	offset := index * sealedChunk
+	end := offset + sealedChunk
+	if end > len(r.sealed) {
+		end = len(r.sealed)
+	}
+	final := end == len(r.sealed)
+	plain, err := r.aead.Open(nil, chunkNonce(r.nonce, uint64(index)), r.sealed[offset:end], chunkAdditionalData(r.profileId, uint64(index), final))
+	if err != nil {
+		r.tampered = true
+		return nil, errSecureEntryTampered
+	}
+	return plain, nil
+}
+
+// tail returns the last n bytes of the data and how many are left to read, the decryption picks its
+// key by them without reading the entry twice
+func (r *secureChunkReader) tail(n int) ([]byte, int64, error) {
+	sealedChunk := secureChunkSize + r.aead.Overhead()
+	last := (len(r.sealed) - 1) / sealedChunk
+	if last < 0 {
+		return nil, 0, nil
+	}
+	tail, err := r.openChunk(last)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(tail) < n && last > 0 {
+		previous, err := r.openChunk(last - 1)
+		if err != nil {
+			clearBytes(tail)
+			return nil, 0, err
+		}
+		joined := append(previous, tail...)
+		clearBytes(tail)
+		tail = joined
+	}
+	if len(tail) > n {
+		kept := append([]byte{}, tail[len(tail)-n:]...)
+		clearBytes(tail)
+		tail = kept
+	}
+	return tail, int64(r.plainSize()) - r.read, nil
+}
+
+func (r *secureChunkReader) close() {
+	clearBytes(r.buf)
+	r.pending = nil
+}
+
+// WithSecureProfileReader streams decrypted profile data to operation chunk by chunk,
+// so the plaintext never exists contiguously in memory. The cache is not locked while
+// operation runs, a profile cleared meanwhile is wiped once the read is done.
+func (sms *SecureMemoryService) WithSecureProfileReader(profileId string, operation func(io.Reader) error) error {
+	sms.mutex.RLock()
+	entry, exists := sms.cache[profileId]
+	if !exists {
+		sms.mutex.RUnlock()
+		return fmt.Errorf("profile %s not found in secure cache", profileId)
+	}
+	entry.lastAccess.Store(time.Now().UnixNano())
+	entry.acquire()
+	encryption := sms.encryption
+	sms.mutex.RUnlock()
+	defer sms.release(entry)
+
+	reader, err := sms.newChunkReader(profileId, entry)
+	if err != nil {
+		return err
+	}
+	if encryption != nil {
+		err = encryption.DecryptReader(reader, operation)
+	} else {
+		err = operation(reader)
+	}
+	reader.close()
+
+	if reader.tampered {
+		sms.clearTampered(profileId, entry)
+		return fmt.Errorf("profile %s: %v", profileId, errSecureEntryTampered)
+	}
+	return err
+}
+
+// clearTampered drops the entry that failed, a profile stored again meanwhile is kept
+func (sms *SecureMemoryService) clearTampered(profileId string, entry *SecureMemoryEntry) {
+	sms.mutex.Lock()
+	defer sms.mutex.Unlock()
+	if sms.cache[profileId] == entry {
+		sms.clearEntry(entry)
+		delete(sms.cache, profileId)
+	}
+}
+
+// readAllSecure reads r to the end, the buffers outgrown on the way are cleared
+func readAllSecure(r io.Reader) ([]byte, error) {
+	buf := make([]byte, 0, 4096)
+	for {
+		if len(buf) == cap(buf) {
+			grown := make([]byte, len(buf), 2*cap(buf))
+			copy(grown, buf)
+			clearBytes(buf)
+			buf = grown
+		}
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF {
+			return buf, nil
+		}
+		if err != nil {
+			clearBytes(buf)
+			return nil, err
+		}
+	}
+}
+
+// WithSecureProfileContentReader provides streaming access to profile content
+func WithSecureProfileContentReader(profileId string, operation func(io.Reader) error) error {
+	return GetSecureMemoryService().WithSecureProfileReader(profileId, operation)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// secureTestProfile spans three chunks, the last one short
+func secureTestProfile() []byte {
+	data := make([]byte, 2*secureChunkSize+100)
+	for i := range data {
+		data[i] = byte('a' + i%26)
+	}
+	return data
+}
+
+func readSecureProfile(sms *SecureMemoryService, profileId string) ([]byte, error) {
+	var data []byte
+	err := sms.WithSecureProfile(profileId, func(plain []byte) error {
+		data = append([]byte{}, plain...)
+		return nil
+	})
+	return data, err
+}
+
+func streamSecureProfile(sms *SecureMemoryService, profileId string) ([]byte, error) {
+	var data []byte
+	err := sms.WithSecureProfileReader(profileId, func(r io.Reader) error {
+		var err error
+		data, err = io.ReadAll(r)
+		return err
+	})
+	return data, err
+}
+
+func assertTampered(t *testing.T, sms *SecureMemoryService, profileId string, err error) {
+	t.Helper()
+	if err == nil || !strings.Contains(err.Error(), errSecureEntryTampered.Error()) {
+		t.Fatalf("tampered entry was opened: %v", err)
+	}
+	if sms.IsProfileSecured(profileId) {
+		t.Fatal("tampered entry stayed in the cache")
+	}
+}
+
+func TestSecureProfileRoundTrip(t *testing.T) {
+	profile := secureTestProfile()
+	services := map[string]*SecureMemoryService{
+		"plain":     NewSecureMemoryService(nil),
+		"encrypted": NewSecureMemoryService(NewEncryptionService(NewStaticKeyProvider(strings.Repeat("k", 32)))),
+	}
+	for name, sms := range services {
+		stored := profile
+		if sms.encryption != nil {
+			var err error
+			if stored, err = sms.encryption.Encrypt(profile); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := sms.StoreSecureProfile("p", stored); err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(sms.cache["p"].obfuscatedData, profile[:64]) {
+			t.Fatalf("%s: sealed entry holds the profile", name)
+		}
+		data, err := readSecureProfile(sms, "p")
+		if err != nil || !bytes.Equal(data, profile) {
+			t.Fatalf("%s: read %d bytes: %v", name, len(data), err)
+		}
+		data, err = streamSecureProfile(sms, "p")
+		if err != nil || !bytes.Equal(data, profile) {
+			t.Fatalf("%s: streamed %d bytes: %v", name, len(data), err)
+		}
+	}
+}
+
+func TestSecureProfileRejectsTamperedChunks(t *testing.T) {
+	sms := NewSecureMemoryService(nil)
+	sealedChunk := secureChunkSize + 16
+	for _, offset := range []int{0, sealedChunk + 7, 2*sealedChunk + 50, -1} {
+		for _, read := range []func(*SecureMemoryService, string) ([]byte, error){readSecureProfile, streamSecureProfile} {
+			if err := sms.StoreSecureProfile("p", secureTestProfile()); err != nil {
+				t.Fatal(err)
+			}
+			sealed := sms.cache["p"].obfuscatedData
+			if offset < 0 {
+				// the tag of the final chunk
+				sealed[len(sealed)-1] ^= 1
+			} else {
+				sealed[offset] ^= 1
+			}
+			_, err := read(sms, "p")
+			assertTampered(t, sms, "p", err)
+		}
+	}
+}
+
+func TestSecureProfileRejectsTruncation(t *testing.T) {
+	sms := NewSecureMemoryService(nil)
+	sealedChunk := secureChunkSize + 16
+	if err := sms.StoreSecureProfile("p", secureTestProfile()); err != nil {
+		t.Fatal(err)
+	}
+	// the chunks left are intact, only the final one is missing
+	entry := sms.cache["p"]
+	entry.obfuscatedData = entry.obfuscatedData[:2*sealedChunk]
+	_, err := readSecureProfile(sms, "p")
+	assertTampered(t, sms, "p", err)
+}
+
+func TestSecureProfileIsBoundToItsId(t *testing.T) {
+	sms := NewSecureMemoryService(nil)
+	if err := sms.StoreSecureProfile("p", secureTestProfile()); err != nil {
+		t.Fatal(err)
+	}
+	sms.cache["q"] = sms.cache["p"]
+	delete(sms.cache, "p")
+	_, err := streamSecureProfile(sms, "q")
+	assertTampered(t, sms, "q", err)
+}
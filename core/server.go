@@ -8,9 +8,20 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
 )
 
-var conn net.Conn
+var (
+	conn      net.Conn
+	connMutex sync.RWMutex
+)
+
+// setConn points the results and the messages at c, the daemon swaps it as apps come and go
+func setConn(c net.Conn) {
+	connMutex.Lock()
+	conn = c
+	connMutex.Unlock()
+}
 
 func (result ActionResult) send() {
 	data, err := result.Json()
@@ -21,38 +32,58 @@ func (result ActionResult) send() {
 }
 
 func sendMessage(message Message) {
+	grpcServer.Publish(message)
+	triggers.Publish(message)
+	remote.Publish(message)
+	if eventBus.PublishMessage(message) {
+		return
+	}
+	postMessage(message)
+}
+
+func postMessage(message Message) {
 	result := ActionResult{
 		Method: messageMethod,
-		Data:   message,
+		Data:   bridgeEncoding.Message(message),
 	}
 	result.send()
 }
 
 func send(data []byte) {
-	if conn == nil {
+	connMutex.RLock()
+	c := conn
+	connMutex.RUnlock()
+	if c == nil {
 		return
 	}
-	_, _ = conn.Write(append(data, []byte("\n")...))
+	_, _ = c.Write(append(data, []byte("\n")...))
 }
 
 func startServer(arg string) {
 
 	_, err := strconv.Atoi(arg)
 
+	var c net.Conn
 	if err != nil {
-		conn, err = net.Dial("unix", arg)
+		c, err = net.Dial("unix", arg)
 	} else {
-		conn, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%s", arg))
+		c, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%s", arg))
 	}
 	if err != nil {
 		panic(err.Error())
 	}
+	setConn(c)
 
 	defer func(conn net.Conn) {
 		_ = conn.Close()
-	}(conn)
+	}(c)
+
+	serveConn(c, nil)
+}
 
-	reader := bufio.NewReader(conn)
+// serveConn runs the actions read from c until it closes, check refuses the ones the peer may not call
+func serveConn(c net.Conn, check func(method Method) error) {
+	reader := bufio.NewReader(c)
 
 	for {
 		data, err := reader.ReadString('\n')
@@ -72,6 +103,13 @@ func startServer(arg string) {
 			Method: action.Method,
 		}
 
+		if check != nil {
+			if err = check(action.Method); err != nil {
+				result.error(err.Error())
+				continue
+			}
+		}
+
 		go handleAction(action, result)
 	}
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+)
+
+const (
+	coreServiceName        = "flclash-core"
+	coreServiceDisplayName = "FlClash Core"
+	coreServiceDescription = "Keeps the FlClash proxy and tun running while the app is closed"
+)
+
+var errServiceUnsupported = errors.New("system service is not supported on this platform")
+
+// daemonMode and controlSocket are set when the core runs as a system service behind the control
+// socket, the controller then refuses what would open the privileged core to the network
+var (
+	daemonMode    = false
+	controlSocket = ""
+	// daemonUser is the sid of the user allowed to connect on windows besides the administrators
+	daemonUser = ""
+)
+
+// ServiceParams installs the core as a system service listening on Socket, Uid and Gid pick the
+// user and the group allowed to connect to it besides root, User is that user on windows and
+// defaults to the one installing
+type ServiceParams struct {
+	Socket string `json:"socket"`
+	Home   string `json:"home"`
+	Uid    *int   `json:"uid"`
+	Gid    *int   `json:"gid"`
+	User   string `json:"user"`
+}
+
+type ServiceStatus struct {
+	Supported bool   `json:"supported"`
+	Installed bool   `json:"installed"`
+	Running   bool   `json:"running"`
+	Daemon    bool   `json:"daemon"`
+	Socket    string `json:"socket"`
+	Error     string `json:"error,omitempty"`
+}
+
+// daemonArgs is the command line the service manager starts the core with
+func daemonArgs(params *ServiceParams) []string {
+	args := []string{"daemon", "-socket", params.Socket}
+	if params.Home != "" {
+		args = append(args, "-home", params.Home)
+	}
+	if params.Uid != nil {
+		args = append(args, "-uid", strconv.Itoa(*params.Uid))
+	}
+	if params.Gid != nil {
+		args = append(args, "-gid", strconv.Itoa(*params.Gid))
+	}
+	if params.User != "" {
+		args = append(args, "-user", params.User)
+	}
+	return args
+}
+
+// runUntilSignal runs the daemon until the service manager terminates it
+func runUntilSignal(run func(stop <-chan struct{})) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	stop := make(chan struct{})
+	go func() {
+		<-signals
+		close(stop)
+	}()
+	run(stop)
+	return nil
+}
+
+func handleInstallService(paramsString string) error {
+	var params = &ServiceParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	if params.Socket == "" {
+		params.Socket = defaultDaemonSocket()
+	}
+	executable, err := coreExecutable()
+	if err != nil {
+		return err
+	}
+	return installService(executable, params)
+}
+
+func handleUninstallService() error {
+	return uninstallService()
+}
+
+func handleStartService() error {
+	return startService()
+}
+
+func handleStopService() error {
+	return stopService()
+}
+
+func handleGetServiceStatus() string {
+	status := &ServiceStatus{Daemon: daemonMode, Socket: controlSocket}
+	if status.Socket == "" {
+		status.Socket = defaultDaemonSocket()
+	}
+	installed, running, err := serviceState()
+	status.Installed, status.Running = installed, running
+	status.Supported = !errors.Is(err, errServiceUnsupported)
+	if err != nil {
+		status.Error = err.Error()
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
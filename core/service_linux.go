@@ -0,0 +1,156 @@
+//go:build linux && !android
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	systemdUnitDir          = "/etc/systemd/system"
+	defaultDaemonSocketPath = "/run/flclash/core.sock"
+)
+
+func defaultDaemonSocket() string {
+	return defaultDaemonSocketPath
+}
+
+func systemdQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\") {
+		return arg
+	}
+	return strconv.Quote(arg)
+}
+
+func systemdUnitPath(name string) string {
+	return systemdUnitDir + "/" + name + ".service"
+}
+
+// systemdUnit runs the core with the capabilities the tun, the redir and tproxy listeners and
+// the routing marks need
+func systemdUnit(description string, executable string, execArgs []string) string {
+	args := []string{systemdQuote(executable)}
+	for _, arg := range execArgs {
+		args = append(args, systemdQuote(arg))
+	}
+	return fmt.Sprintf(`[Unit]
+Description=%s
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=simple
+ExecStart=%s
+Restart=on-failure
+RestartSec=3
+AmbientCapabilities=CAP_NET_ADMIN CAP_NET_BIND_SERVICE CAP_NET_RAW
+CapabilityBoundingSet=CAP_NET_ADMIN CAP_NET_BIND_SERVICE CAP_NET_RAW CAP_CHOWN CAP_FOWNER CAP_DAC_OVERRIDE
+
+[Install]
+WantedBy=multi-user.target
+`, description, strings.Join(args, " "))
+}
+
+func systemctl(args ...string) (string, error) {
+	output, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("systemctl %s: %v %s", args[0], err, strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// installSystemdUnit writes the unit and enables it for the next boots
+func installSystemdUnit(name string, unit string) error {
+	if _, err := exec.LookPath("systemctl"); err != nil {
+		return errServiceUnsupported
+	}
+	if err := os.WriteFile(systemdUnitPath(name), []byte(unit), 0644); err != nil {
+		return err
+	}
+	if _, err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	_, err := systemctl("enable", name)
+	return err
+}
+
+func removeSystemdUnit(name string) error {
+	if _, err := os.Stat(systemdUnitPath(name)); os.IsNotExist(err) {
+		return nil
+	}
+	_, _ = systemctl("disable", "--now", name)
+	if err := os.Remove(systemdUnitPath(name)); err != nil {
+		return err
+	}
+	_, err := systemctl("daemon-reload")
+	return err
+}
+
+func installService(executable string, params *ServiceParams) error {
+	return installSystemdUnit(coreServiceName, systemdUnit(coreServiceDescription, executable, daemonArgs(params)))
+}
+
+func uninstallService() error {
+	return removeSystemdUnit(coreServiceName)
+}
+
+func startService() error {
+	_, err := systemctl("start", coreServiceName)
+	return err
+}
+
+func stopService() error {
+	_, err := systemctl("stop", coreServiceName)
+	return err
+}
+
+func serviceState() (bool, bool, error) {
+	if _, err := exec.LookPath("systemctl"); err != nil {
+		return false, false, errServiceUnsupported
+	}
+	if _, err := os.Stat(systemdUnitPath(coreServiceName)); err != nil {
+		return false, false, nil
+	}
+	// is-active exits non zero for every state but active
+	output, _ := exec.Command("systemctl", "is-active", coreServiceName).Output()
+	return true, strings.TrimSpace(string(output)) == "active", nil
+}
+
+func runDaemonService(run func(stop <-chan struct{})) error {
+	return runUntilSignal(run)
+}
+
+// daemonPeerUid reads the user of the process on the other end of the control socket
+func daemonPeerUid(c net.Conn) (int, error) {
+	unixConn, ok := c.(*net.UnixConn)
+	if !ok {
+		return -1, errors.New("not a unix socket")
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return -1, err
+	}
+	return int(cred.Uid), nil
+}
+
+func prepareControlDir(dir string) error {
+	return os.MkdirAll(dir, 0755)
+}
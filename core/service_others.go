@@ -0,0 +1,45 @@
+//go:build !windows && (!linux || android)
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+)
+
+func defaultDaemonSocket() string {
+	return filepath.Join(os.TempDir(), coreServiceName+".sock")
+}
+
+func installService(_ string, _ *ServiceParams) error {
+	return errServiceUnsupported
+}
+
+func uninstallService() error {
+	return errServiceUnsupported
+}
+
+func startService() error {
+	return errServiceUnsupported
+}
+
+func stopService() error {
+	return errServiceUnsupported
+}
+
+func serviceState() (bool, bool, error) {
+	return false, false, errServiceUnsupported
+}
+
+func runDaemonService(run func(stop <-chan struct{})) error {
+	return runUntilSignal(run)
+}
+
+func daemonPeerUid(_ net.Conn) (int, error) {
+	return -1, nil
+}
+
+func prepareControlDir(dir string) error {
+	return os.MkdirAll(dir, 0755)
+}
@@ -0,0 +1,289 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+	"unsafe"
+)
+
+const (
+	serviceStopTimeout = 10 * time.Second
+	// sioAfUnixGetPeerPid is SIO_AF_UNIX_GETPEERPID, _WSAIOR(IOC_VENDOR, 256)
+	sioAfUnixGetPeerPid = 0x58000100
+	// daemonAppUid stands for the app user, any uid but root is kept to the user methods
+	daemonAppUid = 1
+)
+
+func defaultDaemonSocket() string {
+	base := os.Getenv("ProgramData")
+	if base == "" {
+		base = `C:\ProgramData`
+	}
+	return filepath.Join(base, "FlClash", "core.sock")
+}
+
+func openCoreService() (*mgr.Mgr, *mgr.Service, error) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := m.OpenService(coreServiceName)
+	if err != nil {
+		_ = m.Disconnect()
+		return nil, nil, err
+	}
+	return m, s, nil
+}
+
+func installService(executable string, params *ServiceParams) error {
+	if params.User == "" {
+		user, err := windows.GetCurrentProcessToken().GetTokenUser()
+		if err != nil {
+			return err
+		}
+		params.User = user.User.Sid.String()
+	}
+	if err := secureControlDir(filepath.Dir(params.Socket), params.User); err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(coreServiceName); err == nil {
+		s.Close()
+		return errors.New("service is already installed")
+	}
+	s, err := m.CreateService(coreServiceName, executable, mgr.Config{
+		DisplayName: coreServiceDisplayName,
+		Description: coreServiceDescription,
+		StartType:   mgr.StartAutomatic,
+	}, daemonArgs(params)...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 3 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 10 * time.Second},
+	}, 60)
+}
+
+func uninstallService() error {
+	m, s, err := openCoreService()
+	if errors.Is(err, windows.ERROR_SERVICE_DOES_NOT_EXIST) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	defer s.Close()
+	_ = stopCoreService(s)
+	return s.Delete()
+}
+
+func startService() error {
+	m, s, err := openCoreService()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	defer s.Close()
+	return s.Start()
+}
+
+// stopCoreService asks the service to stop and waits for it to
+func stopCoreService(s *mgr.Service) error {
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(serviceStopTimeout)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return errors.New("timeout waiting for the service to stop")
+		}
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func stopService() error {
+	m, s, err := openCoreService()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	defer s.Close()
+	return stopCoreService(s)
+}
+
+func serviceState() (bool, bool, error) {
+	m, s, err := openCoreService()
+	if errors.Is(err, windows.ERROR_SERVICE_DOES_NOT_EXIST) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	defer m.Disconnect()
+	defer s.Close()
+	status, err := s.Query()
+	if err != nil {
+		return true, false, err
+	}
+	return true, status.State == svc.Running, nil
+}
+
+type daemonService struct {
+	run func(stop <-chan struct{})
+}
+
+func (d *daemonService) Execute(_ []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		d.run(stop)
+		close(done)
+	}()
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				changes <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				close(stop)
+				<-done
+				return false, 0
+			}
+		case <-done:
+			return false, 0
+		}
+	}
+}
+
+// runDaemonService hands the daemon to the service control manager when it started the core
+func runDaemonService(run func(stop <-chan struct{})) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return err
+	}
+	if !isService {
+		return runUntilSignal(run)
+	}
+	return svc.Run(coreServiceName, &daemonService{run: run})
+}
+
+// secureControlDir leaves the directory of the socket to system, the administrators and user, the
+// acl is protected so nothing is inherited from ProgramData
+func secureControlDir(dir string, user string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	sddl := "D:P(A;OICI;FA;;;SY)(A;OICI;FA;;;BA)"
+	if user != "" {
+		sid, err := windows.StringToSid(user)
+		if err != nil {
+			return fmt.Errorf("invalid user sid %s: %v", user, err)
+		}
+		sddl += "(A;OICI;FRFWFX;;;" + sid.String() + ")"
+	}
+	descriptor, err := windows.SecurityDescriptorFromString(sddl)
+	if err != nil {
+		return err
+	}
+	dacl, _, err := descriptor.DACL()
+	if err != nil {
+		return err
+	}
+	return windows.SetNamedSecurityInfo(dir, windows.SE_FILE_OBJECT,
+		windows.DACL_SECURITY_INFORMATION|windows.PROTECTED_DACL_SECURITY_INFORMATION, nil, nil, dacl, nil)
+}
+
+func prepareControlDir(dir string) error {
+	return secureControlDir(dir, daemonUser)
+}
+
+// daemonPeerUid asks the socket for the process on the other end and reads its token, system and
+// elevated administrators are root, the app user is daemonAppUid and anyone else is refused
+func daemonPeerUid(c net.Conn) (int, error) {
+	unixConn, ok := c.(*net.UnixConn)
+	if !ok {
+		return -1, errors.New("not a unix socket")
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	var pid uint32
+	var ioctlErr error
+	err = raw.Control(func(fd uintptr) {
+		var returned uint32
+		ioctlErr = windows.WSAIoctl(windows.Handle(fd), sioAfUnixGetPeerPid, nil, 0,
+			(*byte)(unsafe.Pointer(&pid)), uint32(unsafe.Sizeof(pid)), &returned, nil, 0)
+	})
+	if err == nil {
+		err = ioctlErr
+	}
+	if err != nil {
+		return -1, err
+	}
+	process, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return -1, err
+	}
+	defer windows.CloseHandle(process)
+	var token windows.Token
+	if err = windows.OpenProcessToken(process, windows.TOKEN_QUERY, &token); err != nil {
+		return -1, err
+	}
+	defer token.Close()
+	user, err := token.GetTokenUser()
+	if err != nil {
+		return -1, err
+	}
+	system, err := windows.CreateWellKnownSid(windows.WinLocalSystemSid)
+	if err != nil {
+		return -1, err
+	}
+	if user.User.Sid.Equals(system) {
+		return 0, nil
+	}
+	if token.IsElevated() {
+		administrators, err := windows.CreateWellKnownSid(windows.WinBuiltinAdministratorsSid)
+		if err != nil {
+			return -1, err
+		}
+		groups, err := token.GetTokenGroups()
+		if err != nil {
+			return -1, err
+		}
+		for _, group := range groups.AllGroups() {
+			if group.Attributes&windows.SE_GROUP_ENABLED != 0 && group.Sid.Equals(administrators) {
+				return 0, nil
+			}
+		}
+	}
+	if daemonUser != "" && user.User.Sid.String() == daemonUser {
+		return daemonAppUid, nil
+	}
+	return -1, fmt.Errorf("peer %s is not the user of the app", user.User.Sid.String())
+}
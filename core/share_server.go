@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/metacubex/mihomo/component/ca"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	shareServerDir         = "share"
+	defaultShareServerAddr = "0.0.0.0:7895"
+	pacContentType         = "application/x-ns-proxy-autoconfig"
+)
+
+// ShareServerParams serves the proxy auto-config and the files of the share directory to the
+// devices of the lan, every url starts with the token since pac clients cannot send headers
+type ShareServerParams struct {
+	Enable bool   `json:"enable"`
+	Listen string `json:"listen"`
+	Token  string `json:"token"`
+	TLS    bool   `json:"tls"`
+}
+
+type ShareServerStatus struct {
+	ShareServerParams
+	Address string `json:"address,omitempty"`
+	PacPath string `json:"pac-path"`
+	Dir     string `json:"dir"`
+	Warning string `json:"warning,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type ShareServer struct {
+	mutex    sync.Mutex
+	params   ShareServerParams
+	server   *http.Server
+	listener net.Listener
+	err      error
+}
+
+var shareServer = &ShareServer{}
+
+func newShareToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+func shareDir() string {
+	return constant.Path.Resolve(shareServerDir)
+}
+
+// requestHost is the address of the core as the device sees it, the pac points back at it
+func requestHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		return r.Host
+	}
+	return host
+}
+
+func (s *ShareServer) token() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.params.Token
+}
+
+func (s *ShareServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := chi.URLParam(r, "token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.token())) != 1 {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func handleSharePac(w http.ResponseWriter, r *http.Request) {
+	port, mixed := pacProxyPort()
+	result, err := compilePac(requestHost(r), port, mixed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", pacContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write([]byte(result.Pac))
+}
+
+func (s *ShareServer) router() http.Handler {
+	r := chi.NewRouter()
+	r.Route("/{token}", func(r chi.Router) {
+		r.Use(s.authorize)
+		r.Get("/proxy.pac", handleSharePac)
+		r.Get("/wpad.dat", handleSharePac)
+		r.Get("/files/*", func(w http.ResponseWriter, r *http.Request) {
+			prefix := "/" + chi.URLParam(r, "token") + "/files"
+			http.StripPrefix(prefix, http.FileServer(http.Dir(shareDir()))).ServeHTTP(w, r)
+		})
+	})
+	return r
+}
+
+func (s *ShareServer) stopLocked() {
+	if s.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_ = s.server.Shutdown(ctx)
+	s.server = nil
+	s.listener = nil
+}
+
+func (s *ShareServer) startLocked() error {
+	listener, err := net.Listen("tcp", s.params.Listen)
+	if err != nil {
+		return err
+	}
+	if s.params.TLS {
+		runLock.Lock()
+		certificate, privateKey := "", ""
+		if currentConfig != nil {
+			certificate, privateKey = currentConfig.TLS.Certificate, currentConfig.TLS.PrivateKey
+		}
+		runLock.Unlock()
+		if certificate == "" || privateKey == "" {
+			_ = listener.Close()
+			return errors.New("tls needs the certificate and private-key of the profile")
+		}
+		cert, err := ca.LoadTLSKeyPair(certificate, privateKey, constant.Path)
+		if err != nil {
+			_ = listener.Close()
+			return err
+		}
+		listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+	server := &http.Server{Handler: s.router(), ReadHeaderTimeout: 10 * time.Second}
+	s.server = server
+	s.listener = listener
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Warnln("[Share] serve error: %v", err)
+		}
+	}()
+	log.Infoln("[Share] listening at %s", listener.Addr().String())
+	return nil
+}
+
+// Set restarts the server with the params, an empty token keeps the current one or makes a new one
+func (s *ShareServer) Set(params *ShareServerParams) error {
+	if params.Listen == "" {
+		params.Listen = defaultShareServerAddr
+	}
+	if _, _, err := net.SplitHostPort(params.Listen); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if params.Token == "" {
+		params.Token = s.params.Token
+	}
+	if params.Token == "" {
+		token, err := newShareToken()
+		if err != nil {
+			return err
+		}
+		params.Token = token
+	}
+	s.stopLocked()
+	s.params = *params
+	s.err = nil
+	if !params.Enable {
+		return nil
+	}
+	if err := os.MkdirAll(shareDir(), 0755); err != nil {
+		return err
+	}
+	if err := s.startLocked(); err != nil {
+		s.err = err
+		return err
+	}
+	return nil
+}
+
+func (s *ShareServer) Status() *ShareServerStatus {
+	s.mutex.Lock()
+	status := &ShareServerStatus{ShareServerParams: s.params, Dir: shareDir()}
+	if s.params.Token != "" {
+		status.PacPath = "/" + s.params.Token + "/proxy.pac"
+	}
+	if s.listener != nil {
+		status.Address = s.listener.Addr().String()
+	}
+	if s.err != nil {
+		status.Error = s.err.Error()
+	}
+	s.mutex.Unlock()
+	runLock.Lock()
+	if currentConfig != nil && !currentConfig.General.AllowLan && status.Enable {
+		status.Warning = "allow-lan is off, lan devices cannot use the proxy the pac points at"
+	}
+	runLock.Unlock()
+	return status
+}
+
+func (s *ShareServer) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stopLocked()
+}
+
+func handleSetShareServer(paramsString string) error {
+	var params = &ShareServerParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	params.Token = strings.TrimSpace(params.Token)
+	return shareServer.Set(params)
+}
+
+func handleGetShareServer() string {
+	data, err := json.Marshal(shareServer.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,601 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/metacubex/mihomo/adapter"
+	"github.com/metacubex/mihomo/adapter/outboundgroup"
+	"github.com/metacubex/mihomo/config"
+	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	"github.com/metacubex/sing/common/buf"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	smartGroupType         = "smart"
+	smartScoreWeightsKey   = "score-weights"
+	smartToleranceKey      = "score-tolerance"
+	defaultSmartInterval   = 15 * time.Second
+	defaultSmartTolerance  = 0.1
+	smartFailureAlpha      = 0.2
+	smartThroughputAlpha   = 0.3
+	smartThroughputWindow  = 10 * time.Minute
+	minSmartThroughputSize = 64 * 1024
+)
+
+// SmartWeights mixes the normalized metrics of a member into its score, a missing weight counts as 0
+type SmartWeights struct {
+	RTT        float64 `json:"rtt"`
+	Jitter     float64 `json:"jitter"`
+	Failure    float64 `json:"failure"`
+	Throughput float64 `json:"throughput"`
+}
+
+var defaultSmartWeights = SmartWeights{RTT: 1, Jitter: 0.5, Failure: 2, Throughput: 1}
+
+type SmartGroupOption struct {
+	Weights SmartWeights `json:"weights"`
+	// Tolerance keeps the current member until another one scores this share better
+	Tolerance float64 `json:"tolerance"`
+}
+
+type SmartGroupParams struct {
+	Name string `json:"name"`
+	*SmartGroupOption
+}
+
+type SmartMemberScore struct {
+	Name       string  `json:"name"`
+	Alive      bool    `json:"alive"`
+	RTT        float64 `json:"rtt"`
+	Jitter     float64 `json:"jitter"`
+	Failure    float64 `json:"failure"`
+	Throughput float64 `json:"throughput"`
+	Score      float64 `json:"score"`
+}
+
+type SmartGroupStatus struct {
+	Name      string             `json:"name"`
+	Now       string             `json:"now"`
+	Option    SmartGroupOption   `json:"option"`
+	Evaluated int64              `json:"evaluated"`
+	Members   []SmartMemberScore `json:"members"`
+}
+
+type smartMetrics struct {
+	dials        int
+	failure      float64
+	throughput   float64
+	throughputAt time.Time
+}
+
+type smartState struct {
+	mutex     sync.Mutex
+	metrics   map[string]*smartMetrics
+	selected  string
+	scores    []SmartMemberScore
+	evaluated time.Time
+}
+
+func (s *smartState) metricsLocked(name string) *smartMetrics {
+	metrics, ok := s.metrics[name]
+	if !ok {
+		metrics = &smartMetrics{}
+		s.metrics[name] = metrics
+	}
+	return metrics
+}
+
+func (s *smartState) recordDial(name string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	metrics := s.metricsLocked(name)
+	failed := 0.0
+	if err != nil {
+		failed = 1
+	}
+	if metrics.dials == 0 {
+		metrics.failure = failed
+	} else {
+		metrics.failure += smartFailureAlpha * (failed - metrics.failure)
+	}
+	metrics.dials++
+}
+
+// recordThroughput keeps a moving average of the download rate of bulk connections, short
+// connections say little about the bandwidth of a member
+func (s *smartState) recordThroughput(name string, bytes int64, elapsed time.Duration) {
+	if bytes < minSmartThroughputSize || elapsed <= 0 {
+		return
+	}
+	rate := float64(bytes) / elapsed.Seconds()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	metrics := s.metricsLocked(name)
+	if metrics.throughputAt.IsZero() || time.Since(metrics.throughputAt) > smartThroughputWindow {
+		metrics.throughput = rate
+	} else {
+		metrics.throughput += smartThroughputAlpha * (rate - metrics.throughput)
+	}
+	metrics.throughputAt = time.Now()
+}
+
+// SmartGroups scores the members of the smart groups of a profile, such a group is handed to
+// mihomo as url-test so it keeps its health checks and the core picks the member on top
+type SmartGroups struct {
+	mutex     sync.Mutex
+	profile   map[string]*SmartGroupOption
+	overrides map[string]*SmartGroupOption
+	states    map[string]*smartState
+	running   bool
+}
+
+var smartGroups = &SmartGroups{
+	profile:   map[string]*SmartGroupOption{},
+	overrides: map[string]*SmartGroupOption{},
+	states:    map[string]*smartState{},
+}
+
+func rawSmartWeights(value any) (SmartWeights, bool) {
+	mapping, ok := value.(map[string]any)
+	if !ok {
+		return defaultSmartWeights, false
+	}
+	weight := func(key string) float64 {
+		switch value := mapping[key].(type) {
+		case int:
+			return float64(value)
+		case uint64:
+			return float64(value)
+		case float64:
+			return value
+		}
+		return 0
+	}
+	return SmartWeights{
+		RTT:        weight("rtt"),
+		Jitter:     weight("jitter"),
+		Failure:    weight("failure"),
+		Throughput: weight("throughput"),
+	}, true
+}
+
+func checkSmartGroupOption(option *SmartGroupOption) error {
+	weights := option.Weights
+	if weights.RTT < 0 || weights.Jitter < 0 || weights.Failure < 0 || weights.Throughput < 0 {
+		return fmt.Errorf("score weights must not be negative")
+	}
+	if weights.RTT+weights.Jitter+weights.Failure+weights.Throughput == 0 {
+		option.Weights = defaultSmartWeights
+	}
+	if option.Tolerance < 0 || option.Tolerance >= 1 {
+		option.Tolerance = defaultSmartTolerance
+	}
+	return nil
+}
+
+// Prepare turns the smart groups of the profile into url-test groups and keeps their options
+func (s *SmartGroups) Prepare(rawConfig *config.RawConfig) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.profile = map[string]*SmartGroupOption{}
+	for _, mapping := range rawConfig.ProxyGroup {
+		name, _ := mapping["name"].(string)
+		if groupType, _ := mapping["type"].(string); name == "" || groupType != smartGroupType {
+			continue
+		}
+		weights, _ := rawSmartWeights(mapping[smartScoreWeightsKey])
+		option := &SmartGroupOption{Weights: weights, Tolerance: defaultSmartTolerance}
+		if tolerance, ok := mapping[smartToleranceKey].(float64); ok {
+			option.Tolerance = tolerance
+		}
+		delete(mapping, smartScoreWeightsKey)
+		delete(mapping, smartToleranceKey)
+		mapping["type"] = "url-test"
+		if err := checkSmartGroupOption(option); err != nil {
+			log.Warnln("[SmartGroup] %s: %v", name, err)
+			option.Weights = defaultSmartWeights
+		}
+		s.profile[name] = option
+	}
+	for name := range s.states {
+		if _, ok := s.profile[name]; !ok {
+			delete(s.states, name)
+		}
+	}
+}
+
+func (s *SmartGroups) optionLocked(name string) *SmartGroupOption {
+	if option, ok := s.overrides[name]; ok {
+		if _, ok := s.profile[name]; ok {
+			return option
+		}
+	}
+	return s.profile[name]
+}
+
+// Set replaces the option of a smart group until the next profile, a nil option restores the profile
+func (s *SmartGroups) Set(params *SmartGroupParams) error {
+	if params.SmartGroupOption != nil {
+		if err := checkSmartGroupOption(params.SmartGroupOption); err != nil {
+			return err
+		}
+	}
+	runLock.Lock()
+	defer runLock.Unlock()
+	s.mutex.Lock()
+	if _, ok := s.profile[params.Name]; !ok {
+		s.mutex.Unlock()
+		return fmt.Errorf("smart group %s not found", params.Name)
+	}
+	if params.SmartGroupOption == nil {
+		delete(s.overrides, params.Name)
+	} else {
+		s.overrides[params.Name] = params.SmartGroupOption
+	}
+	s.mutex.Unlock()
+	rewrapOutboundsLocked()
+	return nil
+}
+
+func (s *SmartGroups) wrap(name string, proxy C.ProxyAdapter) C.ProxyAdapter {
+	group, ok := proxy.(*outboundgroup.URLTest)
+	if !ok {
+		return proxy
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	option := s.optionLocked(name)
+	if option == nil {
+		return proxy
+	}
+	state, ok := s.states[name]
+	if !ok {
+		state = &smartState{metrics: map[string]*smartMetrics{}}
+		s.states[name] = state
+	}
+	testUrl := ""
+	if data, err := group.MarshalJSON(); err == nil {
+		var snapshot struct {
+			TestUrl string `json:"testUrl"`
+		}
+		_ = json.Unmarshal(data, &snapshot)
+		testUrl = snapshot.TestUrl
+	}
+	if !s.running {
+		s.running = true
+		go s.run()
+	}
+	return &smartAdapter{ProxyAdapter: proxy, name: name, option: option, state: state, testUrl: testUrl}
+}
+
+func (s *SmartGroups) adapters() []*smartAdapter {
+	var adapters []*smartAdapter
+	for _, proxy := range tunnel.Proxies() {
+		outbound, ok := proxy.(*adapter.Proxy)
+		if !ok {
+			continue
+		}
+		if wrapped, ok := findWrapped[*smartAdapter](outbound.ProxyAdapter); ok {
+			adapters = append(adapters, wrapped)
+		}
+	}
+	return adapters
+}
+
+// run re-evaluates every smart group in the background so a switch does not wait for a dial
+func (s *SmartGroups) run() {
+	for {
+		time.Sleep(powerScaled(defaultSmartInterval))
+		runGuarded("smart-group", func() {
+			for _, wrapped := range s.adapters() {
+				wrapped.evaluate(false)
+			}
+		})
+	}
+}
+
+func (s *SmartGroups) Status() []SmartGroupStatus {
+	adapters := s.adapters()
+	status := make([]SmartGroupStatus, 0, len(adapters))
+	for _, wrapped := range adapters {
+		wrapped.state.mutex.Lock()
+		group := SmartGroupStatus{
+			Name:    wrapped.name,
+			Now:     wrapped.state.selected,
+			Option:  *wrapped.option,
+			Members: append([]SmartMemberScore{}, wrapped.state.scores...),
+		}
+		if !wrapped.state.evaluated.IsZero() {
+			group.Evaluated = wrapped.state.evaluated.UnixMilli()
+		}
+		wrapped.state.mutex.Unlock()
+		status = append(status, group)
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Name < status[j].Name
+	})
+	return status
+}
+
+type smartAdapter struct {
+	C.ProxyAdapter
+	name    string
+	option  *SmartGroupOption
+	state   *smartState
+	testUrl string
+}
+
+func (a *smartAdapter) Inner() C.ProxyAdapter {
+	return a.ProxyAdapter
+}
+
+func (a *smartAdapter) GetProxies(touch bool) []C.Proxy {
+	return a.ProxyAdapter.(*outboundgroup.URLTest).GetProxies(touch)
+}
+
+// delayStats returns the mean and the mean deviation of the successful tests and the share of
+// failed ones in the delay history of the group url, the default history stands in until it has one
+func (a *smartAdapter) delayStats(proxy C.Proxy) (rtt, jitter, failure float64, ok bool) {
+	history := proxy.ExtraDelayHistories()[a.testUrl].History
+	if len(history) == 0 {
+		history = proxy.DelayHistory()
+	}
+	var delays []float64
+	for _, item := range history {
+		if item.Delay == 0 {
+			failure++
+			continue
+		}
+		delays = append(delays, float64(item.Delay))
+	}
+	if len(history) == 0 {
+		return 0, 0, 0, false
+	}
+	failure /= float64(len(history))
+	for _, delay := range delays {
+		rtt += delay
+	}
+	if len(delays) != 0 {
+		rtt /= float64(len(delays))
+	}
+	for i := 1; i < len(delays); i++ {
+		jitter += math.Abs(delays[i] - delays[i-1])
+	}
+	if len(delays) > 1 {
+		jitter /= float64(len(delays) - 1)
+	}
+	return rtt, jitter, failure, len(delays) != 0
+}
+
+// evaluate scores the members, every metric is scaled by the worst member so the weights mix
+// shares, a lower score is better
+func (a *smartAdapter) evaluate(touch bool) C.Proxy {
+	members := a.GetProxies(touch)
+	if len(members) == 0 {
+		return nil
+	}
+	scores := make([]SmartMemberScore, len(members))
+	var maxRTT, maxJitter, maxThroughput float64
+	a.state.mutex.Lock()
+	defer a.state.mutex.Unlock()
+	now := time.Now()
+	for i, member := range members {
+		score := SmartMemberScore{Name: member.Name(), Alive: member.AliveForTestUrl(a.testUrl)}
+		rtt, jitter, failure, tested := a.delayStats(member)
+		if !tested {
+			rtt = math.NaN()
+		}
+		score.RTT, score.Jitter, score.Failure = rtt, jitter, failure
+		if metrics, ok := a.state.metrics[member.Name()]; ok {
+			if metrics.dials != 0 {
+				score.Failure = (score.Failure + metrics.failure) / 2
+			}
+			if now.Sub(metrics.throughputAt) <= smartThroughputWindow {
+				score.Throughput = metrics.throughput
+			}
+		}
+		if tested {
+			maxRTT = math.Max(maxRTT, rtt)
+		}
+		maxJitter = math.Max(maxJitter, jitter)
+		maxThroughput = math.Max(maxThroughput, score.Throughput)
+		scores[i] = score
+	}
+	weights := a.option.Weights
+	total := weights.RTT + weights.Jitter + weights.Failure + weights.Throughput
+	share := func(value, max float64) float64 {
+		if max <= 0 {
+			return 0
+		}
+		return value / max
+	}
+	for i := range scores {
+		score := &scores[i]
+		rtt := 1.0
+		if !math.IsNaN(score.RTT) {
+			rtt = share(score.RTT, maxRTT)
+		} else {
+			score.RTT = 0
+		}
+		// members without a sample stay neutral on throughput
+		throughput := 0.5
+		if maxThroughput > 0 {
+			throughput = 1 - share(score.Throughput, maxThroughput)
+		}
+		score.Score = (weights.RTT*rtt + weights.Jitter*share(score.Jitter, maxJitter) +
+			weights.Failure*score.Failure + weights.Throughput*throughput) / total
+		if !score.Alive {
+			score.Score += 1
+		}
+	}
+	best := 0
+	current := -1
+	for i := range scores {
+		if scores[i].Score < scores[best].Score {
+			best = i
+		}
+		if scores[i].Name == a.state.selected {
+			current = i
+		}
+	}
+	previous := a.state.selected
+	if current >= 0 && scores[current].Alive && scores[current].Score <= scores[best].Score*(1+a.option.Tolerance) {
+		best = current
+	}
+	a.state.selected = scores[best].Name
+	a.state.scores = scores
+	a.state.evaluated = now
+	if previous != "" && previous != a.state.selected {
+		log.Infoln("[SmartGroup] %s switched from %s to %s", a.name, previous, a.state.selected)
+		go sendMessage(Message{
+			Type: ProxyChangedMessage,
+			Data: ProxyChanged{
+				GroupName: a.name,
+				ProxyName: a.state.selected,
+				Previous:  previous,
+			},
+		})
+	}
+	return members[best]
+}
+
+func (a *smartAdapter) pick(touch bool) C.Proxy {
+	members := a.GetProxies(touch)
+	a.state.mutex.Lock()
+	selected := a.state.selected
+	a.state.mutex.Unlock()
+	for _, member := range members {
+		if member.Name() == selected {
+			if member.AliveForTestUrl(a.testUrl) {
+				return member
+			}
+			break
+		}
+	}
+	return a.evaluate(touch)
+}
+
+func (a *smartAdapter) Now() string {
+	if proxy := a.pick(false); proxy != nil {
+		return proxy.Name()
+	}
+	return ""
+}
+
+func (a *smartAdapter) Unwrap(metadata *C.Metadata, touch bool) C.Proxy {
+	if proxy := a.pick(touch); proxy != nil {
+		return proxy
+	}
+	return a.ProxyAdapter.Unwrap(metadata, touch)
+}
+
+func (a *smartAdapter) DialContext(ctx context.Context, metadata *C.Metadata) (C.Conn, error) {
+	proxy := a.pick(true)
+	if proxy == nil {
+		return a.ProxyAdapter.DialContext(ctx, metadata)
+	}
+	conn, err := proxy.DialContext(ctx, metadata)
+	a.state.recordDial(proxy.Name(), err)
+	if err != nil {
+		// the next dial must not wait for the background round to move away
+		a.evaluate(false)
+		return nil, err
+	}
+	conn.AppendToChains(a)
+	return &smartConn{Conn: conn, name: proxy.Name(), state: a.state, started: time.Now()}, nil
+}
+
+func (a *smartAdapter) ListenPacketContext(ctx context.Context, metadata *C.Metadata) (C.PacketConn, error) {
+	proxy := a.pick(true)
+	if proxy == nil {
+		return a.ProxyAdapter.ListenPacketContext(ctx, metadata)
+	}
+	pc, err := proxy.ListenPacketContext(ctx, metadata)
+	a.state.recordDial(proxy.Name(), err)
+	if err != nil {
+		a.evaluate(false)
+		return nil, err
+	}
+	pc.AppendToChains(a)
+	return pc, nil
+}
+
+func (a *smartAdapter) SupportUDP() bool {
+	if proxy := a.pick(false); proxy != nil {
+		return a.ProxyAdapter.SupportUDP() && proxy.SupportUDP()
+	}
+	return a.ProxyAdapter.SupportUDP()
+}
+
+func (a *smartAdapter) MarshalJSON() ([]byte, error) {
+	data, err := a.ProxyAdapter.MarshalJSON()
+	if err != nil {
+		return data, err
+	}
+	mapping := map[string]any{}
+	_ = json.Unmarshal(data, &mapping)
+	mapping["now"] = a.Now()
+	mapping["smart"] = true
+	return json.Marshal(mapping)
+}
+
+// smartConn samples the download rate of a member once the connection closes
+type smartConn struct {
+	C.Conn
+	name    string
+	state   *smartState
+	started time.Time
+	read    atomic.Int64
+	once    sync.Once
+}
+
+func (c *smartConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *smartConn) ReadBuffer(buffer *buf.Buffer) error {
+	err := c.Conn.ReadBuffer(buffer)
+	c.read.Add(int64(buffer.Len()))
+	return err
+}
+
+func (c *smartConn) Close() error {
+	c.once.Do(func() {
+		c.state.recordThroughput(c.name, c.read.Load(), time.Since(c.started))
+	})
+	return c.Conn.Close()
+}
+
+func (c *smartConn) Upstream() any {
+	return c.Conn
+}
+
+func (c *smartConn) WriterReplaceable() bool {
+	return true
+}
+
+func handleSetSmartGroup(paramsString string) error {
+	var params = &SmartGroupParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	return smartGroups.Set(params)
+}
+
+func handleGetSmartGroups() string {
+	data, err := json.Marshal(smartGroups.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/metacubex/mihomo/common/lru"
+	"github.com/metacubex/mihomo/common/utils"
+	"github.com/metacubex/mihomo/component/cidr"
+	"github.com/metacubex/mihomo/component/resolver"
+	"github.com/metacubex/mihomo/component/sniffer"
+	"github.com/metacubex/mihomo/component/trie"
+	C "github.com/metacubex/mihomo/constant"
+	snifferTypes "github.com/metacubex/mihomo/constant/sniffer"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	"github.com/metacubex/mihomo/tunnel/statistic"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultSniffCacheSize = 4096
+	defaultSniffCacheTTL  = 600
+)
+
+var (
+	defaultSniffTLSPorts  = []string{"443", "8443"}
+	defaultSniffHTTPPorts = []string{"80", "8080-8880"}
+	defaultSniffQUICPorts = []string{"443", "8443"}
+)
+
+// SniffingParams replaces the sniffer of the profile, the domain and address lists take plain
+// domains with wildcards and cidrs, an empty port list turns that protocol off and a negative
+// cache size the sniff cache
+type SniffingParams struct {
+	Enable          bool     `json:"enable"`
+	TLSPorts        []string `json:"tls-ports"`
+	HTTPPorts       []string `json:"http-ports"`
+	QUICPorts       []string `json:"quic-ports"`
+	OverrideDest    bool     `json:"override-destination"`
+	ForceDomain     []string `json:"force-domain"`
+	SkipDomain      []string `json:"skip-domain"`
+	SkipSrcAddress  []string `json:"skip-src-address"`
+	SkipDstAddress  []string `json:"skip-dst-address"`
+	ForceDnsMapping bool     `json:"force-dns-mapping"`
+	ParsePureIp     bool     `json:"parse-pure-ip"`
+	CacheSize       int      `json:"cache-size"`
+	CacheTTL        int64    `json:"cache-ttl"`
+}
+
+type SniffStats struct {
+	Enable      bool  `json:"enable"`
+	Connections int64 `json:"connections"`
+	Sniffed     int64 `json:"sniffed"`
+	TLS         int64 `json:"tls"`
+	HTTP        int64 `json:"http"`
+	QUIC        int64 `json:"quic"`
+	Missed      int64 `json:"missed"`
+	CacheHits   int64 `json:"cache-hits"`
+	Learned     int64 `json:"learned"`
+}
+
+// Sniffing owns the sniffer of tun connections and remembers the sniffed domain of each address,
+// later connections to that address are routed by the domain even when sniffing them fails
+type Sniffing struct {
+	mutex     sync.Mutex
+	params    *SniffingParams
+	httpPorts utils.IntRanges[uint16]
+	cache     *lru.LruCache[netip.Addr, string]
+	stats     sniffCounters
+}
+
+type sniffCounters struct {
+	connections atomic.Int64
+	sniffed     atomic.Int64
+	tls         atomic.Int64
+	http        atomic.Int64
+	quic        atomic.Int64
+	missed      atomic.Int64
+	cacheHits   atomic.Int64
+	learned     atomic.Int64
+}
+
+var sniffing = &Sniffing{}
+
+// sniffHostMapper answers address lookups from the sniff cache once the dns mapping has no entry
+type sniffHostMapper struct {
+	resolver.Enhancer
+}
+
+func (m *sniffHostMapper) FakeIPEnabled() bool {
+	return m.Enhancer != nil && m.Enhancer.FakeIPEnabled()
+}
+
+func (m *sniffHostMapper) MappingEnabled() bool {
+	return sniffing.cacheEnabled() || m.Enhancer != nil && m.Enhancer.MappingEnabled()
+}
+
+func (m *sniffHostMapper) IsFakeIP(ip netip.Addr) bool {
+	return m.Enhancer != nil && m.Enhancer.IsFakeIP(ip)
+}
+
+func (m *sniffHostMapper) IsFakeBroadcastIP(ip netip.Addr) bool {
+	return m.Enhancer != nil && m.Enhancer.IsFakeBroadcastIP(ip)
+}
+
+func (m *sniffHostMapper) IsExistFakeIP(ip netip.Addr) bool {
+	return m.Enhancer != nil && m.Enhancer.IsExistFakeIP(ip)
+}
+
+func (m *sniffHostMapper) FindHostByIP(ip netip.Addr) (string, bool) {
+	if m.Enhancer != nil {
+		if host, ok := m.Enhancer.FindHostByIP(ip); ok {
+			return host, true
+		}
+	}
+	return sniffing.lookup(ip)
+}
+
+func (m *sniffHostMapper) FlushFakeIP() error {
+	if m.Enhancer == nil {
+		return nil
+	}
+	return m.Enhancer.FlushFakeIP()
+}
+
+func (m *sniffHostMapper) InsertHostByIP(ip netip.Addr, host string) {
+	if m.Enhancer != nil {
+		m.Enhancer.InsertHostByIP(ip, host)
+	}
+}
+
+func (m *sniffHostMapper) StoreFakePoolState() {
+	if m.Enhancer != nil {
+		m.Enhancer.StoreFakePoolState()
+	}
+}
+
+func sniffPorts(ports []string, defaults []string) ([]string, bool) {
+	if ports == nil {
+		return defaults, true
+	}
+	return ports, len(ports) != 0
+}
+
+func sniffDomainMatchers(domains []string) ([]C.DomainMatcher, error) {
+	if len(domains) == 0 {
+		return nil, nil
+	}
+	domainTrie := trie.New[struct{}]()
+	for _, domain := range domains {
+		if err := domainTrie.Insert(domain, struct{}{}); err != nil {
+			return nil, fmt.Errorf("domain %s: %v", domain, err)
+		}
+	}
+	return []C.DomainMatcher{domainTrie.NewDomainSet()}, nil
+}
+
+func sniffIpMatchers(addresses []string) ([]C.IpMatcher, error) {
+	if len(addresses) == 0 {
+		return nil, nil
+	}
+	set := cidr.NewIpCidrSet()
+	for _, address := range addresses {
+		if err := set.AddIpCidrForString(address); err != nil {
+			return nil, fmt.Errorf("address %s: %v", address, err)
+		}
+	}
+	if err := set.Merge(); err != nil {
+		return nil, err
+	}
+	return []C.IpMatcher{set}, nil
+}
+
+func (params *SniffingParams) snifferConfig() (*sniffer.Config, utils.IntRanges[uint16], error) {
+	config := &sniffer.Config{
+		Enable:          params.Enable,
+		Sniffers:        map[snifferTypes.Type]sniffer.SnifferConfig{},
+		ForceDnsMapping: params.ForceDnsMapping,
+		ParsePureIp:     params.ParsePureIp,
+	}
+	var httpPorts utils.IntRanges[uint16]
+	protocols := []struct {
+		name     snifferTypes.Type
+		ports    []string
+		defaults []string
+	}{
+		{snifferTypes.TLS, params.TLSPorts, defaultSniffTLSPorts},
+		{snifferTypes.HTTP, params.HTTPPorts, defaultSniffHTTPPorts},
+		{snifferTypes.QUIC, params.QUICPorts, defaultSniffQUICPorts},
+	}
+	for _, protocol := range protocols {
+		list, enabled := sniffPorts(protocol.ports, protocol.defaults)
+		if !enabled {
+			continue
+		}
+		ports, err := utils.NewUnsignedRangesFromList[uint16](list)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s ports: %v", protocol.name, err)
+		}
+		if protocol.name == snifferTypes.HTTP {
+			httpPorts = ports
+		}
+		config.Sniffers[protocol.name] = sniffer.SnifferConfig{
+			Ports:        ports,
+			OverrideDest: params.OverrideDest,
+		}
+	}
+	var err error
+	if config.ForceDomain, err = sniffDomainMatchers(params.ForceDomain); err != nil {
+		return nil, nil, fmt.Errorf("force-domain: %v", err)
+	}
+	if config.SkipDomain, err = sniffDomainMatchers(params.SkipDomain); err != nil {
+		return nil, nil, fmt.Errorf("skip-domain: %v", err)
+	}
+	if config.SkipSrcAddress, err = sniffIpMatchers(params.SkipSrcAddress); err != nil {
+		return nil, nil, fmt.Errorf("skip-src-address: %v", err)
+	}
+	if config.SkipDstAddress, err = sniffIpMatchers(params.SkipDstAddress); err != nil {
+		return nil, nil, fmt.Errorf("skip-dst-address: %v", err)
+	}
+	return config, httpPorts, nil
+}
+
+// Set replaces the sniffer, nil params hand it back to the profile on the next setup
+func (s *Sniffing) Set(params *SniffingParams) error {
+	if params != nil {
+		if _, _, err := params.snifferConfig(); err != nil {
+			return err
+		}
+	}
+	runLock.Lock()
+	defer runLock.Unlock()
+	s.mutex.Lock()
+	s.params = params
+	s.cache = nil
+	s.mutex.Unlock()
+	if currentConfig == nil {
+		return nil
+	}
+	return s.ApplyLocked()
+}
+
+// TrimCache forgets the learned domains, sniffing keeps filling the cache afterwards
+func (s *Sniffing) TrimCache() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.cache != nil {
+		s.cache.Clear()
+	}
+}
+
+// ApplyLocked installs the sniffer after a setup, the caller holds runLock
+func (s *Sniffing) ApplyLocked() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := resolver.DefaultHostMapper.(*sniffHostMapper); !ok {
+		resolver.DefaultHostMapper = &sniffHostMapper{Enhancer: resolver.DefaultHostMapper}
+	}
+	if s.params == nil {
+		return nil
+	}
+	config, httpPorts, err := s.params.snifferConfig()
+	if err != nil {
+		return err
+	}
+	dispatcher, err := sniffer.NewDispatcher(config)
+	if err != nil {
+		return err
+	}
+	tunnel.UpdateSniffer(dispatcher)
+	tunnel.SetSniffing(config.Enable)
+	currentConfig.General.Sniffing = config.Enable
+	currentConfig.Sniffer = config
+	s.httpPorts = httpPorts
+	if s.cache == nil && s.params.CacheSize >= 0 {
+		size, ttl := s.params.CacheSize, s.params.CacheTTL
+		if size == 0 {
+			size = defaultSniffCacheSize
+		}
+		if ttl <= 0 {
+			ttl = defaultSniffCacheTTL
+		}
+		s.cache = lru.New[netip.Addr, string](
+			lru.WithSize[netip.Addr, string](size),
+			lru.WithAge[netip.Addr, string](ttl),
+			lru.WithUpdateAgeOnGet[netip.Addr, string](),
+		)
+	}
+	log.Infoln("[Sniffer] applied, enable: %t", config.Enable)
+	return nil
+}
+
+func (s *Sniffing) cacheEnabled() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.cache != nil && s.params != nil && s.params.Enable
+}
+
+func (s *Sniffing) lookup(ip netip.Addr) (string, bool) {
+	s.mutex.Lock()
+	cache := s.cache
+	s.mutex.Unlock()
+	if cache == nil {
+		return "", false
+	}
+	host, ok := cache.Get(ip.Unmap())
+	if ok {
+		s.stats.cacheHits.Add(1)
+	}
+	return host, ok
+}
+
+// Observe counts a new tun connection and learns the address of a sniffed domain
+func (s *Sniffing) Observe(c statistic.Tracker) {
+	metadata := c.Info().Metadata
+	if metadata == nil || metadata.Type != C.TUN {
+		return
+	}
+	s.mutex.Lock()
+	enabled := s.params != nil && s.params.Enable
+	cache := s.cache
+	httpPorts := s.httpPorts
+	s.mutex.Unlock()
+	if !enabled {
+		return
+	}
+	s.stats.connections.Add(1)
+	if metadata.SniffHost == "" {
+		if metadata.Host == "" {
+			s.stats.missed.Add(1)
+		}
+		return
+	}
+	s.stats.sniffed.Add(1)
+	switch {
+	case metadata.NetWork == C.UDP:
+		s.stats.quic.Add(1)
+	case len(httpPorts) != 0 && httpPorts.Check(metadata.DstPort):
+		s.stats.http.Add(1)
+	default:
+		s.stats.tls.Add(1)
+	}
+	if cache == nil {
+		return
+	}
+	// with override-destination the address is cleared, the dialed one is found in the remote destination
+	ip := metadata.DstIP
+	if !ip.IsValid() {
+		ip, _ = netip.ParseAddr(metadata.RemoteDst)
+	}
+	if ip.IsValid() && !resolver.IsFakeIP(ip) {
+		cache.Set(ip.Unmap(), metadata.SniffHost)
+		s.stats.learned.Add(1)
+	}
+}
+
+func (s *Sniffing) Stats() SniffStats {
+	s.mutex.Lock()
+	stats := SniffStats{
+		Enable: s.params != nil && s.params.Enable,
+	}
+	s.mutex.Unlock()
+	stats.Connections = s.stats.connections.Load()
+	stats.Sniffed = s.stats.sniffed.Load()
+	stats.TLS = s.stats.tls.Load()
+	stats.HTTP = s.stats.http.Load()
+	stats.QUIC = s.stats.quic.Load()
+	stats.Missed = s.stats.missed.Load()
+	stats.CacheHits = s.stats.cacheHits.Load()
+	stats.Learned = s.stats.learned.Load()
+	return stats
+}
+
+func handleSetSniffing(paramsString string) error {
+	var params *SniffingParams
+	if err := json.Unmarshal([]byte(paramsString), &params); err != nil {
+		return err
+	}
+	return sniffing.Set(params)
+}
+
+func handleGetSniffStats() string {
+	data, err := json.Marshal(sniffing.Stats())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/metacubex/mihomo/component/resolver"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+type SplitTunnelMode string
+
+const (
+	ExcludeSplitTunnelMode SplitTunnelMode = "exclude"
+	IncludeSplitTunnelMode SplitTunnelMode = "include"
+)
+
+type SplitTunnelParams struct {
+	Mode  SplitTunnelMode `json:"mode"`
+	Cidrs []string        `json:"cidrs"`
+}
+
+type SplitTunnelStatus struct {
+	Mode          SplitTunnelMode `json:"mode"`
+	Cidrs         []string        `json:"cidrs"`
+	RoutesApplied bool            `json:"routes-applied"`
+	RouteError    string          `json:"route-error,omitempty"`
+}
+
+// SplitTunnel sends tun traffic to bypassed destinations direct, exclude mode bypasses the listed cidrs and
+// include mode bypasses everything else. Fake-ip destinations are never matched since their real address is unknown.
+type SplitTunnel struct {
+	mutex         sync.RWMutex
+	mode          SplitTunnelMode
+	prefixes      []netip.Prefix
+	routes        []netip.Prefix
+	routesApplied bool
+	routeError    string
+}
+
+var splitTunnel = &SplitTunnel{mode: ExcludeSplitTunnelMode}
+
+func parseSplitTunnelCidr(value string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		addr, addrErr := netip.ParseAddr(value)
+		if addrErr != nil {
+			return netip.Prefix{}, err
+		}
+		prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+	}
+	return prefix.Masked(), nil
+}
+
+func (s *SplitTunnel) update(mode SplitTunnelMode, prefixes []netip.Prefix) {
+	s.mode = mode
+	s.prefixes = prefixes
+	s.sync()
+}
+
+// sync brings the os bypass routes in line with the rules, the tun interface is left untouched
+func (s *SplitTunnel) sync() {
+	supported := splitTunnelRoutesSupported()
+	var routes []netip.Prefix
+	if supported && s.mode == ExcludeSplitTunnelMode {
+		routes = s.prefixes
+	}
+	added, removed := diffPrefixes(s.routes, routes)
+	var errs []error
+	installed := make([]netip.Prefix, 0, len(routes))
+	for _, prefix := range s.routes {
+		if !containsPrefix(removed, prefix) {
+			installed = append(installed, prefix)
+			continue
+		}
+		if err := removeSplitTunnelRoute(prefix); err != nil {
+			errs = append(errs, err)
+			installed = append(installed, prefix)
+		}
+	}
+	for _, prefix := range added {
+		if err := addSplitTunnelRoute(prefix); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		installed = append(installed, prefix)
+	}
+	s.routes = installed
+	s.routesApplied = supported && len(errs) == 0
+	s.routeError = ""
+	if err := errors.Join(errs...); err != nil {
+		s.routeError = err.Error()
+		log.Warnln("[TUN] update split tunnel routes error: %v", err)
+	}
+}
+
+// Sync reapplies the routes after the tun listener is recreated
+func (s *SplitTunnel) Sync() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sync()
+}
+
+func containsPrefix(prefixes []netip.Prefix, prefix netip.Prefix) bool {
+	for _, item := range prefixes {
+		if item == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+func diffPrefixes(previous []netip.Prefix, current []netip.Prefix) (added []netip.Prefix, removed []netip.Prefix) {
+	for _, prefix := range current {
+		if !containsPrefix(previous, prefix) {
+			added = append(added, prefix)
+		}
+	}
+	for _, prefix := range previous {
+		if !containsPrefix(current, prefix) {
+			removed = append(removed, prefix)
+		}
+	}
+	return
+}
+
+func (s *SplitTunnel) Set(params *SplitTunnelParams) error {
+	mode := params.Mode
+	if mode == "" {
+		mode = ExcludeSplitTunnelMode
+	}
+	if mode != ExcludeSplitTunnelMode && mode != IncludeSplitTunnelMode {
+		return errors.New("invalid split tunnel mode")
+	}
+	prefixes := make([]netip.Prefix, 0, len(params.Cidrs))
+	for _, value := range params.Cidrs {
+		prefix, err := parseSplitTunnelCidr(value)
+		if err != nil {
+			return err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.update(mode, prefixes)
+	return nil
+}
+
+func (s *SplitTunnel) Add(value string) error {
+	prefix, err := parseSplitTunnelCidr(value)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if containsPrefix(s.prefixes, prefix) {
+		return nil
+	}
+	s.update(s.mode, append(append([]netip.Prefix{}, s.prefixes...), prefix))
+	return nil
+}
+
+func (s *SplitTunnel) Remove(value string) bool {
+	prefix, err := parseSplitTunnelCidr(value)
+	if err != nil {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, item := range s.prefixes {
+		if item == prefix {
+			prefixes := append(append([]netip.Prefix{}, s.prefixes[:i]...), s.prefixes[i+1:]...)
+			s.update(s.mode, prefixes)
+			return true
+		}
+	}
+	return false
+}
+
+// Clear removes the os routes when the listeners stop, the rules stay for the next start
+func (s *SplitTunnel) Clear() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, prefix := range s.routes {
+		if err := removeSplitTunnelRoute(prefix); err != nil {
+			log.Warnln("[TUN] clear split tunnel route %s error: %v", prefix, err)
+		}
+	}
+	s.routes = nil
+	s.routesApplied = false
+}
+
+func (s *SplitTunnel) Status() SplitTunnelStatus {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	status := SplitTunnelStatus{
+		Mode:          s.mode,
+		Cidrs:         make([]string, 0, len(s.prefixes)),
+		RoutesApplied: s.routesApplied,
+		RouteError:    s.routeError,
+	}
+	for _, prefix := range s.prefixes {
+		status.Cidrs = append(status.Cidrs, prefix.String())
+	}
+	return status
+}
+
+func (s *SplitTunnel) bypass(addr netip.Addr) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if len(s.prefixes) == 0 || !addr.IsValid() || resolver.IsFakeIP(addr) {
+		return false
+	}
+	addr = addr.Unmap()
+	matched := false
+	for _, prefix := range s.prefixes {
+		if prefix.Contains(addr) {
+			matched = true
+			break
+		}
+	}
+	if s.mode == IncludeSplitTunnelMode {
+		return !matched
+	}
+	return matched
+}
+
+// splitTunnelTunnel pins bypassed tun connections to DIRECT, it also covers traffic the os routes cannot divert
+type splitTunnelTunnel struct {
+	constant.Tunnel
+}
+
+func (t *splitTunnelTunnel) HandleTCPConn(conn net.Conn, metadata *constant.Metadata) {
+	if splitTunnel.bypass(metadata.DstIP) {
+		metadata.SpecialProxy = "DIRECT"
+	}
+	t.Tunnel.HandleTCPConn(conn, metadata)
+}
+
+func (t *splitTunnelTunnel) HandleUDPPacket(packet constant.UDPPacket, metadata *constant.Metadata) {
+	if splitTunnel.bypass(metadata.DstIP) {
+		metadata.SpecialProxy = "DIRECT"
+	}
+	t.Tunnel.HandleUDPPacket(packet, metadata)
+}
+
+func handleSetSplitTunnel(paramsString string) error {
+	var params = &SplitTunnelParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	return splitTunnel.Set(params)
+}
+
+func handleAddSplitTunnelCidr(cidr string) error {
+	return splitTunnel.Add(cidr)
+}
+
+func handleRemoveSplitTunnelCidr(cidr string) bool {
+	return splitTunnel.Remove(cidr)
+}
+
+func handleGetSplitTunnel() string {
+	data, err := json.Marshal(splitTunnel.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,51 @@
+//go:build linux && !android
+
+package main
+
+import (
+	"github.com/metacubex/mihomo/listener"
+	"github.com/sagernet/netlink"
+	"golang.org/x/sys/unix"
+	"net/netip"
+)
+
+const defaultSplitTunnelRuleIndex = 9000
+
+// splitTunnelRoutesSupported reports whether the tun owns the routing through auto-route rules
+func splitTunnelRoutesSupported() bool {
+	tun := listener.GetTunConf()
+	return tun.Enable && tun.AutoRoute
+}
+
+// splitTunnelRule sends the prefix to the main table one priority ahead of the rules of the tun
+func splitTunnelRule(prefix netip.Prefix) *netlink.Rule {
+	ruleIndex := listener.GetTunConf().IPRoute2RuleIndex
+	if ruleIndex == 0 {
+		ruleIndex = defaultSplitTunnelRuleIndex
+	}
+	rule := netlink.NewRule()
+	rule.Priority = ruleIndex - 1
+	rule.Table = unix.RT_TABLE_MAIN
+	rule.Dst = prefix
+	rule.Family = unix.AF_INET
+	if prefix.Addr().Is6() {
+		rule.Family = unix.AF_INET6
+	}
+	return rule
+}
+
+func addSplitTunnelRoute(prefix netip.Prefix) error {
+	err := netlink.RuleAdd(splitTunnelRule(prefix))
+	if err == unix.EEXIST {
+		return nil
+	}
+	return err
+}
+
+func removeSplitTunnelRoute(prefix netip.Prefix) error {
+	err := netlink.RuleDel(splitTunnelRule(prefix))
+	if err == unix.ENOENT {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,18 @@
+//go:build !linux || android
+
+package main
+
+import "net/netip"
+
+// splitTunnelRoutesSupported is false where the routes belong to the os or VpnService, the tunnel still bypasses
+func splitTunnelRoutesSupported() bool {
+	return false
+}
+
+func addSplitTunnelRoute(_ netip.Prefix) error {
+	return nil
+}
+
+func removeSplitTunnelRoute(_ netip.Prefix) error {
+	return nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/metacubex/mihomo/component/geodata"
+	"github.com/metacubex/mihomo/config"
+	cp "github.com/metacubex/mihomo/constant/provider"
+	"github.com/metacubex/mihomo/hub"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	"strings"
+	"sync"
+	"time"
+)
+
+type StartupStage string
+
+const (
+	ConfigStartupStage         StartupStage = "config"
+	GeoStartupStage            StartupStage = "geo"
+	ProxyProvidersStartupStage StartupStage = "proxy-providers"
+	RuleProvidersStartupStage  StartupStage = "rule-providers"
+	HealthCheckStartupStage    StartupStage = "health-check"
+
+	startupConcurrency = 8
+)
+
+type StartCoreParams struct {
+	*SetupParams
+	FastPath bool `json:"fast-path"`
+}
+
+// StartupEvent is posted once per stage, the duration is counted from the start of startCore
+type StartupEvent struct {
+	Stage    StartupStage `json:"stage"`
+	Count    int          `json:"count"`
+	Duration int64        `json:"duration"`
+	Errors   []string     `json:"errors,omitempty"`
+}
+
+type StartupStatus struct {
+	FastPath bool            `json:"fast-path"`
+	Started  int64           `json:"started"`
+	Ready    bool            `json:"ready"`
+	Pending  []StartupStage  `json:"pending"`
+	Stages   []*StartupEvent `json:"stages"`
+}
+
+// Startup tracks one startCore, with the fast path the providers are initialised after the
+// listeners are up and every group health check waits for the remote providers
+type Startup struct {
+	mutex      sync.Mutex
+	active     bool
+	fastPath   bool
+	generation uint64
+	started    time.Time
+	pending    map[StartupStage]struct{}
+	stages     []*StartupEvent
+}
+
+var startup = &Startup{pending: map[StartupStage]struct{}{}}
+
+func (s *Startup) begin(fastPath bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.active = true
+	s.fastPath = fastPath
+	s.started = time.Now()
+	s.pending = map[StartupStage]struct{}{ConfigStartupStage: {}}
+	s.stages = nil
+}
+
+func (s *Startup) expect(stage StartupStage) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pending[stage] = struct{}{}
+}
+
+func (s *Startup) finish(stage StartupStage, count int, errs []string) {
+	s.mutex.Lock()
+	if _, ok := s.pending[stage]; !ok {
+		s.mutex.Unlock()
+		return
+	}
+	delete(s.pending, stage)
+	event := &StartupEvent{
+		Stage:    stage,
+		Count:    count,
+		Duration: time.Since(s.started).Milliseconds(),
+		Errors:   errs,
+	}
+	s.stages = append(s.stages, event)
+	s.mutex.Unlock()
+	log.Infoln("[Startup] %s ready after %dms", stage, event.Duration)
+	go sendMessage(Message{
+		Type: StartupMessage,
+		Data: event,
+	})
+}
+
+// referencedGeoDatabases looks for the rule types that load a database while the config is parsed
+func referencedGeoDatabases(rawConfig *config.RawConfig) (geoIp, geoSite, asn bool) {
+	check := func(rules []string) {
+		for _, rule := range rules {
+			rule = strings.ToUpper(rule)
+			geoIp = geoIp || strings.Contains(rule, "GEOIP,")
+			geoSite = geoSite || strings.Contains(rule, "GEOSITE,")
+			asn = asn || strings.Contains(rule, "IP-ASN,")
+		}
+	}
+	check(rawConfig.Rule)
+	for _, subRules := range rawConfig.SubRules {
+		check(subRules)
+	}
+	return
+}
+
+// PrepareLocked starts verifying the geo databases next to the rest of the setup, parsing the
+// rules then only waits for the ones that are not loaded yet instead of loading them one by one
+func (s *Startup) PrepareLocked(rawConfig *config.RawConfig) {
+	s.mutex.Lock()
+	active := s.active
+	s.mutex.Unlock()
+	if !active {
+		return
+	}
+	geoIp, geoSite, asn := referencedGeoDatabases(rawConfig)
+	var loaders []func() error
+	if geoIp {
+		loaders = append(loaders, geodata.InitGeoIP)
+	}
+	if geoSite {
+		loaders = append(loaders, geodata.InitGeoSite)
+	}
+	if asn {
+		loaders = append(loaders, geodata.InitASN)
+	}
+	s.expect(GeoStartupStage)
+	go func() {
+		s.finish(GeoStartupStage, len(loaders), runParallel(loaders))
+	}()
+}
+
+func runParallel(tasks []func() error) []string {
+	var (
+		wg     sync.WaitGroup
+		mutex  sync.Mutex
+		errs   []string
+		tokens = make(chan struct{}, startupConcurrency)
+	)
+	for _, task := range tasks {
+		wg.Add(1)
+		tokens <- struct{}{}
+		go func(task func() error) {
+			defer func() {
+				<-tokens
+				wg.Done()
+			}()
+			if err := task(); err != nil {
+				mutex.Lock()
+				errs = append(errs, err.Error())
+				mutex.Unlock()
+			}
+		}(task)
+	}
+	wg.Wait()
+	return errs
+}
+
+// ApplyLocked applies the parsed config, the fast path hides the providers from hub.ApplyConfig
+// so it does not wait on their downloads and hands them back to the tunnel right after
+func (s *Startup) ApplyLocked(cfg *config.Config) {
+	s.mutex.Lock()
+	fastPath := s.active && s.fastPath
+	s.generation++
+	generation := s.generation
+	s.mutex.Unlock()
+	if !fastPath {
+		hub.ApplyConfig(cfg)
+		return
+	}
+	applied := *cfg
+	applied.Providers = map[string]cp.ProxyProvider{}
+	applied.RuleProviders = map[string]cp.RuleProvider{}
+	hub.ApplyConfig(&applied)
+	tunnel.UpdateProxies(cfg.Proxies, cfg.Providers)
+	tunnel.UpdateRules(cfg.Rules, cfg.SubRules, cfg.RuleProviders)
+
+	var remote, compatible, rules []func() error
+	for _, provider := range cfg.Providers {
+		task := s.initialTask(generation, provider)
+		if provider.VehicleType() == cp.Compatible {
+			compatible = append(compatible, task)
+		} else {
+			remote = append(remote, task)
+		}
+	}
+	for _, provider := range cfg.RuleProviders {
+		rules = append(rules, s.initialTask(generation, provider))
+	}
+	s.expect(ProxyProvidersStartupStage)
+	s.expect(RuleProvidersStartupStage)
+	s.expect(HealthCheckStartupStage)
+	go func() {
+		s.finish(RuleProvidersStartupStage, len(rules), runParallel(rules))
+	}()
+	go func() {
+		s.finish(ProxyProvidersStartupStage, len(remote), runParallel(remote))
+		// the compatible providers hold the health checks of the groups
+		s.finish(HealthCheckStartupStage, len(compatible), runParallel(compatible))
+	}()
+}
+
+// initialTask skips the provider once a newer setup replaced it
+func (s *Startup) initialTask(generation uint64, provider cp.Provider) func() error {
+	return func() error {
+		s.mutex.Lock()
+		current := s.generation == generation
+		s.mutex.Unlock()
+		if !current {
+			return nil
+		}
+		if err := provider.Initial(); err != nil {
+			log.Errorln("[Startup] initial provider %s error: %v", provider.Name(), err)
+			return err
+		}
+		return nil
+	}
+}
+
+func (s *Startup) ready() {
+	s.finish(ConfigStartupStage, 1, nil)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.active = false
+}
+
+func (s *Startup) Status() *StartupStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	status := &StartupStatus{
+		FastPath: s.fastPath,
+		Started:  s.started.UnixMilli(),
+		Pending:  []StartupStage{},
+		Stages:   append([]*StartupEvent{}, s.stages...),
+	}
+	for stage := range s.pending {
+		status.Pending = append(status.Pending, stage)
+	}
+	_, waiting := s.pending[ConfigStartupStage]
+	status.Ready = !s.started.IsZero() && !waiting
+	return status
+}
+
+// handleStartCore sets up the profile and starts the listeners in one call
+func handleStartCore(bytes []byte) string {
+	params := &StartCoreParams{SetupParams: defaultSetupParams()}
+	if err := UnmarshalJson(bytes, params); err != nil {
+		log.Errorln("unmarshal start params error %v", err)
+		return err.Error()
+	}
+	startup.begin(params.FastPath)
+	err := setupConfig(params.SetupParams)
+	handleStartListener()
+	startup.ready()
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func handleGetStartupStatus() string {
+	data, err := json.Marshal(startup.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
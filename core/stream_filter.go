@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/metacubex/mihomo/hub/route"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel/statistic"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultStreamInterval = time.Second
+	minStreamInterval     = 200 * time.Millisecond
+	streamLogBufferSize   = 1024
+)
+
+// StreamFilter drops the events a client has no use for before they are encoded, an empty field
+// lets everything through and the fields match events they apply to only
+type StreamFilter struct {
+	Level   *log.LogLevel `json:"level"`
+	Modules []string      `json:"modules"`
+	// Hosts match a part of the host or the destination address of a connection
+	Hosts []string `json:"hosts"`
+	// Proxies match any proxy of the chain of a connection
+	Proxies []string `json:"proxies"`
+}
+
+func normalizeStreamValues(values []string) []string {
+	normalized := make([]string, 0, len(values))
+	for _, value := range values {
+		if value = strings.ToLower(strings.TrimSpace(value)); value != "" {
+			normalized = append(normalized, value)
+		}
+	}
+	return normalized
+}
+
+// compile returns the filter with lowered values, nil when it lets everything through
+func (f *StreamFilter) compile() *StreamFilter {
+	if f == nil {
+		return nil
+	}
+	compiled := &StreamFilter{
+		Level:   f.Level,
+		Modules: normalizeStreamValues(f.Modules),
+		Hosts:   normalizeStreamValues(f.Hosts),
+		Proxies: normalizeStreamValues(f.Proxies),
+	}
+	if compiled.Level == nil && len(compiled.Modules) == 0 && len(compiled.Hosts) == 0 && len(compiled.Proxies) == 0 {
+		return nil
+	}
+	return compiled
+}
+
+func (f *StreamFilter) matchesLog(level log.LogLevel, module string) bool {
+	if f.Level != nil && level < *f.Level {
+		return false
+	}
+	if len(f.Modules) == 0 {
+		return true
+	}
+	for _, item := range f.Modules {
+		if item == module {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *StreamFilter) matchesConnection(info *statistic.TrackerInfo) bool {
+	if len(f.Hosts) != 0 {
+		host := ""
+		address := ""
+		if info.Metadata != nil {
+			host = strings.ToLower(info.Metadata.Host)
+			if info.Metadata.DstIP.IsValid() {
+				address = info.Metadata.DstIP.String()
+			}
+		}
+		matched := false
+		for _, item := range f.Hosts {
+			if (host != "" && strings.Contains(host, item)) || (address != "" && strings.Contains(address, item)) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(f.Proxies) != 0 {
+		for _, proxy := range info.Chain {
+			proxy = strings.ToLower(proxy)
+			for _, item := range f.Proxies {
+				if proxy == item {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// matches tells whether the data of an event passes, a nil filter passes everything
+func (f *StreamFilter) matches(data any) bool {
+	if f == nil {
+		return true
+	}
+	switch data := data.(type) {
+	case log.Event:
+		module, _ := logModule(data.Payload)
+		return f.matchesLog(data.LogLevel, module)
+	case LogEntry:
+		return f.matchesLog(data.Level, data.Module)
+	case statistic.Tracker:
+		return f.matchesConnection(data.Info())
+	case *statistic.TrackerInfo:
+		return f.matchesConnection(data)
+	}
+	return true
+}
+
+func splitStreamQuery(query url.Values, key string) []string {
+	var values []string
+	for _, value := range query[key] {
+		values = append(values, strings.Split(value, ",")...)
+	}
+	return values
+}
+
+// parseStreamFilter reads a filter from the query of a websocket, lists are comma separated
+func parseStreamFilter(query url.Values) (*StreamFilter, error) {
+	filter := &StreamFilter{
+		Modules: splitStreamQuery(query, "module"),
+		Hosts:   splitStreamQuery(query, "host"),
+		Proxies: splitStreamQuery(query, "proxy"),
+	}
+	if levelText := query.Get("level"); levelText != "" {
+		level, ok := log.LogLevelMapping[strings.ToLower(levelText)]
+		if !ok {
+			return nil, fmt.Errorf("unknown level %s", levelText)
+		}
+		filter.Level = &level
+	}
+	return filter.compile(), nil
+}
+
+func streamInterval(query url.Values) time.Duration {
+	interval := defaultStreamInterval
+	if value, err := strconv.ParseInt(query.Get("interval"), 10, 64); err == nil && value > 0 {
+		interval = time.Duration(value) * time.Millisecond
+	}
+	if interval < minStreamInterval {
+		interval = minStreamInterval
+	}
+	return powerScaled(interval)
+}
+
+// upgradeStream takes the websocket over, the context ends when the client goes away
+func upgradeStream(w http.ResponseWriter, r *http.Request) (net.Conn, context.Context, context.CancelFunc, bool) {
+	conn, _, _, err := ws.UpgradeHTTP(r, w)
+	if err != nil {
+		return nil, nil, nil, false
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := wsutil.ReadClientData(conn); err != nil {
+				return
+			}
+		}
+	}()
+	return conn, ctx, cancel, true
+}
+
+func streamBadRequest(w http.ResponseWriter, r *http.Request, err error) {
+	render.Status(r, http.StatusBadRequest)
+	render.JSON(w, r, &route.HTTPError{Message: err.Error()})
+}
+
+func streamLogs(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseStreamFilter(r.URL.Query())
+	if err != nil {
+		streamBadRequest(w, r, err)
+		return
+	}
+	if r.Header.Get("Upgrade") != "websocket" {
+		streamBadRequest(w, r, fmt.Errorf("websocket is required"))
+		return
+	}
+	conn, ctx, cancel, ok := upgradeStream(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+	defer conn.Close()
+	sub := log.Subscribe()
+	defer log.UnSubscribe(sub)
+	ch := make(chan log.Event, streamLogBufferSize)
+	go func() {
+		for event := range sub {
+			select {
+			case ch <- event:
+			default:
+			}
+		}
+		close(ch)
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			module, message := logModule(event.Payload)
+			if filter != nil && !filter.matchesLog(event.LogLevel, module) {
+				continue
+			}
+			data, err := json.Marshal(&LogEntry{
+				Time:    time.Now().UnixMilli(),
+				Level:   event.LogLevel,
+				Module:  module,
+				Message: message,
+			})
+			if err != nil {
+				continue
+			}
+			if err = wsutil.WriteServerText(conn, data); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// streamConnections sends the snapshot of the matching connections, the totals stay the ones of
+// all connections
+func streamConnections(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, err := parseStreamFilter(query)
+	if err != nil {
+		streamBadRequest(w, r, err)
+		return
+	}
+	if r.Header.Get("Upgrade") != "websocket" {
+		render.JSON(w, r, filterSnapshot(statistic.DefaultManager.Snapshot(), filter))
+		return
+	}
+	conn, ctx, cancel, ok := upgradeStream(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+	defer conn.Close()
+	ticker := time.NewTicker(streamInterval(query))
+	defer ticker.Stop()
+	for {
+		data, err := json.Marshal(filterSnapshot(statistic.DefaultManager.Snapshot(), filter))
+		if err != nil {
+			return
+		}
+		if err = wsutil.WriteServerText(conn, data); err != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func filterSnapshot(snapshot *statistic.Snapshot, filter *StreamFilter) *statistic.Snapshot {
+	if filter == nil {
+		return snapshot
+	}
+	connections := make([]*statistic.TrackerInfo, 0, len(snapshot.Connections))
+	for _, info := range snapshot.Connections {
+		if filter.matchesConnection(info) {
+			connections = append(connections, info)
+		}
+	}
+	snapshot.Connections = connections
+	return snapshot
+}
+
+// streamRouter serves the filtered streams next to the mihomo ones, those send everything
+func streamRouter(r chi.Router) {
+	r.Get("/streams/logs", streamLogs)
+	r.Get("/streams/connections", streamConnections)
+}
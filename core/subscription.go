@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mihomoHttp "github.com/metacubex/mihomo/component/http"
+	"github.com/metacubex/mihomo/config"
+	"github.com/metacubex/mihomo/log"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSubscriptionTimeout = 30 * time.Second
+	maxSubscriptionBackoff     = 30 * time.Second
+	maxSubscriptionSize        = 32 << 20
+)
+
+type UpdateProfileParams struct {
+	ProfileId    string `json:"profile-id"`
+	Url          string `json:"url"`
+	UserAgent    string `json:"user-agent"`
+	Proxy        string `json:"proxy"`
+	Timeout      int64  `json:"timeout"`
+	Retries      int    `json:"retries"`
+	ETag         string `json:"etag"`
+	LastModified string `json:"last-modified"`
+}
+
+// SubscriptionMeta records the caching headers of the last successful download
+type SubscriptionMeta struct {
+	ProfileId            string             `json:"profile-id"`
+	Url                  string             `json:"url"`
+	Updated              bool               `json:"updated"`
+	Overridden           bool               `json:"overridden"`
+	ETag                 string             `json:"etag"`
+	LastModified         string             `json:"last-modified"`
+	SubscriptionUserinfo string             `json:"subscription-userinfo"`
+	ContentDisposition   string             `json:"content-disposition"`
+	ProfileUpdateHours   string             `json:"profile-update-interval"`
+	Size                 int                `json:"size"`
+	UpdateAt             int64              `json:"update-at"`
+	Usage                *SubscriptionUsage `json:"usage,omitempty"`
+}
+
+var (
+	subscriptionMetas     = map[string]*SubscriptionMeta{}
+	subscriptionMetasLock sync.Mutex
+)
+
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+// UpdateProfile downloads a subscription and stores it in the secure cache without touching disk
+func UpdateProfile(ctx context.Context, params *UpdateProfileParams) (*SubscriptionMeta, error) {
+	if params.ProfileId == "" || params.Url == "" {
+		return nil, errors.New("profile id and url are required")
+	}
+
+	subscriptionMetasLock.Lock()
+	previous := subscriptionMetas[params.ProfileId]
+	subscriptionMetasLock.Unlock()
+	etag, lastModified := params.ETag, params.LastModified
+	if previous != nil && previous.Url == params.Url && GetSecureMemoryService().IsProfileSecured(params.ProfileId) {
+		if etag == "" {
+			etag = previous.ETag
+		}
+		if lastModified == "" {
+			lastModified = previous.LastModified
+		}
+	}
+
+	backoff := time.Second
+	var lastErr error
+	for attempt := 0; attempt <= params.Retries; attempt++ {
+		if attempt > 0 {
+			log.Warnln("[Subscription] retry %s in %v: %v", params.ProfileId, backoff, lastErr)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > maxSubscriptionBackoff {
+				backoff = maxSubscriptionBackoff
+			}
+		}
+		meta, err := fetchSubscription(ctx, params, etag, lastModified)
+		if err == nil {
+			if meta.Usage == nil && previous != nil && previous.Url == params.Url {
+				// a not modified response may skip the header, the hints of the body are still valid
+				meta.Usage = previous.Usage
+			}
+			subscriptionAlerts.Check(params.ProfileId, meta.Usage)
+			subscriptionMetasLock.Lock()
+			subscriptionMetas[params.ProfileId] = meta
+			subscriptionMetasLock.Unlock()
+			return meta, nil
+		}
+		lastErr = err
+		var retryable *retryableError
+		if !errors.As(err, &retryable) {
+			return nil, err
+		}
+	}
+	return nil, lastErr
+}
+
+func fetchSubscription(ctx context.Context, params *UpdateProfileParams, etag, lastModified string) (*SubscriptionMeta, error) {
+	timeout := defaultSubscriptionTimeout
+	if params.Timeout > 0 {
+		timeout = time.Duration(params.Timeout) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	header := map[string][]string{}
+	if params.UserAgent != "" {
+		header["User-Agent"] = []string{params.UserAgent}
+	}
+	if etag != "" {
+		header["If-None-Match"] = []string{etag}
+	}
+	if lastModified != "" {
+		header["If-Modified-Since"] = []string{lastModified}
+	}
+
+	resp, err := mihomoHttp.HttpRequestWithProxy(ctx, params.Url, http.MethodGet, header, nil, params.Proxy)
+	if err != nil {
+		return nil, &retryableError{err: err}
+	}
+	defer resp.Body.Close()
+
+	meta := &SubscriptionMeta{
+		ProfileId:            params.ProfileId,
+		Url:                  params.Url,
+		ETag:                 resp.Header.Get("ETag"),
+		LastModified:         resp.Header.Get("Last-Modified"),
+		SubscriptionUserinfo: resp.Header.Get("Subscription-Userinfo"),
+		ContentDisposition:   resp.Header.Get("Content-Disposition"),
+		ProfileUpdateHours:   resp.Header.Get("Profile-Update-Interval"),
+		UpdateAt:             time.Now().UnixMilli(),
+	}
+	meta.Usage = parseSubscriptionUsage(meta.SubscriptionUserinfo, nil)
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		if meta.ETag == "" {
+			meta.ETag = etag
+		}
+		if meta.LastModified == "" {
+			meta.LastModified = lastModified
+		}
+		return meta, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return nil, &retryableError{err: fmt.Errorf("server responded %s", resp.Status)}
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return nil, fmt.Errorf("server responded %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSubscriptionSize+1))
+	if err != nil {
+		clearBytes(body)
+		return nil, &retryableError{err: err}
+	}
+	defer clearBytes(body)
+	if len(body) > maxSubscriptionSize {
+		return nil, errors.New("subscription exceeds maximum size")
+	}
+	rawConfig, err := config.UnmarshalRawConfig(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subscription content: %v", err)
+	}
+	meta.Usage = parseSubscriptionUsage(meta.SubscriptionUserinfo, rawProxyNames(rawConfig))
+	// the cache keeps the plain subscription, the override is checked here so it fails on update
+	merged, overridden, err := applyProfileOverride(params.ProfileId, body)
+	if err != nil {
+		return nil, err
+	}
+	if overridden {
+		clearBytes(merged)
+		meta.Overridden = true
+	}
+
+	data := body
+	if getEncryptionService() != nil {
+		data, err = getEncryptionService().Encrypt(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt subscription: %v", err)
+		}
+		defer clearBytes(data)
+	}
+	if err := GetSecureMemoryService().StoreSecureProfile(params.ProfileId, data); err != nil {
+		return nil, err
+	}
+
+	meta.Updated = true
+	meta.Size = len(body)
+	return meta, nil
+}
+
+// GetSubscriptionMeta returns the metadata of the last download of a profile
+func GetSubscriptionMeta(profileId string) *SubscriptionMeta {
+	subscriptionMetasLock.Lock()
+	defer subscriptionMetasLock.Unlock()
+	return subscriptionMetas[profileId]
+}
+
+func handleUpdateProfile(paramsString string, fn func(value string, err error)) {
+	go func() {
+		var params = &UpdateProfileParams{}
+		err := json.Unmarshal([]byte(paramsString), params)
+		if err != nil {
+			fn("", err)
+			return
+		}
+		params.Url = strings.TrimSpace(params.Url)
+		meta, err := UpdateProfile(context.Background(), params)
+		if err != nil {
+			fn("", err)
+			return
+		}
+		eventBus.Publish(ProfileUpdatedTopic, meta)
+		data, err := json.Marshal(meta)
+		if err != nil {
+			fn("", err)
+			return
+		}
+		fn(string(data), nil)
+	}()
+}
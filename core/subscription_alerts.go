@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/metacubex/mihomo/adapter/provider"
+	"github.com/metacubex/mihomo/config"
+	"github.com/metacubex/mihomo/log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRemainingPercent = 10
+	defaultExpireDays       = 3
+)
+
+type SubscriptionAlertKind string
+
+const (
+	QuotaLowSubscriptionAlert       SubscriptionAlertKind = "quota-low"
+	QuotaExhaustedSubscriptionAlert SubscriptionAlertKind = "quota-exhausted"
+	ExpiringSubscriptionAlert       SubscriptionAlertKind = "expiring"
+	ExpiredSubscriptionAlert        SubscriptionAlertKind = "expired"
+)
+
+const (
+	headerUsageSource   = "header"
+	embeddedUsageSource = "embedded"
+)
+
+type SubscriptionAlertParams struct {
+	// RemainingPercent warns once the remaining traffic drops below this share of the total
+	RemainingPercent int   `json:"remaining-percent"`
+	RemainingBytes   int64 `json:"remaining-bytes"`
+	ExpireDays       int   `json:"expire-days"`
+}
+
+type SubscriptionAlert struct {
+	ProfileId string                `json:"profile-id"`
+	Kind      SubscriptionAlertKind `json:"kind"`
+	Usage     *SubscriptionUsage    `json:"usage"`
+}
+
+var (
+	embeddedSize      = `([\d.]+)\s*([KMGTPE]?)i?B?`
+	embeddedRemaining = regexp.MustCompile(`(?i)(?:剩余流量|剩余|remaining|left)\s*[:：]?\s*` + embeddedSize)
+	embeddedTraffic   = regexp.MustCompile(`(?i)(?:已用流量|流量|traffic|used)\s*[:：]?\s*` + embeddedSize + `\s*/\s*` + embeddedSize)
+	embeddedExpire    = regexp.MustCompile(`(?i)(?:到期|过期|expire|expiry|expires)[^\d]{0,8}(\d{4})[-/.年](\d{1,2})[-/.月](\d{1,2})`)
+)
+
+func parseEmbeddedSize(value, unit string) (int64, bool) {
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return 0, false
+	}
+	exponent := strings.Index("KMGTPE", strings.ToUpper(unit)) + 1
+	return int64(number * math.Pow(1024, float64(exponent))), true
+}
+
+// parseEmbeddedUsage reads the traffic and expiry hints providers put into the names of dummy nodes
+func parseEmbeddedUsage(names []string) *SubscriptionUsage {
+	usage := &SubscriptionUsage{Source: embeddedUsageSource}
+	found := false
+	for _, name := range names {
+		if match := embeddedTraffic.FindStringSubmatch(name); match != nil {
+			used, okUsed := parseEmbeddedSize(match[1], match[2])
+			total, okTotal := parseEmbeddedSize(match[3], match[4])
+			if okUsed && okTotal && total > 0 {
+				usage.Used, usage.Total = used, total
+				usage.Remaining = total - used
+				found = true
+			}
+		} else if match := embeddedRemaining.FindStringSubmatch(name); match != nil {
+			if remaining, ok := parseEmbeddedSize(match[1], match[2]); ok {
+				usage.Remaining = remaining
+				found = true
+			}
+		}
+		if match := embeddedExpire.FindStringSubmatch(name); match != nil {
+			year, _ := strconv.Atoi(match[1])
+			month, _ := strconv.Atoi(match[2])
+			day, _ := strconv.Atoi(match[3])
+			if month >= 1 && month <= 12 && day >= 1 && day <= 31 {
+				usage.Expire = time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.Local).Unix()
+				found = true
+			}
+		}
+	}
+	if !found {
+		return nil
+	}
+	if usage.Remaining < 0 {
+		usage.Remaining = 0
+	}
+	usage.Expired = usage.Expire > 0 && time.Unix(usage.Expire, 0).Before(time.Now())
+	return usage
+}
+
+func rawProxyNames(rawConfig *config.RawConfig) []string {
+	names := make([]string, 0, len(rawConfig.Proxy))
+	for _, proxy := range rawConfig.Proxy {
+		if name, ok := proxy["name"].(string); ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// parseSubscriptionUsage prefers the subscription-userinfo header and fills the gaps from the node names
+func parseSubscriptionUsage(userinfo string, names []string) *SubscriptionUsage {
+	embedded := parseEmbeddedUsage(names)
+	if strings.TrimSpace(userinfo) == "" {
+		return embedded
+	}
+	usage := subscriptionUsage(provider.NewSubscriptionInfo(userinfo))
+	usage.Source = headerUsageSource
+	if embedded != nil {
+		if usage.Total == 0 {
+			usage.Used, usage.Total, usage.Remaining = embedded.Used, embedded.Total, embedded.Remaining
+		}
+		if usage.Expire == 0 && embedded.Expire != 0 {
+			usage.Expire = embedded.Expire
+			usage.Expired = embedded.Expired
+		}
+	}
+	return usage
+}
+
+// SubscriptionAlerts fires every alert of a profile once, it fires again after the condition cleared
+type SubscriptionAlerts struct {
+	mutex  sync.Mutex
+	params SubscriptionAlertParams
+	fired  map[string]map[SubscriptionAlertKind]bool
+}
+
+var subscriptionAlerts = &SubscriptionAlerts{
+	params: SubscriptionAlertParams{
+		RemainingPercent: defaultRemainingPercent,
+		ExpireDays:       defaultExpireDays,
+	},
+	fired: map[string]map[SubscriptionAlertKind]bool{},
+}
+
+func (a *SubscriptionAlerts) Set(params SubscriptionAlertParams) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if params.RemainingPercent < 0 || params.RemainingPercent > 100 {
+		params.RemainingPercent = defaultRemainingPercent
+	}
+	if params.ExpireDays < 0 {
+		params.ExpireDays = defaultExpireDays
+	}
+	a.params = params
+}
+
+func (a *SubscriptionAlerts) conditions(usage *SubscriptionUsage, now time.Time) map[SubscriptionAlertKind]bool {
+	conditions := map[SubscriptionAlertKind]bool{}
+	metered := usage.Total > 0 || usage.Source == embeddedUsageSource && usage.Remaining > 0
+	if metered {
+		exhausted := usage.Remaining <= 0
+		low := a.params.RemainingBytes > 0 && usage.Remaining < a.params.RemainingBytes
+		if usage.Total > 0 {
+			low = low || usage.Remaining*100 < usage.Total*int64(a.params.RemainingPercent)
+		}
+		conditions[QuotaExhaustedSubscriptionAlert] = exhausted
+		conditions[QuotaLowSubscriptionAlert] = low && !exhausted
+	}
+	if usage.Expire > 0 {
+		expire := time.Unix(usage.Expire, 0)
+		expired := !expire.After(now)
+		conditions[ExpiredSubscriptionAlert] = expired
+		conditions[ExpiringSubscriptionAlert] = !expired && expire.Sub(now) < time.Duration(a.params.ExpireDays)*24*time.Hour
+	}
+	return conditions
+}
+
+// Check compares the usage of a profile with the thresholds and posts the alerts that became true
+func (a *SubscriptionAlerts) Check(profileId string, usage *SubscriptionUsage) {
+	if usage == nil {
+		return
+	}
+	a.mutex.Lock()
+	fired := a.fired[profileId]
+	if fired == nil {
+		fired = map[SubscriptionAlertKind]bool{}
+		a.fired[profileId] = fired
+	}
+	var alerts []SubscriptionAlert
+	for kind, active := range a.conditions(usage, time.Now()) {
+		if active && !fired[kind] {
+			alerts = append(alerts, SubscriptionAlert{ProfileId: profileId, Kind: kind, Usage: usage})
+		}
+		fired[kind] = active
+	}
+	a.mutex.Unlock()
+	for _, alert := range alerts {
+		log.Warnln("[Subscription] %s %s, %d bytes remaining", alert.ProfileId, alert.Kind, usage.Remaining)
+		go sendMessage(Message{
+			Type: SubscriptionAlertMessage,
+			Data: alert,
+		})
+	}
+}
+
+func handleSetSubscriptionAlerts(paramsString string) bool {
+	var params = SubscriptionAlertParams{}
+	if err := json.Unmarshal([]byte(paramsString), &params); err != nil {
+		return false
+	}
+	subscriptionAlerts.Set(params)
+	return true
+}
+
+func handleGetSubscriptionUsage(profileId string) string {
+	meta := GetSubscriptionMeta(profileId)
+	if meta == nil || meta.Usage == nil {
+		return ""
+	}
+	data, err := json.Marshal(meta.Usage)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	syncStateFile     = "sync.json"
+	defaultSyncObject = "flclash/backup.bin"
+	syncMetaSuffix    = ".meta.json"
+	minSyncInterval   = 5 * time.Minute
+	syncResolveLocal  = "local"
+	syncResolveRemote = "remote"
+	SyncIdleState     = "idle"
+	SyncRunningState  = "syncing"
+	SyncPushedState   = "pushed"
+	SyncPulledState   = "pulled"
+	SyncUpToDateState = "up-to-date"
+	SyncConflictState = "conflict"
+	SyncErrorState    = "error"
+	SyncDisabledState = "disabled"
+)
+
+// SyncParams configures the remote, interval is in minutes and 0 only syncs on demand
+type SyncParams struct {
+	Provider   string `json:"provider"`
+	Url        string `json:"url"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	Bucket     string `json:"bucket"`
+	Region     string `json:"region"`
+	AccessKey  string `json:"access-key"`
+	SecretKey  string `json:"secret-key"`
+	Object     string `json:"object"`
+	Proxy      string `json:"proxy"`
+	Passphrase string `json:"passphrase"`
+	DeviceId   string `json:"device-id"`
+	Interval   int    `json:"interval"`
+}
+
+// SyncVector counts the pushes of every device, the remote and the local copy are compared with it
+type SyncVector map[string]uint64
+
+// SyncMeta is stored next to the bundle
+type SyncMeta struct {
+	Vector  SyncVector `json:"vector"`
+	Device  string     `json:"device"`
+	Updated int64      `json:"updated"`
+	Digest  string     `json:"digest"`
+}
+
+type SyncStatus struct {
+	State        string     `json:"state"`
+	Error        string     `json:"error,omitempty"`
+	Provider     string     `json:"provider"`
+	Device       string     `json:"device"`
+	Vector       SyncVector `json:"vector"`
+	LastSync     int64      `json:"last-sync"`
+	RemoteDevice string     `json:"remote-device,omitempty"`
+	Interval     int        `json:"interval"`
+}
+
+type syncState struct {
+	Params   *SyncParams `json:"params"`
+	Vector   SyncVector  `json:"vector"`
+	Digest   string      `json:"digest"`
+	LastSync int64       `json:"last-sync"`
+}
+
+// SyncEngine pushes and pulls the backup bundle and detects concurrent changes with vector timestamps
+type SyncEngine struct {
+	mutex   sync.Mutex
+	runLock sync.Mutex
+	state   *syncState
+	loaded  bool
+	status  SyncStatus
+	cancel  context.CancelFunc
+	remote  *SyncMeta
+}
+
+var syncEngine = &SyncEngine{}
+
+// compare returns 1 when v is newer, -1 when other is newer, 0 when equal and 2 when they are concurrent
+func (v SyncVector) compare(other SyncVector) int {
+	newer, older := false, false
+	for device, count := range v {
+		if count > other[device] {
+			newer = true
+		} else if count < other[device] {
+			older = true
+		}
+	}
+	for device, count := range other {
+		if _, ok := v[device]; !ok && count > 0 {
+			older = true
+		}
+	}
+	switch {
+	case newer && older:
+		return 2
+	case newer:
+		return 1
+	case older:
+		return -1
+	}
+	return 0
+}
+
+func (v SyncVector) merge(other SyncVector) SyncVector {
+	merged := SyncVector{}
+	for device, count := range v {
+		merged[device] = count
+	}
+	for device, count := range other {
+		if count > merged[device] {
+			merged[device] = count
+		}
+	}
+	return merged
+}
+
+func (e *SyncEngine) path() string {
+	return constant.Path.Resolve(syncStateFile)
+}
+
+// loadLocked reads the persisted state, the credentials are stored encrypted with the device key
+func (e *SyncEngine) loadLocked() {
+	if e.loaded || !isInit {
+		return
+	}
+	data, err := os.ReadFile(e.path())
+	if err != nil {
+		e.loaded = true
+		return
+	}
+	state := &syncState{}
+	if json.Unmarshal(data, state) != nil {
+		e.loaded = true
+		return
+	}
+	if state.Params != nil {
+		for _, field := range []*string{&state.Params.Password, &state.Params.SecretKey, &state.Params.Passphrase} {
+			plain, err := decryptSecretValue(*field)
+			if errors.Is(err, errNoKeyProvider) {
+				// the key comes with the init of the encryption, it resumes the engine
+				return
+			}
+			if err != nil {
+				log.Warnln("[Sync] credentials unavailable: %v", err)
+				state.Params = nil
+				break
+			}
+			*field = plain
+		}
+	}
+	e.state = state
+	e.loaded = true
+}
+
+func (e *SyncEngine) saveLocked() {
+	if !isInit || e.state == nil {
+		return
+	}
+	state := *e.state
+	if state.Params != nil {
+		if getEncryptionService() == nil {
+			// without a key the credentials only live in memory
+			state.Params = nil
+		} else {
+			params := *state.Params
+			for _, field := range []*string{&params.Password, &params.SecretKey, &params.Passphrase} {
+				if *field == "" {
+					continue
+				}
+				encrypted, err := EncryptSecretValue(*field)
+				if err != nil {
+					return
+				}
+				*field = encrypted
+			}
+			state.Params = &params
+		}
+	}
+	data, err := json.Marshal(&state)
+	if err != nil {
+		return
+	}
+	_ = os.WriteFile(e.path(), data, 0600)
+}
+
+func (e *SyncEngine) setStatusLocked(state string, err error) {
+	e.status.State = state
+	e.status.Error = ""
+	if err != nil {
+		e.status.Error = err.Error()
+	}
+	if e.state != nil {
+		e.status.Vector = e.state.Vector
+		e.status.LastSync = e.state.LastSync
+		if e.state.Params != nil {
+			e.status.Provider = e.state.Params.Provider
+			e.status.Device = e.state.Params.DeviceId
+			e.status.Interval = e.state.Params.Interval
+		}
+	}
+	if e.remote != nil {
+		e.status.RemoteDevice = e.remote.Device
+	}
+	status := e.status
+	go sendMessage(Message{
+		Type: SyncMessage,
+		Data: status,
+	})
+}
+
+// Configure stores the remote and restarts the schedule
+func (e *SyncEngine) Configure(params *SyncParams) error {
+	if params.Provider == "" {
+		e.Disable()
+		return nil
+	}
+	if _, err := newSyncStorage(params); err != nil {
+		return err
+	}
+	if len(params.Passphrase) < backupMinPassphrase {
+		return fmt.Errorf("passphrase must have at least %d characters", backupMinPassphrase)
+	}
+	if params.DeviceId == "" {
+		hostname, _ := os.Hostname()
+		params.DeviceId = hostname
+	}
+	if params.DeviceId == "" {
+		return errors.New("device id is required")
+	}
+	if params.Object == "" {
+		params.Object = defaultSyncObject
+	}
+	e.mutex.Lock()
+	e.loadLocked()
+	if e.state == nil || e.state.Params == nil || e.state.Params.Provider != params.Provider || e.state.Params.Url != params.Url || e.state.Params.Bucket != params.Bucket || e.state.Params.Object != params.Object {
+		// a new remote starts a new history
+		e.state = &syncState{Vector: SyncVector{}}
+	}
+	e.state.Params = params
+	// the remote configured now replaces one whose credentials wait for the key
+	e.loaded = true
+	e.remote = nil
+	e.saveLocked()
+	e.setStatusLocked(SyncIdleState, nil)
+	e.mutex.Unlock()
+	e.schedule()
+	return nil
+}
+
+func (e *SyncEngine) Disable() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.loadLocked()
+	e.stopLocked()
+	e.state = nil
+	e.remote = nil
+	_ = os.Remove(e.path())
+	e.status = SyncStatus{}
+	e.setStatusLocked(SyncDisabledState, nil)
+}
+
+func (e *SyncEngine) stopLocked() {
+	if e.cancel != nil {
+		e.cancel()
+		e.cancel = nil
+	}
+}
+
+// Stop cancels the schedule, the state is read again after the next init
+func (e *SyncEngine) Stop() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.stopLocked()
+	e.state = nil
+	e.remote = nil
+	e.loaded = false
+	e.status = SyncStatus{}
+}
+
+// Resume starts the schedule of a remote configured in an earlier run
+func (e *SyncEngine) Resume() {
+	e.schedule()
+}
+
+func (e *SyncEngine) schedule() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.loadLocked()
+	e.stopLocked()
+	if e.state == nil || e.state.Params == nil || e.state.Params.Interval <= 0 {
+		return
+	}
+	interval := time.Duration(e.state.Params.Interval) * time.Minute
+	if interval < minSyncInterval {
+		interval = minSyncInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+	go func() {
+		ticker := time.NewTicker(powerScaled(interval))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				ticker.Reset(powerScaled(interval))
+				runGuarded("sync", func() {
+					_ = e.Sync(ctx, "")
+				})
+			}
+		}
+	}()
+}
+
+// localDigest fingerprints the plain content that goes into the bundle
+func localDigest() (string, error) {
+	names, err := backupFileNames()
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	for _, name := range names {
+		data, err := readBackupFile(name)
+		if err != nil {
+			return "", err
+		}
+		hash.Write([]byte(name))
+		hash.Write([]byte{0})
+		hash.Write(data)
+		clearBytes(data)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Sync runs one round, resolve forces the local or the remote copy after a conflict
+func (e *SyncEngine) Sync(ctx context.Context, resolve string) error {
+	e.runLock.Lock()
+	defer e.runLock.Unlock()
+	e.mutex.Lock()
+	e.loadLocked()
+	if e.state == nil || e.state.Params == nil {
+		e.mutex.Unlock()
+		return errors.New("sync is not configured")
+	}
+	params := *e.state.Params
+	vector := e.state.Vector.merge(nil)
+	lastDigest := e.state.Digest
+	e.setStatusLocked(SyncRunningState, nil)
+	e.mutex.Unlock()
+
+	state, remote, err := e.round(ctx, &params, vector, lastDigest, resolve)
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.state == nil || e.state.Params == nil {
+		return err
+	}
+	e.remote = remote
+	if err != nil {
+		e.setStatusLocked(SyncErrorState, err)
+		log.Warnln("[Sync] %v", err)
+		return err
+	}
+	if state != SyncConflictState {
+		e.state.LastSync = time.Now().UnixMilli()
+	}
+	e.saveLocked()
+	e.setStatusLocked(state, nil)
+	return nil
+}
+
+func (e *SyncEngine) round(ctx context.Context, params *SyncParams, vector SyncVector, lastDigest string, resolve string) (string, *SyncMeta, error) {
+	storage, err := newSyncStorage(params)
+	if err != nil {
+		return "", nil, err
+	}
+	remote := &SyncMeta{}
+	data, err := storage.Get(ctx, params.Object+syncMetaSuffix)
+	if errors.Is(err, errSyncNotFound) {
+		remote = nil
+	} else if err != nil {
+		return "", nil, err
+	} else if err := json.Unmarshal(data, remote); err != nil {
+		return "", nil, fmt.Errorf("remote metadata: %v", err)
+	}
+	digest, err := localDigest()
+	if err != nil {
+		return "", remote, err
+	}
+	changed := digest != lastDigest
+	order := 1
+	if remote != nil {
+		order = vector.compare(remote.Vector)
+	}
+	action := ""
+	switch {
+	case resolve == syncResolveLocal:
+		action = "push"
+	case resolve == syncResolveRemote:
+		if remote == nil {
+			return "", nil, errors.New("there is no remote copy")
+		}
+		action = "pull"
+	case order == 0 || order == 1:
+		if changed || order == 1 {
+			action = "push"
+		}
+	case order == -1:
+		if changed {
+			return SyncConflictState, remote, nil
+		}
+		action = "pull"
+	default:
+		return SyncConflictState, remote, nil
+	}
+	switch action {
+	case "push":
+		if remote != nil {
+			vector = vector.merge(remote.Vector)
+		}
+		vector[params.DeviceId]++
+		bundle, err := BackupAll(&BackupParams{Passphrase: params.Passphrase})
+		if err != nil {
+			return "", remote, err
+		}
+		if err := storage.Put(ctx, params.Object, bundle); err != nil {
+			return "", remote, err
+		}
+		meta := &SyncMeta{
+			Vector:  vector,
+			Device:  params.DeviceId,
+			Updated: time.Now().UnixMilli(),
+			Digest:  digest,
+		}
+		metaData, _ := json.Marshal(meta)
+		if err := storage.Put(ctx, params.Object+syncMetaSuffix, metaData); err != nil {
+			return "", remote, err
+		}
+		e.commit(vector, digest)
+		return SyncPushedState, meta, nil
+	case "pull":
+		bundle, err := storage.Get(ctx, params.Object)
+		if err != nil {
+			return "", remote, err
+		}
+		result, err := RestoreAll(&RestoreParams{Passphrase: params.Passphrase}, bundle)
+		if err != nil {
+			return "", remote, err
+		}
+		digest, err = localDigest()
+		if err != nil {
+			return "", remote, err
+		}
+		e.commit(remote.Vector.merge(nil), digest)
+		go sendMessage(Message{
+			Type: SyncMessage,
+			Data: map[string]any{"state": SyncPulledState, "profiles": result.Profiles},
+		})
+		return SyncPulledState, remote, nil
+	}
+	return SyncUpToDateState, remote, nil
+}
+
+func (e *SyncEngine) commit(vector SyncVector, digest string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.state == nil {
+		return
+	}
+	e.state.Vector = vector
+	e.state.Digest = digest
+}
+
+func (e *SyncEngine) Status() SyncStatus {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.loadLocked()
+	if e.state == nil || e.state.Params == nil {
+		return SyncStatus{State: SyncDisabledState}
+	}
+	if e.status.State == "" {
+		e.status.State = SyncIdleState
+	}
+	status := e.status
+	status.Provider = e.state.Params.Provider
+	status.Device = e.state.Params.DeviceId
+	status.Interval = e.state.Params.Interval
+	status.Vector = e.state.Vector
+	status.LastSync = e.state.LastSync
+	return status
+}
+
+func handleSetSync(paramsString string) error {
+	var params = &SyncParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	return syncEngine.Configure(params)
+}
+
+// handleSyncNow takes "", "local" or "remote"
+func handleSyncNow(resolve string) error {
+	if resolve != "" && resolve != syncResolveLocal && resolve != syncResolveRemote {
+		return fmt.Errorf("unknown resolution %s", resolve)
+	}
+	return syncEngine.Sync(context.Background(), resolve)
+}
+
+func handleGetSyncStatus() string {
+	data, err := json.Marshal(syncEngine.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
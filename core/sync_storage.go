@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	mihomoHttp "github.com/metacubex/mihomo/component/http"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	syncStorageWebDAV = "webdav"
+	syncStorageS3     = "s3"
+
+	syncRequestTimeout = 60 * time.Second
+	syncMaxObjectSize  = 256 << 20
+)
+
+var errSyncNotFound = errors.New("remote object not found")
+
+// syncStorage keeps the bundle and its metadata as two named objects
+type syncStorage interface {
+	Get(ctx context.Context, name string) ([]byte, error)
+	Put(ctx context.Context, name string, data []byte) error
+}
+
+func newSyncStorage(params *SyncParams) (syncStorage, error) {
+	switch params.Provider {
+	case syncStorageWebDAV:
+		if params.Url == "" {
+			return nil, errors.New("webdav url is required")
+		}
+		return &webdavStorage{
+			base:     strings.TrimSuffix(params.Url, "/"),
+			username: params.Username,
+			password: params.Password,
+			proxy:    params.Proxy,
+		}, nil
+	case syncStorageS3:
+		if params.Url == "" || params.Bucket == "" || params.AccessKey == "" || params.SecretKey == "" {
+			return nil, errors.New("s3 endpoint, bucket and keys are required")
+		}
+		region := params.Region
+		if region == "" {
+			region = "us-east-1"
+		}
+		return &s3Storage{
+			endpoint:  strings.TrimSuffix(params.Url, "/"),
+			bucket:    params.Bucket,
+			region:    region,
+			accessKey: params.AccessKey,
+			secretKey: params.SecretKey,
+			proxy:     params.Proxy,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown sync provider %s", params.Provider)
+}
+
+func doSyncRequest(ctx context.Context, method string, target string, header http.Header, data []byte, proxy string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, syncRequestTimeout)
+	defer cancel()
+	var body io.Reader
+	if data != nil {
+		body = bytes.NewReader(data)
+	}
+	resp, err := mihomoHttp.HttpRequestWithProxy(ctx, target, method, header, body, proxy)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errSyncNotFound
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, syncMaxObjectSize))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s %s: %s", method, path.Base(target), resp.Status)
+	}
+	return content, nil
+}
+
+type webdavStorage struct {
+	base     string
+	username string
+	password string
+	proxy    string
+}
+
+func (s *webdavStorage) header() http.Header {
+	header := http.Header{}
+	if s.username != "" {
+		request := &http.Request{Header: header}
+		request.SetBasicAuth(s.username, s.password)
+	}
+	return header
+}
+
+func (s *webdavStorage) url(name string) string {
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return s.base + "/" + strings.Join(parts, "/")
+}
+
+func (s *webdavStorage) Get(ctx context.Context, name string) ([]byte, error) {
+	return doSyncRequest(ctx, http.MethodGet, s.url(name), s.header(), nil, s.proxy)
+}
+
+// Put creates the missing collections first, servers answer 405 for the ones that exist
+func (s *webdavStorage) Put(ctx context.Context, name string, data []byte) error {
+	dirs := strings.Split(path.Dir(name), "/")
+	for i := range dirs {
+		if dirs[i] == "." || dirs[i] == "" {
+			continue
+		}
+		_, _ = doSyncRequest(ctx, "MKCOL", s.url(strings.Join(dirs[:i+1], "/"))+"/", s.header(), nil, s.proxy)
+	}
+	header := s.header()
+	header.Set("Content-Type", "application/octet-stream")
+	_, err := doSyncRequest(ctx, http.MethodPut, s.url(name), header, data, s.proxy)
+	return err
+}
+
+// s3Storage talks to S3 compatible services with path style urls and signature v4
+type s3Storage struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	proxy     string
+}
+
+func hmacSHA256(key []byte, value string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *s3Storage) request(ctx context.Context, method string, name string, data []byte) ([]byte, error) {
+	target, err := url.Parse(s.endpoint + "/" + s.bucket + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(data)
+	canonicalURI := target.EscapedPath()
+	canonicalHeaders := "host:" + target.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{method, canonicalURI, "", canonicalHeaders, signedHeaders, payloadHash}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	header := http.Header{}
+	header.Set("X-Amz-Date", amzDate)
+	header.Set("X-Amz-Content-Sha256", payloadHash)
+	header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, signedHeaders, signature))
+	if data != nil {
+		header.Set("Content-Type", "application/octet-stream")
+	}
+	return doSyncRequest(ctx, method, target.String(), header, data, s.proxy)
+}
+
+func (s *s3Storage) Get(ctx context.Context, name string) ([]byte, error) {
+	return s.request(ctx, http.MethodGet, name, nil)
+}
+
+func (s *s3Storage) Put(ctx context.Context, name string, data []byte) error {
+	if data == nil {
+		data = []byte{}
+	}
+	_, err := s.request(ctx, http.MethodPut, name, data)
+	return err
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	systemProxyStoreFile   = "system_proxy.json"
+	maxSystemProxyBypass   = 512
+	defaultSystemProxyHost = "127.0.0.1"
+)
+
+// SystemProxyParams points the proxy settings of the desktop at the core, SyncBypass adds the
+// domains the rules send direct to the bypass list
+type SystemProxyParams struct {
+	Enable     bool     `json:"enable"`
+	Host       string   `json:"host"`
+	Port       int      `json:"port"`
+	Bypass     []string `json:"bypass"`
+	SyncBypass bool     `json:"sync-bypass"`
+}
+
+type SystemProxyStatus struct {
+	SystemProxyParams
+	Backend string `json:"backend"`
+	Enabled bool   `json:"enabled"`
+	Server  string `json:"server,omitempty"`
+	Count   int    `json:"bypass-count"`
+	Saved   bool   `json:"saved"`
+	Error   string `json:"error,omitempty"`
+}
+
+// systemProxyStore is what the settings were before the core changed them, it stays on disk while
+// the core owns them so a crash is undone on the next start
+type systemProxyStore struct {
+	Previous *systemProxySnapshot `json:"previous"`
+	Server   string               `json:"server"`
+}
+
+type SystemProxy struct {
+	mutex    sync.Mutex
+	params   SystemProxyParams
+	previous *systemProxySnapshot
+	server   string
+	bypass   []string
+	err      error
+}
+
+var systemProxy = &SystemProxy{}
+
+func joinSystemProxyServer(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func (s *SystemProxy) path() string {
+	return C.Path.Resolve(systemProxyStoreFile)
+}
+
+func (s *SystemProxy) saveLocked() error {
+	data, err := json.Marshal(&systemProxyStore{Previous: s.previous, Server: s.server})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path(), data, 0644)
+}
+
+// Recover puts back the settings a core that did not shut down left behind
+func (s *SystemProxy) Recover() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, err := os.ReadFile(s.path())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnln("[SystemProxy] load error: %v", err)
+		}
+		return
+	}
+	store := &systemProxyStore{}
+	if err = json.Unmarshal(data, store); err != nil {
+		log.Warnln("[SystemProxy] load error: %v", err)
+		_ = os.Remove(s.path())
+		return
+	}
+	if store.Previous != nil {
+		if err = restoreSystemProxy(store.Previous); err != nil {
+			log.Warnln("[SystemProxy] recover error: %v", err)
+			return
+		}
+		log.Infoln("[SystemProxy] restored the settings left at %s", store.Server)
+	}
+	_ = os.Remove(s.path())
+}
+
+// directBypass lists the domains the rules send direct in front of the first rule that is not a
+// domain one, past it the order of the rules no longer holds in a bypass list, and leaves out the
+// suffixes an earlier rule proxies a name of
+func directBypass() []string {
+	proxies := tunnel.Proxies()
+	var bypass, proxied []string
+	for _, rule := range flattenPacRules(tunnel.Rules()) {
+		ruleType := rule.RuleType()
+		if ruleType != C.Domain && ruleType != C.DomainSuffix {
+			break
+		}
+		payload := strings.ToLower(rule.Payload())
+		if pacRoute(proxies, rule.Adapter()) != pacDirect {
+			proxied = append(proxied, payload)
+			continue
+		}
+		if ruleType == C.DomainSuffix && shadowsProxied(payload, proxied) {
+			continue
+		}
+		if ruleType == C.DomainSuffix {
+			bypass = append(bypass, "*."+payload)
+		}
+		bypass = append(bypass, payload)
+		if len(bypass) >= maxSystemProxyBypass {
+			break
+		}
+	}
+	return bypass
+}
+
+func shadowsProxied(suffix string, proxied []string) bool {
+	for _, name := range proxied {
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SystemProxy) bypassList(params *SystemProxyParams) []string {
+	bypass := append([]string{}, defaultSystemProxyBypass...)
+	seen := map[string]struct{}{}
+	for _, item := range bypass {
+		seen[item] = struct{}{}
+	}
+	extra := params.Bypass
+	if params.SyncBypass {
+		extra = append(append([]string{}, extra...), directBypass()...)
+	}
+	for _, item := range extra {
+		item = strings.TrimSpace(item)
+		if _, ok := seen[item]; ok || item == "" {
+			continue
+		}
+		seen[item] = struct{}{}
+		bypass = append(bypass, item)
+	}
+	return bypass
+}
+
+func (s *SystemProxy) restoreLocked() error {
+	if s.previous == nil {
+		return nil
+	}
+	if err := restoreSystemProxy(s.previous); err != nil {
+		return err
+	}
+	s.previous = nil
+	s.server = ""
+	s.bypass = nil
+	_ = os.Remove(s.path())
+	return nil
+}
+
+// Set applies the proxy, the settings found the first time are kept until it is disabled
+func (s *SystemProxy) Set(params *SystemProxyParams) error {
+	if params.Host == "" {
+		params.Host = defaultSystemProxyHost
+	}
+	port, mixed := pacProxyPort()
+	if params.Port == 0 {
+		params.Port = port
+	}
+	// socks only goes to a mixed port
+	mixed = mixed && params.Port == port
+	if params.Enable && params.Port == 0 {
+		return errors.New("no http or mixed port is open")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.params = *params
+	s.err = nil
+	if !params.Enable {
+		s.err = s.restoreLocked()
+		return s.err
+	}
+	if s.previous == nil {
+		previous, err := readSystemProxy()
+		if err != nil {
+			s.err = err
+			return err
+		}
+		s.previous = previous
+	}
+	s.bypass = s.bypassList(params)
+	s.server = joinSystemProxyServer(params.Host, params.Port)
+	if err := s.saveLocked(); err != nil {
+		s.err = err
+		return err
+	}
+	if err := applySystemProxy(params.Host, params.Port, mixed, s.bypass); err != nil {
+		s.err = err
+		_ = restoreSystemProxy(s.previous)
+		return err
+	}
+	log.Infoln("[SystemProxy] set to %s with %d bypass entries", s.server, len(s.bypass))
+	return nil
+}
+
+// Restore undoes the proxy at shutdown
+func (s *SystemProxy) Restore() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.restoreLocked(); err != nil {
+		log.Warnln("[SystemProxy] restore error: %v", err)
+	}
+}
+
+func (s *SystemProxy) Status() *SystemProxyStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	status := &SystemProxyStatus{
+		SystemProxyParams: s.params,
+		Backend:           systemProxyBackend(),
+		Count:             len(s.bypass),
+		Saved:             s.previous != nil,
+	}
+	enabled, server, err := currentSystemProxy()
+	status.Enabled, status.Server = enabled, server
+	if err == nil {
+		err = s.err
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	return status
+}
+
+func handleSetSystemProxy(paramsString string) error {
+	var params = &SystemProxyParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	return systemProxy.Set(params)
+}
+
+func handleGetSystemProxy() string {
+	data, err := json.Marshal(systemProxy.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,205 @@
+//go:build darwin
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+var defaultSystemProxyBypass = []string{
+	"127.0.0.1", "192.168.0.0/16", "10.0.0.0/8", "172.16.0.0/12", "localhost", "*.local", "<local>",
+}
+
+type networkProxy struct {
+	Enabled bool   `json:"enabled"`
+	Server  string `json:"server"`
+	Port    int    `json:"port"`
+}
+
+type serviceProxy struct {
+	Web    networkProxy `json:"web"`
+	Secure networkProxy `json:"secure"`
+	Socks  networkProxy `json:"socks"`
+	Bypass []string     `json:"bypass"`
+}
+
+// systemProxySnapshot holds the proxies of every enabled network service by name
+type systemProxySnapshot struct {
+	Services map[string]*serviceProxy `json:"services"`
+}
+
+var networkProxyKinds = []struct {
+	get, set, state string
+	field           func(*serviceProxy) *networkProxy
+}{
+	{"-getwebproxy", "-setwebproxy", "-setwebproxystate", func(s *serviceProxy) *networkProxy { return &s.Web }},
+	{"-getsecurewebproxy", "-setsecurewebproxy", "-setsecurewebproxystate", func(s *serviceProxy) *networkProxy { return &s.Secure }},
+	{"-getsocksfirewallproxy", "-setsocksfirewallproxy", "-setsocksfirewallproxystate", func(s *serviceProxy) *networkProxy { return &s.Socks }},
+}
+
+func systemProxyBackend() string {
+	return "networksetup"
+}
+
+func networksetup(args ...string) (string, error) {
+	output, err := exec.Command("networksetup", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("networksetup %s: %v %s", args[0], err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+// networkServices lists the enabled services, the first line is a notice and the disabled ones
+// start with an asterisk
+func networkServices() ([]string, error) {
+	output, err := networksetup("-listallnetworkservices")
+	if err != nil {
+		return nil, err
+	}
+	var services []string
+	scanner := bufio.NewScanner(bytes.NewBufferString(output))
+	for first := true; scanner.Scan(); first = false {
+		line := strings.TrimSpace(scanner.Text())
+		if first || line == "" || strings.HasPrefix(line, "*") {
+			continue
+		}
+		services = append(services, line)
+	}
+	if len(services) == 0 {
+		return nil, errors.New("no enabled network service")
+	}
+	return services, nil
+}
+
+func parseNetworkProxy(output string) networkProxy {
+	proxy := networkProxy{}
+	for _, line := range strings.Split(output, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "Enabled":
+			proxy.Enabled = value == "Yes"
+		case "Server":
+			proxy.Server = value
+		case "Port":
+			proxy.Port, _ = strconv.Atoi(value)
+		}
+	}
+	return proxy
+}
+
+func readServiceProxy(service string) (*serviceProxy, error) {
+	proxy := &serviceProxy{}
+	for _, kind := range networkProxyKinds {
+		output, err := networksetup(kind.get, service)
+		if err != nil {
+			return nil, err
+		}
+		*kind.field(proxy) = parseNetworkProxy(output)
+	}
+	output, err := networksetup("-getproxybypassdomains", service)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(output, "There aren't any") {
+		for _, line := range strings.Split(output, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				proxy.Bypass = append(proxy.Bypass, line)
+			}
+		}
+	}
+	return proxy, nil
+}
+
+func readSystemProxy() (*systemProxySnapshot, error) {
+	services, err := networkServices()
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &systemProxySnapshot{Services: map[string]*serviceProxy{}}
+	for _, service := range services {
+		proxy, err := readServiceProxy(service)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Services[service] = proxy
+	}
+	return snapshot, nil
+}
+
+func writeServiceProxy(service string, proxy *serviceProxy) error {
+	for _, kind := range networkProxyKinds {
+		value := kind.field(proxy)
+		if value.Server != "" {
+			if _, err := networksetup(kind.set, service, value.Server, strconv.Itoa(value.Port)); err != nil {
+				return err
+			}
+		}
+		state := "off"
+		if value.Enabled {
+			state = "on"
+		}
+		if _, err := networksetup(kind.state, service, state); err != nil {
+			return err
+		}
+	}
+	bypass := proxy.Bypass
+	if len(bypass) == 0 {
+		bypass = []string{"Empty"}
+	}
+	_, err := networksetup(append([]string{"-setproxybypassdomains", service}, bypass...)...)
+	return err
+}
+
+func applySystemProxy(host string, port int, mixed bool, bypass []string) error {
+	services, err := networkServices()
+	if err != nil {
+		return err
+	}
+	value := networkProxy{Enabled: true, Server: host, Port: port}
+	socks := networkProxy{}
+	if mixed {
+		socks = value
+	}
+	for _, service := range services {
+		if err := writeServiceProxy(service, &serviceProxy{Web: value, Secure: value, Socks: socks, Bypass: bypass}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func restoreSystemProxy(snapshot *systemProxySnapshot) error {
+	var errs []error
+	for service, proxy := range snapshot.Services {
+		if err := writeServiceProxy(service, proxy); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func currentSystemProxy() (bool, string, error) {
+	services, err := networkServices()
+	if err != nil {
+		return false, "", err
+	}
+	output, err := networksetup("-getwebproxy", services[0])
+	if err != nil {
+		return false, "", err
+	}
+	proxy := parseNetworkProxy(output)
+	if proxy.Server == "" {
+		return proxy.Enabled, "", nil
+	}
+	return proxy.Enabled, joinSystemProxyServer(proxy.Server, proxy.Port), nil
+}
@@ -0,0 +1,231 @@
+//go:build linux && !android
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const kioProxyGroup = "Proxy Settings"
+
+var defaultSystemProxyBypass = []string{
+	"localhost", "127.0.0.1", "192.168.0.0/16", "10.0.0.0/8", "172.16.0.0/12", "::1",
+}
+
+var gnomeProxyKeys = [][2]string{
+	{"org.gnome.system.proxy", "mode"},
+	{"org.gnome.system.proxy", "ignore-hosts"},
+	{"org.gnome.system.proxy.http", "host"},
+	{"org.gnome.system.proxy.http", "port"},
+	{"org.gnome.system.proxy.https", "host"},
+	{"org.gnome.system.proxy.https", "port"},
+	{"org.gnome.system.proxy.socks", "host"},
+	{"org.gnome.system.proxy.socks", "port"},
+}
+
+var kioProxyKeys = []string{"ProxyType", "httpProxy", "httpsProxy", "socksProxy", "NoProxyFor"}
+
+// systemProxySnapshot holds the raw values of the gsettings keys and of kioslaverc, a desktop
+// without one of them leaves it nil
+type systemProxySnapshot struct {
+	Gnome map[string]string `json:"gnome,omitempty"`
+	Kio   map[string]string `json:"kio,omitempty"`
+}
+
+func lookCommand(names ...string) string {
+	for _, name := range names {
+		if path, err := exec.LookPath(name); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+func gsettingsCommand() string {
+	return lookCommand("gsettings")
+}
+
+// kioCommands finds kreadconfig and kwriteconfig of plasma 6 first, only set up on a kde session
+func kioCommands() (string, string) {
+	if !strings.Contains(strings.ToUpper(os.Getenv("XDG_CURRENT_DESKTOP")), "KDE") {
+		return "", ""
+	}
+	return lookCommand("kreadconfig6", "kreadconfig5"), lookCommand("kwriteconfig6", "kwriteconfig5")
+}
+
+func systemProxyBackend() string {
+	var backends []string
+	if gsettingsCommand() != "" {
+		backends = append(backends, "gsettings")
+	}
+	if read, write := kioCommands(); read != "" && write != "" {
+		backends = append(backends, "kioslaverc")
+	}
+	return strings.Join(backends, ",")
+}
+
+func runCommand(name string, args ...string) (string, error) {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %v %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func gnomeKey(key [2]string) string {
+	return key[0] + " " + key[1]
+}
+
+func readSystemProxy() (*systemProxySnapshot, error) {
+	snapshot := &systemProxySnapshot{}
+	if gsettings := gsettingsCommand(); gsettings != "" {
+		snapshot.Gnome = map[string]string{}
+		for _, key := range gnomeProxyKeys {
+			value, err := runCommand(gsettings, "get", key[0], key[1])
+			if err != nil {
+				return nil, err
+			}
+			snapshot.Gnome[gnomeKey(key)] = value
+		}
+	}
+	if read, write := kioCommands(); read != "" && write != "" {
+		snapshot.Kio = map[string]string{}
+		for _, key := range kioProxyKeys {
+			value, err := runCommand(read, "--file", "kioslaverc", "--group", kioProxyGroup, "--key", key)
+			if err != nil {
+				return nil, err
+			}
+			snapshot.Kio[key] = value
+		}
+	}
+	if snapshot.Gnome == nil && snapshot.Kio == nil {
+		return nil, errors.New("neither gsettings nor kwriteconfig is available")
+	}
+	return snapshot, nil
+}
+
+func writeGnomeProxy(values map[string]string) error {
+	gsettings := gsettingsCommand()
+	if gsettings == "" {
+		return errors.New("gsettings is not available")
+	}
+	for _, key := range gnomeProxyKeys {
+		value, ok := values[gnomeKey(key)]
+		if !ok {
+			continue
+		}
+		if _, err := runCommand(gsettings, "set", key[0], key[1], value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeKioProxy(values map[string]string) error {
+	_, write := kioCommands()
+	if write == "" {
+		return errors.New("kwriteconfig is not available")
+	}
+	for _, key := range kioProxyKeys {
+		value, ok := values[key]
+		if !ok {
+			continue
+		}
+		if _, err := runCommand(write, "--file", "kioslaverc", "--group", kioProxyGroup, "--key", key, value); err != nil {
+			return err
+		}
+	}
+	// the running kde programs read kioslaverc again on this signal
+	if dbus := lookCommand("dbus-send"); dbus != "" {
+		_, _ = runCommand(dbus, "--type=signal", "/KIO/Scheduler", "org.kde.KIO.Scheduler.reparseSlaveConfiguration", "string:")
+	}
+	return nil
+}
+
+func gvariantStrings(values []string) string {
+	quoted := make([]string, 0, len(values))
+	for _, value := range values {
+		quoted = append(quoted, "'"+strings.ReplaceAll(value, "'", "")+"'")
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+func applySystemProxy(host string, port int, mixed bool, bypass []string) error {
+	snapshot := &systemProxySnapshot{}
+	if gsettingsCommand() != "" {
+		socksHost, socksPort := "", 0
+		if mixed {
+			socksHost, socksPort = host, port
+		}
+		snapshot.Gnome = map[string]string{
+			"org.gnome.system.proxy mode":         "manual",
+			"org.gnome.system.proxy ignore-hosts": gvariantStrings(bypass),
+			"org.gnome.system.proxy.http host":    host,
+			"org.gnome.system.proxy.http port":    strconv.Itoa(port),
+			"org.gnome.system.proxy.https host":   host,
+			"org.gnome.system.proxy.https port":   strconv.Itoa(port),
+			"org.gnome.system.proxy.socks host":   socksHost,
+			"org.gnome.system.proxy.socks port":   strconv.Itoa(socksPort),
+		}
+	}
+	if read, write := kioCommands(); read != "" && write != "" {
+		server := host + " " + strconv.Itoa(port)
+		socks := ""
+		if mixed {
+			socks = "socks://" + server
+		}
+		snapshot.Kio = map[string]string{
+			"ProxyType":  "1",
+			"httpProxy":  "http://" + server,
+			"httpsProxy": "http://" + server,
+			"socksProxy": socks,
+			"NoProxyFor": strings.Join(bypass, ","),
+		}
+	}
+	if snapshot.Gnome == nil && snapshot.Kio == nil {
+		return errors.New("neither gsettings nor kwriteconfig is available")
+	}
+	return restoreSystemProxy(snapshot)
+}
+
+func restoreSystemProxy(snapshot *systemProxySnapshot) error {
+	var errs []error
+	if snapshot.Gnome != nil {
+		errs = append(errs, writeGnomeProxy(snapshot.Gnome))
+	}
+	if snapshot.Kio != nil {
+		errs = append(errs, writeKioProxy(snapshot.Kio))
+	}
+	return errors.Join(errs...)
+}
+
+func currentSystemProxy() (bool, string, error) {
+	if gsettings := gsettingsCommand(); gsettings != "" {
+		mode, err := runCommand(gsettings, "get", "org.gnome.system.proxy", "mode")
+		if err != nil {
+			return false, "", err
+		}
+		host, _ := runCommand(gsettings, "get", "org.gnome.system.proxy.http", "host")
+		port, _ := runCommand(gsettings, "get", "org.gnome.system.proxy.http", "port")
+		host = strings.Trim(host, "'")
+		if host == "" {
+			return mode == "'manual'", "", nil
+		}
+		value, _ := strconv.Atoi(port)
+		return mode == "'manual'", joinSystemProxyServer(host, value), nil
+	}
+	if read, _ := kioCommands(); read != "" {
+		proxyType, err := runCommand(read, "--file", "kioslaverc", "--group", kioProxyGroup, "--key", "ProxyType")
+		if err != nil {
+			return false, "", err
+		}
+		server, _ := runCommand(read, "--file", "kioslaverc", "--group", kioProxyGroup, "--key", "httpProxy")
+		return proxyType == "1", server, nil
+	}
+	return false, "", errors.New("neither gsettings nor kwriteconfig is available")
+}
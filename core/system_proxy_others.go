@@ -0,0 +1,31 @@
+//go:build !windows && !darwin && (!linux || android)
+
+package main
+
+import "errors"
+
+var defaultSystemProxyBypass []string
+
+var errSystemProxyUnsupported = errors.New("system proxy is not supported on this platform")
+
+type systemProxySnapshot struct{}
+
+func systemProxyBackend() string {
+	return ""
+}
+
+func readSystemProxy() (*systemProxySnapshot, error) {
+	return nil, errSystemProxyUnsupported
+}
+
+func applySystemProxy(_ string, _ int, _ bool, _ []string) error {
+	return errSystemProxyUnsupported
+}
+
+func restoreSystemProxy(_ *systemProxySnapshot) error {
+	return errSystemProxyUnsupported
+}
+
+func currentSystemProxy() (bool, string, error) {
+	return false, "", errSystemProxyUnsupported
+}
@@ -0,0 +1,126 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+	"strings"
+)
+
+const (
+	internetSettingsKey           = `Software\Microsoft\Windows\CurrentVersion\Internet Settings`
+	internetOptionSettingsChanged = 39
+	internetOptionRefresh         = 37
+)
+
+var (
+	wininet                = windows.NewLazySystemDLL("wininet.dll")
+	procInternetSetOptionW = wininet.NewProc("InternetSetOptionW")
+)
+
+var defaultSystemProxyBypass = []string{
+	"localhost", "127.*", "10.*", "192.168.*",
+	"172.16.*", "172.17.*", "172.18.*", "172.19.*", "172.20.*", "172.21.*", "172.22.*", "172.23.*",
+	"172.24.*", "172.25.*", "172.26.*", "172.27.*", "172.28.*", "172.29.*", "172.30.*", "172.31.*",
+	"<local>",
+}
+
+// systemProxySnapshot holds the WinINET values of the current user
+type systemProxySnapshot struct {
+	Enable        uint32 `json:"enable"`
+	Server        string `json:"server"`
+	Override      string `json:"override"`
+	AutoConfigURL string `json:"auto-config-url"`
+}
+
+func systemProxyBackend() string {
+	return "wininet"
+}
+
+func openInternetSettings(access uint32) (registry.Key, error) {
+	return registry.OpenKey(registry.CURRENT_USER, internetSettingsKey, access)
+}
+
+func readSystemProxy() (*systemProxySnapshot, error) {
+	key, err := openInternetSettings(registry.QUERY_VALUE)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Close()
+	snapshot := &systemProxySnapshot{}
+	if enable, _, err := key.GetIntegerValue("ProxyEnable"); err == nil {
+		snapshot.Enable = uint32(enable)
+	}
+	snapshot.Server, _, _ = key.GetStringValue("ProxyServer")
+	snapshot.Override, _, _ = key.GetStringValue("ProxyOverride")
+	snapshot.AutoConfigURL, _, _ = key.GetStringValue("AutoConfigURL")
+	return snapshot, nil
+}
+
+func setStringOrDelete(key registry.Key, name, value string) error {
+	if value == "" {
+		err := key.DeleteValue(name)
+		if errors.Is(err, registry.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return key.SetStringValue(name, value)
+}
+
+func writeSystemProxy(snapshot *systemProxySnapshot) error {
+	key, err := openInternetSettings(registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer key.Close()
+	if err = key.SetDWordValue("ProxyEnable", snapshot.Enable); err != nil {
+		return err
+	}
+	if err = setStringOrDelete(key, "ProxyServer", snapshot.Server); err != nil {
+		return err
+	}
+	if err = setStringOrDelete(key, "ProxyOverride", snapshot.Override); err != nil {
+		return err
+	}
+	if err = setStringOrDelete(key, "AutoConfigURL", snapshot.AutoConfigURL); err != nil {
+		return err
+	}
+	return notifyInternetSettings()
+}
+
+// notifyInternetSettings makes the running programs read the registry again
+func notifyInternetSettings() error {
+	if err := procInternetSetOptionW.Find(); err != nil {
+		return err
+	}
+	for _, option := range []uintptr{internetOptionSettingsChanged, internetOptionRefresh} {
+		ret, _, err := procInternetSetOptionW.Call(0, option, 0, 0)
+		if ret == 0 {
+			return err
+		}
+	}
+	return nil
+}
+
+func applySystemProxy(host string, port int, _ bool, bypass []string) error {
+	return writeSystemProxy(&systemProxySnapshot{
+		Enable:   1,
+		Server:   joinSystemProxyServer(host, port),
+		Override: strings.Join(bypass, ";"),
+	})
+}
+
+func restoreSystemProxy(snapshot *systemProxySnapshot) error {
+	return writeSystemProxy(snapshot)
+}
+
+func currentSystemProxy() (bool, string, error) {
+	snapshot, err := readSystemProxy()
+	if err != nil {
+		return false, "", err
+	}
+	return snapshot.Enable != 0, snapshot.Server, nil
+}
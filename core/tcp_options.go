@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/metacubex/mihomo/component/dialer"
+	"github.com/metacubex/mihomo/config"
+	"github.com/metacubex/mihomo/log"
+	"sync"
+)
+
+const (
+	tfoProxyKey   = "tfo"
+	mptcpProxyKey = "mptcp"
+)
+
+// TcpProxyOption overrides the dialer toggles of one proxy, nil keeps the profile value
+type TcpProxyOption struct {
+	TFO   *bool `json:"tfo"`
+	MPTCP *bool `json:"mptcp"`
+}
+
+// TcpOptionsParams turns tcp fast open and multipath tcp on for every proxy that does not set
+// them in the profile, the changes apply to the proxies of the next setup
+type TcpOptionsParams struct {
+	TFO     bool                       `json:"tfo"`
+	MPTCP   bool                       `json:"mptcp"`
+	Proxies map[string]*TcpProxyOption `json:"proxies"`
+}
+
+type TcpCapabilities struct {
+	TFO         bool   `json:"tfo"`
+	TFOReason   string `json:"tfo-reason,omitempty"`
+	MPTCP       bool   `json:"mptcp"`
+	MPTCPReason string `json:"mptcp-reason,omitempty"`
+}
+
+type TcpProxyStatus struct {
+	TFO   bool `json:"tfo"`
+	MPTCP bool `json:"mptcp"`
+}
+
+type TcpOptionsStatus struct {
+	TcpOptionsParams
+	Capabilities TcpCapabilities            `json:"capabilities"`
+	Applied      map[string]*TcpProxyStatus `json:"applied"`
+}
+
+// TcpOptions decides the tfo and mptcp keys of the profile proxies before they are parsed,
+// a toggle the platform cannot honour is dropped so the proxy still dials a plain connection
+type TcpOptions struct {
+	mutex   sync.Mutex
+	params  TcpOptionsParams
+	applied map[string]*TcpProxyStatus
+}
+
+var tcpOptions = &TcpOptions{applied: map[string]*TcpProxyStatus{}}
+
+func probeTcpCapabilities() TcpCapabilities {
+	capabilities := TcpCapabilities{}
+	capabilities.TFO, capabilities.TFOReason = probeTFO()
+	if capabilities.TFO && dialer.DisableTFO {
+		capabilities.TFO, capabilities.TFOReason = false, "not available on this windows version"
+	}
+	if capabilities.TFO && dialer.DefaultSocketHook != nil {
+		// the socket hook of the VpnService dials without the tfo path
+		capabilities.TFO, capabilities.TFOReason = false, "not available with the socket protect hook"
+	}
+	capabilities.MPTCP, capabilities.MPTCPReason = probeMPTCP()
+	return capabilities
+}
+
+func (o *TcpOptions) Set(params *TcpOptionsParams) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.params = TcpOptionsParams{}
+	if params != nil {
+		o.params = *params
+	}
+}
+
+// resolveTcpToggle picks the override, then the profile value, then the global toggle
+func resolveTcpToggle(mapping map[string]any, key string, global bool, override *bool, supported bool) (enabled bool, dropped bool) {
+	enabled, ok := mapping[key].(bool)
+	if override != nil {
+		enabled = *override
+	} else if !ok {
+		enabled = global
+	}
+	if enabled && !supported {
+		enabled, dropped = false, true
+	}
+	if enabled || ok {
+		mapping[key] = enabled
+	}
+	return enabled, dropped
+}
+
+// Prepare writes the resolved toggles into the profile proxies
+func (o *TcpOptions) Prepare(rawConfig *config.RawConfig) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	capabilities := probeTcpCapabilities()
+	o.applied = map[string]*TcpProxyStatus{}
+	dropped := 0
+	for _, mapping := range rawConfig.Proxy {
+		name, _ := mapping["name"].(string)
+		if name == "" {
+			continue
+		}
+		override := o.params.Proxies[name]
+		if override == nil {
+			override = &TcpProxyOption{}
+		}
+		status := &TcpProxyStatus{}
+		var tfoDropped, mptcpDropped bool
+		status.TFO, tfoDropped = resolveTcpToggle(mapping, tfoProxyKey, o.params.TFO, override.TFO, capabilities.TFO)
+		status.MPTCP, mptcpDropped = resolveTcpToggle(mapping, mptcpProxyKey, o.params.MPTCP, override.MPTCP, capabilities.MPTCP)
+		if tfoDropped || mptcpDropped {
+			dropped++
+		}
+		if status.TFO || status.MPTCP {
+			o.applied[name] = status
+		}
+	}
+	if dropped != 0 {
+		log.Warnln("[TcpOptions] dropped unsupported tfo or mptcp of %d proxies, tfo: %s, mptcp: %s", dropped, capabilities.TFOReason, capabilities.MPTCPReason)
+	}
+}
+
+func (o *TcpOptions) Status() *TcpOptionsStatus {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	status := &TcpOptionsStatus{
+		TcpOptionsParams: o.params,
+		Capabilities:     probeTcpCapabilities(),
+		Applied:          map[string]*TcpProxyStatus{},
+	}
+	for name, applied := range o.applied {
+		status.Applied[name] = applied
+	}
+	return status
+}
+
+func handleSetTcpOptions(paramsString string) bool {
+	var params *TcpOptionsParams
+	if err := json.Unmarshal([]byte(paramsString), &params); err != nil {
+		return false
+	}
+	tcpOptions.Set(params)
+	return true
+}
+
+func handleGetTcpOptions() string {
+	data, err := json.Marshal(tcpOptions.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
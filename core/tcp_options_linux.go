@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	tcpFastOpenSysctl = "/proc/sys/net/ipv4/tcp_fastopen"
+	mptcpSysctl       = "/proc/sys/net/mptcp/enabled"
+	// tcpFastOpenClient is the bit of tcp_fastopen that allows sending data in the syn
+	tcpFastOpenClient = 1
+)
+
+func readSysctlInt(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+func probeTFO() (bool, string) {
+	value, err := readSysctlInt(tcpFastOpenSysctl)
+	if err != nil {
+		return false, "tcp_fastopen is not readable"
+	}
+	if value&tcpFastOpenClient == 0 {
+		return false, "client tcp fast open is disabled by net.ipv4.tcp_fastopen"
+	}
+	return true, ""
+}
+
+func probeMPTCP() (bool, string) {
+	value, err := readSysctlInt(mptcpSysctl)
+	if err != nil {
+		return false, "the kernel has no multipath tcp support"
+	}
+	if value != 1 {
+		return false, "multipath tcp is disabled by net.mptcp.enabled"
+	}
+	return true, ""
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import "runtime"
+
+func probeTFO() (bool, string) {
+	switch runtime.GOOS {
+	case "darwin", "windows", "freebsd":
+		return true, ""
+	}
+	return false, "tcp fast open is not supported on " + runtime.GOOS
+}
+
+// probeMPTCP is false off linux, go only dials multipath tcp there
+func probeMPTCP() (bool, string) {
+	return false, "multipath tcp is only supported on linux"
+}
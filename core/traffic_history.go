@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	trafficHistoryDir       = "traffic"
+	trafficHistoryExt       = ".jsonl"
+	trafficHistoryDayLayout = "2006-01-02"
+	defaultTrafficRetention = 90
+)
+
+type TrafficStep string
+
+const (
+	MinuteTrafficStep TrafficStep = "minute"
+	HourTrafficStep   TrafficStep = "hour"
+	DayTrafficStep    TrafficStep = "day"
+)
+
+// TrafficRecord is the traffic of one minute, or of a coarser step when aggregated
+type TrafficRecord struct {
+	Time int64 `json:"time"`
+	TrafficCounter
+	Connections int                       `json:"connections"`
+	Proxies     map[string]TrafficCounter `json:"proxies,omitempty"`
+}
+
+type TrafficHistoryParams struct {
+	Start   int64       `json:"start"`
+	End     int64       `json:"end"`
+	Step    TrafficStep `json:"step"`
+	Proxies bool        `json:"proxies"`
+}
+
+// TrafficHistory persists minute records in one append-only file per day under the home dir
+type TrafficHistory struct {
+	mutex         sync.Mutex
+	retentionDays int
+	lastPrune     string
+}
+
+var trafficHistory = &TrafficHistory{
+	retentionDays: defaultTrafficRetention,
+}
+
+func (th *TrafficHistory) dir() string {
+	return constant.Path.Resolve(trafficHistoryDir)
+}
+
+// Record appends a minute record, empty minutes are skipped
+func (th *TrafficHistory) Record(record *TrafficRecord) {
+	if record.Up == 0 && record.Down == 0 && record.Connections == 0 {
+		return
+	}
+	if !isInit {
+		return
+	}
+	th.mutex.Lock()
+	defer th.mutex.Unlock()
+	day := time.UnixMilli(record.Time).Format(trafficHistoryDayLayout)
+	if err := os.MkdirAll(th.dir(), 0755); err != nil {
+		log.Errorln("[TrafficHistory] %v", err)
+		return
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	file, err := os.OpenFile(filepath.Join(th.dir(), day+trafficHistoryExt), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Errorln("[TrafficHistory] %v", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		log.Errorln("[TrafficHistory] %v", err)
+	}
+	if th.lastPrune != day {
+		th.lastPrune = day
+		th.pruneLocked(time.UnixMilli(record.Time))
+	}
+}
+
+// pruneLocked removes day files older than the retention
+func (th *TrafficHistory) pruneLocked(now time.Time) {
+	limit := now.AddDate(0, 0, -th.retentionDays).Format(trafficHistoryDayLayout)
+	for _, day := range th.daysLocked() {
+		if day < limit {
+			_ = os.Remove(filepath.Join(th.dir(), day+trafficHistoryExt))
+		}
+	}
+}
+
+func (th *TrafficHistory) daysLocked() []string {
+	entries, err := os.ReadDir(th.dir())
+	if err != nil {
+		return nil
+	}
+	days := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, trafficHistoryExt) {
+			continue
+		}
+		day := strings.TrimSuffix(name, trafficHistoryExt)
+		if _, err := time.ParseInLocation(trafficHistoryDayLayout, day, time.Local); err != nil {
+			continue
+		}
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	return days
+}
+
+// Query reads the records within the range and sums them per step
+func (th *TrafficHistory) Query(params *TrafficHistoryParams) ([]TrafficRecord, error) {
+	th.mutex.Lock()
+	defer th.mutex.Unlock()
+	var startDay, endDay string
+	if params.Start > 0 {
+		startDay = time.UnixMilli(params.Start).Format(trafficHistoryDayLayout)
+	}
+	if params.End > 0 {
+		endDay = time.UnixMilli(params.End).Format(trafficHistoryDayLayout)
+	}
+
+	aggregated := map[int64]*TrafficRecord{}
+	for _, day := range th.daysLocked() {
+		if (startDay != "" && day < startDay) || (endDay != "" && day > endDay) {
+			continue
+		}
+		if err := th.readDayLocked(day, func(record *TrafficRecord) {
+			if (params.Start > 0 && record.Time < params.Start) || (params.End > 0 && record.Time >= params.End) {
+				return
+			}
+			key := truncateTrafficTime(record.Time, params.Step)
+			target, ok := aggregated[key]
+			if !ok {
+				target = &TrafficRecord{Time: key}
+				aggregated[key] = target
+			}
+			target.add(record.Up, record.Down)
+			target.Connections += record.Connections
+			if !params.Proxies {
+				return
+			}
+			if target.Proxies == nil {
+				target.Proxies = map[string]TrafficCounter{}
+			}
+			for name, counter := range record.Proxies {
+				sum := target.Proxies[name]
+				sum.add(counter.Up, counter.Down)
+				target.Proxies[name] = sum
+			}
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	records := make([]TrafficRecord, 0, len(aggregated))
+	for _, record := range aggregated {
+		records = append(records, *record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Time < records[j].Time })
+	return records, nil
+}
+
+func (th *TrafficHistory) readDayLocked(day string, fn func(record *TrafficRecord)) error {
+	file, err := os.Open(filepath.Join(th.dir(), day+trafficHistoryExt))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var record TrafficRecord
+		// a torn last line after a crash is skipped rather than failing the whole day
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		fn(&record)
+	}
+	return scanner.Err()
+}
+
+// Clear deletes all persisted history
+func (th *TrafficHistory) Clear() error {
+	th.mutex.Lock()
+	defer th.mutex.Unlock()
+	return os.RemoveAll(th.dir())
+}
+
+// SetRetention changes how many days of history are kept
+func (th *TrafficHistory) SetRetention(days int) {
+	if days <= 0 {
+		days = defaultTrafficRetention
+	}
+	th.mutex.Lock()
+	defer th.mutex.Unlock()
+	th.retentionDays = days
+	th.pruneLocked(time.Now())
+}
+
+func truncateTrafficTime(timestamp int64, step TrafficStep) int64 {
+	t := time.UnixMilli(timestamp)
+	switch step {
+	case HourTrafficStep:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, time.Local).UnixMilli()
+	case DayTrafficStep:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local).UnixMilli()
+	default:
+		return t.Truncate(time.Minute).UnixMilli()
+	}
+}
+
+func handleGetTrafficHistory(paramsString string) (string, error) {
+	var params = &TrafficHistoryParams{}
+	if paramsString != "" {
+		if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+			return "", err
+		}
+	}
+	records, err := trafficHistory.Query(params)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func handleClearTrafficHistory() bool {
+	return trafficHistory.Clear() == nil
+}
+
+func handleSetTrafficRetention(daysString string) bool {
+	days, err := strconv.Atoi(daysString)
+	if err != nil {
+		return false
+	}
+	trafficHistory.SetRetention(days)
+	return true
+}
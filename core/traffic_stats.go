@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/metacubex/mihomo/tunnel/statistic"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	trafficSampleInterval = time.Second
+	trafficBucketDuration = time.Minute
+	trafficRetention      = 24 * time.Hour
+	unknownTrafficKey     = "unknown"
+)
+
+type TrafficDimension string
+
+const (
+	ProcessTrafficDimension TrafficDimension = "process"
+	DomainTrafficDimension  TrafficDimension = "domain"
+	UserTrafficDimension    TrafficDimension = "user"
+)
+
+type TrafficCounter struct {
+	Up   int64 `json:"up"`
+	Down int64 `json:"down"`
+}
+
+func (c *TrafficCounter) add(up, down int64) {
+	c.Up += up
+	c.Down += down
+}
+
+// TrafficBucket is the traffic of one key within a bucket starting at Time
+type TrafficBucket struct {
+	Time int64 `json:"time"`
+	TrafficCounter
+}
+
+// TrafficUsage is the aggregated traffic of a process or domain over a range
+type TrafficUsage struct {
+	Name string `json:"name"`
+	TrafficCounter
+	Connections int             `json:"connections"`
+	Buckets     []TrafficBucket `json:"buckets,omitempty"`
+}
+
+type TrafficStatsParams struct {
+	Start    int64 `json:"start"`
+	End      int64 `json:"end"`
+	Limit    int   `json:"limit"`
+	Bucketed bool  `json:"bucketed"`
+}
+
+type trafficBucket struct {
+	start       int64
+	total       TrafficCounter
+	count       int
+	process     map[string]*TrafficCounter
+	domain      map[string]*TrafficCounter
+	proxy       map[string]*TrafficCounter
+	user        map[string]*TrafficCounter
+	connections map[TrafficDimension]map[string]int
+}
+
+type trackedConnection struct {
+	tracker statistic.Tracker
+	process string
+	domain  string
+	proxy   string
+	user    string
+	up      int64
+	down    int64
+}
+
+// TrafficAccounting attributes connection traffic to processes and domains in time buckets
+type TrafficAccounting struct {
+	mutex       sync.Mutex
+	connections map[string]*trackedConnection
+	buckets     []*trafficBucket
+	startOnce   sync.Once
+}
+
+var trafficAccounting = &TrafficAccounting{
+	connections: map[string]*trackedConnection{},
+}
+
+// Track registers a new connection for accounting
+func (ta *TrafficAccounting) Track(c statistic.Tracker) {
+	ta.startOnce.Do(func() {
+		go ta.run()
+	})
+	info := c.Info()
+	connection := &trackedConnection{
+		tracker: c,
+		process: unknownTrafficKey,
+		domain:  unknownTrafficKey,
+		proxy:   unknownTrafficKey,
+	}
+	if len(info.Chain) > 0 {
+		connection.proxy = info.Chain[0]
+	}
+	if metadata := info.Metadata; metadata != nil {
+		if metadata.Process != "" {
+			connection.process = metadata.Process
+		}
+		connection.user = metadata.InUser
+		switch {
+		case metadata.Host != "":
+			connection.domain = metadata.Host
+		case metadata.SniffHost != "":
+			connection.domain = metadata.SniffHost
+		case metadata.DstIP.IsValid():
+			connection.domain = metadata.DstIP.String()
+		}
+	}
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+	if _, exists := ta.connections[c.ID()]; exists {
+		return
+	}
+	ta.connections[c.ID()] = connection
+	bucket := ta.bucketLocked(time.Now())
+	bucket.count++
+	bucket.connections[ProcessTrafficDimension][connection.process]++
+	bucket.connections[DomainTrafficDimension][connection.domain]++
+	if connection.user != "" {
+		bucket.connections[UserTrafficDimension][connection.user]++
+	}
+}
+
+func (ta *TrafficAccounting) run() {
+	ticker := time.NewTicker(powerScaled(trafficSampleInterval))
+	defer ticker.Stop()
+	for range ticker.C {
+		ticker.Reset(powerScaled(trafficSampleInterval))
+		runGuarded("traffic", ta.sample)
+		runGuarded("traffic-tick", publishTrafficTick)
+	}
+}
+
+// sample moves the byte deltas of all tracked connections into the current bucket
+func (ta *TrafficAccounting) sample() {
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+	now := time.Now()
+	bucket := ta.bucketLocked(now)
+	for id, connection := range ta.connections {
+		info := connection.tracker.Info()
+		up, down := info.UploadTotal.Load(), info.DownloadTotal.Load()
+		deltaUp, deltaDown := up-connection.up, down-connection.down
+		connection.up, connection.down = up, down
+		if deltaUp != 0 || deltaDown != 0 {
+			bucket.total.add(deltaUp, deltaDown)
+			counterFor(bucket.proxy, connection.proxy).add(deltaUp, deltaDown)
+			counterFor(bucket.process, connection.process).add(deltaUp, deltaDown)
+			counterFor(bucket.domain, connection.domain).add(deltaUp, deltaDown)
+			if connection.user != "" {
+				counterFor(bucket.user, connection.user).add(deltaUp, deltaDown)
+			}
+			quotas.Add(info.Chain, deltaUp, deltaDown)
+		}
+		if statistic.DefaultManager.Get(id) == nil {
+			delete(ta.connections, id)
+		}
+	}
+	ta.trimLocked(now)
+	quotas.Check(now)
+}
+
+func (ta *TrafficAccounting) bucketLocked(now time.Time) *trafficBucket {
+	start := now.Truncate(trafficBucketDuration).UnixMilli()
+	if n := len(ta.buckets); n > 0 {
+		if ta.buckets[n-1].start == start {
+			return ta.buckets[n-1]
+		}
+		trafficHistory.Record(ta.buckets[n-1].record())
+	}
+	bucket := &trafficBucket{
+		start:   start,
+		process: map[string]*TrafficCounter{},
+		domain:  map[string]*TrafficCounter{},
+		proxy:   map[string]*TrafficCounter{},
+		user:    map[string]*TrafficCounter{},
+		connections: map[TrafficDimension]map[string]int{
+			ProcessTrafficDimension: {},
+			DomainTrafficDimension:  {},
+			UserTrafficDimension:    {},
+		},
+	}
+	ta.buckets = append(ta.buckets, bucket)
+	return bucket
+}
+
+func (ta *TrafficAccounting) trimLocked(now time.Time) {
+	limit := now.Add(-trafficRetention).UnixMilli()
+	index := 0
+	for index < len(ta.buckets) && ta.buckets[index].start < limit {
+		ta.buckets[index] = nil
+		index++
+	}
+	ta.buckets = ta.buckets[index:]
+}
+
+// Query aggregates the traffic of a dimension for buckets overlapping the range, largest first
+func (ta *TrafficAccounting) Query(dimension TrafficDimension, params *TrafficStatsParams) []TrafficUsage {
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+	usages := map[string]*TrafficUsage{}
+	for _, bucket := range ta.buckets {
+		if params.Start > 0 && bucket.start+trafficBucketDuration.Milliseconds() <= params.Start {
+			continue
+		}
+		if params.End > 0 && bucket.start >= params.End {
+			continue
+		}
+		counters := bucket.process
+		switch dimension {
+		case DomainTrafficDimension:
+			counters = bucket.domain
+		case UserTrafficDimension:
+			counters = bucket.user
+		}
+		for name, counter := range counters {
+			usage := usageFor(usages, name)
+			usage.add(counter.Up, counter.Down)
+			if params.Bucketed {
+				usage.Buckets = append(usage.Buckets, TrafficBucket{
+					Time:           bucket.start,
+					TrafficCounter: *counter,
+				})
+			}
+		}
+		for name, count := range bucket.connections[dimension] {
+			usageFor(usages, name).Connections += count
+		}
+	}
+
+	list := make([]TrafficUsage, 0, len(usages))
+	for _, usage := range usages {
+		list = append(list, *usage)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i].Up+list[i].Down, list[j].Up+list[j].Down
+		if a != b {
+			return a > b
+		}
+		return list[i].Name < list[j].Name
+	})
+	if params.Limit > 0 && len(list) > params.Limit {
+		list = list[:params.Limit]
+	}
+	return list
+}
+
+// Flush persists the bucket in progress so a shutdown does not lose it
+func (ta *TrafficAccounting) Flush() {
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+	if n := len(ta.buckets); n > 0 {
+		bucket := ta.buckets[n-1]
+		trafficHistory.Record(bucket.record())
+		ta.buckets = ta.buckets[:n-1]
+	}
+}
+
+// Reset drops all recorded buckets while keeping live connections tracked, the history is kept
+func (ta *TrafficAccounting) Reset() {
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+	if n := len(ta.buckets); n > 0 {
+		trafficHistory.Record(ta.buckets[n-1].record())
+	}
+	ta.buckets = nil
+}
+
+func (b *trafficBucket) record() *TrafficRecord {
+	record := &TrafficRecord{
+		Time:           b.start,
+		TrafficCounter: b.total,
+		Connections:    b.count,
+		Proxies:        make(map[string]TrafficCounter, len(b.proxy)),
+	}
+	for name, counter := range b.proxy {
+		record.Proxies[name] = *counter
+	}
+	return record
+}
+
+func counterFor(counters map[string]*TrafficCounter, name string) *TrafficCounter {
+	counter, ok := counters[name]
+	if !ok {
+		counter = &TrafficCounter{}
+		counters[name] = counter
+	}
+	return counter
+}
+
+func usageFor(usages map[string]*TrafficUsage, name string) *TrafficUsage {
+	usage, ok := usages[name]
+	if !ok {
+		usage = &TrafficUsage{Name: name}
+		usages[name] = usage
+	}
+	return usage
+}
+
+func handleGetTrafficStats(dimension TrafficDimension, paramsString string) string {
+	var params = &TrafficStatsParams{}
+	if paramsString != "" {
+		if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+			return ""
+		}
+	}
+	data, err := json.Marshal(trafficAccounting.Query(dimension, params))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
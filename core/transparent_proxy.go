@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+type TransparentBackend string
+
+const (
+	IptablesTransparentBackend TransparentBackend = "iptables"
+	NftablesTransparentBackend TransparentBackend = "nftables"
+)
+
+type TransparentMode string
+
+const (
+	// TProxyTransparentMode sends tcp and udp to the tproxy port
+	TProxyTransparentMode TransparentMode = "tproxy"
+	// RedirectTransparentMode sends tcp to the redir port, udp is not intercepted
+	RedirectTransparentMode TransparentMode = "redirect"
+	// MixedTransparentMode sends tcp to the redir port and udp to the tproxy port
+	MixedTransparentMode TransparentMode = "mixed"
+)
+
+const (
+	transparentChain   = "FLCLASH"
+	transparentTable   = "flclash"
+	defaultTProxyMark  = 1
+	defaultTProxyTable = 100
+)
+
+// transparentBypass are the destinations a gateway never intercepts
+var transparentBypass = []string{
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.168.0.0/16", "224.0.0.0/4", "240.0.0.0/4",
+	"::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+}
+
+// interfaceNamePattern keeps the interface names that end up in the shell script to plain names
+var interfaceNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+
+// TransparentRulesParams describes the interception the rules set up, ports left at zero are
+// taken from the running config and the routing mark keeps the core's own connections out of
+// the rules when local traffic is intercepted too
+type TransparentRulesParams struct {
+	Backend     TransparentBackend `json:"backend"`
+	Mode        TransparentMode    `json:"mode"`
+	RedirPort   int                `json:"redir-port"`
+	TProxyPort  int                `json:"tproxy-port"`
+	DnsPort     int                `json:"dns-port"`
+	Mark        int                `json:"mark"`
+	Table       int                `json:"table"`
+	RoutingMark int                `json:"routing-mark"`
+	Interfaces  []string           `json:"interfaces"`
+	Bypass      []string           `json:"bypass"`
+	Local       bool               `json:"local"`
+	IPv6        bool               `json:"ipv6"`
+}
+
+type TransparentRules struct {
+	Backend  TransparentBackend `json:"backend"`
+	Mode     TransparentMode    `json:"mode"`
+	Setup    string             `json:"setup"`
+	Teardown string             `json:"teardown"`
+}
+
+type TransparentProxyStatus struct {
+	RedirPort   int    `json:"redir-port"`
+	TProxyPort  int    `json:"tproxy-port"`
+	RoutingMark int    `json:"routing-mark"`
+	Supported   bool   `json:"supported"`
+	Error       string `json:"error,omitempty"`
+}
+
+func (p *TransparentRulesParams) complete() error {
+	runLock.Lock()
+	if currentConfig != nil {
+		general := currentConfig.General
+		if p.RedirPort == 0 {
+			p.RedirPort = general.RedirPort
+		}
+		if p.TProxyPort == 0 {
+			p.TProxyPort = general.TProxyPort
+		}
+		if p.RoutingMark == 0 {
+			p.RoutingMark = general.RoutingMark
+		}
+	}
+	runLock.Unlock()
+	if p.Backend == "" {
+		p.Backend = IptablesTransparentBackend
+	}
+	if p.Backend != IptablesTransparentBackend && p.Backend != NftablesTransparentBackend {
+		return fmt.Errorf("unknown backend %s, expected iptables or nftables", p.Backend)
+	}
+	if p.Mode == "" {
+		switch {
+		case p.TProxyPort != 0:
+			p.Mode = TProxyTransparentMode
+		case p.RedirPort != 0:
+			p.Mode = RedirectTransparentMode
+		default:
+			return fmt.Errorf("neither redir-port nor tproxy-port is set")
+		}
+	}
+	switch p.Mode {
+	case TProxyTransparentMode:
+		if p.TProxyPort == 0 {
+			return fmt.Errorf("tproxy mode requires tproxy-port")
+		}
+	case RedirectTransparentMode:
+		if p.RedirPort == 0 {
+			return fmt.Errorf("redirect mode requires redir-port")
+		}
+	case MixedTransparentMode:
+		if p.RedirPort == 0 || p.TProxyPort == 0 {
+			return fmt.Errorf("mixed mode requires redir-port and tproxy-port")
+		}
+	default:
+		return fmt.Errorf("unknown mode %s, expected tproxy, redirect or mixed", p.Mode)
+	}
+	if p.Local && p.RoutingMark == 0 {
+		return fmt.Errorf("intercepting local traffic requires a routing-mark, otherwise the connections of the core loop back into it")
+	}
+	if p.Mark == 0 {
+		p.Mark = defaultTProxyMark
+	}
+	if p.Table == 0 {
+		p.Table = defaultTProxyTable
+	}
+	for _, name := range p.Interfaces {
+		if !interfaceNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid interface %q, expected letters, digits and _.:-", name)
+		}
+	}
+	for _, prefix := range p.Bypass {
+		if _, err := netip.ParsePrefix(prefix); err != nil {
+			return fmt.Errorf("invalid bypass %s: %w", prefix, err)
+		}
+	}
+	return nil
+}
+
+func (p *TransparentRulesParams) bypass(ipv6 bool) []string {
+	var prefixes []string
+	for _, value := range append(append([]string{}, transparentBypass...), p.Bypass...) {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil || prefix.Addr().Is6() != ipv6 {
+			continue
+		}
+		prefixes = append(prefixes, prefix.Masked().String())
+	}
+	return prefixes
+}
+
+// interfaces are the inputs intercepted, local traffic marked in output comes back through lo
+func (p *TransparentRulesParams) interfaces() []string {
+	if len(p.Interfaces) == 0 {
+		return nil
+	}
+	interfaces := append([]string{}, p.Interfaces...)
+	if p.Local && !containsString(interfaces, "lo") {
+		interfaces = append(interfaces, "lo")
+	}
+	return interfaces
+}
+
+func (p *TransparentRulesParams) policyRoutes(setup bool) []string {
+	var lines []string
+	families := []string{"ip"}
+	if p.IPv6 {
+		families = append(families, "ip -6")
+	}
+	for _, family := range families {
+		local := "0.0.0.0/0"
+		if family != "ip" {
+			local = "::/0"
+		}
+		if setup {
+			lines = append(lines,
+				fmt.Sprintf("%s rule add fwmark %d table %d", family, p.Mark, p.Table),
+				fmt.Sprintf("%s route add local %s dev lo table %d", family, local, p.Table),
+			)
+			continue
+		}
+		lines = append(lines,
+			fmt.Sprintf("%s rule del fwmark %d table %d", family, p.Mark, p.Table),
+			fmt.Sprintf("%s route flush table %d", family, p.Table),
+		)
+	}
+	return lines
+}
+
+func (p *TransparentRulesParams) iptables() *TransparentRules {
+	var setup, teardown []string
+	usesTProxy := p.Mode != RedirectTransparentMode
+	commands := []string{"iptables"}
+	if p.IPv6 {
+		commands = append(commands, "ip6tables")
+	}
+	if usesTProxy {
+		setup = append(setup, p.policyRoutes(true)...)
+	}
+	for _, command := range commands {
+		bypass := p.bypass(command == "ip6tables")
+		inputs := []string{""}
+		if interfaces := p.interfaces(); len(interfaces) != 0 {
+			inputs = nil
+			for _, name := range interfaces {
+				inputs = append(inputs, " -i "+name)
+			}
+		}
+		if usesTProxy {
+			chain := transparentChain
+			setup = append(setup, fmt.Sprintf("%s -t mangle -N %s", command, chain))
+			for _, prefix := range bypass {
+				setup = append(setup, fmt.Sprintf("%s -t mangle -A %s -d %s -j RETURN", command, chain, prefix))
+			}
+			protocols := []string{"udp"}
+			if p.Mode == TProxyTransparentMode {
+				protocols = []string{"tcp", "udp"}
+			}
+			for _, protocol := range protocols {
+				setup = append(setup, fmt.Sprintf("%s -t mangle -A %s -p %s -j TPROXY --on-port %d --tproxy-mark %d", command, chain, protocol, p.TProxyPort, p.Mark))
+			}
+			for _, input := range inputs {
+				setup = append(setup, fmt.Sprintf("%s -t mangle -A PREROUTING%s -j %s", command, input, chain))
+				teardown = append(teardown, fmt.Sprintf("%s -t mangle -D PREROUTING%s -j %s", command, input, chain))
+			}
+			if p.Local {
+				local := chain + "_LOCAL"
+				setup = append(setup,
+					fmt.Sprintf("%s -t mangle -N %s", command, local),
+					fmt.Sprintf("%s -t mangle -A %s -m mark --mark %d -j RETURN", command, local, p.RoutingMark),
+				)
+				for _, prefix := range bypass {
+					setup = append(setup, fmt.Sprintf("%s -t mangle -A %s -d %s -j RETURN", command, local, prefix))
+				}
+				for _, protocol := range protocols {
+					setup = append(setup, fmt.Sprintf("%s -t mangle -A %s -p %s -j MARK --set-mark %d", command, local, protocol, p.Mark))
+				}
+				setup = append(setup, fmt.Sprintf("%s -t mangle -A OUTPUT -j %s", command, local))
+				teardown = append(teardown,
+					fmt.Sprintf("%s -t mangle -D OUTPUT -j %s", command, local),
+					fmt.Sprintf("%s -t mangle -F %s", command, local),
+					fmt.Sprintf("%s -t mangle -X %s", command, local),
+				)
+			}
+			teardown = append(teardown,
+				fmt.Sprintf("%s -t mangle -F %s", command, chain),
+				fmt.Sprintf("%s -t mangle -X %s", command, chain),
+			)
+		}
+		if p.Mode != TProxyTransparentMode || p.DnsPort != 0 {
+			chain := transparentChain + "_REDIR"
+			setup = append(setup, fmt.Sprintf("%s -t nat -N %s", command, chain))
+			if p.Local {
+				setup = append(setup, fmt.Sprintf("%s -t nat -A %s -m mark --mark %d -j RETURN", command, chain, p.RoutingMark))
+			}
+			if p.DnsPort != 0 {
+				setup = append(setup, fmt.Sprintf("%s -t nat -A %s -p udp --dport 53 -j REDIRECT --to-ports %d", command, chain, p.DnsPort))
+			}
+			for _, prefix := range bypass {
+				setup = append(setup, fmt.Sprintf("%s -t nat -A %s -d %s -j RETURN", command, chain, prefix))
+			}
+			if p.Mode != TProxyTransparentMode {
+				setup = append(setup, fmt.Sprintf("%s -t nat -A %s -p tcp -j REDIRECT --to-ports %d", command, chain, p.RedirPort))
+			}
+			for _, input := range inputs {
+				setup = append(setup, fmt.Sprintf("%s -t nat -A PREROUTING%s -j %s", command, input, chain))
+				teardown = append(teardown, fmt.Sprintf("%s -t nat -D PREROUTING%s -j %s", command, input, chain))
+			}
+			if p.Local {
+				setup = append(setup, fmt.Sprintf("%s -t nat -A OUTPUT -j %s", command, chain))
+				teardown = append(teardown, fmt.Sprintf("%s -t nat -D OUTPUT -j %s", command, chain))
+			}
+			teardown = append(teardown,
+				fmt.Sprintf("%s -t nat -F %s", command, chain),
+				fmt.Sprintf("%s -t nat -X %s", command, chain),
+			)
+		}
+	}
+	if usesTProxy {
+		teardown = append(teardown, p.policyRoutes(false)...)
+	}
+	return &TransparentRules{
+		Backend:  p.Backend,
+		Mode:     p.Mode,
+		Setup:    strings.Join(setup, "\n") + "\n",
+		Teardown: strings.Join(teardown, "\n") + "\n",
+	}
+}
+
+func (p *TransparentRulesParams) nftables() *TransparentRules {
+	var script []string
+	line := func(indent int, format string, args ...any) {
+		script = append(script, strings.Repeat("\t", indent)+fmt.Sprintf(format, args...))
+	}
+	usesTProxy := p.Mode != RedirectTransparentMode
+	inputs := ""
+	if interfaces := p.interfaces(); len(interfaces) != 0 {
+		inputs = fmt.Sprintf("iifname { %s } ", strings.Join(interfaces, ", "))
+	}
+	bypass := func(indent int) {
+		if prefixes := p.bypass(false); len(prefixes) != 0 {
+			line(indent, "ip daddr { %s } return", strings.Join(prefixes, ", "))
+		}
+		if prefixes := p.bypass(true); p.IPv6 && len(prefixes) != 0 {
+			line(indent, "ip6 daddr { %s } return", strings.Join(prefixes, ", "))
+		}
+	}
+	families := "meta nfproto ipv4 "
+	if p.IPv6 {
+		families = ""
+	}
+	line(0, "table inet %s {", transparentTable)
+	if usesTProxy {
+		protocols := "udp"
+		if p.Mode == TProxyTransparentMode {
+			protocols = "{ tcp, udp }"
+		}
+		line(1, "chain prerouting {")
+		line(2, "type filter hook prerouting priority mangle; policy accept;")
+		bypass(2)
+		line(2, "%s%smeta l4proto %s tproxy to :%d meta mark set %d accept", inputs, families, protocols, p.TProxyPort, p.Mark)
+		line(1, "}")
+		if p.Local {
+			line(1, "chain output {")
+			line(2, "type route hook output priority mangle; policy accept;")
+			line(2, "meta mark %d return", p.RoutingMark)
+			bypass(2)
+			line(2, "%smeta l4proto %s meta mark set %d", families, protocols, p.Mark)
+			line(1, "}")
+		}
+	}
+	if p.Mode != TProxyTransparentMode || p.DnsPort != 0 {
+		redirect := func() {
+			if p.DnsPort != 0 {
+				line(2, "%sudp dport 53 redirect to :%d", families, p.DnsPort)
+			}
+			bypass(2)
+			if p.Mode != TProxyTransparentMode {
+				line(2, "%smeta l4proto tcp redirect to :%d", families, p.RedirPort)
+			}
+		}
+		line(1, "chain prerouting_nat {")
+		line(2, "type nat hook prerouting priority dstnat; policy accept;")
+		if inputs != "" {
+			line(2, "%saccept", strings.Replace(inputs, "iifname", "iifname !=", 1))
+		}
+		redirect()
+		line(1, "}")
+		if p.Local {
+			line(1, "chain output_nat {")
+			line(2, "type nat hook output priority -100; policy accept;")
+			line(2, "meta mark %d return", p.RoutingMark)
+			redirect()
+			line(1, "}")
+		}
+	}
+	line(0, "}")
+	var setup, teardown []string
+	if usesTProxy {
+		setup = append(setup, p.policyRoutes(true)...)
+	}
+	setup = append(setup, "nft -f - <<'EOF'")
+	setup = append(setup, script...)
+	setup = append(setup, "EOF")
+	teardown = append(teardown, fmt.Sprintf("nft delete table inet %s", transparentTable))
+	if usesTProxy {
+		teardown = append(teardown, p.policyRoutes(false)...)
+	}
+	return &TransparentRules{
+		Backend:  p.Backend,
+		Mode:     p.Mode,
+		Setup:    strings.Join(setup, "\n") + "\n",
+		Teardown: strings.Join(teardown, "\n") + "\n",
+	}
+}
+
+// generateTransparentRules writes the shell commands that send the traffic of a gateway to the
+// redir and tproxy listeners, the core does not run them since they need root
+func generateTransparentRules(params *TransparentRulesParams) (*TransparentRules, error) {
+	if err := params.complete(); err != nil {
+		return nil, err
+	}
+	if params.Backend == NftablesTransparentBackend {
+		return params.nftables(), nil
+	}
+	return params.iptables(), nil
+}
+
+func transparentProxyStatus() *TransparentProxyStatus {
+	status := &TransparentProxyStatus{}
+	runLock.Lock()
+	if currentConfig != nil {
+		status.RedirPort = currentConfig.General.RedirPort
+		status.TProxyPort = currentConfig.General.TProxyPort
+		status.RoutingMark = currentConfig.General.RoutingMark
+	}
+	runLock.Unlock()
+	if err := checkTransparentSocket(); err != nil {
+		status.Error = err.Error()
+	} else {
+		status.Supported = true
+	}
+	return status
+}
+
+func handleGenerateTransparentRules(paramsString string) (string, error) {
+	var params = &TransparentRulesParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return "", err
+	}
+	rules, err := generateTransparentRules(params)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(rules)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func handleGetTransparentProxyStatus() string {
+	data, err := json.Marshal(transparentProxyStatus())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
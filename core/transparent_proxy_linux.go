@@ -0,0 +1,22 @@
+//go:build linux && !android
+
+package main
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+)
+
+// checkTransparentSocket sets IP_TRANSPARENT on a scratch socket, the tproxy listener needs it
+// and the kernel only grants it with CAP_NET_ADMIN
+func checkTransparentSocket() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	if err = unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_TRANSPARENT, 1); err != nil {
+		return fmt.Errorf("IP_TRANSPARENT is not permitted, the core needs CAP_NET_ADMIN: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux || android
+
+package main
+
+import "errors"
+
+// checkTransparentSocket fails off desktop linux, tproxy and the iptables or nftables rules are linux only
+func checkTransparentSocket() error {
+	return errors.New("transparent proxy requires linux")
+}
@@ -9,7 +9,6 @@ import (
 	LC "github.com/metacubex/mihomo/listener/config"
 	"github.com/metacubex/mihomo/listener/sing_tun"
 	"github.com/metacubex/mihomo/log"
-	"github.com/metacubex/mihomo/tunnel"
 	"net"
 	"net/netip"
 )
@@ -24,7 +23,7 @@ type Props struct {
 	Dns6     string `json:"dns6"`
 }
 
-func Start(fd int, device string, stack constant.TUNStack) (*sing_tun.Listener, error) {
+func Start(fd int, device string, stack constant.TUNStack, tunnel constant.Tunnel) (*sing_tun.Listener, error) {
 	var prefix4 []netip.Prefix
 	tempPrefix4, err := netip.ParsePrefix(state.DefaultIpv4Address)
 	if err != nil {
@@ -58,7 +57,7 @@ func Start(fd int, device string, stack constant.TUNStack) (*sing_tun.Listener,
 		FileDescriptor:      fd,
 	}
 
-	listener, err := sing_tun.New(options, tunnel.Tunnel)
+	listener, err := sing_tun.New(options, tunnel)
 
 	if err != nil {
 		log.Errorln("startTUN error:", err)
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/shirou/gopsutil/v4/net"
+	"time"
+)
+
+const (
+	defaultTunBenchmarkDuration = 5 * time.Second
+	maxTunBenchmarkDuration     = time.Minute
+)
+
+type TunBenchmarkParams struct {
+	Duration int64 `json:"duration"`
+}
+
+// TunBenchmark is the packet rate seen on the tun interface during the window, counters are from the system side
+type TunBenchmark struct {
+	Device            string            `json:"device"`
+	Stack             constant.TUNStack `json:"stack"`
+	GSO               bool              `json:"gso"`
+	Duration          int64             `json:"duration"`
+	PacketsSent       uint64            `json:"packets-sent"`
+	PacketsRecv       uint64            `json:"packets-recv"`
+	PacketsSentPerSec float64           `json:"packets-sent-per-sec"`
+	PacketsRecvPerSec float64           `json:"packets-recv-per-sec"`
+	BytesSentPerSec   float64           `json:"bytes-sent-per-sec"`
+	BytesRecvPerSec   float64           `json:"bytes-recv-per-sec"`
+	DropsPerSec       float64           `json:"drops-per-sec"`
+}
+
+func tunCounters(ctx context.Context, device string) (*net.IOCountersStat, error) {
+	counters, err := net.IOCountersWithContext(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	for i := range counters {
+		if counters[i].Name == device {
+			return &counters[i], nil
+		}
+	}
+	return nil, errors.New("tun interface not found: " + device)
+}
+
+// runTunBenchmark samples the interface counters while the current traffic flows, run it under a steady load
+func runTunBenchmark(ctx context.Context, duration time.Duration) (*TunBenchmark, error) {
+	device, stack, gso, ok := currentTunDevice()
+	if !ok {
+		return nil, errors.New("tun is not running")
+	}
+	before, err := tunCounters(ctx, device)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(duration):
+	}
+	after, err := tunCounters(ctx, device)
+	if err != nil {
+		return nil, err
+	}
+	elapsed := time.Since(start)
+	benchmark := &TunBenchmark{
+		Device:      device,
+		Stack:       stack,
+		GSO:         gso,
+		Duration:    elapsed.Milliseconds(),
+		PacketsSent: after.PacketsSent - before.PacketsSent,
+		PacketsRecv: after.PacketsRecv - before.PacketsRecv,
+	}
+	benchmark.PacketsSentPerSec = float64(benchmark.PacketsSent) / elapsed.Seconds()
+	benchmark.PacketsRecvPerSec = float64(benchmark.PacketsRecv) / elapsed.Seconds()
+	benchmark.BytesSentPerSec = float64(after.BytesSent-before.BytesSent) / elapsed.Seconds()
+	benchmark.BytesRecvPerSec = float64(after.BytesRecv-before.BytesRecv) / elapsed.Seconds()
+	benchmark.DropsPerSec = float64(after.Dropin+after.Dropout-before.Dropin-before.Dropout) / elapsed.Seconds()
+	return benchmark, nil
+}
+
+func handleBenchmarkTun(paramsString string, fn func(string, error)) {
+	go func() {
+		var params = &TunBenchmarkParams{}
+		if paramsString != "" {
+			if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+				fn("", err)
+				return
+			}
+		}
+		duration := time.Duration(params.Duration) * time.Millisecond
+		if duration <= 0 {
+			duration = defaultTunBenchmarkDuration
+		}
+		if duration > maxTunBenchmarkDuration {
+			duration = maxTunBenchmarkDuration
+		}
+		benchmark, err := runTunBenchmark(context.Background(), duration)
+		if err != nil {
+			fn("", err)
+			return
+		}
+		data, err := json.Marshal(benchmark)
+		if err != nil {
+			fn("", err)
+			return
+		}
+		fn(string(data), nil)
+	}()
+}
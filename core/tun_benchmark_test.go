@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func loopbackInterface(tb testing.TB) string {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			return iface.Name
+		}
+	}
+	tb.Skip("no loopback interface")
+	return ""
+}
+
+func TestRunTunBenchmarkWithoutTun(t *testing.T) {
+	if _, _, _, ok := currentTunDevice(); ok {
+		t.Skip("tun is running")
+	}
+	if _, err := runTunBenchmark(context.Background(), time.Millisecond); err == nil {
+		t.Fatal("benchmark ran without tun")
+	}
+}
+
+func TestTunCounters(t *testing.T) {
+	device := loopbackInterface(t)
+	counters, err := tunCounters(context.Background(), device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counters.Name != device {
+		t.Fatalf("got counters of %s, want %s", counters.Name, device)
+	}
+	if _, err := tunCounters(context.Background(), "flclash-missing0"); err == nil {
+		t.Fatal("found counters of a missing interface")
+	}
+}
+
+// BenchmarkTunCounters is the cost of one sample, runTunBenchmark takes one at each end of the window
+func BenchmarkTunCounters(b *testing.B) {
+	device := loopbackInterface(b)
+	ctx := context.Background()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := tunCounters(ctx, device); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
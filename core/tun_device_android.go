@@ -0,0 +1,74 @@
+//go:build android && cgo
+
+package main
+
+import (
+	t "core/tun"
+	"github.com/metacubex/mihomo/constant"
+	LC "github.com/metacubex/mihomo/listener/config"
+	"golang.org/x/sys/unix"
+)
+
+// currentTunDevice asks the kernel for the name of the VpnService fd, gso is never available on a handed over fd
+func currentTunDevice() (string, constant.TUNStack, bool, bool) {
+	tunLock.Lock()
+	defer tunLock.Unlock()
+	if tunHandler == nil || tunHandler.listener == nil {
+		return "", 0, false, false
+	}
+	stack := tunHandler.listener.Config().Stack
+	ifreq, err := unix.NewIfreq("")
+	if err != nil {
+		return "", stack, false, false
+	}
+	if err = unix.IoctlIfreq(tunHandler.fd, unix.TUNGETIFF, ifreq); err != nil {
+		return "", stack, false, false
+	}
+	return ifreq.Name(), stack, false, true
+}
+
+// restartTunStack runs a new stack on a duplicate of the VpnService fd so the interface is never torn down
+func restartTunStack(stack constant.TUNStack, previous constant.TUNStack) error {
+	tunLock.Lock()
+	defer tunLock.Unlock()
+	if tunHandler == nil || tunHandler.listener == nil {
+		return nil
+	}
+	fd, err := unix.Dup(tunHandler.fd)
+	if err != nil {
+		return err
+	}
+	spareFd, err := unix.Dup(tunHandler.fd)
+	if err != nil {
+		_ = unix.Close(fd)
+		return err
+	}
+	_ = tunHandler.listener.Close()
+	tunHandler.listener = nil
+	device := currentConfig.General.Tun.Device
+	tunListener, err := t.Start(fd, device, stack, tunTunnel)
+	if err == nil {
+		_ = unix.Close(spareFd)
+		tunHandler.fd = fd
+		tunHandler.listener = tunListener
+		return nil
+	}
+	_ = unix.Close(fd)
+	tunListener, restoreErr := t.Start(spareFd, device, previous, tunTunnel)
+	if restoreErr != nil {
+		_ = unix.Close(spareFd)
+		return restoreErr
+	}
+	tunHandler.fd = spareFd
+	tunHandler.listener = tunListener
+	return err
+}
+
+func currentTunConfig() (LC.Tun, bool) {
+	tunLock.Lock()
+	defer tunLock.Unlock()
+	if tunHandler == nil || tunHandler.listener == nil {
+		return LC.Tun{}, false
+	}
+	return tunHandler.listener.Config(), true
+}
@@ -0,0 +1,39 @@
+//go:build !(android && cgo)
+
+package main
+
+import (
+	"errors"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/listener"
+	LC "github.com/metacubex/mihomo/listener/config"
+)
+
+// currentTunDevice returns the interface of the tun listener created from the config
+func currentTunDevice() (string, constant.TUNStack, bool, bool) {
+	tun := listener.GetTunConf()
+	if !tun.Enable || tun.Device == "" {
+		return "", tun.Stack, false, false
+	}
+	return tun.Device, tun.Stack, tun.GSO, true
+}
+
+// restartTunStack recreates the tun listener with the new stack and returns to the previous one when that fails
+func restartTunStack(stack constant.TUNStack, previous constant.TUNStack) error {
+	general := currentConfig.General
+	if !isRunning || !general.Tun.Enable {
+		return nil
+	}
+	updateListeners()
+	if listener.GetTunConf().Enable {
+		return nil
+	}
+	general.Tun.Stack = previous
+	updateListeners()
+	return errors.New("start tun with stack " + stack.String() + " failed")
+}
+
+func currentTunConfig() (LC.Tun, bool) {
+	tun := listener.GetTunConf()
+	return tun, tun.Enable
+}
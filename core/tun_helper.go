@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/listener"
+	LC "github.com/metacubex/mihomo/listener/config"
+	"github.com/metacubex/mihomo/log"
+	"net/netip"
+	"sync"
+)
+
+const (
+	// tunHelperVersion is bumped whenever the messages change, a helper speaking another version
+	// has to be installed again
+	tunHelperVersion      = 2
+	tunHelperCommand      = "tun-helper"
+	tunHelperServiceName  = "flclash-tun-helper"
+	tunHelperHelloMessage = "hello"
+	tunHelperOpenMessage  = "open"
+	tunHelperCloseMessage = "close"
+)
+
+var errTunHelperUnsupported = errors.New("tun helper is not supported on this platform")
+
+// TunHelperParams makes the core ask the helper listening on Socket for the tun device instead of
+// opening it, the core then needs no root once the helper is installed
+type TunHelperParams struct {
+	Enable bool   `json:"enable"`
+	Socket string `json:"socket"`
+}
+
+type TunHelperInstallParams struct {
+	Socket string `json:"socket"`
+	Uid    *int   `json:"uid"`
+}
+
+type TunHelperStatus struct {
+	TunHelperParams
+	Supported bool   `json:"supported"`
+	Installed bool   `json:"installed"`
+	Version   int    `json:"version"`
+	Expected  int    `json:"expected"`
+	Device    string `json:"device,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// tunHelperMessage is one json line each way, the fd rides along the reply to open. BindInterface
+// tells the core binds its sockets to the default interface, a helper that cannot route by the uid
+// of the core needs it before installing routes
+type tunHelperMessage struct {
+	Type          string         `json:"type,omitempty"`
+	Version       int            `json:"version"`
+	Name          string         `json:"name,omitempty"`
+	MTU           uint32         `json:"mtu,omitempty"`
+	Inet4Address  []netip.Prefix `json:"inet4-address,omitempty"`
+	Inet6Address  []netip.Prefix `json:"inet6-address,omitempty"`
+	Routes        []netip.Prefix `json:"routes,omitempty"`
+	Table         int            `json:"table,omitempty"`
+	Rule          int            `json:"rule,omitempty"`
+	BindInterface bool           `json:"bind-interface,omitempty"`
+	Error         string         `json:"error,omitempty"`
+}
+
+func checkTunHelperVersion(reply *tunHelperMessage) error {
+	if reply.Version != tunHelperVersion {
+		return fmt.Errorf("helper speaks version %d, the core expects %d, install the helper again", reply.Version, tunHelperVersion)
+	}
+	if reply.Error != "" {
+		return errors.New(reply.Error)
+	}
+	return nil
+}
+
+// tunHelperRoutes is what auto-route would send to the tun, the helper cannot take over the
+// exclusions and the rule sets of it
+func tunHelperRoutes(tun LC.Tun) []netip.Prefix {
+	if !tun.AutoRoute {
+		return nil
+	}
+	routes := append(append(append([]netip.Prefix{}, tun.RouteAddress...), tun.Inet4RouteAddress...), tun.Inet6RouteAddress...)
+	if len(routes) != 0 {
+		return routes
+	}
+	routes = []netip.Prefix{netip.MustParsePrefix("0.0.0.0/1"), netip.MustParsePrefix("128.0.0.0/1")}
+	if len(tun.Inet6Address) != 0 {
+		routes = append(routes, netip.MustParsePrefix("::/1"), netip.MustParsePrefix("8000::/1"))
+	}
+	return routes
+}
+
+type TunHelper struct {
+	mutex   sync.Mutex
+	params  TunHelperParams
+	fd      int
+	device  string
+	version int
+	err     error
+}
+
+var tunHelper = &TunHelper{}
+
+// handoff is the tun the core starts on the fd of the helper, the routes are already in place
+// and the device cannot do gso without the vnet header the helper did not ask for
+func (h *TunHelper) handoff(tun LC.Tun) LC.Tun {
+	tun.FileDescriptor = h.fd
+	tun.Device = h.device
+	tun.AutoRoute = false
+	tun.AutoRedirect = false
+	tun.StrictRoute = false
+	tun.GSO = false
+	return tun
+}
+
+// Apply swaps the tun of the config for one on a device of the helper, a new device is requested
+// only when the listener would be recreated anyway since that closes the previous fd
+func (h *TunHelper) Apply(tun LC.Tun) LC.Tun {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if !h.params.Enable || tun.FileDescriptor != 0 {
+		return tun
+	}
+	if !tun.Enable {
+		h.releaseLocked()
+		h.fd = 0
+		return tun
+	}
+	if h.fd != 0 {
+		candidate := h.handoff(tun)
+		candidate.Sort()
+		running := listener.GetTunConf()
+		if candidate.Equal(running) {
+			return candidate
+		}
+		if running.FileDescriptor != h.fd {
+			// the listener never started on it, nothing else closes it
+			closeTunFd(h.fd)
+		}
+	}
+	h.releaseLocked()
+	h.fd = 0
+	fd, reply, err := requestTunFd(h.params.Socket, &tunHelperMessage{
+		Type:          tunHelperOpenMessage,
+		Version:       tunHelperVersion,
+		Name:          tun.Device,
+		MTU:           tun.MTU,
+		Inet4Address:  tun.Inet4Address,
+		Inet6Address:  tun.Inet6Address,
+		Routes:        tunHelperRoutes(tun),
+		Table:         tun.IPRoute2TableIndex,
+		Rule:          tun.IPRoute2RuleIndex,
+		BindInterface: tun.AutoDetectInterface,
+	})
+	if reply != nil {
+		h.version = reply.Version
+	}
+	h.err = err
+	if err != nil {
+		log.Warnln("[TunHelper] open tun error: %v", err)
+		return tun
+	}
+	h.fd, h.device = fd, reply.Name
+	log.Infoln("[TunHelper] got %s from the helper", h.device)
+	return h.handoff(tun)
+}
+
+// releaseLocked asks the helper to remove the routes and rules of the device, the helper also does
+// once the device is gone
+func (h *TunHelper) releaseLocked() {
+	if h.device == "" {
+		return
+	}
+	if err := closeTunHelper(h.params.Socket, h.device); err != nil {
+		log.Warnln("[TunHelper] release %s error: %v", h.device, err)
+	}
+	h.device = ""
+}
+
+func (h *TunHelper) Set(params *TunHelperParams) {
+	if params.Socket == "" {
+		params.Socket = defaultTunHelperSocket()
+	}
+	h.mutex.Lock()
+	h.params = *params
+	h.err = nil
+	h.mutex.Unlock()
+}
+
+// Status says hello to the helper, a missing or outdated helper shows up here before the tun fails
+func (h *TunHelper) Status() *TunHelperStatus {
+	h.mutex.Lock()
+	status := &TunHelperStatus{
+		TunHelperParams: h.params,
+		Expected:        tunHelperVersion,
+		Device:          h.device,
+	}
+	socket := h.params.Socket
+	lastErr := h.err
+	h.mutex.Unlock()
+	if socket == "" {
+		socket = defaultTunHelperSocket()
+	}
+	installed, err := tunHelperInstalled()
+	status.Installed = installed
+	status.Supported = !errors.Is(err, errTunHelperUnsupported)
+	if err == nil {
+		var reply *tunHelperMessage
+		reply, err = helloTunHelper(socket)
+		if reply != nil {
+			status.Version = reply.Version
+		}
+	}
+	if err == nil {
+		err = lastErr
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	return status
+}
+
+func handleSetTunHelper(paramsString string) error {
+	var params = &TunHelperParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	tunHelper.Set(params)
+	return nil
+}
+
+func handleGetTunHelper() string {
+	data, err := json.Marshal(tunHelper.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handleInstallTunHelper(paramsString string) error {
+	var params = &TunHelperInstallParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	if params.Socket == "" {
+		params.Socket = defaultTunHelperSocket()
+	}
+	executable, err := coreExecutable()
+	if err != nil {
+		return err
+	}
+	return installTunHelper(executable, params)
+}
+
+func handleUninstallTunHelper() error {
+	return uninstallTunHelper()
+}
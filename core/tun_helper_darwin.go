@@ -0,0 +1,201 @@
+//go:build darwin
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	utunControlName      = "com.apple.net.utun_control"
+	tunHelperLaunchLabel = "io.github.flclash.tunhelper"
+	tunHelperPlistPath   = "/Library/LaunchDaemons/" + tunHelperLaunchLabel + ".plist"
+)
+
+func tunHelperPeerUid(c net.Conn) (int, error) {
+	unixConn, ok := c.(*net.UnixConn)
+	if !ok {
+		return -1, errors.New("not a unix socket")
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	var cred *unix.Xucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptXucred(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return -1, err
+	}
+	return int(cred.Uid), nil
+}
+
+func tunHelperInstalled() (bool, error) {
+	_, err := os.Stat(tunHelperPlistPath)
+	return err == nil, nil
+}
+
+func launchdPlist(executable string, args []string) string {
+	var arguments strings.Builder
+	for _, arg := range append([]string{executable}, args...) {
+		arguments.WriteString("\t\t<string>" + plistEscape(arg) + "</string>\n")
+	}
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+%s	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+</dict>
+</plist>
+`, tunHelperLaunchLabel, arguments.String())
+}
+
+func plistEscape(value string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(value)
+}
+
+func launchctl(args ...string) error {
+	output, err := exec.Command("launchctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("launchctl %s: %v %s", args[0], err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func installTunHelper(executable string, params *TunHelperInstallParams) error {
+	args := []string{tunHelperCommand, "-socket", params.Socket}
+	if params.Uid != nil {
+		args = append(args, "-uid", strconv.Itoa(*params.Uid))
+	}
+	_ = launchctl("bootout", "system/"+tunHelperLaunchLabel)
+	if err := os.WriteFile(tunHelperPlistPath, []byte(launchdPlist(executable, args)), 0644); err != nil {
+		return err
+	}
+	return launchctl("bootstrap", "system", tunHelperPlistPath)
+}
+
+func uninstallTunHelper() error {
+	if _, err := os.Stat(tunHelperPlistPath); os.IsNotExist(err) {
+		return nil
+	}
+	_ = launchctl("bootout", "system/"+tunHelperLaunchLabel)
+	return os.Remove(tunHelperPlistPath)
+}
+
+func runHelperCommand(name string, args ...string) error {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// openUtun connects a utun control socket, unit 0 lets the kernel pick the next free device
+func openUtun(name string) (int, string, error) {
+	unit := 0
+	if index, err := strconv.Atoi(strings.TrimPrefix(name, "utun")); err == nil && strings.HasPrefix(name, "utun") {
+		unit = index + 1
+	}
+	fd, err := unix.Socket(unix.AF_SYSTEM, unix.SOCK_DGRAM, 2)
+	if err != nil {
+		return -1, "", err
+	}
+	ctlInfo := &unix.CtlInfo{}
+	copy(ctlInfo.Name[:], utunControlName)
+	if err = unix.IoctlCtlInfo(fd, ctlInfo); err != nil {
+		_ = unix.Close(fd)
+		return -1, "", os.NewSyscallError("IoctlCtlInfo", err)
+	}
+	if err = unix.Connect(fd, &unix.SockaddrCtl{ID: ctlInfo.Id, Unit: uint32(unit)}); err != nil {
+		_ = unix.Close(fd)
+		return -1, "", os.NewSyscallError("Connect", err)
+	}
+	// UTUN_OPT_IFNAME in the utun control
+	actual, err := unix.GetsockoptString(fd, 2, 2)
+	if err != nil {
+		_ = unix.Close(fd)
+		return -1, "", err
+	}
+	if err = unix.SetNonblock(fd, true); err != nil {
+		_ = unix.Close(fd)
+		return -1, "", err
+	}
+	return fd, actual, nil
+}
+
+// openHelperTun configures the utun with ifconfig and route. The routes cannot leave out the uid
+// of the core like on linux, the core has to keep its sockets off the tun by binding them to the
+// default interface or the request is refused.
+func openHelperTun(uid int, request *tunHelperMessage) (int, string, func(), error) {
+	if len(request.Routes) != 0 && uid != 0 && !request.BindInterface {
+		return -1, "", nil, fmt.Errorf("routes for uid %d need the core bound to the default interface, enable auto-detect-interface", uid)
+	}
+	fd, name, err := openUtun(request.Name)
+	if err != nil {
+		return -1, "", nil, err
+	}
+	helperTuns.release(name)
+	var routes [][]string
+	teardown := func() {
+		for _, route := range routes {
+			_ = runHelperCommand("route", append([]string{"-n", "delete"}, route...)...)
+		}
+	}
+	fail := func(err error) (int, string, func(), error) {
+		teardown()
+		_ = unix.Close(fd)
+		return -1, "", nil, err
+	}
+	if request.MTU != 0 {
+		if err = runHelperCommand("ifconfig", name, "mtu", strconv.Itoa(int(request.MTU))); err != nil {
+			return fail(err)
+		}
+	}
+	for _, prefix := range request.Inet4Address {
+		address := prefix.Addr().String()
+		mask := net.IP(net.CIDRMask(prefix.Bits(), 32)).String()
+		if err = runHelperCommand("ifconfig", name, "inet", address, address, "netmask", mask, "alias"); err != nil {
+			return fail(err)
+		}
+	}
+	for _, prefix := range request.Inet6Address {
+		if err = runHelperCommand("ifconfig", name, "inet6", prefix.String(), "alias"); err != nil {
+			return fail(err)
+		}
+	}
+	if err = runHelperCommand("ifconfig", name, "up"); err != nil {
+		return fail(err)
+	}
+	for _, prefix := range request.Routes {
+		family := "-inet"
+		if prefix.Addr().Is6() {
+			family = "-inet6"
+		}
+		route := []string{family, "-net", prefix.String(), "-interface", name}
+		if err = runHelperCommand("route", append([]string{"-n", "add"}, route...)...); err != nil {
+			return fail(err)
+		}
+		routes = append(routes, route)
+	}
+	return fd, name, teardown, nil
+}
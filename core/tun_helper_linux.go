@@ -0,0 +1,192 @@
+//go:build linux && !android
+
+package main
+
+import (
+	"errors"
+	"github.com/sagernet/netlink"
+	"golang.org/x/sys/unix"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+const (
+	tunHelperDescription     = "Opens the tun device for FlClash"
+	defaultTunHelperDevice   = "Meta"
+	defaultTunHelperTable    = 2022
+	defaultTunHelperRuleBase = 9000
+)
+
+func tunHelperPeerUid(c net.Conn) (int, error) {
+	return daemonPeerUid(c)
+}
+
+func tunHelperInstalled() (bool, error) {
+	if _, err := exec.LookPath("systemctl"); err != nil {
+		return false, errTunHelperUnsupported
+	}
+	_, err := os.Stat(systemdUnitPath(tunHelperServiceName))
+	return err == nil, nil
+}
+
+func installTunHelper(executable string, params *TunHelperInstallParams) error {
+	args := []string{tunHelperCommand, "-socket", params.Socket}
+	if params.Uid != nil {
+		args = append(args, "-uid", strconv.Itoa(*params.Uid))
+	}
+	if err := installSystemdUnit(tunHelperServiceName, systemdUnit(tunHelperDescription, executable, args)); err != nil {
+		return err
+	}
+	_, err := systemctl("restart", tunHelperServiceName)
+	return err
+}
+
+func uninstallTunHelper() error {
+	return removeSystemdUnit(tunHelperServiceName)
+}
+
+func openTunFd(name string) (int, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		_ = unix.Close(fd)
+		return -1, err
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if err = unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		_ = unix.Close(fd)
+		return -1, err
+	}
+	if err = unix.SetNonblock(fd, true); err != nil {
+		_ = unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+func prefixFamily(prefix netip.Prefix) int {
+	if prefix.Addr().Is4() {
+		return unix.AF_INET
+	}
+	return unix.AF_INET6
+}
+
+// tunHelperRouting is what routeTunHelper installed, the rules outlive the device so they are
+// deleted explicitly
+type tunHelperRouting struct {
+	routes []*netlink.Route
+	rules  []*netlink.Rule
+}
+
+func (r *tunHelperRouting) teardown() {
+	for _, rule := range r.rules {
+		_ = netlink.RuleDel(rule)
+	}
+	for _, route := range r.routes {
+		_ = netlink.RouteDel(route)
+	}
+}
+
+// routeTunHelper sends the routes to a table of the tun and keeps the user of the core on the main
+// table, the core cannot mark its own sockets without root so its uid stands in for the mark
+func routeTunHelper(link netlink.Link, uid int, request *tunHelperMessage) (*tunHelperRouting, error) {
+	routing := &tunHelperRouting{}
+	if len(request.Routes) == 0 {
+		return routing, nil
+	}
+	if uid < 0 {
+		return nil, errors.New("the user of the core is unknown, its traffic would loop through the tun")
+	}
+	table := request.Table
+	if table == 0 {
+		table = defaultTunHelperTable
+	}
+	priority := request.Rule
+	if priority == 0 {
+		priority = defaultTunHelperRuleBase
+	}
+	families := map[int]struct{}{}
+	for _, prefix := range request.Routes {
+		dst := &net.IPNet{IP: prefix.Masked().Addr().AsSlice(), Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen())}
+		route := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Table: table}
+		if err := netlink.RouteReplace(route); err != nil {
+			routing.teardown()
+			return nil, err
+		}
+		routing.routes = append(routing.routes, route)
+		families[prefixFamily(prefix)] = struct{}{}
+	}
+	for family := range families {
+		bypass := netlink.NewRule()
+		bypass.Priority = priority
+		bypass.Family = family
+		bypass.Table = unix.RT_TABLE_MAIN
+		bypass.UIDRange = netlink.NewRuleUIDRange(uint32(uid), uint32(uid))
+		if err := netlink.RuleAdd(bypass); err != nil && !errors.Is(err, unix.EEXIST) {
+			routing.teardown()
+			return nil, err
+		}
+		// a rule left by a helper that did not stop cleanly exists already, it is ours all the same
+		routing.rules = append(routing.rules, bypass)
+		tun := netlink.NewRule()
+		tun.Priority = priority + 1
+		tun.Family = family
+		tun.Table = table
+		if err := netlink.RuleAdd(tun); err != nil && !errors.Is(err, unix.EEXIST) {
+			routing.teardown()
+			return nil, err
+		}
+		routing.rules = append(routing.rules, tun)
+	}
+	return routing, nil
+}
+
+// openHelperTun returns the device with the teardown of its routes and rules, the ones of an
+// earlier device of the name go first since the new ones are the same
+func openHelperTun(uid int, request *tunHelperMessage) (int, string, func(), error) {
+	name := request.Name
+	if name == "" {
+		name = defaultTunHelperDevice
+	}
+	helperTuns.release(name)
+	fd, err := openTunFd(name)
+	if err != nil {
+		return -1, "", nil, err
+	}
+	fail := func(err error) (int, string, func(), error) {
+		_ = unix.Close(fd)
+		return -1, "", nil, err
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fail(err)
+	}
+	if request.MTU != 0 {
+		if err = netlink.LinkSetMTU(link, int(request.MTU)); err != nil {
+			return fail(err)
+		}
+	}
+	for _, prefix := range append(append([]netip.Prefix{}, request.Inet4Address...), request.Inet6Address...) {
+		addr, err := netlink.ParseAddr(prefix.String())
+		if err != nil {
+			return fail(err)
+		}
+		if err = netlink.AddrReplace(link, addr); err != nil {
+			return fail(err)
+		}
+	}
+	if err = netlink.LinkSetUp(link); err != nil {
+		return fail(err)
+	}
+	routing, err := routeTunHelper(link, uid, request)
+	if err != nil {
+		return fail(err)
+	}
+	return fd, name, routing.teardown, nil
+}
@@ -0,0 +1,40 @@
+//go:build !darwin && (!linux || android)
+
+package main
+
+// a tun handle of wintun cannot change hands between processes, windows keeps the elevated core
+
+func defaultTunHelperSocket() string {
+	return ""
+}
+
+func closeTunFd(_ int) {
+}
+
+func helloTunHelper(_ string) (*tunHelperMessage, error) {
+	return nil, errTunHelperUnsupported
+}
+
+func closeTunHelper(_ string, _ string) error {
+	return errTunHelperUnsupported
+}
+
+func requestTunFd(_ string, _ *tunHelperMessage) (int, *tunHelperMessage, error) {
+	return 0, nil, errTunHelperUnsupported
+}
+
+func tunHelperInstalled() (bool, error) {
+	return false, errTunHelperUnsupported
+}
+
+func installTunHelper(_ string, _ *TunHelperInstallParams) error {
+	return errTunHelperUnsupported
+}
+
+func uninstallTunHelper() error {
+	return errTunHelperUnsupported
+}
+
+func runTunHelper(_ []string) error {
+	return errTunHelperUnsupported
+}
@@ -0,0 +1,94 @@
+//go:build !cgo && ((linux && !android) || darwin)
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/metacubex/mihomo/log"
+	"net"
+	"os"
+	"time"
+)
+
+// serveTunHelper answers one request, the device is opened for the user of the core on the other
+// end and only that fd leaves the helper
+func serveTunHelper(c *net.UnixConn, allowed int) {
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(tunHelperTimeout))
+	reply := &tunHelperMessage{Version: tunHelperVersion}
+	request, err := readTunHelperMessage(c)
+	if err != nil {
+		return
+	}
+	uid, err := tunHelperPeerUid(c)
+	if err == nil && uid > 0 && allowed >= 0 && uid != allowed {
+		err = fmt.Errorf("uid %d is not allowed", uid)
+	}
+	if err == nil && request.Version != tunHelperVersion {
+		err = fmt.Errorf("core speaks version %d, the helper expects %d", request.Version, tunHelperVersion)
+	}
+	if err != nil {
+		reply.Error = err.Error()
+		_ = writeTunHelperMessage(c, reply, 0)
+		return
+	}
+	switch request.Type {
+	case tunHelperHelloMessage:
+		_ = writeTunHelperMessage(c, reply, 0)
+	case tunHelperOpenMessage:
+		fd, name, teardown, err := openHelperTun(uid, request)
+		if err != nil {
+			log.Warnln("[TunHelper] open %s for uid %d error: %v", request.Name, uid, err)
+			reply.Error = err.Error()
+			_ = writeTunHelperMessage(c, reply, 0)
+			return
+		}
+		reply.Name = name
+		if err = writeTunHelperMessage(c, reply, fd); err != nil {
+			log.Warnln("[TunHelper] hand %s to uid %d error: %v", name, uid, err)
+			teardown()
+		} else {
+			log.Infoln("[TunHelper] handed %s to uid %d", name, uid)
+			helperTuns.record(name, teardown)
+		}
+		// the core holds the device from now on, it goes away once the core closes its fd
+		closeTunFd(fd)
+	case tunHelperCloseMessage:
+		helperTuns.release(request.Name)
+		_ = writeTunHelperMessage(c, reply, 0)
+	default:
+		reply.Error = "unknown message " + request.Type
+		_ = writeTunHelperMessage(c, reply, 0)
+	}
+}
+
+// runTunHelper is the root side of the tun, it opens and configures devices and nothing else
+func runTunHelper(args []string) error {
+	flags := flag.NewFlagSet(tunHelperCommand, flag.ExitOnError)
+	socket := flags.String("socket", defaultTunHelperSocket(), "path of the helper socket")
+	uid := flags.Int("uid", -1, "user allowed to ask for a tun besides root")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	listener, err := listenControlSocket(*socket, *uid, -1)
+	if err != nil {
+		return err
+	}
+	log.Infoln("[TunHelper] version %d listening at %s", tunHelperVersion, *socket)
+	return runUntilSignal(func(stop <-chan struct{}) {
+		go func() {
+			for {
+				c, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go serveTunHelper(c.(*net.UnixConn), *uid)
+			}
+		}()
+		<-stop
+		_ = listener.Close()
+		_ = os.Remove(*socket)
+		helperTuns.releaseAll()
+	})
+}
@@ -0,0 +1,208 @@
+//go:build (linux && !android) || darwin
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"golang.org/x/sys/unix"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTunHelperSocketPath = "/var/run/" + tunHelperServiceName + ".sock"
+	tunHelperTimeout           = 10 * time.Second
+	tunHelperWatchInterval     = 5 * time.Second
+)
+
+type helperTun struct {
+	teardown func()
+}
+
+// helperTunRoutes keeps what the helper installed for each device, it is removed when the core
+// releases the device, the device goes away or the helper stops
+type helperTunRoutes struct {
+	mutex sync.Mutex
+	tuns  map[string]*helperTun
+}
+
+var helperTuns = &helperTunRoutes{tuns: map[string]*helperTun{}}
+
+func (r *helperTunRoutes) record(name string, teardown func()) {
+	tun := &helperTun{teardown: teardown}
+	r.mutex.Lock()
+	previous := r.tuns[name]
+	r.tuns[name] = tun
+	r.mutex.Unlock()
+	if previous != nil {
+		previous.teardown()
+	}
+	go r.watch(name, tun)
+}
+
+// watch removes the routes of a device the core closed without releasing it, e.g. after a crash
+func (r *helperTunRoutes) watch(name string, tun *helperTun) {
+	ticker := time.NewTicker(tunHelperWatchInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.mutex.Lock()
+		current := r.tuns[name] == tun
+		r.mutex.Unlock()
+		if !current {
+			return
+		}
+		if _, err := net.InterfaceByName(name); err != nil {
+			r.remove(name, tun)
+			return
+		}
+	}
+}
+
+func (r *helperTunRoutes) remove(name string, tun *helperTun) {
+	r.mutex.Lock()
+	if r.tuns[name] != tun {
+		r.mutex.Unlock()
+		return
+	}
+	delete(r.tuns, name)
+	r.mutex.Unlock()
+	tun.teardown()
+}
+
+func (r *helperTunRoutes) release(name string) {
+	r.mutex.Lock()
+	tun := r.tuns[name]
+	r.mutex.Unlock()
+	if tun != nil {
+		r.remove(name, tun)
+	}
+}
+
+func (r *helperTunRoutes) releaseAll() {
+	r.mutex.Lock()
+	tuns := r.tuns
+	r.tuns = map[string]*helperTun{}
+	r.mutex.Unlock()
+	for _, tun := range tuns {
+		tun.teardown()
+	}
+}
+
+func defaultTunHelperSocket() string {
+	return defaultTunHelperSocketPath
+}
+
+func closeTunFd(fd int) {
+	_ = unix.Close(fd)
+}
+
+func dialTunHelper(socket string) (*net.UnixConn, error) {
+	c, err := net.DialTimeout("unix", socket, tunHelperTimeout)
+	if err != nil {
+		return nil, err
+	}
+	_ = c.SetDeadline(time.Now().Add(tunHelperTimeout))
+	return c.(*net.UnixConn), nil
+}
+
+func writeTunHelperMessage(c *net.UnixConn, message *tunHelperMessage, fd int) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if fd <= 0 {
+		_, err = c.Write(data)
+		return err
+	}
+	_, _, err = c.WriteMsgUnix(data, unix.UnixRights(fd), nil)
+	return err
+}
+
+func readTunHelperMessage(c *net.UnixConn) (*tunHelperMessage, error) {
+	line, err := bufio.NewReader(c).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	message := &tunHelperMessage{}
+	if err = json.Unmarshal(line, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func helloTunHelper(socket string) (*tunHelperMessage, error) {
+	c, err := dialTunHelper(socket)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if err = writeTunHelperMessage(c, &tunHelperMessage{Type: tunHelperHelloMessage, Version: tunHelperVersion}, 0); err != nil {
+		return nil, err
+	}
+	reply, err := readTunHelperMessage(c)
+	if err != nil {
+		return nil, err
+	}
+	return reply, checkTunHelperVersion(reply)
+}
+
+// closeTunHelper tells the helper the core is done with the device
+func closeTunHelper(socket string, name string) error {
+	c, err := dialTunHelper(socket)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err = writeTunHelperMessage(c, &tunHelperMessage{Type: tunHelperCloseMessage, Version: tunHelperVersion, Name: name}, 0); err != nil {
+		return err
+	}
+	reply, err := readTunHelperMessage(c)
+	if err != nil {
+		return err
+	}
+	return checkTunHelperVersion(reply)
+}
+
+// requestTunFd asks for the device and takes the fd out of the control message of the reply
+func requestTunFd(socket string, request *tunHelperMessage) (int, *tunHelperMessage, error) {
+	c, err := dialTunHelper(socket)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer c.Close()
+	if err = writeTunHelperMessage(c, request, 0); err != nil {
+		return 0, nil, err
+	}
+	data := make([]byte, 4096)
+	oob := make([]byte, unix.CmsgSpace(4))
+	n, oobn, _, _, err := c.ReadMsgUnix(data, oob)
+	if err != nil {
+		return 0, nil, err
+	}
+	reply := &tunHelperMessage{}
+	if err = json.Unmarshal(data[:n], reply); err != nil {
+		return 0, nil, err
+	}
+	var fd int
+	if oobn > 0 {
+		if messages, err := unix.ParseSocketControlMessage(oob[:oobn]); err == nil && len(messages) > 0 {
+			if fds, err := unix.ParseUnixRights(&messages[0]); err == nil && len(fds) > 0 {
+				fd = fds[0]
+			}
+		}
+	}
+	if err = checkTunHelperVersion(reply); err != nil {
+		if fd > 0 {
+			closeTunFd(fd)
+		}
+		return 0, reply, err
+	}
+	if fd <= 0 {
+		return 0, reply, errors.New("helper sent no file descriptor")
+	}
+	return fd, reply, nil
+}
@@ -0,0 +1,120 @@
+//go:build android && cgo
+
+package main
+
+import (
+	"errors"
+	"github.com/metacubex/mihomo/log"
+	"golang.org/x/sys/unix"
+	"net"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+const tunRevokeInterval = 2 * time.Second
+
+// TunProtector is the socket factory of the VpnService, it is registered once and outlives the tun
+// sessions so a socket dialed while the fd changes hands is protected all the same
+type TunProtector struct {
+	sync.RWMutex
+	callback unsafe.Pointer
+}
+
+var protector = &TunProtector{}
+
+func (p *TunProtector) registered() bool {
+	p.RLock()
+	defer p.RUnlock()
+	return p.callback != nil
+}
+
+// protect holds the read lock through the callback so the object is never released under it
+func (p *TunProtector) protect(fd int) bool {
+	p.RLock()
+	defer p.RUnlock()
+	if p.callback == nil {
+		return false
+	}
+	Protect(p.callback, fd)
+	return true
+}
+
+func (p *TunProtector) resolveProcess(source, target net.Addr) string {
+	p.RLock()
+	defer p.RUnlock()
+	if p.callback == nil {
+		return ""
+	}
+	return resolveSocketProcess(p.callback, source, target)
+}
+
+func (p *TunProtector) set(callback unsafe.Pointer) {
+	p.Lock()
+	previous := p.callback
+	p.callback = callback
+	p.Unlock()
+	if previous != nil {
+		releaseObject(previous)
+	}
+}
+
+// handleSetProtector registers the protector, a nil callback hands protection back to the session
+func handleSetProtector(callback unsafe.Pointer) {
+	protector.set(callback)
+	tunLock.Lock()
+	defer tunLock.Unlock()
+	if callback != nil {
+		initTunHook()
+		return
+	}
+	if tunHandler == nil {
+		removeTunHook()
+	}
+}
+
+// tunRevoked tells a detached interface apart from a live one, the kernel keeps the fd open once the
+// VpnService is revoked but TUNGETIFF no longer finds a device behind it
+func tunRevoked(handler *TunHandler) (int, bool) {
+	tunLock.Lock()
+	defer tunLock.Unlock()
+	if tunHandler != handler || handler.listener == nil {
+		return 0, false
+	}
+	ifreq, err := unix.NewIfreq("")
+	if err != nil {
+		return 0, false
+	}
+	err = unix.IoctlIfreq(handler.fd, unix.TUNGETIFF, ifreq)
+	if !errors.Is(err, unix.EBADFD) && !errors.Is(err, unix.EBADF) {
+		return 0, false
+	}
+	fd := handler.fd
+	stopTunLocked()
+	return fd, true
+}
+
+// watchTunRevoke tears a revoked session down and asks the app for a new fd, the protector stays
+// hooked so the sockets dialed until then do not loop
+func watchTunRevoke(handler *TunHandler, done chan struct{}) {
+	ticker := time.NewTicker(tunRevokeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		fd, revoked := tunRevoked(handler)
+		if !revoked {
+			continue
+		}
+		log.Warnln("[TUN] fd %d was revoked, waiting for a new one", fd)
+		go sendMessage(Message{
+			Type: TunRevokedMessage,
+			Data: fd,
+		})
+		go publishTunState()
+		return
+	}
+}
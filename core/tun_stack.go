@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel/statistic"
+)
+
+type TunStackInfo struct {
+	Stack     constant.TUNStack   `json:"stack"`
+	Running   bool                `json:"running"`
+	Available []constant.TUNStack `json:"available"`
+}
+
+// closeTunConnections drops the connections of the old stack so apps reconnect through the new one right away
+func closeTunConnections() {
+	statistic.DefaultManager.Range(func(c statistic.Tracker) bool {
+		if metadata := c.Info().Metadata; metadata != nil && metadata.Type == constant.TUN {
+			_ = c.Close()
+		}
+		return true
+	})
+}
+
+// handleSetTunStack switches the stack of the running tun, the interface and routes stay up on Android
+func handleSetTunStack(stackString string) error {
+	var stack constant.TUNStack
+	if err := stack.UnmarshalText([]byte(stackString)); err != nil {
+		return err
+	}
+	runLock.Lock()
+	defer runLock.Unlock()
+	if currentConfig == nil {
+		return errors.New("config is not ready")
+	}
+	previous := currentConfig.General.Tun.Stack
+	if previous == stack {
+		return nil
+	}
+	currentConfig.General.Tun.Stack = stack
+	if err := restartTunStack(stack, previous); err != nil {
+		currentConfig.General.Tun.Stack = previous
+		return err
+	}
+	closeTunConnections()
+	go publishTunState()
+	log.Infoln("[TUN] stack changed from %s to %s", previous, stack)
+	return nil
+}
+
+func handleGetTunStack() string {
+	info := &TunStackInfo{
+		Available: []constant.TUNStack{constant.TunSystem, constant.TunGvisor, constant.TunMixed},
+	}
+	runLock.Lock()
+	if currentConfig != nil {
+		info.Stack = currentConfig.General.Tun.Stack
+	}
+	runLock.Unlock()
+	_, _, _, info.Running = currentTunDevice()
+	data, err := json.Marshal(info)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
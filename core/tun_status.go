@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/metacubex/mihomo/component/resolver"
+	"github.com/metacubex/mihomo/constant"
+	"net/netip"
+)
+
+// TunStatus reports the addresses of the running tun together with the ipv6 and nat64 state
+type TunStatus struct {
+	Running      bool              `json:"running"`
+	Stack        constant.TUNStack `json:"stack"`
+	Inet4Address []netip.Prefix    `json:"inet4-address"`
+	Inet6Address []netip.Prefix    `json:"inet6-address"`
+	RouteAddress []netip.Prefix    `json:"route-address"`
+	IPv6         bool              `json:"ipv6"`
+	FakeIPRange  string            `json:"fake-ip-range"`
+	FakeIPRange6 string            `json:"fake-ip-range6"`
+	Nat64        Nat64Status       `json:"nat64"`
+	Sniffing     SniffStats        `json:"sniffing"`
+}
+
+func tunStatus() *TunStatus {
+	tun, running := currentTunConfig()
+	status := &TunStatus{
+		Running:      running,
+		Stack:        tun.Stack,
+		Inet4Address: tun.Inet4Address,
+		Inet6Address: tun.Inet6Address,
+		RouteAddress: tun.RouteAddress,
+		IPv6:         !resolver.DisableIPv6,
+		Nat64:        nat64.Status(),
+		Sniffing:     sniffing.Stats(),
+	}
+	runLock.Lock()
+	if currentConfig != nil && currentConfig.DNS.FakeIPRange != nil {
+		status.FakeIPRange = currentConfig.DNS.FakeIPRange.IPNet().String()
+		if status.Nat64.DNS64 {
+			status.FakeIPRange6 = status.Nat64.Prefix
+		}
+	}
+	runLock.Unlock()
+	return status
+}
+
+// publishTunState must not be called with runLock or tunLock held
+func publishTunState() {
+	if eventBus.Has(TunStateTopic) {
+		eventBus.Publish(TunStateTopic, tunStatus())
+	}
+}
+
+func handleGetTunStatus() string {
+	data, err := json.Marshal(tunStatus())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/metacubex/mihomo/adapter"
+	N "github.com/metacubex/mihomo/common/net"
+	"github.com/metacubex/mihomo/component/resolver"
+	"github.com/metacubex/mihomo/config"
+	C "github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	M "github.com/metacubex/sing/common/metadata"
+	"github.com/metacubex/sing/common/uot"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	udpOverTcpKey        = "udp-over-tcp"
+	udpOverTcpVersionKey = "udp-over-tcp-version"
+)
+
+// UdpOverTcpOption turns the UoT extension on for one proxy, version 0 picks the legacy protocol
+// the same way the shadowsocks option does
+type UdpOverTcpOption struct {
+	Enable  bool `json:"enable"`
+	Version int  `json:"version"`
+}
+
+// UdpOverTcpParams overrides the udp-over-tcp keys of the profile proxies by name
+type UdpOverTcpParams struct {
+	Proxies map[string]*UdpOverTcpOption `json:"proxies"`
+}
+
+type UdpOverTcpProxy struct {
+	UdpOverTcpOption
+	// Native is set when the outbound speaks UoT itself, like shadowsocks with udp-over-tcp
+	Native bool  `json:"native"`
+	Flows  int64 `json:"flows"`
+}
+
+type UdpOverTcpStatus struct {
+	Proxies map[string]*UdpOverTcpProxy `json:"proxies"`
+	Active  int                         `json:"active"`
+}
+
+// UdpOverTcp tunnels the udp of outbounds without native udp through a tcp stream to the
+// UoT magic address, which the server side of sing-box and mihomo hands to its udp relay
+type UdpOverTcp struct {
+	mutex     sync.Mutex
+	profile   map[string]*UdpOverTcpOption
+	overrides map[string]*UdpOverTcpOption
+	flows     map[string]*atomic.Int64
+}
+
+var udpOverTcp = &UdpOverTcp{
+	profile:   map[string]*UdpOverTcpOption{},
+	overrides: map[string]*UdpOverTcpOption{},
+	flows:     map[string]*atomic.Int64{},
+}
+
+func checkUdpOverTcpVersion(version int) (uint8, error) {
+	switch version {
+	case 0:
+		return uot.LegacyVersion, nil
+	case uot.Version, uot.LegacyVersion:
+		return uint8(version), nil
+	default:
+		return 0, fmt.Errorf("unknown udp over tcp version %d", version)
+	}
+}
+
+func rawUdpOverTcpOption(mapping map[string]any) (*UdpOverTcpOption, bool) {
+	enable, ok := mapping[udpOverTcpKey].(bool)
+	if !ok {
+		return nil, false
+	}
+	option := &UdpOverTcpOption{Enable: enable}
+	switch version := mapping[udpOverTcpVersionKey].(type) {
+	case int:
+		option.Version = version
+	case uint64:
+		option.Version = int(version)
+	case float64:
+		option.Version = int(version)
+	}
+	return option, true
+}
+
+// Prepare reads the udp-over-tcp keys of the profile proxies, shadowsocks handles them natively
+// and every other type is wrapped once the config is applied
+func (u *UdpOverTcp) Prepare(rawConfig *config.RawConfig) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.profile = map[string]*UdpOverTcpOption{}
+	for _, mapping := range rawConfig.Proxy {
+		name, _ := mapping["name"].(string)
+		if name == "" {
+			continue
+		}
+		if option, ok := rawUdpOverTcpOption(mapping); ok {
+			u.profile[name] = option
+		}
+	}
+}
+
+func (u *UdpOverTcp) optionLocked(name string) *UdpOverTcpOption {
+	if option, ok := u.overrides[name]; ok {
+		return option
+	}
+	return u.profile[name]
+}
+
+func (u *UdpOverTcp) Set(params *UdpOverTcpParams) error {
+	overrides := map[string]*UdpOverTcpOption{}
+	if params != nil {
+		for name, option := range params.Proxies {
+			if option == nil {
+				continue
+			}
+			if _, err := checkUdpOverTcpVersion(option.Version); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			overrides[name] = option
+		}
+	}
+	runLock.Lock()
+	defer runLock.Unlock()
+	u.mutex.Lock()
+	u.overrides = overrides
+	u.mutex.Unlock()
+	rewrapOutboundsLocked()
+	return nil
+}
+
+func canUdpOverTcp(proxy C.ProxyAdapter) bool {
+	if _, ok := proxy.(C.Group); ok {
+		return false
+	}
+	switch proxy.Type() {
+	case C.Direct, C.Reject, C.RejectDrop, C.Compatible, C.Pass, C.Dns:
+		return false
+	}
+	return true
+}
+
+// wrap adds the UoT layer to an outbound that has it enabled and lacks it natively
+func (u *UdpOverTcp) wrap(name string, proxy C.ProxyAdapter) C.ProxyAdapter {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	option := u.optionLocked(name)
+	if option == nil || !option.Enable || proxy.SupportUOT() || !canUdpOverTcp(proxy) {
+		return proxy
+	}
+	version, err := checkUdpOverTcpVersion(option.Version)
+	if err != nil {
+		log.Warnln("[UoT] %s: %v", name, err)
+		return proxy
+	}
+	flows, ok := u.flows[name]
+	if !ok {
+		flows = &atomic.Int64{}
+		u.flows[name] = flows
+	}
+	return &uotAdapter{ProxyAdapter: proxy, version: version, flows: flows}
+}
+
+func (u *UdpOverTcp) Status() *UdpOverTcpStatus {
+	runLock.Lock()
+	defer runLock.Unlock()
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	status := &UdpOverTcpStatus{Proxies: map[string]*UdpOverTcpProxy{}}
+	for name, proxy := range tunnel.ProxiesWithProviders() {
+		outbound, ok := proxy.(*adapter.Proxy)
+		if !ok {
+			continue
+		}
+		if wrapped, ok := findWrapped[*uotAdapter](outbound.ProxyAdapter); ok {
+			status.Proxies[name] = &UdpOverTcpProxy{
+				UdpOverTcpOption: UdpOverTcpOption{Enable: true, Version: int(wrapped.version)},
+				Flows:            wrapped.flows.Load(),
+			}
+			status.Active++
+			continue
+		}
+		if outbound.SupportUOT() {
+			status.Proxies[name] = &UdpOverTcpProxy{
+				UdpOverTcpOption: UdpOverTcpOption{Enable: true},
+				Native:           true,
+			}
+			status.Active++
+			continue
+		}
+		if option := u.optionLocked(name); option != nil {
+			status.Proxies[name] = &UdpOverTcpProxy{UdpOverTcpOption: *option}
+		}
+	}
+	return status
+}
+
+// isUdpOverTcp tells whether a udp connection leaves through an outbound that carries it over tcp
+func isUdpOverTcp(metadata *C.Metadata, chain C.Chain) bool {
+	if metadata == nil || metadata.NetWork != C.UDP || len(chain) == 0 {
+		return false
+	}
+	proxy, ok := tunnel.ProxiesWithProviders()[chain[0]]
+	return ok && proxy.SupportUOT()
+}
+
+// uotAdapter carries the udp of an outbound over a tcp connection it dials to the UoT magic address
+type uotAdapter struct {
+	C.ProxyAdapter
+	version uint8
+	flows   *atomic.Int64
+}
+
+func (a *uotAdapter) Inner() C.ProxyAdapter {
+	return a.ProxyAdapter
+}
+
+func (a *uotAdapter) SupportUDP() bool {
+	return true
+}
+
+func (a *uotAdapter) SupportUOT() bool {
+	return true
+}
+
+func (a *uotAdapter) streamMetadata(metadata *C.Metadata) *C.Metadata {
+	destination := uot.RequestDestination(a.version)
+	stream := metadata.Clone()
+	stream.NetWork = C.TCP
+	stream.Host = destination.Fqdn
+	stream.DstIP = netip.Addr{}
+	stream.DstPort = destination.Port
+	return stream
+}
+
+func (a *uotAdapter) ListenPacketContext(ctx context.Context, metadata *C.Metadata) (C.PacketConn, error) {
+	conn, err := a.ProxyAdapter.DialContext(ctx, a.streamMetadata(metadata))
+	if err != nil {
+		return nil, err
+	}
+	return a.packetConn(ctx, conn, metadata)
+}
+
+func (a *uotAdapter) ListenPacketWithDialer(ctx context.Context, dialer C.Dialer, metadata *C.Metadata) (C.PacketConn, error) {
+	conn, err := a.ProxyAdapter.DialContextWithDialer(ctx, dialer, a.streamMetadata(metadata))
+	if err != nil {
+		return nil, err
+	}
+	return a.packetConn(ctx, conn, metadata)
+}
+
+func (a *uotAdapter) ResolveUDP(ctx context.Context, metadata *C.Metadata) error {
+	if !metadata.Resolved() {
+		ip, err := resolver.ResolveIP(ctx, metadata.Host)
+		if err != nil {
+			return fmt.Errorf("can't resolve ip: %w", err)
+		}
+		metadata.DstIP = ip
+	}
+	return nil
+}
+
+func (a *uotAdapter) packetConn(ctx context.Context, conn net.Conn, metadata *C.Metadata) (C.PacketConn, error) {
+	if err := a.ResolveUDP(ctx, metadata); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	request := uot.Request{Destination: M.SocksaddrFromNet(metadata.UDPAddr())}
+	var pc net.PacketConn
+	if a.version == uot.LegacyVersion {
+		pc = uot.NewConn(conn, request)
+	} else {
+		pc = uot.NewLazyConn(conn, request)
+	}
+	a.flows.Add(1)
+	return &uotPacketConn{
+		EnhancePacketConn: N.NewThreadSafePacketConn(pc),
+		chain:             C.Chain{a.Name()},
+		adapter:           a,
+	}, nil
+}
+
+// uotPacketConn keeps the chain of the tcp stream so the tunnel can append the groups to it
+type uotPacketConn struct {
+	N.EnhancePacketConn
+	chain   C.Chain
+	adapter *uotAdapter
+}
+
+func (c *uotPacketConn) Chains() C.Chain {
+	return c.chain
+}
+
+func (c *uotPacketConn) AppendToChains(a C.ProxyAdapter) {
+	c.chain = append(c.chain, a.Name())
+}
+
+func (c *uotPacketConn) RemoteDestination() string {
+	host, _, _ := net.SplitHostPort(c.adapter.Addr())
+	return host
+}
+
+func (c *uotPacketConn) ResolveUDP(ctx context.Context, metadata *C.Metadata) error {
+	return c.adapter.ResolveUDP(ctx, metadata)
+}
+
+func (c *uotPacketConn) Upstream() any {
+	return c.EnhancePacketConn
+}
+
+func (c *uotPacketConn) WriterReplaceable() bool {
+	return true
+}
+
+func (c *uotPacketConn) ReaderReplaceable() bool {
+	return true
+}
+
+func handleSetUdpOverTcp(paramsString string) error {
+	var params *UdpOverTcpParams
+	if err := json.Unmarshal([]byte(paramsString), &params); err != nil {
+		return err
+	}
+	return udpOverTcp.Set(params)
+}
+
+func handleGetUdpOverTcp() string {
+	data, err := json.Marshal(udpOverTcp.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
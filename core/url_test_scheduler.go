@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/metacubex/mihomo/common/utils"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"github.com/metacubex/mihomo/tunnel"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultURLTestInterval    = 10 * time.Minute
+	defaultURLTestTimeout     = 5 * time.Second
+	defaultURLTestConcurrency = 8
+	defaultURLTestJitter      = 0.1
+	minURLTestInterval        = 10 * time.Second
+)
+
+type URLTestScheduleParams struct {
+	Groups      []string `json:"groups"`
+	TestUrl     string   `json:"test-url"`
+	Interval    int64    `json:"interval"`
+	Timeout     int64    `json:"timeout"`
+	Concurrency int      `json:"concurrency"`
+	Jitter      float64  `json:"jitter"`
+	MaxBackoff  int64    `json:"max-backoff"`
+}
+
+// URLTestNodeState is the scheduling state of a single proxy
+type URLTestNodeState struct {
+	Name     string `json:"name"`
+	Delay    int32  `json:"delay"`
+	Failures int    `json:"failures"`
+	LastTest int64  `json:"last-test"`
+	NextTest int64  `json:"next-test"`
+}
+
+type urlTestScheduler struct {
+	mutex    sync.Mutex
+	cancel   context.CancelFunc
+	params   URLTestScheduleParams
+	interval time.Duration
+	timeout  time.Duration
+	backoff  time.Duration
+	nodes    map[string]*URLTestNodeState
+}
+
+var urlTestSchedule = &urlTestScheduler{}
+
+// Start replaces any running schedule with params
+func (s *urlTestScheduler) Start(params URLTestScheduleParams) error {
+	if len(params.Groups) == 0 {
+		return errors.New("no groups to test")
+	}
+	interval := time.Duration(params.Interval) * time.Millisecond
+	if interval <= 0 {
+		interval = defaultURLTestInterval
+	}
+	if interval < minURLTestInterval {
+		interval = minURLTestInterval
+	}
+	timeout := time.Duration(params.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultURLTestTimeout
+	}
+	backoff := time.Duration(params.MaxBackoff) * time.Millisecond
+	if backoff < interval {
+		backoff = interval * 8
+	}
+	if params.Concurrency <= 0 {
+		params.Concurrency = defaultURLTestConcurrency
+	}
+	if params.Jitter < 0 || params.Jitter >= 1 {
+		params.Jitter = defaultURLTestJitter
+	}
+
+	s.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.mutex.Lock()
+	s.cancel = cancel
+	s.params = params
+	s.interval = interval
+	s.timeout = timeout
+	s.backoff = backoff
+	s.nodes = map[string]*URLTestNodeState{}
+	s.mutex.Unlock()
+	go s.run(ctx)
+	return nil
+}
+
+// Stop cancels the running schedule
+func (s *urlTestScheduler) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+}
+
+func (s *urlTestScheduler) run(ctx context.Context) {
+	for {
+		runGuarded("url-test", func() {
+			s.round(ctx)
+		})
+		s.mutex.Lock()
+		wait := jitterDuration(s.tickLocked(), s.params.Jitter)
+		s.mutex.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// tickLocked is the time until the earliest node is due, bounded by the base interval
+func (s *urlTestScheduler) tickLocked() time.Duration {
+	tick := powerScaled(s.interval)
+	now := time.Now().UnixMilli()
+	for _, node := range s.nodes {
+		if wait := time.Duration(node.NextTest-now) * time.Millisecond; wait < tick {
+			tick = wait
+		}
+	}
+	if tick < time.Second {
+		tick = time.Second
+	}
+	return tick
+}
+
+// round tests all due members of the scheduled groups, results reach the app through the url test hook
+func (s *urlTestScheduler) round(ctx context.Context) {
+	s.mutex.Lock()
+	params := s.params
+	timeout := s.timeout
+	s.mutex.Unlock()
+
+	expectedStatus, _ := utils.NewUnsignedRanges[uint16]("")
+	testUrl := constant.DefaultTestURL
+	if params.TestUrl != "" {
+		testUrl = params.TestUrl
+	}
+
+	due := s.dueProxies(params.Groups)
+	semaphore := make(chan struct{}, params.Concurrency)
+	wg := sync.WaitGroup{}
+	for _, proxy := range due {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case semaphore <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(proxy constant.Proxy) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			testCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			delay, err := proxy.URLTest(testCtx, testUrl, expectedStatus)
+			if ctx.Err() != nil {
+				return
+			}
+			s.record(proxy.Name(), delay, err)
+		}(proxy)
+	}
+	wg.Wait()
+}
+
+func (s *urlTestScheduler) dueProxies(groups []string) []constant.Proxy {
+	proxies := tunnel.ProxiesWithProviders()
+	now := time.Now().UnixMilli()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	seen := map[string]bool{}
+	var due []constant.Proxy
+	for _, groupName := range groups {
+		for _, proxy := range groupMembers(proxies, groupName) {
+			name := proxy.Name()
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			if node, exists := s.nodes[name]; exists && node.NextTest > now {
+				continue
+			}
+			due = append(due, proxy)
+		}
+	}
+	return due
+}
+
+// record updates a node and backs it off exponentially while it keeps failing
+func (s *urlTestScheduler) record(name string, delay uint16, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	node, exists := s.nodes[name]
+	if !exists {
+		node = &URLTestNodeState{Name: name}
+		s.nodes[name] = node
+	}
+	now := time.Now()
+	node.LastTest = now.UnixMilli()
+	next := powerScaled(s.interval)
+	if err != nil || delay == 0 {
+		node.Delay = -1
+		node.Failures++
+		for i := 1; i < node.Failures && next < s.backoff; i++ {
+			next *= 2
+		}
+		if next > s.backoff {
+			next = s.backoff
+		}
+		log.Debugln("[URLTestScheduler] %s failed %d times, next test in %v", name, node.Failures, next)
+	} else {
+		node.Delay = int32(delay)
+		node.Failures = 0
+	}
+	node.NextTest = now.Add(jitterDuration(next, s.params.Jitter)).UnixMilli()
+}
+
+// States returns the scheduling state of all tested nodes
+func (s *urlTestScheduler) States() []URLTestNodeState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	states := make([]URLTestNodeState, 0, len(s.nodes))
+	for _, node := range s.nodes {
+		states = append(states, *node)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	return states
+}
+
+func jitterDuration(d time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return d
+	}
+	return d + time.Duration((rand.Float64()*2-1)*jitter*float64(d))
+}
+
+func handleStartURLTestSchedule(paramsString string) string {
+	var params = URLTestScheduleParams{}
+	if err := json.Unmarshal([]byte(paramsString), &params); err != nil {
+		return err.Error()
+	}
+	if err := urlTestSchedule.Start(params); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func handleStopURLTestSchedule() bool {
+	urlTestSchedule.Stop()
+	return true
+}
+
+func handleGetURLTestSchedule() string {
+	data, err := json.Marshal(urlTestSchedule.States())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
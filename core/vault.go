@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	vaultDir    = "vault"
+	vaultFile   = "secrets.json"
+	vaultRefKey = "vault"
+	// vaultMinInlineBytes is the length a secret needs before it is also replaced inside longer
+	// values, a short one would match ports and names
+	vaultMinInlineBytes = 8
+)
+
+var (
+	vaultNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+	vaultRefPattern  = regexp.MustCompile(`\{\{-?\s*` + vaultRefKey + `\s`)
+)
+
+// VaultSecret is a credential kept once for the profiles granted it, Value is always encrypted
+type VaultSecret struct {
+	Name     string   `json:"name"`
+	Kind     string   `json:"kind,omitempty"`
+	Value    string   `json:"value"`
+	Profiles []string `json:"profiles"`
+	Created  int64    `json:"created"`
+	Updated  int64    `json:"updated"`
+}
+
+// VaultSecretRef is all the app gets of a secret, Ref is what a profile holds in place of the value
+type VaultSecretRef struct {
+	Name     string   `json:"name"`
+	Kind     string   `json:"kind,omitempty"`
+	Ref      string   `json:"ref"`
+	Profiles []string `json:"profiles"`
+	Created  int64    `json:"created"`
+	Updated  int64    `json:"updated"`
+}
+
+// StoreSecretParams stores a secret for the profiles granted it, an empty Value keeps the value of
+// a stored secret and only changes its kind and grants
+type StoreSecretParams struct {
+	Name     string   `json:"name"`
+	Kind     string   `json:"kind"`
+	Value    string   `json:"value"`
+	Profiles []string `json:"profiles"`
+}
+
+type Vault struct {
+	mutex   sync.Mutex
+	secrets []*VaultSecret
+	loaded  bool
+}
+
+var vault = &Vault{}
+
+func vaultPath(name string) string {
+	return filepath.Join(constant.Path.Resolve(vaultDir), name)
+}
+
+// vaultRef is the template a profile uses for the secret, it is rendered at load time
+func vaultRef(name string) string {
+	return fmt.Sprintf("{{ %s %q }}", vaultRefKey, name)
+}
+
+func (s *VaultSecret) ref() VaultSecretRef {
+	return VaultSecretRef{
+		Name:     s.Name,
+		Kind:     s.Kind,
+		Ref:      vaultRef(s.Name),
+		Profiles: append([]string{}, s.Profiles...),
+		Created:  s.Created,
+		Updated:  s.Updated,
+	}
+}
+
+func (s *VaultSecret) granted(profile string) bool {
+	for _, item := range s.Profiles {
+		if item == profile {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeVaultProfiles(profiles []string) []string {
+	normalized := make([]string, 0, len(profiles))
+	for _, profile := range profiles {
+		if profile = strings.TrimSpace(profile); profile != "" {
+			normalized = append(normalized, profile)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+func (v *Vault) loadLocked() {
+	if v.loaded {
+		return
+	}
+	v.loaded = true
+	data, err := os.ReadFile(vaultPath(vaultFile))
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &v.secrets); err != nil {
+		log.Warnln("[Vault] load secrets error: %v", err)
+	}
+}
+
+func (v *Vault) saveLocked() error {
+	data, err := json.Marshal(v.secrets)
+	if err != nil {
+		return err
+	}
+	path := vaultPath(vaultFile)
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+func (v *Vault) findLocked(name string) (int, *VaultSecret) {
+	v.loadLocked()
+	for index, secret := range v.secrets {
+		if secret.Name == name {
+			return index, secret
+		}
+	}
+	return -1, nil
+}
+
+// Store keeps the value under the name, storing a name again replaces its value and grants
+func (v *Vault) Store(params *StoreSecretParams) (VaultSecretRef, error) {
+	if !vaultNamePattern.MatchString(params.Name) {
+		return VaultSecretRef{}, fmt.Errorf("invalid secret name %q", params.Name)
+	}
+	value := params.Value
+	if value != "" && !strings.HasPrefix(value, encryptedValuePrefix) {
+		encrypted, err := EncryptSecretValue(value)
+		if err != nil {
+			return VaultSecretRef{}, err
+		}
+		value = encrypted
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	now := time.Now().UnixMilli()
+	_, secret := v.findLocked(params.Name)
+	if secret == nil {
+		if value == "" {
+			return VaultSecretRef{}, errors.New("value is required")
+		}
+		secret = &VaultSecret{Name: params.Name, Created: now}
+		v.secrets = append(v.secrets, secret)
+	}
+	secret.Kind = params.Kind
+	if value != "" {
+		secret.Value = value
+	}
+	secret.Profiles = normalizeVaultProfiles(params.Profiles)
+	secret.Updated = now
+	return secret.ref(), v.saveLocked()
+}
+
+// reseal moves the values sealed by from to the key in use
+func (v *Vault) reseal(from *EncryptionService) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.loadLocked()
+	if len(v.secrets) == 0 {
+		return nil
+	}
+	for _, secret := range v.secrets {
+		value, err := resealSecretValue(secret.Value, from)
+		if err != nil {
+			return fmt.Errorf("%s: %v", secret.Name, err)
+		}
+		secret.Value = value
+	}
+	return v.saveLocked()
+}
+
+// backup gives the secrets with their plain values, the bundle is sealed with its own passphrase
+func (v *Vault) backup() ([]VaultSecret, error) {
+	v.mutex.Lock()
+	v.loadLocked()
+	secrets := make([]VaultSecret, 0, len(v.secrets))
+	for _, secret := range v.secrets {
+		secrets = append(secrets, *secret)
+	}
+	v.mutex.Unlock()
+	for index := range secrets {
+		plain, err := decryptSecretValue(secrets[index].Value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", secrets[index].Name, err)
+		}
+		secrets[index].Value = plain
+	}
+	return secrets, nil
+}
+
+// restore seals the secrets of a bundle with the key in use, a stored secret of the same name is replaced
+func (v *Vault) restore(secrets []VaultSecret) error {
+	restored := make([]*VaultSecret, 0, len(secrets))
+	for _, secret := range secrets {
+		if !vaultNamePattern.MatchString(secret.Name) {
+			return fmt.Errorf("invalid secret name %q", secret.Name)
+		}
+		value, err := EncryptSecretValue(secret.Value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", secret.Name, err)
+		}
+		copied := secret
+		copied.Value = value
+		copied.Profiles = normalizeVaultProfiles(secret.Profiles)
+		restored = append(restored, &copied)
+	}
+	if len(restored) == 0 {
+		return nil
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	for _, secret := range restored {
+		if index, _ := v.findLocked(secret.Name); index >= 0 {
+			v.secrets[index] = secret
+		} else {
+			v.secrets = append(v.secrets, secret)
+		}
+	}
+	return v.saveLocked()
+}
+
+func (v *Vault) Ref(name string) (VaultSecretRef, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	_, secret := v.findLocked(name)
+	if secret == nil {
+		return VaultSecretRef{}, fmt.Errorf("secret %s is not stored", name)
+	}
+	return secret.ref(), nil
+}
+
+// Delete drops the secret, the profiles still referencing it fail to load until it is stored again
+func (v *Vault) Delete(name string) (bool, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	index, secret := v.findLocked(name)
+	if secret == nil {
+		return false, nil
+	}
+	v.secrets = append(v.secrets[:index], v.secrets[index+1:]...)
+	return true, v.saveLocked()
+}
+
+func (v *Vault) List() []VaultSecretRef {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.loadLocked()
+	list := make([]VaultSecretRef, 0, len(v.secrets))
+	for _, secret := range v.secrets {
+		list = append(list, secret.ref())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// Granted tells the profile is granted a secret, its vault refs are rendered at load time
+func (v *Vault) Granted(profile string) bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.loadLocked()
+	for _, secret := range v.secrets {
+		if secret.granted(profile) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the plain value for a profile granted the secret, only the rendering of a profile
+// asks for it
+func (v *Vault) Resolve(profile, name string) (string, error) {
+	v.mutex.Lock()
+	_, secret := v.findLocked(name)
+	value := ""
+	granted := false
+	if secret != nil {
+		value = secret.Value
+		granted = profile != "" && secret.granted(profile)
+	}
+	v.mutex.Unlock()
+	if secret == nil {
+		return "", fmt.Errorf("secret %s is not stored", name)
+	}
+	if !granted {
+		return "", fmt.Errorf("secret %s is not granted to profile %s", name, profile)
+	}
+	plain, err := decryptSecretValue(value)
+	if err != nil {
+		return "", fmt.Errorf("secret %s: %v", name, err)
+	}
+	return plain, nil
+}
+
+type vaultPlain struct {
+	value string
+	ref   string
+}
+
+// plains gives the values with their refs, the longest first so a value holding another one is
+// replaced as a whole
+func (v *Vault) plains() []vaultPlain {
+	v.mutex.Lock()
+	v.loadLocked()
+	secrets := make([]VaultSecret, 0, len(v.secrets))
+	for _, secret := range v.secrets {
+		secrets = append(secrets, *secret)
+	}
+	v.mutex.Unlock()
+	plains := make([]vaultPlain, 0, len(secrets))
+	for _, secret := range secrets {
+		plain, err := decryptSecretValue(secret.Value)
+		if err != nil || plain == "" {
+			continue
+		}
+		plains = append(plains, vaultPlain{value: plain, ref: vaultRef(secret.Name)})
+	}
+	sort.Slice(plains, func(i, j int) bool {
+		return len(plains[i].value) > len(plains[j].value)
+	})
+	return plains
+}
+
+func (p vaultPlain) replace(value string) (string, bool) {
+	if value == p.value {
+		return p.ref, true
+	}
+	if len(p.value) >= vaultMinInlineBytes && strings.Contains(value, p.value) {
+		return strings.ReplaceAll(value, p.value, p.ref), true
+	}
+	return value, false
+}
+
+// referenceVaultSecrets swaps the values of the document that are stored in the vault for their refs
+func referenceVaultSecrets(node *yaml.Node, plains []vaultPlain) bool {
+	if node.Kind == yaml.ScalarNode {
+		// a port or a flag that happens to equal a secret is no credential
+		if node.ShortTag() != "!!str" {
+			return false
+		}
+		replaced := false
+		for _, plain := range plains {
+			var ok bool
+			if node.Value, ok = plain.replace(node.Value); ok {
+				replaced = true
+			}
+		}
+		if replaced {
+			node.Tag = "!!str"
+			node.Style = yaml.DoubleQuotedStyle
+		}
+		return replaced
+	}
+	replaced := false
+	for _, child := range node.Content {
+		if referenceVaultSecrets(child, plains) {
+			replaced = true
+		}
+	}
+	return replaced
+}
+
+// isVaultRef tells a value that only names a secret of the vault, it is no credential itself
+func isVaultRef(value string) bool {
+	return vaultRefPattern.MatchString(value)
+}
+
+func handleStoreSecret(paramsString string) (string, error) {
+	params := &StoreSecretParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return "", err
+	}
+	ref, err := vault.Store(params)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(ref)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func handleGetSecretRef(name string) (string, error) {
+	ref, err := vault.Ref(name)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(ref)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func handleDeleteSecret(name string) (bool, error) {
+	return vault.Delete(name)
+}
+
+func handleGetSecrets() string {
+	data, err := json.Marshal(vault.List())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
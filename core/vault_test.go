@@ -0,0 +1,169 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/metacubex/mihomo/config"
+	"github.com/metacubex/mihomo/constant"
+	"gopkg.in/yaml.v3"
+)
+
+// useTestVault points the vault at a temporary home with a static key
+func useTestVault(t *testing.T) *Vault {
+	t.Helper()
+	previousHome, previousService := constant.Path.HomeDir(), getEncryptionService()
+	constant.SetHomeDir(t.TempDir())
+	encryptionServiceValue.Store(NewEncryptionService(NewStaticKeyProvider(strings.Repeat("k", 32))))
+	t.Cleanup(func() {
+		constant.SetHomeDir(previousHome)
+		encryptionServiceValue.Store(previousService)
+	})
+	return &Vault{}
+}
+
+func TestVaultResolvesOnlyGrantedProfiles(t *testing.T) {
+	v := useTestVault(t)
+	if _, err := v.Store(&StoreSecretParams{Name: "token", Value: "s3cr3t-value", Profiles: []string{"home", " work "}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, profile := range []string{"home", "work"} {
+		if value, err := v.Resolve(profile, "token"); err != nil || value != "s3cr3t-value" {
+			t.Fatalf("%s resolved %q: %v", profile, value, err)
+		}
+	}
+	for _, profile := range []string{"other", ""} {
+		if value, err := v.Resolve(profile, "token"); err == nil {
+			t.Fatalf("ungranted profile %q resolved %q", profile, value)
+		}
+	}
+	if _, err := v.Resolve("home", "missing"); err == nil {
+		t.Fatal("resolved a secret never stored")
+	}
+}
+
+func TestVaultKeepsValueWhenGrantsChange(t *testing.T) {
+	v := useTestVault(t)
+	if _, err := v.Store(&StoreSecretParams{Name: "token", Value: "s3cr3t-value", Profiles: []string{"home"}}); err != nil {
+		t.Fatal(err)
+	}
+	ref, err := v.Store(&StoreSecretParams{Name: "token", Kind: "password", Profiles: []string{"work"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Kind != "password" || !reflect.DeepEqual(ref.Profiles, []string{"work"}) {
+		t.Fatalf("grants not updated: %+v", ref)
+	}
+	if _, err := v.Resolve("home", "token"); err == nil {
+		t.Fatal("revoked profile still resolves the secret")
+	}
+	if value, err := v.Resolve("work", "token"); err != nil || value != "s3cr3t-value" {
+		t.Fatalf("value changed to %q: %v", value, err)
+	}
+	if _, err := v.Store(&StoreSecretParams{Name: "new", Profiles: []string{"work"}}); err == nil {
+		t.Fatal("stored a new secret without value")
+	}
+}
+
+func TestVaultPersistsEncrypted(t *testing.T) {
+	v := useTestVault(t)
+	if _, err := v.Store(&StoreSecretParams{Name: "token", Value: "s3cr3t-value", Profiles: []string{"home"}}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(vaultPath(vaultFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "s3cr3t-value") {
+		t.Fatal("vault file holds the plain value")
+	}
+	reloaded := &Vault{}
+	if value, err := reloaded.Resolve("home", "token"); err != nil || value != "s3cr3t-value" {
+		t.Fatalf("reloaded vault resolved %q: %v", value, err)
+	}
+	list := reloaded.List()
+	if len(list) != 1 || list[0].Ref != vaultRef("token") || !isVaultRef(list[0].Ref) {
+		t.Fatalf("listed %+v", list)
+	}
+}
+
+func TestVaultRejectsInvalidNames(t *testing.T) {
+	v := useTestVault(t)
+	for _, name := range []string{"", "a b", "../token", "{{ vault }}"} {
+		if _, err := v.Store(&StoreSecretParams{Name: name, Value: "value"}); err == nil {
+			t.Fatalf("stored a secret named %q", name)
+		}
+	}
+}
+
+func TestVaultDelete(t *testing.T) {
+	v := useTestVault(t)
+	if _, err := v.Store(&StoreSecretParams{Name: "token", Value: "value", Profiles: []string{"home"}}); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := v.Delete("token"); !deleted || err != nil {
+		t.Fatalf("delete: %v %v", deleted, err)
+	}
+	if deleted, _ := v.Delete("token"); deleted {
+		t.Fatal("deleted a secret twice")
+	}
+	if _, err := v.Resolve("home", "token"); err == nil {
+		t.Fatal("deleted secret still resolves")
+	}
+}
+
+func TestVaultRendersGrantedProfiles(t *testing.T) {
+	previousVault, previousTemplates := vault, templateVariables
+	vault, templateVariables = useTestVault(t), &TemplateVariables{}
+	t.Cleanup(func() {
+		vault, templateVariables = previousVault, previousTemplates
+	})
+	if _, err := vault.Store(&StoreSecretParams{Name: "password", Value: "hunter22", Profiles: []string{"home"}}); err != nil {
+		t.Fatal(err)
+	}
+	render := func(profile string) (*config.RawConfig, error) {
+		rawConfig := &config.RawConfig{
+			Proxy: []map[string]any{{"password": vaultRef("password"), "name": `{{ env "FLCLASH_NAME" }}`}},
+		}
+		return rawConfig, renderProfileTemplates(profile, rawConfig)
+	}
+	rawConfig, err := render("home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password := rawConfig.Proxy[0]["password"]; password != "hunter22" {
+		t.Fatalf("granted profile resolved %v", password)
+	}
+	// the other templates stay as they are until the profile is marked as templated
+	if name := rawConfig.Proxy[0]["name"]; name != `{{ env "FLCLASH_NAME" }}` {
+		t.Fatalf("untemplated profile rendered %v", name)
+	}
+	rawConfig, err = render("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password := rawConfig.Proxy[0]["password"]; password != vaultRef("password") {
+		t.Fatalf("profile without grants resolved %v", password)
+	}
+}
+
+func TestVaultReferencesOnlyStrings(t *testing.T) {
+	v := useTestVault(t)
+	if _, err := v.Store(&StoreSecretParams{Name: "port", Value: "443", Profiles: []string{"home"}}); err != nil {
+		t.Fatal(err)
+	}
+	document := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte("port: 443\npassword: \"443\"\n"), document); err != nil {
+		t.Fatal(err)
+	}
+	referenceVaultSecrets(document, v.plains())
+	data, err := yaml.Marshal(document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "port: 443") || !strings.Contains(string(data), `password: "{{ vault \"port\" }}"`) {
+		t.Fatalf("references of\n%s", data)
+	}
+}
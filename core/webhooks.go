@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/log"
+	"golang.org/x/time/rate"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTriggerInterval = 10 * time.Second
+	defaultTriggerTimeout  = 10 * time.Second
+	maxTriggerTimeout      = time.Minute
+	maxRunningTriggers     = 4
+	triggerOutputLimit     = 4096
+)
+
+type TriggerEvent string
+
+const (
+	CoreStartedTriggerEvent          TriggerEvent = "core-started"
+	ProxyChangedTriggerEvent         TriggerEvent = "proxy-changed"
+	QuotaExceededTriggerEvent        TriggerEvent = "quota-exceeded"
+	ProviderUpdateFailedTriggerEvent TriggerEvent = "provider-update-failed"
+)
+
+// triggerEventOf names the message for the triggers, any other message is matched by its type
+func triggerEventOf(message Message) TriggerEvent {
+	switch message.Type {
+	case StartupMessage:
+		if event, ok := message.Data.(*StartupEvent); ok && event.Stage == ConfigStartupStage {
+			return CoreStartedTriggerEvent
+		}
+		return ""
+	case ProxyChangedMessage:
+		return ProxyChangedTriggerEvent
+	case QuotaMessage:
+		if event, ok := message.Data.(QuotaEvent); ok && event.State == ExceededQuotaEvent {
+			return QuotaExceededTriggerEvent
+		}
+		return ""
+	case RuleProviderUpdateMessage:
+		if update, ok := message.Data.(RuleProviderUpdate); ok && update.Error != "" {
+			return ProviderUpdateFailedTriggerEvent
+		}
+		return ""
+	case LogMessage, DnsMessage, EventMessage, DelayMessage, RequestMessage, ConnectionsMessage:
+		return ""
+	}
+	return TriggerEvent(message.Type)
+}
+
+// TriggerParams posts the event to Url or runs Command with the event as json on stdin, Interval
+// is the seconds at least between two runs and a burst inside it is dropped
+type TriggerParams struct {
+	Id       string            `json:"id"`
+	Events   []TriggerEvent    `json:"events"`
+	Url      string            `json:"url"`
+	Method   string            `json:"method"`
+	Headers  map[string]string `json:"headers"`
+	Command  []string          `json:"command"`
+	Interval int64             `json:"interval"`
+	Timeout  int64             `json:"timeout"`
+}
+
+type TriggerPayload struct {
+	Event TriggerEvent `json:"event"`
+	Type  MessageType  `json:"type"`
+	Time  int64        `json:"time"`
+	Data  any          `json:"data"`
+}
+
+type TriggerStatus struct {
+	TriggerParams
+	Fired     int64  `json:"fired"`
+	Dropped   int64  `json:"dropped"`
+	Failures  int64  `json:"failures"`
+	LastFire  int64  `json:"last-fire,omitempty"`
+	LastError string `json:"last-error,omitempty"`
+}
+
+type trigger struct {
+	params  TriggerParams
+	events  map[TriggerEvent]struct{}
+	limiter *rate.Limiter
+	status  TriggerStatus
+}
+
+// Triggers run the webhooks and commands of the user on core events, a slow endpoint never holds
+// back the message it was fired by
+type Triggers struct {
+	mutex    sync.Mutex
+	triggers map[string]*trigger
+	running  chan struct{}
+}
+
+var triggers = &Triggers{
+	triggers: map[string]*trigger{},
+	running:  make(chan struct{}, maxRunningTriggers),
+}
+
+func (p *TriggerParams) interval() time.Duration {
+	if p.Interval <= 0 {
+		return defaultTriggerInterval
+	}
+	return time.Duration(p.Interval) * time.Second
+}
+
+func (p *TriggerParams) timeout() time.Duration {
+	timeout := time.Duration(p.Timeout) * time.Second
+	if timeout <= 0 {
+		return defaultTriggerTimeout
+	}
+	if timeout > maxTriggerTimeout {
+		return maxTriggerTimeout
+	}
+	return timeout
+}
+
+// Set adds or replaces a trigger, allowCommand is only given to the app, a command runs with the
+// rights of the core
+func (t *Triggers) Set(params *TriggerParams, allowCommand bool) error {
+	if params.Id == "" {
+		return errors.New("id is required")
+	}
+	if len(params.Events) == 0 {
+		return errors.New("events are required")
+	}
+	if (params.Url == "") == (len(params.Command) == 0) {
+		return errors.New("either url or command is required")
+	}
+	if len(params.Command) != 0 && !allowCommand {
+		return errors.New("command triggers can only be set by the app")
+	}
+	if params.Url != "" {
+		target, err := url.Parse(params.Url)
+		if err != nil {
+			return err
+		}
+		if target.Scheme != "http" && target.Scheme != "https" {
+			return fmt.Errorf("unsupported scheme %s", target.Scheme)
+		}
+		if params.Method == "" {
+			params.Method = http.MethodPost
+		}
+	}
+	item := &trigger{
+		params:  *params,
+		events:  map[TriggerEvent]struct{}{},
+		limiter: rate.NewLimiter(rate.Every(params.interval()), 1),
+	}
+	for _, event := range params.Events {
+		item.events[event] = struct{}{}
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if previous, ok := t.triggers[params.Id]; ok {
+		item.status = previous.status
+	}
+	item.status.TriggerParams = item.params
+	t.triggers[params.Id] = item
+	return nil
+}
+
+func (t *Triggers) Remove(id string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.triggers[id]; !ok {
+		return false
+	}
+	delete(t.triggers, id)
+	return true
+}
+
+// Publish is called for every message, the payload is only built when a trigger wants it
+func (t *Triggers) Publish(message Message) {
+	t.mutex.Lock()
+	if len(t.triggers) == 0 {
+		t.mutex.Unlock()
+		return
+	}
+	event := triggerEventOf(message)
+	if event == "" {
+		t.mutex.Unlock()
+		return
+	}
+	var fired []*trigger
+	for _, item := range t.triggers {
+		if _, ok := item.events[event]; !ok {
+			continue
+		}
+		if !item.limiter.Allow() {
+			item.status.Dropped++
+			continue
+		}
+		item.status.Fired++
+		item.status.LastFire = time.Now().UnixMilli()
+		fired = append(fired, item)
+	}
+	t.mutex.Unlock()
+	if len(fired) == 0 {
+		return
+	}
+	payload, err := json.Marshal(&TriggerPayload{
+		Event: event,
+		Type:  message.Type,
+		Time:  time.Now().UnixMilli(),
+		Data:  message.Data,
+	})
+	if err != nil {
+		return
+	}
+	for _, item := range fired {
+		go t.run(item, event, payload)
+	}
+}
+
+func (t *Triggers) run(item *trigger, event TriggerEvent, payload []byte) {
+	t.running <- struct{}{}
+	defer func() {
+		<-t.running
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), item.params.timeout())
+	defer cancel()
+	var err error
+	if item.params.Url != "" {
+		err = postTrigger(ctx, &item.params, payload)
+	} else {
+		err = runTriggerCommand(ctx, &item.params, event, payload)
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if err != nil {
+		log.Warnln("[Trigger] %s on %s error: %v", item.params.Id, event, err)
+		item.status.Failures++
+		item.status.LastError = err.Error()
+		return
+	}
+	item.status.LastError = ""
+}
+
+func postTrigger(ctx context.Context, params *TriggerParams, payload []byte) error {
+	request, err := http.NewRequestWithContext(ctx, params.Method, params.Url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "FlClash")
+	for key, value := range params.Headers {
+		request.Header.Set(key, value)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, triggerOutputLimit))
+	if response.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("status %s", response.Status)
+	}
+	return nil
+}
+
+func runTriggerCommand(ctx context.Context, params *TriggerParams, event TriggerEvent, payload []byte) error {
+	command := exec.CommandContext(ctx, params.Command[0], params.Command[1:]...)
+	command.Stdin = bytes.NewReader(payload)
+	command.Env = append(os.Environ(), "FLCLASH_EVENT="+string(event))
+	output, err := command.CombinedOutput()
+	if err != nil {
+		if len(output) > triggerOutputLimit {
+			output = output[:triggerOutputLimit]
+		}
+		if len(output) > 0 {
+			return fmt.Errorf("%v: %s", err, bytes.TrimSpace(output))
+		}
+		return err
+	}
+	return nil
+}
+
+func (t *Triggers) Status() []TriggerStatus {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	list := make([]TriggerStatus, 0, len(t.triggers))
+	for _, item := range t.triggers {
+		list = append(list, item.status)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id < list[j].Id
+	})
+	return list
+}
+
+// Test fires a trigger at once with a test event, the rate limit is left alone
+func (t *Triggers) Test(id string) error {
+	t.mutex.Lock()
+	item, ok := t.triggers[id]
+	t.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("trigger %s not found", id)
+	}
+	payload, err := json.Marshal(&TriggerPayload{
+		Event: "test",
+		Time:  time.Now().UnixMilli(),
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), item.params.timeout())
+	defer cancel()
+	if item.params.Url != "" {
+		return postTrigger(ctx, &item.params, payload)
+	}
+	return runTriggerCommand(ctx, &item.params, "test", payload)
+}
+
+func handleSetTrigger(paramsString string, allowCommand bool) error {
+	params := &TriggerParams{}
+	if err := json.Unmarshal([]byte(paramsString), params); err != nil {
+		return err
+	}
+	return triggers.Set(params, allowCommand)
+}
+
+func handleRemoveTrigger(id string) bool {
+	return triggers.Remove(id)
+}
+
+func handleGetTriggers() string {
+	data, err := json.Marshal(triggers.Status())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func handleTestTrigger(id string) error {
+	return triggers.Test(id)
+}
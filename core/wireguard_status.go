@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/metacubex/mihomo/adapter"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/tunnel"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WireGuardPeerStatus is the runtime state of one peer, keys are base64 as in profiles
+type WireGuardPeerStatus struct {
+	PublicKey     string   `json:"public-key"`
+	Endpoint      string   `json:"endpoint"`
+	Handshaked    bool     `json:"handshaked"`
+	LastHandshake int64    `json:"last-handshake"`
+	HandshakeAge  int64    `json:"handshake-age"`
+	TxBytes       int64    `json:"tx-bytes"`
+	RxBytes       int64    `json:"rx-bytes"`
+	AllowedIPs    []string `json:"allowed-ips"`
+}
+
+type WireGuardStatus struct {
+	Name string `json:"name"`
+	// Started is false until the first connection initializes the device
+	Started bool                  `json:"started"`
+	Peers   []WireGuardPeerStatus `json:"peers"`
+}
+
+// wireGuardDevice is implemented by wireguard adapters that expose the device UAPI
+type wireGuardDevice interface {
+	IpcGet() (string, error)
+}
+
+// GetWireGuardStatus reads the handshake state of a wireguard proxy
+func GetWireGuardStatus(name string) (*WireGuardStatus, error) {
+	proxy, ok := tunnel.ProxiesWithProviders()[name].(*adapter.Proxy)
+	if !ok {
+		return nil, fmt.Errorf("proxy %s not found", name)
+	}
+	if proxy.Type() != constant.WireGuard {
+		return nil, fmt.Errorf("proxy %s is not a wireguard proxy", name)
+	}
+	status := &WireGuardStatus{
+		Name:  name,
+		Peers: []WireGuardPeerStatus{},
+	}
+	device, ok := proxy.ProxyAdapter.(wireGuardDevice)
+	if !ok {
+		return nil, errors.New("wireguard status is not supported by this core")
+	}
+	uapi, err := device.IpcGet()
+	if err != nil {
+		// the device is created lazily by the first dial
+		return status, nil
+	}
+	status.Started = true
+	status.Peers = parseWireGuardUapi(uapi, time.Now())
+	return status, nil
+}
+
+// parseWireGuardUapi parses the peer sections of a UAPI get response, device keys are skipped
+func parseWireGuardUapi(uapi string, now time.Time) []WireGuardPeerStatus {
+	peers := []WireGuardPeerStatus{}
+	var peer *WireGuardPeerStatus
+	var handshakeSec, handshakeNsec int64
+	finish := func() {
+		if peer == nil {
+			return
+		}
+		if handshakeSec != 0 || handshakeNsec != 0 {
+			last := time.Unix(handshakeSec, handshakeNsec)
+			peer.Handshaked = true
+			peer.LastHandshake = last.UnixMilli()
+			peer.HandshakeAge = now.Sub(last).Milliseconds()
+		}
+		peers = append(peers, *peer)
+	}
+	scanner := bufio.NewScanner(strings.NewReader(uapi))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		if key == "public_key" {
+			finish()
+			peer = &WireGuardPeerStatus{AllowedIPs: []string{}}
+			handshakeSec, handshakeNsec = 0, 0
+			if raw, err := hex.DecodeString(value); err == nil {
+				peer.PublicKey = base64.StdEncoding.EncodeToString(raw)
+			}
+			continue
+		}
+		if peer == nil {
+			continue
+		}
+		switch key {
+		case "endpoint":
+			peer.Endpoint = value
+		case "last_handshake_time_sec":
+			handshakeSec, _ = strconv.ParseInt(value, 10, 64)
+		case "last_handshake_time_nsec":
+			handshakeNsec, _ = strconv.ParseInt(value, 10, 64)
+		case "tx_bytes":
+			peer.TxBytes, _ = strconv.ParseInt(value, 10, 64)
+		case "rx_bytes":
+			peer.RxBytes, _ = strconv.ParseInt(value, 10, 64)
+		case "allowed_ip":
+			peer.AllowedIPs = append(peer.AllowedIPs, value)
+		}
+	}
+	finish()
+	return peers
+}
+
+func handleGetWireGuardStatus(name string) (string, error) {
+	status, err := GetWireGuardStatus(name)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}